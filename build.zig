@@ -8,6 +8,15 @@ pub fn build(b: *std.Build) void {
     const httpz = b.dependency("httpz", .{ .target = target, .optimize = optimize });
     const zig_yaml = b.dependency("zig-yaml", .{ .target = target, .optimize = optimize });
 
+    // Library module, for embedding a mock server in another project's tests
+    const popshop_module = b.addModule("popshop", .{
+        .root_source_file = b.path("src/main.zig"),
+        .target = target,
+        .optimize = optimize,
+    });
+    popshop_module.addImport("httpz", httpz.module("httpz"));
+    popshop_module.addImport("yaml", zig_yaml.module("yaml"));
+
     // Main executable
     const exe = b.addExecutable(.{
         .name = "popshop",
@@ -0,0 +1,579 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+const app = @import("app.zig");
+const readiness = @import("readiness.zig");
+
+const Server = interfaces.Server;
+const ServerConfig = interfaces.ServerConfig;
+const Request = interfaces.Request;
+const Response = interfaces.Response;
+const PopshopApp = app.PopshopApp;
+const Rule = @import("config.zig").Rule;
+
+/// Prefix shared by every admin endpoint
+pub const prefix = "/__popshop";
+
+/// Global app instance for the admin handler, mirroring the main handler
+var admin_app: ?*PopshopApp = null;
+
+/// Introspection API served on its own listener (`admin_port:`), so it can
+/// never shadow or be shadowed by user-defined routes.
+pub const AdminServer = struct {
+    server: Server,
+    app: *PopshopApp,
+
+    pub fn init(server: Server, popshop_app: *PopshopApp) AdminServer {
+        return AdminServer{ .server = server, .app = popshop_app };
+    }
+
+    /// Serve until `stop` is called
+    pub fn start(self: *AdminServer, server_config: ServerConfig) !void {
+        admin_app = self.app;
+        defer admin_app = null;
+
+        try self.server.addRoute(.GET, "/*", handleRequest);
+        try self.server.addRoute(.POST, "/*", handleRequest);
+
+        std.log.info("Admin API listening on {s}:{d}{s}", .{ server_config.host, server_config.port, prefix });
+        try self.server.start(server_config);
+    }
+
+    /// Thread entry point; failures are logged since there is no caller to return them to
+    pub fn run(self: *AdminServer, server_config: ServerConfig) void {
+        self.start(server_config) catch |err| {
+            std.log.err("Admin server failed: {}", .{err});
+        };
+    }
+
+    pub fn stop(self: *AdminServer) !void {
+        try self.server.stop();
+    }
+
+    fn handleRequest(request: *Request) !Response {
+        const popshop_app = admin_app orelse {
+            std.log.err("App instance not available in admin handler", .{});
+            var response = Response.init(request.arena, .internal_server_error);
+            response.setBody("Server configuration error");
+            return response;
+        };
+        return handleAdminRequest(popshop_app, request);
+    }
+};
+
+/// Dispatch an admin request. Endpoints:
+/// - `GET /__popshop/routes` the loaded route table as JSON
+/// - `GET /__popshop/stats`  hit counts per route and for unmatched requests
+/// - `GET /__popshop/metrics` request counts and latencies for Prometheus
+/// - `GET /__popshop/ready`  503 until the config's `startup_delay` has passed, then 200
+/// - `GET /__popshop/healthz` 200 while the loaded config is current, 503 after a refused reload
+/// - `GET /__popshop/store`  what templates saved with `store`, as a JSON object
+/// - `POST /__popshop/reset` zero the hit counts
+/// - `POST /__popshop/store/clear` forget every stored value
+/// - `POST /__popshop/reload` re-read the config files, keeping the current
+///   config when the new one is invalid
+pub fn handleAdminRequest(popshop_app: *PopshopApp, request: *Request) !Response {
+    const path = std.mem.trimRight(u8, request.path, "/");
+    if (request.method == .GET and std.mem.eql(u8, path, prefix ++ "/routes")) {
+        return routesResponse(popshop_app, request);
+    }
+    if (request.method == .GET and std.mem.eql(u8, path, prefix ++ "/stats")) {
+        return statsResponse(popshop_app, request);
+    }
+    if (request.method == .GET and std.mem.eql(u8, path, prefix ++ "/metrics")) {
+        return metricsResponse(popshop_app, request);
+    }
+    if (request.method == .GET and std.mem.eql(u8, path, prefix ++ "/healthz")) {
+        return healthResponse(popshop_app, request);
+    }
+    if (readiness.matches(request)) {
+        popshop_app.config_lock.lockShared();
+        defer popshop_app.config_lock.unlockShared();
+        return readiness.respond(request, popshop_app.warmupRemainingMs());
+    }
+    if (request.method == .POST and std.mem.eql(u8, path, prefix ++ "/reset")) {
+        popshop_app.resetHits();
+        return Response.init(request.arena, .no_content);
+    }
+    if (request.method == .GET and std.mem.eql(u8, path, prefix ++ "/store")) {
+        var body = std.ArrayList(u8).init(request.arena);
+        try popshop_app.kv_store.writeJson(body.writer());
+        var response = Response.init(request.arena, .ok);
+        try response.setJsonBody(body.items);
+        return response;
+    }
+    if (request.method == .POST and std.mem.eql(u8, path, prefix ++ "/store/clear")) {
+        popshop_app.kv_store.clear();
+        return Response.init(request.arena, .no_content);
+    }
+    if (request.method == .POST and std.mem.eql(u8, path, prefix ++ "/reload")) {
+        return reloadResponse(popshop_app, request);
+    }
+
+    var response = Response.init(request.arena, .not_found);
+    response.setBody("Unknown admin endpoint");
+    return response;
+}
+
+/// The route table in load order; `index` is the number the access log
+/// reports as `route`. The snapshot is taken under the config lock, so it
+/// reflects a single version of a hot-reloaded config.
+fn routesResponse(popshop_app: *PopshopApp, request: *Request) !Response {
+    popshop_app.config_lock.lockShared();
+    defer popshop_app.config_lock.unlockShared();
+    const app_config = &popshop_app.config;
+
+    var body = std.ArrayList(u8).init(request.arena);
+    var json = std.json.writeStream(body.writer(), .{ .whitespace = .indent_2 });
+    defer json.deinit();
+
+    try json.beginObject();
+    try json.objectField("routes");
+    try json.beginArray();
+    for (app_config.rules.items, 0..) |*rule, index| {
+        try json.beginObject();
+        try writeRouteIdentity(&json, rule, index);
+        if (rule.description) |description| {
+            try json.objectField("description");
+            try json.write(description);
+        }
+        try json.objectField("priority");
+        try json.write(rule.priority);
+        if (rule.max_matches) |limit| {
+            try json.objectField("max_matches");
+            try json.write(limit);
+        }
+
+        if (rule.isMock()) {
+            try json.objectField("type");
+            try json.write("mock");
+            if (rule.sequence) |sequence| {
+                try json.objectField("responses");
+                try json.write(sequence.responses.len);
+            } else if (rule.weighted) |weighted| {
+                try json.objectField("responses");
+                try json.write(weighted.responses.len);
+                try json.objectField("weighted");
+                try json.write(true);
+            } else if (rule.schedule) |schedule| {
+                try json.objectField("responses");
+                try json.write(schedule.phases.len);
+                try json.objectField("scheduled");
+                try json.write(true);
+            } else {
+                try json.objectField("status");
+                try json.write(rule.response.?.status);
+            }
+        } else if (rule.proxy) |proxy_config| {
+            try json.objectField("type");
+            try json.write("proxy");
+            if (proxy_config.upstreams) |upstreams| {
+                try json.objectField("upstreams");
+                try json.beginArray();
+                for (upstreams) |upstream| try json.write(.{ .url = upstream.url, .weight = upstream.weight });
+                try json.endArray();
+            } else {
+                try json.objectField("upstream");
+                try json.write(proxy_config.url);
+            }
+        } else if (rule.static) |static| {
+            try json.objectField("type");
+            try json.write("static");
+            try json.objectField("dir");
+            try json.write(static.dir);
+        }
+        try json.endObject();
+    }
+    try json.endArray();
+    try json.objectField("default_response");
+    try json.write(app_config.default_response != null);
+    try json.endObject();
+
+    var response = Response.init(request.arena, .ok);
+    try response.setHeader("Content-Type", "application/json");
+    response.setBody(body.items);
+    return response;
+}
+
+/// Hit counts in load order. Counters restart from zero when the config is reloaded.
+fn statsResponse(popshop_app: *PopshopApp, request: *Request) !Response {
+    popshop_app.config_lock.lockShared();
+    defer popshop_app.config_lock.unlockShared();
+
+    var body = std.ArrayList(u8).init(request.arena);
+    var json = std.json.writeStream(body.writer(), .{ .whitespace = .indent_2 });
+    defer json.deinit();
+
+    try json.beginObject();
+    try json.objectField("routes");
+    try json.beginArray();
+    for (popshop_app.config.rules.items, 0..) |*rule, index| {
+        try json.beginObject();
+        try writeRouteIdentity(&json, rule, index);
+        try json.objectField("hits");
+        try json.write(rule.hits.load(.monotonic));
+        try json.endObject();
+    }
+    try json.endArray();
+    try json.objectField("unmatched");
+    try json.write(popshop_app.unmatched_hits.load(.monotonic));
+    try json.endObject();
+
+    var response = Response.init(request.arena, .ok);
+    try response.setHeader("Content-Type", "application/json");
+    response.setBody(body.items);
+    return response;
+}
+
+/// `{"status":"ok","routes":3}`, or `"degraded"` with a 503 when the last
+/// reload was refused and the routes are those of an older config
+fn healthResponse(popshop_app: *PopshopApp, request: *Request) !Response {
+    popshop_app.config_lock.lockShared();
+    defer popshop_app.config_lock.unlockShared();
+
+    const degraded = popshop_app.reload_failed.load(.monotonic);
+    var response = Response.init(request.arena, if (degraded) .service_unavailable else .ok);
+    const body = try std.json.stringifyAlloc(request.arena, .{
+        .status = if (degraded) "degraded" else "ok",
+        .routes = popshop_app.config.rules.items.len,
+    }, .{});
+    try response.setJsonBody(body);
+    return response;
+}
+
+/// `{"reloaded":true,"routes":3}`, or a 400 listing why the new config was refused
+fn reloadResponse(popshop_app: *PopshopApp, request: *Request) !Response {
+    const config_path = popshop_app.config_path orelse {
+        var response = Response.init(request.arena, .conflict);
+        try response.setJsonBody("{\"reloaded\":false,\"errors\":[\"no config file to reload\"]}");
+        return response;
+    };
+
+    var response = Response.init(request.arena, .ok);
+    const body = switch (try popshop_app.reloadConfigChecked(request.arena, config_path)) {
+        .reloaded => |routes| try std.json.stringifyAlloc(request.arena, .{ .reloaded = true, .routes = routes }, .{}),
+        .rejected => |messages| blk: {
+            std.log.warn("Reload requested over the admin API was refused, keeping the previous config:", .{});
+            for (messages) |message| {
+                std.log.warn("  - {s}", .{message});
+            }
+            response.status = .bad_request;
+            break :blk try std.json.stringifyAlloc(request.arena, .{ .reloaded = false, .errors = messages }, .{});
+        },
+    };
+    try response.setJsonBody(body);
+    return response;
+}
+
+/// Prometheus text exposition of `PopshopApp.metrics`
+fn metricsResponse(popshop_app: *PopshopApp, request: *Request) !Response {
+    var body = std.ArrayList(u8).init(request.arena);
+    try popshop_app.metrics.write(request.arena, body.writer());
+
+    var response = Response.init(request.arena, .ok);
+    try response.setHeader("Content-Type", "text/plain; version=0.0.4; charset=utf-8");
+    response.setBody(body.items);
+    return response;
+}
+
+/// Fields that identify a route: `index`, `name` when it has one, `path`,
+/// `path_regex` or `path_prefix`, `path_segments` when set, and `methods`
+fn writeRouteIdentity(json: anytype, rule: *const Rule, index: usize) !void {
+    try json.objectField("index");
+    try json.write(index);
+    if (rule.name) |name| {
+        try json.objectField("name");
+        try json.write(name);
+    }
+    if (rule.request.path_regex) |pattern| {
+        try json.objectField("path_regex");
+        try json.write(pattern);
+    } else if (rule.request.path_prefix) |prefix| {
+        try json.objectField("path_prefix");
+        try json.write(prefix);
+    } else {
+        try json.objectField("path");
+        try json.write(rule.request.path);
+    }
+    if (rule.request.path_segments) |segments| {
+        try json.objectField("path_segments");
+        try json.write(segments);
+    }
+    try json.objectField("methods");
+    try json.write(rule.request.methods);
+}
+
+test "handleAdminRequest lists routes" {
+    const config = @import("config.zig");
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    const yaml_content =
+        \\- name: "create or list users"
+        \\  description: "Shared by the signup and admin flows"
+        \\  request:
+        \\    path: "/api/users"
+        \\    methods: [get, post]
+        \\  response:
+        \\    status: 201
+        \\- request:
+        \\    path_regex: "/files/.*"
+        \\    method: "GET"
+        \\  proxy:
+        \\    url: "https://example.com/files"
+    ;
+
+    // The admin handler never touches the main server
+    var popshop_app = PopshopApp.init(allocator, undefined, try config.Config.loadFromYaml(allocator, yaml_content));
+    defer popshop_app.deinit();
+
+    var request = testRequest(arena.allocator(), .GET, "/__popshop/routes");
+    const response = try handleAdminRequest(&popshop_app, &request);
+    try std.testing.expectEqual(interfaces.Status.ok, response.status);
+
+    const parsed = try std.json.parseFromSliceLeaky(std.json.Value, arena.allocator(), response.body, .{});
+    const routes = parsed.object.get("routes").?.array.items;
+    try std.testing.expectEqual(@as(usize, 2), routes.len);
+
+    try std.testing.expectEqualStrings("/api/users", routes[0].object.get("path").?.string);
+    try std.testing.expectEqualStrings("create or list users", routes[0].object.get("name").?.string);
+    try std.testing.expectEqualStrings("Shared by the signup and admin flows", routes[0].object.get("description").?.string);
+    try std.testing.expect(routes[1].object.get("name") == null);
+    try std.testing.expectEqualStrings("POST", routes[0].object.get("methods").?.array.items[1].string);
+    try std.testing.expectEqualStrings("mock", routes[0].object.get("type").?.string);
+    try std.testing.expectEqual(@as(i64, 201), routes[0].object.get("status").?.integer);
+
+    try std.testing.expectEqual(@as(i64, 1), routes[1].object.get("index").?.integer);
+    try std.testing.expectEqualStrings("/files/.*", routes[1].object.get("path_regex").?.string);
+    try std.testing.expectEqualStrings("proxy", routes[1].object.get("type").?.string);
+    try std.testing.expectEqualStrings("https://example.com/files", routes[1].object.get("upstream").?.string);
+    try std.testing.expect(!parsed.object.get("default_response").?.bool);
+
+    request.path = "/api/users";
+    try std.testing.expectEqual(interfaces.Status.not_found, (try handleAdminRequest(&popshop_app, &request)).status);
+}
+
+test "handleAdminRequest counts hits" {
+    const config = @import("config.zig");
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/users"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "[]"
+        \\- request:
+        \\    path: "/api/orders"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "[]"
+    ;
+
+    // The admin handler never touches the main server
+    var popshop_app = PopshopApp.init(allocator, undefined, try config.Config.loadFromYaml(allocator, yaml_content));
+    defer popshop_app.deinit();
+
+    const paths = [_][]const u8{ "/api/users", "/api/users", "/api/missing" };
+    for (paths) |path| {
+        var request = testRequest(arena.allocator(), .GET, path);
+        _ = try popshop_app.handleRequestWithContext(&request);
+    }
+
+    var stats_request = testRequest(arena.allocator(), .GET, "/__popshop/stats");
+    var stats = try std.json.parseFromSliceLeaky(std.json.Value, arena.allocator(), (try handleAdminRequest(&popshop_app, &stats_request)).body, .{});
+    var routes = stats.object.get("routes").?.array.items;
+    try std.testing.expectEqual(@as(i64, 2), routes[0].object.get("hits").?.integer);
+    try std.testing.expectEqual(@as(i64, 0), routes[1].object.get("hits").?.integer);
+    try std.testing.expectEqual(@as(i64, 1), stats.object.get("unmatched").?.integer);
+
+    var reset_request = testRequest(arena.allocator(), .POST, "/__popshop/reset");
+    try std.testing.expectEqual(interfaces.Status.no_content, (try handleAdminRequest(&popshop_app, &reset_request)).status);
+
+    stats = try std.json.parseFromSliceLeaky(std.json.Value, arena.allocator(), (try handleAdminRequest(&popshop_app, &stats_request)).body, .{});
+    routes = stats.object.get("routes").?.array.items;
+    try std.testing.expectEqual(@as(i64, 0), routes[0].object.get("hits").?.integer);
+    try std.testing.expectEqual(@as(i64, 0), stats.object.get("unmatched").?.integer);
+}
+
+test "handleAdminRequest shows and clears the store" {
+    const config = @import("config.zig");
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/users/:id"
+        \\    method: "PUT"
+        \\  response:
+        \\    body: "{{store .Params.id .Body}}"
+    ;
+
+    // The admin handler never touches the main server
+    var popshop_app = PopshopApp.init(allocator, undefined, try config.Config.loadFromYaml(allocator, yaml_content));
+    defer popshop_app.deinit();
+
+    var put_request = testRequest(arena.allocator(), .PUT, "/api/users/7");
+    put_request.body = "{\"name\":\"Ada\"}";
+    _ = try popshop_app.handleRequestWithContext(&put_request);
+
+    var store_request = testRequest(arena.allocator(), .GET, "/__popshop/store");
+    var listed = try std.json.parseFromSliceLeaky(std.json.Value, arena.allocator(), (try handleAdminRequest(&popshop_app, &store_request)).body, .{});
+    try std.testing.expectEqualStrings("{\"name\":\"Ada\"}", listed.object.get("7").?.string);
+
+    var clear_request = testRequest(arena.allocator(), .POST, "/__popshop/store/clear");
+    try std.testing.expectEqual(interfaces.Status.no_content, (try handleAdminRequest(&popshop_app, &clear_request)).status);
+    listed = try std.json.parseFromSliceLeaky(std.json.Value, arena.allocator(), (try handleAdminRequest(&popshop_app, &store_request)).body, .{});
+    try std.testing.expectEqual(@as(usize, 0), listed.object.count());
+}
+
+test "handleAdminRequest serves metrics" {
+    const config = @import("config.zig");
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/users/:id"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "{}"
+    ;
+
+    // The admin handler never touches the main server
+    var popshop_app = PopshopApp.init(allocator, undefined, try config.Config.loadFromYaml(allocator, yaml_content));
+    defer popshop_app.deinit();
+
+    const paths = [_][]const u8{ "/api/users/1", "/api/users/2", "/api/missing" };
+    for (paths) |path| {
+        var request = testRequest(arena.allocator(), .GET, path);
+        _ = try popshop_app.handleRequestWithContext(&request);
+    }
+
+    var metrics_request = testRequest(arena.allocator(), .GET, "/__popshop/metrics");
+    const response = try handleAdminRequest(&popshop_app, &metrics_request);
+    try std.testing.expectEqual(interfaces.Status.ok, response.status);
+    try std.testing.expect(std.mem.startsWith(u8, response.getHeader("Content-Type").?, "text/plain; version=0.0.4"));
+
+    const expected_lines = [_][]const u8{
+        "popshop_requests_total{route=\"/api/users/:id\",method=\"GET\",status=\"200\"} 2\n",
+        "popshop_requests_total{route=\"unmatched\",method=\"GET\",status=\"404\"} 1\n",
+        "popshop_request_duration_seconds_count{route=\"/api/users/:id\",method=\"GET\"} 2\n",
+        "popshop_request_duration_seconds_bucket{route=\"unmatched\",method=\"GET\",le=\"+Inf\"} 1\n",
+    };
+    for (expected_lines) |line| {
+        try std.testing.expect(std.mem.indexOf(u8, response.body, line) != null);
+    }
+}
+
+test "handleAdminRequest reloads the config" {
+    const config = @import("config.zig");
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    try tmp.dir.writeFile(.{ .sub_path = "config.yaml", .data =
+        \\- request:
+        \\    path: "/one"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "one"
+    });
+    const path = try tmp.dir.realpathAlloc(allocator, "config.yaml");
+    defer allocator.free(path);
+
+    var popshop_app = PopshopApp.init(allocator, undefined, try config.Config.loadFromFile(allocator, path));
+    defer popshop_app.deinit();
+
+    var reload_request = testRequest(arena.allocator(), .POST, "/__popshop/reload");
+    try std.testing.expectEqual(interfaces.Status.conflict, (try handleAdminRequest(&popshop_app, &reload_request)).status);
+    popshop_app.config_path = path;
+
+    try tmp.dir.writeFile(.{ .sub_path = "config.yaml", .data =
+        \\- request:
+        \\    path: "/one"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "one"
+        \\- request:
+        \\    path: "/two"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "two"
+    });
+    const reloaded = try handleAdminRequest(&popshop_app, &reload_request);
+    try std.testing.expectEqual(interfaces.Status.ok, reloaded.status);
+    try std.testing.expectEqualStrings("{\"reloaded\":true,\"routes\":2}", reloaded.body);
+
+    // An invalid config is refused and the previous one keeps serving
+    try tmp.dir.writeFile(.{ .sub_path = "config.yaml", .data =
+        \\- request:
+        \\    path: "/broken"
+        \\    method: "GET"
+        \\  response:
+        \\    status: 700
+    });
+    const refused = try handleAdminRequest(&popshop_app, &reload_request);
+    try std.testing.expectEqual(interfaces.Status.bad_request, refused.status);
+    const report = try std.json.parseFromSliceLeaky(std.json.Value, arena.allocator(), refused.body, .{});
+    try std.testing.expect(!report.object.get("reloaded").?.bool);
+    try std.testing.expectEqualStrings("rule 1 (/broken): status 700 is outside 100-599", report.object.get("errors").?.array.items[0].string);
+    try std.testing.expectEqual(@as(usize, 2), popshop_app.getStats().rules_count);
+}
+
+test "handleAdminRequest reports health" {
+    const config = @import("config.zig");
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    try tmp.dir.writeFile(.{ .sub_path = "config.yaml", .data =
+        \\- request:
+        \\    path: "/one"
+        \\  response:
+        \\    body: "one"
+    });
+    const path = try tmp.dir.realpathAlloc(allocator, "config.yaml");
+    defer allocator.free(path);
+
+    var popshop_app = PopshopApp.init(allocator, undefined, try config.Config.loadFromFile(allocator, path));
+    defer popshop_app.deinit();
+    popshop_app.config_path = path;
+
+    var health_request = testRequest(arena.allocator(), .GET, "/__popshop/healthz");
+    const healthy = try handleAdminRequest(&popshop_app, &health_request);
+    try std.testing.expectEqual(interfaces.Status.ok, healthy.status);
+    try std.testing.expectEqualStrings("{\"status\":\"ok\",\"routes\":1}", healthy.body);
+
+    // A refused reload leaves the old routes serving, but unhealthy
+    try tmp.dir.writeFile(.{ .sub_path = "config.yaml", .data = "- request:\n    path: \"/one\"\n  response:\n    status: 700\n" });
+    var reload_request = testRequest(arena.allocator(), .POST, "/__popshop/reload");
+    try std.testing.expectEqual(interfaces.Status.bad_request, (try handleAdminRequest(&popshop_app, &reload_request)).status);
+    const degraded = try handleAdminRequest(&popshop_app, &health_request);
+    try std.testing.expectEqual(interfaces.Status.service_unavailable, degraded.status);
+    try std.testing.expectEqualStrings("{\"status\":\"degraded\",\"routes\":1}", degraded.body);
+
+    // Fixing the config and reloading recovers
+    try tmp.dir.writeFile(.{ .sub_path = "config.yaml", .data = "- request:\n    path: \"/one\"\n  response:\n    status: 200\n" });
+    try std.testing.expectEqual(interfaces.Status.ok, (try handleAdminRequest(&popshop_app, &reload_request)).status);
+    try std.testing.expectEqual(interfaces.Status.ok, (try handleAdminRequest(&popshop_app, &health_request)).status);
+}
+
+fn testRequest(arena: std.mem.Allocator, method: interfaces.Method, path: []const u8) Request {
+    return Request{
+        .method = method,
+        .path = path,
+        .query = "",
+        .headers = interfaces.HeaderMap.init(arena),
+        .body = "",
+        .arena = arena,
+    };
+}
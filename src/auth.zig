@@ -0,0 +1,98 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+const config = @import("config.zig");
+
+const Request = interfaces.Request;
+const Response = interfaces.Response;
+const HeaderMap = interfaces.HeaderMap;
+const BasicAuth = config.BasicAuth;
+
+const Sha256 = std.crypto.hash.sha2.Sha256;
+const base64 = std.base64.standard.Decoder;
+
+/// Realm used in the challenge when the rule doesn't name one
+pub const default_realm = "popshop";
+
+/// Whether the request carries the rule's Basic credentials. Both parts are
+/// compared as SHA-256 digests in constant time, so neither a wrong length
+/// nor an early mismatch shows up in the response time.
+pub fn isAuthorized(auth: *const BasicAuth, request: *const Request) bool {
+    const header = request.getHeader("Authorization") orelse return false;
+    const trimmed = std.mem.trim(u8, header, " \t");
+    const scheme_end = std.mem.indexOfScalar(u8, trimmed, ' ') orelse return false;
+    if (!std.ascii.eqlIgnoreCase(trimmed[0..scheme_end], "Basic")) return false;
+    const encoded = std.mem.trim(u8, trimmed[scheme_end + 1 ..], " \t");
+
+    // Credentials longer than this can't be the configured ones anyway
+    var buffer: [1024]u8 = undefined;
+    const decoded_len = base64.calcSizeForSlice(encoded) catch return false;
+    if (decoded_len > buffer.len) return false;
+    base64.decode(buffer[0..decoded_len], encoded) catch return false;
+    const decoded = buffer[0..decoded_len];
+
+    // The username can't contain ':' but the password can
+    const separator = std.mem.indexOfScalar(u8, decoded, ':') orelse return false;
+    const username_ok = digestsEqual(decoded[0..separator], auth.username);
+    const password_ok = digestsEqual(decoded[separator + 1 ..], auth.password);
+    return username_ok and password_ok;
+}
+
+fn digestsEqual(given: []const u8, expected: []const u8) bool {
+    var given_digest: [Sha256.digest_length]u8 = undefined;
+    var expected_digest: [Sha256.digest_length]u8 = undefined;
+    Sha256.hash(given, &given_digest, .{});
+    Sha256.hash(expected, &expected_digest, .{});
+    return std.crypto.timing_safe.eql([Sha256.digest_length]u8, given_digest, expected_digest);
+}
+
+/// The 401 sent to requests without valid credentials
+pub fn challenge(auth: *const BasicAuth, request: *const Request) !Response {
+    var response = Response.init(request.arena, .unauthorized);
+    const realm = auth.realm orelse default_realm;
+    try response.setHeader("WWW-Authenticate", try std.fmt.allocPrint(request.arena, "Basic realm=\"{s}\", charset=\"UTF-8\"", .{realm}));
+    response.setBody("Unauthorized");
+    return response;
+}
+
+fn testRequest(arena: std.mem.Allocator, authorization: ?[]const u8) !Request {
+    var request = Request{
+        .method = .GET,
+        .path = "/",
+        .query = "",
+        .headers = HeaderMap.init(arena),
+        .body = "",
+        .arena = arena,
+    };
+    if (authorization) |value| try request.headers.put("Authorization", value);
+    return request;
+}
+
+test "isAuthorized" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const a = arena.allocator();
+
+    const auth = BasicAuth{ .username = "admin", .password = "s3cret:x" };
+
+    // admin:s3cret:x
+    try std.testing.expect(isAuthorized(&auth, &try testRequest(a, "Basic YWRtaW46czNjcmV0Ong=")));
+    try std.testing.expect(isAuthorized(&auth, &try testRequest(a, "basic  YWRtaW46czNjcmV0Ong=")));
+
+    // Missing, wrong password (admin:wrong), wrong user (root:s3cret:x), malformed
+    try std.testing.expect(!isAuthorized(&auth, &try testRequest(a, null)));
+    try std.testing.expect(!isAuthorized(&auth, &try testRequest(a, "Basic YWRtaW46d3Jvbmc=")));
+    try std.testing.expect(!isAuthorized(&auth, &try testRequest(a, "Basic cm9vdDpzM2NyZXQ6eA==")));
+    try std.testing.expect(!isAuthorized(&auth, &try testRequest(a, "Basic not-base64!")));
+    try std.testing.expect(!isAuthorized(&auth, &try testRequest(a, "Bearer YWRtaW46czNjcmV0Ong=")));
+    try std.testing.expect(!isAuthorized(&auth, &try testRequest(a, "Basic YWRtaW4=")));
+}
+
+test "challenge" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const request = try testRequest(arena.allocator(), null);
+
+    const response = try challenge(&BasicAuth{ .username = "admin", .password = "pw", .realm = "billing" }, &request);
+    try std.testing.expectEqual(interfaces.Status.unauthorized, response.status);
+    try std.testing.expectEqualStrings("Basic realm=\"billing\", charset=\"UTF-8\"", response.getHeader("WWW-Authenticate").?);
+}
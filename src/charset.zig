@@ -0,0 +1,195 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+
+/// Character sets bodies can be decoded from and encoded to, for clients
+/// that don't speak UTF-8
+pub const Charset = enum {
+    utf_8,
+    iso_8859_1,
+    windows_1252,
+    us_ascii,
+
+    /// The charset a name such as "ISO-8859-1" or "latin1" stands for;
+    /// null when it isn't supported
+    pub fn parse(name: []const u8) ?Charset {
+        const aliases = [_]struct { name: []const u8, charset: Charset }{
+            .{ .name = "utf-8", .charset = .utf_8 },
+            .{ .name = "utf8", .charset = .utf_8 },
+            .{ .name = "iso-8859-1", .charset = .iso_8859_1 },
+            .{ .name = "iso8859-1", .charset = .iso_8859_1 },
+            .{ .name = "iso_8859-1", .charset = .iso_8859_1 },
+            .{ .name = "latin1", .charset = .iso_8859_1 },
+            .{ .name = "latin-1", .charset = .iso_8859_1 },
+            .{ .name = "l1", .charset = .iso_8859_1 },
+            .{ .name = "windows-1252", .charset = .windows_1252 },
+            .{ .name = "cp1252", .charset = .windows_1252 },
+            .{ .name = "us-ascii", .charset = .us_ascii },
+            .{ .name = "ascii", .charset = .us_ascii },
+        };
+        const trimmed = std.mem.trim(u8, name, " \t\"");
+        for (aliases) |alias| {
+            if (std.ascii.eqlIgnoreCase(trimmed, alias.name)) return alias.charset;
+        }
+        return null;
+    }
+
+    /// Name for a `Content-Type` charset parameter
+    pub fn label(self: Charset) []const u8 {
+        return switch (self) {
+            .utf_8 => "utf-8",
+            .iso_8859_1 => "iso-8859-1",
+            .windows_1252 => "windows-1252",
+            .us_ascii => "us-ascii",
+        };
+    }
+
+    /// `bytes` in this charset as UTF-8. Bytes ASCII has no character for
+    /// become U+FFFD. UTF-8 input is returned as is.
+    pub fn decode(self: Charset, allocator: std.mem.Allocator, bytes: []const u8) ![]const u8 {
+        if (self == .utf_8) return bytes;
+        var out = try std.ArrayList(u8).initCapacity(allocator, bytes.len);
+        errdefer out.deinit();
+        var buffer: [4]u8 = undefined;
+        for (bytes) |byte| {
+            if (byte < 0x80) {
+                try out.append(byte);
+                continue;
+            }
+            const code_point: u21 = switch (self) {
+                .utf_8 => unreachable,
+                .iso_8859_1 => byte,
+                .windows_1252 => windows_1252_high[byte - 0x80],
+                .us_ascii => std.unicode.replacement_character,
+            };
+            const len = std.unicode.utf8Encode(code_point, &buffer) catch unreachable;
+            try out.appendSlice(buffer[0..len]);
+        }
+        return out.toOwnedSlice();
+    }
+
+    /// UTF-8 `text` in this charset. Characters the charset can't hold, and
+    /// bytes that aren't valid UTF-8, become '?'. UTF-8 is returned as is.
+    pub fn encode(self: Charset, allocator: std.mem.Allocator, text: []const u8) ![]const u8 {
+        if (self == .utf_8) return text;
+        var out = try std.ArrayList(u8).initCapacity(allocator, text.len);
+        errdefer out.deinit();
+        var index: usize = 0;
+        while (index < text.len) {
+            const len = std.unicode.utf8ByteSequenceLength(text[index]) catch 1;
+            const code_point = if (index + len <= text.len)
+                std.unicode.utf8Decode(text[index..][0..len]) catch null
+            else
+                null;
+            index += if (code_point == null) 1 else len;
+            try out.append(if (code_point) |c| self.encodeCodePoint(c) orelse '?' else '?');
+        }
+        return out.toOwnedSlice();
+    }
+
+    fn encodeCodePoint(self: Charset, code_point: u21) ?u8 {
+        if (code_point < 0x80) return @as(u8, @intCast(code_point));
+        switch (self) {
+            .utf_8 => unreachable,
+            .iso_8859_1 => return if (code_point <= 0xff) @as(u8, @intCast(code_point)) else null,
+            .windows_1252 => {
+                for (windows_1252_high, 0x80..) |mapped, byte| {
+                    if (mapped == code_point) return @as(u8, @intCast(byte));
+                }
+                return null;
+            },
+            .us_ascii => return null,
+        }
+    }
+};
+
+/// Windows-1252 bytes 0x80-0xFF as code points. The five bytes it leaves
+/// undefined map to the C1 controls of the same value, as browsers do.
+const windows_1252_high = blk: {
+    var table: [128]u21 = undefined;
+    const c1 = [32]u21{
+        0x20ac, 0x0081, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+        0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008d, 0x017d, 0x008f,
+        0x0090, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+        0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x009d, 0x017e, 0x0178,
+    };
+    for (&table, 0x80..) |*entry, byte| {
+        entry.* = if (byte < 0xa0) c1[byte - 0x80] else @intCast(byte);
+    }
+    break :blk table;
+};
+
+/// `content_type` with its charset parameter set to `charset`, keeping any
+/// other parameters
+pub fn withCharset(allocator: std.mem.Allocator, content_type: []const u8, charset: Charset) ![]const u8 {
+    var out = std.ArrayList(u8).init(allocator);
+    errdefer out.deinit();
+    try out.appendSlice(interfaces.mediaType(content_type));
+    var params = std.mem.splitScalar(u8, content_type, ';');
+    _ = params.first();
+    while (params.next()) |raw| {
+        const param = std.mem.trim(u8, raw, " \t");
+        if (param.len == 0) continue;
+        if (param.len >= 8 and std.ascii.eqlIgnoreCase(param[0..8], "charset=")) continue;
+        try out.appendSlice("; ");
+        try out.appendSlice(param);
+    }
+    try out.writer().print("; charset={s}", .{charset.label()});
+    return out.toOwnedSlice();
+}
+
+test "Charset.parse" {
+    try std.testing.expectEqual(@as(?Charset, .iso_8859_1), Charset.parse("ISO-8859-1"));
+    try std.testing.expectEqual(@as(?Charset, .iso_8859_1), Charset.parse("latin1"));
+    try std.testing.expectEqual(@as(?Charset, .windows_1252), Charset.parse("CP1252"));
+    try std.testing.expectEqual(@as(?Charset, .utf_8), Charset.parse("\"utf-8\""));
+    try std.testing.expectEqual(@as(?Charset, null), Charset.parse("shift_jis"));
+}
+
+test "Charset round-trips Latin-1" {
+    const allocator = std.testing.allocator;
+    const latin1 = "caf\xe9 \xfcber \xa3";
+
+    const decoded = try Charset.iso_8859_1.decode(allocator, latin1);
+    defer allocator.free(decoded);
+    try std.testing.expectEqualStrings("café über £", decoded);
+
+    const encoded = try Charset.iso_8859_1.encode(allocator, decoded);
+    defer allocator.free(encoded);
+    try std.testing.expectEqualStrings(latin1, encoded);
+
+    // Latin-1 has no euro sign
+    const lossy = try Charset.iso_8859_1.encode(allocator, "5 €");
+    defer allocator.free(lossy);
+    try std.testing.expectEqualStrings("5 ?", lossy);
+}
+
+test "Charset windows-1252 and ASCII" {
+    const allocator = std.testing.allocator;
+
+    const decoded = try Charset.windows_1252.decode(allocator, "\x80 \x93quoted\x94");
+    defer allocator.free(decoded);
+    try std.testing.expectEqualStrings("€ “quoted”", decoded);
+    const encoded = try Charset.windows_1252.encode(allocator, decoded);
+    defer allocator.free(encoded);
+    try std.testing.expectEqualStrings("\x80 \x93quoted\x94", encoded);
+
+    const ascii = try Charset.us_ascii.decode(allocator, "a\xe9");
+    defer allocator.free(ascii);
+    try std.testing.expectEqualStrings("a\u{fffd}", ascii);
+
+    // Invalid UTF-8 doesn't stop encoding
+    const invalid = try Charset.iso_8859_1.encode(allocator, "a\xffb");
+    defer allocator.free(invalid);
+    try std.testing.expectEqualStrings("a?b", invalid);
+}
+
+test "withCharset" {
+    const allocator = std.testing.allocator;
+    const plain = try withCharset(allocator, "text/plain", .iso_8859_1);
+    defer allocator.free(plain);
+    try std.testing.expectEqualStrings("text/plain; charset=iso-8859-1", plain);
+
+    const replaced = try withCharset(allocator, "text/html; charset=utf-8; level=1", .windows_1252);
+    defer allocator.free(replaced);
+    try std.testing.expectEqualStrings("text/html; level=1; charset=windows-1252", replaced);
+}
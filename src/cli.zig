@@ -3,11 +3,30 @@ const interfaces = @import("http/interfaces.zig");
 const config = @import("config.zig");
 const app = @import("app.zig");
 const httpz_server = @import("http/httpz_server.zig");
+const recorder = @import("recorder.zig");
+const verifier = @import("verifier.zig");
+const openapi = @import("openapi.zig");
+const har = @import("har.zig");
+const state_store = @import("state_store.zig");
+const logging = @import("logging.zig");
+const admin = @import("admin.zig");
+const remote_config = @import("remote_config.zig");
+const echo = @import("echo.zig");
+const config_dump = @import("config_dump.zig");
+const self_test = @import("self_test.zig");
+const listeners = @import("listeners.zig");
 
 const ServerConfig = interfaces.ServerConfig;
 const Config = config.Config;
 const PopshopApp = app.PopshopApp;
 const ConfigWatcher = app.ConfigWatcher;
+const Recorder = recorder.Recorder;
+const Verifier = verifier.Verifier;
+const HarLog = har.HarLog;
+const StateStore = state_store.StateStore;
+const AccessLog = logging.AccessLog;
+const AdminServer = admin.AdminServer;
+const Listeners = listeners.Listeners;
 
 /// Command line interface for PopShop
 pub const CLI = struct {
@@ -30,6 +49,10 @@ pub const CLI = struct {
             try self.runServeCommand(args[2..]);
         } else if (std.mem.eql(u8, command, "validate")) {
             try self.runValidateCommand(args[2..]);
+        } else if (std.mem.eql(u8, command, "test")) {
+            try self.runTestCommand(args[2..]);
+        } else if (std.mem.eql(u8, command, "gen")) {
+            try self.runGenCommand(args[2..]);
         } else if (std.mem.eql(u8, command, "version")) {
             self.printVersion();
         } else if (std.mem.eql(u8, command, "help") or std.mem.eql(u8, command, "--help")) {
@@ -44,6 +67,12 @@ pub const CLI = struct {
     fn runServeCommand(self: *CLI, args: []const []const u8) !void {
         var serve_config = ServeConfig{};
         var config_path: ?[]const u8 = null;
+        // `--check` validates and exits without serving, like `validate`
+        var check_only = false;
+        // `--print-config` prints the merged config and exits
+        var print_config = false;
+        var redact = false;
+        var json = false;
 
         // Parse serve command arguments
         var i: usize = 0;
@@ -67,9 +96,91 @@ pub const CLI = struct {
                 }
                 serve_config.host = args[i + 1];
                 i += 2;
+            } else if (std.mem.eql(u8, arg, "--socket") or std.mem.startsWith(u8, arg, "--socket=")) {
+                serve_config.socket = optionValue(args, &i, "--socket");
+            } else if (std.mem.eql(u8, arg, "--auto-port")) {
+                serve_config.auto_port = true;
+                i += 1;
             } else if (std.mem.eql(u8, arg, "--watch") or std.mem.eql(u8, arg, "-w")) {
                 serve_config.watch = true;
                 i += 1;
+            } else if (std.mem.eql(u8, arg, "--echo")) {
+                serve_config.echo = true;
+                i += 1;
+            } else if (std.mem.eql(u8, arg, "--quiet") or std.mem.eql(u8, arg, "-q")) {
+                serve_config.quiet = true;
+                i += 1;
+            } else if (std.mem.eql(u8, arg, "--check")) {
+                check_only = true;
+                i += 1;
+            } else if (std.mem.eql(u8, arg, "--print-config")) {
+                print_config = true;
+                i += 1;
+            } else if (std.mem.eql(u8, arg, "--redact")) {
+                redact = true;
+                i += 1;
+            } else if (std.mem.eql(u8, arg, "--json")) {
+                json = true;
+                i += 1;
+            } else if (std.mem.eql(u8, arg, "--lenient")) {
+                serve_config.load_options.lenient = true;
+                i += 1;
+            } else if (std.mem.eql(u8, arg, "--config-timeout") or std.mem.startsWith(u8, arg, "--config-timeout=")) {
+                const value = optionValue(args, &i, "--config-timeout");
+                const timeout_ms = config.parseDurationMs(value) catch 0;
+                if (timeout_ms == 0) {
+                    std.log.err("Invalid config timeout: {s} (expected a duration like 5s)", .{value});
+                    std.process.exit(1);
+                }
+                serve_config.load_options.fetch.timeout_ms = timeout_ms;
+            } else if (std.mem.eql(u8, arg, "--config-auth") or std.mem.startsWith(u8, arg, "--config-auth=")) {
+                serve_config.load_options.fetch.authorization = optionValue(args, &i, "--config-auth");
+            } else if (std.mem.eql(u8, arg, "--record")) {
+                if (i + 1 >= args.len) {
+                    std.log.err("--record requires a directory", .{});
+                    std.process.exit(1);
+                }
+                serve_config.record_dir = args[i + 1];
+                i += 2;
+            } else if (std.mem.eql(u8, arg, "--verify") or std.mem.startsWith(u8, arg, "--verify=")) {
+                serve_config.verify_dir = optionValue(args, &i, "--verify");
+            } else if (std.mem.eql(u8, arg, "--fail-on-drift")) {
+                serve_config.fail_on_drift = true;
+                i += 1;
+            } else if (std.mem.eql(u8, arg, "--har") or std.mem.startsWith(u8, arg, "--har=")) {
+                serve_config.har_path = optionValue(args, &i, "--har");
+            } else if (std.mem.eql(u8, arg, "--config-dir") or std.mem.startsWith(u8, arg, "--config-dir=")) {
+                const dir_path = optionValue(args, &i, "--config-dir");
+                var dir = std.fs.cwd().openDir(dir_path, .{}) catch |err| {
+                    std.log.err("--config-dir must be a directory: {s} ({})", .{ dir_path, err });
+                    std.process.exit(1);
+                };
+                dir.close();
+                config_path = dir_path;
+            } else if (std.mem.eql(u8, arg, "--seed") or std.mem.startsWith(u8, arg, "--seed=") or
+                // --fault-seed predates weighted responses sharing the RNG
+                std.mem.eql(u8, arg, "--fault-seed") or std.mem.startsWith(u8, arg, "--fault-seed="))
+            {
+                const value = if (std.mem.startsWith(u8, arg, "--seed"))
+                    optionValue(args, &i, "--seed")
+                else
+                    optionValue(args, &i, "--fault-seed");
+                serve_config.seed = std.fmt.parseInt(u64, value, 10) catch |err| {
+                    std.log.err("Invalid seed: {s} ({})", .{ value, err });
+                    std.process.exit(1);
+                };
+            } else if (std.mem.eql(u8, arg, "--log-level") or std.mem.startsWith(u8, arg, "--log-level=")) {
+                const value = optionValue(args, &i, "--log-level");
+                logging.runtime_level = logging.parseLevel(value) orelse {
+                    std.log.err("Invalid log level: {s} (expected debug, info, warn or error)", .{value});
+                    std.process.exit(1);
+                };
+            } else if (std.mem.eql(u8, arg, "--log-format") or std.mem.startsWith(u8, arg, "--log-format=")) {
+                const value = optionValue(args, &i, "--log-format");
+                logging.runtime_format = logging.Format.fromString(value) orelse {
+                    std.log.err("Invalid log format: {s} (expected text or json)", .{value});
+                    std.process.exit(1);
+                };
             } else if (std.mem.eql(u8, arg, "--max-request-size")) {
                 if (i + 1 >= args.len) {
                     std.log.err("--max-request-size requires a value", .{});
@@ -94,52 +205,298 @@ pub const CLI = struct {
             config_path = "config.yaml"; // Default config file
         }
 
+        if (serve_config.watch and remote_config.isUrl(config_path.?)) {
+            std.log.warn("--watch only watches local files; POST the admin reload endpoint to re-fetch {s}", .{config_path.?});
+            serve_config.watch = false;
+        }
+
+        if (json and !check_only and !print_config) {
+            std.log.err("--json only applies with --check or --print-config", .{});
+            std.process.exit(1);
+        }
+        if (redact and !print_config) {
+            std.log.err("--redact only applies with --print-config", .{});
+            std.process.exit(1);
+        }
+        if (print_config) {
+            if (check_only) {
+                std.log.err("Use either --check or --print-config, not both", .{});
+                std.process.exit(1);
+            }
+            if (!try self.printConfig(config_path.?, .{ .format = if (json) .json else .yaml, .redact = redact }, serve_config.load_options)) {
+                std.process.exit(1);
+            }
+            return;
+        }
+        if (check_only) {
+            if (!try self.validateConfig(config_path.?, json, serve_config.load_options)) {
+                std.process.exit(1);
+            }
+            return;
+        }
+
         try self.startServer(config_path.?, serve_config);
     }
 
     fn runValidateCommand(self: *CLI, args: []const []const u8) !void {
-        if (args.len == 0) {
+        var config_path: ?[]const u8 = null;
+        var json = false;
+        var load_options = config.LoadOptions{};
+        for (args) |arg| {
+            if (std.mem.eql(u8, arg, "--json")) {
+                json = true;
+            } else if (std.mem.eql(u8, arg, "--lenient")) {
+                load_options.lenient = true;
+            } else if (std.mem.startsWith(u8, arg, "--")) {
+                std.log.err("Unknown option: {s}", .{arg});
+                std.process.exit(1);
+            } else {
+                config_path = arg;
+            }
+        }
+
+        if (config_path == null) {
             std.log.err("validate command requires a config file path", .{});
             std.process.exit(1);
         }
 
-        const config_path = args[0];
-        
-        std.log.info("Validating configuration file: {s}", .{config_path});
+        if (!try self.validateConfig(config_path.?, json, load_options)) {
+            std.process.exit(1);
+        }
+    }
+
+    /// `test <config> <cases.yaml>`: send each example request through the
+    /// config in memory and report which got the expected response
+    fn runTestCommand(self: *CLI, args: []const []const u8) !void {
+        var paths: [2]?[]const u8 = .{ null, null };
+        var path_count: usize = 0;
+        var load_options = config.LoadOptions{};
+        var seed: ?u64 = null;
+        var i: usize = 0;
+        while (i < args.len) {
+            const arg = args[i];
+            if (std.mem.eql(u8, arg, "--seed") or std.mem.startsWith(u8, arg, "--seed=")) {
+                const value = optionValue(args, &i, "--seed");
+                seed = std.fmt.parseInt(u64, value, 10) catch |err| {
+                    std.log.err("Invalid seed: {s} ({})", .{ value, err });
+                    std.process.exit(1);
+                };
+                continue;
+            }
+            if (std.mem.eql(u8, arg, "--lenient")) {
+                load_options.lenient = true;
+            } else if (std.mem.startsWith(u8, arg, "--")) {
+                std.log.err("Unknown option: {s}", .{arg});
+                std.process.exit(1);
+            } else if (path_count < paths.len) {
+                paths[path_count] = arg;
+                path_count += 1;
+            } else {
+                std.log.err("Unexpected argument: {s}", .{arg});
+                std.process.exit(1);
+            }
+            i += 1;
+        }
+        if (path_count != 2) {
+            std.log.err("Usage: popshop test <config.yaml> <cases.yaml>", .{});
+            std.process.exit(1);
+        }
+        const config_path = paths[0].?;
+        const cases_path = paths[1].?;
+
+        var app_config = Config.loadFromFileWithOptions(self.allocator, config_path, load_options) catch |err| {
+            std.log.err("Failed to load {s}: {}", .{ config_path, err });
+            std.process.exit(1);
+        };
+        var errors = try app_config.validate(self.allocator);
+        defer errors.deinit();
+        if (!errors.isEmpty()) {
+            try logErrors(self.allocator, &app_config, &errors);
+            app_config.deinit();
+            std.process.exit(1);
+        }
 
-        var app_config = Config.loadFromFile(self.allocator, config_path) catch |err| {
-            std.log.err("Configuration validation failed: {}", .{err});
+        var arena = std.heap.ArenaAllocator.init(self.allocator);
+        defer arena.deinit();
+        const source = std.fs.cwd().readFileAlloc(arena.allocator(), cases_path, 64 * 1024 * 1024) catch |err| {
+            std.log.err("Failed to read {s}: {}", .{ cases_path, err });
+            app_config.deinit();
             std.process.exit(1);
         };
+        const cases = self_test.parseCases(arena.allocator(), source) catch |err| {
+            app_config.deinit();
+            switch (err) {
+                error.InvalidTestCases => std.process.exit(1),
+                else => return err,
+            }
+        };
+
+        var popshop_app = PopshopApp.init(self.allocator, self_test.offlineServer(), app_config);
+        defer popshop_app.deinit();
+        if (seed) |value| popshop_app.seedRandom(value);
+
+        var stdout = std.io.bufferedWriter(std.io.getStdOut().writer());
+        const summary = try self_test.run(self.allocator, &popshop_app, cases, stdout.writer());
+        try stdout.flush();
+        if (summary.failed > 0) std.process.exit(1);
+    }
+
+    /// `gen openapi <spec>`: print a starter config for an OpenAPI document
+    fn runGenCommand(self: *CLI, args: []const []const u8) !void {
+        if (args.len != 2 or !std.mem.eql(u8, args[0], "openapi")) {
+            std.log.err("Usage: popshop gen openapi <spec.yaml|spec.json>", .{});
+            std.process.exit(1);
+        }
+        const spec_path = args[1];
+
+        const source = std.fs.cwd().readFileAlloc(self.allocator, spec_path, 64 * 1024 * 1024) catch |err| {
+            std.log.err("Failed to read {s}: {}", .{ spec_path, err });
+            std.process.exit(1);
+        };
+        defer self.allocator.free(source);
+
+        var stdout = std.io.bufferedWriter(std.io.getStdOut().writer());
+        const count = openapi.scaffold(self.allocator, source, stdout.writer()) catch |err| switch (err) {
+            error.InvalidOpenApiSpec => std.process.exit(1),
+            else => return err,
+        };
+        try stdout.flush();
+        std.log.info("Generated {d} rules from {s}", .{ count, spec_path });
+    }
+
+    /// Load and validate a config without serving it, for `validate` and
+    /// `serve --check`. Returns whether it is valid. With `json`, the report
+    /// is a single JSON object on stdout instead of log lines.
+    fn validateConfig(self: *CLI, config_path: []const u8, json: bool, load_options: config.LoadOptions) !bool {
+        if (!json) std.log.info("Validating configuration file: {s}", .{config_path});
+
+        var app_config = Config.loadFromFileWithOptions(self.allocator, config_path, load_options) catch |err| {
+            if (json) {
+                const message = try std.fmt.allocPrint(self.allocator, "failed to load {s}: {s}", .{ config_path, @errorName(err) });
+                defer self.allocator.free(message);
+                try writeJsonReport(std.io.getStdOut().writer(), .{
+                    .valid = false,
+                    .errors = &.{.{ .message = message, .file = config_path }},
+                    .warnings = &.{},
+                });
+            } else {
+                std.log.err("Configuration validation failed: {}", .{err});
+            }
+            return false;
+        };
         defer app_config.deinit();
 
-        const stats = self.analyzeConfig(&app_config);
-        
-        std.log.info("✓ Configuration is valid", .{});
-        std.log.info("  Total rules: {}", .{stats.total_rules});
-        std.log.info("  Mock responses: {}", .{stats.mock_rules});
-        std.log.info("  Proxy rules: {}", .{stats.proxy_rules});
-        
-        if (stats.warnings.items.len > 0) {
-            std.log.warn("Warnings:", .{});
-            for (stats.warnings.items) |warning| {
-                std.log.warn("  - {s}", .{warning});
+        var errors = try app_config.validate(self.allocator);
+        defer errors.deinit();
+        var summary = try app_config.summarize(self.allocator);
+        defer summary.deinit();
+
+        if (json) {
+            const problems = try self.allocator.alloc(Problem, errors.messages.items.len);
+            defer self.allocator.free(problems);
+            for (problems, errors.messages.items, errors.rules.items, errors.fields.items) |*problem, message, rule_index, field| {
+                problem.* = .{ .message = message };
+                if (rule_index) |index| {
+                    problem.rule = index + 1;
+                    problem.file = app_config.rules.items[index].source;
+                    problem.line = try app_config.locate(self.allocator, index, field);
+                }
             }
+            try writeJsonReport(std.io.getStdOut().writer(), .{
+                .valid = errors.isEmpty(),
+                .errors = problems,
+                .warnings = summary.warnings.items,
+            });
+            return errors.isEmpty();
+        }
+
+        if (!errors.isEmpty()) {
+            try logErrors(self.allocator, &app_config, &errors);
+            return false;
         }
+
+        std.log.info("✓ Configuration is valid", .{});
+        std.log.info("  Total rules: {}", .{summary.total_rules});
+        std.log.info("  Mock responses: {}", .{summary.mock_rules});
+        std.log.info("  Proxy rules: {}", .{summary.proxy_rules});
+        logWarnings(&summary);
+        return true;
     }
 
-    fn startServer(self: *CLI, config_path: []const u8, serve_config: ServeConfig) !void {
-        std.log.info("Starting PopShop server...", .{});
-        std.log.info("Config file: {s}", .{config_path});
-        std.log.info("Host: {s}", .{serve_config.host});
-        std.log.info("Port: {}", .{serve_config.port});
+    /// `serve --print-config`: write the config as it would be served to
+    /// stdout. Returns whether it loaded; it is printed even when invalid,
+    /// since that is when it is most useful.
+    fn printConfig(self: *CLI, config_path: []const u8, options: config_dump.Options, load_options: config.LoadOptions) !bool {
+        var app_config = Config.loadFromFileWithOptions(self.allocator, config_path, load_options) catch |err| {
+            std.log.err("Failed to load configuration: {}", .{err});
+            return false;
+        };
+        defer app_config.deinit();
+
+        var stdout = std.io.bufferedWriter(std.io.getStdOut().writer());
+        try config_dump.write(self.allocator, stdout.writer(), &app_config, options);
+        try stdout.flush();
+        return true;
+    }
 
-        // Load configuration
-        var app_config = Config.loadFromFile(self.allocator, config_path) catch |err| {
+    fn startServer(self: *CLI, config_path: []const u8, serve_config: ServeConfig) !void {
+        // Load configuration (ownership passes to the app below)
+        var app_config = Config.loadFromFileWithOptions(self.allocator, config_path, serve_config.load_options) catch |err| {
             std.log.err("Failed to load configuration: {}", .{err});
             std.process.exit(1);
         };
-        defer app_config.deinit();
+
+        // Refuse to boot on an invalid config
+        if (!try self.checkConfig(&app_config)) {
+            app_config.deinit();
+            std.process.exit(1);
+        }
+
+        // Copied out of the config, which a reload may free while the server runs
+        var listen_arena = std.heap.ArenaAllocator.init(self.allocator);
+        defer listen_arena.deinit();
+        var server_config = try resolveServerConfig(listen_arena.allocator(), &app_config, serve_config);
+        if (server_config.socket_path == null) {
+            const port = resolvePort(serve_config.port, app_config.port);
+            switch (port.source) {
+                .flag => if (app_config.port) |configured| {
+                    std.log.info("Using --port {d} instead of the config's port {d}", .{ port.port, configured });
+                } else {
+                    std.log.debug("Using --port {d}", .{port.port});
+                },
+                .config => std.log.debug("Using the config's port {d}", .{port.port}),
+                .default => std.log.debug("Using the default port {d}", .{port.port}),
+            }
+            if (server_config.port == 0) {
+                server_config.port = pickFreePort(server_config.host) catch |err| {
+                    std.log.err("Failed to find a free port on {s}: {}", .{ server_config.host, err });
+                    std.process.exit(1);
+                };
+                // Printed even with --quiet, for scripts to capture
+                std.io.getStdOut().writer().print("{d}\n", .{server_config.port}) catch {};
+            } else {
+                // The config's other ports are bound later, so they look free
+                // now but aren't anywhere to move to
+                var reserved = std.ArrayList(u16).init(self.allocator);
+                defer reserved.deinit();
+                try reserved.appendSlice(app_config.listeners orelse &.{});
+                if (app_config.admin_port) |admin_port| try reserved.append(admin_port);
+                // A probe that fails for another reason leaves the server to report it
+                switch (checkPort(server_config.host, server_config.port, serve_config.auto_port, reserved.items) catch .free) {
+                    .free => {},
+                    .moved => |free_port| {
+                        std.log.warn("Port {d} is already in use, listening on {d} instead", .{ server_config.port, free_port });
+                        server_config.port = free_port;
+                        std.io.getStdOut().writer().print("{d}\n", .{server_config.port}) catch {};
+                    },
+                    .in_use => {
+                        logPortInUse(server_config.host, server_config.port);
+                        std.process.exit(1);
+                    },
+                }
+            }
+        }
+        try self.printBanner(&app_config, config_path, serve_config, server_config);
 
         // Create HTTP server
         const server = httpz_server.createHttpZServer(self.allocator) catch |err| {
@@ -150,13 +507,57 @@ pub const CLI = struct {
         // Create application
         var popshop_app = PopshopApp.init(self.allocator, server, app_config);
         defer popshop_app.deinit();
-
-        // Create server configuration
-        const server_config = ServerConfig{
-            .host = serve_config.host,
-            .port = serve_config.port,
-            .max_request_size = serve_config.max_request_size,
-        };
+        if (serve_config.seed) |seed| {
+            popshop_app.seedRandom(seed);
+        }
+        popshop_app.load_options = serve_config.load_options;
+        popshop_app.echo = serve_config.echo;
+        popshop_app.config_path = config_path;
+
+        // Save proxied responses as replayable rules if requested
+        var response_recorder: ?Recorder = null;
+        if (serve_config.record_dir) |record_dir| {
+            response_recorder = Recorder.init(self.allocator, record_dir) catch std.process.exit(1);
+            popshop_app.proxy_client.recorder = &response_recorder.?;
+            std.log.info("Recording proxied responses to {s}", .{record_dir});
+        }
+        defer if (response_recorder) |*r| r.deinit();
+
+        // Compare proxied responses with earlier recordings if requested
+        var response_verifier: ?Verifier = null;
+        if (serve_config.verify_dir) |verify_dir| {
+            response_verifier = Verifier.init(self.allocator, verify_dir) catch std.process.exit(1);
+            popshop_app.proxy_client.verifier = &response_verifier.?;
+            std.log.info("Verifying proxied responses against the recordings in {s}", .{verify_dir});
+        } else if (serve_config.fail_on_drift) {
+            std.log.warn("--fail-on-drift has no effect without --verify", .{});
+        }
+        defer if (response_verifier) |*v| v.deinit();
+
+        // One line per request, written off the request path
+        var access_log = AccessLog.init(self.allocator, logging.runtime_format);
+        try access_log.start();
+        defer access_log.deinit();
+        popshop_app.access_log = &access_log;
+
+        // Capture all traffic for sharing if requested
+        var har_log: ?HarLog = null;
+        if (serve_config.har_path) |har_path| {
+            har_log = HarLog.init(self.allocator, har_path, .{}) catch std.process.exit(1);
+            try har_log.?.start();
+            popshop_app.har_log = &har_log.?;
+            std.log.info("Capturing traffic to {s}", .{har_path});
+        }
+        defer if (har_log) |*h| h.deinit();
+
+        // Keep response sequence positions across restarts if configured
+        var sequence_state: ?StateStore = null;
+        if (popshop_app.config.state_file) |state_file| {
+            sequence_state = try StateStore.init(self.allocator, state_file);
+            popshop_app.state_store = &sequence_state.?;
+            std.log.info("Keeping response sequence positions in {s}", .{state_file});
+        }
+        defer if (sequence_state) |*s| s.deinit();
 
         // Start config watcher if requested
         var watcher: ?ConfigWatcher = null;
@@ -166,44 +567,133 @@ pub const CLI = struct {
         }
         defer if (watcher) |*w| w.stop();
 
-        // Start the server
-        try popshop_app.start(server_config);
+        installShutdownHandlers();
+
+        // Serve on a separate thread so this one can wait for a signal
+        var server_run = ServerRun{};
+        const server_thread = try std.Thread.spawn(.{}, ServerRun.run, .{ &server_run, &popshop_app, server_config });
+
+        // Each of the config's `listeners` is a server of its own, stopped
+        // along with the main one
+        if (popshop_app.config.listeners) |ports| {
+            if (server_config.socket_path == null and std.mem.indexOfScalar(u16, ports, server_config.port) != null) {
+                std.log.err("listeners: port {d} is the same as the server port", .{server_config.port});
+                std.process.exit(1);
+            }
+        }
+        var listener_set = Listeners.start(self.allocator, &popshop_app, server_config) catch |err| {
+            std.log.err("Failed to start the listeners: {}", .{err});
+            std.process.exit(1);
+        };
+        defer listener_set.stop();
+
+        // The admin API gets its own listener so it never collides with user routes
+        var admin_server: ?AdminServer = null;
+        var admin_thread: ?std.Thread = null;
+        if (popshop_app.config.admin_port) |admin_port| {
+            if (server_config.socket_path == null and admin_port == server_config.port) {
+                std.log.err("admin_port {d} is the same as the server port", .{admin_port});
+                std.process.exit(1);
+            }
+            const admin_impl = httpz_server.createHttpZServer(self.allocator) catch |err| {
+                std.log.err("Failed to create admin server: {}", .{err});
+                std.process.exit(1);
+            };
+            admin_server = AdminServer.init(admin_impl, &popshop_app);
+            var admin_config = server_config;
+            admin_config.port = admin_port;
+            admin_config.socket_path = null;
+            admin_thread = try std.Thread.spawn(.{}, AdminServer.run, .{ &admin_server.?, admin_config });
+        }
+        defer if (admin_server) |*a| {
+            a.stop() catch |err| std.log.warn("Failed to stop admin server: {}", .{err});
+            admin_thread.?.join();
+        };
+
+        if (!serve_config.quiet) {
+            std.log.info("Press Ctrl+C to stop the server", .{});
+        }
+        while (!shutdown_requested.load(.acquire) and !server_run.done.load(.acquire)) {
+            std.time.sleep(100 * std.time.ns_per_ms);
+        }
+
+        if (server_run.done.load(.acquire)) {
+            // The server stopped on its own, which only happens on failure
+            server_thread.join();
+            if (server_run.err) |err| {
+                // Taken between the check above and the bind
+                if (err == error.AddressInUse and server_config.socket_path == null) {
+                    logPortInUse(server_config.host, server_config.port);
+                } else {
+                    std.log.err("Server failed: {}", .{err});
+                }
+                return err;
+            }
+            return;
+        }
+
+        popshop_app.config_lock.lockShared();
+        const timeout_ms = popshop_app.config.shutdownTimeoutMs();
+        popshop_app.config_lock.unlockShared();
+
+        std.log.info("Shutdown signal received, waiting up to {d}ms for in-flight requests", .{timeout_ms});
+        try popshop_app.stop();
 
-        std.log.info("Server started successfully!", .{});
-        std.log.info("Press Ctrl+C to stop the server (signal handling temporarily disabled)", .{});
+        const deadline = std.time.milliTimestamp() + @as(i64, @intCast(timeout_ms));
+        while (!server_run.done.load(.acquire)) {
+            if (std.time.milliTimestamp() >= deadline) {
+                // Exiting closes whatever connections are still open
+                std.log.warn("Shutdown timed out after {d}ms, closing remaining connections", .{timeout_ms});
+                std.process.exit(1);
+            }
+            std.time.sleep(50 * std.time.ns_per_ms);
+        }
+        server_thread.join();
+        std.log.info("Shutdown complete", .{});
 
-        // Keep the server running (simplified without signal handling for now)
-        // In a production environment, you'd want to implement proper signal handling
-        while (true) {
-            std.time.sleep(1000 * std.time.ns_per_ms); // Sleep 1 second
+        if (response_verifier) |*v| {
+            v.logSummary();
+            if (serve_config.fail_on_drift and v.drifted.load(.monotonic) > 0) std.process.exit(1);
         }
     }
 
-    fn analyzeConfig(self: *CLI, app_config: *const Config) ConfigStats {
-        
-        var stats = ConfigStats{
-            .total_rules = app_config.rules.items.len,
-            .mock_rules = 0,
-            .proxy_rules = 0,
-            .warnings = std.ArrayList([]const u8).init(self.allocator),
-        };
+    /// Run semantic validation and log every problem found.
+    /// Returns whether the configuration is valid.
+    fn checkConfig(self: *CLI, app_config: *const Config) !bool {
+        var errors = try app_config.validate(self.allocator);
+        defer errors.deinit();
 
-        for (app_config.rules.items) |rule| {
-            if (rule.isMock()) {
-                stats.mock_rules += 1;
+        if (errors.isEmpty()) return true;
+        try logErrors(self.allocator, app_config, &errors);
+        return false;
+    }
+
+    /// Log the startup banner: where the server listens and what the config
+    /// holds. Warnings are logged even when the banner is suppressed.
+    fn printBanner(self: *CLI, app_config: *const Config, config_path: []const u8, serve_config: ServeConfig, server_config: ServerConfig) !void {
+        var summary = try app_config.summarize(self.allocator);
+        defer summary.deinit();
+
+        if (!serve_config.quiet) {
+            const host = if (server_config.host.len == 0) "0.0.0.0" else server_config.host;
+            if (server_config.socket_path) |socket_path| {
+                std.log.info("PopShop starting on unix:{s}", .{socket_path});
+            } else {
+                std.log.info("PopShop starting on http://{s}:{d}", .{ host, server_config.port });
+            }
+            std.log.info("  Config: {s}", .{config_path});
+            std.log.info("  Routes: {d} ({d} mock, {d} proxy)", .{ summary.total_rules, summary.mock_rules, summary.proxy_rules });
+            if (app_config.admin_port) |admin_port| {
+                std.log.info("  Admin API: http://{s}:{d}{s}", .{ host, admin_port, admin.prefix });
             }
-            if (rule.isProxy()) {
-                stats.proxy_rules += 1;
+            if (serve_config.watch) {
+                std.log.info("  Watching config for changes", .{});
             }
-            
-            // Check for potential issues
-            if (!rule.isMock() and !rule.isProxy()) {
-                // This would be caught during config loading, but just in case
-                stats.warnings.append("Rule has neither mock response nor proxy config") catch {};
+            if (serve_config.echo) {
+                std.log.info("  Request echo: {s}", .{echo.path});
             }
         }
-
-        return stats;
+        logWarnings(&summary);
     }
 
     fn printUsage(self: *CLI) void {
@@ -212,7 +702,9 @@ pub const CLI = struct {
         std.log.info("", .{});
         std.log.info("Commands:", .{});
         std.log.info("  serve [config.yaml]    Start the HTTP server", .{});
-        std.log.info("  validate <config.yaml> Validate configuration file", .{});
+        std.log.info("  validate <config.yaml> Validate configuration file (--json for a JSON report, --lenient to ignore unknown keys)", .{});
+        std.log.info("  test <config> <cases>  Check the config answers example requests as expected (--seed <n>, --lenient)", .{});
+        std.log.info("  gen openapi <spec>    Print a starter config with a rule per OpenAPI operation", .{});
         std.log.info("  version               Show version information", .{});
         std.log.info("  help                  Show this help message", .{});
     }
@@ -223,34 +715,298 @@ pub const CLI = struct {
         self.printUsage();
         std.log.info("", .{});
         std.log.info("Serve Options:", .{});
-        std.log.info("  -p, --port <port>           Port to run server on (default: 8080)", .{});
-        std.log.info("  -h, --host <host>           Host to bind to (default: 127.0.0.1)", .{});
-        std.log.info("  -w, --watch                 Watch config file for changes", .{});
+        std.log.info("  -p, --port <port>           Port to run server on, 0 for a free one (default: 8080)", .{});
+        std.log.info("  --auto-port                 If the port is taken, listen on the next free one and print it", .{});
+        std.log.info("  -h, --host <host>           Host to bind to, \"\" for all interfaces (default: 127.0.0.1)", .{});
+        std.log.info("  --socket <path>             Listen on a Unix domain socket instead of TCP", .{});
+        std.log.info("  --config-dir <dir>          Load every .yaml/.yml/.json file under <dir>", .{});
+        std.log.info("  -w, --watch                 Reload config when its files change", .{});
+        std.log.info("  --config-timeout <duration> Time limit for fetching a config from a URL (default: 10s)", .{});
+        std.log.info("  --config-auth <value>       Authorization header sent when fetching a config URL", .{});
+        std.log.info("  -q, --quiet                 Don't print the startup banner", .{});
+        std.log.info("  --check                     Validate the config and exit instead of serving", .{});
+        std.log.info("  --print-config              Print the config as it will be served, after imports and ${{VAR}}s, and exit", .{});
+        std.log.info("  --redact                    With --print-config, hide values taken from the environment", .{});
+        std.log.info("  --json                      With --check or --print-config, print JSON", .{});
+        std.log.info("  --lenient                   Ignore unknown config keys instead of failing", .{});
+        std.log.info("  --record <dir>              Save proxied responses as rules in <dir>", .{});
+        std.log.info("  --verify <dir>              Report proxied responses that differ from those recorded in <dir>", .{});
+        std.log.info("  --fail-on-drift             With --verify, exit with status 1 if any response differed", .{});
+        std.log.info("  --har <file>                Capture every request and response to a HAR file", .{});
+        std.log.info("  --echo                      Answer /__popshop/echo with a JSON dump of the request", .{});
         std.log.info("  --max-request-size <bytes>  Maximum request size (default: 1048576)", .{});
+        std.log.info("  --seed <n>                  Seed faults, weighted responses and template helpers", .{});
+        std.log.info("  --log-level <level>         debug, info, warn or error (default: info)", .{});
+        std.log.info("  --log-format <format>       text or json (default: text)", .{});
+        std.log.info("", .{});
+        std.log.info("Set admin_port in the config to serve GET /__popshop/routes on that port.", .{});
         std.log.info("", .{});
         std.log.info("Examples:", .{});
         std.log.info("  popshop serve config.yaml", .{});
         std.log.info("  popshop serve config.yaml --port 3000 --watch", .{});
+        std.log.info("  popshop serve --config-dir mocks/", .{});
+        std.log.info("  popshop serve https://ci.example.com/popshop.yaml --config-auth \"Bearer $TOKEN\"", .{});
         std.log.info("  popshop validate config.yaml", .{});
+        std.log.info("  popshop test config.yaml cases.yaml", .{});
+        std.log.info("  popshop gen openapi openapi.yaml > mocks/api.yaml", .{});
+        std.log.info("  popshop serve --config-dir mocks/ --check --json", .{});
+        std.log.info("  popshop serve config.yaml --print-config --redact", .{});
     }
 
     fn printVersion(self: *CLI) void {
         _ = self;
-        std.log.info("PopShop v0.1.0", .{});
+        std.log.info("PopShop v{s}", .{app.version});
         std.log.info("Built with Zig {s}", .{@import("builtin").zig_version_string});
     }
 };
 
+/// Set from the signal handler once SIGINT or SIGTERM arrives
+var shutdown_requested = std.atomic.Value(bool).init(false);
+
+/// Route SIGINT and SIGTERM to a graceful shutdown. A second signal while
+/// draining exits immediately.
+fn installShutdownHandlers() void {
+    const action = std.posix.Sigaction{
+        .handler = .{ .handler = handleShutdownSignal },
+        .mask = std.posix.empty_sigset,
+        .flags = 0,
+    };
+    std.posix.sigaction(std.posix.SIG.INT, &action, null);
+    std.posix.sigaction(std.posix.SIG.TERM, &action, null);
+}
+
+fn handleShutdownSignal(sig: c_int) callconv(.c) void {
+    _ = sig;
+    // Only async-signal-safe work here; the main thread does the logging
+    if (shutdown_requested.swap(true, .acq_rel)) {
+        std.posix.exit(1);
+    }
+}
+
+/// Result of the server thread, polled by the main thread during shutdown
+const ServerRun = struct {
+    done: std.atomic.Value(bool) = std.atomic.Value(bool).init(false),
+    err: ?anyerror = null,
+
+    fn run(self: *ServerRun, popshop_app: *PopshopApp, server_config: ServerConfig) void {
+        popshop_app.start(server_config) catch |err| {
+            self.err = err;
+        };
+        self.done.store(true, .release);
+    }
+};
+
+/// Value of an option given as `--name value` or `--name=value`; advances `i` past it
+fn optionValue(args: []const []const u8, i: *usize, comptime name: []const u8) []const u8 {
+    const arg = args[i.*];
+    if (std.mem.startsWith(u8, arg, name ++ "=")) {
+        i.* += 1;
+        return arg[name.len + 1 ..];
+    }
+    if (i.* + 1 >= args.len) {
+        std.log.err(name ++ " requires a value", .{});
+        std.process.exit(1);
+    }
+    i.* += 2;
+    return args[i.* - 1];
+}
+
+/// Options given to `popshop serve`. Listen settings left unset fall back to
+/// the config file, then to the `ServerConfig` defaults.
 const ServeConfig = struct {
-    host: []const u8 = "127.0.0.1",
-    port: u16 = 8080,
+    host: ?[]const u8 = null,
+    port: ?u16 = null,
+    /// Unix domain socket to listen on instead of TCP
+    socket: ?[]const u8 = null,
     watch: bool = false,
+    /// Directory to record proxied responses into
+    record_dir: ?[]const u8 = null,
+    /// Directory of recordings to compare proxied responses with
+    verify_dir: ?[]const u8 = null,
+    /// Exit with status 1 after a `--verify` run in which anything drifted
+    fail_on_drift: bool = false,
+    /// HAR file capturing every exchange
+    har_path: ?[]const u8 = null,
     max_request_size: usize = 1024 * 1024, // 1MB
+    /// Seed for fault injection and weighted responses, for reproducible runs
+    seed: ?u64 = null,
+    /// Skip the startup banner
+    quiet: bool = false,
+    /// Serve the request dump at `/__popshop/echo`
+    echo: bool = false,
+    /// Move to the next free port when the chosen one is taken
+    auto_port: bool = false,
+    /// `--lenient` tolerates unknown config keys, here and on reload
+    load_options: config.LoadOptions = .{},
 };
 
-const ConfigStats = struct {
-    total_rules: usize,
-    mock_rules: usize,
-    proxy_rules: usize,
-    warnings: std.ArrayList([]const u8),
-};
\ No newline at end of file
+/// Where the listening port came from
+const PortSource = enum { flag, config, default };
+
+const PortChoice = struct {
+    port: u16,
+    source: PortSource,
+};
+
+/// `--port` wins over the config's `port`, which wins over the default.
+/// Validation has rejected configured ports outside the u16 range.
+fn resolvePort(flag: ?u16, configured: ?u32) PortChoice {
+    if (flag) |port| return .{ .port = port, .source = .flag };
+    if (configured) |port| return .{ .port = @intCast(port), .source = .config };
+    return .{ .port = (ServerConfig{}).port, .source = .default };
+}
+
+/// Ask the OS for a free port on `host`, for port 0. The probe is closed
+/// before the server binds, so another process could take the port in
+/// between, as with `MockServer`.
+fn pickFreePort(host: []const u8) !u16 {
+    const address = try std.net.Address.parseIp(if (host.len == 0) "0.0.0.0" else host, 0);
+    var probe = try address.listen(.{ .reuse_address = true });
+    defer probe.deinit();
+    return probe.listen_address.getPort();
+}
+
+/// Ports past a taken one that `--auto-port` tries
+const auto_port_attempts = 100;
+
+/// What probing the server's port found
+const PortCheck = union(enum) {
+    free,
+    /// Taken, and `--auto-port` found this one free after it
+    moved: u16,
+    /// Taken, with nothing free found in its place
+    in_use,
+};
+
+/// Probe `port` on `host` before the server binds it, so a port another
+/// process holds gets a clear message rather than a bare bind error. With
+/// `auto` the ports after it are tried in turn, passing over `reserved`
+/// ones. As with `pickFreePort`, the probe is closed before the server binds.
+fn checkPort(host: []const u8, port: u16, auto: bool, reserved: []const u16) !PortCheck {
+    if (try portIsFree(host, port)) return .free;
+    if (!auto) return .in_use;
+    var candidate = port;
+    for (0..auto_port_attempts) |_| {
+        candidate = std.math.add(u16, candidate, 1) catch break;
+        if (std.mem.indexOfScalar(u16, reserved, candidate) != null) continue;
+        if (try portIsFree(host, candidate)) return .{ .moved = candidate };
+    }
+    return .in_use;
+}
+
+fn portIsFree(host: []const u8, port: u16) !bool {
+    const address = try std.net.Address.parseIp(if (host.len == 0) "0.0.0.0" else host, port);
+    var probe = address.listen(.{ .reuse_address = true }) catch |err| switch (err) {
+        error.AddressInUse => return false,
+        else => return err,
+    };
+    probe.deinit();
+    return true;
+}
+
+/// Explain a taken port and the ways around it
+fn logPortInUse(host: []const u8, port: u16) void {
+    std.log.err("Port {d} on {s} is already in use, probably by another popshop or dev server; `lsof -i :{d}` shows which process holds it", .{
+        port, if (host.len == 0) "0.0.0.0" else host, port,
+    });
+    std.log.err("Stop that process, pick another port with --port <port>, or pass --auto-port to use the next free one", .{});
+}
+
+/// Combine the serve flags with the config file's `host`, `port` and `socket`.
+/// Flags win, so `--host` or `--port` also override a configured socket.
+fn resolveServerConfig(allocator: std.mem.Allocator, app_config: *const Config, serve_config: ServeConfig) !ServerConfig {
+    var server_config = ServerConfig{ .max_request_size = serve_config.max_request_size };
+    if (serve_config.host orelse app_config.host) |host| {
+        server_config.host = try allocator.dupe(u8, host);
+    }
+    server_config.port = resolvePort(serve_config.port, app_config.port).port;
+    if (app_config.read_timeout_ms) |timeout_ms| server_config.read_timeout_ms = timeout_ms;
+    if (app_config.write_timeout_ms) |timeout_ms| server_config.write_timeout_ms = timeout_ms;
+    if (app_config.idle_timeout_ms) |timeout_ms| server_config.idle_timeout_ms = timeout_ms;
+
+    const tcp_flags = serve_config.host != null or serve_config.port != null;
+    const socket = serve_config.socket orelse if (tcp_flags) null else app_config.socket;
+    if (socket) |socket_path| {
+        server_config.socket_path = try allocator.dupe(u8, socket_path);
+    }
+    return server_config;
+}
+
+/// Log validation errors, prefixed with `file:line:` where the setting's
+/// location is known
+fn logErrors(allocator: std.mem.Allocator, app_config: *const Config, errors: *const config.ValidationErrors) !void {
+    std.log.err("Configuration has {} error(s):", .{errors.messages.items.len});
+    for (errors.messages.items, errors.rules.items, errors.fields.items) |message, rule_index, field| {
+        const source = if (rule_index) |index| app_config.rules.items[index].source else null;
+        const line = if (rule_index) |index| try app_config.locate(allocator, index, field) else null;
+        if (source != null and line != null) {
+            std.log.err("  - {s}:{d}: {s}", .{ source.?, line.?, message });
+        } else if (source) |file| {
+            std.log.err("  - {s}: {s}", .{ file, message });
+        } else {
+            std.log.err("  - {s}", .{message});
+        }
+    }
+}
+
+/// One validation error in `validate --json` output. `rule` counts from 1,
+/// like the messages.
+const Problem = struct {
+    message: []const u8,
+    file: ?[]const u8 = null,
+    line: ?usize = null,
+    rule: ?usize = null,
+};
+
+const Report = struct {
+    valid: bool,
+    errors: []const Problem,
+    warnings: []const []const u8,
+};
+
+fn writeJsonReport(writer: anytype, report: Report) !void {
+    try std.json.stringify(report, .{ .emit_null_optional_fields = false }, writer);
+    try writer.writeByte('\n');
+}
+
+fn logWarnings(summary: *const config.Summary) void {
+    if (summary.warnings.items.len == 0) return;
+    std.log.warn("Configuration has {d} warning(s):", .{summary.warnings.items.len});
+    for (summary.warnings.items) |warning| {
+        std.log.warn("  - {s}", .{warning});
+    }
+}
+
+test "resolvePort" {
+    try std.testing.expectEqual(PortChoice{ .port = 3000, .source = .flag }, resolvePort(3000, 9000));
+    try std.testing.expectEqual(PortChoice{ .port = 3000, .source = .flag }, resolvePort(3000, null));
+    try std.testing.expectEqual(PortChoice{ .port = 9000, .source = .config }, resolvePort(null, 9000));
+    try std.testing.expectEqual(PortChoice{ .port = 8080, .source = .default }, resolvePort(null, null));
+
+    // An explicit 0 from either source is kept, to be replaced by a free port
+    try std.testing.expectEqual(PortChoice{ .port = 0, .source = .flag }, resolvePort(0, 9000));
+    try std.testing.expectEqual(PortChoice{ .port = 0, .source = .config }, resolvePort(null, 0));
+}
+
+test "pickFreePort" {
+    const port = try pickFreePort("127.0.0.1");
+    try std.testing.expect(port != 0);
+}
+
+test "checkPort reports a taken port" {
+    const address = try std.net.Address.parseIp("127.0.0.1", 0);
+    var taken = try address.listen(.{});
+    defer taken.deinit();
+    const port = taken.listen_address.getPort();
+
+    try std.testing.expectEqual(PortCheck.in_use, try checkPort("127.0.0.1", port, false, &.{}));
+
+    // --auto-port moves on to a port that is free
+    const moved = (try checkPort("127.0.0.1", port, true, &.{})).moved;
+    try std.testing.expect(moved > port);
+    try std.testing.expectEqual(PortCheck.free, try checkPort("127.0.0.1", moved, false, &.{}));
+
+    // but not to one the config's listeners will take
+    const past = (try checkPort("127.0.0.1", port, true, &.{moved})).moved;
+    try std.testing.expect(past > moved);
+}
@@ -0,0 +1,162 @@
+const std = @import("std");
+
+const posix = std.posix;
+const Client = std.http.Client;
+const Connection = Client.Connection;
+
+/// Open a request like `Client.open`, but connect, and for https finish the
+/// TLS handshake, before `deadline` (milliseconds since the epoch). Fails with
+/// error.DeadlineExceeded if that takes too long. Name lookup goes through
+/// the system resolver and is bounded only by its own timeouts.
+pub fn open(client: *Client, method: std.http.Method, uri: std.Uri, options: Client.RequestOptions, deadline: i64) !Client.Request {
+    const protocol: Connection.Protocol = if (std.ascii.eqlIgnoreCase(uri.scheme, "http"))
+        .plain
+    else if (std.ascii.eqlIgnoreCase(uri.scheme, "https"))
+        .tls
+    else
+        return error.UnsupportedUriScheme;
+
+    var host_buffer: [std.Uri.host_name_max]u8 = undefined;
+    const host = try uri.getHost(&host_buffer);
+    const port = uri.port orelse switch (protocol) {
+        .plain => 80,
+        .tls => 443,
+    };
+
+    var request_options = options;
+    request_options.connection = try connect(client, host, port, protocol, deadline);
+    errdefer client.connection_pool.release(client.allocator, request_options.connection.?);
+    return client.open(method, uri, request_options);
+}
+
+/// Limit the next socket read or write to the time left before `deadline`
+pub fn apply(req: *Client.Request, deadline: i64) !void {
+    const connection = req.connection orelse {
+        _ = try remaining(deadline);
+        return;
+    };
+    try setSocketTimeout(connection.stream.handle, deadline);
+}
+
+/// Whether `err` is down to the deadline. Socket timeouts surface as
+/// assorted read and write errors, so past the deadline the clock decides.
+pub fn expired(err: anyerror, deadline: i64) bool {
+    return err == error.DeadlineExceeded or std.time.milliTimestamp() >= deadline;
+}
+
+/// A pooled connection to `host`, or a new one, which is added to the pool's
+/// used list the way `Client.connectTcp` does so that `Request.deinit` can
+/// release it
+fn connect(client: *Client, host: []const u8, port: u16, protocol: Connection.Protocol, deadline: i64) !*Connection {
+    if (client.connection_pool.findConnection(.{ .host = host, .port = port, .protocol = protocol })) |connection| {
+        return connection;
+    }
+    if (Client.disable_tls and protocol == .tls) return error.TlsInitializationFailed;
+
+    const node = try client.allocator.create(Client.ConnectionPool.Node);
+    errdefer client.allocator.destroy(node);
+    node.* = .{ .data = undefined };
+
+    const stream = try connectStream(client.allocator, host, port, deadline);
+    errdefer stream.close();
+
+    node.data = .{
+        .stream = stream,
+        .tls_client = undefined,
+        .protocol = protocol,
+        .host = try client.allocator.dupe(u8, host),
+        .port = port,
+    };
+    errdefer client.allocator.free(node.data.host);
+
+    if (protocol == .tls) {
+        if (Client.disable_tls) unreachable;
+        try loadCertificates(client);
+
+        // The handshake is plain blocking reads and writes on the socket
+        try setSocketTimeout(stream.handle, deadline);
+        node.data.tls_client = try client.allocator.create(std.crypto.tls.Client);
+        errdefer client.allocator.destroy(node.data.tls_client);
+        node.data.tls_client.* = std.crypto.tls.Client.init(stream, .{
+            .host = .{ .explicit = host },
+            .ca = .{ .bundle = client.ca_bundle },
+        }) catch {
+            if (std.time.milliTimestamp() >= deadline) return error.DeadlineExceeded;
+            return error.TlsInitializationFailed;
+        };
+        // HTTP carries the body length, which catches truncation, as in `Client.connectTcp`
+        node.data.tls_client.allow_truncation_attacks = true;
+    }
+
+    client.connection_pool.addUsed(node);
+    return &node.data;
+}
+
+/// Scan the system certificates on first use, which `Client.open` would do
+/// before connecting
+fn loadCertificates(client: *Client) !void {
+    if (!@atomicLoad(bool, &client.next_https_rescan_certs, .acquire)) return;
+
+    client.ca_bundle_mutex.lock();
+    defer client.ca_bundle_mutex.unlock();
+    if (client.next_https_rescan_certs) {
+        client.ca_bundle.rescan(client.allocator) catch return error.CertificateBundleLoadFailure;
+        @atomicStore(bool, &client.next_https_rescan_certs, false, .release);
+    }
+}
+
+/// Connect to the first address of `host` that accepts before `deadline`
+fn connectStream(allocator: std.mem.Allocator, host: []const u8, port: u16, deadline: i64) !std.net.Stream {
+    const list = try std.net.getAddressList(allocator, host, port);
+    defer list.deinit();
+    if (list.addrs.len == 0) return error.UnknownHostName;
+
+    var last_err: anyerror = error.ConnectionRefused;
+    for (list.addrs) |address| {
+        return connectAddress(address, deadline) catch |err| {
+            if (err == error.DeadlineExceeded) return err;
+            last_err = err;
+            continue;
+        };
+    }
+    return last_err;
+}
+
+/// Connect without blocking and wait for the handshake with poll, so a
+/// dropped SYN gives up at the deadline instead of the kernel's retry limit
+fn connectAddress(address: std.net.Address, deadline: i64) !std.net.Stream {
+    const handle = try posix.socket(address.any.family, posix.SOCK.STREAM | posix.SOCK.NONBLOCK | posix.SOCK.CLOEXEC, posix.IPPROTO.TCP);
+    errdefer posix.close(handle);
+
+    posix.connect(handle, &address.any, address.getOsSockLen()) catch |err| switch (err) {
+        error.WouldBlock => {
+            var fds = [_]posix.pollfd{.{ .fd = handle, .events = posix.POLL.OUT, .revents = 0 }};
+            const ms = try remaining(deadline);
+            if (try posix.poll(&fds, @intCast(@min(ms, std.math.maxInt(i32)))) == 0) return error.DeadlineExceeded;
+            try posix.getsockoptError(handle);
+        },
+        else => return err,
+    };
+
+    // std.http.Client reads and writes blocking
+    const flags = try posix.fcntl(handle, posix.F.GETFL, 0);
+    _ = try posix.fcntl(handle, posix.F.SETFL, flags & ~@as(usize, 1 << @bitOffsetOf(posix.O, "NONBLOCK")));
+    return std.net.Stream{ .handle = handle };
+}
+
+fn setSocketTimeout(handle: posix.socket_t, deadline: i64) !void {
+    const ms = try remaining(deadline);
+    const timeout = posix.timeval{
+        .sec = @intCast(ms / std.time.ms_per_s),
+        .usec = @intCast((ms % std.time.ms_per_s) * std.time.us_per_ms),
+    };
+    try posix.setsockopt(handle, posix.SOL.SOCKET, posix.SO.RCVTIMEO, std.mem.asBytes(&timeout));
+    try posix.setsockopt(handle, posix.SOL.SOCKET, posix.SO.SNDTIMEO, std.mem.asBytes(&timeout));
+}
+
+/// Milliseconds left before `deadline`, failing once it has passed
+fn remaining(deadline: i64) !u64 {
+    const ms = deadline - std.time.milliTimestamp();
+    if (ms <= 0) return error.DeadlineExceeded;
+    return @intCast(ms);
+}
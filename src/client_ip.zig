@@ -0,0 +1,108 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+
+const Request = interfaces.Request;
+
+/// An address block from a rule's `client_ip:`, such as `10.0.0.0/8`,
+/// `2001:db8::/32` or a single address, which is a block of one
+pub const IpRange = struct {
+    /// Network-order address bytes; IPv4 uses the first four
+    bytes: [16]u8,
+    is_ipv6: bool,
+    prefix_len: u8,
+
+    /// Parse `address` or `address/prefix`. Null when either part is invalid.
+    pub fn parse(text: []const u8) ?IpRange {
+        const slash = std.mem.indexOfScalar(u8, text, '/');
+        const address = std.net.Address.parseIp(text[0 .. slash orelse text.len], 0) catch return null;
+        var range = fromAddress(address) orelse return null;
+        if (slash) |index| {
+            const prefix_len = std.fmt.parseInt(u8, text[index + 1 ..], 10) catch return null;
+            if (prefix_len > range.prefix_len) return null;
+            range.prefix_len = prefix_len;
+        }
+        return range;
+    }
+
+    /// The block holding just `address`
+    fn fromAddress(address: std.net.Address) ?IpRange {
+        var range = IpRange{ .bytes = [_]u8{0} ** 16, .is_ipv6 = false, .prefix_len = 32 };
+        switch (address.any.family) {
+            std.posix.AF.INET => {
+                range.bytes[0..4].* = @bitCast(address.in.sa.addr);
+            },
+            std.posix.AF.INET6 => {
+                const bytes = address.in6.sa.addr;
+                // IPv4-mapped addresses (::ffff:a.b.c.d) are the IPv4 client they carry
+                const mapped_prefix = [_]u8{0} ** 10 ++ [_]u8{ 0xff, 0xff };
+                if (std.mem.eql(u8, bytes[0..12], &mapped_prefix)) {
+                    range.bytes[0..4].* = bytes[12..16].*;
+                } else {
+                    range.bytes = bytes;
+                    range.is_ipv6 = true;
+                    range.prefix_len = 128;
+                }
+            },
+            else => return null,
+        }
+        return range;
+    }
+
+    pub fn contains(self: IpRange, address: std.net.Address) bool {
+        const client = fromAddress(address) orelse return false;
+        if (client.is_ipv6 != self.is_ipv6) return false;
+
+        const whole_bytes = self.prefix_len / 8;
+        if (!std.mem.eql(u8, self.bytes[0..whole_bytes], client.bytes[0..whole_bytes])) return false;
+        const rest_bits: u3 = @intCast(self.prefix_len % 8);
+        if (rest_bits == 0) return true;
+        const mask = @as(u8, 0xff) << @intCast(8 - @as(u4, rest_bits));
+        return (self.bytes[whole_bytes] & mask) == (client.bytes[whole_bytes] & mask);
+    }
+};
+
+/// The address a request came from. With `trust_proxy`, the first entry of
+/// `X-Forwarded-For`, which a proxy in front of popshop sets to the original
+/// client, takes the place of the connection's address when it parses.
+pub fn clientAddress(request: *const Request, trust_proxy: bool) ?std.net.Address {
+    if (trust_proxy) {
+        if (request.getHeader("X-Forwarded-For")) |forwarded| {
+            var entries = std.mem.splitScalar(u8, forwarded, ',');
+            const first = std.mem.trim(u8, entries.first(), " \t");
+            if (std.net.Address.parseIp(first, 0)) |address| return address else |_| {}
+        }
+    }
+    return request.client_address;
+}
+
+test "IpRange.parse" {
+    const range = IpRange.parse("192.168.1.0/24").?;
+    try std.testing.expect(!range.is_ipv6);
+    try std.testing.expectEqual(@as(u8, 24), range.prefix_len);
+    try std.testing.expectEqual(@as(u8, 32), IpRange.parse("10.1.2.3").?.prefix_len);
+    try std.testing.expectEqual(@as(u8, 128), IpRange.parse("::1").?.prefix_len);
+
+    try std.testing.expect(IpRange.parse("10.0.0.0/33") == null);
+    try std.testing.expect(IpRange.parse("10.0.0/8") == null);
+    try std.testing.expect(IpRange.parse("10.0.0.0/") == null);
+    try std.testing.expect(IpRange.parse("localhost") == null);
+}
+
+test "IpRange.contains" {
+    const office = IpRange.parse("192.168.1.0/24").?;
+    try std.testing.expect(office.contains(try std.net.Address.parseIp("192.168.1.77", 0)));
+    try std.testing.expect(office.contains(try std.net.Address.parseIp("::ffff:192.168.1.77", 0)));
+    try std.testing.expect(!office.contains(try std.net.Address.parseIp("192.168.2.1", 0)));
+    try std.testing.expect(!office.contains(try std.net.Address.parseIp("2001:db8::1", 0)));
+
+    const odd = IpRange.parse("10.0.0.0/9").?;
+    try std.testing.expect(odd.contains(try std.net.Address.parseIp("10.127.0.1", 0)));
+    try std.testing.expect(!odd.contains(try std.net.Address.parseIp("10.128.0.1", 0)));
+
+    const documentation = IpRange.parse("2001:db8::/32").?;
+    try std.testing.expect(documentation.contains(try std.net.Address.parseIp("2001:db8:ffff::1", 0)));
+    try std.testing.expect(!documentation.contains(try std.net.Address.parseIp("2001:db9::1", 0)));
+
+    try std.testing.expect(IpRange.parse("0.0.0.0/0").?.contains(try std.net.Address.parseIp("8.8.8.8", 0)));
+    try std.testing.expect(IpRange.parse("10.1.2.3").?.contains(try std.net.Address.parseIp("10.1.2.3", 0)));
+}
@@ -0,0 +1,162 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+const config = @import("config.zig");
+
+const Request = interfaces.Request;
+const Response = interfaces.Response;
+const HeaderMap = interfaces.HeaderMap;
+const CompressionConfig = config.CompressionConfig;
+
+/// Whether the request's Accept-Encoding allows gzip. `gzip;q=0` opts out,
+/// and an explicit gzip entry takes precedence over `*`.
+pub fn acceptsGzip(request: *const Request) bool {
+    const header = request.getHeader("Accept-Encoding") orelse return false;
+
+    var wildcard = false;
+    var codings = std.mem.splitScalar(u8, header, ',');
+    while (codings.next()) |entry| {
+        var params = std.mem.splitScalar(u8, entry, ';');
+        const coding = std.mem.trim(u8, params.first(), " \t");
+        const is_gzip = std.ascii.eqlIgnoreCase(coding, "gzip") or std.ascii.eqlIgnoreCase(coding, "x-gzip");
+        if (!is_gzip and !std.mem.eql(u8, coding, "*")) continue;
+
+        const refused = while (params.next()) |param| {
+            const trimmed = std.mem.trim(u8, param, " \t");
+            if (trimmed.len < 2 or !std.ascii.eqlIgnoreCase(trimmed[0..2], "q=")) continue;
+            const quality = std.fmt.parseFloat(f64, trimmed[2..]) catch break false;
+            break quality == 0;
+        } else false;
+
+        if (is_gzip) return !refused;
+        wildcard = !refused;
+    }
+    return wildcard;
+}
+
+/// Media types whose bodies are already compressed, so gzip would only add overhead
+fn isCompressedType(content_type: []const u8) bool {
+    const media_type = interfaces.mediaType(content_type);
+
+    const compressed_prefixes = [_][]const u8{ "image/", "video/", "audio/" };
+    for (compressed_prefixes) |prefix| {
+        if (std.ascii.startsWithIgnoreCase(media_type, prefix)) {
+            // SVG is text and compresses well
+            return !std.ascii.eqlIgnoreCase(media_type, "image/svg+xml");
+        }
+    }
+
+    const compressed_types = [_][]const u8{
+        "application/gzip",
+        "application/x-gzip",
+        "application/zip",
+        "application/zstd",
+        "application/x-bzip2",
+        "application/x-xz",
+        "application/x-7z-compressed",
+        "application/vnd.rar",
+        "font/woff",
+        "font/woff2",
+    };
+    for (compressed_types) |compressed| {
+        if (std.ascii.eqlIgnoreCase(media_type, compressed)) return true;
+    }
+    return false;
+}
+
+/// Gzip the body in place when compression is enabled, the body is at least
+/// `min_size` bytes, it isn't already encoded or of a compressed type, and
+/// the client accepts gzip. The body is replaced with one in the request
+/// arena; Content-Length is derived from it when the response is sent.
+pub fn gzipResponse(settings: CompressionConfig, request: *const Request, response: *Response) !void {
+    if (!settings.enabled or response.body.len == 0 or response.body.len < settings.min_size) return;
+    if (response.getHeader("Content-Encoding") != null) return;
+    if (response.getHeader("Content-Type")) |content_type| {
+        if (isCompressedType(content_type)) return;
+    }
+
+    // The body now depends on Accept-Encoding, whichever way this client goes
+    try response.appendHeader("Vary", "Accept-Encoding");
+    if (!acceptsGzip(request)) return;
+
+    var compressed = std.ArrayList(u8).init(response.arena);
+    var source = std.io.fixedBufferStream(response.body);
+    try std.compress.gzip.compress(source.reader(), compressed.writer(), .{});
+
+    try response.setHeader("Content-Encoding", "gzip");
+    // A length set by the rule describes the uncompressed body
+    _ = response.headers.remove("Content-Length");
+    response.setBody(compressed.items);
+}
+
+fn testRequest(arena: std.mem.Allocator, accept_encoding: ?[]const u8) !Request {
+    var request = Request{
+        .method = .GET,
+        .path = "/",
+        .query = "",
+        .headers = HeaderMap.init(arena),
+        .body = "",
+        .arena = arena,
+    };
+    if (accept_encoding) |value| try request.headers.put("Accept-Encoding", value);
+    return request;
+}
+
+test "acceptsGzip" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const a = arena.allocator();
+
+    try std.testing.expect(acceptsGzip(&try testRequest(a, "gzip")));
+    try std.testing.expect(acceptsGzip(&try testRequest(a, "deflate, GZIP;q=0.8")));
+    try std.testing.expect(acceptsGzip(&try testRequest(a, "br, *")));
+    try std.testing.expect(!acceptsGzip(&try testRequest(a, null)));
+    try std.testing.expect(!acceptsGzip(&try testRequest(a, "br, deflate")));
+    try std.testing.expect(!acceptsGzip(&try testRequest(a, "gzip;q=0")));
+    try std.testing.expect(!acceptsGzip(&try testRequest(a, "gzip; q=0.0, *")));
+}
+
+test "gzipResponse" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const a = arena.allocator();
+
+    const body = "{\"items\": [" ++ "\"repeated\", " ** 100 ++ "\"last\"]}";
+    const settings = CompressionConfig{ .min_size = 64 };
+    const request = try testRequest(a, "gzip, deflate");
+
+    var response = Response.init(a, .ok);
+    try response.setHeader("Content-Type", "application/json");
+    try response.setHeader("Content-Length", "9999");
+    response.setBody(body);
+    try gzipResponse(settings, &request, &response);
+
+    try std.testing.expectEqualStrings("gzip", response.getHeader("Content-Encoding").?);
+    try std.testing.expectEqualStrings("Accept-Encoding", response.getHeader("Vary").?);
+    try std.testing.expect(response.getHeader("Content-Length") == null);
+    try std.testing.expect(response.body.len < body.len);
+
+    var decompressed = std.ArrayList(u8).init(a);
+    var compressed = std.io.fixedBufferStream(response.body);
+    try std.compress.gzip.decompress(compressed.reader(), decompressed.writer());
+    try std.testing.expectEqualStrings(body, decompressed.items);
+
+    // Small bodies, compressed types and clients without gzip get the body as is
+    var small = Response.init(a, .ok);
+    small.setBody("{}");
+    try gzipResponse(settings, &request, &small);
+    try std.testing.expect(small.getHeader("Content-Encoding") == null);
+
+    var image = Response.init(a, .ok);
+    try image.setHeader("Content-Type", "image/png");
+    image.setBody(body);
+    try gzipResponse(settings, &request, &image);
+    try std.testing.expect(image.getHeader("Content-Encoding") == null);
+    try std.testing.expectEqualStrings(body, image.body);
+
+    var plain = Response.init(a, .ok);
+    try plain.setHeader("Vary", "Origin");
+    plain.setBody(body);
+    try gzipResponse(settings, &try testRequest(a, null), &plain);
+    try std.testing.expect(plain.getHeader("Content-Encoding") == null);
+    try std.testing.expectEqualStrings("Origin, Accept-Encoding", plain.getHeader("Vary").?);
+}
@@ -0,0 +1,175 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+
+const Request = interfaces.Request;
+const Response = interfaces.Response;
+const HeaderMap = interfaces.HeaderMap;
+
+/// Validators a mock response carries for conditional requests
+pub const Validators = struct {
+    /// Send an `ETag` derived from the body
+    etag: bool = false,
+    /// `Last-Modified` value, an HTTP date validation has already checked
+    last_modified: ?[]const u8 = null,
+};
+
+/// Strong entity tag for a body, e.g. `"5f2b0c8e1a9d4e77"`. The hash is of
+/// the bytes as sent, so a gzipped body gets a tag of its own.
+pub fn etagFor(allocator: std.mem.Allocator, body: []const u8) ![]u8 {
+    return std.fmt.allocPrint(allocator, "\"{x:0>16}\"", .{std.hash.Wyhash.hash(0, body)});
+}
+
+/// Add the validators to a finished response, and turn it into an empty
+/// `304 Not Modified` when the request's `If-None-Match`, or failing that
+/// `If-Modified-Since`, shows the client's copy is current. Only successful
+/// GET and HEAD responses are conditional.
+pub fn apply(validators: Validators, request: *const Request, response: *Response) !void {
+    const etag = if (validators.etag) try etagFor(request.arena, response.body) else null;
+    if (etag) |tag| try response.setHeader("ETag", tag);
+    if (validators.last_modified) |date| try response.setHeader("Last-Modified", date);
+
+    if (response.status != .ok or (request.method != .GET and request.method != .HEAD)) return;
+    if (isNotModified(request, etag, validators.last_modified)) {
+        response.status = .not_modified;
+        response.setBody("");
+    }
+}
+
+fn isNotModified(request: *const Request, etag: ?[]const u8, last_modified: ?[]const u8) bool {
+    // If-Modified-Since is ignored when If-None-Match is present
+    if (request.getHeader("If-None-Match")) |if_none_match| {
+        const tag = etag orelse return false;
+        return anyTagMatches(if_none_match, tag);
+    }
+    const if_modified_since = request.getHeader("If-Modified-Since") orelse return false;
+    const modified = parseHttpDate(last_modified orelse return false) orelse return false;
+    const since = parseHttpDate(if_modified_since) orelse return false;
+    return modified <= since;
+}
+
+/// Weak comparison against a comma-separated tag list, where `*` matches any tag
+fn anyTagMatches(list: []const u8, etag: []const u8) bool {
+    var tags = std.mem.splitScalar(u8, list, ',');
+    while (tags.next()) |entry| {
+        const tag = std.mem.trim(u8, entry, " \t");
+        if (std.mem.eql(u8, tag, "*")) return true;
+        if (std.mem.eql(u8, withoutWeakPrefix(tag), withoutWeakPrefix(etag))) return true;
+    }
+    return false;
+}
+
+fn withoutWeakPrefix(tag: []const u8) []const u8 {
+    return if (std.mem.startsWith(u8, tag, "W/")) tag[2..] else tag;
+}
+
+/// Seconds since the epoch for an HTTP date in the preferred IMF-fixdate
+/// form, such as `Sun, 06 Nov 1994 08:49:37 GMT`; null for anything else
+pub fn parseHttpDate(text: []const u8) ?i64 {
+    const date = std.mem.trim(u8, text, " \t");
+    // "Sun, 06 Nov 1994 08:49:37 GMT"
+    if (date.len != 29 or date[3] != ',' or date[4] != ' ' or date[7] != ' ' or date[11] != ' ' or
+        date[16] != ' ' or date[19] != ':' or date[22] != ':' or !std.mem.eql(u8, date[25..], " GMT"))
+    {
+        return null;
+    }
+
+    const months = [_][]const u8{ "Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec" };
+    const month: u8 = for (months, 1..) |name, number| {
+        if (std.mem.eql(u8, date[8..11], name)) break @intCast(number);
+    } else return null;
+
+    const day = std.fmt.parseInt(u8, date[5..7], 10) catch return null;
+    const year = std.fmt.parseInt(u16, date[12..16], 10) catch return null;
+    const hour = std.fmt.parseInt(u8, date[17..19], 10) catch return null;
+    const minute = std.fmt.parseInt(u8, date[20..22], 10) catch return null;
+    const second = std.fmt.parseInt(u8, date[23..25], 10) catch return null;
+    if (year < 1970 or day < 1 or hour > 23 or minute > 59 or second > 60) return null;
+    const month_days = std.time.epoch.getDaysInMonth(year, @enumFromInt(month));
+    if (day > month_days) return null;
+
+    var days: i64 = 0;
+    var y: u16 = 1970;
+    while (y < year) : (y += 1) {
+        days += std.time.epoch.getDaysInYear(y);
+    }
+    var m: u8 = 1;
+    while (m < month) : (m += 1) {
+        days += std.time.epoch.getDaysInMonth(year, @enumFromInt(m));
+    }
+    days += day - 1;
+    return days * std.time.s_per_day + @as(i64, hour) * 3600 + @as(i64, minute) * 60 + second;
+}
+
+fn testRequest(arena: std.mem.Allocator, method: interfaces.Method) Request {
+    return Request{
+        .method = method,
+        .path = "/",
+        .query = "",
+        .headers = HeaderMap.init(arena),
+        .body = "",
+        .arena = arena,
+    };
+}
+
+test "parseHttpDate" {
+    try std.testing.expectEqual(@as(?i64, 784111777), parseHttpDate("Sun, 06 Nov 1994 08:49:37 GMT"));
+    try std.testing.expectEqual(@as(?i64, 951782400), parseHttpDate("Tue, 29 Feb 2000 00:00:00 GMT"));
+    try std.testing.expectEqual(@as(?i64, null), parseHttpDate("Sunday, 06-Nov-94 08:49:37 GMT"));
+    try std.testing.expectEqual(@as(?i64, null), parseHttpDate("Thu, 30 Feb 2023 00:00:00 GMT"));
+    try std.testing.expectEqual(@as(?i64, null), parseHttpDate("Sun, 06 Nov 1994 08:49:37 UTC"));
+}
+
+test "apply answers a matching If-None-Match with 304" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const a = arena.allocator();
+
+    var request = testRequest(a, .GET);
+    var first = Response.init(a, .ok);
+    first.setBody("{\"id\": 1}");
+    try apply(.{ .etag = true }, &request, &first);
+    try std.testing.expectEqual(interfaces.Status.ok, first.status);
+    const etag = first.getHeader("ETag").?;
+
+    try request.headers.put("If-None-Match", try std.fmt.allocPrint(a, "\"other\", W/{s}", .{etag}));
+    var second = Response.init(a, .ok);
+    second.setBody("{\"id\": 1}");
+    try apply(.{ .etag = true }, &request, &second);
+    try std.testing.expectEqual(interfaces.Status.not_modified, second.status);
+    try std.testing.expectEqualStrings("", second.body);
+    try std.testing.expectEqualStrings(etag, second.getHeader("ETag").?);
+
+    // A changed body gets a new tag, and other methods are never conditional
+    var changed = Response.init(a, .ok);
+    changed.setBody("{\"id\": 2}");
+    try apply(.{ .etag = true }, &request, &changed);
+    try std.testing.expectEqual(interfaces.Status.ok, changed.status);
+    request.method = .POST;
+    var post = Response.init(a, .ok);
+    post.setBody("{\"id\": 1}");
+    try apply(.{ .etag = true }, &request, &post);
+    try std.testing.expectEqual(interfaces.Status.ok, post.status);
+}
+
+test "apply compares If-Modified-Since with Last-Modified" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const a = arena.allocator();
+
+    const validators = Validators{ .last_modified = "Wed, 01 Mar 2023 12:00:00 GMT" };
+    const cases = [_]struct { since: []const u8, status: interfaces.Status }{
+        .{ .since = "Wed, 01 Mar 2023 12:00:00 GMT", .status = .not_modified },
+        .{ .since = "Thu, 02 Mar 2023 08:00:00 GMT", .status = .not_modified },
+        .{ .since = "Tue, 28 Feb 2023 12:00:00 GMT", .status = .ok },
+        .{ .since = "yesterday", .status = .ok },
+    };
+    for (cases) |case| {
+        var request = testRequest(a, .GET);
+        try request.headers.put("If-Modified-Since", case.since);
+        var response = Response.init(a, .ok);
+        response.setBody("hello");
+        try apply(validators, &request, &response);
+        try std.testing.expectEqual(case.status, response.status);
+        try std.testing.expectEqualStrings("Wed, 01 Mar 2023 12:00:00 GMT", response.getHeader("Last-Modified").?);
+    }
+}
@@ -1,565 +1,5629 @@
 const std = @import("std");
 const yaml = @import("yaml");
+const interfaces = @import("http/interfaces.zig");
+const json_path = @import("json_path.zig");
+const Regex = @import("regex.zig").Regex;
+const Schema = @import("json_schema.zig").Schema;
+const template = @import("template.zig");
+const FileCache = @import("file_cache.zig").FileCache;
+const jsonrpc = @import("jsonrpc.zig");
+const conditional_get = @import("conditional_get.zig");
+const faker = @import("faker.zig");
+const RateLimiter = @import("rate_limit.zig").RateLimiter;
+const Quota = @import("rate_limit.zig").Quota;
+const IpRange = @import("client_ip.zig").IpRange;
+const remote_config = @import("remote_config.zig");
+const Charset = @import("charset.zig").Charset;
+const static_files = @import("static_files.zig");
+
+const Request = interfaces.Request;
+const Response = interfaces.Response;
+const Protocol = interfaces.Protocol;
+
+/// Free an owned string map and all of its keys and values
+fn deinitStringMap(allocator: std.mem.Allocator, map: *std.StringHashMap([]const u8)) void {
+    var iter = map.iterator();
+    while (iter.next()) |entry| {
+        allocator.free(entry.key_ptr.*);
+        allocator.free(entry.value_ptr.*);
+    }
+    map.deinit();
+}
+
+/// Copy a string map and all of its keys and values into `allocator`
+fn dupeStringMap(allocator: std.mem.Allocator, map: std.StringHashMap([]const u8)) !std.StringHashMap([]const u8) {
+    var copy = std.StringHashMap([]const u8).init(allocator);
+    var iter = map.iterator();
+    while (iter.next()) |entry| {
+        try copy.put(try allocator.dupe(u8, entry.key_ptr.*), try allocator.dupe(u8, entry.value_ptr.*));
+    }
+    return copy;
+}
 
 /// Configuration for a single request rule
+/// HTTP Basic credentials a request must present to reach the rule
+pub const BasicAuth = struct {
+    username: []const u8,
+    password: []const u8,
+    /// Realm named in the `WWW-Authenticate` challenge
+    realm: ?[]const u8 = null,
+
+    pub fn deinit(self: *BasicAuth, allocator: std.mem.Allocator) void {
+        allocator.free(self.username);
+        allocator.free(self.password);
+        if (self.realm) |realm| {
+            allocator.free(realm);
+        }
+    }
+};
+
+/// Bounds on a request body's length in bytes, both included, for `body_size:`
+pub const BodySize = struct {
+    min: usize = 0,
+    max: ?usize = null,
+
+    pub fn contains(self: BodySize, len: usize) bool {
+        if (len < self.min) return false;
+        return if (self.max) |max| len <= max else true;
+    }
+};
+
 pub const RequestRule = struct {
+    /// Empty when the rule matches on `path_regex` or `path_prefix` instead
     path: []const u8,
-    method: []const u8,
+    /// Regular expression the whole request path must match
+    path_regex: ?[]const u8 = null,
+    /// Path the request must equal or lie under, segment by segment
+    path_prefix: ?[]const u8 = null,
+    /// Number of non-empty segments the request path must have, so 3 takes
+    /// "/api/v1/users" but not "/api/v1". Without a path it stands in for
+    /// `path: "*"`.
+    path_segments: ?u32 = null,
+    /// Compiled `path_regex`; null if the pattern is invalid, which validation reports
+    regex: ?Regex = null,
+    /// Upper-cased HTTP methods the rule accepts; "*" accepts any method
+    methods: []const []const u8,
     headers: ?std.StringHashMap([]const u8) = null,
+    /// Headers the request must not carry, whatever their value; names are
+    /// compared case-insensitively
+    headers_absent: ?[]const []const u8 = null,
+    /// Query parameters that must be present with the given (decoded) values
+    query: ?std.StringHashMap([]const u8) = null,
+    /// Cookies that must be present with the given (decoded) values
+    cookies: ?std.StringHashMap([]const u8) = null,
+    /// Exact request body
     body: ?[]const u8 = null,
+    /// Regular expression the whole request body must match
+    body_regex: ?[]const u8 = null,
+    /// Compiled `body_regex`; null if the pattern is invalid, which validation reports
+    body_pattern: ?Regex = null,
+    /// Length the body must have, as received and before any charset decoding
+    body_size: ?BodySize = null,
+    /// JSON paths (e.g. `$.type`) that must hold the given scalar values
+    body_json: ?std.StringHashMap([]const u8) = null,
+    /// Form fields that must be present with the given (decoded) values, taken
+    /// from a form-encoded body or the query string
+    form: ?std.StringHashMap([]const u8) = null,
+    /// Parts of a `multipart/form-data` body that must be present: a file
+    /// part matches on its filename, any other part on its contents
+    multipart: ?std.StringHashMap([]const u8) = null,
+    /// JSON-RPC 2.0 method the body must call; calls of a batch are matched one by one
+    jsonrpc: ?[]const u8 = null,
+    /// Media type the request's Content-Type must have; parameters such as
+    /// `charset` are ignored on both sides
+    content_type: ?[]const u8 = null,
+    /// Address or CIDR block the client must be in, e.g. `10.0.0.0/8`
+    client_ip: ?[]const u8 = null,
+    /// Parsed `client_ip`; null if it is invalid, which validation reports
+    client_range: ?IpRange = null,
+    /// HTTP version the request must arrive over, e.g. `1.1`
+    proto: ?[]const u8 = null,
+    /// Parsed `proto`; null if it is invalid, which validation reports
+    proto_version: ?Protocol = null,
+    /// Credentials required once the rule matches; others get a 401
+    auth: ?BasicAuth = null,
+    /// Largest body in bytes the rule accepts once it matches; larger ones get a 413
+    max_body_size: ?usize = null,
+    /// Error text of that 413 in place of the default
+    max_body_message: ?[]const u8 = null,
+    /// Requests allowed per window once the rule matches; more get a 429.
+    /// Heap-allocated so every copy of the rule draws from one bucket.
+    rate_limit: ?*RateLimiter = null,
+    /// Set from the rule's `seed:`, so its faults, weighted picks, faker
+    /// bodies and template helpers draw from their own sequence. Kept here,
+    /// with `rate_limit`, because response handling only sees this part of
+    /// the rule; heap-allocated so copies of the rule share it.
+    random_source: ?*SeededRandom = null,
+    /// Set from the rule's `request_charset:`; the body is decoded from it
+    /// before this rule's conditions and templates see it, in place of
+    /// `Config.request_charset`
+    charset: ?Charset = null,
+
+    /// Whether a request with the given method can match this rule
+    pub fn allowsMethod(self: *const RequestRule, method: []const u8) bool {
+        for (self.methods) |allowed| {
+            if (std.mem.eql(u8, allowed, "*") or std.ascii.eqlIgnoreCase(allowed, method)) return true;
+        }
+        return false;
+    }
+
+    /// The path or pattern, for messages and logs
+    pub fn displayPath(self: *const RequestRule) []const u8 {
+        return self.path_regex orelse self.path_prefix orelse self.path;
+    }
 
     pub fn deinit(self: *RequestRule, allocator: std.mem.Allocator) void {
         allocator.free(self.path);
-        allocator.free(self.method);
+        if (self.path_regex) |pattern| {
+            allocator.free(pattern);
+        }
+        if (self.path_prefix) |prefix| {
+            allocator.free(prefix);
+        }
+        if (self.regex) |*regex| {
+            regex.deinit();
+        }
+        if (self.body_regex) |pattern| {
+            allocator.free(pattern);
+        }
+        if (self.body_pattern) |*regex| {
+            regex.deinit();
+        }
+        freeStringList(allocator, self.methods);
         if (self.headers) |*headers| {
-            var iter = headers.iterator();
-            while (iter.next()) |entry| {
-                allocator.free(entry.key_ptr.*);
-                allocator.free(entry.value_ptr.*);
-            }
-            headers.deinit();
+            deinitStringMap(allocator, headers);
+        }
+        if (self.headers_absent) |names| {
+            freeStringList(allocator, names);
+        }
+        if (self.query) |*query| {
+            deinitStringMap(allocator, query);
+        }
+        if (self.cookies) |*cookies| {
+            deinitStringMap(allocator, cookies);
         }
         if (self.body) |body| {
             allocator.free(body);
         }
+        if (self.body_json) |*body_json| {
+            deinitStringMap(allocator, body_json);
+        }
+        if (self.form) |*form| {
+            deinitStringMap(allocator, form);
+        }
+        if (self.multipart) |*multipart| {
+            deinitStringMap(allocator, multipart);
+        }
+        if (self.jsonrpc) |method| {
+            allocator.free(method);
+        }
+        if (self.content_type) |content_type| {
+            allocator.free(content_type);
+        }
+        if (self.client_ip) |client_ip| {
+            allocator.free(client_ip);
+        }
+        if (self.proto) |proto| {
+            allocator.free(proto);
+        }
+        if (self.auth) |*auth| {
+            auth.deinit(allocator);
+        }
+        if (self.max_body_message) |message| {
+            allocator.free(message);
+        }
+        if (self.rate_limit) |limiter| {
+            allocator.destroy(limiter);
+        }
+        if (self.random_source) |source| {
+            allocator.destroy(source);
+        }
     }
 };
 
 /// Configuration for a mock response
 pub const MockResponse = struct {
     status: u16 = 200,
+    /// Status written as a template such as `"{{.Params.code}}"`, rendered per
+    /// request in place of `status`
+    status_template: ?[]const u8 = null,
     headers: ?std.StringHashMap([]const u8) = null,
+    /// Sent after the body, for protocols such as gRPC that report status in
+    /// trailers. Values containing `{{` are rendered like headers.
+    trailers: ?std.StringHashMap([]const u8) = null,
     body: []const u8,
+    /// Render the body as a template. When unset, bodies containing `{{` are templated.
+    template: ?bool = null,
+    /// File to read the body from at request time, resolved relative to the config file.
+    /// `body_template_file` sets this along with `template: true`.
+    body_file: ?[]const u8 = null,
+    /// Time to wait before responding, parsed from durations like "250ms" or "2s"
+    delay_ms: u64 = 0,
+    /// Failure served instead of this response on a random share of requests
+    fault: ?Fault = null,
+    /// JSON Schema file the body must satisfy, resolved relative to the config file
+    body_schema: ?[]const u8 = null,
+    /// Loaded `body_schema`
+    schema: ?*Schema = null,
+    /// Allow gzip encoding for clients that accept it; `compress: false` sends the body as is
+    compress: bool = true,
+    /// Relative chance of being picked from a rule's `responses` list
+    weight: f64 = 1,
+    /// Body sent in pieces with a pause before each, in place of `body`
+    stream: ?[]StreamChunk = null,
+    /// Alternatives tried top to bottom; the first whose condition holds is
+    /// served instead of this response, which is the fallback
+    when: ?[]ResponseBranch = null,
+    /// Sent as `Set-Cookie` headers, one per entry
+    cookies: ?[]ResponseCookie = null,
+    /// Wrap the body in a JSON-RPC 2.0 response echoing the request's `id`
+    jsonrpc: ?jsonrpc.Envelope = null,
+    /// Send an `ETag` hashed from the final body and answer a matching
+    /// `If-None-Match` with 304
+    etag: bool = false,
+    /// `Last-Modified` date, which `If-Modified-Since` is compared with
+    last_modified: ?[]const u8 = null,
+    /// Send `Location` with a 3xx status; `status` is taken from here
+    redirect: ?Redirect = null,
+    /// Upgrade to a WebSocket and play these messages instead of answering
+    websocket: ?WebSocketScript = null,
+    /// Send the body this many times over, for oversized payloads
+    repeat: u32 = 1,
+    /// Send only this many bytes of the body under a `Content-Length` for the
+    /// whole of it, then close the connection, so the client gets a short read
+    truncate: ?u64 = null,
+    /// Send this `Content-Length` whatever the body's actual length, then
+    /// close the connection; a deliberately malformed response for testing
+    /// how clients handle framing
+    content_length: ?u64 = null,
+    /// Drop the connection with a TCP reset after `delay` instead of
+    /// answering, so clients hit their network-error path
+    connection_reset: bool = false,
+    /// True sends `Connection: close` and closes the connection after the
+    /// response, so the client has to reconnect; false keeps it alive
+    close_connection: ?bool = null,
+    /// JSON shape whose `{{name}}`, `{{int:1:10}}` and similar hints are
+    /// filled with fake values per request, in place of `body`
+    faker: ?[]const u8 = null,
+    /// Seed for `faker`, so every request gets the same values
+    faker_seed: ?u64 = null,
+    /// Bodies in several content types, picked per request by `Accept`, in
+    /// place of `body`
+    variants: ?[]ResponseVariant = null,
+    /// Used when `Accept` rules out every variant
+    variant_fallback: VariantFallback = .first,
+    /// Send the request body back, in place of `body`
+    echo_body: ?EchoBody = null,
+    /// Reformat a JSON body before sending; bodies that aren't JSON go as is
+    json_format: JsonFormat = .raw,
+    /// Encode the body in this charset and name it in `Content-Type`
+    charset: ?Charset = null,
+    /// Cap on the requests this response answers, counted before `when`
+    /// is evaluated
+    quota: ?ResponseQuota = null,
+
+    /// The response to serve for `request`, after evaluating `when`
+    pub fn select(self: *const MockResponse, request: *const Request) !*const MockResponse {
+        const branches = self.when orelse return self;
+        for (branches) |*branch| {
+            if (try branch.condition.matches(request)) return &branch.response;
+        }
+        return self;
+    }
+
+    pub fn isTemplated(self: *const MockResponse) bool {
+        return self.template orelse (std.mem.indexOf(u8, self.body, "{{") != null);
+    }
+
+    /// Header values containing `{{` are rendered per request
+    pub fn isTemplatedHeader(value: []const u8) bool {
+        return std.mem.indexOf(u8, value, "{{") != null;
+    }
+
+    /// Whether the body is only known at request time, so `body_schema` has
+    /// to be checked per request rather than once at load
+    pub fn hasDynamicBody(self: *const MockResponse) bool {
+        return self.body_file != null or self.faker != null or self.echo_body != null or self.isTemplated();
+    }
 
     pub fn deinit(self: *MockResponse, allocator: std.mem.Allocator) void {
+        if (self.status_template) |status_template| {
+            allocator.free(status_template);
+        }
         if (self.headers) |*headers| {
-            var iter = headers.iterator();
-            while (iter.next()) |entry| {
-                allocator.free(entry.key_ptr.*);
-                allocator.free(entry.value_ptr.*);
-            }
-            headers.deinit();
+            deinitStringMap(allocator, headers);
+        }
+        if (self.trailers) |*trailers| {
+            deinitStringMap(allocator, trailers);
         }
         allocator.free(self.body);
+        if (self.body_file) |body_file| {
+            allocator.free(body_file);
+        }
+        if (self.body_schema) |body_schema| {
+            allocator.free(body_schema);
+        }
+        if (self.last_modified) |last_modified| {
+            allocator.free(last_modified);
+        }
+        if (self.faker) |shape| {
+            allocator.free(shape);
+        }
+        if (self.variants) |variants| {
+            for (variants) |*variant| {
+                variant.deinit(allocator);
+            }
+            allocator.free(variants);
+        }
+        if (self.redirect) |redirect| {
+            allocator.free(redirect.url);
+        }
+        if (self.echo_body) |echo_body| {
+            if (echo_body.wrap) |key| allocator.free(key);
+        }
+        if (self.websocket) |*websocket| {
+            websocket.deinit(allocator);
+        }
+        if (self.schema) |schema| {
+            schema.deinit();
+            allocator.destroy(schema);
+        }
+        if (self.quota) |*quota| {
+            quota.deinit(allocator);
+        }
+        if (self.when) |branches| {
+            for (branches) |*branch| {
+                branch.deinit(allocator);
+            }
+            allocator.free(branches);
+        }
+        if (self.stream) |chunks| {
+            for (chunks) |chunk| {
+                allocator.free(chunk.data);
+            }
+            allocator.free(chunks);
+        }
+        if (self.cookies) |cookies| {
+            for (cookies) |*cookie| {
+                cookie.deinit(allocator);
+            }
+            allocator.free(cookies);
+        }
+    }
+
+    /// Whether every chunk of `stream` starts with a server-sent event field,
+    /// in which case the response defaults to `text/event-stream`
+    pub fn isEventStream(self: *const MockResponse) bool {
+        const chunks = self.stream orelse return false;
+        const fields = [_][]const u8{ "data:", "event:", "id:", "retry:", ":" };
+        for (chunks) |chunk| {
+            const is_event = for (fields) |field| {
+                if (std.mem.startsWith(u8, chunk.data, field)) break true;
+            } else false;
+            if (!is_event) return false;
+        }
+        return true;
     }
 };
 
-/// Configuration for a proxy
-pub const ProxyConfig = struct {
-    url: []const u8,
-    headers: ?std.StringHashMap([]const u8) = null,
-    timeout_ms: u64 = 30000,
+/// One entry of a response's `cookies:` list
+pub const ResponseCookie = struct {
+    name: []const u8,
+    /// Rendered as a template when it contains `{{`
+    value: []const u8,
+    path: ?[]const u8 = null,
+    /// Seconds; zero or less tells the client to delete the cookie
+    max_age: ?i64 = null,
+    http_only: bool = false,
+    secure: bool = false,
+    same_site: ?interfaces.SetCookie.SameSite = null,
 
-    pub fn deinit(self: *ProxyConfig, allocator: std.mem.Allocator) void {
-        allocator.free(self.url);
-        if (self.headers) |*headers| {
-            var iter = headers.iterator();
-            while (iter.next()) |entry| {
-                allocator.free(entry.key_ptr.*);
-                allocator.free(entry.value_ptr.*);
-            }
-            headers.deinit();
-        }
+    pub fn isTemplated(self: *const ResponseCookie) bool {
+        return std.mem.indexOf(u8, self.value, "{{") != null;
+    }
+
+    pub fn deinit(self: *ResponseCookie, allocator: std.mem.Allocator) void {
+        allocator.free(self.name);
+        allocator.free(self.value);
+        if (self.path) |path| allocator.free(path);
     }
 };
 
-/// A single rule that can either mock a response or proxy to another service
-pub const Rule = struct {
-    request: RequestRule,
-    response: ?MockResponse = null,
-    proxy: ?ProxyConfig = null,
+/// A rule's own random number generator, safe to share between handler threads
+pub const SeededRandom = struct {
+    seed: u64,
+    prng: std.Random.DefaultPrng,
+    mutex: std.Thread.Mutex = .{},
 
-    pub fn init(request: RequestRule) Rule {
-        return Rule{ .request = request };
+    pub fn init(seed: u64) SeededRandom {
+        return SeededRandom{ .seed = seed, .prng = std.Random.DefaultPrng.init(seed) };
     }
 
-    pub fn withMockResponse(self: Rule, response: MockResponse) Rule {
-        var new_rule = self;
-        new_rule.response = response;
-        return new_rule;
+    pub fn random(self: *SeededRandom) std.Random {
+        return std.Random.init(self, fill);
     }
 
-    pub fn withProxy(self: Rule, proxy: ProxyConfig) Rule {
-        var new_rule = self;
-        new_rule.proxy = proxy;
-        return new_rule;
+    fn fill(self: *SeededRandom, buf: []u8) void {
+        self.mutex.lock();
+        defer self.mutex.unlock();
+        self.prng.fill(buf);
     }
+};
 
-    pub fn isMock(self: *const Rule) bool {
-        return self.response != null;
+/// One entry of a response's `variants:`, served to clients whose `Accept`
+/// header prefers its content type
+pub const ResponseVariant = struct {
+    content_type: []const u8,
+    body: []const u8,
+
+    pub fn deinit(self: *ResponseVariant, allocator: std.mem.Allocator) void {
+        allocator.free(self.content_type);
+        allocator.free(self.body);
     }
+};
 
-    pub fn isProxy(self: *const Rule) bool {
-        return self.proxy != null;
+/// What a response with `variants:` sends when `Accept` allows none of them
+pub const VariantFallback = enum {
+    /// The first variant, as though the client accepted anything
+    first,
+    /// 406 Not Acceptable
+    not_acceptable,
+};
+
+/// A response's `quota:`. The count is shared by every request the
+/// response answers and starts over when the config is reloaded.
+pub const ResponseQuota = struct {
+    counter: *Quota,
+    /// Served once the quota is used up, in place of a 429
+    exceeded: ?*MockResponse = null,
+
+    pub fn deinit(self: *ResponseQuota, allocator: std.mem.Allocator) void {
+        allocator.destroy(self.counter);
+        if (self.exceeded) |exceeded| {
+            exceeded.deinit(allocator);
+            allocator.destroy(exceeded);
+        }
     }
+};
 
-    pub fn deinit(self: *Rule, allocator: std.mem.Allocator) void {
-        self.request.deinit(allocator);
-        if (self.response) |*response| {
-            response.deinit(allocator);
+/// How a response's `json_format:` rewrites a JSON body before sending
+pub const JsonFormat = enum {
+    /// As written
+    raw,
+    /// Indented by two spaces
+    pretty,
+    /// Without whitespace between tokens
+    compact,
+};
+
+/// A response's `redirect:` shortcut, which sets the status and `Location`
+pub const Redirect = struct {
+    /// Rendered as a template when it contains `{{`
+    url: []const u8,
+    /// Must be a 3xx status, which validation checks
+    status: u16 = 302,
+
+    pub fn isTemplated(self: *const Redirect) bool {
+        return std.mem.indexOf(u8, self.url, "{{") != null;
+    }
+};
+
+/// A response's `echo_body:` shortcut, which sends the request body back
+pub const EchoBody = struct {
+    /// Key of a JSON object to wrap the body in, so `received` sends
+    /// `{"received": <body>}`; null sends the body as it came
+    wrap: ?[]const u8 = null,
+
+    /// The response body for a request's `body`, allocated in `arena` only
+    /// when wrapped. A JSON body is nested as it is and anything else as a
+    /// string.
+    pub fn render(self: EchoBody, arena: std.mem.Allocator, body: []const u8) ![]const u8 {
+        const key = self.wrap orelse return body;
+        var out = std.ArrayList(u8).init(arena);
+        const writer = out.writer();
+        try writer.writeByte('{');
+        try std.json.encodeJsonString(key, .{}, writer);
+        try writer.writeAll(": ");
+        if (try std.json.validate(arena, body)) {
+            try writer.writeAll(std.mem.trim(u8, body, " \t\r\n"));
+        } else {
+            try std.json.encodeJsonString(body, .{}, writer);
         }
-        if (self.proxy) |*proxy| {
-            proxy.deinit(allocator);
+        try writer.writeByte('}');
+        return out.items;
+    }
+};
+
+/// One entry of a response's `stream:` list
+pub const StreamChunk = struct {
+    data: []const u8,
+    /// Pause before this chunk is sent, parsed like `MockResponse.delay_ms`
+    delay_ms: u64 = 0,
+};
+
+/// A response's `websocket:` section. Upgrade requests are switched to a
+/// WebSocket that is sent `messages` in order, each after its delay.
+pub const WebSocketScript = struct {
+    messages: []StreamChunk,
+    /// Send inbound messages back; the connection then stays open after the
+    /// script until the client closes it, rather than being closed by popshop
+    echo: bool = false,
+
+    pub fn deinit(self: *WebSocketScript, allocator: std.mem.Allocator) void {
+        for (self.messages) |message| {
+            allocator.free(message.data);
         }
+        allocator.free(self.messages);
     }
 };
 
-/// Complete configuration for the popshop server
-pub const Config = struct {
-    rules: std.ArrayList(Rule),
-    allocator: std.mem.Allocator,
+/// One entry of a response's `when:` list
+pub const ResponseBranch = struct {
+    condition: Condition,
+    response: MockResponse,
 
-    pub fn init(allocator: std.mem.Allocator) Config {
-        return Config{
-            .rules = std.ArrayList(Rule).init(allocator),
-            .allocator = allocator,
-        };
+    pub fn deinit(self: *ResponseBranch, allocator: std.mem.Allocator) void {
+        self.condition.deinit(allocator);
+        self.response.deinit(allocator);
     }
+};
 
-    pub fn deinit(self: *Config) void {
-        for (self.rules.items) |*rule| {
-            rule.deinit(self.allocator);
+/// Test on the request for a `when:` branch. Exactly one of `header`,
+/// `query` and `body_contains` is set, which validation checks.
+pub const Condition = struct {
+    /// Header that must be present, case-insensitive
+    header: ?[]const u8 = null,
+    /// Query parameter that must be present
+    query: ?[]const u8 = null,
+    /// Text the raw request body must contain
+    body_contains: ?[]const u8 = null,
+    /// Value the header or query parameter must have, rather than just being present
+    equals: ?[]const u8 = null,
+
+    pub fn matches(self: *const Condition, request: *const Request) !bool {
+        if (self.header) |name| {
+            const value = request.getHeader(name) orelse return false;
+            return if (self.equals) |expected| std.mem.eql(u8, value, expected) else true;
         }
-        self.rules.deinit();
+        if (self.query) |name| {
+            // Any occurrence of a repeated parameter can satisfy it
+            var params = request.queryParams();
+            while (try params.next()) |param| {
+                if (!std.mem.eql(u8, param.name, name)) continue;
+                if (self.equals) |expected| {
+                    if (std.mem.eql(u8, param.value, expected)) return true;
+                } else return true;
+            }
+            return false;
+        }
+        if (self.body_contains) |needle| {
+            return std.mem.indexOf(u8, request.body, needle) != null;
+        }
+        return false;
     }
 
-    pub fn addRule(self: *Config, rule: Rule) !void {
-        try self.rules.append(rule);
+    pub fn deinit(self: *Condition, allocator: std.mem.Allocator) void {
+        if (self.header) |header| allocator.free(header);
+        if (self.query) |query| allocator.free(query);
+        if (self.body_contains) |body_contains| allocator.free(body_contains);
+        if (self.equals) |equals| allocator.free(equals);
     }
+};
 
-    /// Load configuration from YAML file or directory
-    pub fn loadFromFile(allocator: std.mem.Allocator, path: []const u8) !Config {
-        // Check if path is a file or directory
-        const stat = std.fs.cwd().statFile(path) catch |err| switch (err) {
-            error.FileNotFound => {
-                // Try as directory
-                return loadFromDirectory(allocator, path);
-            },
-            else => return err,
-        };
+/// Rewrite of the request path before it is sent upstream. Either a prefix
+/// swap (`strip_prefix` then `add_prefix`) or a `regex` whose `replacement`
+/// may refer to capture groups as `$1`..`$9`.
+pub const PathRewrite = struct {
+    strip_prefix: ?[]const u8 = null,
+    add_prefix: ?[]const u8 = null,
+    /// Pattern the whole path must match; paths that don't match are left alone
+    regex: ?[]const u8 = null,
+    /// Compiled `regex`; null if the pattern is invalid, which validation reports
+    compiled: ?Regex = null,
+    replacement: []const u8 = "",
 
-        switch (stat.kind) {
-            .file => return loadSingleFile(allocator, path),
-            .directory => return loadFromDirectory(allocator, path),
-            else => return error.InvalidPathType,
+    /// The rewritten path, allocated in `arena`. An empty result becomes "/".
+    pub fn apply(self: *const PathRewrite, arena: std.mem.Allocator, path: []const u8) ![]const u8 {
+        var rewritten = std.ArrayList(u8).init(arena);
+        if (self.regex != null) {
+            const regex = self.compiled orelse return path;
+            const captures = try arena.alloc(?[]const u8, regex.group_count + 1);
+            if (!try regex.match(arena, path, captures)) return path;
+            try expandReplacement(rewritten.writer(), self.replacement, captures);
+        } else {
+            var rest = path;
+            if (self.strip_prefix) |prefix| {
+                if (std.mem.startsWith(u8, path, prefix)) rest = path[prefix.len..];
+            }
+            if (self.add_prefix) |prefix| {
+                try rewritten.appendSlice(std.mem.trimRight(u8, prefix, "/"));
+                if (rest.len > 0 and rest[0] != '/') try rewritten.append('/');
+            }
+            try rewritten.appendSlice(rest);
         }
+
+        if (rewritten.items.len == 0) return "/";
+        return rewritten.items;
     }
 
-    /// Load configuration from a single YAML file
-    fn loadSingleFile(allocator: std.mem.Allocator, file_path: []const u8) !Config {
-        const file = try std.fs.cwd().openFile(file_path, .{});
-        defer file.close();
+    /// Copy `replacement`, substituting `$N` with capture group N (empty if
+    /// it did not take part) and `$$` with a literal `$`
+    fn expandReplacement(writer: anytype, replacement: []const u8, captures: []const ?[]const u8) !void {
+        var i: usize = 0;
+        while (i < replacement.len) : (i += 1) {
+            const c = replacement[i];
+            if (c != '$' or i + 1 >= replacement.len) {
+                try writer.writeByte(c);
+                continue;
+            }
+            const next = replacement[i + 1];
+            if (next == '$') {
+                try writer.writeByte('$');
+                i += 1;
+            } else if (std.ascii.isDigit(next)) {
+                const group = next - '0';
+                if (group < captures.len) {
+                    if (captures[group]) |text| try writer.writeAll(text);
+                }
+                i += 1;
+            } else {
+                try writer.writeByte(c);
+            }
+        }
+    }
 
-        const file_size = try file.getEndPos();
-        const content = try allocator.alloc(u8, file_size);
-        defer allocator.free(content);
+    pub fn deinit(self: *PathRewrite, allocator: std.mem.Allocator) void {
+        if (self.strip_prefix) |prefix| allocator.free(prefix);
+        if (self.add_prefix) |prefix| allocator.free(prefix);
+        if (self.regex) |pattern| allocator.free(pattern);
+        if (self.compiled) |*compiled| compiled.deinit();
+        allocator.free(self.replacement);
+    }
+};
 
-        _ = try file.readAll(content);
+/// Random failure injected in place of a mock response, for exercising client retries
+pub const Fault = struct {
+    /// Chance that a request faults, from 0.0 (never) to 1.0 (always)
+    probability: f64,
+    status: u16 = 500,
+    /// Time to wait before sending the fault, like `MockResponse.delay_ms`
+    delay_ms: u64 = 0,
 
-        return loadFromYaml(allocator, content);
+    /// Roll against `probability`
+    pub fn triggers(self: *const Fault, random: std.Random) bool {
+        if (self.probability <= 0) return false;
+        if (self.probability >= 1) return true;
+        return random.float(f64) < self.probability;
     }
+};
 
-    /// Load configuration from all YAML files in a directory
-    pub fn loadFromDirectory(allocator: std.mem.Allocator, dir_path: []const u8) !Config {
-        var config = Config.init(allocator);
-        errdefer config.deinit();
+/// A canned response named by `preset:`, filling in the status, body and
+/// headers a response leaves out
+pub const Preset = struct {
+    name: []const u8,
+    status: u16,
+    body: []const u8 = "",
+    headers: []const [2][]const u8 = &.{},
 
-        var dir = std.fs.cwd().openDir(dir_path, .{ .iterate = true }) catch |err| {
-            std.log.err("Failed to open directory {s}: {}", .{ dir_path, err });
-            return err;
-        };
-        defer dir.close();
+    const json = [_][2][]const u8{.{ "Content-Type", "application/json" }};
+    const json_retry = json ++ [_][2][]const u8{.{ "Retry-After", "1" }};
 
-        var iterator = dir.iterate();
-        var files_loaded: usize = 0;
+    pub const all = [_]Preset{
+        .{ .name = "json_ok", .status = 200, .body = "{\"ok\":true}", .headers = &json },
+        .{ .name = "json_list", .status = 200, .body = "[]", .headers = &json },
+        .{ .name = "created", .status = 201, .body = "{\"ok\":true}", .headers = &json },
+        .{ .name = "accepted", .status = 202, .body = "{\"ok\":true}", .headers = &json },
+        .{ .name = "no_content", .status = 204 },
+        .{ .name = "bad_request", .status = 400, .body = "{\"status\":400,\"error\":\"Bad Request\"}", .headers = &json },
+        .{ .name = "unauthorized", .status = 401, .body = "{\"status\":401,\"error\":\"Unauthorized\"}", .headers = &json },
+        .{ .name = "forbidden", .status = 403, .body = "{\"status\":403,\"error\":\"Forbidden\"}", .headers = &json },
+        .{ .name = "not_found", .status = 404, .body = "{\"status\":404,\"error\":\"Not Found\"}", .headers = &json },
+        .{ .name = "conflict", .status = 409, .body = "{\"status\":409,\"error\":\"Conflict\"}", .headers = &json },
+        .{ .name = "rate_limited", .status = 429, .body = "{\"status\":429,\"error\":\"Too Many Requests\"}", .headers = &json_retry },
+        .{ .name = "server_error", .status = 500, .body = "{\"status\":500,\"error\":\"Internal Server Error\"}", .headers = &json },
+        .{ .name = "unavailable", .status = 503, .body = "{\"status\":503,\"error\":\"Service Unavailable\"}", .headers = &json_retry },
+    };
 
-        while (try iterator.next()) |entry| {
-            // Only process .yaml and .yml files
-            if (entry.kind != .file) continue;
-            
-            const ext = std.fs.path.extension(entry.name);
-            if (!std.mem.eql(u8, ext, ".yaml") and !std.mem.eql(u8, ext, ".yml")) {
-                continue;
-            }
+    pub fn find(name: []const u8) ?*const Preset {
+        for (&all) |*preset| {
+            if (std.mem.eql(u8, preset.name, name)) return preset;
+        }
+        return null;
+    }
+};
 
-            std.log.info("Loading config file: {s}/{s}", .{ dir_path, entry.name });
+/// Top-level `merge_strategy:`, deciding what happens when a rule from a
+/// later file answers the same path and method as one from an earlier file
+/// brought in with `imports:`
+pub const MergeStrategy = enum {
+    /// Keep both; the earlier rule wins, as between files in a directory
+    append,
+    /// The later rule replaces the earlier one
+    override,
+    /// Fail the load
+    reject,
+};
 
-            // Load the file
-            const file = try dir.openFile(entry.name, .{});
-            defer file.close();
+/// Top-level `on_duplicate:`, deciding what happens to rules of the same
+/// priority that answer the same path and method with no header, query or
+/// body conditions to tell them apart
+pub const OnDuplicate = enum {
+    /// Report each pair as a validation error naming both definitions
+    @"error",
+    /// Keep the earlier rule and drop the later one
+    first_wins,
+    /// Keep the later rule and drop the earlier one
+    last_wins,
+    /// Keep both, the later rule answering only the methods the earlier
+    /// one doesn't; it is dropped when none are left
+    merge,
+};
 
-            const file_size = try file.getEndPos();
-            const content = try allocator.alloc(u8, file_size);
-            defer allocator.free(content);
+/// Top-level `compression:` section controlling gzip encoding of responses
+pub const CompressionConfig = struct {
+    enabled: bool = true,
+    /// Bodies smaller than this many bytes are sent uncompressed
+    min_size: usize = 1024,
+};
 
-            _ = try file.readAll(content);
+/// One of a proxy's `upstreams`
+pub const ProxyUpstream = struct {
+    /// Rendered per request like the proxy's own `url`
+    url: []const u8,
+    /// Relative share of the requests sent here; validation ensures it is
+    /// not negative
+    weight: f64 = 1,
+    /// Replaces the proxy's `timeout` for requests sent here
+    timeout_ms: ?u64 = null,
+};
 
-            // Parse YAML and merge rules
-            const file_config = loadFromYaml(allocator, content) catch |err| {
-                std.log.err("Failed to parse {s}/{s}: {}", .{ dir_path, entry.name, err });
-                continue; // Skip invalid files but continue processing
-            };
-            var file_config_copy = file_config;
-            defer file_config_copy.deinit();
+/// What a proxy rule does when the upstream can't be reached
+pub const ProxyFallback = enum {
+    /// Answer with the proxy's own error, e.g. a 504 on timeout
+    none,
+    /// Serve the rule's mock response instead
+    response,
+};
 
-            // Merge rules into main config
-            for (file_config_copy.rules.items) |rule| {
-                // Deep copy the rule since we're moving it to a different config
-                const copied_rule = try copyRule(allocator, rule);
-                try config.addRule(copied_rule);
-            }
+/// A random delay added to every response, for `latency:`
+pub const Latency = struct {
+    min_ms: u64 = 0,
+    max_ms: u64 = 0,
 
-            files_loaded += 1;
+    /// A delay from `min_ms` to `max_ms`, both included
+    pub fn pick(self: Latency, random: std.Random) u64 {
+        if (self.max_ms <= self.min_ms) return self.min_ms;
+        return random.intRangeAtMost(u64, self.min_ms, self.max_ms);
+    }
+};
+
+/// A directory served as is, for `static:` rules
+pub const StaticFiles = struct {
+    /// Resolved against the config's directory
+    dir: []const u8,
+    /// File under `dir` served for paths that name no file, so a single-page
+    /// app's client-side routes all load it
+    index: ?[]const u8 = null,
+    /// List the contents of directories without an index.html
+    listing: bool = false,
+
+    pub fn deinit(self: *StaticFiles, allocator: std.mem.Allocator) void {
+        allocator.free(self.dir);
+        if (self.index) |index| {
+            allocator.free(index);
         }
+    }
+};
 
-        if (files_loaded == 0) {
-            std.log.warn("No YAML files found in directory: {s}", .{dir_path});
-        } else {
-            std.log.info("Loaded {} YAML files from directory: {s}", .{ files_loaded, dir_path });
+/// Configuration for a proxy
+pub const ProxyConfig = struct {
+    /// Upstream to send the request to. A URL containing `{{` is rendered
+    /// per request, like `https://api.example.com/users/{{.Params.id}}`.
+    /// Empty when `upstreams` is set.
+    url: []const u8,
+    /// Upstreams picked per request in proportion to their weights, in
+    /// place of `url`
+    upstreams: ?[]ProxyUpstream = null,
+    /// Sent upstream in place of inbound headers of the same name; values
+    /// containing `{{` are rendered per request
+    headers: ?std.StringHashMap([]const u8) = null,
+    /// Limit for the whole upstream round trip, parsed from `timeout: "5s"`
+    timeout_ms: u64 = 30000,
+    /// When set, the rewritten request path and query are appended to `url`
+    path_rewrite: ?PathRewrite = null,
+    /// Used when connecting fails or the round trip times out
+    fallback: ProxyFallback = .none,
+    /// Also fall back when the upstream answers 4xx or 5xx, which otherwise
+    /// passes through to the client
+    fallback_on_error_status: bool = false,
+    /// Edits made to upstream responses before they reach the client
+    response_rewrite: ?ResponseRewrite = null,
+
+    /// The upstream for a request, drawn by weight from those not yet
+    /// `tried`; null without `upstreams` or once every one with a positive
+    /// weight has been tried
+    pub fn pickUpstream(self: *const ProxyConfig, random: std.Random, tried: []const *const ProxyUpstream) ?*const ProxyUpstream {
+        const upstreams = self.upstreams orelse return null;
+        var total: f64 = 0;
+        var last: ?*const ProxyUpstream = null;
+        for (upstreams) |*upstream| {
+            if (upstream.weight <= 0 or std.mem.indexOfScalar(*const ProxyUpstream, tried, upstream) != null) continue;
+            total += upstream.weight;
+            last = upstream;
         }
+        // Rounding can leave a sliver past the final weight, which goes to `last`
+        const fallback = last orelse return null;
 
-        return config;
+        var remaining = random.float(f64) * total;
+        for (upstreams) |*upstream| {
+            if (upstream.weight <= 0 or std.mem.indexOfScalar(*const ProxyUpstream, tried, upstream) != null) continue;
+            if (remaining < upstream.weight) return upstream;
+            remaining -= upstream.weight;
+        }
+        return fallback;
     }
 
-    /// Deep copy a rule for transferring between configs
-    fn copyRule(allocator: std.mem.Allocator, rule: Rule) !Rule {
-        // Copy request
-        var copied_request = RequestRule{
-            .path = try allocator.dupe(u8, rule.request.path),
-            .method = try allocator.dupe(u8, rule.request.method),
-            .headers = null,
-            .body = null,
+    /// A copy for one request, allocated in `arena` so it stays valid after
+    /// a config reload. `url` is the final target, so the copy has neither
+    /// `upstreams` nor `path_rewrite`.
+    pub fn detach(self: *const ProxyConfig, arena: std.mem.Allocator, url: []const u8) !ProxyConfig {
+        var copy = ProxyConfig{
+            .url = url,
+            .timeout_ms = self.timeout_ms,
+            .fallback = self.fallback,
+            .fallback_on_error_status = self.fallback_on_error_status,
         };
+        if (self.headers) |headers| copy.headers = try dupeStringMap(arena, headers);
+        if (self.response_rewrite) |*rewrite| copy.response_rewrite = try rewrite.dupe(arena);
+        return copy;
+    }
 
-        if (rule.request.headers) |headers| {
-            copied_request.headers = std.StringHashMap([]const u8).init(allocator);
-            var iter = headers.iterator();
-            while (iter.next()) |entry| {
-                const key = try allocator.dupe(u8, entry.key_ptr.*);
-                const value = try allocator.dupe(u8, entry.value_ptr.*);
-                try copied_request.headers.?.put(key, value);
-            }
+    pub fn deinit(self: *ProxyConfig, allocator: std.mem.Allocator) void {
+        allocator.free(self.url);
+        if (self.upstreams) |upstreams| {
+            for (upstreams) |upstream| allocator.free(upstream.url);
+            allocator.free(upstreams);
         }
-
-        if (rule.request.body) |body| {
-            copied_request.body = try allocator.dupe(u8, body);
+        if (self.headers) |*headers| {
+            deinitStringMap(allocator, headers);
         }
+        if (self.path_rewrite) |*path_rewrite| {
+            path_rewrite.deinit(allocator);
+        }
+        if (self.response_rewrite) |*response_rewrite| {
+            response_rewrite.deinit(allocator);
+        }
+    }
+};
 
-        var copied_rule = Rule.init(copied_request);
-
-        // Copy response if present
-        if (rule.response) |response| {
-            var copied_response = MockResponse{
-                .status = response.status,
-                .headers = null,
-                .body = try allocator.dupe(u8, response.body),
-            };
+/// Every occurrence of `find` in an upstream body becomes `replace`
+pub const BodyReplace = struct {
+    find: []const u8,
+    replace: []const u8,
+};
 
-            if (response.headers) |headers| {
-                copied_response.headers = std.StringHashMap([]const u8).init(allocator);
-                var iter = headers.iterator();
-                while (iter.next()) |entry| {
-                    const key = try allocator.dupe(u8, entry.key_ptr.*);
-                    const value = try allocator.dupe(u8, entry.value_ptr.*);
-                    try copied_response.headers.?.put(key, value);
-                }
-            }
+pub const JsonPatchOp = enum { set, remove };
 
-            copied_rule = copied_rule.withMockResponse(copied_response);
-        }
+/// One structured edit of an upstream JSON body
+pub const JsonPatch = struct {
+    op: JsonPatchOp,
+    /// Where to edit, in the JSON path syntax of `body_json` conditions
+    path: []const u8,
+    /// JSON text `set` writes at `path`
+    value: []const u8 = "null",
+};
 
-        // Copy proxy if present
-        if (rule.proxy) |proxy| {
-            var copied_proxy = ProxyConfig{
-                .url = try allocator.dupe(u8, proxy.url),
-                .headers = null,
-                .timeout_ms = proxy.timeout_ms,
-            };
+/// A proxy's `response_rewrite:` section. Headers are removed before they
+/// are added, so listing a header in both replaces it; body replacements
+/// run in order, then the JSON patches.
+pub const ResponseRewrite = struct {
+    /// Set on the response, replacing upstream headers of the same name
+    add_headers: ?std.StringHashMap([]const u8) = null,
+    /// Upstream headers to drop, matched ignoring case
+    remove_headers: []const []const u8 = &.{},
+    body_replace: []BodyReplace = &.{},
+    /// Skipped, along with the reformatting it brings, for bodies that
+    /// aren't JSON
+    json_patch: []JsonPatch = &.{},
 
-            if (proxy.headers) |headers| {
-                copied_proxy.headers = std.StringHashMap([]const u8).init(allocator);
-                var iter = headers.iterator();
-                while (iter.next()) |entry| {
-                    const key = try allocator.dupe(u8, entry.key_ptr.*);
-                    const value = try allocator.dupe(u8, entry.value_ptr.*);
-                    try copied_proxy.headers.?.put(key, value);
-                }
+    /// Rewrite `response` in place, allocating in `arena`. The body length
+    /// is left to the server, which sends `Content-Length` for what it
+    /// is handed.
+    pub fn apply(self: *const ResponseRewrite, arena: std.mem.Allocator, response: *Response) !void {
+        for (self.remove_headers) |name| {
+            _ = response.headers.remove(name);
+        }
+        if (self.add_headers) |headers| {
+            var iter = headers.iterator();
+            while (iter.next()) |entry| {
+                try response.setHeader(try arena.dupe(u8, entry.key_ptr.*), try arena.dupe(u8, entry.value_ptr.*));
             }
+        }
 
-            copied_rule = copied_rule.withProxy(copied_proxy);
+        var body = response.body;
+        for (self.body_replace) |replacement| {
+            body = try std.mem.replaceOwned(u8, arena, body, replacement.find, replacement.replace);
         }
+        if (self.json_patch.len > 0) {
+            body = try self.patchJson(arena, body);
+        }
+        response.setBody(body);
+    }
 
-        return copied_rule;
+    /// A copy allocated in `arena`
+    pub fn dupe(self: *const ResponseRewrite, arena: std.mem.Allocator) !ResponseRewrite {
+        var copy = ResponseRewrite{};
+        if (self.add_headers) |headers| copy.add_headers = try dupeStringMap(arena, headers);
+        const remove_headers = try arena.alloc([]const u8, self.remove_headers.len);
+        for (self.remove_headers, remove_headers) |name, *copied| copied.* = try arena.dupe(u8, name);
+        copy.remove_headers = remove_headers;
+        copy.body_replace = try arena.alloc(BodyReplace, self.body_replace.len);
+        for (self.body_replace, copy.body_replace) |replacement, *copied| {
+            copied.* = .{ .find = try arena.dupe(u8, replacement.find), .replace = try arena.dupe(u8, replacement.replace) };
+        }
+        copy.json_patch = try arena.alloc(JsonPatch, self.json_patch.len);
+        for (self.json_patch, copy.json_patch) |patch, *copied| {
+            copied.* = .{ .op = patch.op, .path = try arena.dupe(u8, patch.path), .value = try arena.dupe(u8, patch.value) };
+        }
+        return copy;
     }
 
-    /// Load configuration from YAML string 
-    pub fn loadFromYaml(allocator: std.mem.Allocator, yaml_content: []const u8) !Config {
-        var config = Config.init(allocator);
-        errdefer config.deinit();
-
-        // Parse YAML using zig-yaml 0.1.1 API
-        var parsed_yaml: yaml.Yaml = .{ .source = yaml_content };
-        defer parsed_yaml.deinit(allocator);
-        
-        parsed_yaml.load(allocator) catch |err| switch (err) {
-            error.ParseFailure => {
-                std.log.err("YAML parse failure", .{});
-                return error.InvalidYamlFormat;
+    fn patchJson(self: *const ResponseRewrite, arena: std.mem.Allocator, body: []const u8) ![]const u8 {
+        var root = std.json.parseFromSliceLeaky(std.json.Value, arena, body, .{ .parse_numbers = false }) catch |err| switch (err) {
+            error.OutOfMemory => return err,
+            else => {
+                std.log.debug("Upstream body is not JSON, so json_patch is skipped", .{});
+                return body;
             },
-            else => return err,
         };
-
-        // Check if we have any documents
-        if (parsed_yaml.docs.items.len == 0) {
-            std.log.warn("No YAML documents found", .{});
-            return config;
+        for (self.json_patch) |patch| {
+            const applied = switch (patch.op) {
+                .set => try json_path.set(arena, &root, patch.path, try std.json.parseFromSliceLeaky(std.json.Value, arena, patch.value, .{ .parse_numbers = false })),
+                .remove => try json_path.remove(&root, patch.path),
+            };
+            if (!applied) {
+                std.log.debug("json_patch {s} {s} found nothing to edit", .{ @tagName(patch.op), patch.path });
+            }
         }
-
-        // Get the first document - should be an array of rules  
-        const doc = parsed_yaml.docs.items[0];
-        
-        // Process the YAML document to extract rules
-        try parseYamlDocument(allocator, &config, doc);
-
-        return config;
+        return std.json.stringifyAlloc(arena, root, .{});
     }
 
-    fn parseYamlDocument(allocator: std.mem.Allocator, config: *Config, doc: anytype) !void {
-        switch (doc) {
-            .list => |list| {
-                // Expected format: array of rule objects
-                for (list) |rule_value| {
-                    const rule = try parseYamlRule(allocator, rule_value);
-                    try config.addRule(rule);
-                }
-            },
-            .map => {
-                // Single rule object
-                const rule = try parseYamlRule(allocator, doc);
-                try config.addRule(rule);
-            },
-            else => {
-                std.log.err("Expected YAML document to be a list or map, got: {}", .{doc});
-                return error.InvalidYamlFormat;
-            },
+    pub fn deinit(self: *ResponseRewrite, allocator: std.mem.Allocator) void {
+        if (self.add_headers) |*headers| {
+            deinitStringMap(allocator, headers);
+        }
+        freeStringList(allocator, self.remove_headers);
+        for (self.body_replace) |replacement| {
+            allocator.free(replacement.find);
+            allocator.free(replacement.replace);
         }
+        allocator.free(self.body_replace);
+        for (self.json_patch) |patch| {
+            allocator.free(patch.path);
+            allocator.free(patch.value);
+        }
+        allocator.free(self.json_patch);
     }
+};
 
-    fn parseYamlRule(allocator: std.mem.Allocator, rule_value: anytype) !Rule {
-        const rule_map = switch (rule_value) {
-            .map => |map| map,
-            else => {
-                std.log.err("Expected rule to be a map, got: {}", .{rule_value});
-                return error.InvalidYamlFormat;
-            },
-        };
+/// Free an owned list of strings
+fn freeStringList(allocator: std.mem.Allocator, list: []const []const u8) void {
+    for (list) |item| {
+        allocator.free(item);
+    }
+    allocator.free(list);
+}
 
-        var request: ?RequestRule = null;
-        var response: ?MockResponse = null;
-        var proxy: ?ProxyConfig = null;
+/// Cross-origin settings applied to every response
+pub const CorsConfig = struct {
+    /// Origins allowed to read responses; "*" allows any origin
+    allowed_origins: []const []const u8,
+    allowed_methods: []const []const u8,
+    allowed_headers: []const []const u8,
+    /// Allow cookies and auth headers, which requires echoing the exact origin
+    allow_credentials: bool = false,
 
-        // Parse the rule map
-        var map_iter = rule_map.iterator();
-        while (map_iter.next()) |entry| {
-            const key = entry.key_ptr.*;
-            const value = entry.value_ptr.*;
+    /// Permissive settings used when the config has no `cors:` section
+    pub const default = CorsConfig{
+        .allowed_origins = &.{"*"},
+        .allowed_methods = &.{ "GET", "POST", "PUT", "DELETE", "PATCH", "OPTIONS" },
+        .allowed_headers = &.{ "Content-Type", "Authorization" },
+    };
 
-            if (std.mem.eql(u8, key, "request")) {
-                request = try parseYamlRequest(allocator, value);
-            } else if (std.mem.eql(u8, key, "response")) {
-                response = try parseYamlResponse(allocator, value);
-            } else if (std.mem.eql(u8, key, "proxy")) {
-                proxy = try parseYamlProxy(allocator, value);
-            }
-        }
+    pub fn deinit(self: *CorsConfig, allocator: std.mem.Allocator) void {
+        freeStringList(allocator, self.allowed_origins);
+        freeStringList(allocator, self.allowed_methods);
+        freeStringList(allocator, self.allowed_headers);
+    }
+};
 
-        if (request == null) {
-            return error.MissingRequestConfiguration;
+/// Responses served in order, one per matching request
+pub const ResponseSequence = struct {
+    responses: []MockResponse,
+    /// Start over after the last response instead of repeating it
+    cycle: bool = false,
+    /// Requests served so far; shared by all handler threads
+    hits: std.atomic.Value(usize) = std.atomic.Value(usize).init(0),
+
+    /// Claim the response for the next request
+    pub fn next(self: *ResponseSequence) *const MockResponse {
+        return self.at(self.hits.fetchAdd(1, .monotonic));
+    }
+
+    /// The response for the request at `index`, counting from 0, for
+    /// positions kept elsewhere such as a `state_file`
+    pub fn at(self: *const ResponseSequence, index: usize) *const MockResponse {
+        if (self.cycle) {
+            return &self.responses[index % self.responses.len];
         }
+        return &self.responses[@min(index, self.responses.len - 1)];
+    }
 
-        var rule = Rule.init(request.?);
-        if (response) |r| {
-            rule = rule.withMockResponse(r);
+    pub fn deinit(self: *ResponseSequence, allocator: std.mem.Allocator) void {
+        for (self.responses) |*response| {
+            response.deinit(allocator);
         }
-        if (proxy) |p| {
-            rule = rule.withProxy(p);
+        allocator.free(self.responses);
+    }
+};
+
+/// Responses picked at random per request, in proportion to their weights
+pub const WeightedResponses = struct {
+    responses: []MockResponse,
+
+    /// Sum of the weights; validation ensures it is positive
+    pub fn totalWeight(self: *const WeightedResponses) f64 {
+        var total: f64 = 0;
+        for (self.responses) |response| {
+            total += response.weight;
         }
+        return total;
+    }
 
-        return rule;
+    pub fn pick(self: *const WeightedResponses, random: std.Random) *const MockResponse {
+        var remaining = random.float(f64) * self.totalWeight();
+        var last = &self.responses[0];
+        for (self.responses) |*response| {
+            if (response.weight <= 0) continue;
+            if (remaining < response.weight) return response;
+            remaining -= response.weight;
+            last = response;
+        }
+        // Rounding can leave a sliver past the final weight
+        return last;
     }
 
-    fn parseYamlRequest(allocator: std.mem.Allocator, request_value: anytype) !RequestRule {
-        const request_map = switch (request_value) {
-            .map => |map| map,
-            else => return error.InvalidYamlFormat,
-        };
+    pub fn deinit(self: *WeightedResponses, allocator: std.mem.Allocator) void {
+        for (self.responses) |*response| {
+            response.deinit(allocator);
+        }
+        allocator.free(self.responses);
+    }
+};
 
-        var path: ?[]const u8 = null;
-        var method: ?[]const u8 = null;
-        var headers: ?std.StringHashMap([]const u8) = null;
-        var body: ?[]const u8 = null;
+/// One entry of a `schedule`, served for `duration_ms` at a time
+pub const SchedulePhase = struct {
+    duration_ms: u64,
+    response: MockResponse,
+};
 
-        var map_iter = request_map.iterator();
-        while (map_iter.next()) |entry| {
-            const key = entry.key_ptr.*;
-            const value = entry.value_ptr.*;
+/// Responses that take turns by server uptime, each for its phase's
+/// duration, starting over after the last
+pub const ResponseSchedule = struct {
+    phases: []SchedulePhase,
 
-            if (std.mem.eql(u8, key, "path")) {
-                if (value == .string) {
-                    path = try allocator.dupe(u8, value.string);
-                }
-            } else if (std.mem.eql(u8, key, "method") or std.mem.eql(u8, key, "verb")) {
-                if (value == .string) {
-                    method = try allocator.dupe(u8, value.string);
-                }
-            } else if (std.mem.eql(u8, key, "headers")) {
-                if (value == .map) {
-                    headers = try parseYamlHeaders(allocator, value.map);
-                }
-            } else if (std.mem.eql(u8, key, "body")) {
-                if (value == .string) {
-                    body = try allocator.dupe(u8, value.string);
-                }
-            }
+    /// Length of one pass through every phase
+    pub fn totalMs(self: *const ResponseSchedule) u64 {
+        var total: u64 = 0;
+        for (self.phases) |phase| {
+            total +|= phase.duration_ms;
         }
+        return total;
+    }
 
-        if (path == null or method == null) {
-            return error.MissingRequiredRequestFields;
+    /// The response for a request `uptime_ms` after the server started
+    pub fn at(self: *const ResponseSchedule, uptime_ms: u64) *const MockResponse {
+        const total = self.totalMs();
+        // Validation rejects zero durations, but don't divide by zero
+        if (total == 0) return &self.phases[0].response;
+        var offset = uptime_ms % total;
+        for (self.phases) |*phase| {
+            if (offset < phase.duration_ms) return &phase.response;
+            offset -= phase.duration_ms;
         }
+        return &self.phases[self.phases.len - 1].response;
+    }
 
-        return RequestRule{
-            .path = path.?,
-            .method = method.?,
-            .headers = headers,
-            .body = body,
-        };
+    pub fn deinit(self: *ResponseSchedule, allocator: std.mem.Allocator) void {
+        for (self.phases) |*phase| {
+            phase.response.deinit(allocator);
+        }
+        allocator.free(self.phases);
     }
+};
 
-    fn parseYamlResponse(allocator: std.mem.Allocator, response_value: anytype) !MockResponse {
-        const response_map = switch (response_value) {
-            .map => |map| map,
-            else => return error.InvalidYamlFormat,
-        };
+/// A single rule that can either mock a response or proxy to another service
+pub const Rule = struct {
+    request: RequestRule,
+    response: ?MockResponse = null,
+    /// Set instead of `response` when the rule lists several responses.
+    /// Heap-allocated so the hit counter is shared by every copy of the rule.
+    sequence: ?*ResponseSequence = null,
+    /// Set from a `responses` list, which picks one at random per request
+    weighted: ?WeightedResponses = null,
+    /// Set from a `schedule` list, which switches response as uptime passes
+    schedule: ?ResponseSchedule = null,
+    proxy: ?ProxyConfig = null,
+    /// Set from `static:`, which serves the files of a directory under the
+    /// rule's `path_prefix`
+    static: ?StaticFiles = null,
+    /// Among matching rules the highest priority wins, before specificity
+    /// is considered; rules default to 0
+    priority: i32 = 0,
+    /// Requests this rule has matched since load or the last reset; shared by
+    /// all handler threads, so only touch it through the rule in `Config.rules`
+    hits: std.atomic.Value(u64) = std.atomic.Value(u64).init(0),
+    /// Set from `max_matches:`; once `hits` reaches it the matcher skips the
+    /// rule, until `POST /__popshop/reset` zeroes the count
+    max_matches: ?u64 = null,
+    /// File the rule was loaded from, for messages; null for inline YAML
+    source: ?[]const u8 = null,
+    /// Line of the rule's list item in `source`, when it could be found
+    line: ?usize = null,
+    /// Label for logs and `/__popshop/routes`, such as "get user by id";
+    /// never used for matching
+    name: ?[]const u8 = null,
+    /// Free-form notes shown by `/__popshop/routes`
+    description: ?[]const u8 = null,
+    /// Set from `log: false`, which leaves the rule's requests out of the
+    /// access log; they still count in metrics and hits
+    log: bool = true,
+    /// Port of the `listeners` entry the rule was listed under; it answers
+    /// only requests to that port, as top-level rules answer only the main one
+    listener: ?u16 = null,
 
-        var status: u16 = 200;
-        var headers: ?std.StringHashMap([]const u8) = null;
-        var body: []const u8 = "";
+    /// Where the rule was defined, like "users.yaml:7", for messages. The
+    /// caller owns the result.
+    pub fn location(self: *const Rule, allocator: std.mem.Allocator) ![]u8 {
+        const source = self.source orelse "config";
+        if (self.line) |line| return std.fmt.allocPrint(allocator, "{s}:{d}", .{ source, line });
+        return allocator.dupe(u8, source);
+    }
 
-        var map_iter = response_map.iterator();
-        while (map_iter.next()) |entry| {
-            const key = entry.key_ptr.*;
-            const value = entry.value_ptr.*;
+    pub fn init(request: RequestRule) Rule {
+        return Rule{ .request = request };
+    }
 
-            if (std.mem.eql(u8, key, "status")) {
-                switch (value) {
-                    .int => |i| status = @intCast(i),
-                    .string => |s| status = std.fmt.parseInt(u16, s, 10) catch 200,
-                    else => {},
-                }
-            } else if (std.mem.eql(u8, key, "headers")) {
-                if (value == .map) {
-                    headers = try parseYamlHeaders(allocator, value.map);
-                }
-            } else if (std.mem.eql(u8, key, "body")) {
-                if (value == .string) {
-                    body = try allocator.dupe(u8, value.string);
-                }
-            }
-        }
+    pub fn withMockResponse(self: Rule, response: MockResponse) Rule {
+        var new_rule = self;
+        new_rule.response = response;
+        return new_rule;
+    }
 
-        return MockResponse{
-            .status = status,
-            .headers = headers,
-            .body = body,
-        };
+    pub fn withProxy(self: Rule, proxy: ProxyConfig) Rule {
+        var new_rule = self;
+        new_rule.proxy = proxy;
+        return new_rule;
     }
 
-    fn parseYamlProxy(allocator: std.mem.Allocator, proxy_value: anytype) !ProxyConfig {
-        const proxy_map = switch (proxy_value) {
-            .map => |map| map,
-            else => return error.InvalidYamlFormat,
+    /// Whether the rule has used up its `max_matches`
+    pub fn exhausted(self: *const Rule) bool {
+        const limit = self.max_matches orelse return false;
+        return self.hits.load(.monotonic) >= limit;
+    }
+
+    /// Count a request against the rule's hits. False, counting nothing,
+    /// when its `max_matches` ran out after the matcher picked it, as
+    /// another handler thread can claim the last match in between.
+    pub fn claimMatch(self: *Rule) bool {
+        const limit = self.max_matches orelse {
+            _ = self.hits.fetchAdd(1, .monotonic);
+            return true;
         };
+        var current = self.hits.load(.monotonic);
+        while (current < limit) {
+            current = self.hits.cmpxchgWeak(current, current + 1, .monotonic, .monotonic) orelse return true;
+        }
+        return false;
+    }
 
-        var url: ?[]const u8 = null;
-        var headers: ?std.StringHashMap([]const u8) = null;
-        var timeout_ms: u64 = 30000;
+    pub fn isMock(self: *const Rule) bool {
+        return self.response != null or self.sequence != null or self.weighted != null or self.schedule != null;
+    }
 
-        var map_iter = proxy_map.iterator();
-        while (map_iter.next()) |entry| {
-            const key: []const u8 = entry.key_ptr.*;
-            const value = entry.value_ptr.*;
+    /// Whether the rule proxies first and serves its mock response only
+    /// when the upstream fails
+    pub fn proxiesFirst(self: *const Rule) bool {
+        const proxy = self.proxy orelse return false;
+        return proxy.fallback == .response;
+    }
 
-            if (std.mem.eql(u8, key, "url")) {
-                if (value == .string) {
-                    url = try allocator.dupe(u8, value.string);
-                }
-            } else if (std.mem.eql(u8, key, "headers")) {
-                if (value == .map) {
-                    headers = try parseYamlHeaders(allocator, value.map);
-                }
-            } else if (std.mem.eql(u8, key, "timeout_ms")) {
-                switch (value) {
-                    .int => |i| timeout_ms = @intCast(i),
-                    .string => |s| timeout_ms = std.fmt.parseInt(u64, s, 10) catch 30000,
-                    else => {},
-                }
-            }
+    /// The mock response to serve for a request, advancing the sequence if
+    /// there is one; `random` picks from weighted responses and `uptime_ms`,
+    /// the time since the server started, chooses a schedule's phase
+    pub fn nextResponse(self: *const Rule, random: std.Random, uptime_ms: u64) ?*const MockResponse {
+        if (self.sequence) |sequence| {
+            return sequence.next();
         }
-
-        if (url == null) {
-            return error.MissingProxyUrl;
+        if (self.weighted) |*weighted| {
+            return weighted.pick(random);
+        }
+        if (self.schedule) |*schedule| {
+            return schedule.at(uptime_ms);
+        }
+        if (self.response) |*response| {
+            return response;
         }
+        return null;
+    }
 
-        return ProxyConfig{
-            .url = url.?,
-            .headers = headers,
-            .timeout_ms = timeout_ms,
-        };
+    pub fn isProxy(self: *const Rule) bool {
+        return self.proxy != null;
     }
 
-    fn parseYamlHeaders(allocator: std.mem.Allocator, headers_map: anytype) !std.StringHashMap([]const u8) {
-        var headers = std.StringHashMap([]const u8).init(allocator);
+    pub fn isStatic(self: *const Rule) bool {
+        return self.static != null;
+    }
 
-        var map_iter = headers_map.iterator();
-        while (map_iter.next()) |entry| {
-            const key: []const u8 = entry.key_ptr.*;
-            const value = entry.value_ptr.*;
-            
-            // Only process string values
-            switch (value) {
-                .string => |s| {
-                    const owned_key = try allocator.dupe(u8, key);
-                    const owned_value = try allocator.dupe(u8, s);
-                    try headers.put(owned_key, owned_value);
-                },
-                else => continue,
-            }
+    pub fn deinit(self: *Rule, allocator: std.mem.Allocator) void {
+        self.request.deinit(allocator);
+        if (self.response) |*response| {
+            response.deinit(allocator);
+        }
+        if (self.sequence) |sequence| {
+            sequence.deinit(allocator);
+            allocator.destroy(sequence);
+        }
+        if (self.weighted) |*weighted| {
+            weighted.deinit(allocator);
+        }
+        if (self.schedule) |*schedule| {
+            schedule.deinit(allocator);
+        }
+        if (self.proxy) |*proxy| {
+            proxy.deinit(allocator);
+        }
+        if (self.static) |*static| {
+            static.deinit(allocator);
+        }
+        if (self.source) |source| {
+            allocator.free(source);
         }
+        if (self.name) |name| {
+            allocator.free(name);
+        }
+        if (self.description) |description| {
+            allocator.free(description);
+        }
+    }
+};
 
-        return headers;
+/// Parse a Go-style duration such as "250ms", "2s", "1m30s" or "1.5h" into
+/// milliseconds. Supported units are ns, us, ms, s, m and h; a bare number is
+/// taken as milliseconds. Sub-millisecond remainders are rounded.
+pub fn parseDurationMs(text: []const u8) !u64 {
+    const trimmed = std.mem.trim(u8, text, " \t");
+    if (trimmed.len == 0) return error.InvalidDuration;
+
+    if (std.fmt.parseInt(u64, trimmed, 10)) |ms| {
+        return ms;
+    } else |_| {}
+
+    var total_ms: f64 = 0;
+    var i: usize = 0;
+    while (i < trimmed.len) {
+        const number_start = i;
+        while (i < trimmed.len and (std.ascii.isDigit(trimmed[i]) or trimmed[i] == '.')) i += 1;
+        if (i == number_start) return error.InvalidDuration;
+        const amount = std.fmt.parseFloat(f64, trimmed[number_start..i]) catch return error.InvalidDuration;
+
+        const unit_start = i;
+        while (i < trimmed.len and std.ascii.isAlphabetic(trimmed[i])) i += 1;
+        const unit = trimmed[unit_start..i];
+
+        const ms_per_unit: f64 = if (std.mem.eql(u8, unit, "ns"))
+            1.0 / std.time.ns_per_ms
+        else if (std.mem.eql(u8, unit, "us"))
+            1.0 / std.time.us_per_ms
+        else if (std.mem.eql(u8, unit, "ms"))
+            1
+        else if (std.mem.eql(u8, unit, "s"))
+            std.time.ms_per_s
+        else if (std.mem.eql(u8, unit, "m"))
+            std.time.ms_per_min
+        else if (std.mem.eql(u8, unit, "h"))
+            std.time.ms_per_hour
+        else
+            return error.InvalidDuration;
+
+        total_ms += amount * ms_per_unit;
     }
 
-};
+    return @intFromFloat(@round(total_ms));
+}
 
-test "Config.loadFromYaml" {
-    const allocator = std.testing.allocator;
-    
-    const yaml_content =
-        \\- request:
-        \\    path: "/api/health"
-        \\    method: "GET"
-        \\  response:
-        \\    status: 200
-        \\    body: '{"status": "ok"}'
-        \\- request:
-        \\    path: "/api/proxy"
-        \\    method: "GET"
-        \\  proxy:
-        \\    url: "https://httpbin.org/get"
-    ;
+/// Parse a size such as "256kb", "1mb" or "1.5MB" into bytes. Units are b,
+/// kb, mb and gb in any case, each 1024 times the last; a bare number is
+/// taken as bytes.
+pub fn parseByteSize(text: []const u8) !usize {
+    const trimmed = std.mem.trim(u8, text, " \t");
+    if (trimmed.len == 0) return error.InvalidByteSize;
 
-    var config = try Config.loadFromYaml(allocator, yaml_content);
-    defer config.deinit();
+    var number_end: usize = 0;
+    while (number_end < trimmed.len and (std.ascii.isDigit(trimmed[number_end]) or trimmed[number_end] == '.')) number_end += 1;
+    if (number_end == 0) return error.InvalidByteSize;
+    const amount = std.fmt.parseFloat(f64, trimmed[0..number_end]) catch return error.InvalidByteSize;
+
+    const unit = std.mem.trimLeft(u8, trimmed[number_end..], " ");
+    const units = [_][]const u8{ "b", "kb", "mb", "gb" };
+    const power = for (units, 0..) |name, index| {
+        if (std.ascii.eqlIgnoreCase(unit, name)) break index;
+    } else if (unit.len == 0) 0 else return error.InvalidByteSize;
+
+    const bytes = @round(amount * std.math.pow(f64, 1024, @floatFromInt(power)));
+    if (bytes > @as(f64, @floatFromInt(std.math.maxInt(usize)))) return error.InvalidByteSize;
+    return @intFromFloat(bytes);
+}
+
+/// State shared by the YAML parsing functions
+/// Expand `${VAR}` and `${VAR:-default}` references in `text` against `env`.
+/// The default also applies when the variable is set but empty, and `$${`
+/// produces a literal `${`. When a variable without a default is unset, the
+/// result is error.UndefinedVariable and `missing` receives its name.
+pub fn expandEnv(allocator: std.mem.Allocator, text: []const u8, env: *const std.process.EnvMap, missing: ?*[]const u8) ![]u8 {
+    var out = std.ArrayList(u8).init(allocator);
+    errdefer out.deinit();
+
+    var i: usize = 0;
+    while (i < text.len) {
+        if (std.mem.startsWith(u8, text[i..], "$${")) {
+            try out.appendSlice("${");
+            i += 3;
+            continue;
+        }
+        if (!std.mem.startsWith(u8, text[i..], "${")) {
+            try out.append(text[i]);
+            i += 1;
+            continue;
+        }
+
+        const close = std.mem.indexOfScalarPos(u8, text, i + 2, '}') orelse return error.InvalidVariableReference;
+        const reference = text[i + 2 .. close];
+        const separator = std.mem.indexOf(u8, reference, ":-");
+        const name = if (separator) |sep| reference[0..sep] else reference;
+        if (name.len == 0) return error.InvalidVariableReference;
+
+        const value = env.get(name);
+        if (value != null and (value.?.len > 0 or separator == null)) {
+            try out.appendSlice(value.?);
+        } else if (separator) |sep| {
+            try out.appendSlice(reference[sep + 2 ..]);
+        } else {
+            if (missing) |m| m.* = name;
+            return error.UndefinedVariable;
+        }
+        i = close + 1;
+    }
+
+    return out.toOwnedSlice();
+}
+
+const ParseContext = struct {
+    allocator: std.mem.Allocator,
+    /// Directory that relative file references resolve against
+    base_dir: []const u8 = ".",
+    /// Variables available to `${VAR}` references in string values
+    env: *const std.process.EnvMap,
+    /// Skip unknown keys instead of rejecting them
+    lenient: bool = false,
+
+    /// Fail on the first key of `map` that isn't in `known`, naming the key,
+    /// the `section` it sits in and the closest known key, so typos such as
+    /// `respose:` don't silently drop config
+    fn checkKeys(self: *const ParseContext, map: anytype, section: []const u8, known: []const []const u8) !void {
+        if (self.lenient) return;
+        const key = firstUnknownKey(map, known) orelse return;
+        if (closestKey(key, known)) |suggestion| {
+            std.log.err("Unknown field '{s}' in {s}; did you mean '{s}'?", .{ key, section, suggestion });
+        } else {
+            std.log.err("Unknown field '{s}' in {s} (use --lenient to ignore unknown fields)", .{ key, section });
+        }
+        return error.UnknownField;
+    }
+
+    /// Copy a string value from the config, expanding environment references
+    fn expand(self: *const ParseContext, text: []const u8) ![]u8 {
+        var missing: []const u8 = "";
+        return expandEnv(self.allocator, text, self.env, &missing) catch |err| {
+            switch (err) {
+                error.UndefinedVariable => std.log.err("Environment variable {s} is not set (use ${{{s}:-default}} to provide a fallback)", .{ missing, missing }),
+                error.InvalidVariableReference => std.log.err("Invalid environment variable reference in '{s}'", .{text}),
+                else => {},
+            }
+            return err;
+        };
+    }
+
+    /// Resolve a path from the config relative to the config's directory
+    fn resolvePath(self: *const ParseContext, path: []const u8) ![]const u8 {
+        if (std.fs.path.isAbsolute(path)) {
+            return self.allocator.dupe(u8, path);
+        }
+        return std.fs.path.join(self.allocator, &.{ self.base_dir, path });
+    }
+};
+
+fn firstUnknownKey(map: anytype, known: []const []const u8) ?[]const u8 {
+    var iter = map.iterator();
+    while (iter.next()) |entry| {
+        const key: []const u8 = entry.key_ptr.*;
+        const is_known = for (known) |name| {
+            if (std.mem.eql(u8, key, name)) break true;
+        } else false;
+        if (!is_known) return key;
+    }
+    return null;
+}
+
+/// The known key within two edits of `key`, if any
+fn closestKey(key: []const u8, known: []const []const u8) ?[]const u8 {
+    var best: ?[]const u8 = null;
+    var best_distance: usize = 3;
+    for (known) |name| {
+        const distance = editDistance(key, name);
+        if (distance < best_distance) {
+            best = name;
+            best_distance = distance;
+        }
+    }
+    return best;
+}
+
+/// Levenshtein distance, saturating for keys too long to be typos of a field name
+fn editDistance(a: []const u8, b: []const u8) usize {
+    var row: [64]usize = undefined;
+    if (b.len >= row.len) return std.math.maxInt(usize);
+
+    for (0..b.len + 1) |j| row[j] = j;
+    for (a, 0..) |a_char, i| {
+        var diagonal = row[0];
+        row[0] = i + 1;
+        for (b, 0..) |b_char, j| {
+            const above = row[j + 1];
+            const substitution = diagonal + @intFromBool(a_char != b_char);
+            row[j + 1] = @min(@min(above, row[j]) + 1, substitution);
+            diagonal = above;
+        }
+    }
+    return row[b.len];
+}
+
+/// How `Config` reads YAML
+pub const LoadOptions = struct {
+    /// Ignore unknown keys rather than failing on them, for configs that
+    /// deliberately carry keys of their own
+    lenient: bool = false,
+    /// For a config at an http(s) URL: how the fetch is made
+    fetch: remote_config.FetchOptions = .{},
+};
+
+/// Complete configuration for the popshop server
+/// Semantic problems found by `Config.validate`, one message per problem
+pub const ValidationErrors = struct {
+    allocator: std.mem.Allocator,
+    messages: std.ArrayList([]const u8),
+    /// Index into `Config.rules` of the rule each message is about, null
+    /// for top-level settings; parallel to `messages`
+    rules: std.ArrayList(?usize),
+    /// Key path within the rule of the setting each message is about, such
+    /// as `response.status`, for `Config.locate`; parallel to `messages`
+    fields: std.ArrayList(?[]const u8),
+    /// Rule that `add` attributes messages to, set while it is validated
+    current_rule: ?usize = null,
+    /// Where the response being validated sits in the rule
+    scope: Scope = .{},
+
+    pub const Scope = struct {
+        path: ?[]const u8 = null,
+        /// The response is a list item, whose fields can't be told apart
+        /// from its siblings', so messages point at the list instead
+        list: bool = false,
+    };
+
+    pub fn init(allocator: std.mem.Allocator) ValidationErrors {
+        return ValidationErrors{
+            .allocator = allocator,
+            .messages = std.ArrayList([]const u8).init(allocator),
+            .rules = std.ArrayList(?usize).init(allocator),
+            .fields = std.ArrayList(?[]const u8).init(allocator),
+        };
+    }
+
+    pub fn deinit(self: *ValidationErrors) void {
+        for (self.messages.items) |message| {
+            self.allocator.free(message);
+        }
+        self.messages.deinit();
+        self.rules.deinit();
+        for (self.fields.items) |field| {
+            if (field) |f| self.allocator.free(f);
+        }
+        self.fields.deinit();
+    }
+
+    pub fn isEmpty(self: *const ValidationErrors) bool {
+        return self.messages.items.len == 0;
+    }
+
+    fn add(self: *ValidationErrors, comptime fmt: []const u8, args: anytype) !void {
+        return self.addAt(null, fmt, args);
+    }
+
+    /// Add a message about `field`, a key path relative to the current scope
+    fn addAt(self: *ValidationErrors, field: ?[]const u8, comptime fmt: []const u8, args: anytype) !void {
+        const message = try std.fmt.allocPrint(self.allocator, fmt, args);
+        errdefer self.allocator.free(message);
+
+        var field_path: ?[]const u8 = null;
+        if (self.scope.path) |scope_path| {
+            field_path = if (field == null or self.scope.list)
+                try self.allocator.dupe(u8, scope_path)
+            else
+                try std.fmt.allocPrint(self.allocator, "{s}.{s}", .{ scope_path, field.? });
+        } else if (field) |f| {
+            field_path = try self.allocator.dupe(u8, f);
+        }
+        errdefer if (field_path) |f| self.allocator.free(f);
+
+        try self.rules.ensureUnusedCapacity(1);
+        try self.fields.ensureUnusedCapacity(1);
+        try self.messages.append(message);
+        self.rules.appendAssumeCapacity(self.current_rule);
+        self.fields.appendAssumeCapacity(field_path);
+    }
+};
+
+/// What a loaded config contains, reported when the server starts
+pub const Summary = struct {
+    allocator: std.mem.Allocator,
+    total_rules: usize = 0,
+    mock_rules: usize = 0,
+    proxy_rules: usize = 0,
+    /// Problems that don't make the config invalid but probably aren't intended
+    warnings: std.ArrayList([]const u8),
+
+    pub fn init(allocator: std.mem.Allocator) Summary {
+        return Summary{
+            .allocator = allocator,
+            .warnings = std.ArrayList([]const u8).init(allocator),
+        };
+    }
+
+    pub fn deinit(self: *Summary) void {
+        for (self.warnings.items) |warning| {
+            self.allocator.free(warning);
+        }
+        self.warnings.deinit();
+    }
+
+    fn addWarning(self: *Summary, comptime fmt: []const u8, args: anytype) !void {
+        const warning = try std.fmt.allocPrint(self.allocator, fmt, args);
+        errdefer self.allocator.free(warning);
+        try self.warnings.append(warning);
+    }
+};
+
+pub const Config = struct {
+    rules: std.ArrayList(Rule),
+    /// Top-level `cors:` section; `CorsConfig.default` applies when unset
+    cors: ?CorsConfig = null,
+    /// Top-level `default_response:` served when no rule matches
+    default_response: ?MockResponse = null,
+    /// Top-level `not_found:` replacing the built-in 404 when no rule matches
+    /// and there is no `default_response`; its status defaults to 404
+    not_found: ?MockResponse = null,
+    /// Top-level `root_response:` answering a GET or HEAD for `/` that no
+    /// rule matches, ahead of `default_response`
+    root_response: ?MockResponse = null,
+    /// Whether an unmatched `/` without a `root_response` gets the built-in
+    /// banner; `root_response: false` turns it off
+    root_banner: bool = true,
+    /// Top-level `server_error:` replacing the built-in body of errors
+    /// popshop raises itself, such as a failed template; status defaults to 500
+    server_error: ?MockResponse = null,
+    /// Top-level `strict_slash:`. When false, "/users" and "/users/" match
+    /// the same rules, whether literal, parameterised or `path_regex`.
+    strict_slash: bool = false,
+    /// Top-level `case_insensitive_paths:`. When set, literal parts of rule
+    /// paths match any letter case; captured parameters keep the request's.
+    /// `path_regex` rules are unaffected.
+    case_insensitive_paths: bool = false,
+    /// Top-level `trust_proxy:`. When set, `client_ip` rules match the first
+    /// `X-Forwarded-For` address rather than the connection's.
+    trust_proxy: bool = false,
+    /// Top-level `request_charset:`, the charset request bodies are decoded
+    /// from before matching and templating, unless a rule sets its own
+    request_charset: ?Charset = null,
+    /// Top-level `listeners:`, the ports served besides the main one. Their
+    /// rules are in `rules`, marked with `Rule.listener`. Read once at
+    /// startup; 0 marks an invalid port, which validation reports.
+    listeners: ?[]const u16 = null,
+    /// Top-level `admin_port:`; serves the admin API on its own listener when set.
+    /// Read once at startup. 0 marks an invalid value, which validation reports.
+    admin_port: ?u16 = null,
+    /// Top-level `shutdown_timeout:`; see `shutdownTimeoutMs`
+    shutdown_timeout_ms: ?u64 = null,
+    /// Top-level `max_concurrent:`; requests beyond this many in flight get
+    /// a 503. 0 marks an invalid value, which validation reports.
+    max_concurrent: ?u32 = null,
+    /// Top-level `startup_delay:`; `/__popshop/ready` answers 503 until this
+    /// long after the server starts
+    startup_delay_ms: ?u64 = null,
+    /// Top-level `latency:`; every response waits a random time in this
+    /// range, on top of its own `delay`
+    latency: ?Latency = null,
+    /// Top-level `startup_block_routes:`; every route answers 503 during
+    /// `startup_delay` too, not just the readiness endpoint
+    startup_block_routes: bool = false,
+    /// Top-level `read_timeout:`, `write_timeout:` and `idle_timeout:`,
+    /// overriding the server's defaults. Read once at startup.
+    read_timeout_ms: ?u64 = null,
+    write_timeout_ms: ?u64 = null,
+    idle_timeout_ms: ?u64 = null,
+    /// Top-level `compression:`; see `compressionConfig`
+    compression: ?CompressionConfig = null,
+    /// Top-level `host:`; interface to bind, where "" means all interfaces.
+    /// This and `port`/`socket` are read once at startup; command-line flags win.
+    host: ?[]const u8 = null,
+    /// Top-level `port:`; 0 binds a free port picked by the OS. Values above
+    /// 65535 mark an invalid port, which validation reports.
+    port: ?u32 = null,
+    /// Top-level `socket:`; Unix domain socket to listen on instead of TCP,
+    /// resolved relative to the config file
+    socket: ?[]const u8 = null,
+    /// Top-level `state_file:`; JSON file keeping response sequence positions
+    /// across restarts, resolved relative to the config file. Read once at startup.
+    state_file: ?[]const u8 = null,
+    /// Top-level `vars:`; named strings templates read as `{{.Vars.name}}`,
+    /// with `${VAR}` references expanded at load
+    vars: ?std.StringHashMap([]const u8) = null,
+    /// Top-level `imports:`; config files merged ahead of this one, resolved
+    /// relative to it. Only the file loaders follow them.
+    imports: ?[]const []const u8 = null,
+    /// Top-level `merge_strategy:`; applies to this file's imports
+    merge_strategy: MergeStrategy = .append,
+    /// Top-level `on_duplicate:`; applied once the config is loaded
+    on_duplicate: OnDuplicate = .@"error",
+    /// What `${VAR}` references in the config's files expanded to, so
+    /// `--print-config --redact` can hide them
+    env_values: std.ArrayList([]const u8),
+    allocator: std.mem.Allocator,
+
+    /// How long in-flight requests get to finish on shutdown when unset
+    pub const default_shutdown_timeout_ms: u64 = 10000;
+
+    pub fn init(allocator: std.mem.Allocator) Config {
+        return Config{
+            .rules = std.ArrayList(Rule).init(allocator),
+            .env_values = std.ArrayList([]const u8).init(allocator),
+            .allocator = allocator,
+        };
+    }
+
+    pub fn deinit(self: *Config) void {
+        for (self.rules.items) |*rule| {
+            rule.deinit(self.allocator);
+        }
+        self.rules.deinit();
+        for (self.env_values.items) |value| {
+            self.allocator.free(value);
+        }
+        self.env_values.deinit();
+        if (self.cors) |*cors| {
+            cors.deinit(self.allocator);
+        }
+        if (self.default_response) |*response| {
+            response.deinit(self.allocator);
+        }
+        if (self.not_found) |*response| {
+            response.deinit(self.allocator);
+        }
+        if (self.root_response) |*response| {
+            response.deinit(self.allocator);
+        }
+        if (self.server_error) |*response| {
+            response.deinit(self.allocator);
+        }
+        if (self.host) |host| {
+            self.allocator.free(host);
+        }
+        if (self.socket) |socket| {
+            self.allocator.free(socket);
+        }
+        if (self.state_file) |state_file| {
+            self.allocator.free(state_file);
+        }
+        if (self.vars) |*vars| {
+            deinitStringMap(self.allocator, vars);
+        }
+        if (self.imports) |imports| {
+            freeStringList(self.allocator, imports);
+        }
+        if (self.listeners) |ports| {
+            self.allocator.free(ports);
+        }
+    }
+
+    /// Grace period for in-flight requests on SIGINT/SIGTERM
+    pub fn shutdownTimeoutMs(self: *const Config) u64 {
+        return self.shutdown_timeout_ms orelse default_shutdown_timeout_ms;
+    }
+
+    /// Gzip settings, with defaults when the config has no `compression:` section
+    pub fn compressionConfig(self: *const Config) CompressionConfig {
+        return self.compression orelse .{};
+    }
+
+    pub fn addRule(self: *Config, rule: Rule) !void {
+        try self.rules.append(rule);
+    }
+
+    /// Check every rule and collect all problems rather than stopping at the first.
+    /// Rules are numbered from 1 in the messages, in the order they were loaded.
+    pub fn validate(self: *const Config, allocator: std.mem.Allocator) !ValidationErrors {
+        var errors = ValidationErrors.init(allocator);
+        errdefer errors.deinit();
+
+        for (self.rules.items, 1..) |rule, number| {
+            errors.current_rule = number - 1;
+            const request = rule.request;
+            const label = request.displayPath();
+
+            for (request.methods) |method| {
+                if (!std.mem.eql(u8, method, "*") and interfaces.Method.fromString(method) == null) {
+                    try errors.addAt("request.method|methods|verb|verbs", "rule {d} ({s}): unknown HTTP method '{s}'", .{ number, label, method });
+                }
+            }
+            if (request.path_regex) |pattern| {
+                if (request.path.len > 0) {
+                    try errors.addAt("request.path_regex", "rule {d} ({s}): set either path or path_regex, not both", .{ number, label });
+                }
+                if (request.path_prefix != null) {
+                    try errors.addAt("request.path_regex", "rule {d} ({s}): set either path_prefix or path_regex, not both", .{ number, label });
+                }
+                var diagnostic = Regex.Diagnostic{};
+                if (Regex.compile(allocator, pattern, &diagnostic)) |compiled| {
+                    var regex = compiled;
+                    regex.deinit();
+                } else |err| switch (err) {
+                    error.OutOfMemory => return err,
+                    error.InvalidPattern => try errors.addAt("request.path_regex", "rule {d}: invalid path_regex '{s}': {s} at offset {d}", .{
+                        number, pattern, diagnostic.message, diagnostic.offset,
+                    }),
+                }
+            } else if (request.path_prefix) |prefix| {
+                if (request.path.len > 0) {
+                    try errors.addAt("request.path_prefix", "rule {d} ({s}): set either path or path_prefix, not both", .{ number, label });
+                } else if (prefix.len == 0 or prefix[0] != '/') {
+                    try errors.addAt("request.path_prefix", "rule {d} ({s}): path_prefix must start with '/'", .{ number, label });
+                }
+            } else if (request.path.len == 0) {
+                try errors.addAt("request.path", "rule {d}: path must not be empty", .{number});
+            } else if (request.path[0] != '/' and !std.mem.eql(u8, request.path, "*")) {
+                try errors.addAt("request.path", "rule {d} ({s}): path must start with '/'", .{ number, request.path });
+            }
+            if (request.body_json) |body_json| {
+                var paths = body_json.keyIterator();
+                while (paths.next()) |body_path| {
+                    if (!json_path.isValid(body_path.*)) {
+                        try errors.addAt("request.body", "rule {d} ({s}): invalid JSON path '{s}'", .{ number, label, body_path.* });
+                    }
+                }
+            }
+            if (request.cookies) |cookies| {
+                var names = cookies.keyIterator();
+                while (names.next()) |name| {
+                    if (name.*.len == 0 or std.mem.indexOfAny(u8, name.*, "=;, \t") != null) {
+                        try errors.addAt("request.cookies", "rule {d} ({s}): cookie name '{s}' must be non-empty without '=', ';', ',' or spaces", .{ number, label, name.* });
+                    }
+                }
+            }
+            if (request.content_type) |content_type| {
+                const media_type = interfaces.mediaType(content_type);
+                const slash = std.mem.indexOfScalar(u8, media_type, '/');
+                if (slash == null or slash.? == 0 or slash.? == media_type.len - 1) {
+                    try errors.addAt("request.content_type", "rule {d} ({s}): content_type '{s}' is not a media type like application/json", .{ number, label, content_type });
+                }
+            }
+            if (request.headers_absent) |names| {
+                if (request.headers) |headers| {
+                    for (names) |name| {
+                        var required = headers.keyIterator();
+                        while (required.next()) |required_name| {
+                            if (std.ascii.eqlIgnoreCase(name, required_name.*)) {
+                                try errors.addAt("request.headers_absent", "rule {d} ({s}): header '{s}' is both required and absent, so the rule never matches", .{ number, label, name });
+                            }
+                        }
+                    }
+                }
+            }
+            if (request.client_ip) |client_ip| {
+                if (request.client_range == null) {
+                    try errors.addAt("request.client_ip", "rule {d} ({s}): client_ip '{s}' is not an IP address or CIDR block like 10.0.0.0/8", .{ number, label, client_ip });
+                }
+            }
+            if (request.proto) |proto| {
+                if (request.proto_version == null) {
+                    try errors.addAt("request.proto", "rule {d} ({s}): proto '{s}' is not 1.0 or 1.1, the HTTP versions the server speaks", .{ number, label, proto });
+                }
+            }
+            if (request.auth) |auth| {
+                if (auth.username.len == 0) {
+                    try errors.addAt("request.auth", "rule {d} ({s}): auth needs a username", .{ number, label });
+                } else if (std.mem.indexOfScalar(u8, auth.username, ':') != null) {
+                    try errors.addAt("request.auth.username", "rule {d} ({s}): auth username can't contain ':'", .{ number, label });
+                }
+                if (auth.password.len == 0) {
+                    try errors.addAt("request.auth", "rule {d} ({s}): auth needs a password", .{ number, label });
+                }
+            }
+            if (request.body_regex) |pattern| {
+                var diagnostic = Regex.Diagnostic{};
+                if (Regex.compile(allocator, pattern, &diagnostic)) |compiled| {
+                    var regex = compiled;
+                    regex.deinit();
+                } else |err| switch (err) {
+                    error.OutOfMemory => return err,
+                    error.InvalidPattern => try errors.addAt("request.body_regex", "rule {d} ({s}): invalid body_regex '{s}': {s} at offset {d}", .{
+                        number, label, pattern, diagnostic.message, diagnostic.offset,
+                    }),
+                }
+            }
+            if (request.body_size) |size| {
+                if (size.max != null and size.min > size.max.?) {
+                    try errors.addAt("request.body_size", "rule {d} ({s}): body_size min of {d} bytes is above its max of {d}", .{ number, label, size.min, size.max.? });
+                }
+            }
+            if (request.max_body_message != null and request.max_body_size == null) {
+                try errors.addAt("request.max_body_message", "rule {d} ({s}): max_body_message needs a max_body_size", .{ number, label });
+            }
+            if (request.rate_limit) |limiter| {
+                if (limiter.requests == 0) {
+                    try errors.addAt("request.rate_limit.requests", "rule {d} ({s}): rate_limit needs requests of at least 1", .{ number, label });
+                }
+                if (limiter.per_ms == 0) {
+                    try errors.addAt("request.rate_limit.per", "rule {d} ({s}): rate_limit needs a per duration above zero", .{ number, label });
+                }
+            }
+            errors.scope = .{ .path = "response" };
+            if (rule.response) |response| {
+                try validateResponse(&errors, allocator, number, label, response);
+            }
+            errors.scope = .{ .path = "response", .list = true };
+            if (rule.sequence) |sequence| {
+                for (sequence.responses) |response| {
+                    try validateResponse(&errors, allocator, number, label, response);
+                }
+            }
+            errors.scope = .{};
+            if (rule.weighted) |weighted| {
+                if (rule.response != null or rule.sequence != null) {
+                    try errors.addAt("responses", "rule {d} ({s}): set either response or responses, not both", .{ number, label });
+                }
+                for (weighted.responses, 1..) |response, position| {
+                    errors.scope = .{ .path = "responses", .list = true };
+                    defer errors.scope = .{};
+                    try validateResponse(&errors, allocator, number, label, response);
+                    // Written so NaN, the marker for an unparseable value, fails too
+                    if (!(response.weight >= 0 and std.math.isFinite(response.weight))) {
+                        try errors.addAt("responses", "rule {d} ({s}): response {d} weight must be a non-negative number", .{ number, label, position });
+                    }
+                }
+                if (!(weighted.totalWeight() > 0)) {
+                    try errors.addAt("responses", "rule {d} ({s}): responses need at least one positive weight", .{ number, label });
+                }
+            }
+            if (rule.schedule) |schedule| {
+                if (rule.response != null or rule.sequence != null or rule.weighted != null) {
+                    try errors.addAt("schedule", "rule {d} ({s}): set either schedule or response/responses, not both", .{ number, label });
+                }
+                for (schedule.phases, 1..) |phase, position| {
+                    errors.scope = .{ .path = "schedule", .list = true };
+                    defer errors.scope = .{};
+                    try validateResponse(&errors, allocator, number, label, phase.response);
+                    if (phase.duration_ms == 0) {
+                        try errors.addAt("schedule", "rule {d} ({s}): schedule phase {d} needs a duration above zero", .{ number, label, position });
+                    }
+                }
+            }
+            if (rule.static) |static| {
+                if (rule.isMock() or rule.isProxy()) {
+                    try errors.addAt("static", "rule {d} ({s}): static can't be combined with a response or a proxy", .{ number, label });
+                }
+                if (std.fs.cwd().openDir(static.dir, .{})) |opened| {
+                    var dir = opened;
+                    dir.close();
+                } else |err| {
+                    try errors.addAt("static.dir", "rule {d} ({s}): static dir '{s}' can't be opened: {s}", .{ number, label, static.dir, @errorName(err) });
+                }
+                if (static.index) |index| {
+                    if (static_files.safePath(index) == null) {
+                        try errors.addAt("static.index", "rule {d} ({s}): static index '{s}' must be a file inside dir", .{ number, label, index });
+                    }
+                }
+            } else if (!rule.isMock() and !rule.isProxy()) {
+                try errors.add("rule {d} ({s}): needs a response or a proxy", .{ number, label });
+            }
+            if (rule.max_matches == 0) {
+                try errors.addAt("max_matches", "rule {d} ({s}): max_matches must be at least 1", .{ number, label });
+            }
+            if (rule.proxy) |proxy_config| {
+                if (try headerTemplateViolation(allocator, proxy_config.url)) |message| {
+                    defer allocator.free(message);
+                    try errors.addAt("proxy.url", "rule {d} ({s}): proxy url template: {s}", .{ number, label, message });
+                }
+                if (proxy_config.upstreams) |upstreams| {
+                    try validateUpstreams(&errors, allocator, number, label, proxy_config.url, upstreams);
+                }
+                if (proxy_config.headers) |headers| {
+                    var iter = headers.iterator();
+                    while (iter.next()) |entry| {
+                        if (try headerTemplateViolation(allocator, entry.value_ptr.*)) |message| {
+                            defer allocator.free(message);
+                            try errors.addAt("proxy.headers", "rule {d} ({s}): proxy header '{s}' template: {s}", .{ number, label, entry.key_ptr.*, message });
+                        }
+                    }
+                }
+                if (proxy_config.path_rewrite) |rewrite| {
+                    try validatePathRewrite(&errors, allocator, number, label, rewrite);
+                }
+                if (proxy_config.response_rewrite) |rewrite| {
+                    try validateResponseRewrite(&errors, number, label, rewrite);
+                }
+                if (proxy_config.fallback == .response and !rule.isMock()) {
+                    try errors.addAt("proxy.fallback", "rule {d} ({s}): fallback: response needs a response on the rule", .{ number, label });
+                }
+                if (proxy_config.fallback_on_error_status and proxy_config.fallback == .none) {
+                    try errors.addAt("proxy.fallback_on_error_status", "rule {d} ({s}): fallback_on_error_status needs fallback: response", .{ number, label });
+                }
+            }
+        }
+
+        if (self.on_duplicate == .@"error") {
+            const conflicts = try self.findDuplicates(allocator);
+            defer allocator.free(conflicts);
+            for (conflicts) |conflict| {
+                const earlier = &self.rules.items[conflict.first];
+                const later = &self.rules.items[conflict.second];
+                const earlier_location = try earlier.location(allocator);
+                defer allocator.free(earlier_location);
+                const later_location = try later.location(allocator);
+                defer allocator.free(later_location);
+                errors.current_rule = conflict.second;
+                try errors.addAt("request.path|path_regex|path_prefix", "rule {d} ({s} {s}) at {s} duplicates rule {d} at {s}; remove one or set on_duplicate to first_wins, last_wins or merge", .{
+                    conflict.second + 1,
+                    conflict.method,
+                    later.request.displayPath(),
+                    later_location,
+                    conflict.first + 1,
+                    earlier_location,
+                });
+            }
+        }
+
+        errors.current_rule = null;
+
+        if (self.default_response) |response| {
+            try validateTopLevelResponse(&errors, allocator, "default_response", response);
+        }
+        if (self.not_found) |response| {
+            try validateTopLevelResponse(&errors, allocator, "not_found", response);
+        }
+        if (self.root_response) |response| {
+            try validateTopLevelResponse(&errors, allocator, "root_response", response);
+        }
+        if (self.server_error) |response| {
+            try validateTopLevelResponse(&errors, allocator, "server_error", response);
+            if (response.isTemplated() or response.body_file != null) {
+                try errors.add("server_error: body must be inline and can't be a template, since it answers template and file errors", .{});
+            }
+        }
+
+        if (self.admin_port) |port| {
+            if (port == 0) {
+                try errors.add("admin_port: must be a port number between 1 and 65535", .{});
+            }
+        }
+        if (self.listeners) |ports| {
+            for (ports, 0..) |port, index| {
+                if (port == 0) {
+                    try errors.add("listeners: entry {d} needs a port number between 1 and 65535", .{index + 1});
+                } else if (std.mem.indexOfScalar(u16, ports[0..index], port) != null) {
+                    try errors.add("listeners: port {d} is listed more than once", .{port});
+                } else if (self.port != null and self.port.? == port) {
+                    try errors.add("listeners: port {d} is the main port", .{port});
+                } else if (self.admin_port != null and self.admin_port.? == port) {
+                    try errors.add("listeners: port {d} is the admin_port", .{port});
+                }
+            }
+        }
+        if (self.port) |port| {
+            if (port > std.math.maxInt(u16)) {
+                try errors.add("port: must be a port number between 0 and 65535", .{});
+            }
+        }
+        if (self.max_concurrent) |limit| {
+            if (limit == 0) {
+                try errors.add("max_concurrent: must be a whole number of at least 1", .{});
+            }
+        }
+        if (self.latency) |latency| {
+            if (latency.min_ms > latency.max_ms) {
+                try errors.add("latency: min of {d}ms is above max of {d}ms", .{ latency.min_ms, latency.max_ms });
+            }
+        }
+        if (self.socket) |socket| {
+            // sun_path also holds the terminating NUL
+            const max_socket_path = @typeInfo(@FieldType(std.posix.sockaddr.un, "path")).array.len - 1;
+            if (socket.len > max_socket_path) {
+                try errors.add("socket: path is longer than {d} bytes: {s}", .{ max_socket_path, socket });
+            }
+        }
+
+        return errors;
+    }
+
+    /// Why a static body breaks its `body_schema`, or null if it conforms.
+    /// Dynamic bodies are checked when they are served instead.
+    fn staticBodyViolation(allocator: std.mem.Allocator, response: MockResponse) !?[]const u8 {
+        const schema = response.schema orelse return null;
+        if (response.hasDynamicBody() or response.stream != null or response.variants != null) return null;
+
+        var arena = std.heap.ArenaAllocator.init(allocator);
+        defer arena.deinit();
+        const message = try schema.validateText(arena.allocator(), response.body) orelse return null;
+        return try allocator.dupe(u8, message);
+    }
+
+    /// Why a templated `body_file` fails to parse, or null if it parses or
+    /// can't be read yet; a missing file is reported when it is served
+    fn bodyTemplateViolation(allocator: std.mem.Allocator, response: MockResponse) !?[]const u8 {
+        const body_file = response.body_file orelse return null;
+        if (!response.isTemplated()) return null;
+
+        var arena = std.heap.ArenaAllocator.init(allocator);
+        defer arena.deinit();
+        const source = std.fs.cwd().readFileAlloc(arena.allocator(), body_file, FileCache.max_file_size) catch return null;
+        var diagnostic = template.Diagnostic{};
+        template.check(arena.allocator(), source, &diagnostic) catch |err| switch (err) {
+            error.OutOfMemory => return err,
+            else => return try allocator.dupe(u8, diagnostic.message),
+        };
+        return null;
+    }
+
+    /// What's wrong with a response's `repeat` or `truncate`, if anything
+    fn sizeViolation(response: MockResponse) ?[]const u8 {
+        if (response.repeat == 0) return "repeat must be a whole number of at least 1";
+        if (response.repeat == 1 and response.truncate == null) return null;
+        if (response.stream != null or response.websocket != null) {
+            return "repeat and truncate only apply to a body, not a stream or websocket";
+        }
+        return null;
+    }
+
+    /// What's wrong with a response's `variants`, if anything
+    fn variantsViolation(response: MockResponse) ?[]const u8 {
+        const variants = response.variants orelse return null;
+        if (variants.len == 0) return "variants needs at least one entry";
+        for (variants) |variant| {
+            const media_type = interfaces.mediaType(variant.content_type);
+            const slash = std.mem.indexOfScalar(u8, media_type, '/') orelse return "variant content_type must be a media type like application/json";
+            if (slash == 0 or slash == media_type.len - 1 or std.mem.indexOfScalar(u8, media_type, '*') != null) {
+                return "variant content_type must be a media type like application/json";
+            }
+        }
+        if (response.body_schema != null) return "body_schema can't check variants, which differ in content type";
+        if (response.stream != null or response.websocket != null) return "variants only apply to a body, not a stream or websocket";
+        return null;
+    }
+
+    /// Checks for `default_response`, `not_found`, `root_response` and
+    /// `server_error`, whose messages are prefixed with `name` instead of a
+    /// rule number
+    fn validateTopLevelResponse(errors: *ValidationErrors, allocator: std.mem.Allocator, name: []const u8, response: MockResponse) !void {
+        if (response.status_template) |status_template| {
+            if (try templateViolation(allocator, status_template)) |message| {
+                defer allocator.free(message);
+                try errors.add("{s}: status template: {s}", .{ name, message });
+            }
+        } else if (response.status < 100 or response.status > 599) {
+            try errors.add("{s}: status {d} is outside 100-599", .{ name, response.status });
+        }
+        if (try staticBodyViolation(allocator, response)) |message| {
+            defer allocator.free(message);
+            try errors.add("{s}: body does not match {s}: {s}", .{ name, response.body_schema.?, message });
+        }
+        if (sizeViolation(response)) |message| {
+            try errors.add("{s}: {s}", .{ name, message });
+        }
+        if (response.faker) |shape| {
+            if (try faker.check(allocator, shape)) |message| {
+                defer allocator.free(message);
+                try errors.add("{s}: faker: {s}", .{ name, message });
+            }
+        }
+        if (variantsViolation(response)) |message| {
+            try errors.add("{s}: {s}", .{ name, message });
+        }
+        if (response.redirect) |redirect| {
+            if (try redirectViolation(allocator, redirect)) |message| {
+                defer allocator.free(message);
+                try errors.add("{s}: redirect {s}", .{ name, message });
+            }
+        }
+        if (response.last_modified) |last_modified| {
+            if (conditional_get.parseHttpDate(last_modified) == null) {
+                try errors.add("{s}: last_modified '{s}' is not an HTTP date like 'Wed, 21 Oct 2015 07:28:00 GMT'", .{ name, last_modified });
+            }
+        }
+        if (response.headers) |headers| {
+            var iter = headers.iterator();
+            while (iter.next()) |entry| {
+                if (try headerTemplateViolation(allocator, entry.value_ptr.*)) |message| {
+                    defer allocator.free(message);
+                    try errors.add("{s}: header '{s}' template: {s}", .{ name, entry.key_ptr.*, message });
+                }
+            }
+        }
+        if (try trailersViolation(allocator, response)) |message| {
+            defer allocator.free(message);
+            try errors.add("{s}: {s}", .{ name, message });
+        }
+        if (quotaViolation(response)) |message| {
+            try errors.add("{s}: {s}", .{ name, message });
+        }
+        if (response.cookies) |cookies| {
+            for (cookies) |cookie| {
+                if (try cookieViolation(allocator, cookie)) |message| {
+                    defer allocator.free(message);
+                    try errors.add("{s}: cookie '{s}': {s}", .{ name, cookie.name, message });
+                }
+            }
+        }
+        if (response.fault) |fault| {
+            if (!(fault.probability >= 0 and fault.probability <= 1)) {
+                try errors.add("{s}: fault probability must be between 0.0 and 1.0", .{name});
+            }
+            if (fault.status < 100 or fault.status > 599) {
+                try errors.add("{s}: fault status {d} is outside 100-599", .{ name, fault.status });
+            }
+        }
+    }
+
+    /// Why a response cookie can't be sent as configured, or null if it can
+    fn cookieViolation(allocator: std.mem.Allocator, cookie: ResponseCookie) !?[]const u8 {
+        const separators = "()<>@,;:\\\"/[]?={} \t";
+        if (cookie.name.len == 0) return try allocator.dupe(u8, "name must not be empty");
+        for (cookie.name) |c| {
+            if (c <= ' ' or c >= 0x7f or std.mem.indexOfScalar(u8, separators, c) != null) {
+                return try allocator.dupe(u8, "name must be a token without spaces or separators such as '=' and ';'");
+            }
+        }
+        if (std.mem.indexOfAny(u8, cookie.value, ";\r\n") != null) {
+            return try allocator.dupe(u8, "value must not contain ';' or line breaks");
+        }
+        if (cookie.same_site == .none and !cookie.secure) {
+            return try allocator.dupe(u8, "same_site: none needs secure: true, or browsers drop the cookie");
+        }
+        if (cookie.isTemplated()) return templateViolation(allocator, cookie.value);
+        return null;
+    }
+
+    /// Why a templated header value won't render, or null if it will or
+    /// isn't a template
+    fn headerTemplateViolation(allocator: std.mem.Allocator, value: []const u8) !?[]const u8 {
+        if (!MockResponse.isTemplatedHeader(value)) return null;
+        return templateViolation(allocator, value);
+    }
+
+    /// Why a response's quota can't work as configured, or null if it can
+    fn quotaViolation(response: MockResponse) ?[]const u8 {
+        const quota = response.quota orelse return null;
+        if (quota.counter.limit == 0) return "quota limit must be at least 1";
+        if (quota.counter.window_ms == 0) return "quota window must be above zero";
+        if (quota.exceeded) |exceeded| {
+            if (exceeded.status < 100 or exceeded.status > 599) return "quota response status is outside 100-599";
+        }
+        return null;
+    }
+
+    /// Why a response's trailers can't be sent as configured, or null if they
+    /// can. Framing and routing headers have to come before the body.
+    fn trailersViolation(allocator: std.mem.Allocator, response: MockResponse) !?[]const u8 {
+        const trailers = response.trailers orelse return null;
+        if (response.truncate != null or response.connection_reset) {
+            return try allocator.dupe(u8, "trailers can't be sent with truncate or connection_reset");
+        }
+        const forbidden = [_][]const u8{ "Content-Length", "Content-Type", "Content-Encoding", "Transfer-Encoding", "Trailer", "Host", "Connection", "Set-Cookie" };
+        var iter = trailers.iterator();
+        while (iter.next()) |entry| {
+            for (forbidden) |header| {
+                if (std.ascii.eqlIgnoreCase(entry.key_ptr.*, header)) {
+                    return try std.fmt.allocPrint(allocator, "{s} can't be sent as a trailer", .{entry.key_ptr.*});
+                }
+            }
+            if (try headerTemplateViolation(allocator, entry.value_ptr.*)) |message| {
+                defer allocator.free(message);
+                return try std.fmt.allocPrint(allocator, "trailer '{s}' template: {s}", .{ entry.key_ptr.*, message });
+            }
+        }
+        return null;
+    }
+
+    /// Why a redirect can't be sent as configured, or null if it can
+    fn redirectViolation(allocator: std.mem.Allocator, redirect: Redirect) !?[]const u8 {
+        if (redirect.status < 300 or redirect.status > 399) {
+            return try std.fmt.allocPrint(allocator, "status {d} is not a 3xx status", .{redirect.status});
+        }
+        if (redirect.url.len == 0) return try allocator.dupe(u8, "url must not be empty");
+        if (std.mem.indexOfAny(u8, redirect.url, "\r\n") != null) {
+            return try allocator.dupe(u8, "url must not contain line breaks");
+        }
+        if (redirect.isTemplated()) {
+            if (try templateViolation(allocator, redirect.url)) |message| {
+                defer allocator.free(message);
+                return try std.fmt.allocPrint(allocator, "url template: {s}", .{message});
+            }
+        }
+        return null;
+    }
+
+    /// Why `source` won't render as a template, or null if it will
+    fn templateViolation(allocator: std.mem.Allocator, source: []const u8) !?[]const u8 {
+        var arena = std.heap.ArenaAllocator.init(allocator);
+        defer arena.deinit();
+        var diagnostic = template.Diagnostic{};
+        template.check(arena.allocator(), source, &diagnostic) catch |err| switch (err) {
+            error.OutOfMemory => return err,
+            else => return try allocator.dupe(u8, diagnostic.message),
+        };
+        return null;
+    }
+
+    fn validatePathRewrite(errors: *ValidationErrors, allocator: std.mem.Allocator, number: usize, label: []const u8, rewrite: PathRewrite) !void {
+        if (rewrite.regex) |pattern| {
+            if (rewrite.strip_prefix != null or rewrite.add_prefix != null) {
+                try errors.addAt("proxy.path_rewrite", "rule {d} ({s}): path_rewrite takes either regex or strip_prefix/add_prefix, not both", .{ number, label });
+            }
+            var diagnostic = Regex.Diagnostic{};
+            if (Regex.compile(allocator, pattern, &diagnostic)) |compiled| {
+                var regex = compiled;
+                regex.deinit();
+            } else |err| switch (err) {
+                error.OutOfMemory => return err,
+                error.InvalidPattern => try errors.addAt("proxy.path_rewrite.regex", "rule {d} ({s}): invalid path_rewrite regex '{s}': {s} at offset {d}", .{
+                    number, label, pattern, diagnostic.message, diagnostic.offset,
+                }),
+            }
+        } else if (rewrite.strip_prefix == null and rewrite.add_prefix == null) {
+            try errors.addAt("proxy.path_rewrite", "rule {d} ({s}): path_rewrite needs strip_prefix, add_prefix or regex", .{ number, label });
+        }
+    }
+
+    fn validateResponseRewrite(errors: *ValidationErrors, number: usize, label: []const u8, rewrite: ResponseRewrite) !void {
+        for (rewrite.body_replace, 1..) |replacement, position| {
+            if (replacement.find.len == 0) {
+                try errors.addAt("proxy.response_rewrite.body_replace", "rule {d} ({s}): body_replace {d} needs a non-empty find", .{ number, label, position });
+            }
+        }
+        for (rewrite.json_patch) |patch| {
+            if (!json_path.isValid(patch.path)) {
+                try errors.addAt("proxy.response_rewrite.json_patch", "rule {d} ({s}): invalid json_patch path '{s}'", .{ number, label, patch.path });
+            }
+        }
+    }
+
+    fn validateStatus(errors: *ValidationErrors, number: usize, path: []const u8, status: u16) !void {
+        if (status < 100 or status > 599) {
+            try errors.addAt("status", "rule {d} ({s}): status {d} is outside 100-599", .{ number, path, status });
+        }
+    }
+
+    fn validateUpstreams(errors: *ValidationErrors, allocator: std.mem.Allocator, number: usize, label: []const u8, url: []const u8, upstreams: []const ProxyUpstream) !void {
+        if (url.len > 0) {
+            try errors.addAt("proxy.upstreams", "rule {d} ({s}): set either proxy url or upstreams, not both", .{ number, label });
+        }
+        if (upstreams.len == 0) {
+            try errors.addAt("proxy.upstreams", "rule {d} ({s}): proxy upstreams need at least one url", .{ number, label });
+            return;
+        }
+        var total: f64 = 0;
+        for (upstreams, 1..) |upstream, position| {
+            // Written so NaN, the marker for an unparseable value, fails too
+            if (!(upstream.weight >= 0 and std.math.isFinite(upstream.weight))) {
+                try errors.addAt("proxy.upstreams", "rule {d} ({s}): upstream {d} weight must be a non-negative number", .{ number, label, position });
+            } else {
+                total += upstream.weight;
+            }
+            if (try headerTemplateViolation(allocator, upstream.url)) |message| {
+                defer allocator.free(message);
+                try errors.addAt("proxy.upstreams", "rule {d} ({s}): upstream {d} url template: {s}", .{ number, label, position, message });
+            }
+        }
+        if (total <= 0) {
+            try errors.addAt("proxy.upstreams", "rule {d} ({s}): proxy upstreams need at least one positive weight", .{ number, label });
+        }
+    }
+
+    fn validateResponse(errors: *ValidationErrors, allocator: std.mem.Allocator, number: usize, path: []const u8, response: MockResponse) !void {
+        try validateResponseFields(errors, allocator, number, path, response);
+        const branches = response.when orelse return;
+
+        const outer = errors.scope;
+        defer errors.scope = outer;
+        if (!outer.list) {
+            // Branch fields point at the `when` list
+            errors.scope = .{ .path = "response.when", .list = true };
+        }
+        for (branches, 1..) |branch, position| {
+            const condition = branch.condition;
+            const tests = @as(u8, @intFromBool(condition.header != null)) +
+                @intFromBool(condition.query != null) +
+                @intFromBool(condition.body_contains != null);
+            if (tests != 1) {
+                try errors.addAt("when", "rule {d} ({s}): when branch {d} condition needs exactly one of header, query or body_contains", .{ number, path, position });
+            } else if (condition.equals != null and condition.body_contains != null) {
+                try errors.addAt("when", "rule {d} ({s}): when branch {d} condition can only use equals with header or query", .{ number, path, position });
+            }
+            try validateResponseFields(errors, allocator, number, path, branch.response);
+        }
+    }
+
+    /// Checks for a single response, not counting its `when` branches
+    fn validateResponseFields(errors: *ValidationErrors, allocator: std.mem.Allocator, number: usize, path: []const u8, response: MockResponse) !void {
+        if (response.status_template) |status_template| {
+            if (try templateViolation(allocator, status_template)) |message| {
+                defer allocator.free(message);
+                try errors.addAt("status", "rule {d} ({s}): status template: {s}", .{ number, path, message });
+            }
+        } else {
+            try validateStatus(errors, number, path, response.status);
+        }
+        if (try staticBodyViolation(allocator, response)) |message| {
+            defer allocator.free(message);
+            try errors.addAt("body", "rule {d} ({s}): body does not match {s}: {s}", .{ number, path, response.body_schema.?, message });
+        }
+        if (response.stream != null and response.body_schema != null) {
+            try errors.addAt("body_schema", "rule {d} ({s}): body_schema can't check a stream response", .{ number, path });
+        }
+        if (sizeViolation(response)) |message| {
+            try errors.addAt(if (response.repeat == 0) "repeat" else "truncate", "rule {d} ({s}): {s}", .{ number, path, message });
+        }
+        if (response.content_length != null) {
+            if (response.stream != null or response.websocket != null) {
+                try errors.addAt("content_length", "rule {d} ({s}): content_length only applies to a body, not a stream or websocket", .{ number, path });
+            } else if (response.trailers != null) {
+                try errors.addAt("content_length", "rule {d} ({s}): content_length can't be combined with trailers, which need a chunked body", .{ number, path });
+            }
+        }
+        if (response.faker) |shape| {
+            if (try faker.check(allocator, shape)) |message| {
+                defer allocator.free(message);
+                try errors.addAt("faker", "rule {d} ({s}): faker: {s}", .{ number, path, message });
+            }
+        }
+        if (variantsViolation(response)) |message| {
+            try errors.addAt("variants", "rule {d} ({s}): {s}", .{ number, path, message });
+        }
+        if (response.websocket) |websocket| {
+            if (websocket.messages.len == 0 and !websocket.echo) {
+                try errors.addAt("websocket", "rule {d} ({s}): websocket needs messages, echo: true or both", .{ number, path });
+            }
+        }
+        if (response.redirect) |redirect| {
+            if (try redirectViolation(allocator, redirect)) |message| {
+                defer allocator.free(message);
+                try errors.addAt("redirect", "rule {d} ({s}): redirect {s}", .{ number, path, message });
+            }
+        }
+        if (response.last_modified) |last_modified| {
+            if (conditional_get.parseHttpDate(last_modified) == null) {
+                try errors.addAt("last_modified", "rule {d} ({s}): last_modified '{s}' is not an HTTP date like 'Wed, 21 Oct 2015 07:28:00 GMT'", .{ number, path, last_modified });
+            }
+        }
+        if (try bodyTemplateViolation(allocator, response)) |message| {
+            defer allocator.free(message);
+            try errors.addAt("body_template_file", "rule {d} ({s}): template {s}: {s}", .{ number, path, response.body_file.?, message });
+        }
+        if (response.headers) |headers| {
+            var iter = headers.iterator();
+            while (iter.next()) |entry| {
+                if (try headerTemplateViolation(allocator, entry.value_ptr.*)) |message| {
+                    defer allocator.free(message);
+                    try errors.addAt("headers", "rule {d} ({s}): header '{s}' template: {s}", .{ number, path, entry.key_ptr.*, message });
+                }
+            }
+        }
+        if (try trailersViolation(allocator, response)) |message| {
+            defer allocator.free(message);
+            try errors.addAt("trailers", "rule {d} ({s}): {s}", .{ number, path, message });
+        }
+        if (quotaViolation(response)) |message| {
+            try errors.addAt("quota", "rule {d} ({s}): {s}", .{ number, path, message });
+        }
+        if (response.cookies) |cookies| {
+            for (cookies) |cookie| {
+                if (try cookieViolation(allocator, cookie)) |message| {
+                    defer allocator.free(message);
+                    try errors.addAt("cookies", "rule {d} ({s}): cookie '{s}': {s}", .{ number, path, cookie.name, message });
+                }
+            }
+        }
+        if (response.fault) |fault| {
+            // Written so NaN, the marker for an unparseable value, fails too
+            if (!(fault.probability >= 0 and fault.probability <= 1)) {
+                try errors.addAt("fault.probability", "rule {d} ({s}): fault probability must be between 0.0 and 1.0", .{ number, path });
+            }
+            if (fault.status < 100 or fault.status > 599) {
+                try errors.addAt("fault.status", "rule {d} ({s}): fault status {d} is outside 100-599", .{ number, path, fault.status });
+            }
+        }
+    }
+
+    /// Load configuration from YAML file or directory
+    pub fn loadFromFile(allocator: std.mem.Allocator, path: []const u8) !Config {
+        return loadFromFileWithOptions(allocator, path, .{});
+    }
+
+    pub fn loadFromFileWithOptions(allocator: std.mem.Allocator, path: []const u8, options: LoadOptions) !Config {
+        if (remote_config.isUrl(path)) return loadFromUrl(allocator, path, options);
+
+        // Check if path is a file or directory
+        const stat = std.fs.cwd().statFile(path) catch |err| switch (err) {
+            error.FileNotFound => {
+                // Try as directory
+                return loadFromDirectoryWithOptions(allocator, path, options);
+            },
+            else => return err,
+        };
+
+        switch (stat.kind) {
+            .file => {
+                var config = try loadFileWithImports(allocator, path, options);
+                errdefer config.deinit();
+                try config.resolveDuplicates();
+                return config;
+            },
+            .directory => return loadFromDirectoryWithOptions(allocator, path, options),
+            else => return error.InvalidPathType,
+        }
+    }
+
+    /// Two rules with the same path and an overlapping method, where one
+    /// can never match because the other always wins: it has a higher
+    /// priority, or the same priority and comes earlier
+    pub const Conflict = struct {
+        /// Indexes into `rules`; `first` wins and `second` never matches.
+        /// `first` < `second` unless `first` has the higher priority.
+        first: usize,
+        second: usize,
+        /// A method both rules accept
+        method: []const u8,
+    };
+
+    /// Find rules shadowed by another rule for the same path and method.
+    /// Only rules without header, query or body constraints are compared;
+    /// constrained rules can still be told apart at request time. A winner
+    /// with `max_matches` shadows nothing, as requests fall through once
+    /// it runs out.
+    pub fn findConflicts(self: *const Config, allocator: std.mem.Allocator) ![]Conflict {
+        var conflicts = std.ArrayList(Conflict).init(allocator);
+        errdefer conflicts.deinit();
+
+        const rules = self.rules.items;
+        for (rules, 0..) |*shadowed, second| {
+            if (hasConstraints(&shadowed.request)) continue;
+            for (rules, 0..) |*winner, first| {
+                const wins = winner.priority > shadowed.priority or (winner.priority == shadowed.priority and first < second);
+                if (!wins or hasConstraints(&winner.request) or winner.max_matches != null) continue;
+                if (winner.listener != shadowed.listener) continue;
+                if (!samePathKind(&winner.request, &shadowed.request)) continue;
+                if (!self.samePath(&winner.request, &shadowed.request)) continue;
+
+                const method = sharedMethod(&winner.request, &shadowed.request) orelse continue;
+                try conflicts.append(.{ .first = first, .second = second, .method = method });
+                break;
+            }
+        }
+        return conflicts.toOwnedSlice();
+    }
+
+    /// The conflicts `on_duplicate` applies to: pairs of equal priority, as
+    /// a higher priority is a deliberate choice of winner
+    fn findDuplicates(self: *const Config, allocator: std.mem.Allocator) ![]Conflict {
+        const conflicts = try self.findConflicts(allocator);
+        defer allocator.free(conflicts);
+
+        var duplicates = std.ArrayList(Conflict).init(allocator);
+        errdefer duplicates.deinit();
+        for (conflicts) |conflict| {
+            if (self.rules.items[conflict.first].priority != self.rules.items[conflict.second].priority) continue;
+            try duplicates.append(conflict);
+        }
+        return duplicates.toOwnedSlice();
+    }
+
+    /// Settle duplicate rules by `on_duplicate`. Under `error` they are left
+    /// for `validate` to report. Run by the loaders once a config is complete.
+    pub fn resolveDuplicates(self: *Config) !void {
+        if (self.on_duplicate == .@"error") return;
+        const allocator = self.allocator;
+
+        // Each pass settles the first duplicate found for every rule; a rule
+        // duplicating several others takes a pass for each
+        while (true) {
+            const conflicts = try self.findDuplicates(allocator);
+            defer allocator.free(conflicts);
+            if (conflicts.len == 0) return;
+
+            const dropped = try allocator.alloc(bool, self.rules.items.len);
+            defer allocator.free(dropped);
+            @memset(dropped, false);
+            var changed = false;
+            for (conflicts) |conflict| {
+                if (dropped[conflict.first] or dropped[conflict.second]) continue;
+                const earlier = &self.rules.items[conflict.first];
+                const later = &self.rules.items[conflict.second];
+                switch (self.on_duplicate) {
+                    .@"error" => unreachable,
+                    .first_wins, .last_wins => {
+                        const drop = if (self.on_duplicate == .first_wins) conflict.second else conflict.first;
+                        std.log.info("Dropping rule {d} ({s}), which duplicates rule {d} (on_duplicate: {s})", .{
+                            drop + 1,
+                            self.rules.items[drop].request.displayPath(),
+                            (if (drop == conflict.first) conflict.second else conflict.first) + 1,
+                            @tagName(self.on_duplicate),
+                        });
+                        dropped[drop] = true;
+                        changed = true;
+                    },
+                    .merge => {
+                        if (try narrowMethods(allocator, &later.request, &earlier.request)) {
+                            changed = true;
+                            if (later.request.methods.len == 0) {
+                                std.log.info("Dropping rule {d} ({s}), as rule {d} answers all its methods (on_duplicate: merge)", .{ conflict.second + 1, later.request.displayPath(), conflict.first + 1 });
+                                dropped[conflict.second] = true;
+                            }
+                        }
+                    },
+                }
+            }
+            // A later "*" rule can't give up single methods, so it is kept as is
+            if (!changed) return;
+
+            var index = self.rules.items.len;
+            while (index > 0) {
+                index -= 1;
+                if (!dropped[index]) continue;
+                var rule = self.rules.orderedRemove(index);
+                rule.deinit(allocator);
+            }
+        }
+    }
+
+    /// Remove from `request` the methods `other` answers, unless `request`
+    /// accepts any method. Returns whether anything was removed.
+    fn narrowMethods(allocator: std.mem.Allocator, request: *RequestRule, other: *const RequestRule) !bool {
+        var kept: usize = 0;
+        for (request.methods) |method| {
+            if (std.mem.eql(u8, method, "*")) return false;
+            if (!other.allowsMethod(method)) kept += 1;
+        }
+        if (kept == request.methods.len) return false;
+
+        const methods = try allocator.alloc([]const u8, kept);
+        var index: usize = 0;
+        for (request.methods) |method| {
+            if (other.allowsMethod(method)) {
+                allocator.free(method);
+            } else {
+                methods[index] = method;
+                index += 1;
+            }
+        }
+        allocator.free(request.methods);
+        request.methods = methods;
+        return true;
+    }
+
+    /// Whether two rules have the same path or pattern, counting "/users"
+    /// and "/users/" as one literal path unless `strict_slash` is set, and
+    /// "/Users" as well when `case_insensitive_paths` is
+    fn samePath(self: *const Config, a: *const RequestRule, b: *const RequestRule) bool {
+        if (a.path_regex != null) return std.mem.eql(u8, a.displayPath(), b.displayPath());
+        // A prefix covers the path under it with or without the slash
+        const strict = self.strict_slash and a.path_prefix == null;
+        const a_path = if (strict) a.displayPath() else trimTrailingSlash(a.displayPath());
+        const b_path = if (strict) b.displayPath() else trimTrailingSlash(b.displayPath());
+        if (self.case_insensitive_paths) return std.ascii.eqlIgnoreCase(a_path, b_path);
+        return std.mem.eql(u8, a_path, b_path);
+    }
+
+    /// Whether both rules match on the same kind of path: literal or
+    /// parameterised `path`, `path_regex` or `path_prefix`
+    fn samePathKind(a: *const RequestRule, b: *const RequestRule) bool {
+        return (a.path_regex == null) == (b.path_regex == null) and (a.path_prefix == null) == (b.path_prefix == null);
+    }
+
+    fn trimTrailingSlash(path: []const u8) []const u8 {
+        if (path.len > 1 and path[path.len - 1] == '/') return path[0 .. path.len - 1];
+        return path;
+    }
+
+    /// Counts and warnings for the startup banner. Warnings cover rules that
+    /// can never match and a default_response hidden behind a catch-all route.
+    pub fn summarize(self: *const Config, allocator: std.mem.Allocator) !Summary {
+        var summary = Summary.init(allocator);
+        errdefer summary.deinit();
+
+        for (self.rules.items, 1..) |rule, number| {
+            summary.total_rules += 1;
+            if (rule.isMock()) summary.mock_rules += 1;
+            if (rule.isProxy()) summary.proxy_rules += 1;
+            if (rule.isMock() and rule.isProxy() and !rule.proxiesFirst()) {
+                try summary.addWarning("rule {d} ({s}) never proxies because it has a response; add fallback: response to proxy first", .{ number, rule.request.displayPath() });
+            }
+        }
+
+        const conflicts = try self.findConflicts(allocator);
+        defer allocator.free(conflicts);
+        for (conflicts) |conflict| {
+            const winner = &self.rules.items[conflict.first];
+            const shadowed = &self.rules.items[conflict.second];
+            try summary.addWarning("rule {d} ({s} {s}) in {s} duplicates rule {d} in {s} and will never match", .{
+                conflict.second + 1,
+                conflict.method,
+                shadowed.request.displayPath(),
+                shadowed.source orelse "config",
+                conflict.first + 1,
+                winner.source orelse "config",
+            });
+        }
+
+        if (self.default_response != null and self.not_found != null) {
+            try summary.addWarning("not_found is never served because default_response answers unmatched requests", .{});
+        }
+        if (self.default_response != null) {
+            for (self.rules.items, 1..) |rule, number| {
+                const request = &rule.request;
+                if (request.path_regex != null or !std.mem.eql(u8, request.path, "*")) continue;
+                if (hasConstraints(request) or !request.allowsMethod("*")) continue;
+                try summary.addWarning("default_response is never served because rule {d} (*) matches every request", .{number});
+                break;
+            }
+        }
+
+        if (self.startup_block_routes and self.startup_delay_ms == null) {
+            try summary.addWarning("startup_block_routes has no effect without a startup_delay", .{});
+        }
+
+        if (self.socket) |socket| {
+            if (self.port != null or self.host != null) {
+                try summary.addWarning("host and port are ignored because the server listens on socket {s}", .{socket});
+            }
+        }
+
+        return summary;
+    }
+
+    fn hasConstraints(request: *const RequestRule) bool {
+        return request.headers != null or request.headers_absent != null or request.query != null or request.cookies != null or request.body != null or request.body_regex != null or request.body_size != null or request.body_json != null or request.multipart != null or request.jsonrpc != null or request.client_ip != null or request.proto != null or request.path_segments != null;
+    }
+
+    fn sharedMethod(a: *const RequestRule, b: *const RequestRule) ?[]const u8 {
+        for (a.methods) |method| {
+            if (std.mem.eql(u8, method, "*")) {
+                return if (b.methods.len > 0) b.methods[0] else null;
+            }
+            if (b.allowsMethod(method)) return method;
+        }
+        return null;
+    }
+
+    /// Load a file along with the files it imports
+    fn loadFileWithImports(allocator: std.mem.Allocator, file_path: []const u8, options: LoadOptions) !Config {
+        var chain = std.ArrayList([]const u8).init(allocator);
+        defer chain.deinit();
+        return loadImported(allocator, file_path, options, &chain);
+    }
+
+    /// Load `file_path` and its imports. `chain` holds the real paths of
+    /// the files importing it, so a file that comes back round fails with
+    /// error.ImportCycle rather than recursing forever.
+    fn loadImported(allocator: std.mem.Allocator, file_path: []const u8, options: LoadOptions, chain: *std.ArrayList([]const u8)) !Config {
+        const real_path = try std.fs.cwd().realpathAlloc(allocator, file_path);
+        defer allocator.free(real_path);
+
+        for (chain.items, 0..) |importer, index| {
+            if (!std.mem.eql(u8, importer, real_path)) continue;
+            var cycle = std.ArrayList(u8).init(allocator);
+            defer cycle.deinit();
+            for (chain.items[index..]) |link| {
+                try cycle.writer().print("{s} -> ", .{link});
+            }
+            try cycle.appendSlice(real_path);
+            std.log.warn("Import cycle: {s}", .{cycle.items});
+            return error.ImportCycle;
+        }
+
+        try chain.append(real_path);
+        defer _ = chain.pop();
+        return mergeImports(allocator, try loadSingleFile(allocator, file_path, options), file_path, options, chain);
+    }
+
+    /// `own` with the files it imports merged ahead of it, one by one and
+    /// then `own` itself, under its `merge_strategy`. Takes ownership of `own`.
+    fn mergeImports(allocator: std.mem.Allocator, loaded: Config, source: []const u8, options: LoadOptions, chain: *std.ArrayList([]const u8)) !Config {
+        var own = loaded;
+        const imports = own.imports orelse return own;
+        defer own.deinit();
+
+        var config = Config.init(allocator);
+        errdefer config.deinit();
+        config.merge_strategy = own.merge_strategy;
+
+        for (imports) |import_path| {
+            std.log.info("Loading {s}, imported by {s}", .{ import_path, source });
+            var imported = loadImported(allocator, import_path, options, chain) catch |err| {
+                if (err != error.ImportCycle and err != error.DuplicateRule) {
+                    std.log.warn("Failed to load {s}, imported by {s}: {s}", .{ import_path, source, @errorName(err) });
+                }
+                return err;
+            };
+            defer imported.deinit();
+            try config.mergeImport(&imported, import_path);
+        }
+        try config.mergeImport(&own, source);
+        return config;
+    }
+
+    /// `mergeFrom`, first dealing with rules of `other` that answer the same
+    /// path and method as a rule already here, going by `merge_strategy`
+    fn mergeImport(self: *Config, other: *Config, source: []const u8) !void {
+        if (self.merge_strategy != .append) {
+            for (other.rules.items) |*rule| {
+                const earlier = self.duplicateOf(rule) orelse continue;
+                if (self.merge_strategy == .reject) {
+                    std.log.warn("{s} in {s} answers the same requests as the rule from {s} (merge_strategy: reject)", .{
+                        rule.request.displayPath(),
+                        source,
+                        self.rules.items[earlier].source orelse "config",
+                    });
+                    return error.DuplicateRule;
+                }
+                var replaced = self.rules.orderedRemove(earlier);
+                replaced.deinit(self.allocator);
+            }
+        }
+        try self.mergeFrom(other, source);
+    }
+
+    /// Index of the rule answering the same path and a method `other`
+    /// does on the same listener, compared the way `findConflicts` does
+    fn duplicateOf(self: *const Config, other: *const Rule) ?usize {
+        const request = &other.request;
+        if (hasConstraints(request)) return null;
+        for (self.rules.items, 0..) |*rule, index| {
+            if (hasConstraints(&rule.request) or rule.listener != other.listener) continue;
+            if (!samePathKind(&rule.request, request)) continue;
+            if (!self.samePath(&rule.request, request)) continue;
+            if (sharedMethod(&rule.request, request) != null) return index;
+        }
+        return null;
+    }
+
+    /// Load one YAML file, recording it as the source of each of its rules
+    fn loadSingleFile(allocator: std.mem.Allocator, file_path: []const u8, options: LoadOptions) !Config {
+        const file = try std.fs.cwd().openFile(file_path, .{});
+        defer file.close();
+
+        const file_size = try file.getEndPos();
+        const content = try allocator.alloc(u8, file_size);
+        defer allocator.free(content);
+
+        _ = try file.readAll(content);
+
+        return loadContent(allocator, content, file_path, std.fs.path.dirname(file_path) orelse ".", options);
+    }
+
+    /// Fetch and load the config at an http(s) URL. Relative paths in it,
+    /// like `body_file:` and `imports:`, resolve against the working directory.
+    fn loadFromUrl(allocator: std.mem.Allocator, url: []const u8, options: LoadOptions) !Config {
+        const content = try remote_config.fetch(allocator, url, options.fetch);
+        defer allocator.free(content);
+
+        var chain = std.ArrayList([]const u8).init(allocator);
+        defer chain.deinit();
+        var config = try mergeImports(allocator, try loadContent(allocator, content, url, ".", options), url, options, &chain);
+        errdefer config.deinit();
+        try config.resolveDuplicates();
+        return config;
+    }
+
+    /// Parse one config's `content`, noting `source` and line numbers on its rules
+    fn loadContent(allocator: std.mem.Allocator, content: []const u8, source: []const u8, base_dir: []const u8, options: LoadOptions) !Config {
+        var config = try parseWithOptions(allocator, content, base_dir, options);
+        errdefer config.deinit();
+        const lines = try ruleLines(allocator, content, config.rules.items.len);
+        defer if (lines) |l| allocator.free(l);
+        for (config.rules.items, 0..) |*rule, index| {
+            rule.source = try allocator.dupe(u8, source);
+            if (lines) |l| rule.line = l[index];
+        }
+        return config;
+    }
+
+    /// Line numbers (from 1) of the rule items in a config file, found by
+    /// scanning for the top-level list or the list under `routes:`. The
+    /// parser doesn't report positions, so this is a heuristic: when the scan
+    /// doesn't find exactly `count` items it returns null rather than guess.
+    fn ruleLines(allocator: std.mem.Allocator, content: []const u8, count: usize) !?[]usize {
+        var lines = std.ArrayList(usize).init(allocator);
+        defer lines.deinit();
+
+        var list_indent: ?usize = null;
+        var in_routes = false;
+        var line_number: usize = 0;
+        var iter = std.mem.splitScalar(u8, content, '\n');
+        while (iter.next()) |raw| {
+            line_number += 1;
+            const line = std.mem.trimRight(u8, raw, " \t\r");
+            const text = std.mem.trimLeft(u8, line, " ");
+            if (text.len == 0 or text[0] == '#' or std.mem.eql(u8, text, "---")) continue;
+
+            const indent = line.len - text.len;
+            const is_item = std.mem.eql(u8, text, "-") or std.mem.startsWith(u8, text, "- ");
+            if (indent == 0 and !is_item) {
+                // A top-level key ends any list before it
+                in_routes = std.mem.startsWith(u8, text, "routes:");
+                list_indent = null;
+                continue;
+            }
+            if (!is_item) continue;
+
+            if (list_indent == null) {
+                if (indent != 0 and !in_routes) continue;
+                list_indent = indent;
+            }
+            if (indent == list_indent.?) try lines.append(line_number);
+        }
+
+        if (count == 0 or lines.items.len != count) return null;
+        return try lines.toOwnedSlice();
+    }
+
+    /// Line of `field`, a key path from `ValidationErrors.fields`, in the
+    /// file the rule came from. Falls back to the rule's own line, or null
+    /// when the rule's location isn't known or the file can't be read.
+    pub fn locate(self: *const Config, allocator: std.mem.Allocator, rule_index: usize, field: ?[]const u8) !?usize {
+        const rule = &self.rules.items[rule_index];
+        const rule_line = rule.line orelse return null;
+        const key_path = field orelse return rule_line;
+        const source = rule.source orelse return rule_line;
+
+        const content = std.fs.cwd().readFileAlloc(allocator, source, std.math.maxInt(usize)) catch return rule_line;
+        defer allocator.free(content);
+        return try locateKey(allocator, content, rule_line, key_path);
+    }
+
+    /// Find a key path such as `response.status` within the rule whose list
+    /// item starts on `rule_line`, going by indentation. A segment may list
+    /// alternatives, as in `request.method|methods`. When a segment isn't
+    /// there (flow style, or a default) the deepest line found is returned.
+    fn locateKey(allocator: std.mem.Allocator, content: []const u8, rule_line: usize, key_path: []const u8) !usize {
+        var lines = std.ArrayList([]const u8).init(allocator);
+        defer lines.deinit();
+        var iter = std.mem.splitScalar(u8, content, '\n');
+        while (iter.next()) |line| {
+            try lines.append(std.mem.trimRight(u8, line, " \t\r"));
+        }
+        if (rule_line == 0 or rule_line > lines.items.len) return rule_line;
+
+        // The item line holds the rule's first key, so it starts the search
+        var found = rule_line - 1;
+        var start = found;
+        var end = blockEnd(lines.items, found, indentOf(lines.items[found]));
+
+        var segments = std.mem.splitScalar(u8, key_path, '.');
+        segment: while (segments.next()) |segment| {
+            const child_column = for (lines.items[start..end]) |line| {
+                if (keyColumn(line)) |column| break column;
+            } else return found + 1;
+
+            for (lines.items[start..end], start..) |line, index| {
+                if (keyColumn(line) != child_column) continue;
+                const name = keyName(line) orelse continue;
+                var alternatives = std.mem.splitScalar(u8, segment, '|');
+                while (alternatives.next()) |alternative| {
+                    if (!std.mem.eql(u8, name, alternative)) continue;
+                    found = index;
+                    start = index + 1;
+                    end = blockEnd(lines.items, index, child_column);
+                    continue :segment;
+                }
+            }
+            break;
+        }
+        return found + 1;
+    }
+
+    /// Index of the first line after `first` indented no deeper than `column`
+    fn blockEnd(lines: []const []const u8, first: usize, column: usize) usize {
+        for (lines[first + 1 ..], first + 1..) |line, index| {
+            if (keyColumn(line) == null) continue;
+            if (indentOf(line) <= column) return index;
+        }
+        return lines.len;
+    }
+
+    fn indentOf(line: []const u8) usize {
+        return line.len - std.mem.trimLeft(u8, line, " ").len;
+    }
+
+    /// Column where a line's key starts, past any `- `; null for blank and comment lines
+    fn keyColumn(line: []const u8) ?usize {
+        const text = std.mem.trimLeft(u8, line, " ");
+        if (text.len == 0 or text[0] == '#') return null;
+        const indent = line.len - text.len;
+        return if (std.mem.startsWith(u8, text, "- ")) indent + 2 else indent;
+    }
+
+    fn keyName(line: []const u8) ?[]const u8 {
+        var text = std.mem.trimLeft(u8, line, " ");
+        if (std.mem.startsWith(u8, text, "- ")) text = std.mem.trimLeft(u8, text[2..], " ");
+        const colon = std.mem.indexOfScalar(u8, text, ':') orelse return null;
+        return std.mem.trim(u8, text[0..colon], " \"'");
+    }
+
+    /// Load configuration from every YAML file under a directory, including
+    /// subdirectories. Files are merged in lexical order of their relative
+    /// paths, so precedence between equally specific rules is predictable.
+    /// A file that fails to parse aborts the whole load.
+    pub fn loadFromDirectory(allocator: std.mem.Allocator, dir_path: []const u8) !Config {
+        return loadFromDirectoryWithOptions(allocator, dir_path, .{});
+    }
+
+    pub fn loadFromDirectoryWithOptions(allocator: std.mem.Allocator, dir_path: []const u8, options: LoadOptions) !Config {
+        var config = Config.init(allocator);
+        errdefer config.deinit();
+
+        const files = listConfigFiles(allocator, dir_path) catch |err| {
+            std.log.err("Failed to read directory {s}: {}", .{ dir_path, err });
+            return err;
+        };
+        defer freeStringList(allocator, files);
+
+        for (files) |relative_path| {
+            const file_path = try std.fs.path.join(allocator, &.{ dir_path, relative_path });
+            defer allocator.free(file_path);
+
+            std.log.info("Loading config file: {s}", .{file_path});
+            var file_config = loadFileWithImports(allocator, file_path, options) catch |err| {
+                std.log.err("Failed to load {s}: {}", .{ file_path, err });
+                return err;
+            };
+            defer file_config.deinit();
+
+            try config.mergeFrom(&file_config, file_path);
+        }
+
+        if (files.len == 0) {
+            std.log.warn("No YAML files found in directory: {s}", .{dir_path});
+        } else {
+            std.log.info("Loaded {} YAML files from directory: {s}", .{ files.len, dir_path });
+        }
+
+        try config.resolveDuplicates();
+        return config;
+    }
+
+    /// Paths of the `.yaml`/`.yml`/`.json` files under `dir_path`, relative to it and
+    /// sorted lexically. Hidden files and directories are skipped.
+    pub fn listConfigFiles(allocator: std.mem.Allocator, dir_path: []const u8) ![]const []const u8 {
+        var dir = try std.fs.cwd().openDir(dir_path, .{ .iterate = true });
+        defer dir.close();
+
+        var files = std.ArrayList([]const u8).init(allocator);
+        errdefer {
+            for (files.items) |file| allocator.free(file);
+            files.deinit();
+        }
+
+        var walker = try dir.walk(allocator);
+        defer walker.deinit();
+        while (try walker.next()) |entry| {
+            if (entry.kind != .file or !isConfigFileName(entry.basename)) continue;
+            if (isHiddenPath(entry.path)) continue;
+            try files.append(try allocator.dupe(u8, entry.path));
+        }
+
+        std.mem.sort([]const u8, files.items, {}, struct {
+            fn lessThan(_: void, a: []const u8, b: []const u8) bool {
+                return std.mem.lessThan(u8, a, b);
+            }
+        }.lessThan);
+        return files.toOwnedSlice();
+    }
+
+    pub fn isConfigFileName(name: []const u8) bool {
+        const ext = std.fs.path.extension(name);
+        return std.mem.eql(u8, ext, ".yaml") or std.mem.eql(u8, ext, ".yml") or std.mem.eql(u8, ext, ".json");
+    }
+
+    fn isHiddenPath(path: []const u8) bool {
+        var components = std.mem.tokenizeAny(u8, path, "/\\");
+        while (components.next()) |component| {
+            if (component[0] == '.') return true;
+        }
+        return false;
+    }
+
+    /// Move the rules and top-level settings of `other` into this config.
+    /// Both configs share an allocator, so ownership transfers without copying
+    /// and `other` is left empty. `source` names `other` in warnings.
+    fn mergeFrom(self: *Config, other: *Config, source: []const u8) !void {
+        const allocator = self.allocator;
+
+        try self.rules.appendSlice(other.rules.items);
+        other.rules.clearRetainingCapacity();
+        try self.env_values.appendSlice(other.env_values.items);
+        other.env_values.clearRetainingCapacity();
+
+        if (other.cors) |cors| {
+            if (self.cors) |*previous| {
+                std.log.warn("{s} replaces the cors section from an earlier file", .{source});
+                previous.deinit(allocator);
+            }
+            self.cors = cors;
+            other.cors = null;
+        }
+        if (other.default_response) |response| {
+            if (self.default_response) |*previous| {
+                std.log.warn("{s} replaces the default_response from an earlier file", .{source});
+                previous.deinit(allocator);
+            }
+            self.default_response = response;
+            other.default_response = null;
+        }
+        if (other.not_found) |response| {
+            if (self.not_found) |*previous| {
+                std.log.warn("{s} replaces the not_found response from an earlier file", .{source});
+                previous.deinit(allocator);
+            }
+            self.not_found = response;
+            other.not_found = null;
+        }
+        if (other.root_response) |response| {
+            if (self.root_response) |*previous| {
+                std.log.warn("{s} replaces the root_response from an earlier file", .{source});
+                previous.deinit(allocator);
+            }
+            self.root_response = response;
+            other.root_response = null;
+        }
+        if (!other.root_banner) {
+            self.root_banner = false;
+        }
+        if (other.server_error) |response| {
+            if (self.server_error) |*previous| {
+                std.log.warn("{s} replaces the server_error response from an earlier file", .{source});
+                previous.deinit(allocator);
+            }
+            self.server_error = response;
+            other.server_error = null;
+        }
+        if (other.strict_slash) {
+            self.strict_slash = true;
+        }
+        if (other.case_insensitive_paths) {
+            self.case_insensitive_paths = true;
+        }
+        if (other.trust_proxy) {
+            self.trust_proxy = true;
+        }
+        if (other.request_charset) |charset| {
+            self.request_charset = charset;
+        }
+        if (other.on_duplicate != .@"error") {
+            if (self.on_duplicate != .@"error" and self.on_duplicate != other.on_duplicate) {
+                std.log.warn("{s} replaces the on_duplicate from an earlier file", .{source});
+            }
+            self.on_duplicate = other.on_duplicate;
+        }
+        if (other.admin_port) |port| {
+            if (self.admin_port != null) {
+                std.log.warn("{s} replaces the admin_port from an earlier file", .{source});
+            }
+            self.admin_port = port;
+        }
+        if (other.shutdown_timeout_ms) |timeout_ms| {
+            if (self.shutdown_timeout_ms != null) {
+                std.log.warn("{s} replaces the shutdown_timeout from an earlier file", .{source});
+            }
+            self.shutdown_timeout_ms = timeout_ms;
+        }
+        if (other.startup_delay_ms) |delay_ms| {
+            if (self.startup_delay_ms != null) {
+                std.log.warn("{s} replaces the startup_delay from an earlier file", .{source});
+            }
+            self.startup_delay_ms = delay_ms;
+        }
+        if (other.listeners) |ports| {
+            const previous = self.listeners orelse &.{};
+            const combined = try std.mem.concat(self.allocator, u16, &.{ previous, ports });
+            if (self.listeners) |old| self.allocator.free(old);
+            self.listeners = combined;
+        }
+        if (other.latency) |latency| {
+            if (self.latency != null) {
+                std.log.warn("{s} replaces the latency from an earlier file", .{source});
+            }
+            self.latency = latency;
+        }
+        if (other.startup_block_routes) {
+            self.startup_block_routes = true;
+        }
+        if (other.max_concurrent) |limit| {
+            if (self.max_concurrent != null) {
+                std.log.warn("{s} replaces the max_concurrent from an earlier file", .{source});
+            }
+            self.max_concurrent = limit;
+        }
+        inline for (.{ "read_timeout", "write_timeout", "idle_timeout" }) |name| {
+            if (@field(other, name ++ "_ms")) |timeout_ms| {
+                if (@field(self, name ++ "_ms") != null) {
+                    std.log.warn("{s} replaces the " ++ name ++ " from an earlier file", .{source});
+                }
+                @field(self, name ++ "_ms") = timeout_ms;
+            }
+        }
+        if (other.compression) |compression| {
+            if (self.compression != null) {
+                std.log.warn("{s} replaces the compression section from an earlier file", .{source});
+            }
+            self.compression = compression;
+        }
+        if (other.host) |host| {
+            if (self.host) |previous| {
+                std.log.warn("{s} replaces the host from an earlier file", .{source});
+                allocator.free(previous);
+            }
+            self.host = host;
+            other.host = null;
+        }
+        if (other.port) |port| {
+            if (self.port != null) {
+                std.log.warn("{s} replaces the port from an earlier file", .{source});
+            }
+            self.port = port;
+        }
+        if (other.socket) |socket| {
+            if (self.socket) |previous| {
+                std.log.warn("{s} replaces the socket from an earlier file", .{source});
+                allocator.free(previous);
+            }
+            self.socket = socket;
+            other.socket = null;
+        }
+        if (other.state_file) |state_file| {
+            if (self.state_file) |previous| {
+                std.log.warn("{s} replaces the state_file from an earlier file", .{source});
+                allocator.free(previous);
+            }
+            self.state_file = state_file;
+            other.state_file = null;
+        }
+        if (other.vars) |*vars| {
+            if (self.vars == null) {
+                self.vars = vars.*;
+            } else {
+                try self.vars.?.ensureUnusedCapacity(vars.count());
+                var iter = vars.iterator();
+                while (iter.next()) |entry| {
+                    if (self.vars.?.fetchPutAssumeCapacity(entry.key_ptr.*, entry.value_ptr.*)) |previous| {
+                        std.log.warn("{s} replaces var '{s}' from an earlier file", .{ source, entry.key_ptr.* });
+                        // The map keeps its existing key, so the duplicate is the one to free
+                        allocator.free(entry.key_ptr.*);
+                        allocator.free(previous.value);
+                    }
+                }
+                vars.deinit();
+            }
+            other.vars = null;
+        }
+    }
+
+    /// Load configuration from YAML string. Relative file references resolve against the working directory.
+    pub fn loadFromYaml(allocator: std.mem.Allocator, yaml_content: []const u8) !Config {
+        return loadFromYamlWithBase(allocator, yaml_content, ".");
+    }
+
+    /// Load configuration from YAML string, resolving relative file references against `base_dir`
+    /// and `${VAR}` references against the process environment
+    pub fn loadFromYamlWithBase(allocator: std.mem.Allocator, yaml_content: []const u8, base_dir: []const u8) !Config {
+        return loadFromYamlWithOptions(allocator, yaml_content, base_dir, .{});
+    }
+
+    pub fn loadFromYamlWithOptions(allocator: std.mem.Allocator, yaml_content: []const u8, base_dir: []const u8, options: LoadOptions) !Config {
+        var config = try parseWithOptions(allocator, yaml_content, base_dir, options);
+        errdefer config.deinit();
+        try config.resolveDuplicates();
+        return config;
+    }
+
+    /// `loadFromYamlWithOptions` without `resolveDuplicates`, for one file
+    /// of several, whose rules must stay as written until they are merged
+    fn parseWithOptions(allocator: std.mem.Allocator, yaml_content: []const u8, base_dir: []const u8, options: LoadOptions) !Config {
+        var env = try std.process.getEnvMap(allocator);
+        defer env.deinit();
+
+        return parseYamlContent(&ParseContext{ .allocator = allocator, .base_dir = base_dir, .env = &env, .lenient = options.lenient }, yaml_content);
+    }
+
+    /// Load configuration from a JSON string. The document has the same shape
+    /// and keys as the YAML form; `loadFromYaml` also accepts JSON.
+    pub fn loadFromJson(allocator: std.mem.Allocator, json_content: []const u8) !Config {
+        return loadFromJsonWithOptions(allocator, json_content, ".", .{});
+    }
+
+    pub fn loadFromJsonWithOptions(allocator: std.mem.Allocator, json_content: []const u8, base_dir: []const u8, options: LoadOptions) !Config {
+        var env = try std.process.getEnvMap(allocator);
+        defer env.deinit();
+
+        var config = try parseJsonContent(&ParseContext{ .allocator = allocator, .base_dir = base_dir, .env = &env, .lenient = options.lenient }, json_content);
+        errdefer config.deinit();
+        try config.resolveDuplicates();
+        return config;
+    }
+
+    /// Load configuration from YAML string with an explicit set of environment variables
+    pub fn loadFromYamlWithEnv(allocator: std.mem.Allocator, yaml_content: []const u8, base_dir: []const u8, env: *const std.process.EnvMap) !Config {
+        var config = try parseYamlContent(&ParseContext{ .allocator = allocator, .base_dir = base_dir, .env = env }, yaml_content);
+        errdefer config.deinit();
+        try config.resolveDuplicates();
+        return config;
+    }
+
+    fn parseYamlContent(ctx: *const ParseContext, yaml_content: []const u8) !Config {
+        // JSON is YAML too, but a strict JSON decode reports errors with their position
+        if (looksLikeJson(yaml_content)) return parseJsonContent(ctx, yaml_content);
+
+        const allocator = ctx.allocator;
+        var config = Config.init(allocator);
+        errdefer config.deinit();
+
+        // Parse YAML using zig-yaml 0.1.1 API
+        var parsed_yaml: yaml.Yaml = .{ .source = yaml_content };
+        defer parsed_yaml.deinit(allocator);
+        
+        parsed_yaml.load(allocator) catch |err| switch (err) {
+            error.ParseFailure => {
+                logParseErrors(&parsed_yaml.parse_errors);
+                return error.InvalidYamlFormat;
+            },
+            else => return err,
+        };
+
+        // Check if we have any documents
+        if (parsed_yaml.docs.items.len == 0) {
+            std.log.warn("No YAML documents found", .{});
+            return config;
+        }
+
+        // Get the first document - should be an array of rules  
+        const doc = parsed_yaml.docs.items[0];
+        
+        // Process the YAML document to extract rules
+        try parseYamlDocument(ctx, &config, doc);
+        try recordEnvValues(&config, ctx.env, yaml_content);
+
+        return config;
+    }
+
+    /// Remember what the `${VAR}` references in `content` expanded to
+    fn recordEnvValues(config: *Config, env: *const std.process.EnvMap, content: []const u8) !void {
+        var i: usize = 0;
+        while (std.mem.indexOfPos(u8, content, i, "${")) |start| {
+            i = start + 2;
+            // `$${` is a literal
+            if (start > 0 and content[start - 1] == '$') continue;
+            const close = std.mem.indexOfScalarPos(u8, content, i, '}') orelse return;
+            const reference = content[i..close];
+            const name = reference[0 .. std.mem.indexOf(u8, reference, ":-") orelse reference.len];
+            const value = env.get(name) orelse continue;
+            if (value.len == 0) continue;
+            const known = for (config.env_values.items) |recorded| {
+                if (std.mem.eql(u8, recorded, value)) break true;
+            } else false;
+            if (known) continue;
+            const copy = try config.allocator.dupe(u8, value);
+            errdefer config.allocator.free(copy);
+            try config.env_values.append(copy);
+        }
+    }
+
+    /// Whether a config is a JSON document: one whose first non-blank
+    /// character opens an object or array. YAML configs start with a key or
+    /// a `-` list item.
+    fn looksLikeJson(content: []const u8) bool {
+        const trimmed = std.mem.trimLeft(u8, content, " \t\r\n");
+        return trimmed.len > 0 and (trimmed[0] == '{' or trimmed[0] == '[');
+    }
+
+    fn parseJsonContent(ctx: *const ParseContext, json_content: []const u8) !Config {
+        var arena = std.heap.ArenaAllocator.init(ctx.allocator);
+        defer arena.deinit();
+
+        var scanner = std.json.Scanner.initCompleteInput(arena.allocator(), json_content);
+        var diagnostics = std.json.Diagnostics{};
+        scanner.enableDiagnostics(&diagnostics);
+        const value = std.json.parseFromTokenSourceLeaky(std.json.Value, arena.allocator(), &scanner, .{}) catch |err| switch (err) {
+            error.OutOfMemory => return err,
+            else => {
+                std.log.err("JSON parse error at line {d}, column {d}: {s}", .{ diagnostics.getLine(), diagnostics.getColumn(), @errorName(err) });
+                return error.InvalidJsonFormat;
+            },
+        };
+
+        var config = Config.init(ctx.allocator);
+        errdefer config.deinit();
+        try parseYamlDocument(ctx, &config, try yamlFromJson(arena.allocator(), value));
+        try recordEnvValues(&config, ctx.env, json_content);
+        return config;
+    }
+
+    /// The YAML value a JSON value reads as, so both formats share one parser.
+    /// Strings are borrowed from `value`.
+    fn yamlFromJson(arena: std.mem.Allocator, value: std.json.Value) !yaml.Value {
+        return switch (value) {
+            .null => .empty,
+            .bool => |b| .{ .boolean = b },
+            .integer => |i| .{ .int = i },
+            .float => |f| .{ .float = f },
+            .number_string, .string => |text| .{ .string = text },
+            .array => |array| blk: {
+                const list = try arena.alloc(yaml.Value, array.items.len);
+                for (list, array.items) |*item, element| {
+                    item.* = try yamlFromJson(arena, element);
+                }
+                break :blk .{ .list = list };
+            },
+            .object => |object| blk: {
+                var map: std.meta.FieldType(yaml.Value, .map) = .{};
+                var iter = object.iterator();
+                while (iter.next()) |entry| {
+                    try map.put(arena, entry.key_ptr.*, try yamlFromJson(arena, entry.value_ptr.*));
+                }
+                break :blk .{ .map = map };
+            },
+        };
+    }
+
+    /// Log each parse error with its position, which zig-yaml counts from 0
+    fn logParseErrors(bundle: *const std.zig.ErrorBundle) void {
+        if (bundle.errorMessageCount() == 0) {
+            std.log.err("YAML parse failure", .{});
+            return;
+        }
+        for (bundle.getMessages()) |index| {
+            const message = bundle.getErrorMessage(index);
+            const text = bundle.nullTerminatedString(message.msg);
+            if (message.src_loc != .none) {
+                const location = bundle.getSourceLocation(message.src_loc);
+                std.log.err("YAML parse failure at line {d}, column {d}: {s}", .{ location.line + 1, location.column + 1, text });
+            } else {
+                std.log.err("YAML parse failure: {s}", .{text});
+            }
+        }
+    }
+
+    /// Accepted document shapes:
+    /// - a list of rules
+    /// - a map with any of the top-level keys in `top_level_keys` (`routes:`, `cors:`, ...)
+    /// - a single bare rule (legacy form)
+    const top_level_keys = [_][]const u8{ "routes", "cors", "default_response", "not_found", "root_response", "server_error", "strict_slash", "case_insensitive_paths", "trust_proxy", "request_charset", "admin_port", "shutdown_timeout", "read_timeout", "write_timeout", "idle_timeout", "compression", "host", "port", "socket", "state_file", "vars", "max_concurrent", "imports", "merge_strategy", "on_duplicate", "startup_delay", "startup_block_routes", "latency", "listeners" };
+
+    /// A response whose status defaults to `status` rather than 200, or the
+    /// status of its preset
+    fn parseYamlStatusResponse(ctx: *const ParseContext, response_value: anytype, status: u16) !MockResponse {
+        var response = try parseYamlResponse(ctx, response_value);
+        if (response_value == .map and response_value.map.get("status") == null and response_value.map.get("preset") == null) {
+            response.status = status;
+        }
+        return response;
+    }
+
+    fn parseYamlDocument(ctx: *const ParseContext, config: *Config, doc: anytype) !void {
+        switch (doc) {
+            .list => |list| {
+                // Expected format: array of rule objects
+                try parseYamlRules(ctx, config, list);
+            },
+            .map => |map| {
+                const is_document = for (top_level_keys) |key| {
+                    if (map.get(key) != null) break true;
+                } else false;
+
+                if (is_document) {
+                    try ctx.checkKeys(map, "the top level", &top_level_keys);
+                    if (map.get("routes")) |routes| {
+                        switch (routes) {
+                            .list => |list| try parseYamlRules(ctx, config, list),
+                            .empty => {},
+                            else => {
+                                std.log.err("Expected 'routes' to be a list", .{});
+                                return error.InvalidYamlFormat;
+                            },
+                        }
+                    }
+                    if (map.get("cors")) |cors| {
+                        config.cors = try parseYamlCors(ctx, cors);
+                    }
+                    if (map.get("default_response")) |response| {
+                        config.default_response = try parseYamlResponse(ctx, response);
+                    }
+                    if (map.get("not_found")) |response| {
+                        config.not_found = try parseYamlStatusResponse(ctx, response, 404);
+                    }
+                    if (map.get("root_response")) |response| {
+                        if (yamlBool(response)) |enabled| {
+                            config.root_banner = enabled;
+                        } else {
+                            config.root_response = try parseYamlResponse(ctx, response);
+                        }
+                    }
+                    if (map.get("server_error")) |response| {
+                        config.server_error = try parseYamlStatusResponse(ctx, response, 500);
+                    }
+                    if (map.get("strict_slash")) |strict_slash| {
+                        config.strict_slash = yamlBool(strict_slash) orelse {
+                            std.log.err("Expected 'strict_slash' to be true or false", .{});
+                            return error.InvalidYamlFormat;
+                        };
+                    }
+                    if (map.get("case_insensitive_paths")) |case_insensitive| {
+                        config.case_insensitive_paths = yamlBool(case_insensitive) orelse {
+                            std.log.err("Expected 'case_insensitive_paths' to be true or false", .{});
+                            return error.InvalidYamlFormat;
+                        };
+                    }
+                    if (map.get("request_charset")) |charset| {
+                        config.request_charset = try parseYamlCharset(charset, "request_charset");
+                    }
+                    if (map.get("trust_proxy")) |trust_proxy| {
+                        config.trust_proxy = yamlBool(trust_proxy) orelse {
+                            std.log.err("Expected 'trust_proxy' to be true or false", .{});
+                            return error.InvalidYamlFormat;
+                        };
+                    }
+                    if (map.get("admin_port")) |port| {
+                        config.admin_port = parseYamlPort(port);
+                    }
+                    if (map.get("shutdown_timeout")) |timeout| {
+                        config.shutdown_timeout_ms = try parseYamlDuration(timeout, "shutdown_timeout");
+                    }
+                    if (map.get("startup_delay")) |delay| {
+                        config.startup_delay_ms = try parseYamlDuration(delay, "startup_delay");
+                    }
+                    if (map.get("latency")) |latency| {
+                        config.latency = try parseYamlLatency(ctx, latency);
+                    }
+                    if (map.get("listeners")) |listeners| {
+                        try parseYamlListeners(ctx, config, listeners);
+                    }
+                    if (map.get("startup_block_routes")) |block| {
+                        config.startup_block_routes = yamlBool(block) orelse {
+                            std.log.err("Expected 'startup_block_routes' to be true or false", .{});
+                            return error.InvalidYamlFormat;
+                        };
+                    }
+                    if (map.get("max_concurrent")) |limit| {
+                        config.max_concurrent = switch (limit) {
+                            .int => |i| std.math.cast(u32, i) orelse 0,
+                            .string => |text| std.fmt.parseInt(u32, text, 10) catch 0,
+                            else => 0,
+                        };
+                    }
+                    if (map.get("read_timeout")) |timeout| {
+                        config.read_timeout_ms = try parseYamlDuration(timeout, "read_timeout");
+                    }
+                    if (map.get("write_timeout")) |timeout| {
+                        config.write_timeout_ms = try parseYamlDuration(timeout, "write_timeout");
+                    }
+                    if (map.get("idle_timeout")) |timeout| {
+                        config.idle_timeout_ms = try parseYamlDuration(timeout, "idle_timeout");
+                    }
+                    if (map.get("compression")) |compression| {
+                        config.compression = try parseYamlCompression(ctx, compression);
+                    }
+                    if (map.get("host")) |host| {
+                        if (host != .string) {
+                            std.log.err("Expected 'host' to be a string", .{});
+                            return error.InvalidYamlFormat;
+                        }
+                        config.host = try ctx.expand(host.string);
+                    }
+                    if (map.get("port")) |port| {
+                        config.port = parseYamlListenPort(port);
+                    }
+                    if (map.get("socket")) |socket| {
+                        if (socket != .string) {
+                            std.log.err("Expected 'socket' to be a string", .{});
+                            return error.InvalidYamlFormat;
+                        }
+                        config.socket = try parseYamlPath(ctx, socket.string);
+                    }
+                    if (map.get("state_file")) |state_file| {
+                        if (state_file != .string) {
+                            std.log.err("Expected 'state_file' to be a string", .{});
+                            return error.InvalidYamlFormat;
+                        }
+                        config.state_file = try parseYamlPath(ctx, state_file.string);
+                    }
+                    if (map.get("vars")) |vars| {
+                        if (vars != .map) {
+                            std.log.err("Expected 'vars' to be a map of names to strings", .{});
+                            return error.InvalidYamlFormat;
+                        }
+                        config.vars = try parseYamlStringMap(ctx, vars.map);
+                    }
+                    if (map.get("imports")) |imports| {
+                        config.imports = try parseYamlImports(ctx, imports);
+                    }
+                    if (map.get("merge_strategy")) |strategy| {
+                        const name = if (strategy == .string) strategy.string else "";
+                        config.merge_strategy = std.meta.stringToEnum(MergeStrategy, name) orelse {
+                            std.log.err("Invalid merge_strategy '{s}' (expected append, override or reject)", .{name});
+                            return error.InvalidYamlFormat;
+                        };
+                    }
+                    if (map.get("on_duplicate")) |policy| {
+                        const name = if (policy == .string) policy.string else "";
+                        config.on_duplicate = std.meta.stringToEnum(OnDuplicate, name) orelse {
+                            std.log.err("Invalid on_duplicate '{s}' (expected error, first_wins, last_wins or merge)", .{name});
+                            return error.InvalidYamlFormat;
+                        };
+                    }
+                    return;
+                }
+
+                // Single rule object
+                const rule = try parseYamlRule(ctx, doc);
+                try config.addRule(rule);
+            },
+            else => {
+                std.log.err("Expected YAML document to be a list or map, got: {}", .{doc});
+                return error.InvalidYamlFormat;
+            },
+        }
+    }
+
+    fn hasHeaderIgnoringCase(headers: *const std.StringHashMap([]const u8), name: []const u8) bool {
+        var iter = headers.keyIterator();
+        while (iter.next()) |key| {
+            if (std.ascii.eqlIgnoreCase(key.*, name)) return true;
+        }
+        return false;
+    }
+
+    fn parseYamlImports(ctx: *const ParseContext, imports_value: anytype) ![]const []const u8 {
+        const allocator = ctx.allocator;
+        const list = switch (imports_value) {
+            .list => |list| list,
+            else => {
+                std.log.err("Expected 'imports' to be a list of file paths", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+
+        const paths = try allocator.alloc([]const u8, list.len);
+        var parsed: usize = 0;
+        errdefer {
+            for (paths[0..parsed]) |path| allocator.free(path);
+            allocator.free(paths);
+        }
+        for (list) |item| {
+            if (item != .string) {
+                std.log.err("Expected 'imports' entries to be file paths", .{});
+                return error.InvalidYamlFormat;
+            }
+            paths[parsed] = try parseYamlPath(ctx, item.string);
+            parsed += 1;
+        }
+        return paths;
+    }
+
+    /// `listeners:`, a list of `{ port, routes }`. The routes join the
+    /// config's rules, each marked with the port it answers on.
+    fn parseYamlListeners(ctx: *const ParseContext, config: *Config, listeners_value: anytype) !void {
+        const list = switch (listeners_value) {
+            .list => |list| list,
+            .empty => return,
+            else => {
+                std.log.err("Expected 'listeners' to be a list of ports and their routes", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+
+        const ports = try ctx.allocator.alloc(u16, list.len);
+        errdefer ctx.allocator.free(ports);
+        for (list, ports) |item, *port| {
+            if (item != .map) {
+                std.log.err("Expected 'listeners' entries to be maps with a port and routes", .{});
+                return error.InvalidYamlFormat;
+            }
+            try ctx.checkKeys(item.map, "listener", &.{ "port", "routes" });
+            port.* = if (item.map.get("port")) |value| parseYamlPort(value) else 0;
+
+            const routes = switch (item.map.get("routes") orelse .empty) {
+                .list => |routes| routes,
+                .empty => continue,
+                else => {
+                    std.log.err("Expected the routes of listener {d} to be a list", .{port.*});
+                    return error.InvalidYamlFormat;
+                },
+            };
+            for (routes) |rule_value| {
+                var rule = try parseYamlRule(ctx, rule_value);
+                rule.listener = port.*;
+                try config.addRule(rule);
+            }
+        }
+        if (config.listeners) |previous| ctx.allocator.free(previous);
+        config.listeners = ports;
+    }
+
+    fn parseYamlRules(ctx: *const ParseContext, config: *Config, list: anytype) !void {
+        for (list) |rule_value| {
+            const rule = try parseYamlRule(ctx, rule_value);
+            try config.addRule(rule);
+        }
+    }
+
+    const rule_keys = [_][]const u8{ "request", "response", "responses", "cycle", "schedule", "proxy", "static", "priority", "seed", "max_matches", "request_charset", "name", "description", "log" };
+
+    fn parseYamlRule(ctx: *const ParseContext, rule_value: anytype) !Rule {
+        const rule_map = switch (rule_value) {
+            .map => |map| map,
+            else => {
+                std.log.err("Expected rule to be a map, got: {}", .{rule_value});
+                return error.InvalidYamlFormat;
+            },
+        };
+
+        try ctx.checkKeys(rule_map, "rule", &rule_keys);
+
+        var request: ?RequestRule = null;
+        var response: ?MockResponse = null;
+        var responses: ?[]MockResponse = null;
+        var weighted: ?[]MockResponse = null;
+        var cycle = false;
+        var schedule: ?[]SchedulePhase = null;
+        var proxy: ?ProxyConfig = null;
+        var static: ?StaticFiles = null;
+        var static_prefix: ?[]const u8 = null;
+        var priority: i32 = 0;
+        var seed: ?u64 = null;
+        var max_matches: ?u64 = null;
+        var request_charset: ?Charset = null;
+        var name: ?[]const u8 = null;
+        errdefer if (name) |text| ctx.allocator.free(text);
+        var description: ?[]const u8 = null;
+        errdefer if (description) |text| ctx.allocator.free(text);
+        var log = true;
+
+        // Parse the rule map
+        var map_iter = rule_map.iterator();
+        while (map_iter.next()) |entry| {
+            const key = entry.key_ptr.*;
+            const value = entry.value_ptr.*;
+
+            if (std.mem.eql(u8, key, "request")) {
+                request = try parseYamlRequest(ctx, value);
+            } else if (std.mem.eql(u8, key, "response")) {
+                if (value == .list) {
+                    responses = try parseYamlResponseList(ctx, value.list);
+                } else {
+                    response = try parseYamlResponse(ctx, value);
+                }
+            } else if (std.mem.eql(u8, key, "responses")) {
+                if (value != .list) {
+                    std.log.err("Expected 'responses' to be a list", .{});
+                    return error.InvalidYamlFormat;
+                }
+                weighted = try parseYamlResponseList(ctx, value.list);
+            } else if (std.mem.eql(u8, key, "cycle")) {
+                cycle = yamlBool(value) orelse false;
+            } else if (std.mem.eql(u8, key, "schedule")) {
+                if (value != .list) {
+                    std.log.err("Expected 'schedule' to be a list", .{});
+                    return error.InvalidYamlFormat;
+                }
+                schedule = try parseYamlSchedule(ctx, value.list);
+            } else if (std.mem.eql(u8, key, "proxy")) {
+                proxy = try parseYamlProxy(ctx, value);
+            } else if (std.mem.eql(u8, key, "static")) {
+                static = try parseYamlStatic(ctx, value, &static_prefix);
+            } else if (std.mem.eql(u8, key, "priority")) {
+                priority = switch (value) {
+                    .int => |i| std.math.cast(i32, i),
+                    .string => |s| std.fmt.parseInt(i32, s, 10) catch null,
+                    else => null,
+                } orelse {
+                    std.log.err("Invalid rule priority: expected a whole number", .{});
+                    return error.InvalidYamlFormat;
+                };
+            } else if (std.mem.eql(u8, key, "seed")) {
+                seed = switch (value) {
+                    .int => |i| std.math.cast(u64, i),
+                    .string => |s| std.fmt.parseInt(u64, s, 10) catch null,
+                    else => null,
+                } orelse {
+                    std.log.err("Invalid rule seed: expected a whole number", .{});
+                    return error.InvalidYamlFormat;
+                };
+            } else if (std.mem.eql(u8, key, "request_charset")) {
+                request_charset = try parseYamlCharset(value, "request_charset");
+            } else if (std.mem.eql(u8, key, "max_matches")) {
+                max_matches = switch (value) {
+                    .int => |i| std.math.cast(u64, i),
+                    .string => |s| std.fmt.parseInt(u64, s, 10) catch null,
+                    else => null,
+                } orelse {
+                    std.log.err("Invalid rule max_matches: expected a whole number", .{});
+                    return error.InvalidYamlFormat;
+                };
+            } else if (std.mem.eql(u8, key, "name")) {
+                if (value != .string) {
+                    std.log.err("Expected rule name to be a string", .{});
+                    return error.InvalidYamlFormat;
+                }
+                if (name) |previous| ctx.allocator.free(previous);
+                name = try ctx.allocator.dupe(u8, value.string);
+            } else if (std.mem.eql(u8, key, "description")) {
+                if (value != .string) {
+                    std.log.err("Expected rule description to be a string", .{});
+                    return error.InvalidYamlFormat;
+                }
+                if (description) |previous| ctx.allocator.free(previous);
+                description = try ctx.allocator.dupe(u8, value.string);
+            } else if (std.mem.eql(u8, key, "log")) {
+                log = yamlBool(value) orelse {
+                    std.log.err("Expected rule log to be true or false", .{});
+                    return error.InvalidYamlFormat;
+                };
+            }
+        }
+
+        // A static rule answers GET and HEAD under its prefix
+        if (static_prefix) |prefix| {
+            if (request != null) {
+                std.log.err("A static rule takes its path from static.prefix; remove its request", .{});
+                return error.InvalidYamlFormat;
+            }
+            const methods = try ctx.allocator.alloc([]const u8, 2);
+            methods[0] = try ctx.allocator.dupe(u8, "GET");
+            methods[1] = try ctx.allocator.dupe(u8, "HEAD");
+            request = RequestRule{ .path = try ctx.allocator.dupe(u8, ""), .path_prefix = prefix, .methods = methods };
+        }
+
+        if (request == null) {
+            return error.MissingRequestConfiguration;
+        }
+
+        if (seed) |value| {
+            const source = try ctx.allocator.create(SeededRandom);
+            source.* = SeededRandom.init(value);
+            request.?.random_source = source;
+        }
+        request.?.charset = request_charset;
+
+        var rule = Rule.init(request.?);
+        rule.priority = priority;
+        rule.max_matches = max_matches;
+        rule.name = name;
+        rule.description = description;
+        rule.log = log;
+        if (response) |r| {
+            rule = rule.withMockResponse(r);
+        }
+        if (responses) |list| {
+            const sequence = try ctx.allocator.create(ResponseSequence);
+            sequence.* = ResponseSequence{ .responses = list, .cycle = cycle };
+            rule.sequence = sequence;
+        }
+        if (weighted) |list| {
+            rule.weighted = WeightedResponses{ .responses = list };
+        }
+        if (schedule) |phases| {
+            rule.schedule = ResponseSchedule{ .phases = phases };
+        }
+        if (proxy) |p| {
+            rule = rule.withProxy(p);
+        }
+        rule.static = static;
+
+        return rule;
+    }
+
+    /// `latency:` with `min` and `max` durations, either of which defaults
+    /// to the other
+    fn parseYamlLatency(ctx: *const ParseContext, latency_value: anytype) !Latency {
+        const latency_map = switch (latency_value) {
+            .map => |map| map,
+            else => {
+                std.log.err("Expected 'latency' to be a map with min and max", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+        try ctx.checkKeys(latency_map, "latency", &.{ "min", "max" });
+
+        const min_ms = if (latency_map.get("min")) |min| try parseYamlDuration(min, "latency min") else null;
+        const max_ms = if (latency_map.get("max")) |max| try parseYamlDuration(max, "latency max") else null;
+        if (min_ms == null and max_ms == null) {
+            std.log.err("Expected 'latency' to set min, max or both", .{});
+            return error.InvalidYamlFormat;
+        }
+        return Latency{ .min_ms = min_ms orelse max_ms.?, .max_ms = max_ms orelse min_ms.? };
+    }
+
+    /// `static:` with `prefix`, `dir` and optionally `index` and `listing`.
+    /// The prefix becomes the rule's `path_prefix`, so it is handed back
+    /// separately.
+    fn parseYamlStatic(ctx: *const ParseContext, static_value: anytype, prefix: *?[]const u8) !StaticFiles {
+        const static_map = switch (static_value) {
+            .map => |map| map,
+            else => {
+                std.log.err("Expected 'static' to be a map", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+        try ctx.checkKeys(static_map, "static", &.{ "prefix", "dir", "index", "listing" });
+
+        const prefix_value = static_map.get("prefix") orelse .empty;
+        const dir_value = static_map.get("dir") orelse .empty;
+        if (prefix_value != .string or dir_value != .string) {
+            std.log.err("A static rule needs a prefix and a dir", .{});
+            return error.InvalidYamlFormat;
+        }
+
+        var static = StaticFiles{ .dir = try parseYamlPath(ctx, dir_value.string) };
+        errdefer static.deinit(ctx.allocator);
+        if (static_map.get("index")) |index| {
+            if (index != .string) {
+                std.log.err("Expected static index to be a file name", .{});
+                return error.InvalidYamlFormat;
+            }
+            static.index = try ctx.expand(index.string);
+        }
+        if (static_map.get("listing")) |listing| {
+            static.listing = yamlBool(listing) orelse {
+                std.log.err("Expected static listing to be true or false", .{});
+                return error.InvalidYamlFormat;
+            };
+        }
+        prefix.* = try ctx.expand(prefix_value.string);
+        return static;
+    }
+
+    fn parseYamlRequest(ctx: *const ParseContext, request_value: anytype) !RequestRule {
+        const request_map = switch (request_value) {
+            .map => |map| map,
+            else => return error.InvalidYamlFormat,
+        };
+        try ctx.checkKeys(request_map, "request", &.{ "path", "path_regex", "path_prefix", "path_segments", "method", "methods", "verb", "verbs", "headers", "headers_absent", "query", "cookies", "body", "body_regex", "form", "multipart", "jsonrpc", "content_type", "client_ip", "proto", "auth", "body_size", "max_body_size", "max_body_message", "rate_limit" });
+
+        var path: ?[]const u8 = null;
+        var path_regex: ?[]const u8 = null;
+        var path_prefix: ?[]const u8 = null;
+        var path_segments: ?u32 = null;
+        var methods: ?[]const []const u8 = null;
+        var headers: ?std.StringHashMap([]const u8) = null;
+        var headers_absent: ?[]const []const u8 = null;
+        var query: ?std.StringHashMap([]const u8) = null;
+        var cookies: ?std.StringHashMap([]const u8) = null;
+        var body: ?[]const u8 = null;
+        var body_regex: ?[]const u8 = null;
+        var body_json: ?std.StringHashMap([]const u8) = null;
+        var form: ?std.StringHashMap([]const u8) = null;
+        var multipart: ?std.StringHashMap([]const u8) = null;
+        var jsonrpc_method: ?[]const u8 = null;
+        var content_type: ?[]const u8 = null;
+        var client_ip: ?[]const u8 = null;
+        var proto: ?[]const u8 = null;
+        var auth: ?BasicAuth = null;
+        var body_size: ?BodySize = null;
+        var max_body_size: ?usize = null;
+        var max_body_message: ?[]const u8 = null;
+        var rate_limit: ?*RateLimiter = null;
+
+        var map_iter = request_map.iterator();
+        while (map_iter.next()) |entry| {
+            const key = entry.key_ptr.*;
+            const value = entry.value_ptr.*;
+
+            if (std.mem.eql(u8, key, "path")) {
+                if (value == .string) {
+                    path = try ctx.expand(value.string);
+                }
+            } else if (std.mem.eql(u8, key, "path_regex")) {
+                if (value == .string) {
+                    path_regex = try ctx.expand(value.string);
+                }
+            } else if (std.mem.eql(u8, key, "body_regex")) {
+                if (value == .string) {
+                    if (body_regex) |previous| ctx.allocator.free(previous);
+                    body_regex = try ctx.expand(value.string);
+                }
+            } else if (std.mem.eql(u8, key, "path_segments")) {
+                path_segments = switch (value) {
+                    .int => |i| std.math.cast(u32, i),
+                    .string => |text| std.fmt.parseInt(u32, text, 10) catch null,
+                    else => null,
+                } orelse {
+                    std.log.err("Expected path_segments to be a whole number of segments", .{});
+                    return error.InvalidYamlFormat;
+                };
+            } else if (std.mem.eql(u8, key, "path_prefix")) {
+                if (value == .string) {
+                    path_prefix = try ctx.expand(value.string);
+                }
+            } else if (std.mem.eql(u8, key, "method") or std.mem.eql(u8, key, "verb") or
+                std.mem.eql(u8, key, "methods") or std.mem.eql(u8, key, "verbs"))
+            {
+                if (methods) |previous| freeStringList(ctx.allocator, previous);
+                methods = try parseYamlMethods(ctx, value);
+            } else if (std.mem.eql(u8, key, "headers")) {
+                if (value == .map) {
+                    headers = try parseYamlStringMap(ctx, value.map);
+                }
+            } else if (std.mem.eql(u8, key, "headers_absent")) {
+                if (headers_absent) |previous| freeStringList(ctx.allocator, previous);
+                headers_absent = try parseYamlStringList(ctx, value, &.{});
+            } else if (std.mem.eql(u8, key, "query")) {
+                if (value == .map) {
+                    query = try parseYamlStringMap(ctx, value.map);
+                }
+            } else if (std.mem.eql(u8, key, "cookies")) {
+                if (value == .map) {
+                    cookies = try parseYamlStringMap(ctx, value.map);
+                }
+            } else if (std.mem.eql(u8, key, "body")) {
+                switch (value) {
+                    .string => |s| body = try ctx.expand(s),
+                    // `body: { equals: "...", json: { "$.field": value } }`
+                    .map => |body_map| {
+                        try ctx.checkKeys(body_map, "request body", &.{ "equals", "json" });
+                        if (body_map.get("equals")) |equals| {
+                            if (equals == .string) body = try ctx.expand(equals.string);
+                        }
+                        if (body_map.get("json")) |conditions| {
+                            if (conditions == .map) body_json = try parseYamlStringMap(ctx, conditions.map);
+                        }
+                    },
+                    else => {},
+                }
+            } else if (std.mem.eql(u8, key, "form")) {
+                if (value == .map) {
+                    form = try parseYamlStringMap(ctx, value.map);
+                }
+            } else if (std.mem.eql(u8, key, "multipart")) {
+                if (value == .map) {
+                    multipart = try parseYamlStringMap(ctx, value.map);
+                }
+            } else if (std.mem.eql(u8, key, "jsonrpc")) {
+                if (value == .string) {
+                    if (jsonrpc_method) |previous| ctx.allocator.free(previous);
+                    jsonrpc_method = try ctx.expand(value.string);
+                }
+            } else if (std.mem.eql(u8, key, "content_type")) {
+                if (value == .string) {
+                    if (content_type) |previous| ctx.allocator.free(previous);
+                    content_type = try ctx.expand(value.string);
+                }
+            } else if (std.mem.eql(u8, key, "client_ip")) {
+                if (value == .string) {
+                    if (client_ip) |previous| ctx.allocator.free(previous);
+                    client_ip = try ctx.expand(value.string);
+                }
+            } else if (std.mem.eql(u8, key, "proto")) {
+                // `proto: 1.1` reads as a number
+                const text = switch (value) {
+                    .string => |text| try ctx.expand(text),
+                    .int => |i| try std.fmt.allocPrint(ctx.allocator, "{d}", .{i}),
+                    .float => |f| try std.fmt.allocPrint(ctx.allocator, "{d:.1}", .{f}),
+                    else => null,
+                };
+                if (text) |owned| {
+                    if (proto) |previous| ctx.allocator.free(previous);
+                    proto = owned;
+                }
+            } else if (std.mem.eql(u8, key, "auth")) {
+                if (value == .map) {
+                    if (auth) |*previous| previous.deinit(ctx.allocator);
+                    auth = try parseYamlAuth(ctx, value.map);
+                }
+            } else if (std.mem.eql(u8, key, "body_size")) {
+                body_size = try parseYamlBodySize(ctx, value);
+            } else if (std.mem.eql(u8, key, "max_body_size")) {
+                max_body_size = try parseYamlByteSize(value, "max_body_size");
+            } else if (std.mem.eql(u8, key, "max_body_message")) {
+                if (value == .string) {
+                    if (max_body_message) |previous| ctx.allocator.free(previous);
+                    max_body_message = try ctx.expand(value.string);
+                }
+            } else if (std.mem.eql(u8, key, "rate_limit")) {
+                if (rate_limit) |previous| ctx.allocator.destroy(previous);
+                rate_limit = try parseYamlRateLimit(ctx, value);
+            }
+        }
+
+        if ((path == null and path_regex == null and path_prefix == null and path_segments == null) or methods == null) {
+            return error.MissingRequiredRequestFields;
+        }
+
+        // An invalid pattern leaves `regex` unset; validation reports it with the reason
+        var regex: ?Regex = null;
+        if (path_regex) |pattern| {
+            regex = Regex.compile(ctx.allocator, pattern, null) catch |err| switch (err) {
+                error.OutOfMemory => return err,
+                error.InvalidPattern => null,
+            };
+        }
+        var body_pattern: ?Regex = null;
+        if (body_regex) |pattern| {
+            body_pattern = Regex.compile(ctx.allocator, pattern, null) catch |err| switch (err) {
+                error.OutOfMemory => return err,
+                error.InvalidPattern => null,
+            };
+        }
+
+        return RequestRule{
+            // A path_segments-only rule takes any path with that many segments
+            .path = path orelse try ctx.allocator.dupe(u8, if (path_regex == null and path_prefix == null) "*" else ""),
+            .path_regex = path_regex,
+            .path_prefix = path_prefix,
+            .path_segments = path_segments,
+            .regex = regex,
+            .methods = methods.?,
+            .headers = headers,
+            .headers_absent = headers_absent,
+            .query = query,
+            .cookies = cookies,
+            .body = body,
+            .body_regex = body_regex,
+            .body_pattern = body_pattern,
+            .body_json = body_json,
+            .form = form,
+            .multipart = multipart,
+            .jsonrpc = jsonrpc_method,
+            .content_type = content_type,
+            .client_ip = client_ip,
+            .client_range = if (client_ip) |text| IpRange.parse(text) else null,
+            .proto = proto,
+            .proto_version = if (proto) |text| Protocol.parse(text) else null,
+            .auth = auth,
+            .body_size = body_size,
+            .max_body_size = max_body_size,
+            .max_body_message = max_body_message,
+            .rate_limit = rate_limit,
+        };
+    }
+
+    /// Parse `body_size: { min, max }`, either of them optional, or a single
+    /// size the body must have exactly
+    fn parseYamlBodySize(ctx: *const ParseContext, size_value: anytype) !BodySize {
+        const size_map = switch (size_value) {
+            .map => |map| map,
+            else => {
+                const exact = try parseYamlByteSize(size_value, "body_size");
+                return BodySize{ .min = exact, .max = exact };
+            },
+        };
+        try ctx.checkKeys(size_map, "body_size", &.{ "min", "max" });
+        return BodySize{
+            .min = if (size_map.get("min")) |min| try parseYamlByteSize(min, "body_size min") else 0,
+            .max = if (size_map.get("max")) |max| try parseYamlByteSize(max, "body_size max") else null,
+        };
+    }
+
+    /// Parse `rate_limit: { requests, per }`. Missing or unparseable counts
+    /// are left at zero for validation to report.
+    fn parseYamlRateLimit(ctx: *const ParseContext, rate_limit_value: anytype) !*RateLimiter {
+        const rate_limit_map = switch (rate_limit_value) {
+            .map => |map| map,
+            else => {
+                std.log.err("Expected 'rate_limit' to be a map with requests and per", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+        try ctx.checkKeys(rate_limit_map, "rate_limit", &.{ "requests", "per" });
+
+        var requests: u32 = 0;
+        if (rate_limit_map.get("requests")) |value| {
+            switch (value) {
+                .int => |i| requests = std.math.cast(u32, i) orelse 0,
+                .string => |text| requests = std.fmt.parseInt(u32, text, 10) catch 0,
+                else => {},
+            }
+        }
+        var per_ms: u64 = 0;
+        if (rate_limit_map.get("per")) |value| {
+            per_ms = try parseYamlDuration(value, "rate_limit per");
+        }
+
+        const limiter = try ctx.allocator.create(RateLimiter);
+        limiter.* = RateLimiter.init(requests, per_ms);
+        return limiter;
+    }
+
+    /// Parse `auth: { username, password, realm }`. A missing username or
+    /// password is left empty for validation to report.
+    fn parseYamlAuth(ctx: *const ParseContext, auth_map: anytype) !BasicAuth {
+        try ctx.checkKeys(auth_map, "auth", &.{ "username", "password", "realm" });
+        const allocator = ctx.allocator;
+        var username: ?[]const u8 = null;
+        errdefer if (username) |u| allocator.free(u);
+        var password: ?[]const u8 = null;
+        errdefer if (password) |p| allocator.free(p);
+        var realm: ?[]const u8 = null;
+        errdefer if (realm) |r| allocator.free(r);
+
+        var iter = auth_map.iterator();
+        while (iter.next()) |entry| {
+            const key = entry.key_ptr.*;
+            const value = entry.value_ptr.*;
+            if (value != .string) continue;
+
+            const target = if (std.mem.eql(u8, key, "username"))
+                &username
+            else if (std.mem.eql(u8, key, "password"))
+                &password
+            else if (std.mem.eql(u8, key, "realm"))
+                &realm
+            else
+                continue;
+            if (target.*) |previous| allocator.free(previous);
+            target.* = try ctx.expand(value.string);
+        }
+
+        return BasicAuth{
+            .username = username orelse try allocator.dupe(u8, ""),
+            .password = password orelse try allocator.dupe(u8, ""),
+            .realm = realm,
+        };
+    }
+
+    /// Parse a single method or a list of methods, upper-casing each so
+    /// `get`, `Get` and `GET` are equivalent
+    fn parseYamlMethods(ctx: *const ParseContext, value: anytype) ![]const []const u8 {
+        const allocator = ctx.allocator;
+        const raw = try parseYamlStringList(ctx, value, &.{});
+        defer freeStringList(allocator, raw);
+
+        if (raw.len == 0) {
+            std.log.err("Request method list must not be empty", .{});
+            return error.MissingRequiredRequestFields;
+        }
+
+        const methods = try allocator.alloc([]const u8, raw.len);
+        var converted: usize = 0;
+        errdefer {
+            for (methods[0..converted]) |method| allocator.free(method);
+            allocator.free(methods);
+        }
+        for (raw) |method| {
+            methods[converted] = try std.ascii.allocUpperString(allocator, method);
+            converted += 1;
+        }
+        return methods;
+    }
+
+    fn parseYamlResponseList(ctx: *const ParseContext, list: anytype) ![]MockResponse {
+        const allocator = ctx.allocator;
+        if (list.len == 0) {
+            std.log.err("Response list must not be empty", .{});
+            return error.InvalidYamlFormat;
+        }
+
+        const responses = try allocator.alloc(MockResponse, list.len);
+        var parsed: usize = 0;
+        errdefer {
+            for (responses[0..parsed]) |*response| {
+                response.deinit(allocator);
+            }
+            allocator.free(responses);
+        }
+
+        for (list) |response_value| {
+            responses[parsed] = try parseYamlResponse(ctx, response_value);
+            parsed += 1;
+        }
+        return responses;
+    }
+
+    const schedule_phase_keys = [_][]const u8{ "duration", "response" };
+
+    /// Phases of a rule's `schedule`, each a `duration` and a `response`
+    fn parseYamlSchedule(ctx: *const ParseContext, list: anytype) ![]SchedulePhase {
+        const allocator = ctx.allocator;
+        if (list.len == 0) {
+            std.log.err("Schedule must not be empty", .{});
+            return error.InvalidYamlFormat;
+        }
+
+        const phases = try allocator.alloc(SchedulePhase, list.len);
+        var parsed: usize = 0;
+        errdefer {
+            for (phases[0..parsed]) |*phase| {
+                phase.response.deinit(allocator);
+            }
+            allocator.free(phases);
+        }
+
+        for (list) |phase_value| {
+            if (phase_value != .map) {
+                std.log.err("Expected each schedule phase to be a map with a duration and a response", .{});
+                return error.InvalidYamlFormat;
+            }
+            try ctx.checkKeys(phase_value.map, "schedule phase", &schedule_phase_keys);
+            const duration = phase_value.map.get("duration") orelse {
+                std.log.err("Schedule phase {d} needs a duration", .{parsed + 1});
+                return error.InvalidYamlFormat;
+            };
+            const response = phase_value.map.get("response") orelse {
+                std.log.err("Schedule phase {d} needs a response", .{parsed + 1});
+                return error.InvalidYamlFormat;
+            };
+            phases[parsed] = .{
+                .duration_ms = try parseYamlDuration(duration, "schedule duration"),
+                .response = try parseYamlResponse(ctx, response),
+            };
+            parsed += 1;
+        }
+        return phases;
+    }
+
+    /// Keys of a response, apart from `when` which branches can't use
+    const response_keys = [_][]const u8{ "status", "headers", "body", "body_file", "body_template_file", "template", "delay", "fault", "body_schema", "compress", "weight", "stream", "cookies", "jsonrpc", "etag", "last_modified", "redirect", "websocket", "repeat", "truncate", "content_length", "preset", "faker", "faker_seed", "variants", "variant_fallback", "body_base64", "body_json", "connection_reset", "close_connection", "echo_body", "json_format", "charset", "trailers" };
+
+    fn parseYamlResponse(ctx: *const ParseContext, response_value: anytype) !MockResponse {
+        if (response_value == .map) {
+            try ctx.checkKeys(response_value.map, "response", &(response_keys ++ [_][]const u8{ "when", "quota" }));
+        }
+        var response = try parseYamlResponseFields(ctx, response_value);
+        errdefer response.deinit(ctx.allocator);
+        if (response_value.map.get("when")) |when| {
+            response.when = try parseYamlWhen(ctx, when);
+        }
+        if (response_value.map.get("quota")) |quota| {
+            response.quota = try parseYamlQuota(ctx, quota);
+        }
+        return response;
+    }
+
+    /// Parse `quota: { limit, window, response }`. The response once it is
+    /// used up takes every response field but `when` and `quota`.
+    fn parseYamlQuota(ctx: *const ParseContext, quota_value: anytype) !ResponseQuota {
+        const allocator = ctx.allocator;
+        const quota_map = switch (quota_value) {
+            .map => |map| map,
+            else => {
+                std.log.err("Expected 'quota' to be a map with limit and an optional window and response", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+        try ctx.checkKeys(quota_map, "quota", &.{ "limit", "window", "response" });
+
+        // Missing or unparseable limits become 0 so validation reports them
+        var limit: u64 = 0;
+        if (quota_map.get("limit")) |value| {
+            limit = switch (value) {
+                .int => |i| std.math.cast(u64, i) orelse 0,
+                .string => |text| std.fmt.parseInt(u64, text, 10) catch 0,
+                else => 0,
+            };
+        }
+        var window_ms: ?u64 = null;
+        if (quota_map.get("window")) |value| {
+            window_ms = try parseYamlDuration(value, "quota window");
+        }
+
+        var exceeded: ?*MockResponse = null;
+        errdefer if (exceeded) |response| allocator.destroy(response);
+        if (quota_map.get("response")) |value| {
+            if (value == .map) try ctx.checkKeys(value.map, "quota.response", &response_keys);
+            exceeded = try allocator.create(MockResponse);
+            exceeded.?.* = try parseYamlResponseFields(ctx, value);
+        }
+        errdefer if (exceeded) |response| response.deinit(allocator);
+
+        const counter = try allocator.create(Quota);
+        counter.* = Quota.init(limit, window_ms);
+        return ResponseQuota{ .counter = counter, .exceeded = exceeded };
+    }
+
+    /// Everything in a response but `when`; branches use this directly, so
+    /// they can't nest
+    fn parseYamlResponseFields(ctx: *const ParseContext, response_value: anytype) !MockResponse {
+        const allocator = ctx.allocator;
+        const response_map = switch (response_value) {
+            .map => |map| map,
+            else => return error.InvalidYamlFormat,
+        };
+
+        var status: u16 = 200;
+        var status_template: ?[]const u8 = null;
+        var headers: ?std.StringHashMap([]const u8) = null;
+        var trailers: ?std.StringHashMap([]const u8) = null;
+        var body: ?[]const u8 = null;
+        var body_base64: ?[]const u8 = null;
+        var body_json: ?[]const u8 = null;
+        var body_file: ?[]const u8 = null;
+        var body_template_file: ?[]const u8 = null;
+        var templated: ?bool = null;
+        var delay_ms: u64 = 0;
+        var fault: ?Fault = null;
+        var body_schema: ?[]const u8 = null;
+        var compress = true;
+        var weight: f64 = 1;
+        var stream: ?[]StreamChunk = null;
+        var cookies: ?[]ResponseCookie = null;
+        var envelope: ?jsonrpc.Envelope = null;
+        var etag = false;
+        var last_modified: ?[]const u8 = null;
+        var redirect: ?Redirect = null;
+        var websocket: ?WebSocketScript = null;
+        var repeat: u32 = 1;
+        var truncate: ?u64 = null;
+        var content_length: ?u64 = null;
+        var connection_reset = false;
+        var close_connection: ?bool = null;
+        var preset: ?*const Preset = null;
+        var faker_shape: ?[]const u8 = null;
+        var faker_seed: ?u64 = null;
+        var variants: ?[]ResponseVariant = null;
+        var variant_fallback: VariantFallback = .first;
+        var echo_body: ?EchoBody = null;
+        var json_format: JsonFormat = .raw;
+        var charset: ?Charset = null;
+
+        var map_iter = response_map.iterator();
+        while (map_iter.next()) |entry| {
+            const key = entry.key_ptr.*;
+            const value = entry.value_ptr.*;
+
+            if (std.mem.eql(u8, key, "status")) {
+                switch (value) {
+                    // Unrepresentable statuses become 0 so validation reports them
+                    .int => |i| status = std.math.cast(u16, i) orelse 0,
+                    .string => |s| if (std.mem.indexOf(u8, s, "{{") != null) {
+                        if (status_template) |previous| allocator.free(previous);
+                        status_template = try ctx.expand(s);
+                    } else {
+                        status = std.fmt.parseInt(u16, s, 10) catch 0;
+                    },
+                    else => {},
+                }
+            } else if (std.mem.eql(u8, key, "headers")) {
+                if (value == .map) {
+                    headers = try parseYamlStringMap(ctx, value.map);
+                }
+            } else if (std.mem.eql(u8, key, "trailers")) {
+                if (value == .map) {
+                    trailers = try parseYamlStringMap(ctx, value.map);
+                }
+            } else if (std.mem.eql(u8, key, "body")) {
+                if (value == .string) {
+                    body = try ctx.expand(value.string);
+                }
+            } else if (std.mem.eql(u8, key, "body_base64")) {
+                if (value == .string) {
+                    if (body_base64) |previous| allocator.free(previous);
+                    body_base64 = try decodeYamlBase64(allocator, value.string);
+                }
+            } else if (std.mem.eql(u8, key, "body_json")) {
+                if (body_json) |previous| allocator.free(previous);
+                body_json = try yamlToJsonText(ctx, value);
+            } else if (std.mem.eql(u8, key, "body_file")) {
+                if (value == .string) {
+                    body_file = try parseYamlPath(ctx, value.string);
+                }
+            } else if (std.mem.eql(u8, key, "body_template_file")) {
+                if (value == .string) {
+                    body_template_file = try parseYamlPath(ctx, value.string);
+                }
+            } else if (std.mem.eql(u8, key, "template")) {
+                templated = yamlBool(value);
+            } else if (std.mem.eql(u8, key, "delay")) {
+                delay_ms = try parseYamlDuration(value, "response delay");
+            } else if (std.mem.eql(u8, key, "fault")) {
+                fault = try parseYamlFault(ctx, value);
+            } else if (std.mem.eql(u8, key, "body_schema")) {
+                if (value == .string) {
+                    body_schema = try parseYamlPath(ctx, value.string);
+                }
+            } else if (std.mem.eql(u8, key, "compress")) {
+                compress = yamlBool(value) orelse true;
+            } else if (std.mem.eql(u8, key, "weight")) {
+                weight = yamlNumber(value);
+            } else if (std.mem.eql(u8, key, "stream")) {
+                stream = try parseYamlChunks(ctx, value, "stream");
+            } else if (std.mem.eql(u8, key, "cookies")) {
+                cookies = try parseYamlCookies(ctx, value);
+            } else if (std.mem.eql(u8, key, "jsonrpc")) {
+                const name = if (value == .string) value.string else "";
+                envelope = std.meta.stringToEnum(jsonrpc.Envelope, name) orelse {
+                    std.log.err("Invalid response jsonrpc '{s}' (expected result or error)", .{name});
+                    return error.InvalidYamlFormat;
+                };
+            } else if (std.mem.eql(u8, key, "etag")) {
+                etag = yamlBool(value) orelse false;
+            } else if (std.mem.eql(u8, key, "last_modified")) {
+                if (value == .string) {
+                    if (last_modified) |previous| allocator.free(previous);
+                    last_modified = try ctx.expand(value.string);
+                }
+            } else if (std.mem.eql(u8, key, "redirect")) {
+                redirect = try parseYamlRedirect(ctx, value);
+            } else if (std.mem.eql(u8, key, "websocket")) {
+                if (websocket) |*previous| previous.deinit(allocator);
+                websocket = try parseYamlWebSocket(ctx, value);
+            } else if (std.mem.eql(u8, key, "repeat")) {
+                // Unparseable counts become 0 so validation reports them
+                repeat = switch (value) {
+                    .int => |i| std.math.cast(u32, i) orelse 0,
+                    .string => |text| std.fmt.parseInt(u32, text, 10) catch 0,
+                    else => 0,
+                };
+            } else if (std.mem.eql(u8, key, "truncate")) {
+                truncate = switch (value) {
+                    .int => |i| std.math.cast(u64, i),
+                    .string => |text| std.fmt.parseInt(u64, text, 10) catch null,
+                    else => null,
+                } orelse {
+                    std.log.err("Expected response truncate to be a byte count", .{});
+                    return error.InvalidYamlFormat;
+                };
+            } else if (std.mem.eql(u8, key, "content_length")) {
+                content_length = switch (value) {
+                    .int => |i| std.math.cast(u64, i),
+                    .string => |text| std.fmt.parseInt(u64, text, 10) catch null,
+                    else => null,
+                } orelse {
+                    std.log.err("Expected response content_length to be a byte count", .{});
+                    return error.InvalidYamlFormat;
+                };
+            } else if (std.mem.eql(u8, key, "connection_reset")) {
+                connection_reset = yamlBool(value) orelse false;
+            } else if (std.mem.eql(u8, key, "close_connection")) {
+                close_connection = yamlBool(value) orelse {
+                    std.log.err("Expected response close_connection to be true or false", .{});
+                    return error.InvalidYamlFormat;
+                };
+            } else if (std.mem.eql(u8, key, "preset")) {
+                const name = if (value == .string) value.string else "";
+                preset = Preset.find(name) orelse {
+                    std.log.err("Unknown response preset '{s}' (see the README for the list)", .{name});
+                    return error.InvalidYamlFormat;
+                };
+            } else if (std.mem.eql(u8, key, "faker")) {
+                if (value == .string) {
+                    if (faker_shape) |previous| allocator.free(previous);
+                    faker_shape = try ctx.expand(value.string);
+                }
+            } else if (std.mem.eql(u8, key, "faker_seed")) {
+                faker_seed = switch (value) {
+                    .int => |i| std.math.cast(u64, i),
+                    .string => |text| std.fmt.parseInt(u64, text, 10) catch null,
+                    else => null,
+                } orelse {
+                    std.log.err("Expected response faker_seed to be a whole number", .{});
+                    return error.InvalidYamlFormat;
+                };
+            } else if (std.mem.eql(u8, key, "variants")) {
+                variants = try parseYamlVariants(ctx, value);
+            } else if (std.mem.eql(u8, key, "variant_fallback")) {
+                const name = if (value == .string) value.string else "";
+                variant_fallback = std.meta.stringToEnum(VariantFallback, name) orelse {
+                    std.log.err("Invalid response variant_fallback '{s}' (expected first or not_acceptable)", .{name});
+                    return error.InvalidYamlFormat;
+                };
+            } else if (std.mem.eql(u8, key, "echo_body")) {
+                if (echo_body) |previous| {
+                    if (previous.wrap) |wrap| allocator.free(wrap);
+                }
+                echo_body = try parseYamlEchoBody(ctx, value);
+            } else if (std.mem.eql(u8, key, "json_format")) {
+                const name = if (value == .string) value.string else "";
+                json_format = std.meta.stringToEnum(JsonFormat, name) orelse {
+                    std.log.err("Invalid response json_format '{s}' (expected raw, pretty or compact)", .{name});
+                    return error.InvalidYamlFormat;
+                };
+            } else if (std.mem.eql(u8, key, "charset")) {
+                charset = try parseYamlCharset(value, "response charset");
+            }
+        }
+
+        // Binary bodies are sent byte for byte, so they can't be templated
+        if (body_base64) |decoded| {
+            if (body != null or body_file != null or body_template_file != null) {
+                std.log.err("Response sets body_base64 along with body or body_file; use only one", .{});
+                allocator.free(decoded);
+                return error.InvalidYamlFormat;
+            }
+            if (charset != null) {
+                std.log.err("Response sets charset on a body_base64 body, which is binary", .{});
+                allocator.free(decoded);
+                return error.InvalidYamlFormat;
+            }
+            if (templated == true) {
+                std.log.warn("Response sets template on a body_base64 body; it is sent as is", .{});
+            }
+            body = decoded;
+            templated = false;
+            if (headers == null) headers = std.StringHashMap([]const u8).init(allocator);
+            if (!hasHeaderIgnoringCase(&headers.?, "Content-Type")) {
+                try headers.?.ensureUnusedCapacity(1);
+                const name = try allocator.dupe(u8, "Content-Type");
+                errdefer allocator.free(name);
+                headers.?.putAssumeCapacity(name, try allocator.dupe(u8, "application/octet-stream"));
+            }
+        }
+
+        // Written as YAML, sent as JSON
+        if (body_json) |json_text| {
+            if (body != null or body_base64 != null or body_file != null or body_template_file != null) {
+                std.log.err("Response sets body_json along with body, body_base64 or body_file; use only one", .{});
+                allocator.free(json_text);
+                return error.InvalidYamlFormat;
+            }
+            body = json_text;
+            if (headers == null) headers = std.StringHashMap([]const u8).init(allocator);
+            if (!hasHeaderIgnoringCase(&headers.?, "Content-Type")) {
+                try headers.?.ensureUnusedCapacity(1);
+                const name = try allocator.dupe(u8, "Content-Type");
+                errdefer allocator.free(name);
+                headers.?.putAssumeCapacity(name, try allocator.dupe(u8, "application/json"));
+            }
+        }
+
+        // The request's body stands in for the response's own
+        if (echo_body) |echo| {
+            if (body != null or body_file != null or body_template_file != null or faker_shape != null or stream != null or variants != null) {
+                std.log.err("Response sets echo_body along with another body; use only one", .{});
+                if (echo.wrap) |wrap| allocator.free(wrap);
+                return error.InvalidYamlFormat;
+            }
+        }
+
+        // A preset only fills in what the response leaves unset
+        if (preset) |p| {
+            if (response_map.get("status") == null) status = p.status;
+            if (body == null and body_file == null and body_template_file == null and stream == null and faker_shape == null and variants == null and echo_body == null) {
+                body = try allocator.dupe(u8, p.body);
+            }
+            for (p.headers) |header| {
+                if (headers) |*map| {
+                    if (hasHeaderIgnoringCase(map, header[0])) continue;
+                } else {
+                    headers = std.StringHashMap([]const u8).init(allocator);
+                }
+                try headers.?.ensureUnusedCapacity(1);
+                const name = try allocator.dupe(u8, header[0]);
+                errdefer allocator.free(name);
+                headers.?.putAssumeCapacity(name, try allocator.dupe(u8, header[1]));
+            }
+        }
+
+        if (redirect) |r| {
+            if (response_map.get("status") != null) {
+                std.log.warn("Response sets both status and redirect; using the redirect status {d}", .{r.status});
+            }
+            if (status_template) |ignored| {
+                allocator.free(ignored);
+                status_template = null;
+            }
+            status = r.status;
+        }
+
+        var schema: ?*Schema = null;
+        if (body_schema) |schema_path| {
+            schema = try loadBodySchema(allocator, schema_path);
+        }
+
+        if (body_template_file) |template_file| {
+            if (body_file) |ignored| {
+                std.log.warn("Response sets both body_file and body_template_file; using {s} and ignoring {s}", .{ template_file, ignored });
+                allocator.free(ignored);
+            }
+            body_file = template_file;
+            templated = true;
+        }
+
+        if (body != null and body_file != null) {
+            std.log.warn("Response sets both body and body_file; using body and ignoring {s}", .{body_file.?});
+            allocator.free(body_file.?);
+            body_file = null;
+        }
+        if (variants != null and (body != null or body_file != null or faker_shape != null)) {
+            std.log.warn("Response sets both variants and a body; only the variants are sent", .{});
+        }
+        if (faker_shape != null and (body != null or body_file != null)) {
+            std.log.warn("Response sets both faker and a body; only the faker body is sent", .{});
+        }
+        if (stream != null and (body != null or body_file != null)) {
+            std.log.warn("Response sets both stream and a body; only the stream is sent", .{});
+        }
+        if (websocket != null and (stream != null or body != null or body_file != null)) {
+            std.log.warn("Response sets websocket along with a body or stream; upgrade requests get the websocket and others a 426", .{});
+        }
+
+        return MockResponse{
+            .status = status,
+            .status_template = status_template,
+            .headers = headers,
+            .trailers = trailers,
+            .body = body orelse "",
+            .template = templated,
+            .body_file = body_file,
+            .delay_ms = delay_ms,
+            .fault = fault,
+            .body_schema = body_schema,
+            .schema = schema,
+            .compress = compress,
+            .weight = weight,
+            .stream = stream,
+            .cookies = cookies,
+            .jsonrpc = envelope,
+            .etag = etag,
+            .last_modified = last_modified,
+            .redirect = redirect,
+            .websocket = websocket,
+            .repeat = repeat,
+            .truncate = truncate,
+            .content_length = content_length,
+            .connection_reset = connection_reset,
+            .close_connection = close_connection,
+            .faker = faker_shape,
+            .faker_seed = faker_seed,
+            .variants = variants,
+            .variant_fallback = variant_fallback,
+            .echo_body = echo_body,
+            .json_format = json_format,
+            .charset = charset,
+        };
+    }
+
+    fn parseYamlWebSocket(ctx: *const ParseContext, websocket_value: anytype) !WebSocketScript {
+        const websocket_map = switch (websocket_value) {
+            .map => |map| map,
+            else => {
+                std.log.err("Expected 'websocket' to be a map with messages and echo", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+        try ctx.checkKeys(websocket_map, "websocket", &.{ "messages", "echo" });
+
+        var echo = false;
+        if (websocket_map.get("echo")) |value| {
+            echo = yamlBool(value) orelse {
+                std.log.err("Expected websocket 'echo' to be true or false", .{});
+                return error.InvalidYamlFormat;
+            };
+        }
+        const messages = if (websocket_map.get("messages")) |value|
+            try parseYamlChunks(ctx, value, "messages")
+        else
+            try ctx.allocator.alloc(StreamChunk, 0);
+        return WebSocketScript{ .messages = messages, .echo = echo };
+    }
+
+    /// Parse `echo_body: true`, or `echo_body: { wrap: received }` to wrap
+    /// the body in a JSON object. False leaves it unset.
+    fn parseYamlEchoBody(ctx: *const ParseContext, echo_value: anytype) !?EchoBody {
+        if (echo_value == .map) {
+            try ctx.checkKeys(echo_value.map, "echo_body", &.{"wrap"});
+            const wrap = echo_value.map.get("wrap") orelse return EchoBody{};
+            if (wrap != .string or wrap.string.len == 0) {
+                std.log.err("Expected echo_body wrap to be the name of a JSON key", .{});
+                return error.InvalidYamlFormat;
+            }
+            return EchoBody{ .wrap = try ctx.expand(wrap.string) };
+        }
+        const enabled = yamlBool(echo_value) orelse {
+            std.log.err("Expected response echo_body to be true, false or a map with wrap", .{});
+            return error.InvalidYamlFormat;
+        };
+        return if (enabled) EchoBody{} else null;
+    }
+
+    fn parseYamlRedirect(ctx: *const ParseContext, redirect_value: anytype) !Redirect {
+        const redirect_map = switch (redirect_value) {
+            .map => |map| map,
+            else => {
+                std.log.err("Expected 'redirect' to be a map with a url", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+        try ctx.checkKeys(redirect_map, "redirect", &.{ "url", "status" });
+
+        const url = redirect_map.get("url") orelse {
+            std.log.err("Redirect is missing its url", .{});
+            return error.InvalidYamlFormat;
+        };
+        if (url != .string) {
+            std.log.err("Expected redirect url to be a string", .{});
+            return error.InvalidYamlFormat;
+        }
+
+        // An unparseable status becomes 0 so validation reports it
+        var redirect = Redirect{ .url = undefined };
+        if (redirect_map.get("status")) |status| {
+            switch (status) {
+                .int => |i| redirect.status = std.math.cast(u16, i) orelse 0,
+                .string => |text| redirect.status = std.fmt.parseInt(u16, text, 10) catch 0,
+                else => redirect.status = 0,
+            }
+        }
+        redirect.url = try ctx.expand(url.string);
+        return redirect;
+    }
+
+    fn parseYamlVariants(ctx: *const ParseContext, variants_value: anytype) ![]ResponseVariant {
+        const allocator = ctx.allocator;
+        const list = switch (variants_value) {
+            .list => |list| list,
+            else => {
+                std.log.err("Expected 'variants' to be a list", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+
+        const variants = try allocator.alloc(ResponseVariant, list.len);
+        var parsed: usize = 0;
+        errdefer {
+            for (variants[0..parsed]) |*variant| variant.deinit(allocator);
+            allocator.free(variants);
+        }
+
+        for (list) |variant_value| {
+            const variant_map = switch (variant_value) {
+                .map => |map| map,
+                else => {
+                    std.log.err("Expected 'variants' entries to be maps with a content_type and body", .{});
+                    return error.InvalidYamlFormat;
+                },
+            };
+            try ctx.checkKeys(variant_map, "variant", &.{ "content_type", "body" });
+            const content_type = variant_map.get("content_type") orelse {
+                std.log.err("Response variant is missing a content_type", .{});
+                return error.InvalidYamlFormat;
+            };
+            if (content_type != .string) {
+                std.log.err("Response variant content_type must be a string", .{});
+                return error.InvalidYamlFormat;
+            }
+
+            var variant = ResponseVariant{ .content_type = try ctx.expand(content_type.string), .body = "" };
+            errdefer variant.deinit(allocator);
+            // Freeing the empty placeholder is a no-op if this fails
+            variant.body = if (variant_map.get("body")) |body| switch (body) {
+                .string => |text| try ctx.expand(text),
+                else => try allocator.dupe(u8, ""),
+            } else try allocator.dupe(u8, "");
+
+            variants[parsed] = variant;
+            parsed += 1;
+        }
+        return variants;
+    }
+
+    fn parseYamlCookies(ctx: *const ParseContext, cookies_value: anytype) ![]ResponseCookie {
+        const allocator = ctx.allocator;
+        const list = switch (cookies_value) {
+            .list => |list| list,
+            else => {
+                std.log.err("Expected 'cookies' to be a list", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+
+        const cookies = try allocator.alloc(ResponseCookie, list.len);
+        var parsed: usize = 0;
+        errdefer {
+            for (cookies[0..parsed]) |*cookie| cookie.deinit(allocator);
+            allocator.free(cookies);
+        }
+
+        for (list) |cookie_value| {
+            const cookie_map = switch (cookie_value) {
+                .map => |map| map,
+                else => {
+                    std.log.err("Expected 'cookies' entries to be maps with a name and value", .{});
+                    return error.InvalidYamlFormat;
+                },
+            };
+            try ctx.checkKeys(cookie_map, "cookie", &.{ "name", "value", "path", "max_age", "http_only", "secure", "same_site" });
+            const name = cookie_map.get("name") orelse {
+                std.log.err("Response cookie is missing a name", .{});
+                return error.InvalidYamlFormat;
+            };
+            if (name != .string) {
+                std.log.err("Response cookie name must be a string", .{});
+                return error.InvalidYamlFormat;
+            }
+
+            var cookie = ResponseCookie{ .name = try ctx.expand(name.string), .value = "" };
+            errdefer cookie.deinit(allocator);
+            // Freeing the empty placeholder is a no-op if this fails
+            cookie.value = if (cookie_map.get("value")) |value| switch (value) {
+                .string => |text| try ctx.expand(text),
+                .int => |i| try std.fmt.allocPrint(allocator, "{d}", .{i}),
+                else => try allocator.dupe(u8, ""),
+            } else try allocator.dupe(u8, "");
+            if (cookie_map.get("path")) |path| {
+                if (path == .string) cookie.path = try ctx.expand(path.string);
+            }
+            if (cookie_map.get("max_age")) |max_age| {
+                cookie.max_age = switch (max_age) {
+                    .int => |i| i,
+                    .string => |s| std.fmt.parseInt(i64, s, 10) catch null,
+                    else => null,
+                } orelse {
+                    std.log.err("Invalid max_age for cookie '{s}': expected a number of seconds", .{cookie.name});
+                    return error.InvalidYamlFormat;
+                };
+            }
+            if (cookie_map.get("http_only")) |http_only| {
+                cookie.http_only = yamlBool(http_only) orelse false;
+            }
+            if (cookie_map.get("secure")) |secure| {
+                cookie.secure = yamlBool(secure) orelse false;
+            }
+            if (cookie_map.get("same_site")) |same_site| {
+                const text = if (same_site == .string) same_site.string else "";
+                var buffer: [8]u8 = undefined;
+                const lowered = if (text.len <= buffer.len) std.ascii.lowerString(&buffer, text) else text;
+                cookie.same_site = std.meta.stringToEnum(interfaces.SetCookie.SameSite, lowered) orelse {
+                    std.log.err("Invalid same_site for cookie '{s}': expected strict, lax or none", .{cookie.name});
+                    return error.InvalidYamlFormat;
+                };
+            }
+
+            cookies[parsed] = cookie;
+            parsed += 1;
+        }
+        return cookies;
+    }
+
+    /// Parse a list of `{ data, delay }` entries, such as `stream:`; `name`
+    /// is the field, for messages
+    fn parseYamlChunks(ctx: *const ParseContext, chunks_value: anytype, comptime name: []const u8) ![]StreamChunk {
+        const allocator = ctx.allocator;
+        const list = switch (chunks_value) {
+            .list => |list| list,
+            else => {
+                std.log.err("Expected '" ++ name ++ "' to be a list", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+        if (list.len == 0) {
+            std.log.err("'" ++ name ++ "' must not be empty", .{});
+            return error.InvalidYamlFormat;
+        }
+
+        const chunks = try allocator.alloc(StreamChunk, list.len);
+        var parsed: usize = 0;
+        errdefer {
+            for (chunks[0..parsed]) |chunk| allocator.free(chunk.data);
+            allocator.free(chunks);
+        }
+
+        for (list) |chunk_value| {
+            const chunk_map = switch (chunk_value) {
+                .map => |map| map,
+                else => {
+                    std.log.err("Expected '" ++ name ++ "' entries to be maps with data and delay", .{});
+                    return error.InvalidYamlFormat;
+                },
+            };
+            try ctx.checkKeys(chunk_map, name ++ " entry", &.{ "data", "delay" });
+            var delay_ms: u64 = 0;
+            if (chunk_map.get("delay")) |delay| {
+                delay_ms = try parseYamlDuration(delay, name ++ " delay");
+            }
+            const data = if (chunk_map.get("data")) |data| switch (data) {
+                .string => |text| try ctx.expand(text),
+                else => try allocator.dupe(u8, ""),
+            } else try allocator.dupe(u8, "");
+
+            chunks[parsed] = StreamChunk{ .data = data, .delay_ms = delay_ms };
+            parsed += 1;
+        }
+        return chunks;
+    }
+
+    fn parseYamlWhen(ctx: *const ParseContext, when_value: anytype) ![]ResponseBranch {
+        const allocator = ctx.allocator;
+        const list = switch (when_value) {
+            .list => |list| list,
+            else => {
+                std.log.err("Expected 'when' to be a list", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+
+        const branches = try allocator.alloc(ResponseBranch, list.len);
+        var parsed: usize = 0;
+        errdefer {
+            for (branches[0..parsed]) |*branch| {
+                branch.deinit(allocator);
+            }
+            allocator.free(branches);
+        }
+
+        for (list) |branch_value| {
+            if (branch_value != .map) {
+                std.log.err("Expected 'when' entries to be maps", .{});
+                return error.InvalidYamlFormat;
+            }
+            try ctx.checkKeys(branch_value.map, "when branch", &(response_keys ++ [_][]const u8{ "condition", "when" }));
+            if (branch_value.map.get("when") != null) {
+                std.log.warn("Nested 'when' lists are not supported; ignoring the inner one", .{});
+            }
+
+            // A branch without a condition is left empty for validation to report
+            var condition = Condition{};
+            if (branch_value.map.get("condition")) |condition_value| {
+                condition = try parseYamlCondition(ctx, condition_value);
+            }
+            errdefer condition.deinit(allocator);
+
+            branches[parsed] = ResponseBranch{
+                .condition = condition,
+                .response = try parseYamlResponseFields(ctx, branch_value),
+            };
+            parsed += 1;
+        }
+        return branches;
+    }
+
+    fn parseYamlCondition(ctx: *const ParseContext, condition_value: anytype) !Condition {
+        const condition_map = switch (condition_value) {
+            .map => |map| map,
+            else => {
+                std.log.err("Expected 'condition' to be a map", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+        try ctx.checkKeys(condition_map, "condition", &.{ "header", "query", "body_contains", "equals" });
+
+        var condition = Condition{};
+        errdefer condition.deinit(ctx.allocator);
+
+        var map_iter = condition_map.iterator();
+        while (map_iter.next()) |entry| {
+            const key: []const u8 = entry.key_ptr.*;
+            const value = entry.value_ptr.*;
+            if (value != .string) continue;
+
+            if (std.mem.eql(u8, key, "header")) {
+                condition.header = try ctx.expand(value.string);
+            } else if (std.mem.eql(u8, key, "query")) {
+                condition.query = try ctx.expand(value.string);
+            } else if (std.mem.eql(u8, key, "body_contains")) {
+                condition.body_contains = try ctx.expand(value.string);
+            } else if (std.mem.eql(u8, key, "equals")) {
+                condition.equals = try ctx.expand(value.string);
+            }
+        }
+        return condition;
+    }
+
+    fn loadBodySchema(allocator: std.mem.Allocator, path: []const u8) !*Schema {
+        const schema = try allocator.create(Schema);
+        errdefer allocator.destroy(schema);
+        schema.* = Schema.loadFile(allocator, path) catch |err| {
+            std.log.err("Failed to load body_schema {s}: {}", .{ path, err });
+            return err;
+        };
+        return schema;
+    }
+
+    fn parseYamlFault(ctx: *const ParseContext, fault_value: anytype) !Fault {
+        const fault_map = switch (fault_value) {
+            .map => |map| map,
+            else => {
+                std.log.err("Expected 'fault' to be a map", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+        try ctx.checkKeys(fault_map, "fault", &.{ "probability", "status", "delay" });
+
+        // Unparseable values become NaN or 0 so validation reports them
+        var fault = Fault{ .probability = std.math.nan(f64) };
+        var map_iter = fault_map.iterator();
+        while (map_iter.next()) |entry| {
+            const key: []const u8 = entry.key_ptr.*;
+            const value = entry.value_ptr.*;
+
+            if (std.mem.eql(u8, key, "probability")) {
+                fault.probability = yamlNumber(value);
+            } else if (std.mem.eql(u8, key, "status")) {
+                switch (value) {
+                    .int => |i| fault.status = std.math.cast(u16, i) orelse 0,
+                    .string => |s| fault.status = std.fmt.parseInt(u16, s, 10) catch 0,
+                    else => {},
+                }
+            } else if (std.mem.eql(u8, key, "delay")) {
+                fault.delay_ms = try parseYamlDuration(value, "fault delay");
+            }
+        }
+        return fault;
+    }
+
+    fn parseYamlProxy(ctx: *const ParseContext, proxy_value: anytype) !ProxyConfig {
+        const proxy_map = switch (proxy_value) {
+            .map => |map| map,
+            else => return error.InvalidYamlFormat,
+        };
+        try ctx.checkKeys(proxy_map, "proxy", &.{ "url", "upstreams", "headers", "path_rewrite", "timeout", "timeout_ms", "fallback", "fallback_on_error_status", "response_rewrite" });
+
+        var url: ?[]const u8 = null;
+        var upstreams: ?[]ProxyUpstream = null;
+        var headers: ?std.StringHashMap([]const u8) = null;
+        var timeout_ms: u64 = 30000;
+        var path_rewrite: ?PathRewrite = null;
+        errdefer if (path_rewrite) |*rewrite| rewrite.deinit(ctx.allocator);
+        var response_rewrite: ?ResponseRewrite = null;
+        errdefer if (response_rewrite) |*rewrite| rewrite.deinit(ctx.allocator);
+        var fallback: ProxyFallback = .none;
+        var fallback_on_error_status = false;
+
+        var map_iter = proxy_map.iterator();
+        while (map_iter.next()) |entry| {
+            const key: []const u8 = entry.key_ptr.*;
+            const value = entry.value_ptr.*;
+
+            if (std.mem.eql(u8, key, "url")) {
+                if (value == .string) {
+                    url = try ctx.expand(value.string);
+                }
+            } else if (std.mem.eql(u8, key, "upstreams")) {
+                upstreams = try parseYamlUpstreams(ctx, value);
+            } else if (std.mem.eql(u8, key, "headers")) {
+                if (value == .map) {
+                    headers = try parseYamlStringMap(ctx, value.map);
+                }
+            } else if (std.mem.eql(u8, key, "path_rewrite")) {
+                path_rewrite = try parseYamlPathRewrite(ctx, value);
+            } else if (std.mem.eql(u8, key, "response_rewrite")) {
+                response_rewrite = try parseYamlResponseRewrite(ctx, value);
+            } else if (std.mem.eql(u8, key, "timeout")) {
+                timeout_ms = try parseYamlDuration(value, "proxy timeout");
+            } else if (std.mem.eql(u8, key, "fallback")) {
+                const name = if (value == .string) value.string else "";
+                fallback = std.meta.stringToEnum(ProxyFallback, name) orelse {
+                    std.log.err("Invalid proxy fallback '{s}' (expected response or none)", .{name});
+                    return error.InvalidYamlFormat;
+                };
+            } else if (std.mem.eql(u8, key, "fallback_on_error_status")) {
+                fallback_on_error_status = yamlBool(value) orelse {
+                    std.log.err("Invalid proxy fallback_on_error_status: expected true or false", .{});
+                    return error.InvalidYamlFormat;
+                };
+            } else if (std.mem.eql(u8, key, "timeout_ms")) {
+                switch (value) {
+                    .int => |i| timeout_ms = @intCast(i),
+                    .string => |s| timeout_ms = std.fmt.parseInt(u64, s, 10) catch 30000,
+                    else => {},
+                }
+            }
+        }
+
+        if (url == null) {
+            if (upstreams == null) return error.MissingProxyUrl;
+            url = try ctx.allocator.dupe(u8, "");
+        }
+
+        return ProxyConfig{
+            .url = url.?,
+            .upstreams = upstreams,
+            .headers = headers,
+            .timeout_ms = timeout_ms,
+            .path_rewrite = path_rewrite,
+            .fallback = fallback,
+            .fallback_on_error_status = fallback_on_error_status,
+            .response_rewrite = response_rewrite,
+        };
+    }
+
+    /// Parse a proxy's `upstreams:` list, each entry a map with a `url` and
+    /// an optional `weight` and `timeout`
+    fn parseYamlUpstreams(ctx: *const ParseContext, upstreams_value: anytype) ![]ProxyUpstream {
+        const items = switch (upstreams_value) {
+            .list => |list| list,
+            else => {
+                std.log.err("Expected proxy 'upstreams' to be a list of urls with weights", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+        var upstreams = std.ArrayList(ProxyUpstream).init(ctx.allocator);
+        errdefer {
+            for (upstreams.items) |upstream| ctx.allocator.free(upstream.url);
+            upstreams.deinit();
+        }
+        for (items) |item| {
+            if (item != .map) {
+                std.log.err("Expected each proxy upstream to be a map with a url", .{});
+                return error.InvalidYamlFormat;
+            }
+            try ctx.checkKeys(item.map, "upstream", &.{ "url", "weight", "timeout" });
+            const url_value = item.map.get("url") orelse .empty;
+            if (url_value != .string) {
+                std.log.err("Proxy upstream is missing its url", .{});
+                return error.InvalidYamlFormat;
+            }
+            var upstream = ProxyUpstream{ .url = undefined };
+            if (item.map.get("weight")) |weight| upstream.weight = yamlNumber(weight);
+            if (item.map.get("timeout")) |timeout| upstream.timeout_ms = try parseYamlDuration(timeout, "proxy upstream timeout");
+            upstream.url = try ctx.expand(url_value.string);
+            errdefer ctx.allocator.free(upstream.url);
+            try upstreams.append(upstream);
+        }
+        return upstreams.toOwnedSlice();
+    }
+
+    fn parseYamlResponseRewrite(ctx: *const ParseContext, rewrite_value: anytype) !ResponseRewrite {
+        const allocator = ctx.allocator;
+        const rewrite_map = switch (rewrite_value) {
+            .map => |map| map,
+            else => {
+                std.log.err("Expected 'response_rewrite' to be a map", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+        try ctx.checkKeys(rewrite_map, "response_rewrite", &.{ "add_headers", "remove_headers", "body_replace", "json_patch" });
+
+        var rewrite = ResponseRewrite{
+            .remove_headers = try parseYamlStringList(ctx, rewrite_map.get("remove_headers"), &.{}),
+            .body_replace = try allocator.alloc(BodyReplace, 0),
+            .json_patch = try allocator.alloc(JsonPatch, 0),
+        };
+        errdefer rewrite.deinit(allocator);
+
+        if (rewrite_map.get("add_headers")) |value| {
+            if (value == .map) rewrite.add_headers = try parseYamlStringMap(ctx, value.map);
+        }
+
+        if (rewrite_map.get("body_replace")) |value| {
+            const items = switch (value) {
+                .list => |list| list,
+                else => {
+                    std.log.err("Expected 'body_replace' to be a list of find/replace pairs", .{});
+                    return error.InvalidYamlFormat;
+                },
+            };
+            var replacements = std.ArrayList(BodyReplace).init(allocator);
+            defer replacements.deinit();
+            errdefer for (replacements.items) |replacement| {
+                allocator.free(replacement.find);
+                allocator.free(replacement.replace);
+            };
+            for (items) |item| {
+                if (item != .map) {
+                    std.log.err("Expected each body_replace entry to be a map with find and replace", .{});
+                    return error.InvalidYamlFormat;
+                }
+                try ctx.checkKeys(item.map, "body_replace", &.{ "find", "replace" });
+                const find = try yamlScalarToString(ctx, item.map.get("find") orelse .empty) orelse {
+                    std.log.err("body_replace entry is missing find", .{});
+                    return error.InvalidYamlFormat;
+                };
+                errdefer allocator.free(find);
+                const replace = try yamlScalarToString(ctx, item.map.get("replace") orelse .empty) orelse try allocator.dupe(u8, "");
+                errdefer allocator.free(replace);
+                try replacements.append(.{ .find = find, .replace = replace });
+            }
+            const owned = try replacements.toOwnedSlice();
+            allocator.free(rewrite.body_replace);
+            rewrite.body_replace = owned;
+        }
+
+        if (rewrite_map.get("json_patch")) |value| {
+            const items = switch (value) {
+                .list => |list| list,
+                else => {
+                    std.log.err("Expected 'json_patch' to be a list of edits", .{});
+                    return error.InvalidYamlFormat;
+                },
+            };
+            var patches = std.ArrayList(JsonPatch).init(allocator);
+            defer patches.deinit();
+            errdefer for (patches.items) |patch| {
+                allocator.free(patch.path);
+                allocator.free(patch.value);
+            };
+            for (items) |item| {
+                if (item != .map) {
+                    std.log.err("Expected each json_patch entry to be a map with op and path", .{});
+                    return error.InvalidYamlFormat;
+                }
+                try ctx.checkKeys(item.map, "json_patch", &.{ "op", "path", "value" });
+                const op_value = item.map.get("op") orelse .empty;
+                const op_name = if (op_value == .string) op_value.string else "";
+                const op = std.meta.stringToEnum(JsonPatchOp, op_name) orelse {
+                    std.log.err("Invalid json_patch op '{s}' (expected set or remove)", .{op_name});
+                    return error.InvalidYamlFormat;
+                };
+                const path = try yamlScalarToString(ctx, item.map.get("path") orelse .empty) orelse {
+                    std.log.err("json_patch entry is missing path", .{});
+                    return error.InvalidYamlFormat;
+                };
+                errdefer allocator.free(path);
+                const patch_value = try yamlToJsonText(ctx, item.map.get("value") orelse .empty);
+                errdefer allocator.free(patch_value);
+                try patches.append(.{ .op = op, .path = path, .value = patch_value });
+            }
+            const owned = try patches.toOwnedSlice();
+            allocator.free(rewrite.json_patch);
+            rewrite.json_patch = owned;
+        }
+        return rewrite;
+    }
+
+    /// `value` written as JSON text, so a `json_patch` value can be any YAML
+    /// value. Strings have `${VAR}` references expanded.
+    fn yamlToJsonText(ctx: *const ParseContext, value: anytype) ![]const u8 {
+        var text = std.ArrayList(u8).init(ctx.allocator);
+        errdefer text.deinit();
+        var json = std.json.writeStream(text.writer(), .{});
+        try writeYamlAsJson(ctx, &json, value);
+        return text.toOwnedSlice();
+    }
+
+    fn writeYamlAsJson(ctx: *const ParseContext, json: anytype, value: anytype) !void {
+        switch (value) {
+            .empty => try json.write(null),
+            .boolean => |b| try json.write(b),
+            .int => |i| try json.write(i),
+            .float => |f| try json.write(f),
+            .string => |s| {
+                const expanded = try ctx.expand(s);
+                defer ctx.allocator.free(expanded);
+                try json.write(expanded);
+            },
+            .list => |list| {
+                try json.beginArray();
+                for (list) |item| try writeYamlAsJson(ctx, json, item);
+                try json.endArray();
+            },
+            .map => |map| {
+                try json.beginObject();
+                var iter = map.iterator();
+                while (iter.next()) |entry| {
+                    try json.objectField(entry.key_ptr.*);
+                    try writeYamlAsJson(ctx, json, entry.value_ptr.*);
+                }
+                try json.endObject();
+            },
+        }
+    }
+
+    fn parseYamlPathRewrite(ctx: *const ParseContext, rewrite_value: anytype) !PathRewrite {
+        const allocator = ctx.allocator;
+        const rewrite_map = switch (rewrite_value) {
+            .map => |map| map,
+            else => {
+                std.log.err("Expected 'path_rewrite' to be a map", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+        try ctx.checkKeys(rewrite_map, "path_rewrite", &.{ "strip_prefix", "add_prefix", "regex", "replacement" });
+
+        var rewrite = PathRewrite{ .replacement = try allocator.dupe(u8, "") };
+        errdefer rewrite.deinit(allocator);
+
+        var map_iter = rewrite_map.iterator();
+        while (map_iter.next()) |entry| {
+            const key: []const u8 = entry.key_ptr.*;
+            const value = entry.value_ptr.*;
+            if (value != .string) continue;
+
+            if (std.mem.eql(u8, key, "strip_prefix")) {
+                rewrite.strip_prefix = try ctx.expand(value.string);
+            } else if (std.mem.eql(u8, key, "add_prefix")) {
+                rewrite.add_prefix = try ctx.expand(value.string);
+            } else if (std.mem.eql(u8, key, "regex")) {
+                rewrite.regex = try ctx.expand(value.string);
+            } else if (std.mem.eql(u8, key, "replacement")) {
+                allocator.free(rewrite.replacement);
+                rewrite.replacement = try ctx.expand(value.string);
+            }
+        }
+
+        // An invalid pattern leaves `compiled` unset; validation reports it with the reason
+        if (rewrite.regex) |pattern| {
+            rewrite.compiled = Regex.compile(allocator, pattern, null) catch |err| switch (err) {
+                error.OutOfMemory => return err,
+                error.InvalidPattern => null,
+            };
+        }
+        return rewrite;
+    }
+
+    fn parseYamlCors(ctx: *const ParseContext, cors_value: anytype) !CorsConfig {
+        const allocator = ctx.allocator;
+        const cors_map = switch (cors_value) {
+            .map => |map| map,
+            else => {
+                std.log.err("Expected 'cors' to be a map", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+        try ctx.checkKeys(cors_map, "cors", &.{ "allowed_origins", "allowed_methods", "allowed_headers", "allow_credentials" });
+
+        const defaults = CorsConfig.default;
+
+        const origins = try parseYamlStringList(ctx, cors_map.get("allowed_origins"), defaults.allowed_origins);
+        errdefer freeStringList(allocator, origins);
+        const methods = try parseYamlStringList(ctx, cors_map.get("allowed_methods"), defaults.allowed_methods);
+        errdefer freeStringList(allocator, methods);
+        const headers = try parseYamlStringList(ctx, cors_map.get("allowed_headers"), defaults.allowed_headers);
+        errdefer freeStringList(allocator, headers);
+
+        const allow_credentials = if (cors_map.get("allow_credentials")) |value| yamlBool(value) orelse false else false;
+
+        return CorsConfig{
+            .allowed_origins = origins,
+            .allowed_methods = methods,
+            .allowed_headers = headers,
+            .allow_credentials = allow_credentials,
+        };
+    }
+
+    /// Parse a port number; out-of-range or non-numeric values become 0
+    fn parseYamlPort(value: anytype) u16 {
+        return switch (value) {
+            .int => |i| std.math.cast(u16, i) orelse 0,
+            .string => |s| std.fmt.parseInt(u16, s, 10) catch 0,
+            else => 0,
+        };
+    }
+
+    /// Like `parseYamlPort`, but 0 is valid, so anything unusable becomes a
+    /// value past the u16 range
+    fn parseYamlListenPort(value: anytype) u32 {
+        const invalid: u32 = std.math.maxInt(u16) + 1;
+        return switch (value) {
+            .int => |i| if (std.math.cast(u16, i)) |port| port else invalid,
+            .string => |s| std.fmt.parseInt(u16, s, 10) catch invalid,
+            else => invalid,
+        };
+    }
+
+    fn parseYamlCompression(ctx: *const ParseContext, compression_value: anytype) !CompressionConfig {
+        const compression_map = switch (compression_value) {
+            .map => |map| map,
+            else => {
+                std.log.err("Expected 'compression' to be a map", .{});
+                return error.InvalidYamlFormat;
+            },
+        };
+        try ctx.checkKeys(compression_map, "compression", &.{ "enabled", "min_size" });
+
+        var compression = CompressionConfig{};
+        if (compression_map.get("enabled")) |enabled| {
+            compression.enabled = yamlBool(enabled) orelse compression.enabled;
+        }
+        if (compression_map.get("min_size")) |min_size| {
+            switch (min_size) {
+                .int => |i| compression.min_size = std.math.cast(usize, i) orelse {
+                    std.log.err("Invalid compression min_size: {d} (must not be negative)", .{i});
+                    return error.InvalidYamlFormat;
+                },
+                .string => |text| compression.min_size = std.fmt.parseInt(usize, text, 10) catch {
+                    std.log.err("Invalid compression min_size: '{s}' (expected a number of bytes)", .{text});
+                    return error.InvalidYamlFormat;
+                },
+                else => {},
+            }
+        }
+        return compression;
+    }
+
+    /// A charset name such as "iso-8859-1"
+    fn parseYamlCharset(value: anytype, field_name: []const u8) !Charset {
+        const name = if (value == .string) value.string else "";
+        return Charset.parse(name) orelse {
+            std.log.err("Unsupported {s} '{s}' (expected utf-8, iso-8859-1, windows-1252 or us-ascii)", .{ field_name, name });
+            return error.InvalidYamlFormat;
+        };
+    }
+
+    /// Decode a `body_base64` value, ignoring the line breaks and spaces a
+    /// YAML block scalar leaves in it
+    fn decodeYamlBase64(allocator: std.mem.Allocator, text: []const u8) ![]const u8 {
+        const decoder = std.base64.standard.decoderWithIgnore(" \t\r\n");
+        const buffer = try allocator.alloc(u8, try decoder.calcSizeUpperBound(text.len));
+        errdefer allocator.free(buffer);
+        const len = decoder.decode(buffer, text) catch {
+            std.log.err("Invalid response body_base64: expected standard base64 such as \"aGVsbG8=\"", .{});
+            return error.InvalidYamlFormat;
+        };
+        return allocator.realloc(buffer, len);
+    }
+
+    /// Expand environment references in a file path and resolve it against the config directory
+    fn parseYamlPath(ctx: *const ParseContext, text: []const u8) ![]const u8 {
+        const expanded = try ctx.expand(text);
+        defer ctx.allocator.free(expanded);
+        return ctx.resolvePath(expanded);
+    }
+
+    /// Parse a list of scalars (or a single scalar) into an owned string list,
+    /// copying `fallback` when the key is absent
+    fn parseYamlStringList(ctx: *const ParseContext, maybe_value: anytype, fallback: []const []const u8) ![]const []const u8 {
+        const allocator = ctx.allocator;
+        var list = std.ArrayList([]const u8).init(allocator);
+        errdefer {
+            for (list.items) |item| allocator.free(item);
+            list.deinit();
+        }
+
+        const value = maybe_value orelse {
+            for (fallback) |item| {
+                try list.append(try allocator.dupe(u8, item));
+            }
+            return list.toOwnedSlice();
+        };
+
+        switch (value) {
+            .list => |items| for (items) |item| {
+                const owned = try yamlScalarToString(ctx, item) orelse continue;
+                errdefer allocator.free(owned);
+                try list.append(owned);
+            },
+            .empty => {},
+            else => if (try yamlScalarToString(ctx, value)) |owned| {
+                errdefer allocator.free(owned);
+                try list.append(owned);
+            },
+        }
+        return list.toOwnedSlice();
+    }
+
+    /// Parse a map of scalar values into an owned string map. Numbers and
+    /// booleans are kept in their textual form so `page: 2` works unquoted.
+    fn parseYamlStringMap(ctx: *const ParseContext, yaml_map: anytype) !std.StringHashMap([]const u8) {
+        const allocator = ctx.allocator;
+        var map = std.StringHashMap([]const u8).init(allocator);
+        errdefer deinitStringMap(allocator, &map);
+
+        var map_iter = yaml_map.iterator();
+        while (map_iter.next()) |entry| {
+            const key: []const u8 = entry.key_ptr.*;
+            const value = entry.value_ptr.*;
+
+            // Skip nested lists and maps
+            const owned_value = try yamlScalarToString(ctx, value) orelse continue;
+            errdefer allocator.free(owned_value);
+            const owned_key = try allocator.dupe(u8, key);
+            errdefer allocator.free(owned_key);
+            try map.put(owned_key, owned_value);
+        }
+
+        return map;
+    }
+
+    /// Parse a duration field, logging the offending value when it is invalid
+    fn parseYamlDuration(value: anytype, field_name: []const u8) !u64 {
+        switch (value) {
+            .int => |i| {
+                if (i < 0) {
+                    std.log.err("Invalid {s}: {d} (must not be negative)", .{ field_name, i });
+                    return error.InvalidDuration;
+                }
+                return @intCast(i);
+            },
+            .string => |s| return parseDurationMs(s) catch |err| {
+                std.log.err("Invalid {s}: '{s}' (expected a duration like \"250ms\" or \"2s\")", .{ field_name, s });
+                return err;
+            },
+            else => {
+                std.log.err("Invalid {s}: expected a duration string", .{field_name});
+                return error.InvalidDuration;
+            },
+        }
+    }
+
+    /// Parse a byte size field, logging the offending value when it is invalid
+    fn parseYamlByteSize(value: anytype, field_name: []const u8) !usize {
+        switch (value) {
+            .int => |i| return std.math.cast(usize, i) orelse {
+                std.log.err("Invalid {s}: {d} (must not be negative)", .{ field_name, i });
+                return error.InvalidByteSize;
+            },
+            .string => |s| return parseByteSize(s) catch |err| {
+                std.log.err("Invalid {s}: '{s}' (expected a size like \"256kb\" or \"1mb\")", .{ field_name, s });
+                return err;
+            },
+            else => {
+                std.log.err("Invalid {s}: expected a size string", .{field_name});
+                return error.InvalidByteSize;
+            },
+        }
+    }
+
+    /// Interpret a YAML scalar as a number, or NaN so validation can report it
+    fn yamlNumber(value: anytype) f64 {
+        return switch (value) {
+            .float => |f| f,
+            .int => |i| @floatFromInt(i),
+            .string => |s| std.fmt.parseFloat(f64, s) catch std.math.nan(f64),
+            else => std.math.nan(f64),
+        };
+    }
+
+    /// Interpret a YAML scalar as a boolean, accepting quoted "true"/"false"
+    fn yamlBool(value: anytype) ?bool {
+        return switch (value) {
+            .boolean => |b| b,
+            .string => |s| if (std.ascii.eqlIgnoreCase(s, "true"))
+                true
+            else if (std.ascii.eqlIgnoreCase(s, "false"))
+                false
+            else
+                null,
+            else => null,
+        };
+    }
+
+    /// Render a YAML scalar as an owned string, or null for non-scalars
+    fn yamlScalarToString(ctx: *const ParseContext, value: anytype) !?[]u8 {
+        const allocator = ctx.allocator;
+        return switch (value) {
+            .string => |s| try ctx.expand(s),
+            .int => |i| try std.fmt.allocPrint(allocator, "{d}", .{i}),
+            .float => |f| try std.fmt.allocPrint(allocator, "{d}", .{f}),
+            .boolean => |b| try allocator.dupe(u8, if (b) "true" else "false"),
+            else => null,
+        };
+    }
+
+};
+
+test "Config.loadFromYaml" {
+    const allocator = std.testing.allocator;
+    
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/health"
+        \\    method: "GET"
+        \\  response:
+        \\    status: 200
+        \\    body: '{"status": "ok"}'
+        \\- request:
+        \\    path: "/api/proxy"
+        \\    method: "GET"
+        \\  proxy:
+        \\    url: "https://httpbin.org/get"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
 
     // We should have parsed 2 rules from the YAML content
     try std.testing.expect(config.rules.items.len == 2);
@@ -567,4 +5631,2547 @@ test "Config.loadFromYaml" {
     try std.testing.expect(!config.rules.items[0].isProxy());
     try std.testing.expect(!config.rules.items[1].isMock());
     try std.testing.expect(config.rules.items[1].isProxy());
-}
\ No newline at end of file
+}
+test "Config.loadFromJson matches the YAML form" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\strict_slash: true
+        \\routes:
+        \\  - request:
+        \\      path: "/api/users"
+        \\      methods: [GET, HEAD]
+        \\      headers:
+        \\        Accept: "application/json"
+        \\    response:
+        \\      status: 201
+        \\      headers:
+        \\        X-Source: "mock"
+        \\      body: '[]'
+        \\      delay: 250ms
+        \\  - request:
+        \\      path: "/api/upstream"
+        \\    proxy:
+        \\      url: "https://api.example.com"
+        \\    priority: 2
+    ;
+    const json_content =
+        \\{
+        \\  "strict_slash": true,
+        \\  "routes": [
+        \\    {
+        \\      "request": {"path": "/api/users", "methods": ["GET", "HEAD"], "headers": {"Accept": "application/json"}},
+        \\      "response": {"status": 201, "headers": {"X-Source": "mock"}, "body": "[]", "delay": "250ms"}
+        \\    },
+        \\    {
+        \\      "request": {"path": "/api/upstream"},
+        \\      "proxy": {"url": "https://api.example.com"},
+        \\      "priority": 2
+        \\    }
+        \\  ]
+        \\}
+    ;
+
+    var from_yaml = try Config.loadFromYaml(allocator, yaml_content);
+    defer from_yaml.deinit();
+    var from_json = try Config.loadFromJson(allocator, json_content);
+    defer from_json.deinit();
+    // JSON given to the YAML loader takes the same path
+    var detected = try Config.loadFromYaml(allocator, json_content);
+    defer detected.deinit();
+
+    for ([_]*const Config{ &from_json, &detected }) |config| {
+        try std.testing.expectEqual(from_yaml.strict_slash, config.strict_slash);
+        try std.testing.expectEqual(from_yaml.rules.items.len, config.rules.items.len);
+        for (from_yaml.rules.items, config.rules.items) |expected, actual| {
+            try std.testing.expectEqualStrings(expected.request.path, actual.request.path);
+            try std.testing.expectEqual(expected.request.methods.len, actual.request.methods.len);
+            for (expected.request.methods, actual.request.methods) |expected_method, actual_method| {
+                try std.testing.expectEqualStrings(expected_method, actual_method);
+            }
+            try std.testing.expectEqual(expected.priority, actual.priority);
+            try std.testing.expectEqual(expected.response == null, actual.response == null);
+            if (expected.response) |response| {
+                try std.testing.expectEqual(response.status, actual.response.?.status);
+                try std.testing.expectEqualStrings(response.body, actual.response.?.body);
+                try std.testing.expectEqual(response.delay_ms, actual.response.?.delay_ms);
+                try std.testing.expectEqualStrings(response.headers.?.get("X-Source").?, actual.response.?.headers.?.get("X-Source").?);
+                try std.testing.expectEqualStrings(expected.request.headers.?.get("Accept").?, actual.request.headers.?.get("Accept").?);
+            }
+            try std.testing.expectEqual(expected.proxy == null, actual.proxy == null);
+            if (expected.proxy) |proxy| {
+                try std.testing.expectEqualStrings(proxy.url, actual.proxy.?.url);
+            }
+        }
+    }
+    try std.testing.expectEqual(@as(u64, 250), from_json.rules.items[0].response.?.delay_ms);
+}
+
+test "Config.loadFromYaml routes key" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\routes:
+        \\  - request:
+        \\      path: "/api/users"
+        \\      method: "GET"
+        \\    response:
+        \\      body: '[]'
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    try std.testing.expectEqual(@as(usize, 1), config.rules.items.len);
+    try std.testing.expectEqualStrings("/api/users", config.rules.items[0].request.path);
+}
+
+test "Config.loadFromYaml empty routes" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYaml(allocator, "routes: []");
+    defer config.deinit();
+
+    try std.testing.expectEqual(@as(usize, 0), config.rules.items.len);
+}
+
+test "Config.loadFromYaml legacy single rule" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\request:
+        \\  path: "/readme"
+        \\  verb: get
+        \\response:
+        \\  body: "hello"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    try std.testing.expectEqual(@as(usize, 1), config.rules.items.len);
+    try std.testing.expect(config.rules.items[0].isMock());
+}
+
+test "Config.loadFromYaml request query" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/users"
+        \\    method: "GET"
+        \\    query:
+        \\      active: "true"
+        \\      page: 2
+        \\  response:
+        \\    body: '[]'
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const query = config.rules.items[0].request.query.?;
+    try std.testing.expectEqualStrings("true", query.get("active").?);
+    try std.testing.expectEqualStrings("2", query.get("page").?);
+}
+
+test "Config.loadFromYaml response headers" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/users"
+        \\    method: "GET"
+        \\  response:
+        \\    body: '[]'
+        \\    headers:
+        \\      Content-Type: "application/json"
+        \\      X-Request-Id: "abc123"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const headers = config.rules.items[0].response.?.headers.?;
+    try std.testing.expectEqual(@as(u32, 2), headers.count());
+    try std.testing.expectEqualStrings("application/json", headers.get("Content-Type").?);
+    try std.testing.expectEqualStrings("abc123", headers.get("X-Request-Id").?);
+}
+
+test "Config.loadFromYamlWithBase body_file" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/users"
+        \\    method: "GET"
+        \\  response:
+        \\    body_file: "fixtures/users.json"
+    ;
+
+    var config = try Config.loadFromYamlWithBase(allocator, yaml_content, "mocks");
+    defer config.deinit();
+
+    const expected = try std.fs.path.join(allocator, &.{ "mocks", "fixtures", "users.json" });
+    defer allocator.free(expected);
+    try std.testing.expectEqualStrings(expected, config.rules.items[0].response.?.body_file.?);
+}
+
+test "Config.validate checks body_template_file syntax" {
+    const allocator = std.testing.allocator;
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    try tmp.dir.writeFile(.{ .sub_path = "user.json.tmpl", .data = "{\"id\": \"{{.Params.id}}\"}" });
+    try tmp.dir.writeFile(.{ .sub_path = "broken.tmpl", .data = "{\"id\": \"{{.Params.id\"}" });
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/users/:id"
+        \\    method: "GET"
+        \\  response:
+        \\    body_template_file: "user.json.tmpl"
+        \\- request:
+        \\    path: "/broken"
+        \\    method: "GET"
+        \\  response:
+        \\    body_template_file: "broken.tmpl"
+    ;
+
+    var config = try Config.loadFromYamlWithBase(allocator, yaml_content, dir_path);
+    defer config.deinit();
+
+    const response = config.rules.items[0].response.?;
+    try std.testing.expect(response.isTemplated());
+    try std.testing.expect(std.mem.endsWith(u8, response.body_file.?, "user.json.tmpl"));
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    const broken_path = config.rules.items[1].response.?.body_file.?;
+    const expected = try std.fmt.allocPrint(allocator, "rule 2 (/broken): template {s}: unclosed action at offset 8", .{broken_path});
+    defer allocator.free(expected);
+    try std.testing.expectEqualStrings(expected, errors.messages.items[0]);
+}
+
+test "Config.validate checks static bodies against body_schema" {
+    const allocator = std.testing.allocator;
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    try tmp.dir.writeFile(.{
+        .sub_path = "user.json",
+        .data = "{\"type\": \"object\", \"required\": [\"id\"], \"properties\": {\"id\": {\"type\": \"integer\"}}}",
+    });
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/users/1"
+        \\    method: "GET"
+        \\  response:
+        \\    body: '{"id": 1}'
+        \\    body_schema: "user.json"
+        \\- request:
+        \\    path: "/users/2"
+        \\    method: "GET"
+        \\  response:
+        \\    body: '{"id": "2"}'
+        \\    body_schema: "user.json"
+        \\- request:
+        \\    path: "/users/:id"
+        \\    method: "GET"
+        \\  response:
+        \\    body: '{"id": "{{.Params.id}}"}'
+        \\    body_schema: "user.json"
+    ;
+
+    var config = try Config.loadFromYamlWithBase(allocator, yaml_content, dir_path);
+    defer config.deinit();
+
+    const schema_path = try std.fs.path.join(allocator, &.{ dir_path, "user.json" });
+    defer allocator.free(schema_path);
+    try std.testing.expectEqualStrings(schema_path, config.rules.items[0].response.?.body_schema.?);
+
+    // The templated body is only checked once it has been rendered
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+
+    const expected = try std.fmt.allocPrint(allocator, "rule 2 (/users/2): body does not match {s}: $.id: expected integer, got string", .{schema_path});
+    defer allocator.free(expected);
+    try std.testing.expectEqualStrings(expected, errors.messages.items[0]);
+}
+
+test "parseByteSize" {
+    try std.testing.expectEqual(@as(usize, 512), try parseByteSize("512"));
+    try std.testing.expectEqual(@as(usize, 512), try parseByteSize("512b"));
+    try std.testing.expectEqual(@as(usize, 256 * 1024), try parseByteSize("256kb"));
+    try std.testing.expectEqual(@as(usize, 1024 * 1024), try parseByteSize("1MB"));
+    try std.testing.expectEqual(@as(usize, 1536), try parseByteSize("1.5 kb"));
+    try std.testing.expectEqual(@as(usize, 2 * 1024 * 1024 * 1024), try parseByteSize("2gb"));
+
+    try std.testing.expectError(error.InvalidByteSize, parseByteSize(""));
+    try std.testing.expectError(error.InvalidByteSize, parseByteSize("mb"));
+    try std.testing.expectError(error.InvalidByteSize, parseByteSize("1tb"));
+    try std.testing.expectError(error.InvalidByteSize, parseByteSize("-1kb"));
+}
+
+test "parseDurationMs" {
+    try std.testing.expectEqual(@as(u64, 250), try parseDurationMs("250ms"));
+    try std.testing.expectEqual(@as(u64, 2000), try parseDurationMs("2s"));
+    try std.testing.expectEqual(@as(u64, 1500), try parseDurationMs("1.5s"));
+    try std.testing.expectEqual(@as(u64, 90_000), try parseDurationMs("1m30s"));
+    try std.testing.expectEqual(@as(u64, 100), try parseDurationMs("100"));
+
+    try std.testing.expectError(error.InvalidDuration, parseDurationMs(""));
+    try std.testing.expectError(error.InvalidDuration, parseDurationMs("fast"));
+    try std.testing.expectError(error.InvalidDuration, parseDurationMs("10parsecs"));
+}
+
+test "Config.loadFromYaml response delay" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/slow"
+        \\    method: "GET"
+        \\  response:
+        \\    delay: "250ms"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    try std.testing.expectEqual(@as(u64, 250), config.rules.items[0].response.?.delay_ms);
+}
+
+test "Config.validate reports every problem" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/ok"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "fine"
+        \\- request:
+        \\    path: "users"
+        \\    method: "FETCH"
+        \\  response:
+        \\    status: 700
+        \\- request:
+        \\    path: "/nothing"
+        \\    method: "POST"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+
+    const expected = [_][]const u8{
+        "rule 2 (users): unknown HTTP method 'FETCH'",
+        "rule 2 (users): path must start with '/'",
+        "rule 2 (users): status 700 is outside 100-599",
+        "rule 3 (/nothing): needs a response or a proxy",
+    };
+    try std.testing.expectEqual(expected.len, errors.messages.items.len);
+    for (expected, errors.messages.items) |want, got| {
+        try std.testing.expectEqualStrings(want, got);
+    }
+}
+
+test "Config.loadFromYaml response fault" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/flaky"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "ok"
+        \\    fault:
+        \\      probability: 0.25
+        \\      status: 502
+        \\      delay: "100ms"
+        \\- request:
+        \\    path: "/broken"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "ok"
+        \\    fault:
+        \\      probability: "often"
+        \\      status: 700
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const fault = config.rules.items[0].response.?.fault.?;
+    try std.testing.expectEqual(@as(f64, 0.25), fault.probability);
+    try std.testing.expectEqual(@as(u16, 502), fault.status);
+    try std.testing.expectEqual(@as(u64, 100), fault.delay_ms);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 2), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/broken): fault probability must be between 0.0 and 1.0", errors.messages.items[0]);
+    try std.testing.expectEqualStrings("rule 2 (/broken): fault status 700 is outside 100-599", errors.messages.items[1]);
+}
+
+test "Config.loadFromYaml response sequence" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/flaky"
+        \\    method: "GET"
+        \\  cycle: true
+        \\  response:
+        \\    - status: 503
+        \\    - status: 200
+        \\      body: "ok"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    var prng = std.Random.DefaultPrng.init(0);
+    const rule = &config.rules.items[0];
+    try std.testing.expect(rule.isMock());
+    try std.testing.expectEqual(@as(u16, 503), rule.nextResponse(prng.random(), 0).?.status);
+    try std.testing.expectEqual(@as(u16, 200), rule.nextResponse(prng.random(), 0).?.status);
+    try std.testing.expectEqual(@as(u16, 503), rule.nextResponse(prng.random(), 0).?.status);
+}
+
+test "Config.loadFromYaml weighted responses" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/users"
+        \\    method: "GET"
+        \\  responses:
+        \\    - weight: 3
+        \\      body: "common"
+        \\    - weight: 0
+        \\      body: "disabled"
+        \\    - body: "rare"
+        \\- request:
+        \\    path: "/broken"
+        \\    method: "GET"
+        \\  responses:
+        \\    - weight: "lots"
+        \\    - weight: 0
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const rule = &config.rules.items[0];
+    try std.testing.expect(rule.isMock());
+    try std.testing.expectEqual(@as(f64, 1), rule.weighted.?.responses[2].weight);
+    try std.testing.expectEqual(@as(f64, 4), rule.weighted.?.totalWeight());
+
+    var prng = std.Random.DefaultPrng.init(7);
+    var common: usize = 0;
+    for (0..400) |_| {
+        const body = rule.nextResponse(prng.random(), 0).?.body;
+        try std.testing.expect(!std.mem.eql(u8, body, "disabled"));
+        if (std.mem.eql(u8, body, "common")) common += 1;
+    }
+    // Three quarters of the picks, give or take
+    try std.testing.expect(common > 250 and common < 350);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+
+    try std.testing.expectEqual(@as(usize, 2), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/broken): response 1 weight must be a non-negative number", errors.messages.items[0]);
+    try std.testing.expectEqualStrings("rule 2 (/broken): responses need at least one positive weight", errors.messages.items[1]);
+}
+
+test "Config.loadFromYaml proxy upstreams" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/*"
+        \\    method: "GET"
+        \\  proxy:
+        \\    upstreams:
+        \\      - url: "http://stable.internal"
+        \\        weight: 9
+        \\      - url: "http://canary.internal"
+        \\        timeout: 500ms
+        \\- request:
+        \\    path: "/both"
+        \\    method: "GET"
+        \\  proxy:
+        \\    url: "http://stable.internal"
+        \\    upstreams:
+        \\      - url: "http://canary.internal"
+        \\        weight: -1
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const proxy = &config.rules.items[0].proxy.?;
+    try std.testing.expectEqualStrings("", proxy.url);
+    try std.testing.expectEqual(@as(usize, 2), proxy.upstreams.?.len);
+    try std.testing.expectEqual(@as(f64, 1), proxy.upstreams.?[1].weight);
+    try std.testing.expectEqual(@as(?u64, 500), proxy.upstreams.?[1].timeout_ms);
+
+    var prng = std.Random.DefaultPrng.init(3);
+    var canary: usize = 0;
+    for (0..400) |_| {
+        if (std.mem.eql(u8, proxy.pickUpstream(prng.random(), &.{}).?.url, "http://canary.internal")) canary += 1;
+    }
+    // A tenth of the picks, give or take
+    try std.testing.expect(canary > 20 and canary < 70);
+
+    // Failing over draws from the upstreams not yet tried, until none are left
+    const first = proxy.pickUpstream(prng.random(), &.{}).?;
+    const second = proxy.pickUpstream(prng.random(), &.{first}).?;
+    try std.testing.expect(first != second);
+    try std.testing.expect(proxy.pickUpstream(prng.random(), &.{ first, second }) == null);
+
+    // Zero weights are never drawn, not even to cover rounding
+    var weighted = [_]ProxyUpstream{ .{ .url = "http://off.internal", .weight = 0 }, .{ .url = "http://on.internal" }, .{ .url = "http://drained.internal", .weight = 0 } };
+    const partial = ProxyConfig{ .url = "", .upstreams = &weighted };
+    for (0..50) |_| {
+        try std.testing.expectEqualStrings("http://on.internal", partial.pickUpstream(prng.random(), &.{}).?.url);
+    }
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 3), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/both): set either proxy url or upstreams, not both", errors.messages.items[0]);
+    try std.testing.expectEqualStrings("rule 2 (/both): upstream 1 weight must be a non-negative number", errors.messages.items[1]);
+    try std.testing.expectEqualStrings("rule 2 (/both): proxy upstreams need at least one positive weight", errors.messages.items[2]);
+}
+
+test "Config.loadFromYaml response schedule" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/flaky"
+        \\  schedule:
+        \\    - duration: "1m"
+        \\      response:
+        \\        body: "up"
+        \\    - duration: "30s"
+        \\      response:
+        \\        status: 503
+        \\- request:
+        \\    path: "/broken"
+        \\  response:
+        \\    body: "both"
+        \\  schedule:
+        \\    - duration: 0
+        \\      response:
+        \\        body: "never"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    var prng = std.Random.DefaultPrng.init(0);
+    const rule = &config.rules.items[0];
+    try std.testing.expect(rule.isMock());
+    try std.testing.expectEqual(@as(u64, 90_000), rule.schedule.?.totalMs());
+    try std.testing.expectEqual(@as(u16, 200), rule.nextResponse(prng.random(), 59_999).?.status);
+    try std.testing.expectEqual(@as(u16, 503), rule.nextResponse(prng.random(), 60_000).?.status);
+    try std.testing.expectEqual(@as(u16, 200), rule.nextResponse(prng.random(), 90_000).?.status);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 2), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/broken): set either schedule or response/responses, not both", errors.messages.items[0]);
+    try std.testing.expectEqualStrings("rule 2 (/broken): schedule phase 1 needs a duration above zero", errors.messages.items[1]);
+}
+
+test "Config.loadFromFile locates validation errors" {
+    const allocator = std.testing.allocator;
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    try tmp.dir.writeFile(.{ .sub_path = "mocks.yaml", .data =
+        \\# Users API
+        \\cors:
+        \\  allowed_origins:
+        \\    - "*"
+        \\routes:
+        \\  - request:
+        \\      path: "/api/users"
+        \\      methods:
+        \\        - get
+        \\    response:
+        \\      body: "[]"
+        \\
+        \\  - request:
+        \\      path: "api/broken"
+        \\      method: get
+        \\    response:
+        \\      status: 700
+        \\
+    });
+    const file_path = try tmp.dir.realpathAlloc(allocator, "mocks.yaml");
+    defer allocator.free(file_path);
+
+    var config = try Config.loadFromFile(allocator, file_path);
+    defer config.deinit();
+    try std.testing.expectEqual(@as(?usize, 6), config.rules.items[0].line);
+    try std.testing.expectEqual(@as(?usize, 13), config.rules.items[1].line);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 2), errors.messages.items.len);
+    for (errors.rules.items) |rule_index| {
+        try std.testing.expectEqual(@as(?usize, 1), rule_index);
+    }
+
+    // Each message points at the line that set the offending value
+    try std.testing.expectEqualStrings("request.path", errors.fields.items[0].?);
+    try std.testing.expectEqual(@as(?usize, 14), try config.locate(allocator, 1, errors.fields.items[0]));
+    try std.testing.expectEqualStrings("response.status", errors.fields.items[1].?);
+    try std.testing.expectEqual(@as(?usize, 17), try config.locate(allocator, 1, errors.fields.items[1]));
+    try std.testing.expectEqual(@as(?usize, 8), try config.locate(allocator, 0, "request.method|methods"));
+    try std.testing.expectEqual(@as(?usize, 10), try config.locate(allocator, 0, "response.fault.status"));
+
+    // A file laid out so the scan can't find every rule gets no lines at all
+    try std.testing.expect((try Config.ruleLines(allocator, "- request: {path: /a}\n", 2)) == null);
+}
+
+test "Config.validate checks status templates" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/status/:code"
+        \\    method: "GET"
+        \\  response:
+        \\    status: "{{.Params.code}}"
+        \\- request:
+        \\    path: "/broken"
+        \\    method: "GET"
+        \\  response:
+        \\    status: "{{.Params.code"
+        \\- request:
+        \\    path: "/created"
+        \\    method: "POST"
+        \\  response:
+        \\    status: "201"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    try std.testing.expectEqualStrings("{{.Params.code}}", config.rules.items[0].response.?.status_template.?);
+    try std.testing.expect(config.rules.items[2].response.?.status_template == null);
+    try std.testing.expectEqual(@as(u16, 201), config.rules.items[2].response.?.status);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    try std.testing.expect(std.mem.startsWith(u8, errors.messages.items[0], "rule 2 (/broken): status template: "));
+}
+
+test "Config.validate checks response cookies" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/login"
+        \\    method: "POST"
+        \\  response:
+        \\    cookies:
+        \\      - name: session
+        \\        value: "{{uuid}}"
+        \\        same_site: none
+        \\        secure: true
+        \\      - name: "bad name"
+        \\        value: x
+        \\      - name: tracker
+        \\        value: x
+        \\        same_site: none
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+    const cookies = config.rules.items[0].response.?.cookies.?;
+    try std.testing.expectEqual(@as(usize, 3), cookies.len);
+    try std.testing.expectEqual(interfaces.SetCookie.SameSite.none, cookies[0].same_site.?);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 2), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 1 (/login): cookie 'bad name': name must be a token without spaces or separators such as '=' and ';'", errors.messages.items[0]);
+    try std.testing.expectEqualStrings("rule 1 (/login): cookie 'tracker': same_site: none needs secure: true, or browsers drop the cookie", errors.messages.items[1]);
+}
+
+test "Config.validate checks redirects" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/old"
+        \\  response:
+        \\    redirect:
+        \\      url: "/new"
+        \\      status: 308
+        \\- request:
+        \\    path: "/ok"
+        \\  response:
+        \\    redirect:
+        \\      url: "/new"
+        \\      status: 200
+        \\- request:
+        \\    path: "/next"
+        \\  response:
+        \\    redirect:
+        \\      url: "{{.Query.next"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+    const moved = config.rules.items[0].response.?;
+    try std.testing.expectEqual(@as(u16, 308), moved.status);
+    try std.testing.expectEqualStrings("/new", moved.redirect.?.url);
+    try std.testing.expectEqual(@as(u16, 302), config.rules.items[2].response.?.status);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 2), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/ok): redirect status 200 is not a 3xx status", errors.messages.items[0]);
+    try std.testing.expect(std.mem.startsWith(u8, errors.messages.items[1], "rule 3 (/next): redirect url template: "));
+}
+
+test "Config.validate checks header templates" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/echo"
+        \\  response:
+        \\    headers:
+        \\      X-Static: "fixed"
+        \\      X-Echo-Id: "{{.Headers.X-Request-Id}}"
+        \\- request:
+        \\    path: "/broken"
+        \\  response:
+        \\    headers:
+        \\      X-Broken: "{{.Headers.X-Request-Id"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    try std.testing.expect(std.mem.startsWith(u8, errors.messages.items[0], "rule 2 (/broken): header 'X-Broken' template: "));
+}
+
+test "Config.validate checks trailers" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/grpc"
+        \\  response:
+        \\    trailers:
+        \\      Grpc-Status: "0"
+        \\      X-Echo-Id: "{{.Headers.X-Request-Id}}"
+        \\- request:
+        \\    path: "/length"
+        \\  response:
+        \\    trailers:
+        \\      Content-Length: "5"
+        \\- request:
+        \\    path: "/broken"
+        \\  response:
+        \\    trailers:
+        \\      X-Broken: "{{.Headers.X-Request-Id"
+        \\- request:
+        \\    path: "/cut"
+        \\  response:
+        \\    truncate: 2
+        \\    trailers:
+        \\      Grpc-Status: "0"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+    try std.testing.expectEqualStrings("0", config.rules.items[0].response.?.trailers.?.get("Grpc-Status").?);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 3), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/length): Content-Length can't be sent as a trailer", errors.messages.items[0]);
+    try std.testing.expect(std.mem.startsWith(u8, errors.messages.items[1], "rule 3 (/broken): trailer 'X-Broken' template: "));
+    try std.testing.expectEqualStrings("rule 4 (/cut): trailers can't be sent with truncate or connection_reset", errors.messages.items[2]);
+}
+
+test "Config response presets" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\not_found:
+        \\  preset: json_list
+        \\routes:
+        \\  - request:
+        \\      path: "/ok"
+        \\    response:
+        \\      preset: json_ok
+        \\  - request:
+        \\      path: "/gone"
+        \\    response:
+        \\      preset: no_content
+        \\  - request:
+        \\      path: "/busy"
+        \\    response:
+        \\      preset: unavailable
+        \\      status: 502
+        \\      body: '{"retry": true}'
+        \\      delay: "10ms"
+        \\      headers:
+        \\        content-type: "application/problem+json"
+        \\        X-Upstream: "billing"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const ok = config.rules.items[0].response.?;
+    try std.testing.expectEqual(@as(u16, 200), ok.status);
+    try std.testing.expectEqualStrings("{\"ok\":true}", ok.body);
+    try std.testing.expectEqualStrings("application/json", ok.headers.?.get("Content-Type").?);
+
+    const gone = config.rules.items[1].response.?;
+    try std.testing.expectEqual(@as(u16, 204), gone.status);
+    try std.testing.expectEqualStrings("", gone.body);
+    try std.testing.expect(gone.headers == null);
+
+    // Explicit fields win, and the preset's other headers are kept
+    const busy = config.rules.items[2].response.?;
+    try std.testing.expectEqual(@as(u16, 502), busy.status);
+    try std.testing.expectEqualStrings("{\"retry\": true}", busy.body);
+    try std.testing.expectEqual(@as(u64, 10), busy.delay_ms);
+    try std.testing.expectEqual(@as(u32, 3), busy.headers.?.count());
+    try std.testing.expectEqualStrings("application/problem+json", busy.headers.?.get("content-type").?);
+    try std.testing.expectEqualStrings("1", busy.headers.?.get("Retry-After").?);
+
+    // The preset's status beats not_found's default of 404
+    try std.testing.expectEqual(@as(u16, 200), config.not_found.?.status);
+    try std.testing.expectEqualStrings("[]", config.not_found.?.body);
+}
+
+test "Config.validate checks content_length" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/misframed"
+        \\  response:
+        \\    body: "hello"
+        \\    content_length: 20
+        \\- request:
+        \\    path: "/events"
+        \\  response:
+        \\    stream:
+        \\      - data: "data: 1"
+        \\    content_length: 3
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+    try std.testing.expectEqual(@as(?u64, 20), config.rules.items[0].response.?.content_length);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/events): content_length only applies to a body, not a stream or websocket", errors.messages.items[0]);
+}
+
+test "Config.validate checks repeat and truncate" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/large"
+        \\  response:
+        \\    body: "ab"
+        \\    repeat: 1000
+        \\    truncate: 10
+        \\- request:
+        \\    path: "/none"
+        \\  response:
+        \\    body: "ab"
+        \\    repeat: 0
+        \\- request:
+        \\    path: "/events"
+        \\  response:
+        \\    stream:
+        \\      - data: "data: 1"
+        \\    truncate: 3
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+    try std.testing.expectEqual(@as(u32, 1000), config.rules.items[0].response.?.repeat);
+    try std.testing.expectEqual(@as(?u64, 10), config.rules.items[0].response.?.truncate);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 2), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/none): repeat must be a whole number of at least 1", errors.messages.items[0]);
+    try std.testing.expectEqualStrings("rule 3 (/events): repeat and truncate only apply to a body, not a stream or websocket", errors.messages.items[1]);
+}
+
+test "Config.validate checks variants" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/users"
+        \\  response:
+        \\    variants:
+        \\      - content_type: "application/json; charset=utf-8"
+        \\        body: "[]"
+        \\      - content_type: "text/csv"
+        \\- request:
+        \\    path: "/none"
+        \\  response:
+        \\    variants: []
+        \\- request:
+        \\    path: "/wild"
+        \\  response:
+        \\    variants:
+        \\      - content_type: "text/*"
+        \\        body: "anything"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+    const variants = config.rules.items[0].response.?.variants.?;
+    try std.testing.expectEqual(@as(usize, 2), variants.len);
+    try std.testing.expectEqualStrings("", variants[1].body);
+    try std.testing.expectEqual(VariantFallback.first, config.rules.items[0].response.?.variant_fallback);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 2), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/none): variants needs at least one entry", errors.messages.items[0]);
+    try std.testing.expectEqualStrings("rule 3 (/wild): variant content_type must be a media type like application/json", errors.messages.items[1]);
+}
+
+test "Config.validate checks faker shapes" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/users/1"
+        \\  response:
+        \\    faker: '{"name": "{{name}}", "age": "{{int:18:65}}"}'
+        \\    faker_seed: 7
+        \\- request:
+        \\    path: "/users/2"
+        \\  response:
+        \\    faker: '{"name": "{{nickname}}"}'
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+    try std.testing.expectEqual(@as(?u64, 7), config.rules.items[0].response.?.faker_seed);
+    try std.testing.expect(config.rules.items[0].response.?.hasDynamicBody());
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/users/2): faker: unknown or malformed hint '{{nickname}}'", errors.messages.items[0]);
+}
+
+test "Config.validate checks content_type" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/login"
+        \\    method: "POST"
+        \\    content_type: "application/json; charset=utf-8"
+        \\  response:
+        \\    body: "ok"
+        \\- request:
+        \\    path: "/api/upload"
+        \\    method: "POST"
+        \\    content_type: "json"
+        \\  response:
+        \\    body: "ok"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+    try std.testing.expectEqualStrings("application/json; charset=utf-8", config.rules.items[0].request.content_type.?);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/api/upload): content_type 'json' is not a media type like application/json", errors.messages.items[0]);
+}
+
+test "Config.validate checks proto" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/legacy"
+        \\    method: "GET"
+        \\    proto: 1.0
+        \\  response:
+        \\    body: "1.0"
+        \\- request:
+        \\    path: "/legacy"
+        \\    method: "GET"
+        \\    proto: "HTTP/1.1"
+        \\  response:
+        \\    body: "1.1"
+        \\- request:
+        \\    path: "/h2"
+        \\    method: "GET"
+        \\    proto: 2
+        \\  response:
+        \\    body: "2"
+        \\- request:
+        \\    path: "/h3"
+        \\    method: "GET"
+        \\    proto: "h3"
+        \\  response:
+        \\    body: "3"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+    try std.testing.expectEqualStrings("1.0", config.rules.items[0].request.proto.?);
+    try std.testing.expectEqual(@as(?Protocol, .http_1_0), config.rules.items[0].request.proto_version);
+    try std.testing.expectEqual(@as(?Protocol, .http_1_1), config.rules.items[1].request.proto_version);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 2), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 3 (/h2): proto '2' is not 1.0 or 1.1, the HTTP versions the server speaks", errors.messages.items[0]);
+    try std.testing.expectEqualStrings("rule 4 (/h3): proto 'h3' is not 1.0 or 1.1, the HTTP versions the server speaks", errors.messages.items[1]);
+}
+
+test "Config.loadFromYaml body_size" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYaml(allocator,
+        \\- request:
+        \\    path: "/upload"
+        \\    method: post
+        \\    body_size: 0
+        \\  response:
+        \\    status: 400
+        \\- request:
+        \\    path: "/upload"
+        \\    method: post
+        \\    body_size:
+        \\      min: 1
+        \\      max: 1kb
+        \\  response:
+        \\    status: 201
+        \\- request:
+        \\    path: "/upload"
+        \\    method: post
+        \\    body_size:
+        \\      min: "2kb"
+        \\      max: 1kb
+        \\  response:
+        \\    status: 413
+    );
+    defer config.deinit();
+
+    const empty = config.rules.items[0].request.body_size.?;
+    try std.testing.expectEqual(@as(usize, 0), empty.min);
+    try std.testing.expectEqual(@as(?usize, 0), empty.max);
+    const small = config.rules.items[1].request.body_size.?;
+    try std.testing.expectEqual(@as(usize, 1), small.min);
+    try std.testing.expectEqual(@as(?usize, 1024), small.max);
+    try std.testing.expect(small.contains(1024) and !small.contains(1025) and !small.contains(0));
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqualStrings("rule 3 (/upload): body_size min of 2048 bytes is above its max of 1024", errors.messages.items[0]);
+}
+
+test "Config.loadFromYaml headers_absent" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYaml(allocator,
+        \\- request:
+        \\    path: "/api/orders"
+        \\    headers_absent: [Authorization]
+        \\  response:
+        \\    status: 401
+        \\- request:
+        \\    path: "/api/orders"
+        \\    headers_absent: "X-Debug"
+        \\  response:
+        \\    status: 200
+        \\- request:
+        \\    path: "/api/cart"
+        \\    headers:
+        \\      Authorization: "Bearer abc"
+        \\    headers_absent: [authorization]
+        \\  response:
+        \\    status: 200
+    );
+    defer config.deinit();
+    try std.testing.expectEqualStrings("Authorization", config.rules.items[0].request.headers_absent.?[0]);
+    try std.testing.expectEqualStrings("X-Debug", config.rules.items[1].request.headers_absent.?[0]);
+
+    // Absent headers are constraints, so the two orders rules aren't duplicates
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 3 (/api/cart): header 'authorization' is both required and absent, so the rule never matches", errors.messages.items[0]);
+}
+
+test "Config.validate checks client_ip" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\trust_proxy: true
+        \\routes:
+        \\  - request:
+        \\      path: "/admin"
+        \\      method: "GET"
+        \\      client_ip: "192.168.0.0/16"
+        \\    response:
+        \\      body: "ok"
+        \\  - request:
+        \\      path: "/ops"
+        \\      method: "GET"
+        \\      client_ip: "192.168.0.0/40"
+        \\    response:
+        \\      body: "ok"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+    try std.testing.expect(config.trust_proxy);
+    try std.testing.expectEqual(@as(u8, 16), config.rules.items[0].request.client_range.?.prefix_len);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/ops): client_ip '192.168.0.0/40' is not an IP address or CIDR block like 10.0.0.0/8", errors.messages.items[0]);
+}
+
+test "Config.validate checks auth" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/admin"
+        \\    method: "GET"
+        \\    auth:
+        \\      username: "admin"
+        \\      password: "pw"
+        \\  response:
+        \\    body: "ok"
+        \\- request:
+        \\    path: "/api/ops"
+        \\    method: "GET"
+        \\    auth:
+        \\      username: "ops:team"
+        \\  response:
+        \\    body: "ok"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const auth = config.rules.items[0].request.auth.?;
+    try std.testing.expectEqualStrings("admin", auth.username);
+    try std.testing.expectEqualStrings("pw", auth.password);
+    try std.testing.expect(auth.realm == null);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+
+    const expected = [_][]const u8{
+        "rule 2 (/api/ops): auth username can't contain ':'",
+        "rule 2 (/api/ops): auth needs a password",
+    };
+    try std.testing.expectEqual(expected.len, errors.messages.items.len);
+    for (expected, errors.messages.items) |want, got| {
+        try std.testing.expectEqualStrings(want, got);
+    }
+}
+
+test "Config.validate checks rate_limit" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/search"
+        \\    method: "GET"
+        \\    rate_limit:
+        \\      requests: 10
+        \\      per: 1s
+        \\  response:
+        \\    body: "[]"
+        \\- request:
+        \\    path: "/api/slow"
+        \\    method: "GET"
+        \\    rate_limit:
+        \\      requests: many
+        \\  response:
+        \\    body: "[]"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const limiter = config.rules.items[0].request.rate_limit.?;
+    try std.testing.expectEqual(@as(u32, 10), limiter.requests);
+    try std.testing.expectEqual(@as(u64, 1000), limiter.per_ms);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+
+    const expected = [_][]const u8{
+        "rule 2 (/api/slow): rate_limit needs requests of at least 1",
+        "rule 2 (/api/slow): rate_limit needs a per duration above zero",
+    };
+    try std.testing.expectEqual(expected.len, errors.messages.items.len);
+    for (expected, errors.messages.items) |want, got| {
+        try std.testing.expectEqualStrings(want, got);
+    }
+}
+
+test "Config.validate checks quota" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/convert"
+        \\  response:
+        \\    quota:
+        \\      limit: 100
+        \\      window: 1h
+        \\      response:
+        \\        preset: rate_limited
+        \\- request:
+        \\    path: "/api/none"
+        \\  response:
+        \\    quota:
+        \\      window: 0s
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const quota = config.rules.items[0].response.?.quota.?;
+    try std.testing.expectEqual(@as(u64, 100), quota.counter.limit);
+    try std.testing.expectEqual(@as(?u64, 3_600_000), quota.counter.window_ms);
+    try std.testing.expectEqual(@as(u16, 429), quota.exceeded.?.status);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/api/none): quota limit must be at least 1", errors.messages.items[0]);
+}
+
+test "Config.validate checks when conditions" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/search"
+        \\    method: "POST"
+        \\  response:
+        \\    body: "none"
+        \\    when:
+        \\      - condition:
+        \\          body_contains: "needle"
+        \\        body: "found"
+        \\      - body: "no condition"
+        \\      - condition:
+        \\          header: "X-Mode"
+        \\          query: "mode"
+        \\        status: 700
+        \\      - condition:
+        \\          body_contains: "x"
+        \\          equals: "y"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const branches = config.rules.items[0].response.?.when.?;
+    try std.testing.expectEqual(@as(usize, 4), branches.len);
+    try std.testing.expectEqualStrings("needle", branches[0].condition.body_contains.?);
+    try std.testing.expectEqualStrings("found", branches[0].response.body);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+
+    const expected = [_][]const u8{
+        "rule 1 (/api/search): when branch 2 condition needs exactly one of header, query or body_contains",
+        "rule 1 (/api/search): when branch 3 condition needs exactly one of header, query or body_contains",
+        "rule 1 (/api/search): status 700 is outside 100-599",
+        "rule 1 (/api/search): when branch 4 condition can only use equals with header or query",
+    };
+    try std.testing.expectEqual(expected.len, errors.messages.items.len);
+    for (expected, errors.messages.items) |want, got| {
+        try std.testing.expectEqualStrings(want, got);
+    }
+}
+
+test "Config.loadFromYaml cors section" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\cors:
+        \\  allowed_origins:
+        \\    - "https://app.example.com"
+        \\  allowed_methods:
+        \\    - GET
+        \\    - POST
+        \\  allow_credentials: true
+        \\routes:
+        \\  - request:
+        \\      path: "/api/users"
+        \\      method: "GET"
+        \\    response:
+        \\      body: '[]'
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const cors = config.cors.?;
+    try std.testing.expectEqual(@as(usize, 1), config.rules.items.len);
+    try std.testing.expectEqual(@as(usize, 1), cors.allowed_origins.len);
+    try std.testing.expectEqualStrings("https://app.example.com", cors.allowed_origins[0]);
+    try std.testing.expectEqualStrings("POST", cors.allowed_methods[1]);
+    // Unset lists fall back to the defaults
+    try std.testing.expectEqualStrings("Content-Type", cors.allowed_headers[0]);
+    try std.testing.expect(cors.allow_credentials);
+}
+
+test "Config.loadFromYaml proxy timeout" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/slow"
+        \\    method: "GET"
+        \\  proxy:
+        \\    url: "https://example.com/slow"
+        \\    timeout: "1.5s"
+        \\- request:
+        \\    path: "/api/default"
+        \\    method: "GET"
+        \\  proxy:
+        \\    url: "https://example.com/default"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    try std.testing.expectEqual(@as(u64, 1500), config.rules.items[0].proxy.?.timeout_ms);
+    try std.testing.expectEqual(@as(u64, 30000), config.rules.items[1].proxy.?.timeout_ms);
+}
+
+test "Config.loadFromYaml proxy path_rewrite" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/v2/*"
+        \\    method: "GET"
+        \\  proxy:
+        \\    url: "https://example.com"
+        \\    path_rewrite:
+        \\      strip_prefix: "/v2"
+        \\      add_prefix: "/api/v2"
+        \\- request:
+        \\    path_regex: "/files/(.*)"
+        \\    method: "GET"
+        \\  proxy:
+        \\    url: "https://example.com"
+        \\    path_rewrite:
+        \\      regex: "/files/(.*"
+        \\      replacement: "/blobs/$1"
+        \\- request:
+        \\    path: "/empty"
+        \\    method: "GET"
+        \\  proxy:
+        \\    url: "https://example.com"
+        \\    path_rewrite:
+        \\      replacement: "/x"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const prefix = config.rules.items[0].proxy.?.path_rewrite.?;
+    try std.testing.expectEqualStrings("/v2", prefix.strip_prefix.?);
+    try std.testing.expectEqualStrings("/api/v2", prefix.add_prefix.?);
+
+    const pattern = config.rules.items[1].proxy.?.path_rewrite.?;
+    try std.testing.expectEqualStrings("/blobs/$1", pattern.replacement);
+    try std.testing.expect(pattern.compiled == null);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 2), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/files/(.*)): invalid path_rewrite regex '/files/(.*': missing closing parenthesis at offset 10", errors.messages.items[0]);
+    try std.testing.expectEqualStrings("rule 3 (/empty): path_rewrite needs strip_prefix, add_prefix or regex", errors.messages.items[1]);
+}
+
+test "Config.loadFromYaml proxy response_rewrite" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/users/:id"
+        \\  proxy:
+        \\    url: "https://api.example.com"
+        \\    response_rewrite:
+        \\      add_headers:
+        \\        X-Mocked: "partly"
+        \\      remove_headers: [Server, X-Powered-By]
+        \\      body_replace:
+        \\        - find: "https://api.example.com"
+        \\          replace: "http://localhost:8080"
+        \\      json_patch:
+        \\        - op: set
+        \\          path: "$.meta"
+        \\          value:
+        \\            source: popshop
+        \\            stale: false
+        \\        - op: remove
+        \\          path: "$.internal"
+        \\- request:
+        \\    path: "/broken"
+        \\  proxy:
+        \\    url: "https://api.example.com"
+        \\    response_rewrite:
+        \\      body_replace:
+        \\        - find: ""
+        \\      json_patch:
+        \\        - op: remove
+        \\          path: "internal"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const rewrite = config.rules.items[0].proxy.?.response_rewrite.?;
+    try std.testing.expectEqualStrings("partly", rewrite.add_headers.?.get("X-Mocked").?);
+    try std.testing.expectEqual(@as(usize, 2), rewrite.remove_headers.len);
+    try std.testing.expectEqualStrings("http://localhost:8080", rewrite.body_replace[0].replace);
+    try std.testing.expectEqual(JsonPatchOp.set, rewrite.json_patch[0].op);
+    const value = try std.json.parseFromSlice(std.json.Value, allocator, rewrite.json_patch[0].value, .{});
+    defer value.deinit();
+    try std.testing.expectEqualStrings("popshop", value.value.object.get("source").?.string);
+    try std.testing.expectEqualStrings("null", rewrite.json_patch[1].value);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 2), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/broken): body_replace 1 needs a non-empty find", errors.messages.items[0]);
+    try std.testing.expectEqualStrings("rule 2 (/broken): invalid json_patch path 'internal'", errors.messages.items[1]);
+}
+
+test "expandEnv" {
+    const allocator = std.testing.allocator;
+
+    var env = std.process.EnvMap.init(allocator);
+    defer env.deinit();
+    try env.put("UPSTREAM_URL", "https://api.example.com");
+    try env.put("EMPTY", "");
+
+    const set = try expandEnv(allocator, "${UPSTREAM_URL}/users", &env, null);
+    defer allocator.free(set);
+    try std.testing.expectEqualStrings("https://api.example.com/users", set);
+
+    const defaulted = try expandEnv(allocator, "${PORT:-8080} ${EMPTY:-none} $${LITERAL}", &env, null);
+    defer allocator.free(defaulted);
+    try std.testing.expectEqualStrings("8080 none ${LITERAL}", defaulted);
+
+    var missing: []const u8 = "";
+    try std.testing.expectError(error.UndefinedVariable, expandEnv(allocator, "x-${API_TOKEN}", &env, &missing));
+    try std.testing.expectEqualStrings("API_TOKEN", missing);
+    try std.testing.expectError(error.InvalidVariableReference, expandEnv(allocator, "${UNCLOSED", &env, null));
+}
+
+test "Config rejects unknown fields unless lenient" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/users"
+        \\  respose:
+        \\    body: "lost"
+    ;
+
+    // Strict loading fails on the typo, logging it; check the pieces that decide
+    var parsed: yaml.Yaml = .{ .source = yaml_content };
+    defer parsed.deinit(allocator);
+    try parsed.load(allocator);
+    const rule_map = parsed.docs.items[0].list[0].map;
+    try std.testing.expectEqualStrings("respose", firstUnknownKey(rule_map, &Config.rule_keys).?);
+    try std.testing.expectEqualStrings("response", closestKey("respose", &Config.rule_keys).?);
+    try std.testing.expect(closestKey("description", &Config.rule_keys) == null);
+    try std.testing.expect(firstUnknownKey(parsed.docs.items[0].list[0].map.get("request").?.map, &.{"path"}) == null);
+
+    var config = try Config.loadFromYamlWithOptions(allocator, yaml_content, ".", .{ .lenient = true });
+    defer config.deinit();
+    try std.testing.expectEqual(@as(usize, 1), config.rules.items.len);
+    try std.testing.expect(config.rules.items[0].response == null);
+}
+
+test "Config.loadFromYamlWithEnv expands string fields" {
+    const allocator = std.testing.allocator;
+
+    var env = std.process.EnvMap.init(allocator);
+    defer env.deinit();
+    try env.put("UPSTREAM_URL", "https://api.example.com");
+    try env.put("TOKEN", "secret");
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/users"
+        \\    method: "GET"
+        \\  proxy:
+        \\    url: "${UPSTREAM_URL}/users"
+        \\    headers:
+        \\      authorization: "Bearer ${TOKEN}"
+        \\- request:
+        \\    path: "/api/region"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "${REGION:-us-east-1}"
+    ;
+
+    var config = try Config.loadFromYamlWithEnv(allocator, yaml_content, ".", &env);
+    defer config.deinit();
+
+    const proxy = config.rules.items[0].proxy.?;
+    try std.testing.expectEqualStrings("https://api.example.com/users", proxy.url);
+    try std.testing.expectEqualStrings("Bearer secret", proxy.headers.?.get("authorization").?);
+    try std.testing.expectEqualStrings("us-east-1", config.rules.items[1].response.?.body);
+}
+
+test "Config.loadFromYaml default_response" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\default_response:
+        \\  status: 404
+        \\  body: '{"error": "not_found"}'
+        \\  headers:
+        \\    content-type: "application/json"
+        \\routes:
+        \\  - request:
+        \\      path: "/api/users"
+        \\      method: "GET"
+        \\    response:
+        \\      body: '[]'
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const fallback = config.default_response.?;
+    try std.testing.expectEqual(@as(usize, 1), config.rules.items.len);
+    try std.testing.expectEqual(@as(u16, 404), fallback.status);
+    try std.testing.expectEqualStrings("{\"error\": \"not_found\"}", fallback.body);
+    try std.testing.expectEqualStrings("application/json", fallback.headers.?.get("content-type").?);
+}
+
+test "Config.loadFromYaml startup_delay" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYaml(allocator,
+        \\startup_delay: "1500ms"
+        \\startup_block_routes: true
+        \\routes: []
+    );
+    defer config.deinit();
+    try std.testing.expectEqual(@as(?u64, 1500), config.startup_delay_ms);
+    try std.testing.expect(config.startup_block_routes);
+
+    var defaults = try Config.loadFromYaml(allocator, "startup_block_routes: true\nroutes: []\n");
+    defer defaults.deinit();
+    try std.testing.expectEqual(@as(?u64, null), defaults.startup_delay_ms);
+    var summary = try defaults.summarize(allocator);
+    defer summary.deinit();
+    try std.testing.expectEqual(@as(usize, 1), summary.warnings.items.len);
+    try std.testing.expectEqualStrings("startup_block_routes has no effect without a startup_delay", summary.warnings.items[0]);
+}
+
+test "Config.loadFromYaml body_base64" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYaml(allocator,
+        \\- request:
+        \\    path: "/blob"
+        \\  response:
+        \\    body_base64: |
+        \\      AAEC
+        \\      A/8=
+    );
+    defer config.deinit();
+    const response = config.rules.items[0].response.?;
+    try std.testing.expectEqualSlices(u8, &[_]u8{ 0x00, 0x01, 0x02, 0x03, 0xff }, response.body);
+    try std.testing.expectEqualStrings("application/octet-stream", response.headers.?.get("Content-Type").?);
+    try std.testing.expect(!response.isTemplated());
+}
+
+test "Config.loadFromYaml body_json" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYaml(allocator,
+        \\- request:
+        \\    path: "/users/1"
+        \\  response:
+        \\    body_json:
+        \\      id: 1
+        \\      name: 'Ada "the Countess"'
+        \\      roles: [owner, "billing"]
+        \\      address:
+        \\        city: "London"
+        \\        lines: ["221B Baker Street"]
+        \\- request:
+        \\    path: "/users"
+        \\  response:
+        \\    headers:
+        \\      content-type: "application/vnd.api+json"
+        \\    body_json: []
+    );
+    defer config.deinit();
+    const user = config.rules.items[0].response.?;
+    try std.testing.expectEqualStrings(
+        \\{"id":1,"name":"Ada \"the Countess\"","roles":["owner","billing"],"address":{"city":"London","lines":["221B Baker Street"]}}
+    , user.body);
+    try std.testing.expectEqualStrings("application/json", user.headers.?.get("Content-Type").?);
+
+    // A Content-Type of the rule's own is kept
+    const users = config.rules.items[1].response.?;
+    try std.testing.expectEqualStrings("[]", users.body);
+    try std.testing.expectEqual(@as(u32, 1), users.headers.?.count());
+    try std.testing.expectEqualStrings("application/vnd.api+json", users.headers.?.get("content-type").?);
+}
+
+test "Config.validate checks proxy templates" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYaml(allocator,
+        \\- request:
+        \\    path: "/users/:id"
+        \\  proxy:
+        \\    url: "https://api.example.com/users/{{.Params.id}"
+        \\    headers:
+        \\      X-Tenant: "{{.Nope}}"
+    );
+    defer config.deinit();
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 2), errors.messages.items.len);
+    try std.testing.expect(std.mem.startsWith(u8, errors.messages.items[0], "rule 1 (/users/:id): proxy url template: "));
+    try std.testing.expectEqualStrings("rule 1 (/users/:id): proxy header 'X-Tenant' template: unknown field '.Nope'", errors.messages.items[1]);
+}
+
+test "Config.loadFromYaml rule name and description" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYaml(allocator,
+        \\- name: "get user by id"
+        \\  description: "Used by the profile page"
+        \\  request:
+        \\    path: "/users/:id"
+        \\  response:
+        \\    body: "{}"
+        \\- request:
+        \\    path: "/health"
+        \\  response:
+        \\    body: "ok"
+    );
+    defer config.deinit();
+    try std.testing.expectEqualStrings("get user by id", config.rules.items[0].name.?);
+    try std.testing.expectEqualStrings("Used by the profile page", config.rules.items[0].description.?);
+    try std.testing.expect(config.rules.items[1].name == null);
+    try std.testing.expect(config.rules.items[1].description == null);
+}
+
+test "Config.loadFromYaml rule seed" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYaml(allocator,
+        \\- seed: 42
+        \\  request:
+        \\    path: "/seeded"
+        \\  response:
+        \\    body: "ok"
+        \\- request:
+        \\    path: "/unseeded"
+        \\  response:
+        \\    body: "ok"
+    );
+    defer config.deinit();
+    try std.testing.expectEqual(@as(u64, 42), config.rules.items[0].request.random_source.?.seed);
+    try std.testing.expect(config.rules.items[1].request.random_source == null);
+}
+
+test "Config.loadFromYaml rule max_matches" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYaml(allocator,
+        \\- max_matches: 1
+        \\  request:
+        \\    path: "/token"
+        \\  response:
+        \\    body: "fresh"
+        \\- request:
+        \\    path: "/token"
+        \\  response:
+        \\    status: 409
+        \\- max_matches: 0
+        \\  request:
+        \\    path: "/never"
+        \\  response:
+        \\    body: "ok"
+    );
+    defer config.deinit();
+    try std.testing.expectEqual(@as(?u64, 1), config.rules.items[0].max_matches);
+    try std.testing.expect(config.rules.items[1].max_matches == null);
+
+    // The limited rule doesn't shadow the one it falls through to
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 3 (/never): max_matches must be at least 1", errors.messages.items[0]);
+}
+
+test "Config.loadFromYaml shutdown_timeout" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYaml(allocator,
+        \\shutdown_timeout: "30s"
+        \\routes: []
+    );
+    defer config.deinit();
+    try std.testing.expectEqual(@as(u64, 30000), config.shutdownTimeoutMs());
+
+    var defaults = try Config.loadFromYaml(allocator,
+        \\- request:
+        \\    path: "/api/health"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "ok"
+    );
+    defer defaults.deinit();
+    try std.testing.expectEqual(Config.default_shutdown_timeout_ms, defaults.shutdownTimeoutMs());
+}
+
+test "Config.loadFromYaml server timeouts" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYaml(allocator,
+        \\read_timeout: "5s"
+        \\write_timeout: 1500
+        \\idle_timeout: "2m"
+        \\routes: []
+    );
+    defer config.deinit();
+    try std.testing.expectEqual(@as(?u64, 5000), config.read_timeout_ms);
+    try std.testing.expectEqual(@as(?u64, 1500), config.write_timeout_ms);
+    try std.testing.expectEqual(@as(?u64, 120_000), config.idle_timeout_ms);
+}
+
+test "Config.loadFromYaml compression" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\compression:
+        \\  enabled: false
+        \\  min_size: 256
+        \\routes:
+        \\  - request:
+        \\      path: "/raw"
+        \\      method: "GET"
+        \\    response:
+        \\      body: "bytes"
+        \\      compress: false
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const compression = config.compressionConfig();
+    try std.testing.expect(!compression.enabled);
+    try std.testing.expectEqual(@as(usize, 256), compression.min_size);
+    try std.testing.expect(!config.rules.items[0].response.?.compress);
+
+    var defaults = Config.init(allocator);
+    defer defaults.deinit();
+    try std.testing.expect(defaults.compressionConfig().enabled);
+    try std.testing.expectEqual(@as(usize, 1024), defaults.compressionConfig().min_size);
+}
+
+test "Config.loadFromYaml host and port" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYaml(allocator,
+        \\host: "127.0.0.1"
+        \\port: 9090
+        \\routes: []
+    );
+    defer config.deinit();
+
+    try std.testing.expectEqualStrings("127.0.0.1", config.host.?);
+    try std.testing.expectEqual(@as(u16, 9090), config.port.?);
+    try std.testing.expect(config.socket == null);
+
+    // An empty host binds every interface
+    var any = try Config.loadFromYaml(allocator,
+        \\host: ""
+        \\port: 99999
+        \\routes: []
+    );
+    defer any.deinit();
+
+    try std.testing.expectEqualStrings("", any.host.?);
+    var errors = try any.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    try std.testing.expectEqualStrings("port: must be a port number between 0 and 65535", errors.messages.items[0]);
+
+    // 0 asks the OS for a free port
+    var ephemeral = try Config.loadFromYaml(allocator,
+        \\port: 0
+        \\routes: []
+    );
+    defer ephemeral.deinit();
+    try std.testing.expectEqual(@as(u32, 0), ephemeral.port.?);
+    var ephemeral_errors = try ephemeral.validate(allocator);
+    defer ephemeral_errors.deinit();
+    try std.testing.expect(ephemeral_errors.isEmpty());
+}
+
+test "Config.loadFromYaml socket" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYamlWithBase(allocator,
+        \\socket: "run/popshop.sock"
+        \\port: 9090
+        \\routes: []
+    , "/srv/mocks");
+    defer config.deinit();
+
+    try std.testing.expectEqualStrings("/srv/mocks/run/popshop.sock", config.socket.?);
+
+    var summary = try config.summarize(allocator);
+    defer summary.deinit();
+    try std.testing.expectEqual(@as(usize, 1), summary.warnings.items.len);
+    try std.testing.expectEqualStrings("host and port are ignored because the server listens on socket /srv/mocks/run/popshop.sock", summary.warnings.items[0]);
+
+    var long = try Config.loadFromYaml(allocator, "socket: \"/tmp/" ++ "s" ** 200 ++ "\"\nroutes: []");
+    defer long.deinit();
+    var errors = try long.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    try std.testing.expect(std.mem.startsWith(u8, errors.messages.items[0], "socket: path is longer than"));
+}
+
+test "Config.findConflicts and priority" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/users"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "[]"
+        \\- priority: 10
+        \\  request:
+        \\    path: "/users"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "maintenance"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+    try std.testing.expectEqual(@as(i32, 0), config.rules.items[0].priority);
+    try std.testing.expectEqual(@as(i32, 10), config.rules.items[1].priority);
+
+    // The later rule wins, so the earlier one is reported as shadowed
+    const conflicts = try config.findConflicts(allocator);
+    defer allocator.free(conflicts);
+    try std.testing.expectEqual(@as(usize, 1), conflicts.len);
+    try std.testing.expectEqual(@as(usize, 1), conflicts[0].first);
+    try std.testing.expectEqual(@as(usize, 0), conflicts[0].second);
+}
+
+test "Config.findConflicts and strict_slash" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/users"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "[]"
+        \\- request:
+        \\    path: "/users/"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "shadowed"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+    try std.testing.expect(!config.strict_slash);
+
+    const conflicts = try config.findConflicts(allocator);
+    defer allocator.free(conflicts);
+    try std.testing.expectEqual(@as(usize, 1), conflicts.len);
+
+    config.strict_slash = true;
+    const strict_conflicts = try config.findConflicts(allocator);
+    defer allocator.free(strict_conflicts);
+    try std.testing.expectEqual(@as(usize, 0), strict_conflicts.len);
+
+    var strict_config = try Config.loadFromYaml(allocator, "strict_slash: true\nroutes: []\n");
+    defer strict_config.deinit();
+    try std.testing.expect(strict_config.strict_slash);
+}
+
+test "Config.loadFromYaml path_prefix" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path_prefix: "/api/v1"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "v1"
+        \\- request:
+        \\    path: "/both"
+        \\    path_prefix: "/both"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "ok"
+        \\- request:
+        \\    path_prefix: "api"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "relative"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+    try std.testing.expectEqualStrings("/api/v1", config.rules.items[0].request.path_prefix.?);
+    try std.testing.expectEqualStrings("", config.rules.items[0].request.path);
+    try std.testing.expectEqualStrings("/api/v1", config.rules.items[0].request.displayPath());
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 2), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/both): set either path or path_prefix, not both", errors.messages.items[0]);
+    try std.testing.expectEqualStrings("rule 3 (api): path_prefix must start with '/'", errors.messages.items[1]);
+}
+
+test "Config.loadFromYaml path_segments" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path_segments: 3
+        \\    method: "GET"
+        \\  response:
+        \\    body: "three"
+        \\- request:
+        \\    path: "/users/*"
+        \\    path_segments: "2"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "two"
+        \\- request:
+        \\    path: "*"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "fallback"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+    try std.testing.expectEqual(@as(?u32, 3), config.rules.items[0].request.path_segments);
+    try std.testing.expectEqualStrings("*", config.rules.items[0].request.path);
+    try std.testing.expectEqual(@as(?u32, 2), config.rules.items[1].request.path_segments);
+    try std.testing.expectEqualStrings("/users/*", config.rules.items[1].request.path);
+
+    // A segment count is a constraint, so the catch-all doesn't shadow it
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 0), errors.messages.items.len);
+}
+
+test "Config.loadFromYaml latency" {
+    const allocator = std.testing.allocator;
+
+    var config = try Config.loadFromYaml(allocator,
+        \\latency:
+        \\  min: "20ms"
+        \\  max: "1s"
+        \\routes: []
+    );
+    defer config.deinit();
+    const latency = config.latency.?;
+    try std.testing.expectEqual(@as(u64, 20), latency.min_ms);
+    try std.testing.expectEqual(@as(u64, 1000), latency.max_ms);
+
+    // Picks stay in bounds, and a seed repeats them
+    var prng = std.Random.DefaultPrng.init(1);
+    var first: [100]u64 = undefined;
+    for (&first) |*delay_ms| {
+        delay_ms.* = latency.pick(prng.random());
+        try std.testing.expect(delay_ms.* >= 20 and delay_ms.* <= 1000);
+    }
+    prng = std.Random.DefaultPrng.init(1);
+    for (first) |delay_ms| try std.testing.expectEqual(delay_ms, latency.pick(prng.random()));
+    try std.testing.expectEqual(@as(u64, 5), (Latency{ .min_ms = 5, .max_ms = 5 }).pick(prng.random()));
+
+    var inverted = try Config.loadFromYaml(allocator,
+        \\latency:
+        \\  min: "2s"
+        \\  max: "1s"
+        \\routes: []
+    );
+    defer inverted.deinit();
+    var errors = try inverted.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqualStrings("latency: min of 2000ms is above max of 1000ms", errors.messages.items[0]);
+}
+
+test "Config.loadFromYaml static" {
+    const allocator = std.testing.allocator;
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    try tmp.dir.makePath("dist");
+    try tmp.dir.writeFile(.{ .sub_path = "popshop.yaml", .data =
+        \\- static:
+        \\    prefix: "/app"
+        \\    dir: "dist"
+        \\    index: "index.html"
+        \\- static:
+        \\    prefix: "/docs"
+        \\    dir: "missing"
+        \\    index: "../index.html"
+        \\- static:
+        \\    prefix: "/both"
+        \\    dir: "dist"
+        \\  response:
+        \\    body: "ok"
+        \\
+    });
+
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+    const path = try std.fs.path.join(allocator, &.{ dir_path, "popshop.yaml" });
+    defer allocator.free(path);
+    var config = try Config.loadFromFile(allocator, path);
+    defer config.deinit();
+
+    const rule = config.rules.items[0];
+    try std.testing.expect(rule.isStatic());
+    try std.testing.expectEqualStrings("/app", rule.request.path_prefix.?);
+    try std.testing.expectEqual(@as(usize, 2), rule.request.methods.len);
+    try std.testing.expect(std.mem.endsWith(u8, rule.static.?.dir, "dist"));
+    try std.testing.expectEqualStrings("index.html", rule.static.?.index.?);
+    try std.testing.expect(!rule.static.?.listing);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 3), errors.messages.items.len);
+    try std.testing.expect(std.mem.indexOf(u8, errors.messages.items[0], "static dir '") != null);
+    try std.testing.expect(std.mem.indexOf(u8, errors.messages.items[1], "static index '../index.html' must be a file inside dir") != null);
+    try std.testing.expectEqualStrings("rule 3 (/both): static can't be combined with a response or a proxy", errors.messages.items[2]);
+}
+
+test "Config.loadFromYaml path_regex" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path_regex: "/files/(.*)\\.json"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "{{index .Matches 1}}"
+        \\- request:
+        \\    path: "/both"
+        \\    path_regex: "/both"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "ok"
+        \\- request:
+        \\    path_regex: "/files/(.*"
+        \\    method: "GET"
+        \\  response:
+        \\    body: "broken"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const request = config.rules.items[0].request;
+    try std.testing.expectEqualStrings("/files/(.*)\\.json", request.displayPath());
+    try std.testing.expect(try request.regex.?.isMatch("/files/report.json"));
+    try std.testing.expect(config.rules.items[2].request.regex == null);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 2), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/both): set either path or path_regex, not both", errors.messages.items[0]);
+    try std.testing.expectEqualStrings("rule 3: invalid path_regex '/files/(.*': missing closing parenthesis at offset 10", errors.messages.items[1]);
+}
+
+test "Config.loadFromYaml body_regex" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/orders"
+        \\    method: "POST"
+        \\    body_regex: '.*"id":\s*(\d+).*'
+        \\  response:
+        \\    body: "{{index .BodyMatches 1}}"
+        \\- request:
+        \\    path: "/broken"
+        \\    method: "POST"
+        \\    body_regex: "[a-z"
+        \\  response:
+        \\    body: "broken"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const request = config.rules.items[0].request;
+    try std.testing.expectEqualStrings(".*\"id\":\\s*(\\d+).*", request.body_regex.?);
+    try std.testing.expect(try request.body_pattern.?.isMatch("{\"id\": 7}"));
+    try std.testing.expect(config.rules.items[1].request.body_pattern == null);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/broken): invalid body_regex '[a-z': missing closing ] at offset 4", errors.messages.items[0]);
+}
+
+test "Config.loadFromYaml request methods" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/scalar"
+        \\    verb: Get
+        \\  response:
+        \\    body: "one"
+        \\- request:
+        \\    path: "/list"
+        \\    verbs:
+        \\      - get
+        \\      - HEAD
+        \\  response:
+        \\    body: "many"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const scalar = config.rules.items[0].request;
+    try std.testing.expectEqual(@as(usize, 1), scalar.methods.len);
+    try std.testing.expectEqualStrings("GET", scalar.methods[0]);
+
+    const list = config.rules.items[1].request;
+    try std.testing.expectEqual(@as(usize, 2), list.methods.len);
+    try std.testing.expectEqualStrings("GET", list.methods[0]);
+    try std.testing.expectEqualStrings("HEAD", list.methods[1]);
+    try std.testing.expect(list.allowsMethod("head"));
+    try std.testing.expect(!list.allowsMethod("POST"));
+}
+
+test "Config.loadFromYaml request body conditions" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/payments"
+        \\    method: "POST"
+        \\    body:
+        \\      json:
+        \\        "$.type": refund
+        \\        "$.amount": 10
+        \\  response:
+        \\    body: "refunded"
+        \\- request:
+        \\    path: "/payments"
+        \\    method: "POST"
+        \\    body:
+        \\      json:
+        \\        "type": charge
+        \\  response:
+        \\    body: "charged"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const conditions = config.rules.items[0].request.body_json.?;
+    try std.testing.expectEqualStrings("refund", conditions.get("$.type").?);
+    try std.testing.expectEqualStrings("10", conditions.get("$.amount").?);
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    try std.testing.expectEqualStrings("rule 2 (/payments): invalid JSON path 'type'", errors.messages.items[0]);
+}
+
+test "Config.loadFromDirectory" {
+    const allocator = std.testing.allocator;
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+
+    try tmp.dir.makePath("nested");
+    try tmp.dir.makePath(".hidden");
+    try tmp.dir.writeFile(.{ .sub_path = "b.yaml", .data = "- request:\n    path: \"/b\"\n  response:\n    body: \"b\"\n" });
+    try tmp.dir.writeFile(.{ .sub_path = "a.yml", .data = "- request:\n    path: \"/a\"\n  response:\n    body: \"a\"\n" });
+    try tmp.dir.writeFile(.{ .sub_path = "nested/c.yaml", .data = "- request:\n    path: \"/c\"\n  response:\n    body: \"c\"\n" });
+    try tmp.dir.writeFile(.{ .sub_path = ".hidden/d.yaml", .data = "- request:\n    path: \"/d\"\n  response:\n    body: \"d\"\n" });
+    try tmp.dir.writeFile(.{ .sub_path = "notes.txt", .data = "not yaml" });
+
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+
+    var config = try Config.loadFromDirectory(allocator, dir_path);
+    defer config.deinit();
+
+    const expected = [_][]const u8{ "/a", "/b", "/c" };
+    try std.testing.expectEqual(expected.len, config.rules.items.len);
+    for (expected, config.rules.items) |path, rule| {
+        try std.testing.expectEqualStrings(path, rule.request.path);
+    }
+    try std.testing.expect(std.mem.endsWith(u8, config.rules.items[2].source.?, "c.yaml"));
+}
+
+test "Config.loadFromFile follows imports" {
+    const allocator = std.testing.allocator;
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+
+    try tmp.dir.makePath("shared");
+    try tmp.dir.writeFile(.{ .sub_path = "shared/health.yaml", .data = "- request:\n    path: \"/health\"\n  response:\n    body: \"shared\"\n" });
+    try tmp.dir.writeFile(.{ .sub_path = "shared/users.yaml", .data = "- request:\n    path: \"/users\"\n  response:\n    body_file: \"users.json\"\n" });
+    try tmp.dir.writeFile(.{ .sub_path = "append.yaml", .data =
+        \\imports:
+        \\  - shared/health.yaml
+        \\  - shared/users.yaml
+        \\routes:
+        \\  - request:
+        \\      path: "/health"
+        \\    response:
+        \\      body: "own"
+        \\
+    });
+    try tmp.dir.writeFile(.{ .sub_path = "override.yaml", .data =
+        \\imports: [shared/health.yaml]
+        \\merge_strategy: override
+        \\routes:
+        \\  - request:
+        \\      path: "/health"
+        \\    response:
+        \\      body: "own"
+        \\
+    });
+    try tmp.dir.writeFile(.{ .sub_path = "reject.yaml", .data =
+        \\imports: [shared/health.yaml]
+        \\merge_strategy: reject
+        \\routes:
+        \\  - request:
+        \\      path: "/health"
+        \\    response:
+        \\      body: "own"
+        \\
+    });
+
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+
+    // Imports come first, resolved against the file that names them
+    const append_path = try std.fs.path.join(allocator, &.{ dir_path, "append.yaml" });
+    defer allocator.free(append_path);
+    var appended = try Config.loadFromFile(allocator, append_path);
+    defer appended.deinit();
+    try std.testing.expectEqual(@as(usize, 3), appended.rules.items.len);
+    try std.testing.expectEqualStrings("shared", appended.rules.items[0].response.?.body);
+    try std.testing.expect(std.mem.endsWith(u8, appended.rules.items[0].source.?, "health.yaml"));
+    const users_body = try std.fs.path.join(allocator, &.{ dir_path, "shared", "users.json" });
+    defer allocator.free(users_body);
+    try std.testing.expectEqualStrings(users_body, appended.rules.items[1].response.?.body_file.?);
+    try std.testing.expectEqualStrings("own", appended.rules.items[2].response.?.body);
+
+    const override_path = try std.fs.path.join(allocator, &.{ dir_path, "override.yaml" });
+    defer allocator.free(override_path);
+    var overridden = try Config.loadFromFile(allocator, override_path);
+    defer overridden.deinit();
+    try std.testing.expectEqual(@as(usize, 1), overridden.rules.items.len);
+    try std.testing.expectEqualStrings("own", overridden.rules.items[0].response.?.body);
+
+    const reject_path = try std.fs.path.join(allocator, &.{ dir_path, "reject.yaml" });
+    defer allocator.free(reject_path);
+    try std.testing.expectError(error.DuplicateRule, Config.loadFromFile(allocator, reject_path));
+}
+
+test "Config.loadFromFile rejects import cycles" {
+    const allocator = std.testing.allocator;
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+
+    try tmp.dir.writeFile(.{ .sub_path = "a.yaml", .data = "imports: [b.yaml]\nroutes: []\n" });
+    try tmp.dir.writeFile(.{ .sub_path = "b.yaml", .data = "imports: [c.yaml]\nroutes: []\n" });
+    try tmp.dir.writeFile(.{ .sub_path = "c.yaml", .data = "imports: [a.yaml]\nroutes: []\n" });
+    try tmp.dir.writeFile(.{ .sub_path = "self.yaml", .data = "imports: [self.yaml]\n" });
+
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+    inline for (.{ "a.yaml", "self.yaml" }) |name| {
+        const path = try std.fs.path.join(allocator, &.{ dir_path, name });
+        defer allocator.free(path);
+        try std.testing.expectError(error.ImportCycle, Config.loadFromFile(allocator, path));
+    }
+}
+
+test "Config.findConflicts" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/users"
+        \\    methods: [get, post]
+        \\  response:
+        \\    body: "first"
+        \\- request:
+        \\    path: "/users"
+        \\    method: "POST"
+        \\  response:
+        \\    body: "shadowed"
+        \\- request:
+        \\    path: "/users"
+        \\    method: "GET"
+        \\    query:
+        \\      page: "2"
+        \\  response:
+        \\    body: "constrained"
+        \\- request:
+        \\    path: "/users"
+        \\    method: "DELETE"
+        \\  response:
+        \\    body: "other method"
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    const conflicts = try config.findConflicts(allocator);
+    defer allocator.free(conflicts);
+
+    try std.testing.expectEqual(@as(usize, 1), conflicts.len);
+    try std.testing.expectEqual(@as(usize, 0), conflicts[0].first);
+    try std.testing.expectEqual(@as(usize, 1), conflicts[0].second);
+    try std.testing.expectEqualStrings("POST", conflicts[0].method);
+}
+
+test "Config on_duplicate" {
+    const allocator = std.testing.allocator;
+
+    const rules =
+        \\routes:
+        \\  - request:
+        \\      path: "/users"
+        \\      methods: [get, post]
+        \\    response:
+        \\      body: "first"
+        \\  - request:
+        \\      path: "/users/"
+        \\      methods: [post, put]
+        \\    response:
+        \\      body: "second"
+        \\  - request:
+        \\      path: "/users"
+        \\      method: get
+        \\      query:
+        \\        page: "2"
+        \\    response:
+        \\      body: "constrained"
+        \\  - priority: 5
+        \\    request:
+        \\      path: "/users"
+        \\      method: get
+        \\    response:
+        \\      body: "prioritized"
+        \\
+    ;
+
+    // By default the duplicate is only reported, by validate
+    {
+        var config = try Config.loadFromYaml(allocator, rules);
+        defer config.deinit();
+        try std.testing.expectEqual(OnDuplicate.@"error", config.on_duplicate);
+        try std.testing.expectEqual(@as(usize, 4), config.rules.items.len);
+
+        var errors = try config.validate(allocator);
+        defer errors.deinit();
+        try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+        try std.testing.expectEqualStrings("rule 2 (POST /users/) at config duplicates rule 1 at config; remove one or set on_duplicate to first_wins, last_wins or merge", errors.messages.items[0]);
+        try std.testing.expectEqual(@as(?usize, 1), errors.rules.items[0]);
+    }
+
+    const Case = struct { policy: []const u8, bodies: []const []const u8 };
+    const cases = [_]Case{
+        .{ .policy = "first_wins", .bodies = &.{ "first", "constrained", "prioritized" } },
+        .{ .policy = "last_wins", .bodies = &.{ "second", "constrained", "prioritized" } },
+        .{ .policy = "merge", .bodies = &.{ "first", "second", "constrained", "prioritized" } },
+    };
+    for (cases) |case| {
+        const yaml_content = try std.fmt.allocPrint(allocator, "on_duplicate: {s}\n{s}", .{ case.policy, rules });
+        defer allocator.free(yaml_content);
+        var config = try Config.loadFromYaml(allocator, yaml_content);
+        defer config.deinit();
+
+        try std.testing.expectEqual(case.bodies.len, config.rules.items.len);
+        for (case.bodies, config.rules.items) |body, rule| {
+            try std.testing.expectEqualStrings(body, rule.response.?.body);
+        }
+        var errors = try config.validate(allocator);
+        defer errors.deinit();
+        try std.testing.expect(errors.isEmpty());
+    }
+
+    // Merging leaves the later rule only the method the earlier one lacks
+    var merged = try Config.loadFromYaml(allocator, "on_duplicate: merge\n" ++ rules);
+    defer merged.deinit();
+    try std.testing.expectEqual(@as(usize, 1), merged.rules.items[1].request.methods.len);
+    try std.testing.expectEqualStrings("PUT", merged.rules.items[1].request.methods[0]);
+
+    var merged_away = try Config.loadFromYaml(allocator,
+        \\on_duplicate: merge
+        \\routes:
+        \\  - request:
+        \\      path: "/users"
+        \\      method: "*"
+        \\    response:
+        \\      body: "any"
+        \\  - request:
+        \\      path: "/users"
+        \\      method: get
+        \\    response:
+        \\      body: "unreachable"
+        \\
+    );
+    defer merged_away.deinit();
+    try std.testing.expectEqual(@as(usize, 1), merged_away.rules.items.len);
+}
+
+test "Config on_duplicate names both files" {
+    const allocator = std.testing.allocator;
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+
+    const rule =
+        \\- request:
+        \\    path: "/users"
+        \\    method: get
+        \\  response:
+        \\    body: "[]"
+        \\
+    ;
+    try tmp.dir.writeFile(.{ .sub_path = "a.yaml", .data = rule });
+    try tmp.dir.writeFile(.{ .sub_path = "b.yaml", .data = "# users again\n" ++ rule });
+
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+    var config = try Config.loadFromDirectory(allocator, dir_path);
+    defer config.deinit();
+
+    var errors = try config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expectEqual(@as(usize, 1), errors.messages.items.len);
+    const expected = try std.fmt.allocPrint(allocator, "rule 2 (GET /users) at {s}/b.yaml:2 duplicates rule 1 at {s}/a.yaml:1; remove one or set on_duplicate to first_wins, last_wins or merge", .{ dir_path, dir_path });
+    defer allocator.free(expected);
+    try std.testing.expectEqualStrings(expected, errors.messages.items[0]);
+}
+
+test "Config.summarize" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\default_response:
+        \\  status: 404
+        \\routes:
+        \\  - request:
+        \\      path: "/users"
+        \\      method: "GET"
+        \\    response:
+        \\      body: "[]"
+        \\  - request:
+        \\      path: "/users"
+        \\      method: "GET"
+        \\    response:
+        \\      body: "shadowed"
+        \\  - request:
+        \\      path: "/external"
+        \\      method: "GET"
+        \\    proxy:
+        \\      url: "https://example.com"
+        \\  - request:
+        \\      path: "*"
+        \\      method: "*"
+        \\    response:
+        \\      status: 418
+    ;
+
+    var config = try Config.loadFromYaml(allocator, yaml_content);
+    defer config.deinit();
+
+    var summary = try config.summarize(allocator);
+    defer summary.deinit();
+
+    try std.testing.expectEqual(@as(usize, 4), summary.total_rules);
+    try std.testing.expectEqual(@as(usize, 3), summary.mock_rules);
+    try std.testing.expectEqual(@as(usize, 1), summary.proxy_rules);
+
+    try std.testing.expectEqual(@as(usize, 2), summary.warnings.items.len);
+    try std.testing.expectEqualStrings("rule 2 (GET /users) in config duplicates rule 1 in config and will never match", summary.warnings.items[0]);
+    try std.testing.expectEqualStrings("default_response is never served because rule 4 (*) matches every request", summary.warnings.items[1]);
+}
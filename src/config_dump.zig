@@ -0,0 +1,283 @@
+const std = @import("std");
+const config = @import("config.zig");
+
+const Config = config.Config;
+
+pub const Format = enum { yaml, json };
+
+pub const Options = struct {
+    format: Format = .yaml,
+    /// Hide what `${VAR}` references expanded to, and basic auth passwords
+    redact: bool = false,
+};
+
+/// Written in place of redacted values
+pub const redacted = "<redacted>";
+
+/// Fields that are compiled or runtime state rather than configuration
+const skipped_fields = [_][]const u8{ "allocator", "hits", "regex", "body_pattern", "compiled", "schema", "random_source", "client_range", "proto_version", "credit", "updated_ms", "used", "window_started_ms", "mutex", "env_values" };
+
+/// Write `app_config` as popshop will serve it: imports merged, presets
+/// expanded, `${VAR}` references substituted and defaults filled in. Keys
+/// are the parsed field names, such as `delay_ms` for `delay`.
+pub fn write(allocator: std.mem.Allocator, writer: anytype, app_config: *const Config, options: Options) !void {
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    const redactor = Redactor{
+        .arena = arena.allocator(),
+        .secrets = if (options.redact) app_config.env_values.items else &.{},
+        .enabled = options.redact,
+    };
+
+    var text = std.ArrayList(u8).init(arena.allocator());
+    var json = std.json.writeStream(text.writer(), .{ .whitespace = .indent_2 });
+    try writeValue(&json, app_config.*, &redactor);
+
+    switch (options.format) {
+        .json => {
+            try writer.writeAll(text.items);
+            try writer.writeByte('\n');
+        },
+        .yaml => {
+            const root = try std.json.parseFromSliceLeaky(std.json.Value, arena.allocator(), text.items, .{ .parse_numbers = false });
+            try writeYamlObject(writer, root.object, 0);
+        },
+    }
+}
+
+const Redactor = struct {
+    arena: std.mem.Allocator,
+    /// Substrings to hide wherever they appear
+    secrets: []const []const u8,
+    enabled: bool,
+
+    fn apply(self: *const Redactor, text: []const u8) ![]const u8 {
+        var result = text;
+        for (self.secrets) |secret| {
+            if (secret.len == 0) continue;
+            result = try std.mem.replaceOwned(u8, self.arena, result, secret, redacted);
+        }
+        return result;
+    }
+
+    fn hides(self: *const Redactor, field_name: []const u8) bool {
+        return self.enabled and std.mem.eql(u8, field_name, "password");
+    }
+};
+
+fn isSkipped(comptime name: []const u8) bool {
+    for (skipped_fields) |skipped| {
+        if (std.mem.eql(u8, name, skipped)) return true;
+    }
+    return false;
+}
+
+fn writeValue(json: anytype, value: anytype, redactor: *const Redactor) !void {
+    const T = @TypeOf(value);
+    if (T == []const u8 or T == []u8) return json.write(try redactor.apply(value));
+    if (T == std.StringHashMap([]const u8)) return writeStringMap(json, value, redactor);
+
+    switch (@typeInfo(T)) {
+        .bool, .int, .comptime_int => try json.write(value),
+        // NaN marks a number that didn't parse, which JSON can't hold
+        .float => if (std.math.isFinite(value)) try json.write(value) else try json.write(null),
+        .@"enum" => try json.write(@tagName(value)),
+        .optional => if (value) |inner| try writeValue(json, inner, redactor) else try json.write(null),
+        .pointer => |pointer| switch (pointer.size) {
+            .one => try writeValue(json, value.*, redactor),
+            .slice => {
+                try json.beginArray();
+                for (value) |item| try writeValue(json, item, redactor);
+                try json.endArray();
+            },
+            else => try json.write(null),
+        },
+        .@"struct" => |info| {
+            // Managed ArrayLists, such as `Config.rules`
+            if (@hasField(T, "items") and @hasField(T, "capacity")) return writeValue(json, value.items, redactor);
+
+            try json.beginObject();
+            inline for (info.fields) |field| {
+                if (comptime isSkipped(field.name)) continue;
+                const field_value = @field(value, field.name);
+                const unset = @typeInfo(field.type) == .optional and field_value == null;
+                if (!unset) {
+                    try json.objectField(field.name);
+                    if (redactor.hides(field.name)) {
+                        try json.write(redacted);
+                    } else {
+                        try writeValue(json, field_value, redactor);
+                    }
+                }
+            }
+            try json.endObject();
+        },
+        else => try json.write(null),
+    }
+}
+
+/// Headers, query conditions and the like, by key so the output is stable
+fn writeStringMap(json: anytype, map: std.StringHashMap([]const u8), redactor: *const Redactor) !void {
+    const keys = try redactor.arena.alloc([]const u8, map.count());
+    var iter = map.keyIterator();
+    var index: usize = 0;
+    while (iter.next()) |key| : (index += 1) {
+        keys[index] = key.*;
+    }
+    std.mem.sort([]const u8, keys, {}, lessThan);
+
+    try json.beginObject();
+    for (keys) |key| {
+        try json.objectField(key);
+        try json.write(try redactor.apply(map.get(key).?));
+    }
+    try json.endObject();
+}
+
+fn lessThan(_: void, a: []const u8, b: []const u8) bool {
+    return std.mem.lessThan(u8, a, b);
+}
+
+fn writeYamlObject(writer: anytype, object: std.json.ObjectMap, indent: usize) !void {
+    var iter = object.iterator();
+    while (iter.next()) |entry| {
+        try writer.writeByteNTimes(' ', indent);
+        try writeYamlKey(writer, entry.key_ptr.*);
+        try writer.writeByte(':');
+        try writeYamlValue(writer, entry.value_ptr.*, indent + 2);
+    }
+}
+
+fn writeYamlArray(writer: anytype, array: std.json.Array, indent: usize) !void {
+    for (array.items) |item| {
+        try writer.writeByteNTimes(' ', indent);
+        try writer.writeByte('-');
+        try writeYamlValue(writer, item, indent + 2);
+    }
+}
+
+/// The rest of a line after `key:` or `-`, with any nested block below it
+fn writeYamlValue(writer: anytype, value: std.json.Value, indent: usize) !void {
+    switch (value) {
+        .object => |object| {
+            if (object.count() == 0) return writer.writeAll(" {}\n");
+            try writer.writeByte('\n');
+            try writeYamlObject(writer, object, indent);
+        },
+        .array => |array| {
+            if (array.items.len == 0) return writer.writeAll(" []\n");
+            try writer.writeByte('\n');
+            try writeYamlArray(writer, array, indent);
+        },
+        .null => try writer.writeAll(" null\n"),
+        .bool => |b| try writer.print(" {}\n", .{b}),
+        .integer => |i| try writer.print(" {d}\n", .{i}),
+        .float => |f| try writer.print(" {d}\n", .{f}),
+        .number_string => |number| try writer.print(" {s}\n", .{number}),
+        // JSON string escapes are valid in YAML double-quoted scalars
+        .string => |text| {
+            try writer.writeByte(' ');
+            try std.json.encodeJsonString(text, .{}, writer);
+            try writer.writeByte('\n');
+        },
+    }
+}
+
+fn writeYamlKey(writer: anytype, key: []const u8) !void {
+    const plain = key.len > 0 and (std.ascii.isAlphanumeric(key[0]) or key[0] == '_' or key[0] == '/') and for (key) |c| {
+        if (!std.ascii.isAlphanumeric(c) and std.mem.indexOfScalar(u8, "_-./", c) == null) break false;
+    } else true;
+    if (plain) return writer.writeAll(key);
+    try std.json.encodeJsonString(key, .{}, writer);
+}
+
+test "write expands imports and presets" {
+    const allocator = std.testing.allocator;
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    try tmp.dir.writeFile(.{ .sub_path = "main.yaml", .data =
+        \\imports: [users.yaml]
+        \\routes:
+        \\  - request:
+        \\      path: "/health"
+        \\    response:
+        \\      preset: json_ok
+        \\
+    });
+    try tmp.dir.writeFile(.{ .sub_path = "users.yaml", .data =
+        \\- request:
+        \\    path: "/users"
+        \\  response:
+        \\    delay: "250ms"
+        \\    body: "[]"
+        \\
+    });
+
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+    const path = try std.fs.path.join(allocator, &.{ dir_path, "main.yaml" });
+    defer allocator.free(path);
+    var app_config = try Config.loadFromFile(allocator, path);
+    defer app_config.deinit();
+
+    var yaml_out = std.ArrayList(u8).init(allocator);
+    defer yaml_out.deinit();
+    try write(allocator, yaml_out.writer(), &app_config, .{});
+    // The imported rule arrives with its delay parsed, and the preset with
+    // its body and header filled in
+    try std.testing.expect(std.mem.indexOf(u8, yaml_out.items, "path: \"/users\"") != null);
+    try std.testing.expect(std.mem.indexOf(u8, yaml_out.items, "delay_ms: 250") != null);
+    try std.testing.expect(std.mem.indexOf(u8, yaml_out.items, "body: \"{\\\"ok\\\":true}\"") != null);
+    try std.testing.expect(std.mem.indexOf(u8, yaml_out.items, "Content-Type: \"application/json\"") != null);
+
+    var json_out = std.ArrayList(u8).init(allocator);
+    defer json_out.deinit();
+    try write(allocator, json_out.writer(), &app_config, .{ .format = .json });
+    const parsed = try std.json.parseFromSlice(std.json.Value, allocator, json_out.items, .{});
+    defer parsed.deinit();
+    const rules = parsed.value.object.get("rules").?.array.items;
+    try std.testing.expectEqual(@as(usize, 2), rules.len);
+    var paths: [2][]const u8 = undefined;
+    for (rules, &paths) |rule, *rule_path| {
+        rule_path.* = rule.object.get("request").?.object.get("path").?.string;
+    }
+    std.mem.sort([]const u8, &paths, {}, lessThan);
+    try std.testing.expectEqualStrings("/health", paths[0]);
+    try std.testing.expectEqualStrings("/users", paths[1]);
+}
+
+test "write redacts environment values" {
+    const allocator = std.testing.allocator;
+
+    var env = std.process.EnvMap.init(allocator);
+    defer env.deinit();
+    try env.put("UPSTREAM_TOKEN", "s3cret");
+
+    var app_config = try Config.loadFromYamlWithEnv(allocator,
+        \\- request:
+        \\    path: "/orders"
+        \\    auth:
+        \\      username: "admin"
+        \\      password: "hunter2"
+        \\  proxy:
+        \\    url: "https://orders.example.com"
+        \\    headers:
+        \\      Authorization: "Bearer ${UPSTREAM_TOKEN}"
+    , ".", &env);
+    defer app_config.deinit();
+
+    var plain = std.ArrayList(u8).init(allocator);
+    defer plain.deinit();
+    try write(allocator, plain.writer(), &app_config, .{});
+    try std.testing.expect(std.mem.indexOf(u8, plain.items, "Bearer s3cret") != null);
+
+    var hidden = std.ArrayList(u8).init(allocator);
+    defer hidden.deinit();
+    try write(allocator, hidden.writer(), &app_config, .{ .redact = true });
+    try std.testing.expect(std.mem.indexOf(u8, hidden.items, "s3cret") == null);
+    try std.testing.expect(std.mem.indexOf(u8, hidden.items, "hunter2") == null);
+    try std.testing.expect(std.mem.indexOf(u8, hidden.items, "Authorization: \"Bearer <redacted>\"") != null);
+    try std.testing.expect(std.mem.indexOf(u8, hidden.items, "password: \"<redacted>\"") != null);
+}
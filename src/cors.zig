@@ -0,0 +1,81 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+const config = @import("config.zig");
+
+const Request = interfaces.Request;
+const Response = interfaces.Response;
+const CorsConfig = config.CorsConfig;
+
+/// Whether the request is a browser preflight rather than a plain OPTIONS call
+pub fn isPreflight(request: *const Request) bool {
+    return request.method == .OPTIONS and
+        request.getHeader("Origin") != null and
+        request.getHeader("Access-Control-Request-Method") != null;
+}
+
+/// The value for Access-Control-Allow-Origin, or null if the origin is not allowed.
+/// With credentials enabled a wildcard is answered with the specific origin,
+/// since browsers reject `*` on credentialed requests.
+pub fn allowedOrigin(cors: *const CorsConfig, origin: ?[]const u8) ?[]const u8 {
+    var wildcard = false;
+    for (cors.allowed_origins) |allowed| {
+        if (std.mem.eql(u8, allowed, "*")) {
+            wildcard = true;
+        } else if (origin) |o| {
+            if (std.ascii.eqlIgnoreCase(allowed, o)) return o;
+        }
+    }
+
+    if (!wildcard) return null;
+    if (cors.allow_credentials) return origin;
+    return "*";
+}
+
+/// Answer a preflight request. A disallowed origin gets no CORS headers,
+/// which makes the browser block the actual request.
+pub fn preflightResponse(cors: *const CorsConfig, request: *const Request) !Response {
+    var response = Response.init(request.arena, .no_content);
+    const origin = allowedOrigin(cors, request.getHeader("Origin")) orelse return response;
+
+    try setOriginHeaders(cors, &response, origin);
+    try response.setHeader("Access-Control-Allow-Methods", try std.mem.join(request.arena, ", ", cors.allowed_methods));
+    try response.setHeader("Access-Control-Allow-Headers", try std.mem.join(request.arena, ", ", cors.allowed_headers));
+    return response;
+}
+
+/// Add CORS headers to a regular response. Headers set explicitly by a rule are kept.
+pub fn applyHeaders(cors: *const CorsConfig, request: *const Request, response: *Response) !void {
+    if (response.getHeader("Access-Control-Allow-Origin") != null) return;
+
+    const origin = allowedOrigin(cors, request.getHeader("Origin")) orelse return;
+    try setOriginHeaders(cors, response, origin);
+}
+
+fn setOriginHeaders(cors: *const CorsConfig, response: *Response, origin: []const u8) !void {
+    try response.setHeader("Access-Control-Allow-Origin", origin);
+    if (!std.mem.eql(u8, origin, "*")) {
+        // The header depends on the request origin, so caches must key on it
+        try response.appendHeader("Vary", "Origin");
+    }
+    if (cors.allow_credentials) {
+        try response.setHeader("Access-Control-Allow-Credentials", "true");
+    }
+}
+
+test "allowedOrigin" {
+    const exact = CorsConfig{
+        .allowed_origins = &.{"https://app.example.com"},
+        .allowed_methods = &.{},
+        .allowed_headers = &.{},
+    };
+    try std.testing.expectEqualStrings("https://app.example.com", allowedOrigin(&exact, "https://app.example.com").?);
+    try std.testing.expect(allowedOrigin(&exact, "https://evil.example.com") == null);
+    try std.testing.expect(allowedOrigin(&exact, null) == null);
+
+    try std.testing.expectEqualStrings("*", allowedOrigin(&CorsConfig.default, "https://a.example.com").?);
+
+    var credentialed = CorsConfig.default;
+    credentialed.allow_credentials = true;
+    try std.testing.expectEqualStrings("https://a.example.com", allowedOrigin(&credentialed, "https://a.example.com").?);
+    try std.testing.expect(allowedOrigin(&credentialed, null) == null);
+}
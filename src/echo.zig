@@ -0,0 +1,160 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+const admin = @import("admin.zig");
+
+const Request = interfaces.Request;
+const Response = interfaces.Response;
+
+/// Served by the main listener when `--echo` is given, ahead of every rule
+pub const path = admin.prefix ++ "/echo";
+
+/// Bytes of the request body copied into the dump; the rest is cut off
+pub const max_body_size = 64 * 1024;
+
+/// Whether `request` is for the echo endpoint. Any method qualifies, so
+/// POST bodies can be inspected too.
+pub fn matches(request: *const Request) bool {
+    return std.mem.eql(u8, request.path, path);
+}
+
+/// Describe `request` as JSON: its method, path, query, headers and body.
+/// The body is only read, so nothing else sees it changed. Bodies that
+/// aren't UTF-8 are base64 encoded.
+pub fn respond(request: *const Request) !Response {
+    var body = std.ArrayList(u8).init(request.arena);
+    var json = std.json.writeStream(body.writer(), .{ .whitespace = .indent_2 });
+    defer json.deinit();
+
+    try json.beginObject();
+    try json.objectField("method");
+    try json.write(request.method.toString());
+    try json.objectField("path");
+    try json.write(request.path);
+    try json.objectField("raw_query");
+    try json.write(request.query);
+
+    // A parameter given more than once keeps every value, in order
+    var query = std.StringArrayHashMap(std.ArrayList([]const u8)).init(request.arena);
+    var params = request.queryParams();
+    while (try params.next()) |param| {
+        const values = try query.getOrPut(param.name);
+        if (!values.found_existing) values.value_ptr.* = std.ArrayList([]const u8).init(request.arena);
+        try values.value_ptr.append(param.value);
+    }
+    try json.objectField("query");
+    try json.beginObject();
+    var query_iter = query.iterator();
+    while (query_iter.next()) |entry| {
+        try json.objectField(entry.key_ptr.*);
+        try json.write(entry.value_ptr.items);
+    }
+    try json.endObject();
+
+    // Sorted, since the header map has no order of its own
+    const names = try request.arena.alloc([]const u8, request.headers.count());
+    var header_iter = request.headers.keyIterator();
+    var index: usize = 0;
+    while (header_iter.next()) |name| : (index += 1) names[index] = name.*;
+    std.mem.sort([]const u8, names, {}, struct {
+        fn lessThan(_: void, a: []const u8, b: []const u8) bool {
+            return std.ascii.lessThanIgnoreCase(a, b);
+        }
+    }.lessThan);
+    try json.objectField("headers");
+    try json.beginObject();
+    for (names) |name| {
+        try json.objectField(name);
+        try json.write(request.headers.get(name).?);
+    }
+    try json.endObject();
+
+    const echoed = request.body[0..@min(request.body.len, max_body_size)];
+    try json.objectField("body");
+    if (std.unicode.utf8ValidateSlice(echoed)) {
+        try json.write(echoed);
+    } else {
+        const encoder = std.base64.standard.Encoder;
+        const encoded = try request.arena.alloc(u8, encoder.calcSize(echoed.len));
+        try json.write(encoder.encode(encoded, echoed));
+        try json.objectField("body_encoding");
+        try json.write("base64");
+    }
+    try json.objectField("body_size");
+    try json.write(request.body.len);
+    try json.objectField("body_truncated");
+    try json.write(request.body.len > max_body_size);
+
+    if (request.client_address) |address| {
+        try json.objectField("client_address");
+        try json.print("\"{}\"", .{address});
+    }
+    try json.endObject();
+
+    var response = Response.init(request.arena, .ok);
+    try response.setHeader("Content-Type", "application/json");
+    response.setBody(body.items);
+    return response;
+}
+
+test "respond echoes the request" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var request = Request{
+        .method = .POST,
+        .path = path,
+        .query = "tag=a&tag=b%20c&page=2",
+        .headers = interfaces.HeaderMap.init(arena.allocator()),
+        .body = "{\"name\": \"popshop\"}",
+        .client_address = try std.net.Address.parseIp("127.0.0.1", 5000),
+        .arena = arena.allocator(),
+    };
+    try request.headers.put("X-Request-Id", "req-1");
+    try request.headers.put("Content-Type", "application/json");
+
+    const response = try respond(&request);
+    try std.testing.expectEqual(interfaces.Status.ok, response.status);
+    // The request is untouched
+    try std.testing.expectEqualStrings("{\"name\": \"popshop\"}", request.body);
+
+    const dump = (try std.json.parseFromSliceLeaky(std.json.Value, arena.allocator(), response.body, .{})).object;
+    try std.testing.expectEqualStrings("POST", dump.get("method").?.string);
+    try std.testing.expectEqualStrings(path, dump.get("path").?.string);
+    try std.testing.expectEqualStrings("tag=a&tag=b%20c&page=2", dump.get("raw_query").?.string);
+    const tags = dump.get("query").?.object.get("tag").?.array.items;
+    try std.testing.expectEqual(@as(usize, 2), tags.len);
+    try std.testing.expectEqualStrings("b c", tags[1].string);
+    try std.testing.expectEqualStrings("2", dump.get("query").?.object.get("page").?.array.items[0].string);
+    try std.testing.expectEqualStrings("req-1", dump.get("headers").?.object.get("X-Request-Id").?.string);
+    try std.testing.expectEqualStrings("{\"name\": \"popshop\"}", dump.get("body").?.string);
+    try std.testing.expectEqual(@as(i64, 19), dump.get("body_size").?.integer);
+    try std.testing.expect(!dump.get("body_truncated").?.bool);
+    try std.testing.expectEqualStrings("127.0.0.1:5000", dump.get("client_address").?.string);
+}
+
+test "respond caps and encodes the body" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    const large = try arena.allocator().alloc(u8, max_body_size + 10);
+    @memset(large, 'x');
+    var request = Request{
+        .method = .PUT,
+        .path = path,
+        .query = "",
+        .headers = interfaces.HeaderMap.init(arena.allocator()),
+        .body = large,
+        .arena = arena.allocator(),
+    };
+    var dump = (try std.json.parseFromSliceLeaky(std.json.Value, arena.allocator(), (try respond(&request)).body, .{})).object;
+    try std.testing.expectEqual(@as(usize, max_body_size), dump.get("body").?.string.len);
+    try std.testing.expectEqual(@as(i64, max_body_size + 10), dump.get("body_size").?.integer);
+    try std.testing.expect(dump.get("body_truncated").?.bool);
+
+    request.body = &.{ 0xff, 0x00, 0x01 };
+    dump = (try std.json.parseFromSliceLeaky(std.json.Value, arena.allocator(), (try respond(&request)).body, .{})).object;
+    try std.testing.expectEqualStrings("/wAB", dump.get("body").?.string);
+    try std.testing.expectEqualStrings("base64", dump.get("body_encoding").?.string);
+}
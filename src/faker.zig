@@ -0,0 +1,310 @@
+const std = @import("std");
+const template = @import("template.zig");
+
+const Value = std.json.Value;
+
+/// A `{{...}}` placeholder in a faker shape
+const Hint = union(enum) {
+    /// `int`, `int:min:max`; both bounds inclusive
+    int: struct { min: i64 = 0, max: i64 = 100 },
+    /// `float`, `float:min:max`; rounded to two decimals
+    float: struct { min: f64 = 0, max: f64 = 1 },
+    boolean,
+    text: Text,
+};
+
+/// Hints that produce strings
+const Text = enum {
+    name,
+    first_name,
+    last_name,
+    email,
+    username,
+    phone,
+    company,
+    street,
+    city,
+    country,
+    zip,
+    word,
+    sentence,
+    uuid,
+    url,
+    ipv4,
+    date,
+    datetime,
+};
+
+const first_names = [_][]const u8{ "Ada", "Alan", "Grace", "Linus", "Margaret", "Dennis", "Barbara", "Ken", "Frances", "Edsger", "Radia", "Donald", "Hedy", "Tim", "Katherine", "John", "Joan", "Guido", "Sophie", "Niklaus" };
+const last_names = [_][]const u8{ "Lovelace", "Turing", "Hopper", "Torvalds", "Hamilton", "Ritchie", "Liskov", "Thompson", "Allen", "Dijkstra", "Perlman", "Knuth", "Lamarr", "Berners-Lee", "Johnson", "McCarthy", "Clarke", "Rossum", "Wilson", "Wirth" };
+const companies = [_][]const u8{ "Acme Corp", "Globex", "Initech", "Umbrella", "Hooli", "Vandelay Industries", "Stark Industries", "Wayne Enterprises", "Soylent", "Tyrell" };
+const street_kinds = [_][]const u8{ "Street", "Avenue", "Road", "Lane", "Way", "Drive" };
+const cities = [_][]const u8{ "Springfield", "Riverside", "Portland", "Madison", "Georgetown", "Salem", "Fairview", "Franklin", "Greenville", "Bristol" };
+const countries = [_][]const u8{ "United States", "Canada", "Mexico", "Brazil", "United Kingdom", "Germany", "France", "Japan", "India", "Australia" };
+const words = [_][]const u8{ "lorem", "ipsum", "dolor", "sit", "amet", "consectetur", "adipiscing", "elit", "sed", "do", "eiusmod", "tempor", "incididunt", "ut", "labore", "et", "dolore", "magna", "aliqua", "enim" };
+
+/// Fill the JSON document `shape` with fake values. A string that is a
+/// single hint such as `"{{int:18:65}}"` becomes a value of that type, so
+/// numbers and booleans come out unquoted; hints inside longer strings are
+/// replaced with their text. Everything else is copied as written.
+pub fn render(allocator: std.mem.Allocator, shape: []const u8, random: std.Random) ![]u8 {
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    const document = std.json.parseFromSliceLeaky(Value, arena.allocator(), shape, .{}) catch |err| switch (err) {
+        error.OutOfMemory => return err,
+        else => return error.InvalidFakerShape,
+    };
+    const filled = try fill(arena.allocator(), document, random);
+    return std.json.stringifyAlloc(allocator, filled, .{});
+}
+
+/// Why `shape` can't be rendered, or null if it can. The caller owns the message.
+pub fn check(allocator: std.mem.Allocator, shape: []const u8) !?[]const u8 {
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    const document = std.json.parseFromSliceLeaky(Value, arena.allocator(), shape, .{}) catch |err| switch (err) {
+        error.OutOfMemory => return err,
+        else => return try std.fmt.allocPrint(allocator, "not valid JSON ({s})", .{@errorName(err)}),
+    };
+    if (try firstBadHint(document)) |hint| {
+        return try std.fmt.allocPrint(allocator, "unknown or malformed hint '{{{{{s}}}}}'", .{hint});
+    }
+    return null;
+}
+
+fn firstBadHint(value: Value) !?[]const u8 {
+    switch (value) {
+        .string => |text| {
+            var rest = text;
+            while (nextHint(rest)) |found| {
+                if (parseHint(found.hint) == null) return found.hint;
+                rest = found.rest;
+            }
+        },
+        .array => |array| for (array.items) |item| {
+            if (try firstBadHint(item)) |hint| return hint;
+        },
+        .object => |object| for (object.values()) |item| {
+            if (try firstBadHint(item)) |hint| return hint;
+        },
+        else => {},
+    }
+    return null;
+}
+
+const FoundHint = struct {
+    /// Text before the hint
+    before: []const u8,
+    /// The hint without its braces, trimmed
+    hint: []const u8,
+    /// Text after the hint
+    rest: []const u8,
+};
+
+fn nextHint(text: []const u8) ?FoundHint {
+    const start = std.mem.indexOf(u8, text, "{{") orelse return null;
+    const end = std.mem.indexOfPos(u8, text, start + 2, "}}") orelse return null;
+    return .{
+        .before = text[0..start],
+        .hint = std.mem.trim(u8, text[start + 2 .. end], " \t"),
+        .rest = text[end + 2 ..],
+    };
+}
+
+fn parseHint(text: []const u8) ?Hint {
+    var parts = std.mem.splitScalar(u8, text, ':');
+    const kind = parts.first();
+    if (std.mem.eql(u8, kind, "int")) {
+        var hint: @FieldType(Hint, "int") = .{};
+        if (parts.next()) |min| {
+            hint.min = std.fmt.parseInt(i64, min, 10) catch return null;
+            hint.max = std.fmt.parseInt(i64, parts.next() orelse return null, 10) catch return null;
+        }
+        if (parts.next() != null or hint.min > hint.max) return null;
+        return .{ .int = hint };
+    }
+    if (std.mem.eql(u8, kind, "float")) {
+        var hint: @FieldType(Hint, "float") = .{};
+        if (parts.next()) |min| {
+            hint.min = std.fmt.parseFloat(f64, min) catch return null;
+            hint.max = std.fmt.parseFloat(f64, parts.next() orelse return null) catch return null;
+        }
+        if (parts.next() != null or !(hint.min <= hint.max)) return null;
+        return .{ .float = hint };
+    }
+    if (parts.next() != null) return null;
+    if (std.mem.eql(u8, kind, "bool")) return .boolean;
+    return .{ .text = std.meta.stringToEnum(Text, kind) orelse return null };
+}
+
+fn fill(arena: std.mem.Allocator, value: Value, random: std.Random) !Value {
+    switch (value) {
+        .string => |text| return fillString(arena, text, random),
+        .array => |array| {
+            var filled = try std.json.Array.initCapacity(arena, array.items.len);
+            for (array.items) |item| filled.appendAssumeCapacity(try fill(arena, item, random));
+            return .{ .array = filled };
+        },
+        .object => |object| {
+            var filled = std.json.ObjectMap.init(arena);
+            var iter = object.iterator();
+            while (iter.next()) |entry| {
+                try filled.put(entry.key_ptr.*, try fill(arena, entry.value_ptr.*, random));
+            }
+            return .{ .object = filled };
+        },
+        else => return value,
+    }
+}
+
+fn fillString(arena: std.mem.Allocator, text: []const u8, random: std.Random) !Value {
+    const first = nextHint(text) orelse return .{ .string = text };
+    if (first.before.len == 0 and first.rest.len == 0) {
+        const hint = parseHint(first.hint) orelse return error.InvalidFakerShape;
+        switch (hint) {
+            .int => |range| return .{ .integer = random.intRangeAtMost(i64, range.min, range.max) },
+            .float => return .{ .number_string = try fakeText(arena, hint, random) },
+            .boolean => return .{ .bool = random.boolean() },
+            .text => return .{ .string = try fakeText(arena, hint, random) },
+        }
+    }
+
+    var out = std.ArrayList(u8).init(arena);
+    var rest = text;
+    while (nextHint(rest)) |found| {
+        try out.appendSlice(found.before);
+        try out.appendSlice(try fakeText(arena, parseHint(found.hint) orelse return error.InvalidFakerShape, random));
+        rest = found.rest;
+    }
+    try out.appendSlice(rest);
+    return .{ .string = out.items };
+}
+
+fn pick(random: std.Random, list: []const []const u8) []const u8 {
+    return list[random.uintLessThan(usize, list.len)];
+}
+
+fn fakeText(arena: std.mem.Allocator, hint: Hint, random: std.Random) ![]const u8 {
+    var out = std.ArrayList(u8).init(arena);
+    const writer = out.writer();
+    switch (hint) {
+        .int => |range| try writer.print("{d}", .{random.intRangeAtMost(i64, range.min, range.max)}),
+        .float => |range| try writer.print("{d:.2}", .{range.min + random.float(f64) * (range.max - range.min)}),
+        .boolean => try writer.writeAll(if (random.boolean()) "true" else "false"),
+        .text => |kind| switch (kind) {
+            .name => try writer.print("{s} {s}", .{ pick(random, &first_names), pick(random, &last_names) }),
+            .first_name => try writer.writeAll(pick(random, &first_names)),
+            .last_name => try writer.writeAll(pick(random, &last_names)),
+            .email => {
+                for (pick(random, &first_names)) |c| try writer.writeByte(std.ascii.toLower(c));
+                try writer.writeByte('.');
+                for (pick(random, &last_names)) |c| try writer.writeByte(std.ascii.toLower(c));
+                try writer.writeAll("@example.com");
+            },
+            .username => {
+                for (pick(random, &first_names)) |c| try writer.writeByte(std.ascii.toLower(c));
+                try writer.print("{d}", .{random.intRangeAtMost(u8, 10, 99)});
+            },
+            .phone => try writer.print("+1-555-{d:0>3}-{d:0>4}", .{ random.uintLessThan(u16, 1000), random.uintLessThan(u16, 10000) }),
+            .company => try writer.writeAll(pick(random, &companies)),
+            .street => try writer.print("{d} {s} {s}", .{ random.intRangeAtMost(u16, 1, 9999), pick(random, &last_names), pick(random, &street_kinds) }),
+            .city => try writer.writeAll(pick(random, &cities)),
+            .country => try writer.writeAll(pick(random, &countries)),
+            .zip => try writer.print("{d:0>5}", .{random.uintLessThan(u32, 100000)}),
+            .word => try writer.writeAll(pick(random, &words)),
+            .sentence => {
+                const count = random.intRangeAtMost(usize, 4, 9);
+                for (0..count) |index| {
+                    const word = pick(random, &words);
+                    if (index == 0) {
+                        try writer.writeByte(std.ascii.toUpper(word[0]));
+                        try writer.writeAll(word[1..]);
+                    } else {
+                        try writer.print(" {s}", .{word});
+                    }
+                }
+                try writer.writeByte('.');
+            },
+            .uuid => try template.writeUuid(writer, random),
+            .url => try writer.print("https://example.com/{s}/{d}", .{ pick(random, &words), random.intRangeAtMost(u16, 1, 999) }),
+            .ipv4 => try writer.print("10.{d}.{d}.{d}", .{ random.int(u8), random.int(u8), random.intRangeAtMost(u8, 1, 254) }),
+            .date, .datetime => {
+                try writer.print("{d}-{d:0>2}-{d:0>2}", .{ random.intRangeAtMost(u16, 2000, 2029), random.intRangeAtMost(u8, 1, 12), random.intRangeAtMost(u8, 1, 28) });
+                if (kind == .datetime) {
+                    try writer.print("T{d:0>2}:{d:0>2}:{d:0>2}Z", .{ random.uintLessThan(u8, 24), random.uintLessThan(u8, 60), random.uintLessThan(u8, 60) });
+                }
+            },
+        },
+    }
+    return out.items;
+}
+
+test "render fills the shape with typed values" {
+    const allocator = std.testing.allocator;
+    var prng = std.Random.DefaultPrng.init(42);
+
+    const shape =
+        \\{"id": "{{uuid}}", "name": "{{name}}", "email": "{{email}}", "age": "{{int:18:65}}",
+        \\ "score": "{{float:0:5}}", "active": "{{bool}}", "kind": "user", "since": "{{date}}",
+        \\ "tags": ["{{word}}", "fixed"], "address": {"city": "{{city}}", "line": "{{int:1:99}} {{street}}"}, "limit": 10}
+    ;
+    const body = try render(allocator, shape, prng.random());
+    defer allocator.free(body);
+
+    const parsed = try std.json.parseFromSlice(Value, allocator, body, .{});
+    defer parsed.deinit();
+    const user = parsed.value.object;
+
+    try std.testing.expectEqual(@as(usize, 36), user.get("id").?.string.len);
+    try std.testing.expect(std.mem.indexOfScalar(u8, user.get("name").?.string, ' ') != null);
+    try std.testing.expect(std.mem.endsWith(u8, user.get("email").?.string, "@example.com"));
+    const age = user.get("age").?.integer;
+    try std.testing.expect(age >= 18 and age <= 65);
+    const score = switch (user.get("score").?) {
+        .float => |f| f,
+        .integer => |i| @as(f64, @floatFromInt(i)),
+        else => return error.TestUnexpectedResult,
+    };
+    try std.testing.expect(score >= 0 and score <= 5);
+    try std.testing.expect(user.get("active").? == .bool);
+    try std.testing.expectEqualStrings("user", user.get("kind").?.string);
+    try std.testing.expectEqual(@as(usize, 10), user.get("since").?.string.len);
+    try std.testing.expectEqual(@as(usize, 2), user.get("tags").?.array.items.len);
+    try std.testing.expectEqualStrings("fixed", user.get("tags").?.array.items[1].string);
+    try std.testing.expect(user.get("address").?.object.get("city").? == .string);
+    // Hints inside longer strings render as text
+    try std.testing.expect(std.ascii.isDigit(user.get("address").?.object.get("line").?.string[0]));
+    try std.testing.expectEqual(@as(i64, 10), user.get("limit").?.integer);
+}
+
+test "render is deterministic for a seed" {
+    const allocator = std.testing.allocator;
+    const shape = "[\"{{name}}\", \"{{int}}\", \"{{sentence}}\", \"{{datetime}}\"]";
+
+    var first_prng = std.Random.DefaultPrng.init(7);
+    const first = try render(allocator, shape, first_prng.random());
+    defer allocator.free(first);
+    var second_prng = std.Random.DefaultPrng.init(7);
+    const second = try render(allocator, shape, second_prng.random());
+    defer allocator.free(second);
+    try std.testing.expectEqualStrings(first, second);
+}
+
+test "check" {
+    const allocator = std.testing.allocator;
+    try std.testing.expect(try check(allocator, "{\"a\": \"{{int:1:2}}\", \"b\": [\"{{ phone }}\"]}") == null);
+
+    const cases = [_]struct { shape: []const u8, message: []const u8 }{
+        .{ .shape = "{\"a\": \"{{nickname}}\"}", .message = "unknown or malformed hint '{{nickname}}'" },
+        .{ .shape = "{\"a\": \"{{int:9:1}}\"}", .message = "unknown or malformed hint '{{int:9:1}}'" },
+        .{ .shape = "{\"a\": \"{{email:x}}\"}", .message = "unknown or malformed hint '{{email:x}}'" },
+        .{ .shape = "{\"a\": ", .message = "not valid JSON (UnexpectedEndOfInput)" },
+    };
+    for (cases) |case| {
+        const message = (try check(allocator, case.shape)).?;
+        defer allocator.free(message);
+        try std.testing.expectEqualStrings(case.message, message);
+    }
+}
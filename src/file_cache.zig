@@ -0,0 +1,92 @@
+const std = @import("std");
+
+/// Cache of file contents that re-reads a file only when its modification time changes.
+/// Safe to share between request handler threads.
+pub const FileCache = struct {
+    allocator: std.mem.Allocator,
+    entries: std.StringHashMap(Entry),
+    mutex: std.Thread.Mutex = .{},
+
+    /// Largest file that will be served from the cache
+    pub const max_file_size = 10 * 1024 * 1024; // 10MB
+
+    const Entry = struct {
+        mtime: i128,
+        content: []const u8,
+    };
+
+    pub fn init(allocator: std.mem.Allocator) FileCache {
+        return FileCache{
+            .allocator = allocator,
+            .entries = std.StringHashMap(Entry).init(allocator),
+        };
+    }
+
+    pub fn deinit(self: *FileCache) void {
+        var iter = self.entries.iterator();
+        while (iter.next()) |entry| {
+            self.allocator.free(entry.key_ptr.*);
+            self.allocator.free(entry.value_ptr.content);
+        }
+        self.entries.deinit();
+    }
+
+    /// Return the contents of `path`, copied into `arena` so the result stays
+    /// valid even if another request refreshes the cache entry.
+    pub fn read(self: *FileCache, arena: std.mem.Allocator, path: []const u8) ![]const u8 {
+        const file = try std.fs.cwd().openFile(path, .{});
+        defer file.close();
+        const stat = try file.stat();
+
+        self.mutex.lock();
+        defer self.mutex.unlock();
+
+        const result = try self.entries.getOrPut(path);
+        if (result.found_existing) {
+            if (result.value_ptr.mtime == stat.mtime) {
+                return arena.dupe(u8, result.value_ptr.content);
+            }
+        } else {
+            result.key_ptr.* = self.allocator.dupe(u8, path) catch |err| {
+                self.entries.removeByPtr(result.key_ptr);
+                return err;
+            };
+            // Placeholder that never matches a real mtime, so a failed read is retried
+            result.value_ptr.* = .{ .mtime = std.math.minInt(i128), .content = "" };
+        }
+
+        const content = try file.readToEndAlloc(self.allocator, max_file_size);
+        self.allocator.free(result.value_ptr.content);
+        result.value_ptr.* = .{ .mtime = stat.mtime, .content = content };
+
+        return arena.dupe(u8, content);
+    }
+};
+
+test "FileCache.read refreshes on mtime change" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+
+    try tmp.dir.writeFile(.{ .sub_path = "body.json", .data = "{\"v\": 1}" });
+    const path = try tmp.dir.realpathAlloc(allocator, "body.json");
+    defer allocator.free(path);
+
+    var cache = FileCache.init(allocator);
+    defer cache.deinit();
+
+    try std.testing.expectEqualStrings("{\"v\": 1}", try cache.read(arena.allocator(), path));
+
+    // Rewrite the file with a later mtime so the cache notices the change
+    try tmp.dir.writeFile(.{ .sub_path = "body.json", .data = "{\"v\": 2}" });
+    const file = try tmp.dir.openFile("body.json", .{ .mode = .read_write });
+    defer file.close();
+    const stat = try file.stat();
+    try file.updateTimes(stat.atime, stat.mtime + std.time.ns_per_s);
+
+    try std.testing.expectEqualStrings("{\"v\": 2}", try cache.read(arena.allocator(), path));
+    try std.testing.expectEqual(@as(u32, 1), cache.entries.count());
+}
@@ -0,0 +1,418 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+
+const Request = interfaces.Request;
+const Response = interfaces.Response;
+const HeaderMap = interfaces.HeaderMap;
+
+/// Records served traffic as an HTTP Archive (HAR 1.2) that browser devtools
+/// and other tools can import. Handlers serialize entries into a buffer and a
+/// background thread appends them to the file every `flush_interval_ms`,
+/// rewriting the closing brackets after them, so the file is a complete HAR
+/// after every flush and not only once the server stops. As with the access
+/// log, entries beyond `max_pending` are dropped rather than making requests wait.
+pub const HarLog = struct {
+    allocator: std.mem.Allocator,
+    file: std.fs.File,
+    options: Options,
+    mutex: std.Thread.Mutex = .{},
+    condition: std.Thread.Condition = .{},
+    /// Serialized entries, each preceded by a comma
+    pending: std.ArrayList(u8),
+    /// Entries in `pending`
+    queued: usize = 0,
+    /// Entries in the file, to know whether the next one needs its comma;
+    /// only the writer touches it
+    written: usize = 0,
+    dropped: usize = 0,
+    should_stop: bool = false,
+    thread: ?std.Thread = null,
+    /// Where the closing brackets start, and so where the next entries go
+    trailer_offset: u64,
+
+    pub const Options = struct {
+        /// Bodies longer than this are cut off; the entry's comment says so
+        max_body_size: usize = 64 * 1024,
+        flush_interval_ms: u64 = 1000,
+    };
+
+    /// Most buffered output before new entries are dropped
+    pub const max_pending = 4 * 1024 * 1024; // 4MB
+
+    const header = "{\"log\":{\"version\":\"1.2\",\"creator\":{\"name\":\"popshop\",\"version\":\"0.1.0\"},\"entries\":[";
+    const trailer = "\n]}}\n";
+
+    /// Create `path`, replacing any earlier capture, with an empty log
+    pub fn init(allocator: std.mem.Allocator, path: []const u8, options: Options) !HarLog {
+        const file = std.fs.cwd().createFile(path, .{ .truncate = true }) catch |err| {
+            std.log.err("Failed to create HAR file {s}: {}", .{ path, err });
+            return err;
+        };
+        errdefer file.close();
+        try file.writeAll(header ++ trailer);
+
+        return HarLog{
+            .allocator = allocator,
+            .file = file,
+            .options = options,
+            .pending = std.ArrayList(u8).init(allocator),
+            .trailer_offset = header.len,
+        };
+    }
+
+    pub fn start(self: *HarLog) !void {
+        self.thread = try std.Thread.spawn(.{}, run, .{self});
+    }
+
+    /// Write the remaining entries, stop the writer thread and close the file
+    pub fn deinit(self: *HarLog) void {
+        if (self.thread) |thread| {
+            self.mutex.lock();
+            self.should_stop = true;
+            self.condition.signal();
+            self.mutex.unlock();
+            thread.join();
+        }
+        // Anything recorded without a writer thread, as in tests
+        self.flush(self.pending.items, self.queued, self.dropped);
+        self.pending.deinit();
+        self.file.close();
+    }
+
+    /// Queue an exchange that started at `started_ms` (milliseconds since the
+    /// epoch); serializing uses the request arena and never blocks on I/O
+    pub fn record(self: *HarLog, request: *const Request, response: *const Response, started_ms: i64, duration_ns: u64) void {
+        var entry = std.ArrayList(u8).init(request.arena);
+        writeEntry(request.arena, entry.writer(), request, response, started_ms, duration_ns, self.options.max_body_size) catch {
+            self.mutex.lock();
+            defer self.mutex.unlock();
+            self.dropped += 1;
+            return;
+        };
+
+        self.mutex.lock();
+        defer self.mutex.unlock();
+
+        if (self.pending.items.len + 1 + entry.items.len > max_pending) {
+            self.dropped += 1;
+            return;
+        }
+        self.pending.ensureUnusedCapacity(1 + entry.items.len) catch {
+            self.dropped += 1;
+            return;
+        };
+        self.pending.appendAssumeCapacity(',');
+        self.pending.appendSliceAssumeCapacity(entry.items);
+        self.queued += 1;
+    }
+
+    fn run(self: *HarLog) void {
+        var batch = std.ArrayList(u8).init(self.allocator);
+        defer batch.deinit();
+
+        while (true) {
+            self.mutex.lock();
+            if (!self.should_stop) {
+                self.condition.timedWait(&self.mutex, self.options.flush_interval_ms * std.time.ns_per_ms) catch {};
+            }
+            std.mem.swap(std.ArrayList(u8), &batch, &self.pending);
+            const count = self.queued;
+            self.queued = 0;
+            const dropped = self.dropped;
+            self.dropped = 0;
+            const stopping = self.should_stop;
+            self.mutex.unlock();
+
+            self.flush(batch.items, count, dropped);
+            batch.clearRetainingCapacity();
+
+            if (stopping) break;
+        }
+    }
+
+    /// Write `count` entries over the old trailer and put the trailer back
+    /// after them. Entries that fail to write are lost, and the next flush
+    /// starts over from the old trailer. Only the writer thread calls this
+    /// while the server runs.
+    fn flush(self: *HarLog, entries: []const u8, count: usize, dropped: usize) void {
+        if (dropped > 0) {
+            std.log.warn("HAR log dropped {d} entries while the writer was behind", .{dropped});
+        }
+        if (count == 0) return;
+
+        // The first entry in the file goes without its comma
+        const data = if (self.written == 0) entries[1..] else entries;
+        self.writeAfterEntries(data) catch |err| {
+            std.log.warn("Failed to write {d} HAR entries: {}", .{ count, err });
+            return;
+        };
+        self.trailer_offset += data.len;
+        self.written += count;
+    }
+
+    fn writeAfterEntries(self: *HarLog, data: []const u8) !void {
+        try self.file.pwriteAll(data, self.trailer_offset);
+        try self.file.pwriteAll(trailer, self.trailer_offset + data.len);
+        // Cut off whatever a failed flush left beyond the trailer
+        try self.file.setEndPos(self.trailer_offset + data.len + trailer.len);
+    }
+};
+
+/// One HAR entry object, on its own line. Only the headers popshop has are
+/// known, so header and cookie sizes are reported as unknown (-1).
+fn writeEntry(
+    arena: std.mem.Allocator,
+    writer: anytype,
+    request: *const Request,
+    response: *const Response,
+    started_ms: i64,
+    duration_ns: u64,
+    max_body_size: usize,
+) !void {
+    const time_ms = @as(f64, @floatFromInt(duration_ns)) / std.time.ns_per_ms;
+
+    try writer.writeAll("\n{\"startedDateTime\":\"");
+    try writeDateTime(writer, started_ms);
+    try writer.print("\",\"time\":{d:.3},\"request\":{{\"method\":", .{time_ms});
+    try std.json.encodeJsonString(request.method.toString(), .{}, writer);
+
+    const url = try std.fmt.allocPrint(arena, "http://{s}{s}{s}{s}", .{
+        request.getHeader("Host") orelse "localhost",
+        request.path,
+        if (request.query.len > 0) "?" else "",
+        request.query,
+    });
+    try writer.writeAll(",\"url\":");
+    try std.json.encodeJsonString(url, .{}, writer);
+    try writer.writeAll(",\"httpVersion\":\"HTTP/1.1\",\"cookies\":[],\"headers\":");
+    try writeHeaders(writer, &request.headers, &.{});
+
+    try writer.writeAll(",\"queryString\":[");
+    var query = request.queryParams();
+    var first = true;
+    while (try query.next()) |param| : (first = false) {
+        if (!first) try writer.writeAll(",");
+        try writeNameValue(writer, param.name, param.value);
+    }
+    try writer.writeAll("]");
+
+    if (request.body.len > 0) {
+        try writer.writeAll(",\"postData\":{\"mimeType\":");
+        try std.json.encodeJsonString(request.getHeader("Content-Type") orelse "", .{}, writer);
+        try writeBodyText(writer, request.body, max_body_size);
+        try writer.writeAll("}");
+    }
+    try writer.print(",\"headersSize\":-1,\"bodySize\":{d}}}", .{request.body.len});
+
+    if (response.reset_connection) {
+        // Recorded the way browsers record a request that got no answer
+        try writer.writeAll(",\"response\":{\"status\":0,\"statusText\":\"\",\"httpVersion\":\"\",\"cookies\":[],\"headers\":[],\"content\":{\"size\":0,\"mimeType\":\"\"},\"redirectURL\":\"\",\"headersSize\":-1,\"bodySize\":-1,\"_error\":\"connection reset\"}");
+    } else {
+        try writeResponse(arena, writer, response, max_body_size);
+    }
+
+    try writer.print(",\"cache\":{{}},\"timings\":{{\"send\":0,\"wait\":{d:.3},\"receive\":0}}}}", .{time_ms});
+}
+
+fn writeResponse(arena: std.mem.Allocator, writer: anytype, response: *const Response, max_body_size: usize) !void {
+    // Streamed bodies are recorded as if sent in one piece
+    var body = response.body;
+    if (response.chunks) |chunks| {
+        var joined = std.ArrayList(u8).init(arena);
+        for (chunks) |chunk| try joined.appendSlice(chunk.data);
+        body = joined.items;
+    }
+
+    try writer.print(",\"response\":{{\"status\":{d},\"statusText\":", .{@intFromEnum(response.status)});
+    try std.json.encodeJsonString(response.status.phrase(), .{}, writer);
+    try writer.writeAll(",\"httpVersion\":\"HTTP/1.1\",\"cookies\":[");
+    for (response.set_cookies.items, 0..) |cookie, index| {
+        if (index > 0) try writer.writeAll(",");
+        const pair_end = std.mem.indexOfScalar(u8, cookie, ';') orelse cookie.len;
+        const separator = std.mem.indexOfScalar(u8, cookie[0..pair_end], '=') orelse pair_end;
+        try writeNameValue(writer, cookie[0..separator], cookie[@min(separator + 1, pair_end)..pair_end]);
+    }
+    try writer.writeAll("],\"headers\":");
+    try writeHeaders(writer, &response.headers, response.set_cookies.items);
+    try writer.print(",\"content\":{{\"size\":{d},\"mimeType\":", .{body.len});
+    try std.json.encodeJsonString(response.getHeader("Content-Type") orelse "", .{}, writer);
+    try writeBodyText(writer, body, max_body_size);
+    try writer.writeAll("},\"redirectURL\":");
+    try std.json.encodeJsonString(response.getHeader("Location") orelse "", .{}, writer);
+    try writer.print(",\"headersSize\":-1,\"bodySize\":{d}}}", .{body.len});
+}
+
+fn writeHeaders(writer: anytype, headers: *const HeaderMap, set_cookies: []const []const u8) !void {
+    try writer.writeAll("[");
+    var iter = headers.iterator();
+    var first = true;
+    while (iter.next()) |header| : (first = false) {
+        if (!first) try writer.writeAll(",");
+        try writeNameValue(writer, header.key_ptr.*, header.value_ptr.*);
+    }
+    for (set_cookies) |cookie| {
+        if (!first) try writer.writeAll(",");
+        first = false;
+        try writeNameValue(writer, "Set-Cookie", cookie);
+    }
+    try writer.writeAll("]");
+}
+
+fn writeNameValue(writer: anytype, name: []const u8, value: []const u8) !void {
+    try writer.writeAll("{\"name\":");
+    try std.json.encodeJsonString(name, .{}, writer);
+    try writer.writeAll(",\"value\":");
+    try std.json.encodeJsonString(value, .{}, writer);
+    try writer.writeAll("}");
+}
+
+/// The `text` of a body, cut to `max_size`. Binary bodies, such as gzipped
+/// responses, are left out; a `comment` notes either change.
+fn writeBodyText(writer: anytype, body: []const u8, max_size: usize) !void {
+    if (!std.unicode.utf8ValidateSlice(body) or std.mem.indexOfScalar(u8, body, 0) != null) {
+        try writer.print(",\"text\":\"\",\"comment\":\"binary body of {d} bytes redacted\"", .{body.len});
+        return;
+    }
+    if (body.len <= max_size) {
+        try writer.writeAll(",\"text\":");
+        try std.json.encodeJsonString(body, .{}, writer);
+        return;
+    }
+
+    // Don't cut a UTF-8 sequence in half
+    var end = max_size;
+    while (end > 0 and (body[end] & 0xc0) == 0x80) end -= 1;
+    try writer.writeAll(",\"text\":");
+    try std.json.encodeJsonString(body[0..end], .{}, writer);
+    try writer.print(",\"comment\":\"truncated to {d} of {d} bytes\"", .{ end, body.len });
+}
+
+/// `2006-01-02T15:04:05.000Z` for a time in milliseconds since the epoch
+fn writeDateTime(writer: anytype, ms: i64) !void {
+    const clamped: u64 = @intCast(@max(0, ms));
+    const epoch_seconds = std.time.epoch.EpochSeconds{ .secs = clamped / std.time.ms_per_s };
+    const year_day = epoch_seconds.getEpochDay().calculateYearDay();
+    const month_day = year_day.calculateMonthDay();
+    const day_seconds = epoch_seconds.getDaySeconds();
+    try writer.print("{d:0>4}-{d:0>2}-{d:0>2}T{d:0>2}:{d:0>2}:{d:0>2}.{d:0>3}Z", .{
+        year_day.year,
+        month_day.month.numeric(),
+        month_day.day_index + 1,
+        day_seconds.getHoursIntoDay(),
+        day_seconds.getMinutesIntoHour(),
+        day_seconds.getSecondsIntoMinute(),
+        clamped % std.time.ms_per_s,
+    });
+}
+
+test "HarLog writes a valid archive" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const path = try tmp.dir.realpathAlloc(arena.allocator(), ".");
+    const har_path = try std.fs.path.join(arena.allocator(), &.{ path, "traffic.har" });
+
+    var har_log = try HarLog.init(allocator, har_path, .{ .max_body_size = 8 });
+
+    var request = Request{
+        .method = .POST,
+        .path = "/api/users",
+        .query = "page=2&q=a+b",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "{\"name\":\"jane\"}",
+        .arena = arena.allocator(),
+    };
+    try request.headers.put("Host", "localhost:8080");
+    try request.headers.put("Content-Type", "application/json");
+
+    var response = Response.init(arena.allocator(), .created);
+    try response.setHeader("Content-Type", "application/json");
+    response.body = "{\"id\":1}";
+    har_log.record(&request, &response, 1_700_000_000_123, 2_500_000);
+
+    var binary = Response.init(arena.allocator(), .ok);
+    binary.body = "\x1f\x8b\x08\x00";
+    request.method = .GET;
+    request.body = "";
+    har_log.record(&request, &binary, 1_700_000_000_500, 1_000_000);
+
+    var reset = Response.init(arena.allocator(), .bad_gateway);
+    reset.reset_connection = true;
+    har_log.record(&request, &reset, 1_700_000_000_900, 0);
+    har_log.deinit();
+
+    const content = try tmp.dir.readFileAlloc(arena.allocator(), "traffic.har", 1024 * 1024);
+    const parsed = try std.json.parseFromSlice(std.json.Value, arena.allocator(), content, .{});
+    const log = parsed.value.object.get("log").?.object;
+    try std.testing.expectEqualStrings("1.2", log.get("version").?.string);
+    const entries = log.get("entries").?.array.items;
+    try std.testing.expectEqual(@as(usize, 3), entries.len);
+
+    const first = entries[0].object;
+    try std.testing.expectEqualStrings("2023-11-14T22:13:20.123Z", first.get("startedDateTime").?.string);
+    const first_request = first.get("request").?.object;
+    try std.testing.expectEqualStrings("http://localhost:8080/api/users?page=2&q=a+b", first_request.get("url").?.string);
+    try std.testing.expectEqualStrings("a b", first_request.get("queryString").?.array.items[1].object.get("value").?.string);
+    const post_data = first_request.get("postData").?.object;
+    try std.testing.expectEqualStrings("{\"name\":", post_data.get("text").?.string);
+    try std.testing.expectEqualStrings("truncated to 8 of 15 bytes", post_data.get("comment").?.string);
+
+    const first_response = first.get("response").?.object;
+    try std.testing.expectEqual(@as(i64, 201), first_response.get("status").?.integer);
+    try std.testing.expectEqualStrings("{\"id\":1}", first_response.get("content").?.object.get("text").?.string);
+
+    const redacted = entries[1].object.get("response").?.object.get("content").?.object;
+    try std.testing.expectEqualStrings("", redacted.get("text").?.string);
+    try std.testing.expectEqualStrings("binary body of 4 bytes redacted", redacted.get("comment").?.string);
+
+    // A reset connection has no status, as in browser captures
+    const unanswered = entries[2].object.get("response").?.object;
+    try std.testing.expectEqual(@as(i64, 0), unanswered.get("status").?.integer);
+    try std.testing.expectEqualStrings("connection reset", unanswered.get("_error").?.string);
+}
+
+test "HarLog keeps the archive valid after a failed write" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const path = try tmp.dir.realpathAlloc(arena.allocator(), ".");
+    const har_path = try std.fs.path.join(arena.allocator(), &.{ path, "traffic.har" });
+
+    var har_log = try HarLog.init(allocator, har_path, .{});
+
+    var request = Request{
+        .method = .GET,
+        .path = "/lost",
+        .query = "",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "",
+        .arena = arena.allocator(),
+    };
+    var response = Response.init(arena.allocator(), .ok);
+    har_log.record(&request, &response, 1_700_000_000_000, 0);
+
+    // Flush the first entry through a read-only handle, as the writer thread would
+    const writable = har_log.file;
+    har_log.file = try tmp.dir.openFile("traffic.har", .{});
+    har_log.flush(har_log.pending.items, har_log.queued, 0);
+    har_log.pending.clearRetainingCapacity();
+    har_log.queued = 0;
+    har_log.file.close();
+    har_log.file = writable;
+
+    request.path = "/kept";
+    har_log.record(&request, &response, 1_700_000_000_100, 0);
+    har_log.deinit();
+
+    const content = try tmp.dir.readFileAlloc(arena.allocator(), "traffic.har", 1024 * 1024);
+    const parsed = try std.json.parseFromSlice(std.json.Value, arena.allocator(), content, .{});
+    const entries = parsed.value.object.get("log").?.object.get("entries").?.array.items;
+    try std.testing.expectEqual(@as(usize, 1), entries.len);
+    try std.testing.expectEqualStrings("http://localhost/kept", entries[0].object.get("request").?.object.get("url").?.string);
+}
@@ -11,11 +11,18 @@ const MiddlewareFn = interfaces.MiddlewareFn;
 const Server = interfaces.Server;
 const ServerConfig = interfaces.ServerConfig;
 const HeaderMap = interfaces.HeaderMap;
+const Chunk = interfaces.Chunk;
+const WebSocketScript = interfaces.WebSocketScript;
+const websocket = httpz.websocket;
 
 /// HttpZ server implementation
 pub const HttpZServer = struct {
     allocator: std.mem.Allocator,
     http_server: ?*httpz.Server(RequestContext) = null,
+    /// Guards `http_server` and `stop_requested`, which `stop` uses from another thread
+    server_mutex: std.Thread.Mutex = .{},
+    /// Set by a `stop` that arrives before the server is listening
+    stop_requested: bool = false,
     config: ServerConfig = .{},
     routes: std.ArrayList(Route),
     middlewares: std.ArrayList(MiddlewareFn),
@@ -30,6 +37,9 @@ pub const HttpZServer = struct {
     const RequestContext = struct {
         arena: std.heap.ArenaAllocator,
         server: *HttpZServer,
+
+        /// Tells httpz which type handles upgraded connections
+        pub const WebsocketHandler = WebSocketSession;
     };
 
     pub fn init(allocator: std.mem.Allocator) !HttpZServer {
@@ -42,9 +52,6 @@ pub const HttpZServer = struct {
     }
 
     pub fn deinit(self: *HttpZServer) void {
-        if (self.http_server) |s| {
-            s.deinit();
-        }
         self.routes.deinit();
         self.middlewares.deinit();
         self.route_handlers.deinit();
@@ -63,40 +70,108 @@ pub const HttpZServer = struct {
         };
     }
 
+    /// Serve until `stop` is called. Blocks the calling thread; on return the
+    /// worker threads have finished the requests they were handling.
     fn start(ptr: *anyopaque, config: ServerConfig) !void {
         const self: *HttpZServer = @ptrCast(@alignCast(ptr));
         self.config = config;
 
         // Create httpz server
-        var http_server = try httpz.Server(RequestContext).init(self.allocator, .{
-            .address = config.host,
-            .port = config.port,
-            .request = .{
-                .max_body_size = config.max_request_size,
-            },
-        }, RequestContext{
+        const http_server = try self.allocator.create(httpz.Server(RequestContext));
+        defer self.allocator.destroy(http_server);
+        if (config.socket_path) |socket_path| {
+            try removeStaleSocket(socket_path);
+        }
+
+        http_server.* = try httpz.Server(RequestContext).init(self.allocator, listenerConfig(config), RequestContext{
             .arena = std.heap.ArenaAllocator.init(self.allocator),
             .server = self,
         });
 
+        defer http_server.deinit();
+
         // Setup routes
         for (self.routes.items) |route| {
-            try self.setupRoute(&http_server, route);
+            try self.setupRoute(http_server, route);
         }
 
-        // CORS and error handling is implemented in the genericHandler
+        // Error handling is implemented in the genericHandler; CORS is handled by the app
+
+        // Publish the server so stop() can reach it, then serve until stopped
+        self.server_mutex.lock();
+        if (self.stop_requested) {
+            self.server_mutex.unlock();
+            return;
+        }
+        self.http_server = http_server;
+        self.server_mutex.unlock();
+        defer {
+            self.server_mutex.lock();
+            self.http_server = null;
+            self.server_mutex.unlock();
+        }
 
-        // Start the server
         try http_server.listen();
-        self.http_server = &http_server;
     }
 
+    /// The httpz settings for `config`. httpz counts timeouts in whole
+    /// seconds, so they are rounded up, and has no write timeout of its own;
+    /// `genericHandler` sets that on each connection's socket.
+    fn listenerConfig(config: ServerConfig) httpz.Config {
+        return .{
+            .address = if (config.host.len == 0) "0.0.0.0" else config.host,
+            .port = config.port,
+            .unix_path = config.socket_path,
+            .request = .{
+                .max_body_size = config.max_request_size,
+            },
+            .timeout = .{
+                .request = timeoutSeconds(config.read_timeout_ms),
+                .keepalive = timeoutSeconds(config.idle_timeout_ms),
+            },
+        };
+    }
+
+    fn timeoutSeconds(timeout_ms: u64) ?u32 {
+        if (timeout_ms == 0) return null;
+        return @intCast(@min((timeout_ms + 999) / 1000, std.math.maxInt(u32)));
+    }
+
+    /// Bound how long a blocking write to the client may stall
+    fn setWriteTimeout(socket: std.posix.socket_t, timeout_ms: u64) void {
+        const timeout = std.posix.timeval{
+            .sec = @intCast(timeout_ms / 1000),
+            .usec = @intCast((timeout_ms % 1000) * 1000),
+        };
+        std.posix.setsockopt(socket, std.posix.SOL.SOCKET, std.posix.SO.SNDTIMEO, std.mem.asBytes(&timeout)) catch |err| {
+            std.log.debug("Failed to set the write timeout: {}", .{err});
+        };
+    }
+
+    /// Delete a socket file left behind by a previous run, which would make
+    /// the bind fail. Anything other than a socket at that path is left alone.
+    fn removeStaleSocket(path: []const u8) !void {
+        const stat = std.fs.cwd().statFile(path) catch |err| switch (err) {
+            error.FileNotFound => return,
+            else => return err,
+        };
+        if (stat.kind != .unix_domain_socket) {
+            std.log.err("Socket path {s} exists and is not a socket", .{path});
+            return error.SocketPathInUse;
+        }
+        std.log.debug("Removing stale socket {s}", .{path});
+        try std.fs.cwd().deleteFile(path);
+    }
+
+    /// Stop accepting connections and make `start` return once in-flight
+    /// requests are done. Safe to call from any thread.
     fn stop(ptr: *anyopaque) !void {
         const self: *HttpZServer = @ptrCast(@alignCast(ptr));
+        self.server_mutex.lock();
+        defer self.server_mutex.unlock();
+        self.stop_requested = true;
         if (self.http_server) |s| {
             s.stop();
-            s.deinit();
-            self.http_server = null;
         }
     }
 
@@ -143,15 +218,8 @@ pub const HttpZServer = struct {
     
     fn genericHandler(ctx: RequestContext, req: *httpz.Request, res: *httpz.Response) !void {
         const server_instance = ctx.server;
-        
-        // Handle CORS preflight requests (OPTIONS)
-        if (req.method == .OPTIONS) {
-            res.header("Access-Control-Allow-Origin", "*");
-            res.header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, PATCH, OPTIONS");
-            res.header("Access-Control-Allow-Headers", "Content-Type, Authorization");
-            res.status = 200;
-            res.body = "";
-            return;
+        if (server_instance.config.write_timeout_ms > 0) {
+            setWriteTimeout(res.conn.stream.handle, server_instance.config.write_timeout_ms);
         }
         
         // Create route key from request method only (since we use wildcard paths)
@@ -161,8 +229,6 @@ pub const HttpZServer = struct {
         // Look up the handler (should always be found since we register all methods)
         const handler = server_instance.route_handlers.get(route_key) orelse {
             std.log.warn("No handler found for method: {s}", .{method_str});
-            // Add CORS headers to 404 responses too
-            res.header("Access-Control-Allow-Origin", "*");
             res.status = 404;
             res.body = "Method not supported";
             return;
@@ -171,28 +237,113 @@ pub const HttpZServer = struct {
         // Convert httpz request to interface request  
         var interface_req = try convertRequest(req, req.arena);
         defer interface_req.deinit();
+        interface_req.listener = server_instance.config.listener;
         
-        // Call the actual handler (with error handling)
-        var interface_res = handler(&interface_req) catch |err| {
+        // Call the actual handler through the middlewares, first registered outermost
+        const next = interfaces.Next{ .middlewares = server_instance.middlewares.items, .handler = handler };
+        var interface_res = next.handle(&interface_req) catch |err| {
             std.log.err("Request handler error: {}", .{err});
-            res.header("Access-Control-Allow-Origin", "*");
             res.status = 500;
             res.body = "Internal Server Error";
             return;
         };
         defer interface_res.deinit();
+
+        if (interface_res.delay_ms > 0 and !server_instance.waitOutDelay(res.conn.stream.handle, interface_res.delay_ms)) {
+            interface_res.finish();
+            std.log.debug("Client went away during a {d}ms delay", .{interface_res.delay_ms});
+            std.posix.shutdown(res.conn.stream.handle, .both) catch {};
+            return;
+        }
+        // The slot covers the delay but not the sending
+        interface_res.finish();
+
+        if (interface_res.websocket) |script| {
+            const session_ctx = WebSocketSession.Context{ .allocator = server_instance.allocator, .script = script };
+            if (!try httpz.upgradeWebsocket(WebSocketSession, req, res, &session_ctx)) {
+                res.status = 400;
+                res.body = "Invalid WebSocket upgrade";
+            }
+            return;
+        }
         
-        // Convert interface response to httpz response (includes CORS headers)
-        try convertResponse(res, interface_res);
+        // Convert interface response to httpz response
+        try convertResponse(res, interface_res, req.protocol == .HTTP10, req.method == .HEAD, clientCloses(req));
+    }
+
+    /// Delays are waited out in slices this long, checking in between
+    /// whether the server is stopping or the client has hung up
+    const delay_slice_ms = 10;
+
+    /// Wait `delay_ms` before sending a response, cut short once the server
+    /// is stopping so a shutdown doesn't wait out every pending delay.
+    /// Returns false if the client hung up meanwhile.
+    fn waitOutDelay(self: *HttpZServer, socket: std.posix.socket_t, delay_ms: u64) bool {
+        var remaining_ms = delay_ms;
+        while (remaining_ms > 0 and !self.isStopping()) {
+            const slice_ms = @min(remaining_ms, delay_slice_ms);
+            if (clientHungUp(socket, slice_ms)) return false;
+            remaining_ms -= slice_ms;
+        }
+        return true;
+    }
+
+    fn isStopping(self: *HttpZServer) bool {
+        self.server_mutex.lock();
+        defer self.server_mutex.unlock();
+        return self.stop_requested;
+    }
+
+    /// Wait up to `timeout_ms` for the client to close its end of the
+    /// connection. Bytes it sends meanwhile, such as a pipelined request,
+    /// are left for httpz to read. A client that half-closes after sending
+    /// its request looks the same and isn't answered.
+    fn clientHungUp(socket: std.posix.socket_t, timeout_ms: u64) bool {
+        var fds = [_]std.posix.pollfd{.{ .fd = socket, .events = std.posix.POLL.IN, .revents = 0 }};
+        const ready = std.posix.poll(&fds, @intCast(timeout_ms)) catch {
+            std.time.sleep(timeout_ms * std.time.ns_per_ms);
+            return false;
+        };
+        if (ready == 0) return false;
+        if (fds[0].revents & (std.posix.POLL.HUP | std.posix.POLL.ERR) != 0) return true;
+
+        var peeked: [1]u8 = undefined;
+        const read = std.posix.recv(socket, &peeked, std.posix.MSG.PEEK | std.posix.MSG.DONTWAIT) catch |err| switch (err) {
+            error.WouldBlock => return false,
+            else => return true,
+        };
+        if (read == 0) return true;
+        // Unread bytes keep the socket readable, so polling again would return at once
+        std.time.sleep(timeout_ms * std.time.ns_per_ms);
+        return false;
+    }
+
+    /// Whether the request asked for its connection to be closed, which
+    /// httpz does whatever the response says
+    fn clientCloses(req: *httpz.Request) bool {
+        const connection = req.header("connection") orelse return false;
+        var tokens = std.mem.splitScalar(u8, connection, ',');
+        while (tokens.next()) |token| {
+            if (std.ascii.eqlIgnoreCase(std.mem.trim(u8, token, " \t"), "close")) return true;
+        }
+        return false;
     }
 
     fn convertRequest(req: *httpz.Request, arena: std.mem.Allocator) !Request {
         var headers = HeaderMap.init(arena);
         
-        // Convert headers - httpz headers are key-value pairs
+        // Convert headers - httpz headers are key-value pairs. Repeated
+        // headers are combined into one value, cookies with "; " as in a
+        // single Cookie header and anything else with ", ".
         var header_it = req.headers.iterator();
         while (header_it.next()) |kv| {
-            try headers.put(kv.key, kv.value);
+            const entry = try headers.getOrPut(kv.key);
+            if (!entry.found_existing) {
+                entry.value_ptr.* = kv.value;
+                continue;
+            }
+            const separator = if (std.ascii.eqlIgnoreCase(kv.key, "Cookie")) "; " else ", ";
+            entry.value_ptr.* = try std.fmt.allocPrint(arena, "{s}{s}{s}", .{ entry.value_ptr.*, separator, kv.value });
         }
 
         // Parse method from httpz method enum
@@ -204,34 +355,774 @@ pub const HttpZServer = struct {
             .query = req.url.query,
             .headers = headers,
             .body = req.body() orelse "",
+            .client_address = req.address,
+            .protocol = if (req.protocol == .HTTP10) .http_1_0 else .http_1_1,
             .arena = arena,
         };
     }
 
-    fn convertResponse(res: *httpz.Response, response: Response) !void {
+    /// `http10` marks a response to an HTTP/1.0 client, which can't read
+    /// chunked bodies and gets its connection closed after the response, as
+    /// httpz only keeps HTTP/1.1 connections alive. `head` marks a response
+    /// to a HEAD request, which carries no body to put trailers after.
+    /// `client_closes` marks a request that asked to close the connection,
+    /// so keep-alive can't be offered.
+    fn convertResponse(res: *httpz.Response, response: Response, http10: bool, head: bool, client_closes: bool) !void {
         // Set status
         res.status = @intFromEnum(response.status);
-
-        // Add CORS headers to all responses
-        res.header("Access-Control-Allow-Origin", "*");
-        res.header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, PATCH, OPTIONS");
-        res.header("Access-Control-Allow-Headers", "Content-Type, Authorization");
+        const close = response.close_connection orelse false;
+        if (http10 or close) {
+            res.header("Connection", "close");
+        } else if (response.close_connection == false and !client_closes) {
+            res.header("Connection", "keep-alive");
+        }
 
         // Set headers
         var header_iter = response.headers.iterator();
         while (header_iter.next()) |header| {
             res.header(header.key_ptr.*, header.value_ptr.*);
         }
+        for (response.set_cookies.items) |cookie| {
+            res.header("Set-Cookie", cookie);
+        }
+
+        if (response.trailers.items.len > 0 and !http10 and !head and allowsBody(response.status)) {
+            return writeWithTrailers(res, response);
+        }
+        if (response.chunks) |chunks| {
+            if (http10) {
+                res.body = try collectChunks(res.arena, chunks);
+                return;
+            }
+            streamChunks(res, chunks);
+            if (close) std.posix.shutdown(res.conn.stream.handle, .both) catch {};
+            return;
+        }
+        if (response.truncate_at != null or response.content_length != null) {
+            const sent = if (head) 0 else response.truncate_at orelse response.body.len;
+            return writeUnframed(res, response, response.content_length orelse response.body.len, sent);
+        }
+        if (response.reset_connection) {
+            return resetConnection(res);
+        }
 
         // Set body
         res.body = response.body;
+
+        // httpz closes HTTP/1.0 connections itself
+        if (close and !http10) writeAndClose(res);
+    }
+
+    /// Send the response now instead of after the handler returns, then
+    /// shut the connection, so the client has to open a new one for its
+    /// next request
+    fn writeAndClose(res: *httpz.Response) void {
+        defer std.posix.shutdown(res.conn.stream.handle, .both) catch {};
+        res.write() catch |err| {
+            std.log.debug("Client went away before the response was sent: {}", .{err});
+        };
+    }
+
+    /// The chunks as one body, for clients that can't take a chunked one.
+    /// The delays still run, so the response arrives no sooner than a
+    /// streamed one would finish.
+    fn collectChunks(arena: std.mem.Allocator, chunks: []const Chunk) ![]const u8 {
+        var body = std.ArrayList(u8).init(arena);
+        for (chunks) |chunk| {
+            if (chunk.delay_ms > 0) {
+                std.time.sleep(chunk.delay_ms * std.time.ns_per_ms);
+            }
+            try body.appendSlice(chunk.data);
+        }
+        return body.items;
+    }
+
+    /// Write the head with `content_length` and the first `sent` bytes of
+    /// the body to the socket ourselves, since httpz always sends a
+    /// Content-Length that matches, then shut the connection so the client
+    /// sees the body end where it does rather than waiting for the rest
+    fn writeUnframed(res: *httpz.Response, response: Response, content_length: u64, sent: usize) void {
+        const stream = res.conn.stream;
+        defer std.posix.shutdown(stream.handle, .both) catch {};
+
+        var head = std.ArrayList(u8).init(res.arena);
+        const writer = head.writer();
+        writer.print("HTTP/1.1 {d} {s}\r\n", .{ @intFromEnum(response.status), response.status.phrase() }) catch return;
+        var header_iter = response.headers.iterator();
+        while (header_iter.next()) |header| {
+            // Framing is ours to write, once
+            if (std.ascii.eqlIgnoreCase(header.key_ptr.*, "Content-Length") or std.ascii.eqlIgnoreCase(header.key_ptr.*, "Connection")) continue;
+            writer.print("{s}: {s}\r\n", .{ header.key_ptr.*, header.value_ptr.* }) catch return;
+        }
+        for (response.set_cookies.items) |cookie| {
+            writer.print("Set-Cookie: {s}\r\n", .{cookie}) catch return;
+        }
+        writer.print("Content-Length: {d}\r\nConnection: close\r\n\r\n", .{content_length}) catch return;
+
+        stream.writeAll(head.items) catch return;
+        stream.writeAll(response.body[0..sent]) catch |err| {
+            std.log.debug("Client went away during a truncated response: {}", .{err});
+        };
+    }
+
+    /// 1xx, 204 and 304 responses end at their headers
+    fn allowsBody(status: Status) bool {
+        const code = @intFromEnum(status);
+        return code >= 200 and code != 204 and code != 304;
+    }
+
+    /// Write the whole response to the socket ourselves, since httpz ends a
+    /// chunked body with no room for trailers: the body as chunks, then the
+    /// trailers after the last one. The connection is closed afterwards, as
+    /// httpz no longer knows where the response ended.
+    fn writeWithTrailers(res: *httpz.Response, response: Response) void {
+        const stream = res.conn.stream;
+        defer std.posix.shutdown(stream.handle, .both) catch {};
+
+        var head = std.ArrayList(u8).init(res.arena);
+        const writer = head.writer();
+        writer.print("HTTP/1.1 {d} {s}\r\n", .{ @intFromEnum(response.status), response.status.phrase() }) catch return;
+        var header_iter = response.headers.iterator();
+        while (header_iter.next()) |header| {
+            writer.print("{s}: {s}\r\n", .{ header.key_ptr.*, header.value_ptr.* }) catch return;
+        }
+        for (response.set_cookies.items) |cookie| {
+            writer.print("Set-Cookie: {s}\r\n", .{cookie}) catch return;
+        }
+        writer.writeAll("Trailer: ") catch return;
+        for (response.trailers.items, 0..) |trailer, index| {
+            if (index > 0) writer.writeAll(", ") catch return;
+            writer.writeAll(trailer[0]) catch return;
+        }
+        writer.writeAll("\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n") catch return;
+        stream.writeAll(head.items) catch return;
+
+        const body_chunk = [_]Chunk{.{ .data = response.body }};
+        const chunks = response.chunks orelse &body_chunk;
+        for (chunks, 0..) |chunk, index| {
+            if (chunk.delay_ms > 0) {
+                std.time.sleep(chunk.delay_ms * std.time.ns_per_ms);
+            }
+            // An empty chunk would end the body early
+            if (chunk.data.len == 0) continue;
+            stream.writer().print("{x}\r\n", .{chunk.data.len}) catch return;
+            stream.writeAll(chunk.data) catch |err| {
+                std.log.debug("Stopped streaming after {d} of {d} chunks: {}", .{ index, chunks.len, err });
+                return;
+            };
+            stream.writeAll("\r\n") catch return;
+        }
+
+        var tail = std.ArrayList(u8).init(res.arena);
+        tail.appendSlice("0\r\n") catch return;
+        for (response.trailers.items) |trailer| {
+            tail.writer().print("{s}: {s}\r\n", .{ trailer[0], trailer[1] }) catch return;
+        }
+        tail.appendSlice("\r\n") catch return;
+        stream.writeAll(tail.items) catch |err| {
+            std.log.debug("Client went away before the trailers: {}", .{err});
+        };
+    }
+
+    /// Hang up without sending a byte. A zero linger time makes the close
+    /// that follows send a reset, so clients see the connection fail rather
+    /// than a response.
+    fn resetConnection(res: *httpz.Response) void {
+        const handle = res.conn.stream.handle;
+        const linger = extern struct { onoff: c_int, seconds: c_int }{ .onoff = 1, .seconds = 0 };
+        std.posix.setsockopt(handle, std.posix.SOL.SOCKET, std.posix.SO.LINGER, std.mem.asBytes(&linger)) catch |err| {
+            std.log.debug("Failed to set a zero linger time: {}", .{err});
+        };
+        std.posix.shutdown(handle, .both) catch {};
+    }
+
+    /// Write each chunk straight to the socket. The handler has returned by
+    /// now, so the config lock isn't held while the delays run.
+    fn streamChunks(res: *httpz.Response, chunks: []const Chunk) void {
+        for (chunks, 0..) |chunk, index| {
+            if (chunk.delay_ms > 0) {
+                std.time.sleep(chunk.delay_ms * std.time.ns_per_ms);
+            }
+            // A failed write is the only sign that the client has gone away
+            res.chunk(chunk.data) catch |err| {
+                std.log.debug("Stopped streaming after {d} of {d} chunks: {}", .{ index, chunks.len, err });
+                return;
+            };
+        }
+    }
+
+};
+
+test "listenerConfig applies the timeouts" {
+    const defaults = HttpZServer.listenerConfig(.{});
+    try std.testing.expectEqual(@as(?u32, 10), defaults.timeout.request);
+    try std.testing.expectEqual(@as(?u32, 60), defaults.timeout.keepalive);
+
+    const custom = HttpZServer.listenerConfig(.{ .host = "", .read_timeout_ms = 1500, .idle_timeout_ms = 0 });
+    try std.testing.expectEqualStrings("0.0.0.0", custom.address.?);
+    try std.testing.expectEqual(@as(?u32, 2), custom.timeout.request);
+    try std.testing.expectEqual(@as(?u32, null), custom.timeout.keepalive);
+}
+
+/// An upgraded connection playing a `WebSocketScript`. The messages go out
+/// from a thread of their own so their delays don't hold up an httpz worker,
+/// while websocket.zig delivers inbound messages, answers pings and replies
+/// to a client's close on its own threads.
+const WebSocketSession = struct {
+    state: *State,
+
+    pub const Context = struct {
+        allocator: std.mem.Allocator,
+        /// Only valid during `init`, which copies it
+        script: WebSocketScript,
+    };
+
+    /// Shared by the connection and the script thread; the last to let go frees it
+    const State = struct {
+        allocator: std.mem.Allocator,
+        conn: *websocket.Conn,
+        messages: []Chunk,
+        echo: bool,
+        /// Held while writing, so the connection can't be released mid-write
+        mutex: std.Thread.Mutex = .{},
+        closed: bool = false,
+        refs: std.atomic.Value(u8) = std.atomic.Value(u8).init(2),
+
+        fn send(self: *State, data: []const u8) !void {
+            self.mutex.lock();
+            defer self.mutex.unlock();
+            if (self.closed) return error.ConnectionClosed;
+            try self.conn.write(data);
+        }
+
+        fn play(self: *State) void {
+            defer self.release();
+            for (self.messages, 0..) |message, index| {
+                if (message.delay_ms > 0) {
+                    std.time.sleep(message.delay_ms * std.time.ns_per_ms);
+                }
+                self.send(message.data) catch |err| {
+                    std.log.debug("Stopped the WebSocket script after {d} of {d} messages: {}", .{ index, self.messages.len, err });
+                    return;
+                };
+            }
+            // An echoing socket stays open for the client to close
+            if (self.echo) return;
+            self.mutex.lock();
+            defer self.mutex.unlock();
+            if (!self.closed) {
+                self.conn.close(.{}) catch |err| {
+                    std.log.debug("Failed to close the WebSocket: {}", .{err});
+                };
+            }
+        }
+
+        fn release(self: *State) void {
+            if (self.refs.fetchSub(1, .acq_rel) != 1) return;
+            for (self.messages) |message| {
+                self.allocator.free(message.data);
+            }
+            self.allocator.free(self.messages);
+            self.allocator.destroy(self);
+        }
+    };
+
+    pub fn init(conn: *websocket.Conn, ctx: *const Context) !WebSocketSession {
+        const allocator = ctx.allocator;
+        const messages = try allocator.alloc(Chunk, ctx.script.messages.len);
+        var copied: usize = 0;
+        errdefer {
+            for (messages[0..copied]) |message| allocator.free(message.data);
+            allocator.free(messages);
+        }
+        for (ctx.script.messages, messages) |source, *message| {
+            message.* = .{ .data = try allocator.dupe(u8, source.data), .delay_ms = source.delay_ms };
+            copied += 1;
+        }
+
+        const state = try allocator.create(State);
+        state.* = .{ .allocator = allocator, .conn = conn, .messages = messages, .echo = ctx.script.echo };
+        return .{ .state = state };
+    }
+
+    pub fn afterInit(self: *WebSocketSession) !void {
+        const thread = std.Thread.spawn(.{}, State.play, .{self.state}) catch |err| {
+            // No thread will release its reference
+            self.state.release();
+            return err;
+        };
+        thread.detach();
+    }
+
+    pub fn clientMessage(self: *WebSocketSession, data: []const u8) !void {
+        if (self.state.echo) try self.state.send(data);
+    }
+
+    pub fn close(self: *WebSocketSession) void {
+        self.state.mutex.lock();
+        self.state.closed = true;
+        self.state.mutex.unlock();
+        self.state.release();
+    }
+};
+
+fn scriptedSocket(request: *Request) anyerror!Response {
+    var response = Response.init(request.arena, .switching_protocols);
+    response.websocket = .{
+        .messages = &[_]Chunk{ .{ .data = "hello" }, .{ .data = "tick", .delay_ms = 20 } },
+        .echo = true,
+    };
+    return response;
+}
+
+fn serveForTest(server: *Server, config: ServerConfig) void {
+    server.start(config) catch |err| {
+        std.log.warn("Test server failed: {}", .{err});
+    };
+}
+
+fn freePortForTest() !u16 {
+    var probe = try (try std.net.Address.parseIp("127.0.0.1", 0)).listen(.{});
+    defer probe.deinit();
+    return probe.listen_address.getPort();
+}
+
+/// Connect to a test server once it is listening, failing reads that
+/// stall rather than hanging the test
+fn connectForTest(port: u16) !std.net.Stream {
+    const address = try std.net.Address.parseIp("127.0.0.1", port);
+    const stream = for (0..200) |_| {
+        break std.net.tcpConnectToAddress(address) catch {
+            std.time.sleep(10 * std.time.ns_per_ms);
+            continue;
+        };
+    } else return error.ServerDidNotStart;
+    errdefer stream.close();
+    const timeout = std.posix.timeval{ .sec = 5, .usec = 0 };
+    try std.posix.setsockopt(stream.handle, std.posix.SOL.SOCKET, std.posix.SO.RCVTIMEO, std.mem.asBytes(&timeout));
+    return stream;
+}
+
+fn legacyResponses(request: *Request) anyerror!Response {
+    var response = Response.init(request.arena, .ok);
+    try response.setHeader("Content-Type", "text/plain");
+    if (std.mem.eql(u8, request.path, "/stream")) {
+        response.chunks = &[_]Chunk{ .{ .data = "hel" }, .{ .data = "lo", .delay_ms = 10 } };
+    } else {
+        response.setBody("plain");
+    }
+    return response;
+}
+
+fn connectionResponses(request: *Request) anyerror!Response {
+    var response = Response.init(request.arena, .ok);
+    response.setBody("hello");
+    response.close_connection = std.mem.eql(u8, request.path, "/close");
+    return response;
+}
+
+/// Read from `stream` until what has arrived ends with `suffix`
+fn readUntilForTest(allocator: std.mem.Allocator, stream: std.net.Stream, suffix: []const u8) ![]u8 {
+    var received = std.ArrayList(u8).init(allocator);
+    errdefer received.deinit();
+    var buffer: [1024]u8 = undefined;
+    while (!std.mem.endsWith(u8, received.items, suffix)) {
+        const read = try stream.read(&buffer);
+        if (read == 0) return error.EndOfStream;
+        try received.appendSlice(buffer[0..read]);
+    }
+    return received.toOwnedSlice();
+}
+
+fn truncatedResponse(request: *Request) anyerror!Response {
+    var response = Response.init(request.arena, .ok);
+    try response.setHeader("Content-Type", "text/plain");
+    response.setBody("hello world");
+    response.truncate_at = 4;
+    return response;
+}
+
+fn misframedResponses(request: *Request) anyerror!Response {
+    var response = Response.init(request.arena, .ok);
+    try response.setHeader("Content-Type", "text/plain");
+    response.setBody("hello");
+    response.content_length = if (std.mem.eql(u8, request.path, "/short")) 2 else 20;
+    return response;
+}
+
+fn trailerResponses(request: *Request) anyerror!Response {
+    var response = Response.init(request.arena, .ok);
+    try response.setHeader("Content-Type", "text/plain");
+    if (std.mem.eql(u8, request.path, "/stream")) {
+        response.chunks = &[_]Chunk{ .{ .data = "hel" }, .{ .data = "lo", .delay_ms = 10 } };
+    } else {
+        response.setBody("hello");
+    }
+    try response.addTrailer("Grpc-Status", "0");
+    try response.addTrailer("Grpc-Message", "OK");
+    return response;
+}
+
+fn resetResponse(request: *Request) anyerror!Response {
+    var response = Response.init(request.arena, .bad_gateway);
+    response.setBody("never sent");
+    response.reset_connection = true;
+    return response;
+}
+
+/// The delayed responses the server hasn't let go of yet
+var delayed_in_flight = std.atomic.Value(u32).init(0);
+
+fn delayedResponses(request: *Request) anyerror!Response {
+    var response = Response.init(request.arena, .ok);
+    response.setBody("late");
+    response.delay_ms = if (std.mem.eql(u8, request.path, "/short")) 30 else 10_000;
+    _ = delayed_in_flight.fetchAdd(1, .monotonic);
+    response.in_flight = &delayed_in_flight;
+    return response;
+}
+
+/// Wait up to two seconds for `count` to reach `expected`
+fn expectCountForTest(count: *const std.atomic.Value(u32), expected: u32) !void {
+    for (0..200) |_| {
+        if (count.load(.monotonic) == expected) return;
+        std.time.sleep(10 * std.time.ns_per_ms);
+    }
+    return error.TestUnexpectedResult;
+}
+
+/// Send `request_text` on a fresh connection and read until the server closes it
+fn exchangeForTest(allocator: std.mem.Allocator, port: u16, request_text: []const u8) ![]u8 {
+    const stream = try connectForTest(port);
+    defer stream.close();
+    try stream.writeAll(request_text);
+    return stream.reader().readAllAlloc(allocator, 64 * 1024);
+}
+
+/// Value of header `name` in a raw response, or null
+fn testHeader(raw: []const u8, name: []const u8) ?[]const u8 {
+    const head_end = std.mem.indexOf(u8, raw, "\r\n\r\n") orelse return null;
+    var lines = std.mem.splitSequence(u8, raw[0..head_end], "\r\n");
+    _ = lines.first();
+    while (lines.next()) |line| {
+        const colon = std.mem.indexOfScalar(u8, line, ':') orelse continue;
+        if (std.ascii.eqlIgnoreCase(line[0..colon], name)) return std.mem.trim(u8, line[colon + 1 ..], " ");
     }
+    return null;
+}
+
+test "reset connections send no response" {
+    // See the WebSocket test for why this uses the page allocator
+    const allocator = std.heap.page_allocator;
+    var impl = try HttpZServer.init(allocator);
+    defer impl.deinit();
+    var server = impl.server();
+    try server.addRoute(.GET, "/*", resetResponse);
+
+    const port = try freePortForTest();
+    const thread = try std.Thread.spawn(.{}, serveForTest, .{ &server, ServerConfig{ .port = port } });
+    defer thread.join();
+    defer server.stop() catch {};
+
+    // Depending on timing the client reads the reset or just the hang-up,
+    // but never a status line
+    if (exchangeForTest(allocator, port, "GET /reset HTTP/1.1\r\nHost: localhost\r\n\r\n")) |raw| {
+        defer allocator.free(raw);
+        try std.testing.expectEqual(@as(usize, 0), raw.len);
+    } else |err| {
+        try std.testing.expectEqual(error.ConnectionResetByPeer, err);
+    }
+}
+
+test "delays end early when the client hangs up or the server stops" {
+    // See the WebSocket test for why this uses the page allocator
+    const allocator = std.heap.page_allocator;
+    var impl = try HttpZServer.init(allocator);
+    defer impl.deinit();
+    var server = impl.server();
+    try server.addRoute(.GET, "/*", delayedResponses);
+
+    const port = try freePortForTest();
+    const thread = try std.Thread.spawn(.{}, serveForTest, .{ &server, ServerConfig{ .port = port } });
+    defer thread.join();
+    var stopped = false;
+    defer if (!stopped) server.stop() catch {};
+
+    var timer = try std.time.Timer.start();
+    const short = try exchangeForTest(allocator, port, "GET /short HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n");
+    defer allocator.free(short);
+    try std.testing.expect(std.mem.endsWith(u8, short, "\r\n\r\nlate"));
+    try std.testing.expect(timer.read() >= 30 * std.time.ns_per_ms);
+    try expectCountForTest(&delayed_in_flight, 0);
+
+    // A client that hangs up frees its slot long before the 10s are over
+    const abandoned = try connectForTest(port);
+    try abandoned.writeAll("GET /long HTTP/1.1\r\nHost: localhost\r\n\r\n");
+    try expectCountForTest(&delayed_in_flight, 1);
+    abandoned.close();
+    try expectCountForTest(&delayed_in_flight, 0);
+
+    // Stopping stops the wait too
+    const pending = try connectForTest(port);
+    defer pending.close();
+    try pending.writeAll("GET /long HTTP/1.1\r\nHost: localhost\r\n\r\n");
+    try expectCountForTest(&delayed_in_flight, 1);
+    stopped = true;
+    try server.stop();
+    try expectCountForTest(&delayed_in_flight, 0);
+}
+
+test "responses can close or keep alive their connection" {
+    // See the WebSocket test for why this uses the page allocator
+    const allocator = std.heap.page_allocator;
+    var impl = try HttpZServer.init(allocator);
+    defer impl.deinit();
+    var server = impl.server();
+    try server.addRoute(.GET, "/*", connectionResponses);
+
+    const port = try freePortForTest();
+    const thread = try std.Thread.spawn(.{}, serveForTest, .{ &server, ServerConfig{ .port = port } });
+    defer thread.join();
+    defer server.stop() catch {};
+
+    // The client didn't ask to close, so reading to the end only returns
+    // because the server hung up
+    const closed = try exchangeForTest(allocator, port, "GET /close HTTP/1.1\r\nHost: localhost\r\n\r\n");
+    defer allocator.free(closed);
+    try std.testing.expect(std.mem.startsWith(u8, closed, "HTTP/1.1 200 "));
+    try std.testing.expectEqualStrings("close", testHeader(closed, "Connection").?);
+    try std.testing.expect(std.mem.endsWith(u8, closed, "\r\n\r\nhello"));
+
+    // A kept-alive connection answers a second request
+    const stream = try connectForTest(port);
+    defer stream.close();
+    try stream.writeAll("GET /keep HTTP/1.1\r\nHost: localhost\r\n\r\n");
+    const first = try readUntilForTest(allocator, stream, "hello");
+    defer allocator.free(first);
+    try std.testing.expectEqualStrings("keep-alive", testHeader(first, "Connection").?);
+    try stream.writeAll("GET /keep HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n");
+    const second = try stream.reader().readAllAlloc(allocator, 64 * 1024);
+    defer allocator.free(second);
+    try std.testing.expect(std.mem.startsWith(u8, second, "HTTP/1.1 200 "));
+    // Keep-alive isn't offered to a client closing anyway
+    try std.testing.expect(testHeader(second, "Connection") == null);
+}
+
+test "trailers follow a chunked body" {
+    // See the WebSocket test for why this uses the page allocator
+    const allocator = std.heap.page_allocator;
+    var impl = try HttpZServer.init(allocator);
+    defer impl.deinit();
+    var server = impl.server();
+    try server.addRoute(.GET, "/*", trailerResponses);
+
+    const port = try freePortForTest();
+    const thread = try std.Thread.spawn(.{}, serveForTest, .{ &server, ServerConfig{ .port = port } });
+    defer thread.join();
+    defer server.stop() catch {};
+
+    const raw = try exchangeForTest(allocator, port, "GET /grpc HTTP/1.1\r\nHost: localhost\r\nTE: trailers\r\n\r\n");
+    defer allocator.free(raw);
+    try std.testing.expect(std.mem.startsWith(u8, raw, "HTTP/1.1 200 "));
+    try std.testing.expectEqualStrings("chunked", testHeader(raw, "Transfer-Encoding").?);
+    try std.testing.expectEqualStrings("Grpc-Status, Grpc-Message", testHeader(raw, "Trailer").?);
+    try std.testing.expect(testHeader(raw, "Content-Length") == null);
+    try std.testing.expect(std.mem.endsWith(u8, raw, "\r\n\r\n5\r\nhello\r\n0\r\nGrpc-Status: 0\r\nGrpc-Message: OK\r\n\r\n"));
+
+    // Streamed chunks keep their boundaries ahead of the trailers
+    const streamed = try exchangeForTest(allocator, port, "GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n");
+    defer allocator.free(streamed);
+    try std.testing.expect(std.mem.endsWith(u8, streamed, "\r\n\r\n3\r\nhel\r\n2\r\nlo\r\n0\r\nGrpc-Status: 0\r\nGrpc-Message: OK\r\n\r\n"));
+
+    // HTTP/1.0 can't carry trailers, so only the body is sent
+    const legacy = try exchangeForTest(allocator, port, "GET /grpc HTTP/1.0\r\n\r\n");
+    defer allocator.free(legacy);
+    try std.testing.expect(testHeader(legacy, "Trailer") == null);
+    try std.testing.expect(std.mem.endsWith(u8, legacy, "\r\n\r\nhello"));
+}
+
+test "HTTP/1.0 clients get delimited bodies and a closed connection" {
+    // See the WebSocket test for why this uses the page allocator
+    const allocator = std.heap.page_allocator;
+    var impl = try HttpZServer.init(allocator);
+    defer impl.deinit();
+    var server = impl.server();
+    try server.addRoute(.GET, "/*", legacyResponses);
+
+    const port = try freePortForTest();
+    const thread = try std.Thread.spawn(.{}, serveForTest, .{ &server, ServerConfig{ .port = port } });
+    defer thread.join();
+    defer server.stop() catch {};
+
+    // Reading to the end only returns because the server closes the connection
+    const plain = try exchangeForTest(allocator, port, "GET /plain HTTP/1.0\r\nHost: localhost\r\n\r\n");
+    defer allocator.free(plain);
+    try std.testing.expect(std.mem.startsWith(u8, plain, "HTTP/1.1 200 "));
+    try std.testing.expectEqualStrings("close", testHeader(plain, "Connection").?);
+    try std.testing.expectEqualStrings("5", testHeader(plain, "Content-Length").?);
+    try std.testing.expect(std.mem.endsWith(u8, plain, "\r\n\r\nplain"));
 
+    // A streamed response is sent whole instead of chunked
+    const streamed = try exchangeForTest(allocator, port, "GET /stream HTTP/1.0\r\n\r\n");
+    defer allocator.free(streamed);
+    try std.testing.expect(std.mem.startsWith(u8, streamed, "HTTP/1.1 200"));
+    try std.testing.expect(testHeader(streamed, "Transfer-Encoding") == null);
+    try std.testing.expectEqualStrings("5", testHeader(streamed, "Content-Length").?);
+    try std.testing.expectEqualStrings("close", testHeader(streamed, "Connection").?);
+    try std.testing.expect(std.mem.endsWith(u8, streamed, "\r\n\r\nhello"));
+
+    // HTTP/1.1 streams as before
+    const chunked = try exchangeForTest(allocator, port, "GET /stream HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n");
+    defer allocator.free(chunked);
+    try std.testing.expectEqualStrings("chunked", testHeader(chunked, "Transfer-Encoding").?);
+}
+
+test "truncated responses promise more than they send" {
+    // See the WebSocket test for why this uses the page allocator
+    const allocator = std.heap.page_allocator;
+    var impl = try HttpZServer.init(allocator);
+    defer impl.deinit();
+    var server = impl.server();
+    try server.addRoute(.GET, "/*", truncatedResponse);
+
+    const port = try freePortForTest();
+    const thread = try std.Thread.spawn(.{}, serveForTest, .{ &server, ServerConfig{ .port = port } });
+    defer thread.join();
+    defer server.stop() catch {};
+
+    // The read ends early because the server hangs up, not after 11 bytes
+    const raw = try exchangeForTest(allocator, port, "GET /truncated HTTP/1.1\r\nHost: localhost\r\n\r\n");
+    defer allocator.free(raw);
+    try std.testing.expect(std.mem.startsWith(u8, raw, "HTTP/1.1 200 OK\r\n"));
+    try std.testing.expectEqualStrings("11", testHeader(raw, "Content-Length").?);
+    try std.testing.expectEqualStrings("text/plain", testHeader(raw, "Content-Type").?);
+    const body_start = std.mem.indexOf(u8, raw, "\r\n\r\n").? + 4;
+    try std.testing.expectEqualStrings("hell", raw[body_start..]);
+}
+
+test "content_length overrides what the client is told" {
+    // See the WebSocket test for why this uses the page allocator
+    const allocator = std.heap.page_allocator;
+    var impl = try HttpZServer.init(allocator);
+    defer impl.deinit();
+    var server = impl.server();
+    try server.addRoute(.GET, "/*", misframedResponses);
+
+    const port = try freePortForTest();
+    const thread = try std.Thread.spawn(.{}, serveForTest, .{ &server, ServerConfig{ .port = port } });
+    defer thread.join();
+    defer server.stop() catch {};
+
+    // Promised 20 bytes, the client gets 5 and then the connection ends
+    // instead of waiting for the other 15
+    const long = try exchangeForTest(allocator, port, "GET /long HTTP/1.1\r\nHost: localhost\r\n\r\n");
+    defer allocator.free(long);
+    try std.testing.expectEqualStrings("20", testHeader(long, "Content-Length").?);
+    try std.testing.expectEqualStrings("close", testHeader(long, "Connection").?);
+    try std.testing.expectEqualStrings("hello", long[std.mem.indexOf(u8, long, "\r\n\r\n").? + 4 ..]);
+
+    // Promised 2, the whole body still follows
+    const short = try exchangeForTest(allocator, port, "GET /short HTTP/1.1\r\nHost: localhost\r\n\r\n");
+    defer allocator.free(short);
+    try std.testing.expectEqualStrings("2", testHeader(short, "Content-Length").?);
+    try std.testing.expectEqualStrings("hello", short[std.mem.indexOf(u8, short, "\r\n\r\n").? + 4 ..]);
+}
+
+const TestFrame = struct {
+    opcode: u4,
+    payload: []u8,
 };
 
+/// Read one unmasked frame, as servers send them
+fn readTestFrame(reader: anytype, buffer: []u8) !TestFrame {
+    const head = try reader.readBytesNoEof(2);
+    if (head[1] & 0x80 != 0) return error.MaskedServerFrame;
+    const len: usize = switch (head[1] & 0x7f) {
+        126 => try reader.readInt(u16, .big),
+        127 => return error.FrameTooLarge,
+        else => |short| short,
+    };
+    if (len > buffer.len) return error.FrameTooLarge;
+    try reader.readNoEof(buffer[0..len]);
+    return .{ .opcode = @truncate(head[0]), .payload = buffer[0..len] };
+}
+
+/// Write one masked frame, as clients must
+fn writeTestFrame(stream: std.net.Stream, opcode: u4, payload: []const u8) !void {
+    var frame: [128]u8 = undefined;
+    const mask = [4]u8{ 0x37, 0xfa, 0x21, 0x3d };
+    frame[0] = 0x80 | @as(u8, opcode);
+    frame[1] = 0x80 | @as(u8, @intCast(payload.len));
+    frame[2..6].* = mask;
+    for (payload, 0..) |byte, index| {
+        frame[6 + index] = byte ^ mask[index % 4];
+    }
+    try stream.writeAll(frame[0 .. 6 + payload.len]);
+}
+
+test "WebSocket upgrade plays the script and echoes" {
+    // The server keeps its route keys until exit and the sessions allocate
+    // from several threads, so this uses the page allocator
+    const allocator = std.heap.page_allocator;
+    var impl = try HttpZServer.init(allocator);
+    defer impl.deinit();
+    var server = impl.server();
+    try server.addRoute(.GET, "/*", scriptedSocket);
+
+    const port = try freePortForTest();
+    const thread = try std.Thread.spawn(.{}, serveForTest, .{ &server, ServerConfig{ .port = port } });
+    defer thread.join();
+    defer server.stop() catch {};
+
+    const stream = try connectForTest(port);
+    defer stream.close();
+
+    try stream.writeAll("GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" ++
+        "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n");
+    var buffered = std.io.bufferedReader(stream.reader());
+    const reader = buffered.reader();
+
+    var line_buffer: [256]u8 = undefined;
+    const status_line = try reader.readUntilDelimiter(&line_buffer, '\n');
+    try std.testing.expect(std.mem.startsWith(u8, status_line, "HTTP/1.1 101"));
+    var accepted = false;
+    while (true) {
+        const line = std.mem.trimRight(u8, try reader.readUntilDelimiter(&line_buffer, '\n'), "\r");
+        if (line.len == 0) break;
+        const accept_header = "sec-websocket-accept:";
+        if (std.ascii.startsWithIgnoreCase(line, accept_header)) {
+            try std.testing.expectEqualStrings("s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", std.mem.trim(u8, line[accept_header.len..], " "));
+            accepted = true;
+        }
+    }
+    try std.testing.expect(accepted);
+
+    var frame_buffer: [256]u8 = undefined;
+    for ([_][]const u8{ "hello", "tick" }) |expected| {
+        const frame = try readTestFrame(reader, &frame_buffer);
+        try std.testing.expectEqual(@as(u4, 0x1), frame.opcode);
+        try std.testing.expectEqualStrings(expected, frame.payload);
+    }
+
+    try writeTestFrame(stream, 0x1, "ping me");
+    const echoed = try readTestFrame(reader, &frame_buffer);
+    try std.testing.expectEqual(@as(u4, 0x1), echoed.opcode);
+    try std.testing.expectEqualStrings("ping me", echoed.payload);
+
+    try writeTestFrame(stream, 0x9, "beat");
+    const pong = try readTestFrame(reader, &frame_buffer);
+    try std.testing.expectEqual(@as(u4, 0xA), pong.opcode);
+    try std.testing.expectEqualStrings("beat", pong.payload);
+
+    // A client-initiated close is answered with a close
+    try writeTestFrame(stream, 0x8, &[_]u8{ 0x03, 0xe8 });
+    const closed = try readTestFrame(reader, &frame_buffer);
+    try std.testing.expectEqual(@as(u4, 0x8), closed.opcode);
+}
+
 /// Factory function to create HttpZ server
 pub fn createHttpZServer(allocator: std.mem.Allocator) !Server {
     const server_impl = try allocator.create(HttpZServer);
     server_impl.* = try HttpZServer.init(allocator);
     return server_impl.server();
-}
\ No newline at end of file
+}
@@ -34,45 +34,100 @@ pub const Method = enum {
     }
 };
 
-/// HTTP status codes
+/// HTTP version a request arrived over; the server only speaks HTTP/1.x
+pub const Protocol = enum {
+    http_1_0,
+    http_1_1,
+
+    /// The version "1.1", "HTTP/1.0" and the like name
+    pub fn parse(text: []const u8) ?Protocol {
+        var version = std.mem.trim(u8, text, " \t");
+        if (version.len >= 5 and std.ascii.eqlIgnoreCase(version[0..5], "HTTP/")) version = version[5..];
+        if (std.mem.eql(u8, version, "1.0")) return .http_1_0;
+        if (std.mem.eql(u8, version, "1.1")) return .http_1_1;
+        return null;
+    }
+
+    pub fn toString(self: Protocol) []const u8 {
+        return switch (self) {
+            .http_1_0 => "HTTP/1.0",
+            .http_1_1 => "HTTP/1.1",
+        };
+    }
+};
+
+/// HTTP status codes. Non-exhaustive so configs and upstreams can use any code.
 pub const Status = enum(u16) {
+    switching_protocols = 101,
     ok = 200,
     created = 201,
     no_content = 204,
+    not_modified = 304,
     bad_request = 400,
     unauthorized = 401,
     forbidden = 403,
     not_found = 404,
     method_not_allowed = 405,
     request_timeout = 408,
+    conflict = 409,
     payload_too_large = 413,
+    upgrade_required = 426,
     too_many_requests = 429,
     internal_server_error = 500,
     bad_gateway = 502,
     service_unavailable = 503,
+    gateway_timeout = 504,
+    _,
 
     pub fn phrase(self: Status) []const u8 {
         return switch (self) {
+            .switching_protocols => "Switching Protocols",
             .ok => "OK",
             .created => "Created",
             .no_content => "No Content",
+            .not_modified => "Not Modified",
             .bad_request => "Bad Request",
             .unauthorized => "Unauthorized",
             .forbidden => "Forbidden",
             .not_found => "Not Found",
             .method_not_allowed => "Method Not Allowed",
             .request_timeout => "Request Timeout",
+            .conflict => "Conflict",
             .payload_too_large => "Payload Too Large",
+            .upgrade_required => "Upgrade Required",
             .too_many_requests => "Too Many Requests",
             .internal_server_error => "Internal Server Error",
             .bad_gateway => "Bad Gateway",
             .service_unavailable => "Service Unavailable",
+            .gateway_timeout => "Gateway Timeout",
+            _ => "",
         };
     }
 };
 
-/// Header map type for cleaner APIs
-pub const HeaderMap = std.StringHashMap([]const u8);
+/// Hash map context that compares header names case-insensitively
+pub const HeaderNameContext = struct {
+    pub fn hash(self: HeaderNameContext, name: []const u8) u64 {
+        _ = self;
+        var hasher = std.hash.Wyhash.init(0);
+        var buf: [64]u8 = undefined;
+        var i: usize = 0;
+        while (i < name.len) {
+            const n = @min(buf.len, name.len - i);
+            hasher.update(std.ascii.lowerString(buf[0..n], name[i .. i + n]));
+            i += n;
+        }
+        return hasher.final();
+    }
+
+    pub fn eql(self: HeaderNameContext, a: []const u8, b: []const u8) bool {
+        _ = self;
+        return std.ascii.eqlIgnoreCase(a, b);
+    }
+};
+
+/// Header map type for cleaner APIs. Names are case-insensitive, like HTTP headers.
+pub const HeaderMap = std.HashMap([]const u8, []const u8, HeaderNameContext, std.hash_map.default_max_load_percentage);
 
 /// Abstract HTTP request interface
 /// This ensures the core app doesn't depend on any specific HTTP library
@@ -82,6 +137,12 @@ pub const Request = struct {
     query: []const u8,
     headers: HeaderMap,
     body: []const u8,
+    /// Address of the connected client, when the server backend knows it
+    client_address: ?std.net.Address = null,
+    protocol: Protocol = .http_1_1,
+    /// Port of the config `listeners` entry the request arrived on; null on
+    /// the main port
+    listener: ?u16 = null,
     
     // Arena allocator for this request - automatically cleaned up after response
     arena: std.mem.Allocator,
@@ -97,6 +158,287 @@ pub const Request = struct {
     pub fn hasHeader(self: *const Request, name: []const u8) bool {
         return self.headers.contains(name);
     }
+
+    /// Whether this is a GET asking to become a WebSocket connection
+    pub fn isWebSocketUpgrade(self: *const Request) bool {
+        if (self.method != .GET) return false;
+        const upgrade = self.getHeader("Upgrade") orelse return false;
+        const connection = self.getHeader("Connection") orelse return false;
+        if (!std.ascii.eqlIgnoreCase(std.mem.trim(u8, upgrade, " \t"), "websocket")) return false;
+        // Connection is a token list, e.g. "keep-alive, Upgrade"
+        var tokens = std.mem.splitScalar(u8, connection, ',');
+        while (tokens.next()) |token| {
+            if (std.ascii.eqlIgnoreCase(std.mem.trim(u8, token, " \t"), "upgrade")) return true;
+        }
+        return false;
+    }
+
+    /// Iterate the decoded query string parameters
+    pub fn queryParams(self: *const Request) FormIterator {
+        return FormIterator.init(self.arena, self.query);
+    }
+
+    /// Iterate the decoded fields of a form body. As with Go's `PostForm`,
+    /// only POST, PUT and PATCH bodies sent as
+    /// `application/x-www-form-urlencoded` are read; other requests yield nothing.
+    pub fn postFormParams(self: *const Request) FormIterator {
+        const has_form = switch (self.method) {
+            .POST, .PUT, .PATCH => if (self.getHeader("Content-Type")) |content_type|
+                std.ascii.eqlIgnoreCase(mediaType(content_type), "application/x-www-form-urlencoded")
+            else
+                false,
+            else => false,
+        };
+        return FormIterator.init(self.arena, if (has_form) self.body else "");
+    }
+
+    /// Iterate the parts of a `multipart/form-data` body; other requests
+    /// yield nothing. Parts point into `body`, so nothing is copied.
+    pub fn multipartParts(self: *const Request) std.mem.Allocator.Error!MultipartIterator {
+        const content_type = self.getHeader("Content-Type") orelse return MultipartIterator.empty;
+        if (!std.ascii.eqlIgnoreCase(mediaType(content_type), "multipart/form-data")) return MultipartIterator.empty;
+        const boundary = headerParam(content_type, "boundary") orelse return MultipartIterator.empty;
+        if (boundary.len == 0) return MultipartIterator.empty;
+        return MultipartIterator.init(self.body, try std.fmt.allocPrint(self.arena, "\r\n--{s}", .{boundary}));
+    }
+
+    /// The first multipart part called `name`
+    pub fn getPart(self: *const Request, name: []const u8) std.mem.Allocator.Error!?Part {
+        var parts = try self.multipartParts();
+        while (parts.next()) |part| {
+            if (std.mem.eql(u8, part.name, name)) return part;
+        }
+        return null;
+    }
+
+    /// Iterate the cookies of the `Cookie` header, values percent-decoded
+    pub fn cookies(self: *const Request) CookieIterator {
+        return CookieIterator{
+            .arena = self.arena,
+            .pairs = std.mem.splitScalar(u8, self.getHeader("Cookie") orelse "", ';'),
+        };
+    }
+
+    /// The decoded value of the first cookie called `name`
+    pub fn getCookie(self: *const Request, name: []const u8) std.mem.Allocator.Error!?[]const u8 {
+        var iter = self.cookies();
+        while (try iter.next()) |cookie| {
+            if (std.mem.eql(u8, cookie.name, name)) return cookie.value;
+        }
+        return null;
+    }
+};
+
+/// Iterator over `name=value` pairs of a Cookie header. Values may be
+/// wrapped in double quotes, which are removed. Unlike form data, `+` is
+/// kept as is. Pairs without a name are skipped.
+pub const CookieIterator = struct {
+    arena: std.mem.Allocator,
+    pairs: std.mem.SplitIterator(u8, .scalar),
+
+    pub fn next(self: *CookieIterator) std.mem.Allocator.Error!?FormParam {
+        while (self.pairs.next()) |pair| {
+            const separator = std.mem.indexOfScalar(u8, pair, '=') orelse continue;
+            const name = std.mem.trim(u8, pair[0..separator], " \t");
+            if (name.len == 0) continue;
+
+            var value = std.mem.trim(u8, pair[separator + 1 ..], " \t");
+            if (value.len >= 2 and value[0] == '"' and value[value.len - 1] == '"') {
+                value = value[1 .. value.len - 1];
+            }
+            if (std.mem.indexOfScalar(u8, value, '%') != null) {
+                value = std.Uri.percentDecodeInPlace(try self.arena.dupe(u8, value));
+            }
+            return FormParam{ .name = name, .value = value };
+        }
+        return null;
+    }
+};
+
+/// One part of a `multipart/form-data` body
+pub const Part = struct {
+    name: []const u8,
+    /// Set for file uploads
+    filename: ?[]const u8 = null,
+    content_type: ?[]const u8 = null,
+    data: []const u8,
+};
+
+/// Iterator over the parts of a multipart body. Parts without a name are
+/// skipped, and a body cut off mid-part ends the iteration.
+pub const MultipartIterator = struct {
+    body: []const u8,
+    /// `\r\n--` and the boundary; the first delimiter may lack the line break
+    delimiter: []const u8,
+    /// Just past the last delimiter found, null once the closing one is reached
+    position: ?usize,
+
+    pub const empty = MultipartIterator{ .body = "", .delimiter = "", .position = null };
+
+    pub fn init(body: []const u8, delimiter: []const u8) MultipartIterator {
+        const first = if (std.mem.startsWith(u8, body, delimiter[2..]))
+            delimiter.len - 2
+        else if (std.mem.indexOf(u8, body, delimiter)) |index|
+            index + delimiter.len
+        else
+            null;
+        return MultipartIterator{ .body = body, .delimiter = delimiter, .position = first };
+    }
+
+    pub fn next(self: *MultipartIterator) ?Part {
+        while (self.position) |position| {
+            self.position = null;
+            const rest = self.body[position..];
+            // `--` after the delimiter closes the body
+            if (std.mem.startsWith(u8, rest, "--")) return null;
+            const line_end = std.mem.indexOf(u8, rest, "\r\n") orelse return null;
+            const headers_start = line_end + 2;
+            // A part without headers starts its data right after a blank line
+            const headers_end = if (std.mem.startsWith(u8, rest[headers_start..], "\r\n"))
+                headers_start
+            else
+                std.mem.indexOfPos(u8, rest, headers_start, "\r\n\r\n") orelse return null;
+            const data_start = if (headers_end == headers_start) headers_start + 2 else headers_end + 4;
+            const data_end = std.mem.indexOfPos(u8, rest, data_start, self.delimiter) orelse return null;
+            self.position = position + data_end + self.delimiter.len;
+
+            var part = Part{ .name = "", .data = rest[data_start..data_end] };
+            var lines = std.mem.splitSequence(u8, rest[headers_start..headers_end], "\r\n");
+            while (lines.next()) |line| {
+                const colon = std.mem.indexOfScalar(u8, line, ':') orelse continue;
+                const header_name = std.mem.trim(u8, line[0..colon], " \t");
+                const value = std.mem.trim(u8, line[colon + 1 ..], " \t");
+                if (std.ascii.eqlIgnoreCase(header_name, "Content-Disposition")) {
+                    part.name = headerParam(value, "name") orelse "";
+                    part.filename = headerParam(value, "filename");
+                } else if (std.ascii.eqlIgnoreCase(header_name, "Content-Type")) {
+                    part.content_type = value;
+                }
+            }
+            if (part.name.len > 0) return part;
+        }
+        return null;
+    }
+};
+
+/// The parameter `name` of a header value such as `form-data; name="file"`,
+/// without its quotes
+pub fn headerParam(value: []const u8, name: []const u8) ?[]const u8 {
+    var params = std.mem.splitScalar(u8, value, ';');
+    // The first item is the value itself, e.g. `form-data`
+    _ = params.next();
+    while (params.next()) |param| {
+        const separator = std.mem.indexOfScalar(u8, param, '=') orelse continue;
+        if (!std.ascii.eqlIgnoreCase(std.mem.trim(u8, param[0..separator], " \t"), name)) continue;
+        const param_value = std.mem.trim(u8, param[separator + 1 ..], " \t");
+        if (param_value.len >= 2 and param_value[0] == '"' and param_value[param_value.len - 1] == '"') {
+            return param_value[1 .. param_value.len - 1];
+        }
+        return param_value;
+    }
+    return null;
+}
+
+/// A single decoded name/value pair from a URL-encoded string
+pub const FormParam = struct {
+    name: []const u8,
+    value: []const u8,
+};
+
+/// Iterator over `application/x-www-form-urlencoded` data such as a query string.
+/// Names and values are decoded (`+` and percent escapes) into the arena.
+/// Repeated names are yielded once per occurrence, in order.
+pub const FormIterator = struct {
+    arena: std.mem.Allocator,
+    pairs: std.mem.SplitIterator(u8, .scalar),
+
+    pub fn init(arena: std.mem.Allocator, encoded: []const u8) FormIterator {
+        return FormIterator{
+            .arena = arena,
+            .pairs = std.mem.splitScalar(u8, encoded, '&'),
+        };
+    }
+
+    pub fn next(self: *FormIterator) !?FormParam {
+        while (self.pairs.next()) |pair| {
+            if (pair.len == 0) continue;
+
+            const separator = std.mem.indexOfScalar(u8, pair, '=');
+            const raw_name = if (separator) |i| pair[0..i] else pair;
+            const raw_value = if (separator) |i| pair[i + 1 ..] else "";
+
+            return FormParam{
+                .name = try urlDecode(self.arena, raw_name),
+                .value = try urlDecode(self.arena, raw_value),
+            };
+        }
+        return null;
+    }
+};
+
+/// Decode a URL-encoded component. Returns the input unchanged when there is nothing to decode.
+pub fn urlDecode(allocator: std.mem.Allocator, encoded: []const u8) ![]const u8 {
+    if (std.mem.indexOfAny(u8, encoded, "%+") == null) return encoded;
+
+    const buffer = try allocator.dupe(u8, encoded);
+    std.mem.replaceScalar(u8, buffer, '+', ' ');
+    return std.Uri.percentDecodeInPlace(buffer);
+}
+
+/// A Content-Type value without its parameters, e.g. `text/html` for `text/html; charset=utf-8`
+pub fn mediaType(content_type: []const u8) []const u8 {
+    const end = std.mem.indexOfScalar(u8, content_type, ';') orelse content_type.len;
+    return std.mem.trim(u8, content_type[0..end], " \t");
+}
+
+/// A piece of a streamed response body
+pub const Chunk = struct {
+    data: []const u8,
+    /// Pause before sending this chunk
+    delay_ms: u64 = 0,
+};
+
+/// Messages for a WebSocket connection, sent after the upgrade in order
+pub const WebSocketScript = struct {
+    /// Text messages, each sent after its delay
+    messages: []const Chunk,
+    /// Send each inbound message straight back; the connection then stays
+    /// open after the script until the client closes it
+    echo: bool = false,
+};
+
+/// A cookie for a `Set-Cookie` header, formatted with `{}`
+pub const SetCookie = struct {
+    name: []const u8,
+    value: []const u8,
+    path: ?[]const u8 = null,
+    /// Seconds until the cookie expires; zero or less deletes it at once
+    max_age: ?i64 = null,
+    http_only: bool = false,
+    secure: bool = false,
+    same_site: ?SameSite = null,
+
+    pub const SameSite = enum { strict, lax, none };
+
+    /// Values with spaces or commas are quoted, as Go's `http.SetCookie` does
+    pub fn format(self: SetCookie, comptime fmt: []const u8, options: std.fmt.FormatOptions, writer: anytype) !void {
+        _ = fmt;
+        _ = options;
+        try writer.print("{s}=", .{self.name});
+        if (std.mem.indexOfAny(u8, self.value, " ,") != null) {
+            try writer.print("\"{s}\"", .{self.value});
+        } else {
+            try writer.writeAll(self.value);
+        }
+        if (self.path) |path| try writer.print("; Path={s}", .{path});
+        if (self.max_age) |max_age| try writer.print("; Max-Age={d}", .{@max(max_age, 0)});
+        if (self.http_only) try writer.writeAll("; HttpOnly");
+        if (self.secure) try writer.writeAll("; Secure");
+        if (self.same_site) |same_site| {
+            const names = std.enums.EnumArray(SameSite, []const u8).init(.{ .strict = "Strict", .lax = "Lax", .none = "None" });
+            try writer.print("; SameSite={s}", .{names.get(same_site)});
+        }
+    }
 };
 
 /// Abstract HTTP response interface
@@ -104,6 +446,37 @@ pub const Response = struct {
     status: Status,
     headers: HeaderMap,
     body: []const u8,
+    /// `Set-Cookie` values, sent as one header each since they can't be
+    /// joined with commas like other headers
+    set_cookies: std.ArrayListUnmanaged([]const u8) = .{},
+    /// Sent after the body with chunked encoding, their names declared in a
+    /// `Trailer` header. HTTP/1.0 clients get the body without them.
+    trailers: std.ArrayListUnmanaged([2][]const u8) = .{},
+    /// Send these with chunked encoding instead of `body`, flushing each one.
+    /// The server stops early if the client goes away.
+    chunks: ?[]const Chunk = null,
+    /// Upgrade the connection to a WebSocket and play this script in place
+    /// of sending a body. Only for requests that asked to upgrade.
+    websocket: ?WebSocketScript = null,
+    /// Send only this many bytes of `body`, with a `Content-Length` for all
+    /// of it, and then close the connection
+    truncate_at: ?usize = null,
+    /// Send this as the `Content-Length` whatever the body's length, and
+    /// close the connection after the body so neither side waits on the other
+    content_length: ?u64 = null,
+    /// Drop the connection with a TCP reset instead of answering. Servers
+    /// that can't reach the socket send the status with an empty body.
+    reset_connection: bool = false,
+    /// True closes the connection once the response is sent, false keeps
+    /// it open with `Connection: keep-alive` where the client allows it;
+    /// null leaves it to the server
+    close_connection: ?bool = null,
+    /// Wait this long before sending anything. The server waits once the
+    /// handler has returned, so no config lock is held meanwhile, and sends
+    /// early if it is stopping or gives up if the client hangs up.
+    delay_ms: u64 = 0,
+    /// A `max_concurrent` slot the response holds until `finish`
+    in_flight: ?*std.atomic.Value(u32) = null,
     
     arena: std.mem.Allocator,
 
@@ -120,10 +493,42 @@ pub const Response = struct {
         self.headers.deinit();
     }
 
+    /// Give back the response's `in_flight` slot. Servers call this once
+    /// `delay_ms` has passed; callers handling a request themselves call it
+    /// when they are done with the response.
+    pub fn finish(self: *Response) void {
+        if (self.in_flight) |count| _ = count.fetchSub(1, .monotonic);
+        self.in_flight = null;
+    }
+
+    /// Set a header, replacing any existing value regardless of name casing
     pub fn setHeader(self: *Response, name: []const u8, value: []const u8) !void {
         try self.headers.put(name, value);
     }
 
+    pub fn getHeader(self: *const Response, name: []const u8) ?[]const u8 {
+        return self.headers.get(name);
+    }
+
+    /// Add a value to a comma-separated header such as Vary, keeping what is
+    /// already there. Values already listed are not repeated.
+    pub fn appendHeader(self: *Response, name: []const u8, value: []const u8) !void {
+        const existing = self.getHeader(name) orelse return self.setHeader(name, value);
+        var values = std.mem.splitScalar(u8, existing, ',');
+        while (values.next()) |listed| {
+            if (std.ascii.eqlIgnoreCase(std.mem.trim(u8, listed, " \t"), value)) return;
+        }
+        try self.setHeader(name, try std.fmt.allocPrint(self.arena, "{s}, {s}", .{ existing, value }));
+    }
+
+    pub fn addCookie(self: *Response, cookie: SetCookie) !void {
+        try self.set_cookies.append(self.arena, try std.fmt.allocPrint(self.arena, "{}", .{cookie}));
+    }
+
+    pub fn addTrailer(self: *Response, name: []const u8, value: []const u8) !void {
+        try self.trailers.append(self.arena, .{ name, value });
+    }
+
     pub fn setBody(self: *Response, body: []const u8) void {
         self.body = body;
     }
@@ -137,8 +542,22 @@ pub const Response = struct {
 /// Request handler function type
 pub const HandlerFn = *const fn (request: *Request) anyerror!Response;
 
-/// Middleware function type  
-pub const MiddlewareFn = *const fn (request: *Request, next: HandlerFn) anyerror!Response;
+/// Middleware function type. It may change the request, call `next.handle`
+/// to get the response from the rest of the chain (or answer itself
+/// without calling it), then change the response before returning it.
+pub const MiddlewareFn = *const fn (request: *Request, next: Next) anyerror!Response;
+
+/// What a middleware hands the request on to: the middlewares registered
+/// after it, then the route's handler
+pub const Next = struct {
+    middlewares: []const MiddlewareFn,
+    handler: HandlerFn,
+
+    pub fn handle(self: Next, request: *Request) !Response {
+        if (self.middlewares.len == 0) return self.handler(request);
+        return self.middlewares[0](request, .{ .middlewares = self.middlewares[1..], .handler = self.handler });
+    }
+};
 
 /// Abstract HTTP server interface
 /// Any HTTP server implementation must conform to this interface
@@ -175,21 +594,138 @@ pub const Server = struct {
 
 /// Server configuration
 pub const ServerConfig = struct {
+    /// Interface to bind; "" binds all interfaces
     host: []const u8 = "127.0.0.1",
     port: u16 = 8080,
+    /// Listen on this Unix domain socket instead of `host` and `port`
+    socket_path: ?[]const u8 = null,
+    /// Set on the servers of a config's `listeners`, and from there on each
+    /// of their requests as `Request.listener`
+    listener: ?u16 = null,
     
     // Security settings
     max_request_size: usize = 1024 * 1024, // 1MB
-    request_timeout_ms: u64 = 30000, // 30 seconds
+    /// Time a client gets to send a complete request; this is what stops a
+    /// slowloris client holding a worker. 0 disables it.
+    read_timeout_ms: u64 = 10000, // 10 seconds
+    /// Longest a single socket write may block on a client that isn't
+    /// reading. Response delays happen between writes, so they aren't cut short.
+    write_timeout_ms: u64 = 30000, // 30 seconds
+    /// How long a keep-alive connection may sit between requests
+    idle_timeout_ms: u64 = 60000, // 1 minute
     max_header_size: usize = 8 * 1024, // 8KB
     rate_limit_requests: u32 = 100,
     rate_limit_window_ms: u64 = 60000, // 1 minute
-    
-    // CORS settings
-    cors_origins: []const []const u8 = &.{"*"},
-    cors_methods: []const []const u8 = &.{ "GET", "POST", "PUT", "DELETE", "PATCH", "OPTIONS" },
-    cors_headers: []const []const u8 = &.{ "Content-Type", "Authorization" },
 };
 
 /// Factory function type for creating server implementations
-pub const ServerFactory = *const fn (allocator: std.mem.Allocator) anyerror!Server;
\ No newline at end of file
+pub const ServerFactory = *const fn (allocator: std.mem.Allocator) anyerror!Server;
+
+test "FormIterator decodes repeated params" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+
+    var iter = FormIterator.init(arena.allocator(), "name=Jane+Doe&id=1&id=2&tag=a%26b&flag");
+
+    const expected = [_]FormParam{
+        .{ .name = "name", .value = "Jane Doe" },
+        .{ .name = "id", .value = "1" },
+        .{ .name = "id", .value = "2" },
+        .{ .name = "tag", .value = "a&b" },
+        .{ .name = "flag", .value = "" },
+    };
+    for (expected) |want| {
+        const got = (try iter.next()).?;
+        try std.testing.expectEqualStrings(want.name, got.name);
+        try std.testing.expectEqualStrings(want.value, got.value);
+    }
+    try std.testing.expect((try iter.next()) == null);
+}
+
+test "CookieIterator splits and decodes cookies" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+
+    var request = Request{
+        .method = .GET,
+        .path = "/",
+        .query = "",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "",
+        .arena = arena.allocator(),
+    };
+    try request.headers.put("Cookie", "session=abc; theme=\"dark mode\";user=jane%40example.com; tag=a+b; =skipped; flag");
+
+    try std.testing.expectEqualStrings("abc", (try request.getCookie("session")).?);
+    try std.testing.expectEqualStrings("dark mode", (try request.getCookie("theme")).?);
+    try std.testing.expectEqualStrings("jane@example.com", (try request.getCookie("user")).?);
+    try std.testing.expectEqualStrings("a+b", (try request.getCookie("tag")).?);
+    try std.testing.expect((try request.getCookie("flag")) == null);
+    try std.testing.expect((try request.getCookie("missing")) == null);
+}
+
+test "MultipartIterator splits a form-data body" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+
+    var request = Request{
+        .method = .POST,
+        .path = "/upload",
+        .query = "",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "preamble\r\n" ++
+            "--XyZ\r\n" ++
+            "Content-Disposition: form-data; name=\"title\"\r\n" ++
+            "\r\n" ++
+            "Holiday\r\n" ++
+            "--XyZ\r\n" ++
+            "Content-Disposition: form-data; name=\"photo\"; filename=\"beach.png\"\r\n" ++
+            "Content-Type: image/png\r\n" ++
+            "\r\n" ++
+            "\x89PNG\r\n--not-the-boundary\r\n" ++
+            "--XyZ--\r\n",
+        .arena = arena.allocator(),
+    };
+    try std.testing.expect((try request.multipartParts()).next() == null);
+
+    try request.headers.put("Content-Type", "multipart/form-data; boundary=\"XyZ\"");
+    var parts = try request.multipartParts();
+    const title = parts.next().?;
+    try std.testing.expectEqualStrings("title", title.name);
+    try std.testing.expectEqualStrings("Holiday", title.data);
+    try std.testing.expect(title.filename == null);
+
+    const photo = parts.next().?;
+    try std.testing.expectEqualStrings("photo", photo.name);
+    try std.testing.expectEqualStrings("beach.png", photo.filename.?);
+    try std.testing.expectEqualStrings("image/png", photo.content_type.?);
+    try std.testing.expectEqualStrings("\x89PNG\r\n--not-the-boundary", photo.data);
+    try std.testing.expect(parts.next() == null);
+
+    try std.testing.expectEqualStrings("Holiday", (try request.getPart("title")).?.data);
+    try std.testing.expect((try request.getPart("missing")) == null);
+}
+
+test "SetCookie formats a Set-Cookie value" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+
+    var response = Response.init(arena.allocator(), .ok);
+    try response.addCookie(.{ .name = "session", .value = "abc123", .path = "/", .max_age = 3600, .http_only = true, .secure = true, .same_site = .lax });
+    try response.addCookie(.{ .name = "greeting", .value = "hello, world", .max_age = -1 });
+
+    try std.testing.expectEqual(@as(usize, 2), response.set_cookies.items.len);
+    try std.testing.expectEqualStrings("session=abc123; Path=/; Max-Age=3600; HttpOnly; Secure; SameSite=Lax", response.set_cookies.items[0]);
+    try std.testing.expectEqualStrings("greeting=\"hello, world\"; Max-Age=0", response.set_cookies.items[1]);
+}
+
+test "HeaderMap is case-insensitive" {
+    var headers = HeaderMap.init(std.testing.allocator);
+    defer headers.deinit();
+
+    try headers.put("content-type", "text/plain");
+    try headers.put("Content-Type", "application/json");
+
+    try std.testing.expectEqual(@as(u32, 1), headers.count());
+    try std.testing.expectEqualStrings("application/json", headers.get("CONTENT-TYPE").?);
+}
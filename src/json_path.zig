@@ -0,0 +1,224 @@
+const std = @import("std");
+
+/// A single step in a JSON path
+pub const Step = union(enum) {
+    key: []const u8,
+    index: usize,
+};
+
+pub const Error = error{InvalidPath};
+
+/// Iterator over the steps of a JSON path. Supported syntax is the common
+/// subset of JSONPath: `$`, `.name`, `["name"]` / `['name']` and `[index]`,
+/// e.g. `$.items[0].type` or `$["content-type"]`.
+pub const PathIterator = struct {
+    path: []const u8,
+    pos: usize,
+
+    pub fn init(path: []const u8) Error!PathIterator {
+        if (path.len == 0 or path[0] != '$') return error.InvalidPath;
+        return PathIterator{ .path = path, .pos = 1 };
+    }
+
+    pub fn next(self: *PathIterator) Error!?Step {
+        if (self.pos >= self.path.len) return null;
+
+        switch (self.path[self.pos]) {
+            '.' => {
+                const start = self.pos + 1;
+                var end = start;
+                while (end < self.path.len and self.path[end] != '.' and self.path[end] != '[') : (end += 1) {}
+                if (end == start) return error.InvalidPath;
+                self.pos = end;
+                return Step{ .key = self.path[start..end] };
+            },
+            '[' => {
+                const close = std.mem.indexOfScalarPos(u8, self.path, self.pos, ']') orelse return error.InvalidPath;
+                const inner = self.path[self.pos + 1 .. close];
+                self.pos = close + 1;
+
+                if (inner.len >= 2 and (inner[0] == '"' or inner[0] == '\'') and inner[inner.len - 1] == inner[0]) {
+                    return Step{ .key = inner[1 .. inner.len - 1] };
+                }
+                const index = std.fmt.parseInt(usize, inner, 10) catch return error.InvalidPath;
+                return Step{ .index = index };
+            },
+            else => return error.InvalidPath,
+        }
+    }
+};
+
+/// Whether the path uses supported syntax
+pub fn isValid(path: []const u8) bool {
+    var iter = PathIterator.init(path) catch return false;
+    while (iter.next() catch return false) |_| {}
+    return true;
+}
+
+/// Resolve `path` against a parsed JSON document. Returns null when a step
+/// does not exist, such as a missing key or an out-of-range index.
+pub fn lookup(root: std.json.Value, path: []const u8) Error!?std.json.Value {
+    var iter = try PathIterator.init(path);
+    var current = root;
+    while (try iter.next()) |step| {
+        current = switch (step) {
+            .key => |key| switch (current) {
+                .object => |object| object.get(key) orelse return null,
+                else => return null,
+            },
+            .index => |index| switch (current) {
+                .array => |array| if (index < array.items.len) array.items[index] else return null,
+                else => return null,
+            },
+        };
+    }
+    return current;
+}
+
+/// Write `value` at `path` in a parsed JSON document, adding objects for
+/// missing keys along the way. A last index may name an element or one past
+/// the end, which appends. Returns false when the path leads through
+/// something that isn't an object or array, or an index out of range.
+/// Anything added is allocated in `arena`.
+pub fn set(arena: std.mem.Allocator, root: *std.json.Value, path: []const u8, value: std.json.Value) !bool {
+    var iter = try PathIterator.init(path);
+    var current = root;
+    var step = try iter.next() orelse {
+        root.* = value;
+        return true;
+    };
+    while (try iter.next()) |following| {
+        current = try child(arena, current, step) orelse return false;
+        step = following;
+    }
+    switch (step) {
+        .key => |key| switch (current.*) {
+            .object => |*object| try object.put(try arena.dupe(u8, key), value),
+            else => return false,
+        },
+        .index => |index| switch (current.*) {
+            .array => |*array| if (index < array.items.len) {
+                array.items[index] = value;
+            } else if (index == array.items.len) {
+                try array.append(value);
+            } else return false,
+            else => return false,
+        },
+    }
+    return true;
+}
+
+/// Remove the value at `path`, keeping the order of what remains. Returns
+/// false when there is nothing there; the document itself can't be removed.
+pub fn remove(root: *std.json.Value, path: []const u8) Error!bool {
+    var iter = try PathIterator.init(path);
+    var current = root;
+    var step = try iter.next() orelse return false;
+    while (try iter.next()) |following| {
+        current = child(null, current, step) catch unreachable orelse return false;
+        step = following;
+    }
+    switch (step) {
+        .key => |key| switch (current.*) {
+            .object => |*object| return object.orderedRemove(key),
+            else => return false,
+        },
+        .index => |index| switch (current.*) {
+            .array => |*array| {
+                if (index >= array.items.len) return false;
+                _ = array.orderedRemove(index);
+                return true;
+            },
+            else => return false,
+        },
+    }
+}
+
+/// Where `step` leads from `current`. With an `arena`, a missing key is
+/// added as an empty object; without one it is null.
+fn child(arena: ?std.mem.Allocator, current: *std.json.Value, step: Step) !?*std.json.Value {
+    switch (step) {
+        .key => |key| switch (current.*) {
+            .object => |*object| {
+                if (object.getPtr(key)) |existing| return existing;
+                const allocator = arena orelse return null;
+                const entry = try object.getOrPut(try allocator.dupe(u8, key));
+                entry.value_ptr.* = .{ .object = std.json.ObjectMap.init(allocator) };
+                return entry.value_ptr;
+            },
+            else => return null,
+        },
+        .index => |index| switch (current.*) {
+            .array => |array| return if (index < array.items.len) &array.items[index] else null,
+            else => return null,
+        },
+    }
+}
+
+/// Compare a JSON scalar to an expected value written as text in the config.
+/// Numbers compare numerically, so `10` matches both `10` and `10.0`;
+/// objects and arrays never match.
+pub fn scalarEquals(value: std.json.Value, expected: []const u8) bool {
+    return switch (value) {
+        .string => |s| std.mem.eql(u8, s, expected),
+        .bool => |b| std.mem.eql(u8, expected, if (b) "true" else "false"),
+        .null => std.mem.eql(u8, expected, "null"),
+        .integer => |i| numberEquals(@floatFromInt(i), expected),
+        .float => |f| numberEquals(f, expected),
+        .number_string => |s| std.mem.eql(u8, s, expected),
+        .array, .object => false,
+    };
+}
+
+fn numberEquals(actual: f64, expected: []const u8) bool {
+    const wanted = std.fmt.parseFloat(f64, expected) catch return false;
+    return actual == wanted;
+}
+
+test "lookup resolves keys and indexes" {
+    var parsed = try std.json.parseFromSlice(std.json.Value, std.testing.allocator,
+        \\{"type": "refund", "items": [{"sku": "a"}, {"sku": "b"}], "meta": {"content-type": "json"}, "amount": 10}
+    , .{});
+    defer parsed.deinit();
+    const root = parsed.value;
+
+    try std.testing.expectEqualStrings("refund", (try lookup(root, "$.type")).?.string);
+    try std.testing.expectEqualStrings("b", (try lookup(root, "$.items[1].sku")).?.string);
+    try std.testing.expectEqualStrings("json", (try lookup(root, "$.meta['content-type']")).?.string);
+    try std.testing.expect((try lookup(root, "$.items[5]")) == null);
+    try std.testing.expect((try lookup(root, "$.type.nested")) == null);
+    try std.testing.expectError(error.InvalidPath, lookup(root, "type"));
+
+    try std.testing.expect(scalarEquals((try lookup(root, "$.amount")).?, "10.0"));
+    try std.testing.expect(!scalarEquals((try lookup(root, "$.amount")).?, "11"));
+}
+
+test "set and remove edit a document" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    var root = try std.json.parseFromSliceLeaky(std.json.Value, arena.allocator(),
+        \\{"id": 7, "internal": true, "tags": ["a", "b"]}
+    , .{});
+
+    try std.testing.expect(try set(arena.allocator(), &root, "$.meta.source", .{ .string = "popshop" }));
+    try std.testing.expect(try set(arena.allocator(), &root, "$.tags[0]", .{ .string = "z" }));
+    try std.testing.expect(try set(arena.allocator(), &root, "$.tags[2]", .{ .string = "c" }));
+    try std.testing.expect(!try set(arena.allocator(), &root, "$.tags[9]", .null));
+    try std.testing.expect(!try set(arena.allocator(), &root, "$.id.nested", .null));
+    try std.testing.expect(try remove(&root, "$.internal"));
+    try std.testing.expect(try remove(&root, "$.tags[1]"));
+    try std.testing.expect(!try remove(&root, "$.missing.key"));
+    try std.testing.expect(!try remove(&root, "$"));
+
+    const text = try std.json.stringifyAlloc(arena.allocator(), root, .{});
+    try std.testing.expectEqualStrings("{\"id\":7,\"tags\":[\"z\",\"c\"],\"meta\":{\"source\":\"popshop\"}}", text);
+}
+
+test "isValid" {
+    try std.testing.expect(isValid("$"));
+    try std.testing.expect(isValid("$.a[0][\"b\"]"));
+    try std.testing.expect(!isValid("$."));
+    try std.testing.expect(!isValid("$[x]"));
+    try std.testing.expect(!isValid("$[0"));
+    try std.testing.expect(!isValid(".a"));
+}
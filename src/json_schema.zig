@@ -0,0 +1,480 @@
+const std = @import("std");
+const Regex = @import("regex.zig").Regex;
+
+const Value = std.json.Value;
+
+/// Largest schema file accepted
+const max_schema_size = 1024 * 1024; // 1MB
+/// Deepest schema nesting followed, which also stops `$ref` cycles
+const max_depth = 64;
+
+/// A JSON Schema document. The commonly used validation keywords are
+/// supported: `type`, `enum`, `const`, `properties`, `required`,
+/// `additionalProperties`, `minProperties`/`maxProperties`, `items` (a schema
+/// or a tuple), `minItems`/`maxItems`, `uniqueItems`, `minLength`/`maxLength`,
+/// `pattern`, `minimum`/`maximum` and their exclusive forms, `multipleOf`,
+/// `allOf`/`anyOf`/`oneOf`/`not`, and `$ref` to a JSON pointer within the
+/// same document. Other keywords, including `format`, are ignored.
+pub const Schema = struct {
+    arena: std.heap.ArenaAllocator,
+    root: Value,
+
+    pub fn parse(allocator: std.mem.Allocator, text: []const u8) !Schema {
+        var arena = std.heap.ArenaAllocator.init(allocator);
+        errdefer arena.deinit();
+
+        const root = try std.json.parseFromSliceLeaky(Value, arena.allocator(), text, .{ .allocate = .alloc_always });
+        switch (root) {
+            .object, .bool => {},
+            else => return error.InvalidSchema,
+        }
+        return Schema{ .arena = arena, .root = root };
+    }
+
+    pub fn loadFile(allocator: std.mem.Allocator, path: []const u8) !Schema {
+        const text = try std.fs.cwd().readFileAlloc(allocator, path, max_schema_size);
+        defer allocator.free(text);
+        return parse(allocator, text);
+    }
+
+    pub fn deinit(self: *Schema) void {
+        self.arena.deinit();
+    }
+
+    /// Check a JSON document. Returns null when it conforms, otherwise the
+    /// first violation found, allocated in `arena`. Text that isn't JSON is
+    /// a violation too.
+    pub fn validateText(self: *const Schema, arena: std.mem.Allocator, text: []const u8) !?[]const u8 {
+        const instance = std.json.parseFromSliceLeaky(Value, arena, text, .{}) catch |err| switch (err) {
+            error.OutOfMemory => return error.OutOfMemory,
+            else => return "body is not valid JSON",
+        };
+        return self.validate(arena, instance);
+    }
+
+    /// Like `validateText`, for an already parsed document
+    pub fn validate(self: *const Schema, arena: std.mem.Allocator, instance: Value) !?[]const u8 {
+        var validator = Validator{ .arena = arena, .root = self.root };
+        return validator.check(self.root, instance, "$", 0);
+    }
+};
+
+const Validator = struct {
+    arena: std.mem.Allocator,
+    root: Value,
+
+    const Error = std.mem.Allocator.Error;
+
+    fn fail(self: *Validator, location: []const u8, comptime format: []const u8, args: anytype) Error!?[]const u8 {
+        return try std.fmt.allocPrint(self.arena, "{s}: " ++ format, .{location} ++ args);
+    }
+
+    fn check(self: *Validator, schema: Value, instance: Value, location: []const u8, depth: usize) Error!?[]const u8 {
+        if (depth > max_depth) return self.fail(location, "schema nesting is too deep", .{});
+
+        const keywords = switch (schema) {
+            .bool => |allowed| return if (allowed) null else self.fail(location, "no value is allowed here", .{}),
+            .object => |object| object,
+            // Anything else isn't a schema; treat it as accepting everything
+            else => return null,
+        };
+
+        if (keywords.get("$ref")) |ref| {
+            if (ref == .string) {
+                const target = resolvePointer(self.root, ref.string) orelse {
+                    return self.fail(location, "cannot resolve $ref '{s}'", .{ref.string});
+                };
+                if (try self.check(target, instance, location, depth + 1)) |message| return message;
+            }
+        }
+
+        if (keywords.get("type")) |expected| {
+            if (!matchesType(expected, instance)) {
+                return self.fail(location, "expected {s}, got {s}", .{ try self.describeType(expected), typeName(instance) });
+            }
+        }
+        if (keywords.get("enum")) |options| {
+            if (options == .array) {
+                for (options.array.items) |option| {
+                    if (jsonEqual(option, instance)) break;
+                } else return self.fail(location, "value is not one of the allowed enum values", .{});
+            }
+        }
+        if (keywords.get("const")) |expected| {
+            if (!jsonEqual(expected, instance)) return self.fail(location, "value does not equal const", .{});
+        }
+
+        if (try self.checkCombinators(keywords, instance, location, depth)) |message| return message;
+
+        return switch (instance) {
+            .object => |object| self.checkObject(keywords, object, location, depth),
+            .array => |array| self.checkArray(keywords, array.items, location, depth),
+            .string => |string| self.checkString(keywords, string, location),
+            .integer, .float, .number_string => if (toFloat(instance)) |number| self.checkNumber(keywords, number, location) else null,
+            .null, .bool => null,
+        };
+    }
+
+    fn checkCombinators(self: *Validator, keywords: std.json.ObjectMap, instance: Value, location: []const u8, depth: usize) Error!?[]const u8 {
+        if (keywords.get("allOf")) |all| {
+            if (all == .array) {
+                for (all.array.items) |sub| {
+                    if (try self.check(sub, instance, location, depth + 1)) |message| return message;
+                }
+            }
+        }
+        if (keywords.get("anyOf")) |any| {
+            if (any == .array) {
+                var first_failure: ?[]const u8 = null;
+                for (any.array.items) |sub| {
+                    const message = try self.check(sub, instance, location, depth + 1) orelse break;
+                    if (first_failure == null) first_failure = message;
+                } else if (first_failure) |message| {
+                    return self.fail(location, "value matches none of anyOf ({s})", .{message});
+                }
+            }
+        }
+        if (keywords.get("oneOf")) |one| {
+            if (one == .array) {
+                var matched: usize = 0;
+                for (one.array.items) |sub| {
+                    if (try self.check(sub, instance, location, depth + 1) == null) matched += 1;
+                }
+                if (matched != 1) return self.fail(location, "value matches {d} of oneOf, expected exactly 1", .{matched});
+            }
+        }
+        if (keywords.get("not")) |sub| {
+            if (try self.check(sub, instance, location, depth + 1) == null) {
+                return self.fail(location, "value must not match the schema in not", .{});
+            }
+        }
+        return null;
+    }
+
+    fn checkObject(self: *Validator, keywords: std.json.ObjectMap, object: std.json.ObjectMap, location: []const u8, depth: usize) Error!?[]const u8 {
+        if (keywords.get("required")) |required| {
+            if (required == .array) {
+                for (required.array.items) |name| {
+                    if (name == .string and !object.contains(name.string)) {
+                        return self.fail(location, "missing required property '{s}'", .{name.string});
+                    }
+                }
+            }
+        }
+        if (integerKeyword(keywords, "minProperties")) |min| {
+            if (object.count() < min) return self.fail(location, "expected at least {d} properties, got {d}", .{ min, object.count() });
+        }
+        if (integerKeyword(keywords, "maxProperties")) |max| {
+            if (object.count() > max) return self.fail(location, "expected at most {d} properties, got {d}", .{ max, object.count() });
+        }
+
+        const properties: ?std.json.ObjectMap = if (keywords.get("properties")) |p| (if (p == .object) p.object else null) else null;
+        const additional = keywords.get("additionalProperties");
+
+        var iter = object.iterator();
+        while (iter.next()) |entry| {
+            const name = entry.key_ptr.*;
+            const child_location = try std.fmt.allocPrint(self.arena, "{s}.{s}", .{ location, name });
+
+            if (properties) |props| {
+                if (props.get(name)) |sub| {
+                    if (try self.check(sub, entry.value_ptr.*, child_location, depth + 1)) |message| return message;
+                    continue;
+                }
+            }
+            if (additional) |sub| {
+                if (sub == .bool and !sub.bool) {
+                    return self.fail(location, "property '{s}' is not allowed", .{name});
+                }
+                if (try self.check(sub, entry.value_ptr.*, child_location, depth + 1)) |message| return message;
+            }
+        }
+        return null;
+    }
+
+    fn checkArray(self: *Validator, keywords: std.json.ObjectMap, items: []const Value, location: []const u8, depth: usize) Error!?[]const u8 {
+        if (integerKeyword(keywords, "minItems")) |min| {
+            if (items.len < min) return self.fail(location, "expected at least {d} items, got {d}", .{ min, items.len });
+        }
+        if (integerKeyword(keywords, "maxItems")) |max| {
+            if (items.len > max) return self.fail(location, "expected at most {d} items, got {d}", .{ max, items.len });
+        }
+        if (keywords.get("uniqueItems")) |unique| {
+            if (unique == .bool and unique.bool) {
+                for (items, 0..) |item, i| {
+                    for (items[0..i], 0..) |earlier, j| {
+                        if (jsonEqual(earlier, item)) return self.fail(location, "items {d} and {d} are equal", .{ j, i });
+                    }
+                }
+            }
+        }
+
+        const item_schema = keywords.get("items") orelse return null;
+        for (items, 0..) |item, i| {
+            // An array of schemas validates a tuple position by position
+            const sub = switch (item_schema) {
+                .array => |tuple| if (i < tuple.items.len) tuple.items[i] else break,
+                else => item_schema,
+            };
+            const child_location = try std.fmt.allocPrint(self.arena, "{s}[{d}]", .{ location, i });
+            if (try self.check(sub, item, child_location, depth + 1)) |message| return message;
+        }
+        return null;
+    }
+
+    fn checkString(self: *Validator, keywords: std.json.ObjectMap, string: []const u8, location: []const u8) Error!?[]const u8 {
+        const length = std.unicode.utf8CountCodepoints(string) catch string.len;
+        if (integerKeyword(keywords, "minLength")) |min| {
+            if (length < min) return self.fail(location, "expected at least {d} characters, got {d}", .{ min, length });
+        }
+        if (integerKeyword(keywords, "maxLength")) |max| {
+            if (length > max) return self.fail(location, "expected at most {d} characters, got {d}", .{ max, length });
+        }
+        if (keywords.get("pattern")) |pattern| {
+            if (pattern == .string) {
+                // JSON Schema patterns search the string rather than match all of it
+                const search = try std.fmt.allocPrint(self.arena, ".*(?:{s}).*", .{pattern.string});
+                const regex = Regex.compile(self.arena, search, null) catch |err| switch (err) {
+                    error.OutOfMemory => return error.OutOfMemory,
+                    error.InvalidPattern => return self.fail(location, "invalid pattern '{s}' in schema", .{pattern.string}),
+                };
+                if (!try regex.isMatch(string)) return self.fail(location, "'{s}' does not match pattern '{s}'", .{ string, pattern.string });
+            }
+        }
+        return null;
+    }
+
+    fn checkNumber(self: *Validator, keywords: std.json.ObjectMap, number: f64, location: []const u8) Error!?[]const u8 {
+        if (numberKeyword(keywords, "minimum")) |min| {
+            if (number < min) return self.fail(location, "{d} is less than the minimum {d}", .{ number, min });
+        }
+        if (numberKeyword(keywords, "maximum")) |max| {
+            if (number > max) return self.fail(location, "{d} is greater than the maximum {d}", .{ number, max });
+        }
+        if (numberKeyword(keywords, "exclusiveMinimum")) |min| {
+            if (number <= min) return self.fail(location, "{d} must be greater than {d}", .{ number, min });
+        }
+        if (numberKeyword(keywords, "exclusiveMaximum")) |max| {
+            if (number >= max) return self.fail(location, "{d} must be less than {d}", .{ number, max });
+        }
+        if (numberKeyword(keywords, "multipleOf")) |divisor| {
+            if (divisor > 0 and @rem(number, divisor) != 0) return self.fail(location, "{d} is not a multiple of {d}", .{ number, divisor });
+        }
+        return null;
+    }
+
+    fn describeType(self: *Validator, expected: Value) Error![]const u8 {
+        switch (expected) {
+            .string => |name| return name,
+            .array => |names| {
+                var description = std.ArrayList(u8).init(self.arena);
+                for (names.items, 0..) |name, i| {
+                    if (i > 0) try description.appendSlice(" or ");
+                    if (name == .string) try description.appendSlice(name.string);
+                }
+                return description.items;
+            },
+            else => return "a valid type",
+        }
+    }
+};
+
+fn matchesType(expected: Value, instance: Value) bool {
+    return switch (expected) {
+        .string => |name| isType(name, instance),
+        .array => |names| for (names.items) |name| {
+            if (name == .string and isType(name.string, instance)) break true;
+        } else false,
+        // Malformed `type` keywords don't reject anything
+        else => true,
+    };
+}
+
+fn isType(name: []const u8, instance: Value) bool {
+    if (std.mem.eql(u8, name, "integer")) {
+        return switch (instance) {
+            .integer => true,
+            .float => |f| @floor(f) == f,
+            .number_string => |s| std.mem.indexOfAny(u8, s, ".eE") == null,
+            else => false,
+        };
+    }
+    if (std.mem.eql(u8, name, "number")) {
+        return toFloat(instance) != null;
+    }
+    return std.mem.eql(u8, name, typeName(instance));
+}
+
+fn typeName(instance: Value) []const u8 {
+    return switch (instance) {
+        .null => "null",
+        .bool => "boolean",
+        .integer => "integer",
+        .float, .number_string => "number",
+        .string => "string",
+        .array => "array",
+        .object => "object",
+    };
+}
+
+fn toFloat(value: Value) ?f64 {
+    return switch (value) {
+        .integer => |i| @floatFromInt(i),
+        .float => |f| f,
+        .number_string => |s| std.fmt.parseFloat(f64, s) catch null,
+        else => null,
+    };
+}
+
+fn numberKeyword(keywords: std.json.ObjectMap, name: []const u8) ?f64 {
+    return toFloat(keywords.get(name) orelse return null);
+}
+
+fn integerKeyword(keywords: std.json.ObjectMap, name: []const u8) ?usize {
+    return switch (keywords.get(name) orelse return null) {
+        .integer => |i| std.math.cast(usize, i),
+        else => null,
+    };
+}
+
+/// Structural equality, comparing numbers by value so `1` equals `1.0`
+fn jsonEqual(a: Value, b: Value) bool {
+    if (toFloat(a)) |x| {
+        const y = toFloat(b) orelse return false;
+        return x == y;
+    }
+    return switch (a) {
+        .null => b == .null,
+        .bool => |x| b == .bool and b.bool == x,
+        .string => |x| b == .string and std.mem.eql(u8, x, b.string),
+        .array => |x| blk: {
+            if (b != .array or x.items.len != b.array.items.len) break :blk false;
+            for (x.items, b.array.items) |left, right| {
+                if (!jsonEqual(left, right)) break :blk false;
+            }
+            break :blk true;
+        },
+        .object => |x| blk: {
+            if (b != .object or x.count() != b.object.count()) break :blk false;
+            var iter = x.iterator();
+            while (iter.next()) |entry| {
+                const other = b.object.get(entry.key_ptr.*) orelse break :blk false;
+                if (!jsonEqual(entry.value_ptr.*, other)) break :blk false;
+            }
+            break :blk true;
+        },
+        // Numbers too large for f64
+        .number_string => |x| b == .number_string and std.mem.eql(u8, x, b.number_string),
+        .integer, .float => false,
+    };
+}
+
+/// Resolve a `$ref` of the form `#` or `#/json/pointer` against the root document
+fn resolvePointer(root: Value, ref: []const u8) ?Value {
+    if (!std.mem.startsWith(u8, ref, "#")) return null;
+    const pointer = ref[1..];
+    if (pointer.len == 0) return root;
+    if (pointer[0] != '/') return null;
+
+    var current = root;
+    var tokens = std.mem.splitScalar(u8, pointer[1..], '/');
+    while (tokens.next()) |raw_token| {
+        // "~1" encodes '/' and "~0" encodes '~'; tokens are short, so a fixed buffer will do
+        var buffer: [256]u8 = undefined;
+        if (raw_token.len > buffer.len) return null;
+        var len: usize = 0;
+        var i: usize = 0;
+        while (i < raw_token.len) : (i += 1) {
+            if (raw_token[i] == '~' and i + 1 < raw_token.len) {
+                buffer[len] = if (raw_token[i + 1] == '1') '/' else '~';
+                i += 1;
+            } else {
+                buffer[len] = raw_token[i];
+            }
+            len += 1;
+        }
+        const token = buffer[0..len];
+
+        current = switch (current) {
+            .object => |object| object.get(token) orelse return null,
+            .array => |array| blk: {
+                const index = std.fmt.parseInt(usize, token, 10) catch return null;
+                if (index >= array.items.len) return null;
+                break :blk array.items[index];
+            },
+            else => return null,
+        };
+    }
+    return current;
+}
+
+test "Schema.validateText" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+
+    var schema = try Schema.parse(std.testing.allocator,
+        \\{
+        \\  "type": "object",
+        \\  "required": ["id", "name"],
+        \\  "additionalProperties": false,
+        \\  "properties": {
+        \\    "id": {"type": "integer", "minimum": 1},
+        \\    "name": {"type": "string", "minLength": 1, "pattern": "^[A-Z]"},
+        \\    "role": {"enum": ["admin", "user"]},
+        \\    "tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "uniqueItems": true}
+        \\  },
+        \\  "$defs": {"tag": {"type": "string", "maxLength": 8}}
+        \\}
+    );
+    defer schema.deinit();
+
+    const a = arena.allocator();
+    try std.testing.expect(try schema.validateText(a, "{\"id\": 1, \"name\": \"Ada\", \"tags\": [\"x\", \"y\"]}") == null);
+    try std.testing.expect(try schema.validateText(a, "{\"id\": 2.0, \"name\": \"Bo\", \"role\": \"admin\"}") == null);
+
+    const cases = [_]struct { body: []const u8, message: []const u8 }{
+        .{ .body = "[]", .message = "$: expected object, got array" },
+        .{ .body = "{\"id\": 1}", .message = "$: missing required property 'name'" },
+        .{ .body = "{\"id\": \"1\", \"name\": \"Ada\"}", .message = "$.id: expected integer, got string" },
+        .{ .body = "{\"id\": 0, \"name\": \"Ada\"}", .message = "$.id: 0 is less than the minimum 1" },
+        .{ .body = "{\"id\": 1, \"name\": \"ada\"}", .message = "$.name: 'ada' does not match pattern '^[A-Z]'" },
+        .{ .body = "{\"id\": 1, \"name\": \"Ada\", \"role\": \"root\"}", .message = "$.role: value is not one of the allowed enum values" },
+        .{ .body = "{\"id\": 1, \"name\": \"Ada\", \"tags\": [\"much-too-long\"]}", .message = "$.tags[0]: expected at most 8 characters, got 13" },
+        .{ .body = "{\"id\": 1, \"name\": \"Ada\", \"tags\": [\"x\", \"x\"]}", .message = "$.tags: items 0 and 1 are equal" },
+        .{ .body = "{\"id\": 1, \"name\": \"Ada\", \"extra\": true}", .message = "$: property 'extra' is not allowed" },
+        .{ .body = "{\"id\": 1,", .message = "body is not valid JSON" },
+    };
+    for (cases) |case| {
+        const message = try schema.validateText(a, case.body);
+        try std.testing.expect(message != null);
+        try std.testing.expectEqualStrings(case.message, message.?);
+    }
+}
+
+test "Schema combinators" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const a = arena.allocator();
+
+    var one_of = try Schema.parse(std.testing.allocator,
+        \\{"oneOf": [{"type": "integer"}, {"type": "string"}], "not": {"const": 3}}
+    );
+    defer one_of.deinit();
+
+    try std.testing.expect(try one_of.validateText(a, "2") == null);
+    try std.testing.expect(try one_of.validateText(a, "\"two\"") == null);
+    try std.testing.expectEqualStrings("$: value matches 0 of oneOf, expected exactly 1", (try one_of.validateText(a, "true")).?);
+    try std.testing.expectEqualStrings("$: value must not match the schema in not", (try one_of.validateText(a, "3.0")).?);
+
+    var any_of = try Schema.parse(std.testing.allocator,
+        \\{"anyOf": [{"type": "integer"}, {"minLength": 2}]}
+    );
+    defer any_of.deinit();
+
+    try std.testing.expect(try any_of.validateText(a, "5") == null);
+    try std.testing.expect(try any_of.validateText(a, "\"ab\"") == null);
+    try std.testing.expectEqualStrings(
+        "$: value matches none of anyOf ($: expected integer, got string)",
+        (try any_of.validateText(a, "\"a\"")).?,
+    );
+}
@@ -0,0 +1,124 @@
+const std = @import("std");
+
+/// Which member of a JSON-RPC 2.0 response a mock's body becomes
+pub const Envelope = enum {
+    result,
+    @"error",
+};
+
+/// Error code for a call that no rule answers
+pub const method_not_found = -32601;
+/// Error code for a call whose response isn't JSON
+pub const internal_error = -32603;
+
+/// The parts of a JSON-RPC call that matching and responses use
+pub const Call = struct {
+    method: []const u8,
+    /// The `id` as JSON text; null for a notification, which gets no response
+    id: ?[]const u8 = null,
+};
+
+/// Parse a single call. Null when the text isn't a JSON-RPC 2.0 request
+/// object, including when it is a batch.
+pub fn parseCall(arena: std.mem.Allocator, text: []const u8) std.mem.Allocator.Error!?Call {
+    const root = std.json.parseFromSliceLeaky(std.json.Value, arena, text, .{}) catch |err| switch (err) {
+        error.OutOfMemory => return error.OutOfMemory,
+        else => return null,
+    };
+    return callFromValue(arena, root);
+}
+
+fn callFromValue(arena: std.mem.Allocator, value: std.json.Value) std.mem.Allocator.Error!?Call {
+    if (value != .object) return null;
+    const version = value.object.get("jsonrpc") orelse return null;
+    if (version != .string or !std.mem.eql(u8, version.string, "2.0")) return null;
+    const method = value.object.get("method") orelse return null;
+    if (method != .string) return null;
+
+    const id = if (value.object.get("id")) |id| try std.json.stringifyAlloc(arena, id, .{}) else null;
+    return Call{ .method = method.string, .id = id };
+}
+
+/// Each call of a batch as JSON text. Null unless `text` is a non-empty
+/// array of JSON-RPC 2.0 requests, so other JSON arrays are left alone.
+pub fn splitBatch(arena: std.mem.Allocator, text: []const u8) std.mem.Allocator.Error!?[]const []const u8 {
+    const trimmed = std.mem.trim(u8, text, " \t\r\n");
+    if (trimmed.len == 0 or trimmed[0] != '[') return null;
+    const root = std.json.parseFromSliceLeaky(std.json.Value, arena, trimmed, .{}) catch |err| switch (err) {
+        error.OutOfMemory => return error.OutOfMemory,
+        else => return null,
+    };
+    if (root != .array or root.array.items.len == 0) return null;
+
+    const calls = try arena.alloc([]const u8, root.array.items.len);
+    for (root.array.items, calls) |item, *call| {
+        if ((try callFromValue(arena, item)) == null) return null;
+        call.* = try std.json.stringifyAlloc(arena, item, .{});
+    }
+    return calls;
+}
+
+/// Whether `text` is a single JSON document
+pub fn isJson(arena: std.mem.Allocator, text: []const u8) std.mem.Allocator.Error!bool {
+    return std.json.validate(arena, text);
+}
+
+/// `{"jsonrpc":"2.0","id":...,"result":...}` around `body`, or with
+/// `"error"` in place of `"result"`. A body that isn't JSON is sent as a
+/// string, and a missing id as null.
+pub fn wrap(arena: std.mem.Allocator, envelope: Envelope, id: ?[]const u8, body: []const u8) std.mem.Allocator.Error![]u8 {
+    const trimmed = std.mem.trim(u8, body, " \t\r\n");
+    const member = if (try isJson(arena, trimmed)) trimmed else try std.json.stringifyAlloc(arena, body, .{});
+    return std.fmt.allocPrint(arena, "{{\"jsonrpc\":\"2.0\",\"id\":{s},\"{s}\":{s}}}", .{ id orelse "null", @tagName(envelope), member });
+}
+
+/// An error response with the given code and message
+pub fn errorResponse(arena: std.mem.Allocator, id: ?[]const u8, code: i64, message: []const u8) std.mem.Allocator.Error![]u8 {
+    return wrap(arena, .@"error", id, try std.json.stringifyAlloc(arena, .{ .code = code, .message = message }, .{}));
+}
+
+test "parseCall" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const a = arena.allocator();
+
+    const call = (try parseCall(a, "{\"jsonrpc\": \"2.0\", \"method\": \"eth_blockNumber\", \"id\": \"abc\"}")).?;
+    try std.testing.expectEqualStrings("eth_blockNumber", call.method);
+    try std.testing.expectEqualStrings("\"abc\"", call.id.?);
+
+    const notification = (try parseCall(a, "{\"jsonrpc\": \"2.0\", \"method\": \"ping\"}")).?;
+    try std.testing.expect(notification.id == null);
+
+    try std.testing.expect((try parseCall(a, "{\"jsonrpc\": \"1.0\", \"method\": \"ping\", \"id\": 1}")) == null);
+    try std.testing.expect((try parseCall(a, "{\"jsonrpc\": \"2.0\", \"id\": 1}")) == null);
+    try std.testing.expect((try parseCall(a, "[{\"jsonrpc\": \"2.0\", \"method\": \"ping\"}]")) == null);
+    try std.testing.expect((try parseCall(a, "method=ping")) == null);
+}
+
+test "splitBatch" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const a = arena.allocator();
+
+    const calls = (try splitBatch(a, " [{\"jsonrpc\":\"2.0\",\"method\":\"a\",\"id\":1}, {\"jsonrpc\":\"2.0\",\"method\":\"b\"}]")).?;
+    try std.testing.expectEqual(@as(usize, 2), calls.len);
+    try std.testing.expectEqualStrings("{\"jsonrpc\":\"2.0\",\"method\":\"a\",\"id\":1}", calls[0]);
+    try std.testing.expectEqualStrings("b", (try parseCall(a, calls[1])).?.method);
+
+    try std.testing.expect((try splitBatch(a, "[]")) == null);
+    try std.testing.expect((try splitBatch(a, "[1, 2]")) == null);
+    try std.testing.expect((try splitBatch(a, "{\"jsonrpc\":\"2.0\",\"method\":\"a\"}")) == null);
+}
+
+test "wrap" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const a = arena.allocator();
+
+    try std.testing.expectEqualStrings("{\"jsonrpc\":\"2.0\",\"id\":7,\"result\":{\"ok\": true}}", try wrap(a, .result, "7", " {\"ok\": true}\n"));
+    try std.testing.expectEqualStrings("{\"jsonrpc\":\"2.0\",\"id\":null,\"result\":\"plain text\"}", try wrap(a, .result, null, "plain text"));
+    try std.testing.expectEqualStrings(
+        "{\"jsonrpc\":\"2.0\",\"id\":\"x\",\"error\":{\"code\":-32601,\"message\":\"Method not found\"}}",
+        try errorResponse(a, "\"x\"", method_not_found, "Method not found"),
+    );
+}
@@ -0,0 +1,105 @@
+const std = @import("std");
+
+/// Values response templates save with `store` and read back with `load`,
+/// so one request can leave state for a later one, e.g. a POST saving the
+/// body a GET then returns. Kept in memory for the life of the server,
+/// across config reloads, and safe to use from several threads.
+pub const KvStore = struct {
+    allocator: std.mem.Allocator,
+    /// Insertion-ordered, so the admin API lists keys as they were first stored
+    entries: std.StringArrayHashMap([]const u8),
+    mutex: std.Thread.Mutex = .{},
+
+    pub fn init(allocator: std.mem.Allocator) KvStore {
+        return KvStore{
+            .allocator = allocator,
+            .entries = std.StringArrayHashMap([]const u8).init(allocator),
+        };
+    }
+
+    pub fn deinit(self: *KvStore) void {
+        self.freeEntries();
+        self.entries.deinit();
+    }
+
+    fn freeEntries(self: *KvStore) void {
+        for (self.entries.keys(), self.entries.values()) |key, value| {
+            self.allocator.free(key);
+            self.allocator.free(value);
+        }
+    }
+
+    /// Save `value` under `key`, replacing what was there
+    pub fn put(self: *KvStore, key: []const u8, value: []const u8) !void {
+        const owned_value = try self.allocator.dupe(u8, value);
+        errdefer self.allocator.free(owned_value);
+
+        self.mutex.lock();
+        defer self.mutex.unlock();
+
+        if (self.entries.getPtr(key)) |existing| {
+            self.allocator.free(existing.*);
+            existing.* = owned_value;
+            return;
+        }
+        const owned_key = try self.allocator.dupe(u8, key);
+        errdefer self.allocator.free(owned_key);
+        try self.entries.put(owned_key, owned_value);
+    }
+
+    /// A copy of the value under `key` in `allocator`, since another request
+    /// may replace it at any time; null when nothing was stored
+    pub fn get(self: *KvStore, allocator: std.mem.Allocator, key: []const u8) !?[]const u8 {
+        self.mutex.lock();
+        defer self.mutex.unlock();
+
+        const value = self.entries.get(key) orelse return null;
+        return try allocator.dupe(u8, value);
+    }
+
+    /// Forget every value
+    pub fn clear(self: *KvStore) void {
+        self.mutex.lock();
+        defer self.mutex.unlock();
+
+        self.freeEntries();
+        self.entries.clearRetainingCapacity();
+    }
+
+    /// Every entry as a JSON object of strings
+    pub fn writeJson(self: *KvStore, writer: anytype) !void {
+        self.mutex.lock();
+        defer self.mutex.unlock();
+
+        var json = std.json.writeStream(writer, .{ .whitespace = .indent_2 });
+        try json.beginObject();
+        for (self.entries.keys(), self.entries.values()) |key, value| {
+            try json.objectField(key);
+            try json.write(value);
+        }
+        try json.endObject();
+    }
+};
+
+test "KvStore saves, replaces and clears values" {
+    const allocator = std.testing.allocator;
+    var store = KvStore.init(allocator);
+    defer store.deinit();
+
+    try std.testing.expect(try store.get(allocator, "user") == null);
+    try store.put("user", "{\"name\":\"Ada\"}");
+    try store.put("count", "1");
+    try store.put("user", "{\"name\":\"Grace\"}");
+
+    const user = (try store.get(allocator, "user")).?;
+    defer allocator.free(user);
+    try std.testing.expectEqualStrings("{\"name\":\"Grace\"}", user);
+
+    var out = std.ArrayList(u8).init(allocator);
+    defer out.deinit();
+    try store.writeJson(out.writer());
+    try std.testing.expectEqualStrings("{\n  \"user\": \"{\\\"name\\\":\\\"Grace\\\"}\",\n  \"count\": \"1\"\n}", out.items);
+
+    store.clear();
+    try std.testing.expect(try store.get(allocator, "count") == null);
+}
@@ -0,0 +1,260 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+const httpz_server = @import("http/httpz_server.zig");
+const config = @import("config.zig");
+const app = @import("app.zig");
+const self_test = @import("self_test.zig");
+
+const Request = interfaces.Request;
+const Response = interfaces.Response;
+const ServerConfig = interfaces.ServerConfig;
+const HttpZServer = httpz_server.HttpZServer;
+const Config = config.Config;
+const PopshopApp = app.PopshopApp;
+
+/// App the listeners' handler serves, set while any of them is running
+var listener_app: ?*PopshopApp = null;
+
+/// How long `start` waits for a listener to bind its port
+const bind_timeout_ms = 5000;
+
+/// The extra ports of a config's `listeners:`, each served by its own HTTP
+/// server on its own thread. They share the main server's app, and their
+/// requests carry the port they came in on, so each port answers with its
+/// own rules.
+pub const Listeners = struct {
+    allocator: std.mem.Allocator,
+    servers: std.ArrayList(*Listener),
+    threads: std.ArrayList(std.Thread),
+
+    /// One port's server, and how its thread ended once it has
+    const Listener = struct {
+        impl: HttpZServer,
+        err: ?anyerror = null,
+        stopped: std.Thread.ResetEvent = .{},
+    };
+
+    /// Listen on every port in the app's `listeners`, with the rest of
+    /// `base` as the main server has it, returning once each has bound its
+    /// port or with the error of the first that can't. Ports are fixed from
+    /// here on; a reload changes what they answer, not which there are.
+    pub fn start(allocator: std.mem.Allocator, popshop_app: *PopshopApp, base: ServerConfig) !Listeners {
+        var self = Listeners{
+            .allocator = allocator,
+            .servers = std.ArrayList(*Listener).init(allocator),
+            .threads = std.ArrayList(std.Thread).init(allocator),
+        };
+        errdefer self.stop();
+        listener_app = popshop_app;
+
+        const ports = blk: {
+            popshop_app.config_lock.lockShared();
+            defer popshop_app.config_lock.unlockShared();
+            break :blk try allocator.dupe(u16, popshop_app.config.listeners orelse &.{});
+        };
+        defer allocator.free(ports);
+
+        const host = if (base.host.len == 0) "0.0.0.0" else base.host;
+        // A wildcard address is reached through loopback
+        const connect_host = if (std.mem.eql(u8, host, "0.0.0.0")) "127.0.0.1" else if (std.mem.eql(u8, host, "::")) "::1" else host;
+        for (ports) |port| {
+            // httpz binds inside its serving loop, so a port another process
+            // holds is found out here, where the error can be returned
+            const address = try std.net.Address.parseIp(host, port);
+            var probe = address.listen(.{ .reuse_address = true }) catch |err| {
+                std.log.err("Listener can't bind port {d} on {s}: {}", .{ port, host, err });
+                return err;
+            };
+            probe.deinit();
+
+            const listener = try allocator.create(Listener);
+            listener.* = .{ .impl = HttpZServer.init(allocator) catch |err| {
+                allocator.destroy(listener);
+                return err;
+            } };
+            try self.servers.append(listener);
+
+            var server = listener.impl.server();
+            inline for (.{ .GET, .POST, .PUT, .DELETE, .PATCH, .HEAD, .OPTIONS }) |method| {
+                try server.addRoute(method, "/*", handleRequest);
+            }
+
+            var listener_config = base;
+            listener_config.port = port;
+            listener_config.socket_path = null;
+            listener_config.listener = port;
+            try self.threads.append(try std.Thread.spawn(.{}, run, .{ listener, listener_config }));
+            try waitUntilBound(listener, try std.net.Address.parseIp(connect_host, port));
+            std.log.info("Listener serving on {s}:{d}", .{ host, port });
+        }
+        return self;
+    }
+
+    /// Wait until `address` takes connections, or fail with the error the
+    /// listener stopped with
+    fn waitUntilBound(listener: *Listener, address: std.net.Address) !void {
+        for (0..bind_timeout_ms / 10) |_| {
+            if (listener.stopped.isSet()) return listener.err orelse error.ListenerStopped;
+            if (std.net.tcpConnectToAddress(address)) |stream| {
+                stream.close();
+                return;
+            } else |_| {}
+            std.time.sleep(10 * std.time.ns_per_ms);
+        }
+        std.log.err("Listener on port {d} didn't start within {d}ms", .{ address.getPort(), bind_timeout_ms });
+        return error.ListenerDidNotStart;
+    }
+
+    /// Stop every listener and wait for the requests each is handling
+    pub fn stop(self: *Listeners) void {
+        for (self.servers.items) |listener| {
+            var server = listener.impl.server();
+            server.stop() catch |err| std.log.warn("Failed to stop listener: {}", .{err});
+        }
+        for (self.threads.items) |thread| thread.join();
+        for (self.servers.items) |listener| {
+            listener.impl.deinit();
+            self.allocator.destroy(listener);
+        }
+        self.threads.deinit();
+        self.servers.deinit();
+        listener_app = null;
+    }
+
+    /// Thread entry point. A failure to bind is returned by `start`, which
+    /// waits for it; later ones are only logged, as nothing waits for them.
+    fn run(listener: *Listener, listener_config: ServerConfig) void {
+        var server = listener.impl.server();
+        server.start(listener_config) catch |err| {
+            std.log.err("Listener on port {d} failed: {}", .{ listener_config.port, err });
+            listener.err = err;
+        };
+        listener.stopped.set();
+    }
+
+    fn handleRequest(request: *Request) !Response {
+        const popshop_app = listener_app orelse {
+            std.log.err("App instance not available in listener handler", .{});
+            var response = Response.init(request.arena, .internal_server_error);
+            response.setBody("Server configuration error");
+            return response;
+        };
+        return popshop_app.handleRequestWithContext(request);
+    }
+};
+
+fn freePortForTest() !u16 {
+    var probe = try (try std.net.Address.parseIp("127.0.0.1", 0)).listen(.{});
+    defer probe.deinit();
+    return probe.listen_address.getPort();
+}
+
+/// The body of a GET to `path` on `port`, retrying until the listener is up
+fn getForTest(allocator: std.mem.Allocator, port: u16, path: []const u8) ![]u8 {
+    const address = try std.net.Address.parseIp("127.0.0.1", port);
+    const stream = for (0..200) |_| {
+        break std.net.tcpConnectToAddress(address) catch {
+            std.time.sleep(10 * std.time.ns_per_ms);
+            continue;
+        };
+    } else return error.ListenerDidNotStart;
+    defer stream.close();
+
+    try stream.writer().print("GET {s} HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", .{path});
+    const raw = try stream.reader().readAllAlloc(allocator, 64 * 1024);
+    defer allocator.free(raw);
+    const body_start = (std.mem.indexOf(u8, raw, "\r\n\r\n") orelse return error.NoResponse) + 4;
+    return allocator.dupe(u8, raw[body_start..]);
+}
+
+test "Listeners answer each port with its own routes" {
+    // HttpZServer keeps its route keys until exit, so this uses the page
+    // allocator, like the server's own tests
+    const allocator = std.heap.page_allocator;
+
+    const users_port = try freePortForTest();
+    const orders_port = try freePortForTest();
+    const yaml_content = try std.fmt.allocPrint(allocator,
+        \\listeners:
+        \\  - port: {d}
+        \\    routes:
+        \\      - request:
+        \\          path: "/health"
+        \\        response:
+        \\          body: "users"
+        \\  - port: {d}
+        \\    routes:
+        \\      - request:
+        \\          path: "/health"
+        \\        response:
+        \\          body: "orders"
+        \\      - request:
+        \\          path: "/orders"
+        \\        response:
+        \\          body: "[]"
+        \\routes:
+        \\  - request:
+        \\      path: "/health"
+        \\    response:
+        \\      body: "main"
+    , .{ users_port, orders_port });
+    defer allocator.free(yaml_content);
+
+    var app_config = try Config.loadFromYaml(allocator, yaml_content);
+    var errors = try app_config.validate(allocator);
+    defer errors.deinit();
+    try std.testing.expect(errors.isEmpty());
+
+    var popshop_app = PopshopApp.init(allocator, self_test.offlineServer(), app_config);
+    defer popshop_app.deinit();
+    var listeners = try Listeners.start(allocator, &popshop_app, .{});
+    defer listeners.stop();
+
+    const users = try getForTest(allocator, users_port, "/health");
+    defer allocator.free(users);
+    try std.testing.expectEqualStrings("users", users);
+    const orders = try getForTest(allocator, orders_port, "/health");
+    defer allocator.free(orders);
+    try std.testing.expectEqualStrings("orders", orders);
+    const listed = try getForTest(allocator, orders_port, "/orders");
+    defer allocator.free(listed);
+    try std.testing.expectEqualStrings("[]", listed);
+
+    // Another port's routes are out of reach
+    const missing = try getForTest(allocator, users_port, "/orders");
+    defer allocator.free(missing);
+    try std.testing.expect(!std.mem.eql(u8, missing, "[]"));
+
+    // The main server's rules answer only the main server
+    var main_request = Request{
+        .method = .GET,
+        .path = "/health",
+        .query = "",
+        .headers = interfaces.HeaderMap.init(allocator),
+        .body = "",
+        .arena = allocator,
+    };
+    defer main_request.deinit();
+    try std.testing.expectEqualStrings("main", (try popshop_app.handleRequestWithContext(&main_request)).body);
+}
+
+test "Listeners fail to start on a taken port" {
+    const allocator = std.heap.page_allocator;
+
+    var taken = try (try std.net.Address.parseIp("127.0.0.1", 0)).listen(.{});
+    defer taken.deinit();
+    const yaml_content = try std.fmt.allocPrint(allocator,
+        \\listeners:
+        \\  - port: {d}
+        \\    routes:
+        \\      - request:
+        \\          path: "/health"
+        \\        response:
+        \\          body: "users"
+    , .{taken.listen_address.getPort()});
+    defer allocator.free(yaml_content);
+
+    var popshop_app = PopshopApp.init(allocator, self_test.offlineServer(), try Config.loadFromYaml(allocator, yaml_content));
+    defer popshop_app.deinit();
+    try std.testing.expectError(error.AddressInUse, Listeners.start(allocator, &popshop_app, .{ .host = "127.0.0.1" }));
+}
@@ -0,0 +1,314 @@
+const std = @import("std");
+
+/// Output format for log lines
+pub const Format = enum {
+    text,
+    json,
+
+    pub fn fromString(str: []const u8) ?Format {
+        return std.meta.stringToEnum(Format, str);
+    }
+};
+
+/// Runtime log settings, set from the command line before the server starts
+pub var runtime_level: std.log.Level = .info;
+pub var runtime_format: Format = .text;
+
+/// Parse a level name as accepted by `--log-level`
+pub fn parseLevel(str: []const u8) ?std.log.Level {
+    if (std.mem.eql(u8, str, "error")) return .err;
+    if (std.mem.eql(u8, str, "warning")) return .warn;
+    return std.meta.stringToEnum(std.log.Level, str);
+}
+
+/// Log function installed through `std_options`. Filters on the runtime level
+/// and writes text lines (the std.log default layout) or JSON lines to stderr.
+pub fn logFn(
+    comptime message_level: std.log.Level,
+    comptime scope: @Type(.enum_literal),
+    comptime format: []const u8,
+    args: anytype,
+) void {
+    if (@intFromEnum(message_level) > @intFromEnum(runtime_level)) return;
+
+    std.debug.lockStdErr();
+    defer std.debug.unlockStdErr();
+    const stderr = std.io.getStdErr().writer();
+
+    switch (runtime_format) {
+        .text => {
+            const scope_prefix = if (scope == .default) "" else "(" ++ @tagName(scope) ++ ")";
+            const prefix = comptime message_level.asText() ++ scope_prefix ++ ": ";
+            nosuspend stderr.print(prefix ++ format ++ "\n", args) catch return;
+        },
+        .json => {
+            // Messages are formatted into a fixed buffer; overly long ones are truncated
+            var buffer: [4096]u8 = undefined;
+            const message = std.fmt.bufPrint(&buffer, format, args) catch buffer[0..];
+            const scope_name = if (scope == .default) "" else @tagName(scope);
+            nosuspend writeJsonLine(stderr, message_level.asText(), scope_name, message) catch return;
+        },
+    }
+}
+
+fn writeJsonLine(writer: anytype, level: []const u8, scope: []const u8, message: []const u8) !void {
+    try writer.print("{{\"ts\":{d},\"level\":\"{s}\"", .{ std.time.milliTimestamp(), level });
+    if (scope.len > 0) {
+        try writer.writeAll(",\"scope\":");
+        try std.json.encodeJsonString(scope, .{}, writer);
+    }
+    try writer.writeAll(",\"msg\":");
+    try std.json.encodeJsonString(message, .{}, writer);
+    try writer.writeAll("}\n");
+}
+
+/// One handled request
+pub const AccessEntry = struct {
+    method: []const u8,
+    path: []const u8,
+    /// Index of the matched rule in load order, null when nothing matched
+    route: ?usize = null,
+    /// `path` or `path_regex` of the matched rule, copied so it outlives a reload
+    route_path: ?[]const u8 = null,
+    /// `name` of the matched rule, copied like `route_path`
+    route_name: ?[]const u8 = null,
+    /// 0 when `reset` is set
+    status: u16,
+    /// Set when the connection was reset instead of answered
+    reset: bool = false,
+    duration_ns: u64,
+    /// Set for proxy routes
+    upstream_url: ?[]const u8 = null,
+    /// Status returned by the upstream; null if it never answered
+    upstream_status: ?u16 = null,
+    /// Set when the matched rule has `log: false`, so the entry is counted
+    /// but never written
+    quiet: bool = false,
+
+    /// Write the entry as a single line, including the trailing newline
+    pub fn write(self: *const AccessEntry, writer: anytype, format: Format) !void {
+        const duration_ms = @as(f64, @floatFromInt(self.duration_ns)) / std.time.ns_per_ms;
+        switch (format) {
+            .text => {
+                try writer.print("info: request method={s} path={s} route=", .{ self.method, self.path });
+                if (self.route) |route| try writer.print("{d}", .{route}) else try writer.writeAll("none");
+                if (self.route_name) |name| {
+                    try writer.writeAll(" route_name=");
+                    try std.json.encodeJsonString(name, .{}, writer);
+                }
+                if (self.reset) try writer.writeAll(" status=reset") else try writer.print(" status={d}", .{self.status});
+                try writer.print(" duration_ms={d:.3}", .{duration_ms});
+                if (self.upstream_url) |url| {
+                    try writer.print(" upstream={s} upstream_status=", .{url});
+                    if (self.upstream_status) |status| try writer.print("{d}", .{status}) else try writer.writeAll("none");
+                }
+                try writer.writeAll("\n");
+            },
+            .json => {
+                try writer.print("{{\"ts\":{d},\"level\":\"info\",\"msg\":\"request\",\"method\":", .{std.time.milliTimestamp()});
+                try std.json.encodeJsonString(self.method, .{}, writer);
+                try writer.writeAll(",\"path\":");
+                try std.json.encodeJsonString(self.path, .{}, writer);
+                if (self.route) |route| try writer.print(",\"route\":{d}", .{route}) else try writer.writeAll(",\"route\":null");
+                if (self.route_name) |name| {
+                    try writer.writeAll(",\"route_name\":");
+                    try std.json.encodeJsonString(name, .{}, writer);
+                }
+                if (self.reset) {
+                    try writer.writeAll(",\"status\":null,\"reset\":true");
+                } else {
+                    try writer.print(",\"status\":{d}", .{self.status});
+                }
+                try writer.print(",\"duration_ms\":{d:.3}", .{duration_ms});
+                if (self.upstream_url) |url| {
+                    try writer.writeAll(",\"upstream\":");
+                    try std.json.encodeJsonString(url, .{}, writer);
+                    if (self.upstream_status) |status| {
+                        try writer.print(",\"upstream_status\":{d}", .{status});
+                    } else {
+                        try writer.writeAll(",\"upstream_status\":null");
+                    }
+                }
+                try writer.writeAll("}\n");
+            },
+        }
+    }
+};
+
+/// Access log that keeps stderr writes off the request path. Handlers append
+/// formatted lines to an in-memory buffer and a background thread writes them
+/// out; if the writer falls behind, lines beyond `max_pending` are dropped and
+/// counted rather than making requests wait.
+pub const AccessLog = struct {
+    allocator: std.mem.Allocator,
+    format: Format,
+    mutex: std.Thread.Mutex = .{},
+    condition: std.Thread.Condition = .{},
+    pending: std.ArrayList(u8),
+    dropped: usize = 0,
+    should_stop: bool = false,
+    thread: ?std.Thread = null,
+
+    /// Most buffered output before new lines are dropped
+    pub const max_pending = 1024 * 1024; // 1MB
+
+    pub fn init(allocator: std.mem.Allocator, format: Format) AccessLog {
+        return AccessLog{
+            .allocator = allocator,
+            .format = format,
+            .pending = std.ArrayList(u8).init(allocator),
+        };
+    }
+
+    pub fn start(self: *AccessLog) !void {
+        self.thread = try std.Thread.spawn(.{}, run, .{self});
+    }
+
+    /// Flush remaining lines and stop the writer thread
+    pub fn deinit(self: *AccessLog) void {
+        if (self.thread) |thread| {
+            self.mutex.lock();
+            self.should_stop = true;
+            self.condition.signal();
+            self.mutex.unlock();
+            thread.join();
+        }
+        self.pending.deinit();
+    }
+
+    /// Queue an entry; formatting uses `arena` and never blocks on I/O
+    pub fn record(self: *AccessLog, arena: std.mem.Allocator, entry: AccessEntry) void {
+        var line = std.ArrayList(u8).init(arena);
+        entry.write(line.writer(), self.format) catch {
+            self.countDropped();
+            return;
+        };
+
+        self.mutex.lock();
+        defer self.mutex.unlock();
+
+        if (self.pending.items.len + line.items.len > max_pending) {
+            self.dropped += 1;
+            return;
+        }
+        self.pending.appendSlice(line.items) catch {
+            self.dropped += 1;
+            return;
+        };
+        self.condition.signal();
+    }
+
+    fn countDropped(self: *AccessLog) void {
+        self.mutex.lock();
+        defer self.mutex.unlock();
+        self.dropped += 1;
+    }
+
+    fn run(self: *AccessLog) void {
+        var batch = std.ArrayList(u8).init(self.allocator);
+        defer batch.deinit();
+
+        while (true) {
+            self.mutex.lock();
+            while (self.pending.items.len == 0 and !self.should_stop) {
+                self.condition.wait(&self.mutex);
+            }
+            std.mem.swap(std.ArrayList(u8), &batch, &self.pending);
+            const dropped = self.dropped;
+            self.dropped = 0;
+            const stopping = self.should_stop;
+            self.mutex.unlock();
+
+            self.flush(batch.items, dropped);
+            batch.clearRetainingCapacity();
+
+            if (stopping) break;
+        }
+    }
+
+    fn flush(self: *AccessLog, lines: []const u8, dropped: usize) void {
+        std.debug.lockStdErr();
+        defer std.debug.unlockStdErr();
+        const stderr = std.io.getStdErr().writer();
+
+        stderr.writeAll(lines) catch {};
+        if (dropped == 0) return;
+
+        var buffer: [128]u8 = undefined;
+        const message = std.fmt.bufPrint(&buffer, "access log dropped {d} line(s) while the writer was behind", .{dropped}) catch return;
+        switch (self.format) {
+            .text => stderr.print("warning: {s}\n", .{message}) catch {},
+            .json => writeJsonLine(stderr, "warning", "", message) catch {},
+        }
+    }
+};
+
+test "AccessEntry.write" {
+    var buffer = std.ArrayList(u8).init(std.testing.allocator);
+    defer buffer.deinit();
+
+    const entry = AccessEntry{
+        .method = "GET",
+        .path = "/api/\"quoted\"",
+        .route = 2,
+        .status = 200,
+        .duration_ns = 1_500_000,
+        .upstream_url = "https://example.com/api",
+        .upstream_status = 201,
+    };
+
+    try entry.write(buffer.writer(), .text);
+    try std.testing.expectEqualStrings(
+        "info: request method=GET path=/api/\"quoted\" route=2 status=200 duration_ms=1.500 upstream=https://example.com/api upstream_status=201\n",
+        buffer.items,
+    );
+
+    buffer.clearRetainingCapacity();
+    try entry.write(buffer.writer(), .json);
+    // Skip the timestamp, which varies
+    const rest = buffer.items[std.mem.indexOf(u8, buffer.items, ",\"level\"").?..];
+    try std.testing.expectEqualStrings(
+        ",\"level\":\"info\",\"msg\":\"request\",\"method\":\"GET\",\"path\":\"/api/\\\"quoted\\\"\",\"route\":2,\"status\":200,\"duration_ms\":1.500,\"upstream\":\"https://example.com/api\",\"upstream_status\":201}\n",
+        rest,
+    );
+
+    // A reset connection has no status to log
+    const reset = AccessEntry{ .method = "POST", .path = "/pay", .route = 0, .status = 0, .reset = true, .duration_ns = 0 };
+    buffer.clearRetainingCapacity();
+    try reset.write(buffer.writer(), .text);
+    try std.testing.expectEqualStrings("info: request method=POST path=/pay route=0 status=reset duration_ms=0.000\n", buffer.items);
+    buffer.clearRetainingCapacity();
+    try reset.write(buffer.writer(), .json);
+    try std.testing.expect(std.mem.indexOf(u8, buffer.items, ",\"route\":0,\"status\":null,\"reset\":true,\"duration_ms\":0.000}") != null);
+}
+
+test "AccessLog.record" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+
+    // Without a writer thread the lines stay buffered, which makes them inspectable
+    var access_log = AccessLog.init(std.testing.allocator, .text);
+    defer access_log.deinit();
+
+    access_log.record(arena.allocator(), .{ .method = "POST", .path = "/x", .status = 404, .duration_ns = 0 });
+    try std.testing.expectEqualStrings(
+        "info: request method=POST path=/x route=none status=404 duration_ms=0.000\n",
+        access_log.pending.items,
+    );
+
+    // Names are quoted, as they usually contain spaces
+    access_log.pending.clearRetainingCapacity();
+    access_log.record(arena.allocator(), .{ .method = "GET", .path = "/users/7", .route = 0, .route_name = "get user by id", .status = 200, .duration_ns = 0 });
+    try std.testing.expectEqualStrings(
+        "info: request method=GET path=/users/7 route=0 route_name=\"get user by id\" status=200 duration_ms=0.000\n",
+        access_log.pending.items,
+    );
+}
+
+test "parseLevel" {
+    try std.testing.expectEqual(std.log.Level.err, parseLevel("error").?);
+    try std.testing.expectEqual(std.log.Level.warn, parseLevel("warn").?);
+    try std.testing.expectEqual(std.log.Level.warn, parseLevel("warning").?);
+    try std.testing.expectEqual(std.log.Level.debug, parseLevel("debug").?);
+    try std.testing.expect(parseLevel("verbose") == null);
+}
@@ -1,5 +1,12 @@
 const std = @import("std");
 const cli = @import("cli.zig");
+const logging = @import("logging.zig");
+
+// Everything is compiled in; `--log-level` filters at runtime
+pub const std_options: std.Options = .{
+    .log_level = .debug,
+    .logFn = logging.logFn,
+};
 
 pub fn main() !void {
     var gpa = std.heap.GeneralPurposeAllocator(.{}){};
@@ -17,17 +24,87 @@ pub fn main() !void {
 
 // Re-export main modules for testing
 pub const config = @import("config.zig");
+pub const config_dump = @import("config_dump.zig");
 pub const matcher = @import("matcher.zig");
 pub const proxy = @import("proxy.zig");
+pub const client_deadline = @import("client_deadline.zig");
 pub const app = @import("app.zig");
+pub const template = @import("template.zig");
+pub const file_cache = @import("file_cache.zig");
+pub const cors = @import("cors.zig");
+pub const auth = @import("auth.zig");
+pub const compression = @import("compression.zig");
+pub const conditional_get = @import("conditional_get.zig");
+pub const recorder = @import("recorder.zig");
+pub const verifier = @import("verifier.zig");
+pub const har = @import("har.zig");
+pub const json_path = @import("json_path.zig");
+pub const jsonrpc = @import("jsonrpc.zig");
+pub const state_store = @import("state_store.zig");
+pub const kv_store = @import("kv_store.zig");
+pub const rate_limit = @import("rate_limit.zig");
+pub const client_ip = @import("client_ip.zig");
+pub const remote_config = @import("remote_config.zig");
+pub const echo = @import("echo.zig");
+pub const static_files = @import("static_files.zig");
+pub const self_test = @import("self_test.zig");
+pub const listeners = @import("listeners.zig");
+pub const readiness = @import("readiness.zig");
+pub const openapi = @import("openapi.zig");
+pub const faker = @import("faker.zig");
+pub const negotiation = @import("negotiation.zig");
+pub const charset = @import("charset.zig");
+pub const regex = @import("regex.zig");
+pub const json_schema = @import("json_schema.zig");
+pub const admin = @import("admin.zig");
+pub const metrics = @import("metrics.zig");
+pub const mock_server = @import("mock_server.zig");
+pub const MockServer = mock_server.MockServer;
+pub const log = logging;
 pub const interfaces = @import("http/interfaces.zig");
+pub const httpz_server = @import("http/httpz_server.zig");
 
 test {
     // Reference all modules to ensure they compile and run their tests
     std.testing.refAllDecls(@This());
     std.testing.refAllDecls(config);
+    std.testing.refAllDecls(config_dump);
     std.testing.refAllDecls(matcher);
     std.testing.refAllDecls(proxy);
+    std.testing.refAllDecls(client_deadline);
     std.testing.refAllDecls(app);
+    std.testing.refAllDecls(template);
+    std.testing.refAllDecls(file_cache);
+    std.testing.refAllDecls(cors);
+    std.testing.refAllDecls(auth);
+    std.testing.refAllDecls(compression);
+    std.testing.refAllDecls(conditional_get);
+    std.testing.refAllDecls(recorder);
+    std.testing.refAllDecls(verifier);
+    std.testing.refAllDecls(har);
+    std.testing.refAllDecls(json_path);
+    std.testing.refAllDecls(jsonrpc);
+    std.testing.refAllDecls(state_store);
+    std.testing.refAllDecls(kv_store);
+    std.testing.refAllDecls(rate_limit);
+    std.testing.refAllDecls(client_ip);
+    std.testing.refAllDecls(remote_config);
+    std.testing.refAllDecls(echo);
+    std.testing.refAllDecls(static_files);
+    std.testing.refAllDecls(self_test);
+    std.testing.refAllDecls(listeners);
+    std.testing.refAllDecls(readiness);
+    std.testing.refAllDecls(openapi);
+    std.testing.refAllDecls(faker);
+    std.testing.refAllDecls(negotiation);
+    std.testing.refAllDecls(charset);
+    std.testing.refAllDecls(regex);
+    std.testing.refAllDecls(json_schema);
+    std.testing.refAllDecls(admin);
+    std.testing.refAllDecls(metrics);
+    std.testing.refAllDecls(mock_server);
+    std.testing.refAllDecls(logging);
     std.testing.refAllDecls(interfaces);
+    std.testing.refAllDecls(httpz_server);
+    std.testing.refAllDecls(cli);
 }
\ No newline at end of file
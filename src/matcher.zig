@@ -1,6 +1,11 @@
 const std = @import("std");
 const config = @import("config.zig");
 const interfaces = @import("http/interfaces.zig");
+const json_path = @import("json_path.zig");
+const jsonrpc = @import("jsonrpc.zig");
+const client_ip = @import("client_ip.zig");
+const Regex = @import("regex.zig").Regex;
+const Charset = @import("charset.zig").Charset;
 
 const Rule = config.Rule;
 const Request = interfaces.Request;
@@ -9,32 +14,142 @@ const HeaderMap = interfaces.HeaderMap;
 /// Request matcher that determines which rule matches an incoming request
 pub const RequestMatcher = struct {
     allocator: std.mem.Allocator,
+    /// Mirrors `Config.strict_slash`: when false, "/users" and "/users/"
+    /// are the same path for every kind of rule
+    strict_slash: bool = false,
+    /// Mirrors `Config.case_insensitive_paths`: literal segments of `path`
+    /// rules match regardless of letter case
+    case_insensitive: bool = false,
+    /// Mirrors `Config.trust_proxy`: `client_ip` rules check the first
+    /// `X-Forwarded-For` address
+    trust_proxy: bool = false,
+    /// Mirrors `Config.request_charset`: bodies are decoded from it before
+    /// body conditions are checked, unless the rule sets its own
+    charset: ?Charset = null,
 
     pub fn init(allocator: std.mem.Allocator) RequestMatcher {
         return RequestMatcher{ .allocator = allocator };
     }
 
-    /// Find the first rule that matches the given request
-    pub fn findMatchingRule(self: *RequestMatcher, request: *const Request, rules: []const Rule) ?*const Rule {
-        // RequestMatcher might need allocator for future regex support
-        
+    /// Find the rule that best matches the given request. The highest
+    /// `priority` wins; among equal priorities path specificity is compared
+    /// (literal segments beat parameters, which beat wildcards), then the
+    /// number of request constraints; ties go to the rule defined first.
+    /// A catch-all `*` rule ranks last within its priority. Proxy and mock
+    /// rules are ranked alike, so either kind can be gated on the request.
+    /// Rules that used up their `max_matches` are skipped.
+    pub fn findMatchingRule(self: *RequestMatcher, request: *const Request, rules: []const Rule) !?*const Rule {
+        const index = try self.findMatchingIndex(request, rules) orelse return null;
+        return &rules[index];
+    }
+
+    /// Same as `findMatchingRule`, but returns the position of the rule in `rules`
+    pub fn findMatchingIndex(self: *RequestMatcher, request: *const Request, rules: []const Rule) !?usize {
+        var best: ?usize = null;
+        var best_priority: i32 = 0;
+        var best_score: u64 = 0;
+
+        for (rules, 0..) |*rule, index| {
+            if (rule.exhausted()) continue;
+            if (!try self.doesRuleMatch(request, rule)) continue;
+
+            const score = specificity(rule);
+            if (best == null or rule.priority > best_priority or (rule.priority == best_priority and score > best_score)) {
+                best = index;
+                best_priority = rule.priority;
+                best_score = score;
+            }
+        }
+        return best;
+    }
+
+    /// The methods configured for rules whose path matches the request, as an
+    /// `Allow` header value such as "GET, POST", so a wrong method can be
+    /// answered with 405 rather than 404. Null when no rule has this path, or
+    /// one of them accepts every method and so failed on something else.
+    /// Catch-all rules don't make a path known.
+    pub fn allowedMethods(self: *RequestMatcher, allocator: std.mem.Allocator, request: *const Request, rules: []const Rule) !?[]const u8 {
+        var methods = std.ArrayList([]const u8).init(allocator);
+        defer methods.deinit();
+
         for (rules) |*rule| {
-            if (self.doesRuleMatch(request, rule)) {
-                return rule;
+            if (rule.exhausted()) continue;
+            if (rule.request.path_regex == null and rule.request.path_prefix == null and rule.request.path_segments == null and PathMatcher.isCatchAll(rule.request.path)) continue;
+            if (!try self.matchPath(request, rule)) continue;
+
+            for (rule.request.methods) |method| {
+                if (std.mem.eql(u8, method, "*")) return null;
+                const seen = for (methods.items) |listed| {
+                    if (std.ascii.eqlIgnoreCase(listed, method)) break true;
+                } else false;
+                if (!seen) try methods.append(method);
             }
         }
-        return null;
+
+        if (methods.items.len == 0) return null;
+        return try std.mem.join(allocator, ", ", methods.items);
+    }
+
+    /// Path specificity in the high bits, request constraint count in the low bits.
+    /// Catch-all rules score 0 and every other rule scores above it; regex
+    /// and prefix paths rank like a bare wildcard, below any literal or
+    /// parameter segment, with longer prefixes above shorter ones and all
+    /// prefixes above regex paths. A segment count is one more constraint.
+    fn specificity(rule: *const Rule) u64 {
+        if (rule.request.path_regex == null and rule.request.path_prefix == null and rule.request.path_segments == null and PathMatcher.isCatchAll(rule.request.path)) return 0;
+
+        var constraints: u32 = 0;
+        if (rule.request.headers) |headers| constraints += headers.count();
+        if (rule.request.headers_absent) |names| constraints += @intCast(@min(names.len, 0xffff));
+        if (rule.request.query) |query| constraints += query.count();
+        if (rule.request.cookies) |cookies| constraints += cookies.count();
+        if (rule.request.form) |form| constraints += form.count();
+        if (rule.request.multipart) |multipart| constraints += multipart.count();
+        if (rule.request.jsonrpc != null) constraints += 1;
+        if (rule.request.body != null) constraints += 1;
+        if (rule.request.body_regex != null) constraints += 1;
+        if (rule.request.body_size != null) constraints += 1;
+        if (rule.request.content_type != null) constraints += 1;
+        if (rule.request.client_ip != null) constraints += 1;
+        if (rule.request.proto != null) constraints += 1;
+        if (rule.request.path_segments != null) constraints += 1;
+        if (rule.request.body_json) |body_json| constraints += body_json.count();
+        const counted: u64 = @min(constraints, 0xffff);
+        if (rule.request.path_prefix) |prefix| {
+            return (1 << 32) | ((@as(u64, @min(prefix.len, 0xfffe)) + 1) << 16) | counted;
+        }
+        const path_score: u32 = if (rule.request.path_regex != null) 0 else PathMatcher.specificity(rule.request.path);
+        return (@as(u64, path_score + 1) << 32) | counted;
     }
 
     /// Check if a single rule matches the request
-    pub fn doesRuleMatch(self: *RequestMatcher, request: *const Request, rule: *const Rule) bool {
+    pub fn doesRuleMatch(self: *RequestMatcher, request: *const Request, rule: *const Rule) !bool {
+        if (rule.listener != request.listener) return false;
+        // Sizes count the bytes received, so they're checked before decoding
+        if (rule.request.body_size) |size| {
+            if (!size.contains(request.body.len)) return false;
+        }
+        const charset = rule.request.charset orelse self.charset orelse return self.matchConditions(request, rule);
+        if (charset == .utf_8 or request.body.len == 0) return self.matchConditions(request, rule);
+
+        var decoded = request.*;
+        decoded.body = charset.decode(request.arena, request.body) catch return false;
+        return self.matchConditions(&decoded, rule);
+    }
+
+    fn matchConditions(self: *RequestMatcher, request: *const Request, rule: *const Rule) !bool {
         // Check HTTP method
         if (!self.matchMethod(request, rule)) {
             return false;
         }
 
         // Check path
-        if (!self.matchPath(request, rule)) {
+        if (!try self.matchPath(request, rule)) {
+            return false;
+        }
+
+        // Check query parameters if specified
+        if (!self.matchQuery(request, rule)) {
             return false;
         }
 
@@ -43,8 +158,48 @@ pub const RequestMatcher = struct {
             return false;
         }
 
+        // Check absent headers if specified
+        if (!matchHeadersAbsent(request, rule)) {
+            return false;
+        }
+
+        // Check cookies if specified
+        if (!matchCookies(request, rule)) {
+            return false;
+        }
+
+        // Check form fields if specified
+        if (!matchForm(request, rule)) {
+            return false;
+        }
+
+        // Check multipart parts if specified
+        if (!matchMultipart(request, rule)) {
+            return false;
+        }
+
+        // Check JSON-RPC method if specified
+        if (!matchJsonRpc(request, rule)) {
+            return false;
+        }
+
+        // Check content type if specified
+        if (!matchContentType(request, rule)) {
+            return false;
+        }
+
+        // Check client address if specified
+        if (!self.matchClientIp(request, rule)) {
+            return false;
+        }
+
+        // Check protocol version if specified
+        if (!matchProto(request, rule)) {
+            return false;
+        }
+
         // Check body if specified
-        if (!self.matchBody(request, rule)) {
+        if (!try self.matchBody(request, rule)) {
             return false;
         }
 
@@ -54,25 +209,125 @@ pub const RequestMatcher = struct {
     fn matchMethod(self: *RequestMatcher, request: *const Request, rule: *const Rule) bool {
         _ = self;
         
-        const request_method = request.method.toString();
-        const rule_method = rule.request.method;
-        
-        return std.ascii.eqlIgnoreCase(request_method, rule_method);
+        return rule.request.allowsMethod(request.method.toString());
+    }
+
+    fn matchPath(self: *RequestMatcher, request: *const Request, rule: *const Rule) !bool {
+        if (rule.request.path_segments) |segments| {
+            if (PathMatcher.segmentCount(request.path) != segments) return false;
+        }
+        if (rule.request.path_regex != null) {
+            // An invalid pattern never matches
+            const regex = rule.request.regex orelse return false;
+            if (try regex.isMatch(request.path)) return true;
+            if (self.strict_slash) return false;
+
+            var fallback = std.heap.stackFallback(512, self.allocator);
+            const allocator = fallback.get();
+            const other = try PathMatcher.toggleTrailingSlash(allocator, request.path);
+            defer allocator.free(other);
+            return regex.isMatch(other);
+        }
+        if (rule.request.path_prefix) |prefix| {
+            return PathMatcher.hasPrefix(request.path, prefix, self.case_insensitive);
+        }
+        return PathMatcher.matchesWith(request.path, rule.request.path, self.strict_slash, self.case_insensitive);
     }
 
-    fn matchPath(self: *RequestMatcher, request: *const Request, rule: *const Rule) bool {
+    /// Every configured parameter must be present with its exact decoded value.
+    /// For repeated parameters (`?id=1&id=2`) the rule matches if any occurrence
+    /// equals the expected value, so `id: "2"` matches that request.
+    fn matchQuery(self: *RequestMatcher, request: *const Request, rule: *const Rule) bool {
         _ = self;
-        
-        const request_path = request.path;
-        const rule_path = rule.request.path;
-        
-        // For now, exact match. Could be extended to support:
-        // - Wildcards: /api/*
-        // - Path parameters: /api/users/{id}
-        // - Regex patterns: /api/users/\d+
-        return std.mem.eql(u8, request_path, rule_path);
+
+        const rule_query = rule.request.query orelse return true;
+
+        var iter = rule_query.iterator();
+        while (iter.next()) |entry| {
+            if (!queryHasValue(request, entry.key_ptr.*, entry.value_ptr.*)) {
+                return false;
+            }
+        }
+
+        return true;
+    }
+
+    fn queryHasValue(request: *const Request, name: []const u8, expected_value: []const u8) bool {
+        return hasValue(request.queryParams(), name, expected_value);
+    }
+
+    /// Like Go's `Request.Form`, a field matches whether it was posted in a
+    /// form body or sent in the query string
+    fn matchForm(request: *const Request, rule: *const Rule) bool {
+        const rule_form = rule.request.form orelse return true;
+
+        var iter = rule_form.iterator();
+        while (iter.next()) |entry| {
+            const name = entry.key_ptr.*;
+            const expected_value = entry.value_ptr.*;
+            if (!hasValue(request.postFormParams(), name, expected_value) and !queryHasValue(request, name, expected_value)) {
+                return false;
+            }
+        }
+
+        return true;
+    }
+
+    fn hasValue(form_params: interfaces.FormIterator, name: []const u8, expected_value: []const u8) bool {
+        var params = form_params;
+        // A decode failure (out of memory) is treated as a non-match
+        while (params.next() catch return false) |param| {
+            if (std.mem.eql(u8, param.name, name) and std.mem.eql(u8, param.value, expected_value)) {
+                return true;
+            }
+        }
+        return false;
+    }
+
+    /// Each configured part must appear under its name. An upload is compared
+    /// by filename and a plain field by its contents; with repeated names any
+    /// part may match, as with query parameters.
+    fn matchMultipart(request: *const Request, rule: *const Rule) bool {
+        const rule_parts = rule.request.multipart orelse return true;
+
+        var iter = rule_parts.iterator();
+        next_entry: while (iter.next()) |entry| {
+            // An allocation failure is treated as a non-match
+            var parts = request.multipartParts() catch return false;
+            while (parts.next()) |part| {
+                if (!std.mem.eql(u8, part.name, entry.key_ptr.*)) continue;
+                const actual = part.filename orelse part.data;
+                if (std.mem.eql(u8, actual, entry.value_ptr.*)) continue :next_entry;
+            }
+            return false;
+        }
+        return true;
+    }
+
+    /// The body must be a single JSON-RPC 2.0 call of the configured method.
+    /// The app splits batches into calls before matching.
+    fn matchJsonRpc(request: *const Request, rule: *const Rule) bool {
+        const method = rule.request.jsonrpc orelse return true;
+        // An allocation failure is treated as a non-match
+        const call = (jsonrpc.parseCall(request.arena, request.body) catch return false) orelse return false;
+        return std.mem.eql(u8, call.method, method);
+    }
+
+    /// Cookie names and decoded values are compared exactly; with repeated
+    /// names the first cookie counts, as most servers read it
+    fn matchCookies(request: *const Request, rule: *const Rule) bool {
+        const rule_cookies = rule.request.cookies orelse return true;
+
+        var iter = rule_cookies.iterator();
+        while (iter.next()) |entry| {
+            // A decode failure (out of memory) is treated as a non-match
+            const actual = (request.getCookie(entry.key_ptr.*) catch return false) orelse return false;
+            if (!std.mem.eql(u8, actual, entry.value_ptr.*)) return false;
+        }
+        return true;
     }
 
+    /// Header names are compared case-insensitively, values exactly
     fn matchHeaders(self: *RequestMatcher, request: *const Request, rule: *const Rule) bool {
         _ = self;
         
@@ -93,17 +348,76 @@ pub const RequestMatcher = struct {
         return true;
     }
 
-    fn matchBody(self: *RequestMatcher, request: *const Request, rule: *const Rule) bool {
+    /// None of the `headers_absent` names may be sent, even empty
+    fn matchHeadersAbsent(request: *const Request, rule: *const Rule) bool {
+        const names = rule.request.headers_absent orelse return true;
+        for (names) |name| {
+            if (request.getHeader(name) != null) return false;
+        }
+        return true;
+    }
+
+    /// Media types are compared case-insensitively, so `application/json`
+    /// matches `Application/JSON; charset=utf-8`
+    fn matchContentType(request: *const Request, rule: *const Rule) bool {
+        const expected = rule.request.content_type orelse return true;
+        const actual = request.getHeader("Content-Type") orelse return false;
+        return std.ascii.eqlIgnoreCase(interfaces.mediaType(actual), interfaces.mediaType(expected));
+    }
+
+    /// An invalid `client_ip` matches no one
+    fn matchClientIp(self: *RequestMatcher, request: *const Request, rule: *const Rule) bool {
+        if (rule.request.client_ip == null) return true;
+        const range = rule.request.client_range orelse return false;
+        const address = client_ip.clientAddress(request, self.trust_proxy) orelse return false;
+        return range.contains(address);
+    }
+
+    /// An invalid `proto` matches nothing
+    fn matchProto(request: *const Request, rule: *const Rule) bool {
+        if (rule.request.proto == null) return true;
+        const version = rule.request.proto_version orelse return false;
+        return request.protocol == version;
+    }
+
+    fn matchBody(self: *RequestMatcher, request: *const Request, rule: *const Rule) !bool {
         _ = self;
         
-        const expected_body = rule.request.body orelse return true;
-        return std.mem.eql(u8, request.body, expected_body);
+        if (rule.request.body) |expected_body| {
+            if (!std.mem.eql(u8, request.body, expected_body)) return false;
+        }
+        if (rule.request.body_regex != null) {
+            // An invalid pattern never matches; validation reports it
+            const regex = rule.request.body_pattern orelse return false;
+            if (!try regex.isMatch(request.body)) return false;
+        }
+        if (rule.request.body_json) |conditions| {
+            return matchBodyJson(request, &conditions);
+        }
+        return true;
+    }
+
+    /// Every JSON path must resolve to its expected scalar. Bodies that are
+    /// not valid JSON simply don't match.
+    fn matchBodyJson(request: *const Request, conditions: *const std.StringHashMap([]const u8)) bool {
+        const root = std.json.parseFromSliceLeaky(std.json.Value, request.arena, request.body, .{}) catch return false;
+
+        var iter = conditions.iterator();
+        while (iter.next()) |entry| {
+            const value = (json_path.lookup(root, entry.key_ptr.*) catch return false) orelse return false;
+            if (!json_path.scalarEquals(value, entry.value_ptr.*)) return false;
+        }
+        return true;
     }
 };
 
 /// Advanced path matcher supporting wildcards and parameters
 pub const PathMatcher = struct {
     allocator: std.mem.Allocator,
+    /// Keep "/users" and "/users/" distinct; see `Config.strict_slash`
+    strict_slash: bool = false,
+    /// Ignore letter case in literal segments; see `Config.case_insensitive_paths`
+    case_insensitive: bool = false,
 
     pub fn init(allocator: std.mem.Allocator) PathMatcher {
         return PathMatcher{ .allocator = allocator };
@@ -111,73 +425,176 @@ pub const PathMatcher = struct {
 
     /// Match path with support for wildcards and parameters
     /// Examples:
-    /// - "/api/*" matches "/api/users" and "/api/posts"
-    /// - "/api/users/{id}" matches "/api/users/123" 
-    /// - "/api/users/{id}/posts/{post_id}" matches "/api/users/123/posts/456"
+    /// - "/api/*" matches "/api/users" and "/api/posts/7", capturing
+    ///   "users" and "posts/7" as the wildcard
+    /// - "/api/users/{id}" and "/api/users/:id" match "/api/users/123"
+    /// - "/orgs/:org/users/:id" matches "/orgs/acme/users/456"
+    /// Unless `strict_slash` is set, a single trailing slash on either side
+    /// is ignored, so "/api/users/123/" also matches "/api/users/:id".
     pub fn matchPath(self: *PathMatcher, request_path: []const u8, rule_path: []const u8) !?PathMatch {
-        if (std.mem.indexOf(u8, rule_path, "*") == null and 
-            std.mem.indexOf(u8, rule_path, "{") == null) {
-            // Simple exact match
-            if (std.mem.eql(u8, request_path, rule_path)) {
-                return PathMatch.init(self.allocator);
-            }
-            return null;
+        var match = PathMatch.init(self.allocator);
+        errdefer match.deinit();
+
+        if (try matchSegments(request_path, rule_path, &match, self.strict_slash, self.case_insensitive)) {
+            return match;
         }
+        match.deinit();
+        return null;
+    }
 
-        return self.matchPatternPath(request_path, rule_path);
+    /// Check whether a path matches without capturing parameters, ignoring
+    /// a trailing slash
+    pub fn matches(request_path: []const u8, rule_path: []const u8) bool {
+        return matchesWith(request_path, rule_path, false, false);
     }
 
-    fn matchPatternPath(self: *PathMatcher, request_path: []const u8, rule_path: []const u8) !?PathMatch {
-        var match = PathMatch.init(self.allocator);
-        errdefer match.deinit();
+    /// `matches`, keeping trailing slashes significant when `strict_slash` is
+    /// set and ignoring letter case when `case_insensitive` is
+    pub fn matchesWith(request_path: []const u8, rule_path: []const u8, strict_slash: bool, case_insensitive: bool) bool {
+        // Capturing is disabled, so no allocation can fail
+        return matchSegments(request_path, rule_path, null, strict_slash, case_insensitive) catch unreachable;
+    }
+
+    /// The path with its trailing slash removed, or with one added if it has
+    /// none, for retrying a regex that must not care about the slash
+    pub fn toggleTrailingSlash(allocator: std.mem.Allocator, path: []const u8) ![]u8 {
+        if (path.len > 1 and path[path.len - 1] == '/') return allocator.dupe(u8, path[0 .. path.len - 1]);
+        return std.mem.concat(allocator, u8, &.{ path, "/" });
+    }
+
+    /// Whether the rule path is the bare `*` catch-all, which matches any path
+    pub fn isCatchAll(rule_path: []const u8) bool {
+        return std.mem.eql(u8, rule_path, "*");
+    }
+
+    /// Whether `request_path` is `prefix` or lies under it, comparing whole
+    /// segments so "/api/v1" covers "/api/v1/users" but not "/api/v10".
+    /// A trailing slash on either side is ignored.
+    pub fn hasPrefix(request_path: []const u8, prefix: []const u8, case_insensitive: bool) bool {
+        const trimmed = trimTrailingSlash(prefix);
+        if (request_path.len < trimmed.len) return false;
+        const head = request_path[0..trimmed.len];
+        const same = if (case_insensitive) std.ascii.eqlIgnoreCase(head, trimmed) else std.mem.eql(u8, head, trimmed);
+        if (!same) return false;
+        return request_path.len == trimmed.len or trimmed[trimmed.len - 1] == '/' or request_path[trimmed.len] == '/';
+    }
+
+    /// Non-empty segments in `request_path`, so "/a/b/" and "//a/b" have 2
+    pub fn segmentCount(request_path: []const u8) usize {
+        var count: usize = 0;
+        var segments = std.mem.tokenizeScalar(u8, request_path, '/');
+        while (segments.next()) |_| count += 1;
+        return count;
+    }
+
+    /// Whether the rule path contains wildcards or parameters. Only a whole
+    /// `*` segment, or a segment starting with `:` or wrapped in `{}`, counts,
+    /// so "/v1/items:batch" is a literal path.
+    pub fn isPattern(rule_path: []const u8) bool {
+        var segments = std.mem.tokenizeScalar(u8, rule_path, '/');
+        while (segments.next()) |segment| {
+            if (std.mem.eql(u8, segment, "*") or parameterName(segment) != null) return true;
+        }
+        return false;
+    }
+
+    /// Rank a rule path so literal routes win over parameterised ones:
+    /// each literal segment scores 2, each parameter 1 and a wildcard 0,
+    /// with a bonus for fully literal paths. "/users/me" therefore beats "/users/:id".
+    pub fn specificity(rule_path: []const u8) u32 {
+        var score: u32 = 0;
+        var segments = std.mem.tokenizeScalar(u8, rule_path, '/');
+        while (segments.next()) |segment| {
+            if (std.mem.eql(u8, segment, "*")) continue;
+            score += if (parameterName(segment) != null) 1 else 2;
+        }
+        if (!isPattern(rule_path)) score += 1;
+        return score;
+    }
+
+    fn parameterName(segment: []const u8) ?[]const u8 {
+        if (segment.len > 2 and segment[0] == '{' and segment[segment.len - 1] == '}') {
+            return segment[1 .. segment.len - 1];
+        }
+        if (segment.len > 1 and segment[0] == ':') {
+            return segment[1..];
+        }
+        return null;
+    }
+
+    fn trimTrailingSlash(path: []const u8) []const u8 {
+        if (path.len > 1 and path[path.len - 1] == '/') {
+            return path[0 .. path.len - 1];
+        }
+        return path;
+    }
+
+    /// Captured parameters and wildcards keep the request's own casing
+    fn matchSegments(request_path: []const u8, rule_path: []const u8, captures: ?*PathMatch, strict_slash: bool, case_insensitive: bool) !bool {
+        const request_trimmed = if (strict_slash) request_path else trimTrailingSlash(request_path);
+        const rule_trimmed = if (strict_slash) rule_path else trimTrailingSlash(rule_path);
+        if (!isPattern(rule_path)) {
+            // Simple exact match
+            return literalEql(request_trimmed, rule_trimmed, case_insensitive);
+        }
 
         // Split paths into segments
-        var request_segments = std.mem.splitScalar(u8, request_path, '/');
-        var rule_segments = std.mem.splitScalar(u8, rule_path, '/');
+        var request_segments = std.mem.splitScalar(u8, request_trimmed, '/');
+        var rule_segments = std.mem.splitScalar(u8, rule_trimmed, '/');
 
         while (true) {
+            const req_start = request_segments.index orelse request_trimmed.len;
             const req_segment = request_segments.next();
             const rule_segment = rule_segments.next();
 
             // Both exhausted - match
             if (req_segment == null and rule_segment == null) {
-                return match;
+                return true;
             }
 
             // Only one exhausted - no match unless rule ends with wildcard
             if (req_segment == null or rule_segment == null) {
-                if (rule_segment != null and std.mem.eql(u8, rule_segment.?, "*")) {
-                    return match;
-                }
-                return null;
+                if (rule_segment == null or !std.mem.eql(u8, rule_segment.?, "*")) return false;
+                if (captures) |match| try match.setWildcard("");
+                return true;
             }
 
             const req_seg = req_segment.?;
             const rule_seg = rule_segment.?;
 
-            // Wildcard matches everything remaining
+            // Wildcard matches everything remaining, slashes included
             if (std.mem.eql(u8, rule_seg, "*")) {
-                return match;
+                if (captures) |match| try match.setWildcard(request_trimmed[req_start..]);
+                return true;
             }
 
-            // Parameter extraction
-            if (std.mem.startsWith(u8, rule_seg, "{") and std.mem.endsWith(u8, rule_seg, "}")) {
-                const param_name = rule_seg[1..rule_seg.len-1];
-                try match.addParameter(param_name, req_seg);
+            // Parameter extraction - parameters never match an empty segment
+            if (parameterName(rule_seg)) |param_name| {
+                if (req_seg.len == 0) return false;
+                if (captures) |match| {
+                    try match.addParameter(param_name, req_seg);
+                }
                 continue;
             }
 
             // Exact segment match
-            if (!std.mem.eql(u8, req_seg, rule_seg)) {
-                return null;
+            if (!literalEql(req_seg, rule_seg, case_insensitive)) {
+                return false;
             }
         }
     }
+
+    fn literalEql(request_text: []const u8, rule_text: []const u8, case_insensitive: bool) bool {
+        if (case_insensitive) return std.ascii.eqlIgnoreCase(request_text, rule_text);
+        return std.mem.eql(u8, request_text, rule_text);
+    }
 };
 
 /// Result of a successful path match, containing extracted parameters
 pub const PathMatch = struct {
     parameters: std.StringHashMap([]const u8),
+    /// The part of the path a `*` segment matched, without its leading slash
+    wildcard: ?[]const u8 = null,
     allocator: std.mem.Allocator,
 
     pub fn init(allocator: std.mem.Allocator) PathMatch {
@@ -194,6 +611,9 @@ pub const PathMatch = struct {
             self.allocator.free(entry.value_ptr.*);
         }
         self.parameters.deinit();
+        if (self.wildcard) |wildcard| {
+            self.allocator.free(wildcard);
+        }
     }
 
     pub fn addParameter(self: *PathMatch, name: []const u8, value: []const u8) !void {
@@ -202,6 +622,12 @@ pub const PathMatch = struct {
         try self.parameters.put(owned_name, owned_value);
     }
 
+    pub fn setWildcard(self: *PathMatch, value: []const u8) !void {
+        const owned = try self.allocator.dupe(u8, value);
+        if (self.wildcard) |previous| self.allocator.free(previous);
+        self.wildcard = owned;
+    }
+
     pub fn getParameter(self: *const PathMatch, name: []const u8) ?[]const u8 {
         return self.parameters.get(name);
     }
@@ -233,11 +659,11 @@ test "RequestMatcher.exact_match" {
     const rule = Rule{
         .request = config.RequestRule{
             .path = "/api/health",
-            .method = "GET",
+            .methods = &.{"GET"},
         },
     };
     
-    try std.testing.expect(matcher.doesRuleMatch(&request, &rule));
+    try std.testing.expect(try matcher.doesRuleMatch(&request, &rule));
 }
 
 test "RequestMatcher.method_mismatch" {
@@ -260,24 +686,1032 @@ test "RequestMatcher.method_mismatch" {
     const rule = Rule{
         .request = config.RequestRule{
             .path = "/api/health",
-            .method = "GET", // Different method
+            .methods = &.{"GET"}, // Different method
         },
     };
     
-    try std.testing.expect(!matcher.doesRuleMatch(&request, &rule));
+    try std.testing.expect(!try matcher.doesRuleMatch(&request, &rule));
 }
 
-test "PathMatcher.wildcard" {
+test "RequestMatcher.allowed_methods" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const allocator = arena.allocator();
+
+    var matcher = RequestMatcher.init(allocator);
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/users/:id", .methods = &.{ "GET", "PUT" } } },
+        .{ .request = .{ .path = "/users/:id", .methods = &.{ "DELETE", "GET" } } },
+        .{ .request = .{ .path = "/health", .methods = &.{"*"} } },
+        .{ .request = .{ .path = "*", .methods = &.{"GET"} } },
+    };
+
+    var request = Request{
+        .method = .POST,
+        .path = "/users/42",
+        .query = "",
+        .headers = HeaderMap.init(allocator),
+        .body = "",
+        .arena = allocator,
+    };
+    try std.testing.expectEqualStrings("GET, PUT, DELETE", (try matcher.allowedMethods(allocator, &request, &rules)).?);
+
+    // Unknown paths are a 404, even with a catch-all for another method
+    request.path = "/orders";
+    try std.testing.expect(try matcher.allowedMethods(allocator, &request, &rules) == null);
+
+    // A rule accepting any method failed on something other than the method
+    request.path = "/health";
+    try std.testing.expect(try matcher.allowedMethods(allocator, &request, &rules) == null);
+}
+
+test "RequestMatcher.query_match" {
     const allocator = std.testing.allocator;
-    
-    var matcher = PathMatcher.init(allocator);
-    
-    const result = try matcher.matchPath("/api/users/123", "/api/*");
-    try std.testing.expect(result != null);
-    
-    if (result) |match| {
-        var match_copy = match;
-        defer match_copy.deinit();
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var matcher = RequestMatcher.init(allocator);
+
+    var headers = HeaderMap.init(allocator);
+    defer headers.deinit();
+
+    var query = std.StringHashMap([]const u8).init(allocator);
+    defer query.deinit();
+    try query.put("active", "true");
+    try query.put("name", "Jane Doe");
+
+    const rule = Rule{
+        .request = config.RequestRule{
+            .path = "/users",
+            .methods = &.{"GET"},
+            .query = query,
+        },
+    };
+
+    var request = Request{
+        .method = .GET,
+        .path = "/users",
+        .query = "id=1&active=true&name=Jane%20Doe",
+        .headers = headers,
+        .body = "",
+        .arena = arena.allocator(),
+    };
+    try std.testing.expect(try matcher.doesRuleMatch(&request, &rule));
+
+    request.query = "active=false&name=Jane%20Doe";
+    try std.testing.expect(!try matcher.doesRuleMatch(&request, &rule));
+
+    request.query = "";
+    try std.testing.expect(!try matcher.doesRuleMatch(&request, &rule));
+}
+
+test "RequestMatcher.query_repeated_params" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var matcher = RequestMatcher.init(allocator);
+
+    var headers = HeaderMap.init(allocator);
+    defer headers.deinit();
+
+    var query = std.StringHashMap([]const u8).init(allocator);
+    defer query.deinit();
+    try query.put("id", "2");
+
+    const rule = Rule{
+        .request = config.RequestRule{
+            .path = "/users",
+            .methods = &.{"GET"},
+            .query = query,
+        },
+    };
+
+    const request = Request{
+        .method = .GET,
+        .path = "/users",
+        .query = "id=1&id=2",
+        .headers = headers,
+        .body = "",
+        .arena = arena.allocator(),
+    };
+    try std.testing.expect(try matcher.doesRuleMatch(&request, &rule));
+}
+
+test "RequestMatcher.cookies" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var matcher = RequestMatcher.init(allocator);
+
+    var cookies = std.StringHashMap([]const u8).init(allocator);
+    defer cookies.deinit();
+    try cookies.put("session", "user:42");
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/account", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "/account", .methods = &.{"GET"}, .cookies = cookies } },
+    };
+
+    var request = Request{
+        .method = .GET,
+        .path = "/account",
+        .query = "",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "",
+        .arena = arena.allocator(),
+    };
+    try std.testing.expectEqual(&rules[0], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    // Repeated Cookie headers arrive joined with "; "
+    try request.headers.put("cookie", "theme=dark; session=user%3A42");
+    try std.testing.expectEqual(&rules[1], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    try request.headers.put("cookie", "session=user:7");
+    try std.testing.expectEqual(&rules[0], (try matcher.findMatchingRule(&request, &rules)).?);
+}
+
+test "RequestMatcher.prefers_header_constraints" {
+    const allocator = std.testing.allocator;
+
+    var matcher = RequestMatcher.init(allocator);
+
+    var rule_headers = std.StringHashMap([]const u8).init(allocator);
+    defer rule_headers.deinit();
+    try rule_headers.put("Authorization", "Bearer token");
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/api/protected", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "/api/protected", .methods = &.{"GET"}, .headers = rule_headers } },
+    };
+
+    var request = Request{
+        .method = .GET,
+        .path = "/api/protected",
+        .query = "",
+        .headers = HeaderMap.init(allocator),
+        .body = "",
+        .arena = allocator,
+    };
+    defer request.deinit();
+    try std.testing.expectEqual(&rules[0], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    // httpz lowercases incoming header names
+    try request.headers.put("authorization", "Bearer token");
+    try std.testing.expectEqual(&rules[1], (try matcher.findMatchingRule(&request, &rules)).?);
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+
+    // Values are case-sensitive
+    try request.headers.put("authorization", "bearer token");
+    try std.testing.expectEqual(&rules[0], (try matcher.findMatchingRule(&request, &rules)).?);
+}
+
+test "RequestMatcher.content_type" {
+    const allocator = std.testing.allocator;
+
+    var matcher = RequestMatcher.init(allocator);
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/api/login", .methods = &.{"POST"} } },
+        .{ .request = .{ .path = "/api/login", .methods = &.{"POST"}, .content_type = "application/json" } },
+        .{ .request = .{ .path = "/api/login", .methods = &.{"POST"}, .content_type = "application/x-www-form-urlencoded; charset=utf-8" } },
+    };
+
+    var request = Request{
+        .method = .POST,
+        .path = "/api/login",
+        .query = "",
+        .headers = HeaderMap.init(allocator),
+        .body = "",
+        .arena = allocator,
+    };
+    defer request.deinit();
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+
+    try request.headers.put("content-type", "application/json; charset=utf-8");
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+
+    try request.headers.put("content-type", "Application/JSON");
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+
+    try request.headers.put("content-type", "application/x-www-form-urlencoded");
+    try std.testing.expectEqual(@as(?usize, 2), try matcher.findMatchingIndex(&request, &rules));
+
+    try request.headers.put("content-type", "application/jsonl");
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+}
+
+test "RequestMatcher.form_fields" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var matcher = RequestMatcher.init(allocator);
+
+    var form = std.StringHashMap([]const u8).init(allocator);
+    defer form.deinit();
+    try form.put("action", "delete");
+    try form.put("name", "Jane Doe");
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/legacy", .methods = &.{"*"} } },
+        .{ .request = .{ .path = "/legacy", .methods = &.{"*"}, .form = form } },
+    };
+
+    var request = Request{
+        .method = .POST,
+        .path = "/legacy",
+        .query = "",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "action=delete&name=Jane+Doe",
+        .arena = arena.allocator(),
+    };
+
+    // The body only counts as a form with the form content type
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+    try request.headers.put("content-type", "application/x-www-form-urlencoded; charset=utf-8");
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+
+    // Fields can come from the body and the query string together
+    request.body = "action=delete";
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+    request.query = "name=Jane%20Doe";
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+
+    // A GET body is never read as a form, but its query string is
+    request.method = .GET;
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+    request.query = "action=delete&name=Jane+Doe";
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+}
+
+test "RequestMatcher.multipart" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var matcher = RequestMatcher.init(allocator);
+
+    var multipart = std.StringHashMap([]const u8).init(allocator);
+    defer multipart.deinit();
+    try multipart.put("kind", "avatar");
+    try multipart.put("upload", "me.jpg");
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/upload", .methods = &.{"POST"} } },
+        .{ .request = .{ .path = "/upload", .methods = &.{"POST"}, .multipart = multipart } },
+    };
+
+    var request = Request{
+        .method = .POST,
+        .path = "/upload",
+        .query = "",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "--b0undary\r\n" ++
+            "Content-Disposition: form-data; name=\"kind\"\r\n" ++
+            "\r\n" ++
+            "avatar\r\n" ++
+            "--b0undary\r\n" ++
+            "Content-Disposition: form-data; name=\"upload\"; filename=\"me.jpg\"\r\n" ++
+            "Content-Type: image/jpeg\r\n" ++
+            "\r\n" ++
+            "not really a jpeg\r\n" ++
+            "--b0undary--\r\n",
+        .arena = arena.allocator(),
+    };
+
+    // Without the multipart content type the body is opaque
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+    try request.headers.put("Content-Type", "multipart/form-data; boundary=b0undary");
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+
+    // A file part is matched by its filename, not its contents
+    try multipart.put("upload", "not really a jpeg");
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+}
+
+test "RequestMatcher.jsonrpc" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var matcher = RequestMatcher.init(allocator);
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/rpc", .methods = &.{"POST"}, .jsonrpc = "eth_getBalance" } },
+        .{ .request = .{ .path = "/rpc", .methods = &.{"POST"}, .jsonrpc = "eth_blockNumber" } },
+    };
+
+    var request = Request{
+        .method = .POST,
+        .path = "/rpc",
+        .query = "",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "{\"jsonrpc\": \"2.0\", \"method\": \"eth_blockNumber\", \"id\": 1}",
+        .arena = arena.allocator(),
+    };
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+
+    request.body = "{\"jsonrpc\": \"2.0\", \"method\": \"eth_call\", \"id\": 1}";
+    try std.testing.expectEqual(@as(?usize, null), try matcher.findMatchingIndex(&request, &rules));
+
+    // Neither other JSON-RPC versions nor whole batches match
+    request.body = "{\"jsonrpc\": \"1.0\", \"method\": \"eth_getBalance\", \"id\": 1}";
+    try std.testing.expectEqual(@as(?usize, null), try matcher.findMatchingIndex(&request, &rules));
+    request.body = "[{\"jsonrpc\": \"2.0\", \"method\": \"eth_getBalance\", \"id\": 1}]";
+    try std.testing.expectEqual(@as(?usize, null), try matcher.findMatchingIndex(&request, &rules));
+}
+
+test "RequestMatcher.client_ip" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var matcher = RequestMatcher.init(allocator);
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/admin", .methods = &.{"GET"}, .client_ip = "10.0.0.0/8", .client_range = client_ip.IpRange.parse("10.0.0.0/8") } },
+        .{ .request = .{ .path = "/admin", .methods = &.{"GET"} } },
+    };
+
+    var request = Request{
+        .method = .GET,
+        .path = "/admin",
+        .query = "",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "",
+        .client_address = try std.net.Address.parseIp("10.1.2.3", 40000),
+        .arena = arena.allocator(),
+    };
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+
+    request.client_address = try std.net.Address.parseIp("203.0.113.9", 40000);
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+
+    // X-Forwarded-For only counts behind a trusted proxy
+    try request.headers.put("X-Forwarded-For", "10.9.8.7, 203.0.113.9");
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+    matcher.trust_proxy = true;
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+
+    // A forwarded address that doesn't parse falls back to the connection's
+    try request.headers.put("X-Forwarded-For", "unknown");
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+    request.client_address = null;
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+}
+
+test "RequestMatcher.proto" {
+    const allocator = std.testing.allocator;
+
+    var matcher = RequestMatcher.init(allocator);
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/legacy", .methods = &.{"GET"}, .proto = "1.0", .proto_version = .http_1_0 } },
+        .{ .request = .{ .path = "/legacy", .methods = &.{"GET"}, .proto = "1.1", .proto_version = .http_1_1 } },
+        .{ .request = .{ .path = "/legacy", .methods = &.{"GET"}, .proto = "3", .proto_version = null } },
+    };
+
+    var headers = HeaderMap.init(allocator);
+    defer headers.deinit();
+
+    var request = Request{
+        .method = .GET,
+        .path = "/legacy",
+        .query = "",
+        .headers = headers,
+        .body = "",
+        .arena = allocator,
+    };
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+
+    request.protocol = .http_1_0;
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+
+    try std.testing.expectEqual(@as(?interfaces.Protocol, .http_1_1), interfaces.Protocol.parse("HTTP/1.1"));
+    // Versions the server can't receive aren't versions a rule can ask for
+    try std.testing.expectEqual(@as(?interfaces.Protocol, null), interfaces.Protocol.parse("2"));
+    try std.testing.expectEqual(@as(?interfaces.Protocol, null), interfaces.Protocol.parse("1"));
+}
+
+test "RequestMatcher.headers_absent" {
+    const allocator = std.testing.allocator;
+
+    var matcher = RequestMatcher.init(allocator);
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/me", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "/me", .methods = &.{"GET"}, .headers_absent = &.{ "Authorization", "X-Api-Key" } } },
+    };
+
+    var request = Request{
+        .method = .GET,
+        .path = "/me",
+        .query = "",
+        .headers = HeaderMap.init(allocator),
+        .body = "",
+        .arena = allocator,
+    };
+    defer request.headers.deinit();
+    // Missing both, so the more specific anonymous route wins
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+
+    // Either header is enough to fall through to the signed-in route,
+    // whatever its case or value
+    try request.headers.put("authorization", "Bearer abc");
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+    _ = request.headers.remove("authorization");
+    try request.headers.put("X-API-KEY", "");
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+}
+
+test "RequestMatcher.body_size" {
+    const allocator = std.testing.allocator;
+
+    var matcher = RequestMatcher.init(allocator);
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/upload", .methods = &.{"POST"}, .body_size = .{ .max = 0 } } },
+        .{ .request = .{ .path = "/upload", .methods = &.{"POST"}, .body_size = .{ .min = 1, .max = 1024 } } },
+        .{ .request = .{ .path = "/upload", .methods = &.{"POST"}, .body_size = .{ .min = 1025 } } },
+    };
+
+    var request = Request{
+        .method = .POST,
+        .path = "/upload",
+        .query = "",
+        .headers = HeaderMap.init(allocator),
+        .body = "",
+        .arena = allocator,
+    };
+    defer request.headers.deinit();
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+
+    request.body = "{\"name\":\"Ada\"}";
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+
+    // Both bounds are inclusive
+    const large = try allocator.alloc(u8, 1025);
+    defer allocator.free(large);
+    @memset(large, 'x');
+    request.body = large[0..1024];
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+    request.body = large;
+    try std.testing.expectEqual(@as(?usize, 2), try matcher.findMatchingIndex(&request, &rules));
+}
+
+test "RequestMatcher.body_regex" {
+    const allocator = std.testing.allocator;
+
+    var matcher = RequestMatcher.init(allocator);
+
+    var regex = try Regex.compile(allocator, "\\{\"order\":\\s*(\\d+).*", null);
+    defer regex.deinit();
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/orders", .methods = &.{"POST"}, .body_regex = "\\{\"order\":\\s*(\\d+).*", .body_pattern = regex } },
+        // Never compiled, as with an invalid pattern
+        .{ .request = .{ .path = "/orders", .methods = &.{"POST"}, .body_regex = "(" } },
+        .{ .request = .{ .path = "/orders", .methods = &.{"POST"} } },
+    };
+
+    var request = Request{
+        .method = .POST,
+        .path = "/orders",
+        .query = "",
+        .headers = HeaderMap.init(allocator),
+        .body = "{\"order\": 42,\n\"note\": \"rush\"}",
+        .arena = allocator,
+    };
+    defer request.headers.deinit();
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+
+    // The pattern must cover the whole body
+    request.body = "[{\"order\": 42}]";
+    try std.testing.expectEqual(@as(?usize, 2), try matcher.findMatchingIndex(&request, &rules));
+    request.body = "{\"order\": \"x\"}";
+    try std.testing.expectEqual(@as(?usize, 2), try matcher.findMatchingIndex(&request, &rules));
+}
+
+test "RequestMatcher.proxy_and_mock_rules_compete" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    // The plain mock comes first, so only specificity can make the proxy win
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/orders"
+        \\    method: GET
+        \\  response:
+        \\    body: "mocked"
+        \\- request:
+        \\    path: "/api/orders"
+        \\    method: GET
+        \\    headers:
+        \\      X-Use-Upstream: "1"
+        \\  proxy:
+        \\    url: "https://api.example.com"
+    ;
+
+    var loaded = try config.Config.loadFromYaml(allocator, yaml_content);
+    defer loaded.deinit();
+    var matcher = RequestMatcher.init(allocator);
+
+    var request = Request{
+        .method = .GET,
+        .path = "/api/orders",
+        .query = "",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "",
+        .arena = arena.allocator(),
+    };
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, loaded.rules.items));
+
+    try request.headers.put("X-Use-Upstream", "1");
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, loaded.rules.items));
+    try std.testing.expect(loaded.rules.items[1].isProxy());
+
+    // Neither shadows the other, so no conflict is reported
+    const conflicts = try loaded.findConflicts(allocator);
+    defer allocator.free(conflicts);
+    try std.testing.expectEqual(@as(usize, 0), conflicts.len);
+}
+
+test "PathMatcher.colon_parameters" {
+    const allocator = std.testing.allocator;
+
+    var matcher = PathMatcher.init(allocator);
+
+    var match = (try matcher.matchPath("/orgs/acme/users/42/", "/orgs/:org/users/:id")).?;
+    defer match.deinit();
+
+    try std.testing.expectEqualStrings("acme", match.getParameter("org").?);
+    try std.testing.expectEqualStrings("42", match.getParameter("id").?);
+
+    try std.testing.expect(PathMatcher.matches("/users/1", "/users/:id/"));
+    try std.testing.expect(!PathMatcher.matches("/users/", "/users/:id"));
+    try std.testing.expect(!PathMatcher.matches("/users/1/posts", "/users/:id"));
+
+    // A colon inside a segment is literal
+    try std.testing.expect(!PathMatcher.isPattern("/v1/items:batch"));
+    try std.testing.expect(PathMatcher.matches("/v1/items:batch", "/v1/items:batch"));
+    try std.testing.expect(!PathMatcher.matches("/v1/items:export", "/v1/items:batch"));
+    try std.testing.expect(PathMatcher.specificity("/v1/items:batch") > PathMatcher.specificity("/v1/:action"));
+}
+
+test "RequestMatcher.literal_beats_parameter" {
+    const allocator = std.testing.allocator;
+
+    var matcher = RequestMatcher.init(allocator);
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/users/:id", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "/users/me", .methods = &.{"GET"} } },
+    };
+
+    var headers = HeaderMap.init(allocator);
+    defer headers.deinit();
+
+    var request = Request{
+        .method = .GET,
+        .path = "/users/me",
+        .query = "",
+        .headers = headers,
+        .body = "",
+        .arena = allocator,
+    };
+    try std.testing.expectEqual(&rules[1], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    request.path = "/users/7";
+    try std.testing.expectEqual(&rules[0], (try matcher.findMatchingRule(&request, &rules)).?);
+}
+
+test "RequestMatcher.catch_all_ranks_last" {
+    const allocator = std.testing.allocator;
+
+    var matcher = RequestMatcher.init(allocator);
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "*", .methods = &.{"*"} } },
+        .{ .request = .{ .path = "/api/*", .methods = &.{"GET"} } },
+    };
+
+    var headers = HeaderMap.init(allocator);
+    defer headers.deinit();
+
+    var request = Request{
+        .method = .GET,
+        .path = "/api/users",
+        .query = "",
+        .headers = headers,
+        .body = "",
+        .arena = allocator,
+    };
+    try std.testing.expectEqual(&rules[1], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    request.method = .DELETE;
+    request.path = "/elsewhere";
+    try std.testing.expectEqual(&rules[0], (try matcher.findMatchingRule(&request, &rules)).?);
+}
+
+test "RequestMatcher.priority" {
+    const allocator = std.testing.allocator;
+
+    var matcher = RequestMatcher.init(allocator);
+
+    var headers = HeaderMap.init(allocator);
+    defer headers.deinit();
+
+    // A maintenance catch-all deliberately shadows the specific route
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/api/users/:id", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "/api/users/42", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "*", .methods = &.{"*"} }, .priority = 10 },
+    };
+
+    var request = Request{
+        .method = .GET,
+        .path = "/api/users/42",
+        .query = "",
+        .headers = headers,
+        .body = "",
+        .arena = allocator,
+    };
+    try std.testing.expectEqual(&rules[2], (try matcher.findMatchingRule(&request, &rules)).?);
+    // Without it, the literal route wins on specificity
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, rules[0..2]));
+
+    // Equal priorities fall back to specificity, then definition order
+    const tied = [_]Rule{
+        .{ .request = .{ .path = "/api/users/:id", .methods = &.{"GET"} }, .priority = 5 },
+        .{ .request = .{ .path = "/api/users/42", .methods = &.{"GET"} }, .priority = 5 },
+        .{ .request = .{ .path = "/api/users/42", .methods = &.{"GET"} }, .priority = 5 },
+        .{ .request = .{ .path = "/api/users/:id", .methods = &.{"GET"} }, .priority = -1 },
+    };
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &tied));
+
+    request.path = "/api/users/7";
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &tied));
+}
+
+test "RequestMatcher.strict_slash" {
+    const allocator = std.testing.allocator;
+
+    var regex = try Regex.compile(allocator, "/files/[a-z]+", null);
+    defer regex.deinit();
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/users", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "/teams/", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "/users/:id", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "", .path_regex = "/files/[a-z]+", .regex = regex, .methods = &.{"GET"} } },
+    };
+
+    var headers = HeaderMap.init(allocator);
+    defer headers.deinit();
+    var request = Request{
+        .method = .GET,
+        .path = "",
+        .query = "",
+        .headers = headers,
+        .body = "",
+        .arena = allocator,
+    };
+
+    const cases = [_]struct { path: []const u8, loose: ?usize, strict: ?usize }{
+        .{ .path = "/users", .loose = 0, .strict = 0 },
+        .{ .path = "/users/", .loose = 0, .strict = null },
+        .{ .path = "/teams", .loose = 1, .strict = null },
+        .{ .path = "/teams/", .loose = 1, .strict = 1 },
+        .{ .path = "/users/42/", .loose = 2, .strict = null },
+        .{ .path = "/files/report/", .loose = 3, .strict = null },
+    };
+
+    var matcher = RequestMatcher.init(allocator);
+    for (cases) |case| {
+        request.path = case.path;
+        matcher.strict_slash = false;
+        try std.testing.expectEqual(case.loose, try matcher.findMatchingIndex(&request, &rules));
+        matcher.strict_slash = true;
+        try std.testing.expectEqual(case.strict, try matcher.findMatchingIndex(&request, &rules));
+    }
+
+    // Parameters are captured either way the slash falls
+    var path_matcher = PathMatcher.init(allocator);
+    var match = (try path_matcher.matchPath("/users/42/", "/users/:id")).?;
+    defer match.deinit();
+    try std.testing.expectEqualStrings("42", match.getParameter("id").?);
+    path_matcher.strict_slash = true;
+    try std.testing.expect(try path_matcher.matchPath("/users/42/", "/users/:id") == null);
+}
+
+test "RequestMatcher.case_insensitive" {
+    const allocator = std.testing.allocator;
+
+    var regex = try Regex.compile(allocator, "/files/[a-z]+", null);
+    defer regex.deinit();
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/api/Users", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "/api/orgs/:org/Members/*", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "", .path_regex = "/files/[a-z]+", .regex = regex, .methods = &.{"GET"} } },
+    };
+
+    var headers = HeaderMap.init(allocator);
+    defer headers.deinit();
+    var request = Request{
+        .method = .GET,
+        .path = "",
+        .query = "",
+        .headers = headers,
+        .body = "",
+        .arena = allocator,
+    };
+
+    const cases = [_]struct { path: []const u8, sensitive: ?usize, insensitive: ?usize }{
+        .{ .path = "/api/Users", .sensitive = 0, .insensitive = 0 },
+        .{ .path = "/API/users/", .sensitive = null, .insensitive = 0 },
+        .{ .path = "/api/orgs/Acme/Members/Jo/Roles", .sensitive = 1, .insensitive = 1 },
+        .{ .path = "/Api/Orgs/Acme/MEMBERS/Jo", .sensitive = null, .insensitive = 1 },
+        // Patterns keep their own case rules
+        .{ .path = "/files/Report", .sensitive = null, .insensitive = null },
+    };
+
+    var matcher = RequestMatcher.init(allocator);
+    for (cases) |case| {
+        request.path = case.path;
+        matcher.case_insensitive = false;
+        try std.testing.expectEqual(case.sensitive, try matcher.findMatchingIndex(&request, &rules));
+        matcher.case_insensitive = true;
+        try std.testing.expectEqual(case.insensitive, try matcher.findMatchingIndex(&request, &rules));
+    }
+
+    // Captures keep the request's casing
+    var path_matcher = PathMatcher{ .allocator = allocator, .case_insensitive = true };
+    var match = (try path_matcher.matchPath("/API/ORGS/AcMe/members/Jo/Roles", "/api/orgs/:org/Members/*")).?;
+    defer match.deinit();
+    try std.testing.expectEqualStrings("AcMe", match.getParameter("org").?);
+    try std.testing.expectEqualStrings("Jo/Roles", match.wildcard.?);
+}
+
+test "RequestMatcher.path_regex" {
+    const allocator = std.testing.allocator;
+
+    var matcher = RequestMatcher.init(allocator);
+
+    var regex = try Regex.compile(allocator, "/files/.*\\.json", null);
+    defer regex.deinit();
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "", .path_regex = "/files/.*\\.json", .regex = regex, .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "/files/index.json", .methods = &.{"GET"} } },
+        // Invalid pattern, left uncompiled by the config loader
+        .{ .request = .{ .path = "", .path_regex = "(", .methods = &.{"GET"} } },
+    };
+
+    var headers = HeaderMap.init(allocator);
+    defer headers.deinit();
+
+    var request = Request{
+        .method = .GET,
+        .path = "/files/a/b.json",
+        .query = "",
+        .headers = headers,
+        .body = "",
+        .arena = allocator,
+    };
+    try std.testing.expectEqual(&rules[0], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    // Literal paths outrank patterns
+    request.path = "/files/index.json";
+    try std.testing.expectEqual(&rules[1], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    request.path = "/files/a.txt";
+    try std.testing.expect((try matcher.findMatchingRule(&request, &rules)) == null);
+}
+
+test "RequestMatcher.path_prefix" {
+    const allocator = std.testing.allocator;
+
+    var matcher = RequestMatcher.init(allocator);
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "", .path_prefix = "/api", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "", .path_prefix = "/api/v2/", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "/api/v2/health", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "/api/v2/:resource/:id/orders", .methods = &.{"GET"} } },
+    };
+
+    var headers = HeaderMap.init(allocator);
+    defer headers.deinit();
+
+    var request = Request{
+        .method = .GET,
+        .path = "/api/v1/users",
+        .query = "",
+        .headers = headers,
+        .body = "",
+        .arena = allocator,
+    };
+    try std.testing.expectEqual(&rules[0], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    // The longest prefix wins, and the prefix itself matches with or without the slash
+    request.path = "/api/v2/users";
+    try std.testing.expectEqual(&rules[1], (try matcher.findMatchingRule(&request, &rules)).?);
+    request.path = "/api/v2";
+    try std.testing.expectEqual(&rules[1], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    // Any `path` rule outranks a prefix, patterns included
+    request.path = "/api/v2/health";
+    try std.testing.expectEqual(&rules[2], (try matcher.findMatchingRule(&request, &rules)).?);
+    request.path = "/api/v2/users/7/orders";
+    try std.testing.expectEqual(&rules[3], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    // Prefixes end at a segment boundary
+    request.path = "/apis";
+    try std.testing.expect((try matcher.findMatchingRule(&request, &rules)) == null);
+
+    try std.testing.expect(PathMatcher.hasPrefix("/API/v1", "/api", true));
+    try std.testing.expect(!PathMatcher.hasPrefix("/API/v1", "/api", false));
+    try std.testing.expect(PathMatcher.hasPrefix("/anything", "/", false));
+}
+
+test "RequestMatcher.path_segments" {
+    const allocator = std.testing.allocator;
+
+    var matcher = RequestMatcher.init(allocator);
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "*", .path_segments = 2, .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "*", .path_segments = 3, .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "", .path_prefix = "/api", .path_segments = 3, .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "/api/:version/:resource/:id", .path_segments = 4, .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "*", .methods = &.{"GET"} } },
+    };
+
+    var headers = HeaderMap.init(allocator);
+    defer headers.deinit();
+
+    var request = Request{
+        .method = .GET,
+        .path = "/users/7",
+        .query = "",
+        .headers = headers,
+        .body = "",
+        .arena = allocator,
+    };
+    try std.testing.expectEqual(&rules[0], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    // Alongside a path the count narrows it, and the path itself ranks as usual
+    request.path = "/users/7/orders";
+    try std.testing.expectEqual(&rules[1], (try matcher.findMatchingRule(&request, &rules)).?);
+    request.path = "/api/v1/users";
+    try std.testing.expectEqual(&rules[2], (try matcher.findMatchingRule(&request, &rules)).?);
+    request.path = "/api/v1/users/7";
+    try std.testing.expectEqual(&rules[3], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    // Empty segments don't count, and other lengths fall through to the catch-all
+    request.path = "//users//7/";
+    try std.testing.expectEqual(&rules[0], (try matcher.findMatchingRule(&request, &rules)).?);
+    request.path = "/a/b/c/d/e";
+    try std.testing.expectEqual(&rules[4], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    try std.testing.expectEqual(@as(usize, 0), PathMatcher.segmentCount("/"));
+    try std.testing.expectEqual(@as(usize, 3), PathMatcher.segmentCount("/api/v1/users"));
+}
+
+test "RequestMatcher.body_json_conditions" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var matcher = RequestMatcher.init(allocator);
+
+    var refund = std.StringHashMap([]const u8).init(allocator);
+    defer refund.deinit();
+    try refund.put("$.type", "refund");
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/payments", .methods = &.{"POST"} } },
+        .{ .request = .{ .path = "/payments", .methods = &.{"POST"}, .body_json = refund } },
+    };
+
+    var request = Request{
+        .method = .POST,
+        .path = "/payments",
+        .query = "",
+        .headers = HeaderMap.init(allocator),
+        .body = "{\"type\": \"refund\", \"amount\": 10}",
+        .arena = arena.allocator(),
+    };
+    defer request.deinit();
+    try std.testing.expectEqual(&rules[1], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    request.body = "{\"type\": \"charge\"}";
+    try std.testing.expectEqual(&rules[0], (try matcher.findMatchingRule(&request, &rules)).?);
+
+    // Invalid JSON falls through to the unconstrained rule instead of erroring
+    request.body = "type=refund";
+    try std.testing.expectEqual(&rules[0], (try matcher.findMatchingRule(&request, &rules)).?);
+}
+
+test "RequestMatcher.malformed_json_bodies" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var matcher = RequestMatcher.init(allocator);
+
+    var refund = std.StringHashMap([]const u8).init(allocator);
+    defer refund.deinit();
+    try refund.put("$.type", "refund");
+
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/rpc", .methods = &.{"POST"}, .body_json = refund } },
+        .{ .request = .{ .path = "/rpc", .methods = &.{"POST"}, .jsonrpc = "eth_blockNumber" } },
+        .{ .request = .{ .path = "/rpc", .methods = &.{"POST"} } },
+    };
+
+    var request = Request{
+        .method = .POST,
+        .path = "/rpc",
+        .query = "",
+        .headers = HeaderMap.init(allocator),
+        .body = "{\"type\": \"refund\"}",
+        .arena = arena.allocator(),
+    };
+    defer request.deinit();
+    try std.testing.expectEqual(@as(?usize, 0), try matcher.findMatchingIndex(&request, &rules));
+
+    request.body = "{\"jsonrpc\": \"2.0\", \"id\": 1, \"method\": \"eth_blockNumber\"}";
+    try std.testing.expectEqual(@as(?usize, 1), try matcher.findMatchingIndex(&request, &rules));
+
+    // Truncated, non-JSON and empty bodies match neither JSON rule, and
+    // reach the unconstrained one untouched
+    for ([_][]const u8{ "{\"type\": \"refund\"", "not json", "" }) |body| {
+        request.body = body;
+        try std.testing.expectEqual(@as(?usize, 2), try matcher.findMatchingIndex(&request, &rules));
+        try std.testing.expectEqualStrings(body, request.body);
+    }
+}
+
+test "PathMatcher.wildcard" {
+    const allocator = std.testing.allocator;
+    
+    var matcher = PathMatcher.init(allocator);
+    
+    const result = try matcher.matchPath("/api/users/123", "/api/*");
+    try std.testing.expect(result != null);
+    
+    if (result) |match| {
+        var match_copy = match;
+        defer match_copy.deinit();
+        try std.testing.expectEqualStrings("users/123", match_copy.wildcard.?);
+    }
+
+    // The prefix alone matches with nothing captured, and a trailing slash is dropped
+    var prefix_only = (try matcher.matchPath("/api", "/api/*")).?;
+    defer prefix_only.deinit();
+    try std.testing.expectEqualStrings("", prefix_only.wildcard.?);
+    var trailing = (try matcher.matchPath("/api/css/site.css/", "/api/*")).?;
+    defer trailing.deinit();
+    try std.testing.expectEqualStrings("css/site.css", trailing.wildcard.?);
+
+    try std.testing.expect((try matcher.matchPath("/apis/users", "/api/*")) == null);
+}
+
+test "RequestMatcher.wildcard_ranks_below_parameter_and_literal" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var matcher = RequestMatcher.init(allocator);
+
+    // Listed least specific first, so definition order can't explain the result
+    const rules = [_]Rule{
+        .{ .request = .{ .path = "/static/*", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "/static/:file", .methods = &.{"GET"} } },
+        .{ .request = .{ .path = "/static/index.html", .methods = &.{"GET"} } },
+    };
+
+    const cases = [_]struct { path: []const u8, rule: usize }{
+        .{ .path = "/static/index.html", .rule = 2 },
+        .{ .path = "/static/app.js", .rule = 1 },
+        .{ .path = "/static/css/site.css", .rule = 0 },
+        .{ .path = "/static", .rule = 0 },
+    };
+    for (cases) |case| {
+        var request = Request{
+            .method = .GET,
+            .path = case.path,
+            .query = "",
+            .headers = HeaderMap.init(arena.allocator()),
+            .body = "",
+            .arena = arena.allocator(),
+        };
+        try std.testing.expectEqual(@as(?usize, case.rule), try matcher.findMatchingIndex(&request, &rules));
     }
 }
 
@@ -0,0 +1,225 @@
+const std = @import("std");
+
+/// Request counts and latencies in the Prometheus text exposition format.
+/// Series are labelled by the matched rule's path (not the request path, so
+/// the number of series stays bounded) and the request method. Unlike
+/// `Rule.hits`, the counters survive config reloads and `POST /reset`, as
+/// Prometheus expects of counters.
+pub const Metrics = struct {
+    allocator: std.mem.Allocator,
+    mutex: std.Thread.Mutex = .{},
+    /// Keyed by route and method joined with a NUL byte
+    series: std.StringHashMap(Series),
+
+    /// Route label for requests that matched no rule
+    pub const unmatched_route = "unmatched";
+
+    /// Histogram bucket upper bounds in seconds, the Prometheus client defaults
+    pub const bucket_bounds = [_]f64{ 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10 };
+
+    const Series = struct {
+        statuses: std.AutoArrayHashMap(u16, u64),
+        /// Requests per bucket, not cumulative; the last slot counts those above every bound
+        buckets: [bucket_bounds.len + 1]u64 = [_]u64{0} ** (bucket_bounds.len + 1),
+        count: u64 = 0,
+        sum_ns: u64 = 0,
+    };
+
+    pub fn init(allocator: std.mem.Allocator) Metrics {
+        return Metrics{
+            .allocator = allocator,
+            .series = std.StringHashMap(Series).init(allocator),
+        };
+    }
+
+    pub fn deinit(self: *Metrics) void {
+        var iter = self.series.iterator();
+        while (iter.next()) |entry| {
+            self.allocator.free(entry.key_ptr.*);
+            entry.value_ptr.statuses.deinit();
+        }
+        self.series.deinit();
+    }
+
+    /// Count one handled request. Status 0 stands for a connection reset
+    /// instead of answered and is labelled `reset`.
+    pub fn record(self: *Metrics, route: []const u8, method: []const u8, status: u16, duration_ns: u64) !void {
+        self.mutex.lock();
+        defer self.mutex.unlock();
+
+        // Only a new series keeps its key, so build it on the stack where it fits
+        var key_fallback = std.heap.stackFallback(512, self.allocator);
+        const key_allocator = key_fallback.get();
+        const key = try std.fmt.allocPrint(key_allocator, "{s}\x00{s}", .{ route, method });
+        defer key_allocator.free(key);
+
+        const result = try self.series.getOrPut(key);
+        if (!result.found_existing) {
+            result.key_ptr.* = self.allocator.dupe(u8, key) catch |err| {
+                self.series.removeByPtr(result.key_ptr);
+                return err;
+            };
+            result.value_ptr.* = Series{ .statuses = std.AutoArrayHashMap(u16, u64).init(self.allocator) };
+        }
+        const series = result.value_ptr;
+
+        const status_count = try series.statuses.getOrPut(status);
+        if (!status_count.found_existing) status_count.value_ptr.* = 0;
+        status_count.value_ptr.* += 1;
+
+        const seconds = @as(f64, @floatFromInt(duration_ns)) / std.time.ns_per_s;
+        const bucket = for (bucket_bounds, 0..) |bound, index| {
+            if (seconds <= bound) break index;
+        } else bucket_bounds.len;
+        series.buckets[bucket] += 1;
+        series.count += 1;
+        series.sum_ns += duration_ns;
+    }
+
+    /// Write every series, sorted by route then method so scrapes are stable
+    pub fn write(self: *Metrics, allocator: std.mem.Allocator, writer: anytype) !void {
+        self.mutex.lock();
+        defer self.mutex.unlock();
+
+        const keys = try allocator.alloc([]const u8, self.series.count());
+        defer allocator.free(keys);
+        var key_iter = self.series.keyIterator();
+        var i: usize = 0;
+        while (key_iter.next()) |key| : (i += 1) {
+            keys[i] = key.*;
+        }
+        std.mem.sort([]const u8, keys, {}, struct {
+            fn lessThan(_: void, a: []const u8, b: []const u8) bool {
+                return std.mem.lessThan(u8, a, b);
+            }
+        }.lessThan);
+
+        try writer.writeAll("# HELP popshop_requests_total Requests handled, by matched route, method and status.\n");
+        try writer.writeAll("# TYPE popshop_requests_total counter\n");
+        for (keys) |key| {
+            const series = self.series.getPtr(key).?;
+            var statuses = series.statuses.iterator();
+            while (statuses.next()) |entry| {
+                try writer.writeAll("popshop_requests_total{");
+                try writeLabels(writer, key);
+                if (entry.key_ptr.* == 0) {
+                    try writer.print(",status=\"reset\"}} {d}\n", .{entry.value_ptr.*});
+                } else {
+                    try writer.print(",status=\"{d}\"}} {d}\n", .{ entry.key_ptr.*, entry.value_ptr.* });
+                }
+            }
+        }
+
+        try writer.writeAll("# HELP popshop_request_duration_seconds Time to produce a response, by matched route and method.\n");
+        try writer.writeAll("# TYPE popshop_request_duration_seconds histogram\n");
+        for (keys) |key| {
+            const series = self.series.getPtr(key).?;
+            var cumulative: u64 = 0;
+            for (bucket_bounds, 0..) |bound, index| {
+                cumulative += series.buckets[index];
+                try writer.writeAll("popshop_request_duration_seconds_bucket{");
+                try writeLabels(writer, key);
+                try writer.print(",le=\"{d}\"}} {d}\n", .{ bound, cumulative });
+            }
+            try writer.writeAll("popshop_request_duration_seconds_bucket{");
+            try writeLabels(writer, key);
+            try writer.print(",le=\"+Inf\"}} {d}\n", .{series.count});
+
+            const sum_seconds = @as(f64, @floatFromInt(series.sum_ns)) / std.time.ns_per_s;
+            try writer.writeAll("popshop_request_duration_seconds_sum{");
+            try writeLabels(writer, key);
+            try writer.print("}} {d}\n", .{sum_seconds});
+            try writer.writeAll("popshop_request_duration_seconds_count{");
+            try writeLabels(writer, key);
+            try writer.print("}} {d}\n", .{series.count});
+        }
+    }
+
+    /// `route="...",method="..."` for a series key
+    fn writeLabels(writer: anytype, key: []const u8) !void {
+        const separator = std.mem.indexOfScalar(u8, key, 0).?;
+        try writer.writeAll("route=\"");
+        try writeLabelValue(writer, key[0..separator]);
+        try writer.writeAll("\",method=\"");
+        try writeLabelValue(writer, key[separator + 1 ..]);
+        try writer.writeAll("\"");
+    }
+
+    fn writeLabelValue(writer: anytype, value: []const u8) !void {
+        for (value) |c| {
+            switch (c) {
+                '\\' => try writer.writeAll("\\\\"),
+                '"' => try writer.writeAll("\\\""),
+                '\n' => try writer.writeAll("\\n"),
+                else => try writer.writeByte(c),
+            }
+        }
+    }
+};
+
+test "Metrics.write" {
+    const allocator = std.testing.allocator;
+    var metrics = Metrics.init(allocator);
+    defer metrics.deinit();
+
+    try metrics.record("/users/:id", "GET", 200, 2 * std.time.ns_per_ms);
+    try metrics.record("/users/:id", "GET", 404, 20 * std.time.ns_per_ms);
+    try metrics.record("/files/\"raw\"", "POST", 201, 30 * std.time.ns_per_s);
+
+    var out = std.ArrayList(u8).init(allocator);
+    defer out.deinit();
+    try metrics.write(allocator, out.writer());
+
+    const expected =
+        \\# HELP popshop_requests_total Requests handled, by matched route, method and status.
+        \\# TYPE popshop_requests_total counter
+        \\popshop_requests_total{route="/files/\"raw\"",method="POST",status="201"} 1
+        \\popshop_requests_total{route="/users/:id",method="GET",status="200"} 1
+        \\popshop_requests_total{route="/users/:id",method="GET",status="404"} 1
+        \\# HELP popshop_request_duration_seconds Time to produce a response, by matched route and method.
+        \\# TYPE popshop_request_duration_seconds histogram
+        \\popshop_request_duration_seconds_bucket{route="/files/\"raw\"",method="POST",le="0.005"} 0
+        \\popshop_request_duration_seconds_bucket{route="/files/\"raw\"",method="POST",le="0.01"} 0
+        \\popshop_request_duration_seconds_bucket{route="/files/\"raw\"",method="POST",le="0.025"} 0
+        \\popshop_request_duration_seconds_bucket{route="/files/\"raw\"",method="POST",le="0.05"} 0
+        \\popshop_request_duration_seconds_bucket{route="/files/\"raw\"",method="POST",le="0.1"} 0
+        \\popshop_request_duration_seconds_bucket{route="/files/\"raw\"",method="POST",le="0.25"} 0
+        \\popshop_request_duration_seconds_bucket{route="/files/\"raw\"",method="POST",le="0.5"} 0
+        \\popshop_request_duration_seconds_bucket{route="/files/\"raw\"",method="POST",le="1"} 0
+        \\popshop_request_duration_seconds_bucket{route="/files/\"raw\"",method="POST",le="2.5"} 0
+        \\popshop_request_duration_seconds_bucket{route="/files/\"raw\"",method="POST",le="5"} 0
+        \\popshop_request_duration_seconds_bucket{route="/files/\"raw\"",method="POST",le="10"} 0
+        \\popshop_request_duration_seconds_bucket{route="/files/\"raw\"",method="POST",le="+Inf"} 1
+        \\popshop_request_duration_seconds_sum{route="/files/\"raw\"",method="POST"} 30
+        \\popshop_request_duration_seconds_count{route="/files/\"raw\"",method="POST"} 1
+        \\popshop_request_duration_seconds_bucket{route="/users/:id",method="GET",le="0.005"} 1
+        \\popshop_request_duration_seconds_bucket{route="/users/:id",method="GET",le="0.01"} 1
+        \\popshop_request_duration_seconds_bucket{route="/users/:id",method="GET",le="0.025"} 2
+        \\popshop_request_duration_seconds_bucket{route="/users/:id",method="GET",le="0.05"} 2
+        \\popshop_request_duration_seconds_bucket{route="/users/:id",method="GET",le="0.1"} 2
+        \\popshop_request_duration_seconds_bucket{route="/users/:id",method="GET",le="0.25"} 2
+        \\popshop_request_duration_seconds_bucket{route="/users/:id",method="GET",le="0.5"} 2
+        \\popshop_request_duration_seconds_bucket{route="/users/:id",method="GET",le="1"} 2
+        \\popshop_request_duration_seconds_bucket{route="/users/:id",method="GET",le="2.5"} 2
+        \\popshop_request_duration_seconds_bucket{route="/users/:id",method="GET",le="5"} 2
+        \\popshop_request_duration_seconds_bucket{route="/users/:id",method="GET",le="10"} 2
+        \\popshop_request_duration_seconds_bucket{route="/users/:id",method="GET",le="+Inf"} 2
+        \\popshop_request_duration_seconds_sum{route="/users/:id",method="GET"} 0.022
+        \\popshop_request_duration_seconds_count{route="/users/:id",method="GET"} 2
+        \\
+    ;
+    try std.testing.expectEqualStrings(expected, out.items);
+}
+
+test "Metrics labels reset connections" {
+    const allocator = std.testing.allocator;
+    var metrics = Metrics.init(allocator);
+    defer metrics.deinit();
+
+    try metrics.record("/pay", "POST", 0, 0);
+
+    var out = std.ArrayList(u8).init(allocator);
+    defer out.deinit();
+    try metrics.write(allocator, out.writer());
+    try std.testing.expect(std.mem.indexOf(u8, out.items, "popshop_requests_total{route=\"/pay\",method=\"POST\",status=\"reset\"} 1\n") != null);
+}
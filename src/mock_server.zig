@@ -0,0 +1,264 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+const httpz_server = @import("http/httpz_server.zig");
+const config = @import("config.zig");
+const app = @import("app.zig");
+
+const ServerConfig = interfaces.ServerConfig;
+const MiddlewareFn = interfaces.MiddlewareFn;
+const HttpZServer = httpz_server.HttpZServer;
+const Config = config.Config;
+const PopshopApp = app.PopshopApp;
+
+/// A popshop server for embedding, typically in another program's tests:
+///
+///     const mock = try MockServer.initYaml(allocator, yaml, .{});
+///     defer mock.close();
+///     try mock.start();
+///     // point the client under test at mock.url()
+///
+/// Request handling reaches the app through a global, so only one
+/// MockServer can be running per process at a time.
+pub const MockServer = struct {
+    allocator: std.mem.Allocator,
+    http: *HttpZServer,
+    popshop_app: PopshopApp,
+    options: Options,
+    /// Resolved when `start` binds; 0 until then
+    port: u16 = 0,
+    url_buffer: [64]u8 = undefined,
+    url_len: usize = 0,
+    thread: ?std.Thread = null,
+    done: std.atomic.Value(bool) = std.atomic.Value(bool).init(false),
+    run_error: ?anyerror = null,
+
+    pub const Options = struct {
+        /// An IP address; names aren't resolved
+        host: []const u8 = "127.0.0.1",
+        /// 0 picks a free port
+        port: u16 = 0,
+        /// Makes faults and weighted responses reproducible
+        seed: ?u64 = null,
+        /// How long `start` waits for the listener to come up
+        start_timeout_ms: u64 = 5000,
+        /// Run around popshop's handling of every request, the first listed
+        /// outermost. They see the request before CORS, admin routes and
+        /// rule matching, and the response after them, once it has been
+        /// logged and counted.
+        middleware: []const MiddlewareFn = &.{},
+    };
+
+    var running = std.atomic.Value(bool).init(false);
+
+    /// Take ownership of `app_config`, which is validated first. Build it
+    /// in code or with `Config.loadFromYaml`. Call `close` when done.
+    pub fn init(allocator: std.mem.Allocator, app_config: Config, options: Options) !*MockServer {
+        var owned_config = app_config;
+        errdefer owned_config.deinit();
+
+        var errors = try owned_config.validate(allocator);
+        defer errors.deinit();
+        if (!errors.isEmpty()) {
+            std.log.err("Configuration has {} error(s):", .{errors.messages.items.len});
+            for (errors.messages.items) |message| {
+                std.log.err("  - {s}", .{message});
+            }
+            return error.InvalidConfig;
+        }
+
+        const http = try allocator.create(HttpZServer);
+        errdefer allocator.destroy(http);
+        http.* = try HttpZServer.init(allocator);
+        errdefer http.deinit();
+        var server = http.server();
+        for (options.middleware) |middleware| try server.addMiddleware(middleware);
+
+        const self = try allocator.create(MockServer);
+        self.* = MockServer{
+            .allocator = allocator,
+            .http = http,
+            .popshop_app = PopshopApp.init(allocator, server, owned_config),
+            .options = options,
+        };
+        if (options.seed) |seed| self.popshop_app.seedRandom(seed);
+        return self;
+    }
+
+    /// Parse a YAML config, e.g. one embedded with `@embedFile`
+    pub fn initYaml(allocator: std.mem.Allocator, yaml_content: []const u8, options: Options) !*MockServer {
+        return init(allocator, try Config.loadFromYaml(allocator, yaml_content), options);
+    }
+
+    /// Listen in a background thread. Returns once the server accepts connections.
+    pub fn start(self: *MockServer) !void {
+        if (self.thread != null) return error.AlreadyStarted;
+        if (running.swap(true, .acq_rel)) return error.AnotherServerRunning;
+        errdefer running.store(false, .release);
+
+        const address = try std.net.Address.parseIp(self.options.host, self.options.port);
+        self.port = self.options.port;
+        if (self.port == 0) {
+            // Let the OS pick a port, then hand it to the real listener
+            var probe = try address.listen(.{ .reuse_address = true });
+            self.port = probe.listen_address.getPort();
+            probe.deinit();
+        }
+        const url_text = try std.fmt.bufPrint(&self.url_buffer, "http://{}", .{withPort(address, self.port)});
+        self.url_len = url_text.len;
+
+        var server_config = ServerConfig{ .host = self.options.host, .port = self.port };
+        const app_config = &self.popshop_app.config;
+        if (app_config.read_timeout_ms) |timeout_ms| server_config.read_timeout_ms = timeout_ms;
+        if (app_config.write_timeout_ms) |timeout_ms| server_config.write_timeout_ms = timeout_ms;
+        if (app_config.idle_timeout_ms) |timeout_ms| server_config.idle_timeout_ms = timeout_ms;
+        self.thread = try std.Thread.spawn(.{}, run, .{ self, server_config });
+        errdefer self.shutdown();
+
+        const deadline = std.time.milliTimestamp() + @as(i64, @intCast(self.options.start_timeout_ms));
+        while (true) {
+            if (self.done.load(.acquire)) return self.run_error orelse error.ServerStopped;
+            if (std.net.tcpConnectToAddress(withPort(address, self.port))) |stream| {
+                stream.close();
+                return;
+            } else |_| {}
+            if (std.time.milliTimestamp() >= deadline) return error.StartTimeout;
+            std.time.sleep(10 * std.time.ns_per_ms);
+        }
+    }
+
+    /// Base URL without a trailing slash, e.g. `http://127.0.0.1:41234`
+    pub fn url(self: *const MockServer) []const u8 {
+        return self.url_buffer[0..self.url_len];
+    }
+
+    /// The app, for hit counts and `resetHits`
+    pub fn application(self: *MockServer) *PopshopApp {
+        return &self.popshop_app;
+    }
+
+    /// Stop the server if it's running, wait for in-flight requests, and free everything
+    pub fn close(self: *MockServer) void {
+        self.shutdown();
+        self.popshop_app.deinit();
+        self.http.deinit();
+        self.allocator.destroy(self.http);
+        self.allocator.destroy(self);
+    }
+
+    fn shutdown(self: *MockServer) void {
+        const thread = self.thread orelse return;
+        self.popshop_app.stop() catch |err| std.log.warn("Failed to stop mock server: {}", .{err});
+        thread.join();
+        self.thread = null;
+        running.store(false, .release);
+    }
+
+    fn run(self: *MockServer, server_config: ServerConfig) void {
+        self.popshop_app.start(server_config) catch |err| {
+            self.run_error = err;
+        };
+        self.done.store(true, .release);
+    }
+
+    fn withPort(address: std.net.Address, port: u16) std.net.Address {
+        var result = address;
+        result.setPort(port);
+        return result;
+    }
+};
+
+test "MockServer serves a YAML config" {
+    const allocator = std.testing.allocator;
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/api/users/:id"
+        \\    method: "GET"
+        \\  response:
+        \\    status: 200
+        \\    body: '{"id": "{{.Params.id}}"}'
+    ;
+
+    const mock = try MockServer.initYaml(allocator, yaml_content, .{});
+    defer mock.close();
+    try mock.start();
+    try std.testing.expect(std.mem.startsWith(u8, mock.url(), "http://127.0.0.1:"));
+
+    var client = std.http.Client{ .allocator = allocator };
+    defer client.deinit();
+
+    const target = try std.fmt.allocPrint(allocator, "{s}/api/users/7", .{mock.url()});
+    defer allocator.free(target);
+    var body = std.ArrayList(u8).init(allocator);
+    defer body.deinit();
+    const result = try client.fetch(.{
+        .location = .{ .url = target },
+        .response_storage = .{ .dynamic = &body },
+        .keep_alive = false,
+    });
+
+    try std.testing.expectEqual(std.http.Status.ok, result.status);
+    try std.testing.expectEqualStrings("{\"id\": \"7\"}", body.items);
+    try std.testing.expectEqual(@as(u64, 1), mock.application().config.rules.items[0].hits.load(.monotonic));
+}
+
+test "MockServer runs middleware around the mock" {
+    const allocator = std.testing.allocator;
+
+    const Tenant = struct {
+        fn inject(request: *interfaces.Request, next: interfaces.Next) anyerror!interfaces.Response {
+            try request.headers.put("X-Tenant", "acme");
+            var response = try next.handle(request);
+            try response.setHeader("X-Middleware", "outer");
+            return response;
+        }
+
+        fn tag(request: *interfaces.Request, next: interfaces.Next) anyerror!interfaces.Response {
+            var response = try next.handle(request);
+            // Runs before `inject` gets the response back
+            try response.setHeader("X-Middleware", "inner");
+            try response.setHeader("X-Inner", "yes");
+            return response;
+        }
+    };
+
+    const yaml_content =
+        \\- request:
+        \\    path: "/tenant"
+        \\    headers:
+        \\      X-Tenant: "acme"
+        \\  response:
+        \\    body: '{"tenant": "{{.Headers.X-Tenant}}"}'
+    ;
+
+    const mock = try MockServer.initYaml(allocator, yaml_content, .{ .middleware = &.{ Tenant.inject, Tenant.tag } });
+    defer mock.close();
+    try mock.start();
+
+    var client = std.http.Client{ .allocator = allocator };
+    defer client.deinit();
+
+    const target = try std.fmt.allocPrint(allocator, "{s}/tenant", .{mock.url()});
+    defer allocator.free(target);
+    var header_buffer: [4096]u8 = undefined;
+    var request = try client.open(.GET, try std.Uri.parse(target), .{ .server_header_buffer = &header_buffer, .keep_alive = false });
+    defer request.deinit();
+    try request.send();
+    try request.wait();
+
+    // The rule only matches because the middleware added the header
+    try std.testing.expectEqual(std.http.Status.ok, request.response.status);
+    var middleware_header: ?[]const u8 = null;
+    var inner_header: ?[]const u8 = null;
+    var headers = request.response.iterateHeaders();
+    while (headers.next()) |header| {
+        if (std.ascii.eqlIgnoreCase(header.name, "X-Middleware")) middleware_header = header.value;
+        if (std.ascii.eqlIgnoreCase(header.name, "X-Inner")) inner_header = header.value;
+    }
+    try std.testing.expectEqualStrings("outer", middleware_header.?);
+    try std.testing.expectEqualStrings("yes", inner_header.?);
+
+    const body = try request.reader().readAllAlloc(allocator, 1024);
+    defer allocator.free(body);
+    try std.testing.expectEqualStrings("{\"tenant\": \"acme\"}", body);
+}
@@ -0,0 +1,79 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+
+/// How much a request's `Accept` header wants `content_type`, from 0 (not
+/// at all) to 1. The most specific range that covers the type decides, so
+/// `text/*;q=0.5, text/html` gives `text/html` 1 and `text/plain` 0.5.
+/// A missing or empty header accepts everything.
+pub fn quality(accept: ?[]const u8, content_type: []const u8) f64 {
+    const header = accept orelse return 1;
+    if (std.mem.trim(u8, header, " \t").len == 0) return 1;
+
+    const offered = interfaces.mediaType(content_type);
+    const slash = std.mem.indexOfScalar(u8, offered, '/') orelse offered.len;
+    const offered_type = offered[0..slash];
+
+    // 0: no match yet, 1: */*, 2: type/*, 3: type/subtype
+    var best_specificity: u8 = 0;
+    var best_quality: f64 = 0;
+    var ranges = std.mem.splitScalar(u8, header, ',');
+    while (ranges.next()) |raw| {
+        var params = std.mem.splitScalar(u8, raw, ';');
+        const range = std.mem.trim(u8, params.first(), " \t");
+        const specificity: u8 = if (std.mem.eql(u8, range, "*/*") or std.mem.eql(u8, range, "*"))
+            1
+        else if (std.mem.endsWith(u8, range, "/*") and std.ascii.eqlIgnoreCase(range[0 .. range.len - 2], offered_type))
+            2
+        else if (std.ascii.eqlIgnoreCase(range, offered))
+            3
+        else
+            continue;
+        if (specificity <= best_specificity) continue;
+
+        var q: f64 = 1;
+        while (params.next()) |param| {
+            const trimmed = std.mem.trim(u8, param, " \t");
+            if (trimmed.len < 2 or !std.ascii.eqlIgnoreCase(trimmed[0..2], "q=")) continue;
+            q = std.math.clamp(std.fmt.parseFloat(f64, trimmed[2..]) catch 0, 0, 1);
+        }
+        best_specificity = specificity;
+        best_quality = q;
+    }
+    return best_quality;
+}
+
+/// Index of the entry in `content_types` the `Accept` header wants most,
+/// the earliest on a tie; null when it accepts none of them
+pub fn choose(accept: ?[]const u8, content_types: []const []const u8) ?usize {
+    var best: ?usize = null;
+    var best_quality: f64 = 0;
+    for (content_types, 0..) |content_type, index| {
+        const q = quality(accept, content_type);
+        if (q > best_quality) {
+            best = index;
+            best_quality = q;
+        }
+    }
+    return best;
+}
+
+test "quality" {
+    try std.testing.expectEqual(@as(f64, 1), quality(null, "application/json"));
+    try std.testing.expectEqual(@as(f64, 1), quality("application/json", "application/json; charset=utf-8"));
+    try std.testing.expectEqual(@as(f64, 0), quality("application/json", "application/xml"));
+    try std.testing.expectEqual(@as(f64, 0.5), quality("text/*;q=0.5, text/html", "text/plain"));
+    try std.testing.expectEqual(@as(f64, 1), quality("text/*;q=0.5, text/html", "text/html"));
+    try std.testing.expectEqual(@as(f64, 0.1), quality("application/xml, */*; q=0.1", "application/json"));
+    // An explicit q=0 refuses the type even when a wildcard allows it
+    try std.testing.expectEqual(@as(f64, 0), quality("*/*, application/xml;q=0", "application/xml"));
+}
+
+test "choose" {
+    const offered = [_][]const u8{ "application/json", "application/xml" };
+    try std.testing.expectEqual(@as(?usize, 0), choose(null, &offered));
+    try std.testing.expectEqual(@as(?usize, 0), choose("application/json, application/xml;q=0.9", &offered));
+    try std.testing.expectEqual(@as(?usize, 1), choose("application/xml, application/json;q=0.8", &offered));
+    try std.testing.expectEqual(@as(?usize, 1), choose("text/html, application/*;q=0.2, application/xml;q=0.5", &offered));
+    try std.testing.expectEqual(@as(?usize, 0), choose("*/*", &offered));
+    try std.testing.expectEqual(@as(?usize, null), choose("text/html, image/*", &offered));
+}
@@ -0,0 +1,462 @@
+const std = @import("std");
+const yaml = @import("yaml");
+const recorder = @import("recorder.zig");
+
+const Value = std.json.Value;
+
+/// Operation keys of an OpenAPI path item, in the order rules are written
+const methods = [_][]const u8{ "get", "put", "post", "delete", "options", "head", "patch", "trace" };
+
+/// Deepest nesting followed when building a body from a schema, which also
+/// ends recursive `$ref`s
+const max_schema_depth = 8;
+
+/// Write a starter popshop config for the OpenAPI 3 document `source`, YAML
+/// or JSON, with a rule per operation. Each rule answers with the
+/// operation's lowest 2xx response, or `default` as a 200, using the example
+/// given for it or else a body sketched from its schema. This is a scaffold
+/// to edit, not a faithful mock: request constraints are left out. Returns
+/// the number of rules written.
+pub fn scaffold(allocator: std.mem.Allocator, source: []const u8, writer: anytype) !usize {
+    var arena_state = std.heap.ArenaAllocator.init(allocator);
+    defer arena_state.deinit();
+    const arena = arena_state.allocator();
+
+    const spec = try parseSpec(arena, source);
+    const paths = field(spec, "paths") orelse {
+        std.log.err("OpenAPI document has no paths", .{});
+        return error.InvalidOpenApiSpec;
+    };
+    if (paths != .object) {
+        std.log.err("Expected OpenAPI 'paths' to be a map", .{});
+        return error.InvalidOpenApiSpec;
+    }
+
+    try writer.writeAll("# Generated by popshop gen openapi");
+    if (field(spec, "info")) |info| {
+        if (stringField(info, "title")) |title| try writer.print(" from {s}", .{firstLine(title)});
+        if (stringField(info, "version")) |version| try writer.print(" {s}", .{firstLine(version)});
+    }
+    try writer.writeAll("\n");
+
+    var count: usize = 0;
+    var path_iter = paths.object.iterator();
+    while (path_iter.next()) |entry| {
+        const item = resolveRef(spec, entry.value_ptr.*) orelse continue;
+        for (methods) |method| {
+            const operation = field(item, method) orelse continue;
+            if (operation != .object) continue;
+            try writeRule(arena, spec, writer, entry.key_ptr.*, method, operation);
+            count += 1;
+        }
+    }
+    return count;
+}
+
+/// An OpenAPI path template such as `/users/{id}` in popshop's `/users/:id` form
+pub fn convertPath(allocator: std.mem.Allocator, path: []const u8) ![]u8 {
+    var converted = std.ArrayList(u8).init(allocator);
+    errdefer converted.deinit();
+    var segments = std.mem.splitScalar(u8, path, '/');
+    var first = true;
+    while (segments.next()) |segment| {
+        if (!first) try converted.append('/');
+        first = false;
+        if (segment.len > 2 and segment[0] == '{' and segment[segment.len - 1] == '}') {
+            try converted.append(':');
+            try converted.appendSlice(segment[1 .. segment.len - 1]);
+        } else {
+            try converted.appendSlice(segment);
+        }
+    }
+    return converted.toOwnedSlice();
+}
+
+/// The document as a JSON value, whichever format it is written in
+fn parseSpec(arena: std.mem.Allocator, source: []const u8) !Value {
+    const trimmed = std.mem.trimLeft(u8, source, " \t\r\n");
+    if (trimmed.len > 0 and trimmed[0] == '{') {
+        return std.json.parseFromSliceLeaky(Value, arena, source, .{}) catch |err| switch (err) {
+            error.OutOfMemory => return err,
+            else => {
+                std.log.err("OpenAPI document is not valid JSON: {s}", .{@errorName(err)});
+                return error.InvalidOpenApiSpec;
+            },
+        };
+    }
+
+    var document: yaml.Yaml = .{ .source = source };
+    document.load(arena) catch |err| switch (err) {
+        error.ParseFailure => {
+            std.log.err("OpenAPI document is not valid YAML", .{});
+            return error.InvalidOpenApiSpec;
+        },
+        else => return err,
+    };
+    if (document.docs.items.len == 0) {
+        std.log.err("OpenAPI document is empty", .{});
+        return error.InvalidOpenApiSpec;
+    }
+    return jsonFromYaml(arena, document.docs.items[0]);
+}
+
+fn jsonFromYaml(arena: std.mem.Allocator, value: yaml.Value) !Value {
+    return switch (value) {
+        .empty => .null,
+        .boolean => |b| .{ .bool = b },
+        .int => |i| .{ .integer = i },
+        .float => |f| .{ .float = f },
+        .string => |text| .{ .string = text },
+        .list => |list| blk: {
+            var array = try std.json.Array.initCapacity(arena, list.len);
+            for (list) |item| array.appendAssumeCapacity(try jsonFromYaml(arena, item));
+            break :blk .{ .array = array };
+        },
+        .map => |map| blk: {
+            var object = std.json.ObjectMap.init(arena);
+            var iter = map.iterator();
+            while (iter.next()) |entry| {
+                try object.put(entry.key_ptr.*, try jsonFromYaml(arena, entry.value_ptr.*));
+            }
+            break :blk .{ .object = object };
+        },
+    };
+}
+
+fn writeRule(arena: std.mem.Allocator, spec: Value, writer: anytype, path: []const u8, method: []const u8, operation: Value) !void {
+    if (stringField(operation, "summary") orelse stringField(operation, "operationId")) |label| {
+        try writer.print("# {s}\n", .{firstLine(label)});
+    }
+    try writer.writeAll("- request:\n    path: ");
+    try recorder.writeYamlString(writer, try convertPath(arena, path));
+    try writer.writeAll("\n    method: \"");
+    for (method) |c| try writer.writeByte(std.ascii.toUpper(c));
+    try writer.writeAll("\"\n  response:\n");
+
+    const picked = pickResponse(operation);
+    try writer.print("    status: {d}\n", .{picked.status});
+
+    const response = if (picked.response) |r| resolveRef(spec, r) else null;
+    const content = if (response) |r| field(r, "content") else null;
+    if (content) |c| {
+        if (pickMediaType(c)) |media| {
+            // Wildcard types like */* can't be sent as a Content-Type
+            if (std.mem.indexOfScalar(u8, media.name, '*') == null) {
+                try writer.writeAll("    headers:\n      Content-Type: ");
+                try recorder.writeYamlString(writer, media.name);
+                try writer.writeAll("\n");
+            }
+            const json = std.mem.indexOf(u8, media.name, "json") != null;
+            if (try exampleBody(arena, spec, media.value, json)) |body| {
+                // Examples are sent as written, even if they contain {{
+                try writer.writeAll("    template: false\n    body: ");
+                try recorder.writeYamlString(writer, body);
+                try writer.writeAll("\n");
+            }
+        }
+    }
+    try writer.writeAll("\n");
+}
+
+const PickedResponse = struct {
+    status: u16 = 200,
+    response: ?Value = null,
+};
+
+/// The lowest 2xx response, then `default` as a 200, then the first
+/// declared status so an operation that only lists errors still gets a rule
+fn pickResponse(operation: Value) PickedResponse {
+    const responses = field(operation, "responses") orelse return .{};
+    if (responses != .object) return .{};
+
+    var best: ?PickedResponse = null;
+    var iter = responses.object.iterator();
+    while (iter.next()) |entry| {
+        const status = std.fmt.parseInt(u16, entry.key_ptr.*, 10) catch continue;
+        if (status < 200 or status > 299) continue;
+        if (best == null or status < best.?.status) best = .{ .status = status, .response = entry.value_ptr.* };
+    }
+    if (best) |picked| return picked;
+    if (responses.object.get("default")) |default| return .{ .response = default };
+
+    iter = responses.object.iterator();
+    while (iter.next()) |entry| {
+        const status = std.fmt.parseInt(u16, entry.key_ptr.*, 10) catch continue;
+        if (status >= 100 and status <= 599) return .{ .status = status, .response = entry.value_ptr.* };
+    }
+    return .{};
+}
+
+const MediaType = struct {
+    name: []const u8,
+    value: Value,
+};
+
+/// The first JSON media type of a response's `content`, else its first
+fn pickMediaType(content: Value) ?MediaType {
+    if (content != .object) return null;
+    var first: ?MediaType = null;
+    var iter = content.object.iterator();
+    while (iter.next()) |entry| {
+        const media = MediaType{ .name = entry.key_ptr.*, .value = entry.value_ptr.* };
+        if (std.mem.indexOf(u8, media.name, "json") != null) return media;
+        if (first == null) first = media;
+    }
+    return first;
+}
+
+/// A media type's `example`, its first `examples` entry or a sample of its
+/// schema, as body text. Strings are sent bare unless the type is JSON.
+fn exampleBody(arena: std.mem.Allocator, spec: Value, media: Value, json: bool) !?[]const u8 {
+    const example = field(media, "example") orelse firstExample(spec, media) orelse blk: {
+        const schema = field(media, "schema") orelse return null;
+        break :blk try sampleSchema(arena, spec, schema, 0) orelse return null;
+    };
+    if (!json and example == .string) return example.string;
+    return try std.json.stringifyAlloc(arena, example, .{});
+}
+
+fn firstExample(spec: Value, media: Value) ?Value {
+    const examples = field(media, "examples") orelse return null;
+    if (examples != .object) return null;
+    var iter = examples.object.iterator();
+    while (iter.next()) |entry| {
+        const example = resolveRef(spec, entry.value_ptr.*) orelse continue;
+        if (field(example, "value")) |value| return value;
+    }
+    return null;
+}
+
+/// A value shaped like `schema`: its own example, default or first enum
+/// value where it has one, and placeholders by type otherwise
+fn sampleSchema(arena: std.mem.Allocator, spec: Value, schema_value: Value, depth: usize) std.mem.Allocator.Error!?Value {
+    if (depth > max_schema_depth) return null;
+    const schema = resolveRef(spec, schema_value) orelse return null;
+    if (schema != .object) return null;
+
+    if (field(schema, "example")) |example| return example;
+    if (field(schema, "default")) |default| return default;
+    if (field(schema, "enum")) |values| {
+        if (values == .array and values.array.items.len > 0) return values.array.items[0];
+    }
+    inline for (.{ "oneOf", "anyOf" }) |key| {
+        if (field(schema, key)) |options| {
+            if (options == .array and options.array.items.len > 0) return sampleSchema(arena, spec, options.array.items[0], depth + 1);
+        }
+    }
+    if (field(schema, "allOf")) |parts| {
+        if (parts == .array) {
+            var merged = std.json.ObjectMap.init(arena);
+            for (parts.array.items) |part| {
+                const sample = try sampleSchema(arena, spec, part, depth + 1) orelse continue;
+                if (sample != .object) return sample;
+                var iter = sample.object.iterator();
+                while (iter.next()) |entry| try merged.put(entry.key_ptr.*, entry.value_ptr.*);
+            }
+            return .{ .object = merged };
+        }
+    }
+
+    const kind = schemaType(schema) orelse if (field(schema, "properties") != null) "object" else return null;
+    if (std.mem.eql(u8, kind, "object")) {
+        var object = std.json.ObjectMap.init(arena);
+        if (field(schema, "properties")) |properties| {
+            if (properties == .object) {
+                var iter = properties.object.iterator();
+                while (iter.next()) |entry| {
+                    const sample = try sampleSchema(arena, spec, entry.value_ptr.*, depth + 1) orelse continue;
+                    try object.put(entry.key_ptr.*, sample);
+                }
+            }
+        }
+        return .{ .object = object };
+    }
+    if (std.mem.eql(u8, kind, "array")) {
+        var array = std.json.Array.init(arena);
+        if (field(schema, "items")) |items| {
+            if (try sampleSchema(arena, spec, items, depth + 1)) |sample| try array.append(sample);
+        }
+        return .{ .array = array };
+    }
+    if (std.mem.eql(u8, kind, "integer") or std.mem.eql(u8, kind, "number")) return .{ .integer = 0 };
+    if (std.mem.eql(u8, kind, "boolean")) return .{ .bool = false };
+    if (std.mem.eql(u8, kind, "string")) {
+        const format = stringField(schema, "format") orelse "";
+        const formats = [_][2][]const u8{
+            .{ "date-time", "2024-01-01T00:00:00Z" },
+            .{ "date", "2024-01-01" },
+            .{ "uuid", "00000000-0000-0000-0000-000000000000" },
+            .{ "email", "user@example.com" },
+            .{ "uri", "https://example.com" },
+        };
+        for (formats) |known| {
+            if (std.mem.eql(u8, format, known[0])) return .{ .string = known[1] };
+        }
+        return .{ .string = "string" };
+    }
+    return null;
+}
+
+/// A schema's `type`; in OpenAPI 3.1 a list, of which the first that isn't "null"
+fn schemaType(schema: Value) ?[]const u8 {
+    const kind = field(schema, "type") orelse return null;
+    switch (kind) {
+        .string => |name| return name,
+        .array => |names| for (names.items) |name| {
+            if (name == .string and !std.mem.eql(u8, name.string, "null")) return name.string;
+        },
+        else => {},
+    }
+    return null;
+}
+
+/// Follow local `$ref`s like `#/components/schemas/User`. Null for refs
+/// that point elsewhere or at nothing.
+fn resolveRef(spec: Value, value: Value) ?Value {
+    var current = value;
+    for (0..max_schema_depth) |_| {
+        const ref = stringField(current, "$ref") orelse return current;
+        if (!std.mem.startsWith(u8, ref, "#/")) return null;
+        var target = spec;
+        var parts = std.mem.splitScalar(u8, ref[2..], '/');
+        while (parts.next()) |part| {
+            // JSON pointer escapes aren't decoded; component names rarely need them
+            target = field(target, part) orelse return null;
+        }
+        current = target;
+    }
+    return null;
+}
+
+fn field(value: Value, name: []const u8) ?Value {
+    if (value != .object) return null;
+    return value.object.get(name);
+}
+
+fn stringField(value: Value, name: []const u8) ?[]const u8 {
+    const found = field(value, name) orelse return null;
+    return if (found == .string) found.string else null;
+}
+
+fn firstLine(text: []const u8) []const u8 {
+    return std.mem.trim(u8, text[0 .. std.mem.indexOfScalar(u8, text, '\n') orelse text.len], " \t\r");
+}
+
+const test_spec =
+    \\openapi: 3.0.3
+    \\info:
+    \\  title: Users API
+    \\  version: 1.2.0
+    \\paths:
+    \\  /users:
+    \\    get:
+    \\      summary: List users
+    \\      responses:
+    \\        "200":
+    \\          description: OK
+    \\          content:
+    \\            application/json:
+    \\              schema:
+    \\                type: array
+    \\                items:
+    \\                  $ref: "#/components/schemas/User"
+    \\    post:
+    \\      operationId: createUser
+    \\      responses:
+    \\        "400":
+    \\          description: Invalid
+    \\        "201":
+    \\          description: Created
+    \\          content:
+    \\            application/json:
+    \\              example:
+    \\                id: 7
+    \\                name: Ada
+    \\  /users/{id}/avatar:
+    \\    delete:
+    \\      responses:
+    \\        "204":
+    \\          description: Removed
+    \\    get:
+    \\      responses:
+    \\        default:
+    \\          description: The avatar
+    \\          content:
+    \\            text/plain:
+    \\              examples:
+    \\                small:
+    \\                  value: "avatar {{id}}"
+    \\components:
+    \\  schemas:
+    \\    User:
+    \\      type: object
+    \\      properties:
+    \\        id:
+    \\          type: integer
+    \\        email:
+    \\          type: string
+    \\          format: email
+    \\        role:
+    \\          type: string
+    \\          enum: [admin, member]
+;
+
+test "convertPath" {
+    const allocator = std.testing.allocator;
+    const converted = try convertPath(allocator, "/orgs/{org}/users/{id}");
+    defer allocator.free(converted);
+    try std.testing.expectEqualStrings("/orgs/:org/users/:id", converted);
+
+    const literal = try convertPath(allocator, "/health/{}");
+    defer allocator.free(literal);
+    try std.testing.expectEqualStrings("/health/{}", literal);
+}
+
+test "scaffold writes a loadable rule per operation" {
+    const allocator = std.testing.allocator;
+    const Config = @import("config.zig").Config;
+
+    var output = std.ArrayList(u8).init(allocator);
+    defer output.deinit();
+    try std.testing.expectEqual(@as(usize, 4), try scaffold(allocator, test_spec, output.writer()));
+    try std.testing.expect(std.mem.startsWith(u8, output.items, "# Generated by popshop gen openapi from Users API 1.2.0\n"));
+
+    var config = try Config.loadFromYaml(allocator, output.items);
+    defer config.deinit();
+    const rules = config.rules.items;
+    try std.testing.expectEqual(@as(usize, 4), rules.len);
+
+    // Bodies sketched from the schema follow $refs
+    try std.testing.expectEqualStrings("/users", rules[0].request.path);
+    try std.testing.expectEqualStrings("GET", rules[0].request.methods[0]);
+    try std.testing.expectEqual(@as(u16, 200), rules[0].response.?.status);
+    try std.testing.expectEqualStrings("[{\"id\":0,\"email\":\"user@example.com\",\"role\":\"admin\"}]", rules[0].response.?.body);
+    try std.testing.expectEqualStrings("application/json", rules[0].response.?.headers.?.get("Content-Type").?);
+
+    // The 2xx response wins over an error declared first
+    try std.testing.expectEqualStrings("POST", rules[1].request.methods[0]);
+    try std.testing.expectEqual(@as(u16, 201), rules[1].response.?.status);
+    try std.testing.expectEqualStrings("{\"id\":7,\"name\":\"Ada\"}", rules[1].response.?.body);
+
+    // Operations come in a fixed method order, not the spec's
+    try std.testing.expectEqualStrings("/users/:id/avatar", rules[2].request.path);
+    try std.testing.expectEqualStrings("GET", rules[2].request.methods[0]);
+    try std.testing.expectEqualStrings("avatar {{id}}", rules[2].response.?.body);
+    try std.testing.expect(!rules[2].response.?.isTemplated());
+
+    try std.testing.expectEqualStrings("DELETE", rules[3].request.methods[0]);
+    try std.testing.expectEqual(@as(u16, 204), rules[3].response.?.status);
+    try std.testing.expectEqualStrings("", rules[3].response.?.body);
+}
+
+test "scaffold reads JSON documents" {
+    const allocator = std.testing.allocator;
+    const spec =
+        \\{"openapi": "3.1.0", "paths": {"/health": {"get": {"responses": {"200": {"content": {"application/json": {"schema": {"type": ["object", "null"], "properties": {"ok": {"type": "boolean"}}}}}}}}}}}
+    ;
+
+    var output = std.ArrayList(u8).init(allocator);
+    defer output.deinit();
+    try std.testing.expectEqual(@as(usize, 1), try scaffold(allocator, spec, output.writer()));
+    try std.testing.expect(std.mem.indexOf(u8, output.items, "    body: '{\"ok\":false}'\n") != null);
+}
@@ -1,17 +1,41 @@
 const std = @import("std");
 const interfaces = @import("http/interfaces.zig");
 const config = @import("config.zig");
+const recorder = @import("recorder.zig");
+const verifier = @import("verifier.zig");
+const client_deadline = @import("client_deadline.zig");
 
 const Request = interfaces.Request;
 const Response = interfaces.Response;
 const Status = interfaces.Status;
 const HeaderMap = interfaces.HeaderMap;
 const ProxyConfig = config.ProxyConfig;
+const Recorder = recorder.Recorder;
+const Verifier = verifier.Verifier;
+
+/// What happened upstream while proxying, for access logging
+pub const ProxyOutcome = struct {
+    /// Status the upstream answered with; null if it never answered
+    upstream_status: ?u16 = null,
+    /// URL the request was sent to, after any path rewrite; lives in the request arena
+    upstream_url: ?[]const u8 = null,
+    /// The round trip hit the proxy timeout and the response is a local 504
+    timed_out: bool = false,
+};
 
 /// HTTP client for making proxy requests
 pub const ProxyClient = struct {
     allocator: std.mem.Allocator,
     client: std.http.Client,
+    /// Skip the SSRF check for loopback and private addresses (tests and local upstreams)
+    allow_private_hosts: bool = false,
+    /// When set, every upstream response is saved as a replayable rule
+    recorder: ?*Recorder = null,
+    /// When set, every upstream response is compared with its recording
+    verifier: ?*Verifier = null,
+
+    /// Largest upstream response body that will be relayed
+    pub const max_response_size = 10 * 1024 * 1024; // 10MB
 
     pub fn init(allocator: std.mem.Allocator) ProxyClient {
         return ProxyClient{
@@ -24,54 +48,113 @@ pub const ProxyClient = struct {
         self.client.deinit();
     }
 
-    /// Proxy a request to the target URL
+    /// Proxy a request to the target URL, forwarding the inbound headers and body
+    /// and relaying the upstream status, headers and body back. Bodies are held
+    /// in the request arena because the interface Response carries a byte slice;
+    /// Content-Length on both legs is derived from the actual body.
+    /// `outcome`, when given, is filled in with the target URL and upstream status.
     pub fn proxyRequest(
         self: *ProxyClient, 
         request: *const Request, 
         proxy_config: *const ProxyConfig,
+        outcome: ?*ProxyOutcome,
     ) !Response {
+        const target_url = try upstreamUrl(request.arena, request, proxy_config);
+        if (outcome) |o| o.upstream_url = target_url;
+
         // Validate proxy URL for security
-        if (!isValidProxyUrl(proxy_config.url)) {
-            std.log.warn("Blocked potentially unsafe proxy URL: {s}", .{proxy_config.url});
+        if (!self.allow_private_hosts and !isValidProxyUrl(target_url)) {
+            std.log.warn("Blocked potentially unsafe proxy URL: {s}", .{target_url});
             var response = Response.init(request.arena, .bad_request);
             response.setBody("Invalid proxy URL");
             return response;
         }
 
         // Parse target URL
-        const uri = std.Uri.parse(proxy_config.url) catch |err| {
-            std.log.err("Failed to parse proxy URL {s}: {}", .{ proxy_config.url, err });
+        const uri = std.Uri.parse(target_url) catch |err| {
+            std.log.err("Failed to parse proxy URL {s}: {}", .{ target_url, err });
             var response = Response.init(request.arena, .bad_request);
             response.setBody("Invalid proxy URL format");
             return response;
         };
 
+        const forward_headers = try buildForwardHeaders(request.arena, request, proxy_config);
+
+        // The timeout covers the whole round trip, from connecting to reading the body
+        const deadline = std.time.milliTimestamp() + @as(i64, @intCast(proxy_config.timeout_ms));
+
         // Create HTTP request
-        var req = try self.client.open(
+        var req = client_deadline.open(
+            &self.client,
             parseMethod(request.method),
             uri,
             .{
                 .server_header_buffer = try request.arena.alloc(u8, 16 * 1024),
                 .redirect_behavior = .unhandled,
+                .headers = .{
+                    // Pass the client's User-Agent through instead of the std default
+                    .user_agent = if (request.hasHeader("User-Agent")) .omit else .default,
+                },
+                .extra_headers = forward_headers,
             },
-        );
+            deadline,
+        ) catch |err| {
+            if (!client_deadline.expired(err, deadline)) return err;
+            return timedOut(request, target_url, proxy_config, outcome);
+        };
         defer req.deinit();
 
-        // Set timeout (temporarily disabled due to API changes)
-        _ = proxy_config.timeout_ms; // Suppress unused warning
-        // req.connection.?.data.socket.setTimeout(proxy_config.timeout_ms) catch |err| {
-        //     std.log.warn("Failed to set socket timeout: {}", .{err});
-        // };
+        var response = self.roundTrip(&req, request, deadline) catch |err| {
+            if (!client_deadline.expired(err, deadline)) return err;
+
+            // The connection is mid-response; don't hand it back to the pool
+            if (req.connection) |connection| connection.closing = true;
+            return timedOut(request, target_url, proxy_config, outcome);
+        };
+
+        if (outcome) |o| o.upstream_status = @intFromEnum(response.status);
+
+        // Only genuine upstream responses are verified and recorded, never
+        // local errors. Verifying first lets --verify and --record share a
+        // directory, reporting drift before the new capture replaces the old.
+        if (self.verifier) |v| {
+            _ = v.verify(request, &response) catch |err| {
+                std.log.warn("Failed to verify response for {s}: {}", .{ request.path, err });
+            };
+        }
+        if (self.recorder) |r| {
+            r.record(request, &response) catch |err| {
+                std.log.warn("Failed to record response for {s}: {}", .{ request.path, err });
+            };
+        }
+
+        // Recordings keep what the upstream sent; the client gets the rewrite
+        if (proxy_config.response_rewrite) |*rewrite| {
+            try rewrite.apply(request.arena, &response);
+        }
+
+        return response;
+    }
 
-        // Copy headers from original request (temporarily disabled)
-        // try self.copyRequestHeaders(&req, request, proxy_config);
+    /// The local 504 for a round trip that ran out of time
+    fn timedOut(request: *const Request, target_url: []const u8, proxy_config: *const ProxyConfig, outcome: ?*ProxyOutcome) Response {
+        std.log.warn("Proxy request to {s} timed out after {d}ms", .{ target_url, proxy_config.timeout_ms });
+        if (outcome) |o| o.timed_out = true;
+        var response = Response.init(request.arena, .gateway_timeout);
+        response.setBody("Upstream request timed out");
+        return response;
+    }
 
+    /// Send the request and read the full response, failing with
+    /// error.DeadlineExceeded once `deadline` (milliseconds since the epoch) passes
+    fn roundTrip(self: *ProxyClient, req: *std.http.Client.Request, request: *const Request, deadline: i64) !Response {
         // Set content length if body exists
         if (request.body.len > 0) {
             req.transfer_encoding = .{ .content_length = request.body.len };
         }
 
         // Send request
+        try client_deadline.apply(req, deadline);
         try req.send();
 
         // Send body if present
@@ -81,53 +164,28 @@ pub const ProxyClient = struct {
         }
 
         // Wait for response
+        try client_deadline.apply(req, deadline);
         try req.wait();
 
         // Create response
         var response = Response.init(request.arena, @enumFromInt(@intFromEnum(req.response.status)));
         
         // Copy response headers
-        try self.copyResponseHeaders(&response, &req);
-
-        // Read response body
-        const body = try req.reader().readAllAlloc(request.arena, 10 * 1024 * 1024); // 10MB max
-        response.setBody(body);
-
-        return response;
-    }
-
-    fn copyRequestHeaders(
-        self: *ProxyClient,
-        req: *std.http.Client.Request,
-        request: *const Request,
-        proxy_config: *const ProxyConfig,
-    ) !void {
-        _ = self;
-
-        // Copy original request headers (filtered)
-        var iter = request.headers.iterator();
-        while (iter.next()) |entry| {
-            const name = entry.key_ptr.*;
-            const value = entry.value_ptr.*;
-            
-            // Skip headers that shouldn't be forwarded
-            if (shouldSkipHeader(name)) {
-                continue;
-            }
-            
-            try req.headers.append(name, value);
-        }
-
-        // Add proxy-specific headers
-        if (proxy_config.headers) |proxy_headers| {
-            var proxy_iter = proxy_headers.iterator();
-            while (proxy_iter.next()) |entry| {
-                try req.headers.append(entry.key_ptr.*, entry.value_ptr.*);
-            }
+        try self.copyResponseHeaders(&response, req);
+
+        // Read response body, re-arming the socket timeout before every read
+        var body = std.ArrayList(u8).init(request.arena);
+        var buffer: [16 * 1024]u8 = undefined;
+        while (true) {
+            try client_deadline.apply(req, deadline);
+            const n = try req.reader().read(&buffer);
+            if (n == 0) break;
+            if (body.items.len + n > max_response_size) return error.StreamTooLong;
+            try body.appendSlice(buffer[0..n]);
         }
+        response.setBody(body.items);
 
-        // Add X-Forwarded-For header
-        try req.headers.append("X-Forwarded-For", "popshop-proxy");
+        return response;
     }
 
     fn copyResponseHeaders(self: *ProxyClient, response: *Response, req: *std.http.Client.Request) !void {
@@ -160,6 +218,97 @@ pub const ProxyClient = struct {
     }
 };
 
+/// The URL a request is proxied to, allocated in `arena`. Without a
+/// `path_rewrite` this is the configured URL as is; with one, the rewritten
+/// request path and the original query string are appended to it.
+pub fn upstreamUrl(arena: std.mem.Allocator, request: *const Request, proxy_config: *const ProxyConfig) ![]const u8 {
+    const path_rewrite = proxy_config.path_rewrite orelse return arena.dupe(u8, proxy_config.url);
+
+    const path = try path_rewrite.apply(arena, request.path);
+    const base = std.mem.trimRight(u8, proxy_config.url, "/");
+    const separator = if (std.mem.startsWith(u8, path, "/")) "" else "/";
+    if (request.query.len == 0) {
+        return std.fmt.allocPrint(arena, "{s}{s}{s}", .{ base, separator, path });
+    }
+    return std.fmt.allocPrint(arena, "{s}{s}{s}?{s}", .{ base, separator, path, request.query });
+}
+
+/// Headers to send upstream: the inbound headers minus hop-by-hop ones,
+/// X-Forwarded-For extended with the client address, and finally the rule's
+/// proxy headers, which replace inbound headers of the same name.
+fn buildForwardHeaders(
+    arena: std.mem.Allocator,
+    request: *const Request,
+    proxy_config: *const ProxyConfig,
+) ![]const std.http.Header {
+    var headers = std.ArrayList(std.http.Header).init(arena);
+
+    const connection = request.getHeader("Connection");
+    var iter = request.headers.iterator();
+    while (iter.next()) |entry| {
+        const name = entry.key_ptr.*;
+        if (shouldSkipHeader(name) or isConnectionOption(connection, name)) continue;
+        if (std.ascii.eqlIgnoreCase(name, "X-Forwarded-For")) continue;
+
+        try headers.append(.{ .name = name, .value = entry.value_ptr.* });
+    }
+
+    const forwarded_for = request.getHeader("X-Forwarded-For");
+    if (request.client_address) |address| {
+        const client_ip = try formatClientIp(arena, address);
+        const value = if (forwarded_for) |previous|
+            try std.fmt.allocPrint(arena, "{s}, {s}", .{ previous, client_ip })
+        else
+            client_ip;
+        try headers.append(.{ .name = "X-Forwarded-For", .value = value });
+    } else if (forwarded_for) |previous| {
+        try headers.append(.{ .name = "X-Forwarded-For", .value = previous });
+    }
+
+    if (proxy_config.headers) |proxy_headers| {
+        var proxy_iter = proxy_headers.iterator();
+        while (proxy_iter.next()) |entry| {
+            removeHeader(&headers, entry.key_ptr.*);
+            try headers.append(.{ .name = entry.key_ptr.*, .value = entry.value_ptr.* });
+        }
+    }
+
+    return headers.items;
+}
+
+fn removeHeader(headers: *std.ArrayList(std.http.Header), name: []const u8) void {
+    var i: usize = 0;
+    while (i < headers.items.len) {
+        if (std.ascii.eqlIgnoreCase(headers.items[i].name, name)) {
+            _ = headers.orderedRemove(i);
+        } else {
+            i += 1;
+        }
+    }
+}
+
+/// Whether `name` is listed in the Connection header, which marks it hop-by-hop
+fn isConnectionOption(connection: ?[]const u8, name: []const u8) bool {
+    const value = connection orelse return false;
+    var options = std.mem.splitScalar(u8, value, ',');
+    while (options.next()) |option| {
+        if (std.ascii.eqlIgnoreCase(std.mem.trim(u8, option, " \t"), name)) return true;
+    }
+    return false;
+}
+
+/// Client IP without the port, as used in X-Forwarded-For
+fn formatClientIp(arena: std.mem.Allocator, address: std.net.Address) ![]const u8 {
+    // Addresses format as "1.2.3.4:port" or "[::1]:port"
+    const text = try std.fmt.allocPrint(arena, "{}", .{address});
+    if (text.len > 0 and text[0] == '[') {
+        const end = std.mem.indexOfScalar(u8, text, ']') orelse return text;
+        return text[1..end];
+    }
+    const colon = std.mem.lastIndexOfScalar(u8, text, ':') orelse return text;
+    return text[0..colon];
+}
+
 /// Validate proxy URLs to prevent SSRF attacks
 fn isValidProxyUrl(url: []const u8) bool {
     const uri = std.Uri.parse(url) catch return false;
@@ -220,13 +369,17 @@ fn shouldSkipHeader(name: []const u8) bool {
     const skip_headers = [_][]const u8{
         "host",
         "connection",
+        "keep-alive",
         "upgrade", 
         "proxy-connection",
         "proxy-authenticate",
         "proxy-authorization",
         "te",
+        "trailer",
         "trailers",
         "transfer-encoding",
+        "content-length", // Set by the client from the forwarded body
+        "accept-encoding", // The client negotiates and decodes compression itself
     };
     
     for (skip_headers) |skip| {
@@ -246,11 +399,15 @@ fn shouldSkipResponseHeader(name: []const u8) bool {
     
     const skip_headers = [_][]const u8{
         "connection",
+        "keep-alive",
         "upgrade",
         "proxy-authenticate", 
         "proxy-authorization",
+        "te",
+        "trailer",
         "transfer-encoding",
         "content-encoding", // Let the client handle encoding
+        "content-length", // Recomputed from the relayed (decoded) body
     };
     
     for (skip_headers) |skip| {
@@ -382,4 +539,307 @@ test "shouldSkipHeader" {
     
     try std.testing.expect(!shouldSkipHeader("Content-Type"));
     try std.testing.expect(!shouldSkipHeader("Authorization"));
-}
\ No newline at end of file
+}
+test "formatClientIp" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+
+    try std.testing.expectEqualStrings("203.0.113.7", try formatClientIp(arena.allocator(), try std.net.Address.parseIp("203.0.113.7", 5000)));
+    try std.testing.expectEqualStrings("::1", try formatClientIp(arena.allocator(), try std.net.Address.parseIp("::1", 5000)));
+}
+
+test "upstreamUrl" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+
+    var request = Request{
+        .method = .GET,
+        .path = "/v2/users/7",
+        .query = "page=2&sort=name",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "",
+        .arena = arena.allocator(),
+    };
+
+    var proxy_config = ProxyConfig{ .url = "https://api.example.com/" };
+    try std.testing.expectEqualStrings("https://api.example.com/", try upstreamUrl(arena.allocator(), &request, &proxy_config));
+
+    proxy_config.path_rewrite = .{ .strip_prefix = "/v2", .add_prefix = "/api/v2/" };
+    try std.testing.expectEqualStrings(
+        "https://api.example.com/api/v2/users/7?page=2&sort=name",
+        try upstreamUrl(arena.allocator(), &request, &proxy_config),
+    );
+
+    // Stripping the whole path leaves the upstream root
+    request.path = "/v2";
+    request.query = "";
+    proxy_config.path_rewrite = .{ .strip_prefix = "/v2" };
+    try std.testing.expectEqualStrings("https://api.example.com/", try upstreamUrl(arena.allocator(), &request, &proxy_config));
+
+    var regex = try @import("regex.zig").Regex.compile(std.testing.allocator, "/v(\\d+)/(.*)", null);
+    defer regex.deinit();
+    request.path = "/v3/orders";
+    proxy_config.path_rewrite = .{ .regex = "/v(\\d+)/(.*)", .compiled = regex, .replacement = "/api/$2?$$v=$1" };
+    try std.testing.expectEqualStrings("https://api.example.com/api/orders?$v=3", try upstreamUrl(arena.allocator(), &request, &proxy_config));
+
+    // Paths the pattern doesn't match pass through unchanged
+    request.path = "/health";
+    try std.testing.expectEqualStrings("https://api.example.com/health", try upstreamUrl(arena.allocator(), &request, &proxy_config));
+}
+
+/// Upstream that answers a single request and records what it received
+const TestUpstream = struct {
+    arena: std.heap.ArenaAllocator,
+    method: std.http.Method = .GET,
+    body: []const u8 = "",
+    headers: std.StringHashMap([]const u8),
+    /// Time to stall before responding
+    delay_ms: u64 = 0,
+    response_body: []const u8 = "echoed",
+    err: ?anyerror = null,
+
+    fn init(allocator: std.mem.Allocator) TestUpstream {
+        return TestUpstream{
+            .arena = std.heap.ArenaAllocator.init(allocator),
+            .headers = std.StringHashMap([]const u8).init(allocator),
+        };
+    }
+
+    fn deinit(self: *TestUpstream) void {
+        self.headers.deinit();
+        self.arena.deinit();
+    }
+
+    fn serveOne(self: *TestUpstream, listener: *std.net.Server) void {
+        self.serve(listener) catch |err| {
+            self.err = err;
+        };
+    }
+
+    fn serve(self: *TestUpstream, listener: *std.net.Server) !void {
+        const allocator = self.arena.allocator();
+        const connection = try listener.accept();
+        defer connection.stream.close();
+
+        var buffer: [8192]u8 = undefined;
+        var server = std.http.Server.init(connection, &buffer);
+        var req = try server.receiveHead();
+
+        self.method = req.head.method;
+        var header_iter = req.iterateHeaders();
+        while (header_iter.next()) |header| {
+            const name = try std.ascii.allocLowerString(allocator, header.name);
+            try self.headers.put(name, try allocator.dupe(u8, header.value));
+        }
+        self.body = try (try req.reader()).readAllAlloc(allocator, 1024);
+
+        std.time.sleep(self.delay_ms * std.time.ns_per_ms);
+        try req.respond(self.response_body, .{
+            .status = .created,
+            .keep_alive = false,
+            .extra_headers = &.{.{ .name = "X-Upstream", .value = "yes" }},
+        });
+    }
+};
+
+test "ProxyClient forwards headers and body" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var listener = try (try std.net.Address.parseIp("127.0.0.1", 0)).listen(.{ .reuse_address = true });
+    defer listener.deinit();
+
+    var upstream = TestUpstream.init(allocator);
+    defer upstream.deinit();
+    const thread = try std.Thread.spawn(.{}, TestUpstream.serveOne, .{ &upstream, &listener });
+
+    var proxy_headers = std.StringHashMap([]const u8).init(arena.allocator());
+    try proxy_headers.put("x-forwarded-by", "popshop");
+    const proxy_config = ProxyConfig{
+        .url = try std.fmt.allocPrint(arena.allocator(), "http://127.0.0.1:{d}/echo", .{listener.listen_address.getPort()}),
+        .headers = proxy_headers,
+    };
+
+    var request = Request{
+        .method = .POST,
+        .path = "/api/echo",
+        .query = "",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "payload",
+        .client_address = try std.net.Address.parseIp("203.0.113.7", 5000),
+        .arena = arena.allocator(),
+    };
+    try request.headers.put("content-type", "text/plain");
+    try request.headers.put("user-agent", "test-client");
+    try request.headers.put("connection", "close, x-hop");
+    try request.headers.put("x-hop", "dropped");
+    try request.headers.put("x-forwarded-for", "198.51.100.1");
+
+    var client = ProxyClient.init(allocator);
+    defer client.deinit();
+    client.allow_private_hosts = true;
+
+    var outcome = ProxyOutcome{};
+    const response = try client.proxyRequest(&request, &proxy_config, &outcome);
+    thread.join();
+    if (upstream.err) |err| return err;
+
+    try std.testing.expectEqual(@as(?u16, 201), outcome.upstream_status);
+    try std.testing.expectEqual(std.http.Method.POST, upstream.method);
+    try std.testing.expectEqualStrings("payload", upstream.body);
+    try std.testing.expectEqualStrings("7", upstream.headers.get("content-length").?);
+    try std.testing.expectEqualStrings("text/plain", upstream.headers.get("content-type").?);
+    try std.testing.expectEqualStrings("test-client", upstream.headers.get("user-agent").?);
+    try std.testing.expectEqualStrings("198.51.100.1, 203.0.113.7", upstream.headers.get("x-forwarded-for").?);
+    try std.testing.expectEqualStrings("popshop", upstream.headers.get("x-forwarded-by").?);
+    try std.testing.expect(upstream.headers.get("x-hop") == null);
+
+    try std.testing.expectEqual(Status.created, response.status);
+    try std.testing.expectEqualStrings("yes", response.getHeader("X-Upstream").?);
+    try std.testing.expect(response.getHeader("Content-Length") == null);
+    try std.testing.expectEqualStrings("echoed", response.body);
+}
+
+test "ProxyClient rewrites upstream responses" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var listener = try (try std.net.Address.parseIp("127.0.0.1", 0)).listen(.{ .reuse_address = true });
+    defer listener.deinit();
+
+    var upstream = TestUpstream.init(allocator);
+    defer upstream.deinit();
+    upstream.response_body =
+        \\{"self": "https://api.internal/users/7", "internal": true, "id": 7}
+    ;
+    const thread = try std.Thread.spawn(.{}, TestUpstream.serveOne, .{ &upstream, &listener });
+
+    var add_headers = std.StringHashMap([]const u8).init(arena.allocator());
+    try add_headers.put("X-Rewritten", "yes");
+    var body_replace = [_]config.BodyReplace{.{ .find = "https://api.internal", .replace = "http://localhost:8080" }};
+    var json_patch = [_]config.JsonPatch{
+        .{ .op = .remove, .path = "$.internal" },
+        .{ .op = .set, .path = "$.meta.source", .value = "\"popshop\"" },
+    };
+    const proxy_config = ProxyConfig{
+        .url = try std.fmt.allocPrint(arena.allocator(), "http://127.0.0.1:{d}/users/7", .{listener.listen_address.getPort()}),
+        .response_rewrite = .{
+            .add_headers = add_headers,
+            .remove_headers = &.{"x-upstream"},
+            .body_replace = &body_replace,
+            .json_patch = &json_patch,
+        },
+    };
+
+    var request = Request{
+        .method = .GET,
+        .path = "/users/7",
+        .query = "",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "",
+        .arena = arena.allocator(),
+    };
+
+    var client = ProxyClient.init(allocator);
+    defer client.deinit();
+    client.allow_private_hosts = true;
+
+    const response = try client.proxyRequest(&request, &proxy_config, null);
+    thread.join();
+    if (upstream.err) |err| return err;
+
+    try std.testing.expectEqual(Status.created, response.status);
+    try std.testing.expect(response.getHeader("X-Upstream") == null);
+    try std.testing.expectEqualStrings("yes", response.getHeader("X-Rewritten").?);
+    // The server sends a Content-Length for the rewritten body
+    try std.testing.expect(response.getHeader("Content-Length") == null);
+    try std.testing.expectEqualStrings("{\"self\":\"http://localhost:8080/users/7\",\"id\":7,\"meta\":{\"source\":\"popshop\"}}", response.body);
+}
+
+test "ProxyClient times out slow upstreams" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var listener = try (try std.net.Address.parseIp("127.0.0.1", 0)).listen(.{ .reuse_address = true });
+    defer listener.deinit();
+
+    var upstream = TestUpstream.init(allocator);
+    defer upstream.deinit();
+    upstream.delay_ms = 500;
+    const thread = try std.Thread.spawn(.{}, TestUpstream.serveOne, .{ &upstream, &listener });
+    // The upstream may fail to respond once the proxy hangs up; only the proxy side matters here
+    defer thread.join();
+
+    const proxy_config = ProxyConfig{
+        .url = try std.fmt.allocPrint(arena.allocator(), "http://127.0.0.1:{d}/slow", .{listener.listen_address.getPort()}),
+        .timeout_ms = 100,
+    };
+
+    var request = Request{
+        .method = .GET,
+        .path = "/api/slow",
+        .query = "",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "",
+        .arena = arena.allocator(),
+    };
+
+    var client = ProxyClient.init(allocator);
+    defer client.deinit();
+    client.allow_private_hosts = true;
+
+    const started = std.time.milliTimestamp();
+    const response = try client.proxyRequest(&request, &proxy_config, null);
+
+    try std.testing.expectEqual(Status.gateway_timeout, response.status);
+    try std.testing.expect(std.time.milliTimestamp() - started < 500);
+}
+
+test "ProxyClient times out upstreams that never accept or never finish the TLS handshake" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    // With its one-connection backlog taken, the listener drops further SYNs,
+    // so connecting stalls as it would against a blackholed host
+    var full = try (try std.net.Address.parseIp("127.0.0.1", 0)).listen(.{ .reuse_address = true, .kernel_backlog = 0 });
+    defer full.deinit();
+    const filler = try std.net.tcpConnectToAddress(full.listen_address);
+    defer filler.close();
+
+    // The kernel completes the TCP handshake but nothing ever answers the ClientHello
+    var silent = try (try std.net.Address.parseIp("127.0.0.1", 0)).listen(.{ .reuse_address = true });
+    defer silent.deinit();
+
+    var client = ProxyClient.init(allocator);
+    defer client.deinit();
+    client.allow_private_hosts = true;
+
+    var request = Request{
+        .method = .GET,
+        .path = "/api/stalled",
+        .query = "",
+        .headers = HeaderMap.init(arena.allocator()),
+        .body = "",
+        .arena = arena.allocator(),
+    };
+
+    const urls = [_][]const u8{
+        try std.fmt.allocPrint(arena.allocator(), "http://127.0.0.1:{d}/stalled", .{full.listen_address.getPort()}),
+        try std.fmt.allocPrint(arena.allocator(), "https://127.0.0.1:{d}/stalled", .{silent.listen_address.getPort()}),
+    };
+    for (urls) |url| {
+        const proxy_config = ProxyConfig{ .url = url, .timeout_ms = 200 };
+
+        var outcome = ProxyOutcome{};
+        const started = std.time.milliTimestamp();
+        const response = try client.proxyRequest(&request, &proxy_config, &outcome);
+
+        try std.testing.expectEqual(Status.gateway_timeout, response.status);
+        try std.testing.expect(outcome.timed_out);
+        try std.testing.expect(std.time.milliTimestamp() - started < 1000);
+    }
+}
@@ -0,0 +1,159 @@
+const std = @import("std");
+
+/// Token bucket behind a rule's `rate_limit:`. It holds `requests` tokens
+/// that refill evenly over `per_ms`, so the limit rolls with the window
+/// instead of resetting at fixed boundaries. Safe to share between handler
+/// threads.
+pub const RateLimiter = struct {
+    requests: u32,
+    per_ms: u64,
+    /// Tokens left, in units of 1/`per_ms` of a token so refilling stays in
+    /// whole numbers: each millisecond adds `requests` units
+    credit: u128,
+    /// When `credit` was last brought up to date; null until the first request
+    updated_ms: ?i64 = null,
+    mutex: std.Thread.Mutex = .{},
+
+    /// A full bucket
+    pub fn init(requests: u32, per_ms: u64) RateLimiter {
+        return RateLimiter{ .requests = requests, .per_ms = per_ms, .credit = capacity(requests, per_ms) };
+    }
+
+    fn capacity(requests: u32, per_ms: u64) u128 {
+        return @as(u128, requests) * per_ms;
+    }
+
+    /// Take a token at `now_ms`. Null when the request may go ahead,
+    /// otherwise the milliseconds until a token is available again.
+    pub fn acquire(self: *RateLimiter, now_ms: i64) ?u64 {
+        self.mutex.lock();
+        defer self.mutex.unlock();
+
+        // Limits validation rejects never throttle
+        if (self.requests == 0 or self.per_ms == 0) return null;
+
+        if (self.updated_ms) |updated_ms| {
+            const elapsed: u128 = @intCast(@max(now_ms - updated_ms, 0));
+            self.credit = @min(capacity(self.requests, self.per_ms), self.credit + elapsed * self.requests);
+        }
+        self.updated_ms = now_ms;
+
+        if (self.credit >= self.per_ms) {
+            self.credit -= self.per_ms;
+            return null;
+        }
+        return @intCast(std.math.divCeil(u128, self.per_ms - self.credit, self.requests) catch unreachable);
+    }
+
+    /// Refill the bucket
+    pub fn reset(self: *RateLimiter) void {
+        self.mutex.lock();
+        defer self.mutex.unlock();
+
+        self.credit = capacity(self.requests, self.per_ms);
+        self.updated_ms = null;
+    }
+};
+
+/// A hard cap on requests, unlike `RateLimiter` which refills as it goes.
+/// With a window the count starts over every `window_ms`, in fixed windows
+/// from the first request; without one it only starts over on reload.
+pub const Quota = struct {
+    limit: u64,
+    window_ms: ?u64 = null,
+    /// Requests counted in the current window
+    used: u64 = 0,
+    /// When the current window began; null until the first request
+    window_started_ms: ?i64 = null,
+    mutex: std.Thread.Mutex = .{},
+
+    pub fn init(limit: u64, window_ms: ?u64) Quota {
+        return Quota{ .limit = limit, .window_ms = window_ms };
+    }
+
+    /// Count a request at `now_ms`, unless the quota is used up
+    pub fn take(self: *Quota, now_ms: i64) Outcome {
+        self.mutex.lock();
+        defer self.mutex.unlock();
+
+        const window = self.window_ms orelse 0;
+        if (self.window_started_ms) |started_ms| {
+            const elapsed: u64 = @intCast(@max(now_ms - started_ms, 0));
+            if (window > 0 and elapsed >= window) {
+                self.window_started_ms = started_ms + @as(i64, @intCast(elapsed - elapsed % window));
+                self.used = 0;
+            }
+        } else {
+            self.window_started_ms = now_ms;
+        }
+
+        if (self.used < self.limit) {
+            self.used += 1;
+            return .allowed;
+        }
+        if (window == 0) return .{ .exceeded = null };
+        const elapsed: u64 = @intCast(@max(now_ms - self.window_started_ms.?, 0));
+        return .{ .exceeded = window - elapsed };
+    }
+
+    pub const Outcome = union(enum) {
+        allowed,
+        /// Milliseconds until the window starts over; null without a window
+        exceeded: ?u64,
+    };
+};
+
+/// `Retry-After` seconds for a wait from `RateLimiter.acquire`, rounded up
+/// so a client that waits that long finds a token
+pub fn retryAfterSeconds(wait_ms: u64) u64 {
+    return @max(1, std.math.divCeil(u64, wait_ms, std.time.ms_per_s) catch unreachable);
+}
+
+test "RateLimiter refills as the window rolls" {
+    var limiter = RateLimiter.init(3, 60_000);
+
+    try std.testing.expectEqual(@as(?u64, null), limiter.acquire(0));
+    try std.testing.expectEqual(@as(?u64, null), limiter.acquire(10));
+    try std.testing.expectEqual(@as(?u64, null), limiter.acquire(20));
+    // One token comes back every 20 seconds
+    try std.testing.expectEqual(@as(?u64, 19_980), limiter.acquire(20));
+    try std.testing.expectEqual(@as(?u64, 9_980), limiter.acquire(10_020));
+    try std.testing.expectEqual(@as(?u64, null), limiter.acquire(20_020));
+    try std.testing.expect(limiter.acquire(20_030) != null);
+
+    // A quiet minute fills the bucket, but never past its size
+    try std.testing.expectEqual(@as(?u64, null), limiter.acquire(200_000));
+    try std.testing.expectEqual(@as(?u64, null), limiter.acquire(200_000));
+    try std.testing.expectEqual(@as(?u64, null), limiter.acquire(200_000));
+    try std.testing.expect(limiter.acquire(200_000) != null);
+
+    limiter.reset();
+    try std.testing.expectEqual(@as(?u64, null), limiter.acquire(200_001));
+}
+
+test "Quota caps requests and starts over each window" {
+    var quota = Quota.init(2, 60_000);
+
+    try std.testing.expectEqual(Quota.Outcome.allowed, quota.take(1_000));
+    try std.testing.expectEqual(Quota.Outcome.allowed, quota.take(2_000));
+    try std.testing.expectEqual(Quota.Outcome{ .exceeded = 40_000 }, quota.take(21_000));
+    // Waiting inside the window doesn't help, unlike a rate limit
+    try std.testing.expectEqual(Quota.Outcome{ .exceeded = 1 }, quota.take(60_999));
+
+    // Windows are fixed from the first request
+    try std.testing.expectEqual(Quota.Outcome.allowed, quota.take(61_000));
+    try std.testing.expectEqual(Quota.Outcome.allowed, quota.take(62_000));
+    try std.testing.expectEqual(Quota.Outcome{ .exceeded = 59_000 }, quota.take(62_000));
+    try std.testing.expectEqual(Quota.Outcome.allowed, quota.take(250_000));
+    try std.testing.expectEqual(@as(?i64, 241_000), quota.window_started_ms);
+
+    var lifetime = Quota.init(1, null);
+    try std.testing.expectEqual(Quota.Outcome.allowed, lifetime.take(0));
+    try std.testing.expectEqual(Quota.Outcome{ .exceeded = null }, lifetime.take(std.time.ms_per_day));
+}
+
+test "retryAfterSeconds" {
+    try std.testing.expectEqual(@as(u64, 1), retryAfterSeconds(0));
+    try std.testing.expectEqual(@as(u64, 1), retryAfterSeconds(1000));
+    try std.testing.expectEqual(@as(u64, 20), retryAfterSeconds(19_980));
+}
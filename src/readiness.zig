@@ -0,0 +1,54 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+const admin = @import("admin.zig");
+const rate_limit = @import("rate_limit.zig");
+
+const Request = interfaces.Request;
+const Response = interfaces.Response;
+
+/// Served by the main listener and the admin API, ahead of every rule
+pub const path = admin.prefix ++ "/ready";
+
+/// Whether `request` is a readiness probe. HEAD is accepted too, for
+/// probes that only look at the status.
+pub fn matches(request: *const Request) bool {
+    if (request.method != .GET and request.method != .HEAD) return false;
+    return std.mem.eql(u8, std.mem.trimRight(u8, request.path, "/"), path);
+}
+
+/// Milliseconds left of a `delay_ms` warmup that began at `started_ms`;
+/// 0 once it has passed
+pub fn remainingMs(delay_ms: ?u64, started_ms: i64, now_ms: i64) u64 {
+    const delay = delay_ms orelse return 0;
+    const elapsed: u64 = @intCast(@max(0, now_ms - started_ms));
+    return delay -| elapsed;
+}
+
+/// 200 with `{"ready": true}` once warmed up, else 503 with the time left
+pub fn respond(request: *const Request, remaining_ms: u64) !Response {
+    if (remaining_ms == 0) {
+        var response = Response.init(request.arena, .ok);
+        try response.setHeader("Content-Type", "application/json");
+        response.setBody("{\"ready\":true}");
+        return response;
+    }
+    var response = Response.init(request.arena, .service_unavailable);
+    try response.setHeader("Content-Type", "application/json");
+    try response.setHeader("Retry-After", try retryAfter(request.arena, remaining_ms));
+    response.setBody(try std.fmt.allocPrint(request.arena, "{{\"ready\":false,\"remaining_ms\":{d}}}", .{remaining_ms}));
+    return response;
+}
+
+/// `Retry-After` value covering the rest of the warmup
+pub fn retryAfter(arena: std.mem.Allocator, remaining_ms: u64) ![]const u8 {
+    return std.fmt.allocPrint(arena, "{d}", .{rate_limit.retryAfterSeconds(remaining_ms)});
+}
+
+test "remainingMs" {
+    try std.testing.expectEqual(@as(u64, 0), remainingMs(null, 1000, 1000));
+    try std.testing.expectEqual(@as(u64, 5000), remainingMs(5000, 1000, 1000));
+    try std.testing.expectEqual(@as(u64, 1500), remainingMs(5000, 1000, 4500));
+    try std.testing.expectEqual(@as(u64, 0), remainingMs(5000, 1000, 6000));
+    // A clock that steps back doesn't extend the warmup
+    try std.testing.expectEqual(@as(u64, 5000), remainingMs(5000, 1000, 900));
+}
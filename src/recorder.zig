@@ -0,0 +1,186 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+
+const Request = interfaces.Request;
+const Response = interfaces.Response;
+
+/// Saves proxied exchanges as standalone rule files that can be served later
+/// without network access. Each exchange produces `<name>.yaml` plus a
+/// `<name>.body` file holding the raw response body, referenced via `body_file`
+/// so binary payloads survive byte-for-byte.
+pub const Recorder = struct {
+    allocator: std.mem.Allocator,
+    dir: std.fs.Dir,
+
+    /// Open (creating if needed) the directory recordings are written to
+    pub fn init(allocator: std.mem.Allocator, dir_path: []const u8) !Recorder {
+        const dir = std.fs.cwd().makeOpenPath(dir_path, .{}) catch |err| {
+            std.log.err("Failed to open record directory {s}: {}", .{ dir_path, err });
+            return err;
+        };
+        return Recorder{ .allocator = allocator, .dir = dir };
+    }
+
+    pub fn deinit(self: *Recorder) void {
+        self.dir.close();
+    }
+
+    /// Write the request and upstream response as a rule. The file name is
+    /// derived from the method and path, so recording the same endpoint again
+    /// replaces the earlier capture. Safe to call from several threads.
+    pub fn record(self: *Recorder, request: *const Request, response: *const Response) !void {
+        const name = try recordingName(self.allocator, request.method.toString(), request.path);
+        defer self.allocator.free(name);
+
+        const body_name = try std.fmt.allocPrint(self.allocator, "{s}.body", .{name});
+        defer self.allocator.free(body_name);
+        const rule_name = try std.fmt.allocPrint(self.allocator, "{s}.yaml", .{name});
+        defer self.allocator.free(rule_name);
+
+        // Write the body first so a rule never references a missing file
+        try self.writeAtomic(body_name, response.body);
+
+        var rule = std.ArrayList(u8).init(self.allocator);
+        defer rule.deinit();
+        try writeRule(rule.writer(), request, response, body_name);
+        try self.writeAtomic(rule_name, rule.items);
+
+        std.log.info("Recorded {s} {s} to {s}", .{ request.method.toString(), request.path, rule_name });
+    }
+
+    fn writeAtomic(self: *Recorder, name: []const u8, content: []const u8) !void {
+        var file = try self.dir.atomicFile(name, .{});
+        defer file.deinit();
+        try file.file.writeAll(content);
+        try file.finish();
+    }
+};
+
+/// File name stem for a recording: a readable slug of the method and path
+/// followed by a hash of both, which keeps distinct paths from colliding
+/// after slugging (e.g. `/a-b` and `/a_b`).
+pub fn recordingName(allocator: std.mem.Allocator, method: []const u8, path: []const u8) ![]u8 {
+    var hasher = std.hash.Wyhash.init(0);
+    hasher.update(method);
+    hasher.update(" ");
+    hasher.update(path);
+
+    const max_slug_len = 64;
+    var slug: [max_slug_len]u8 = undefined;
+    var slug_len: usize = 0;
+    for (path) |c| {
+        if (slug_len == max_slug_len) break;
+        const mapped: u8 = if (std.ascii.isAlphanumeric(c)) std.ascii.toLower(c) else '_';
+        // Collapse runs of separators
+        if (mapped == '_' and (slug_len == 0 or slug[slug_len - 1] == '_')) continue;
+        slug[slug_len] = mapped;
+        slug_len += 1;
+    }
+    const trimmed = std.mem.trimRight(u8, slug[0..slug_len], "_");
+
+    var method_buf: [16]u8 = undefined;
+    const lower_method = std.ascii.lowerString(method_buf[0..@min(method.len, method_buf.len)], method[0..@min(method.len, method_buf.len)]);
+
+    if (trimmed.len == 0) {
+        return std.fmt.allocPrint(allocator, "{s}-{x:0>16}", .{ lower_method, hasher.final() });
+    }
+    return std.fmt.allocPrint(allocator, "{s}_{s}-{x:0>16}", .{ lower_method, trimmed, hasher.final() });
+}
+
+fn writeRule(writer: anytype, request: *const Request, response: *const Response, body_name: []const u8) !void {
+    try writer.writeAll("- request:\n    path: ");
+    try writeYamlString(writer, request.path);
+    try writer.print("\n    method: \"{s}\"\n", .{request.method.toString()});
+
+    try writer.print("  response:\n    status: {d}\n", .{@intFromEnum(response.status)});
+    try writer.writeAll("    template: false\n");
+    try writer.writeAll("    body_file: ");
+    try writeYamlString(writer, body_name);
+    try writer.writeAll("\n");
+
+    if (response.headers.count() > 0) {
+        try writer.writeAll("    headers:\n");
+        var iter = response.headers.iterator();
+        while (iter.next()) |entry| {
+            try writer.writeAll("      ");
+            try writeYamlString(writer, entry.key_ptr.*);
+            try writer.writeAll(": ");
+            try writeYamlString(writer, entry.value_ptr.*);
+            try writer.writeAll("\n");
+        }
+    }
+}
+
+/// Single-quoted YAML scalar; the only escape is a doubled quote
+pub fn writeYamlString(writer: anytype, value: []const u8) !void {
+    try writer.writeByte('\'');
+    for (value) |c| {
+        if (c == '\'') try writer.writeByte('\'');
+        try writer.writeByte(c);
+    }
+    try writer.writeByte('\'');
+}
+
+test "recordingName is deterministic and collision resistant" {
+    const allocator = std.testing.allocator;
+
+    const a = try recordingName(allocator, "GET", "/api/users");
+    defer allocator.free(a);
+    const again = try recordingName(allocator, "GET", "/api/users");
+    defer allocator.free(again);
+    const b = try recordingName(allocator, "GET", "/api-users");
+    defer allocator.free(b);
+    const c = try recordingName(allocator, "POST", "/api/users");
+    defer allocator.free(c);
+
+    try std.testing.expectEqualStrings(a, again);
+    try std.testing.expect(std.mem.startsWith(u8, a, "get_api_users-"));
+    try std.testing.expect(!std.mem.eql(u8, a, b));
+    try std.testing.expect(!std.mem.eql(u8, a, c));
+}
+
+test "Recorder.record writes a replayable rule" {
+    const config = @import("config.zig");
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+
+    var recorder = try Recorder.init(allocator, dir_path);
+    defer recorder.deinit();
+
+    const request = Request{
+        .method = .GET,
+        .path = "/api/it's",
+        .query = "",
+        .headers = interfaces.HeaderMap.init(arena.allocator()),
+        .body = "",
+        .arena = arena.allocator(),
+    };
+    var response = Response.init(arena.allocator(), .created);
+    try response.setHeader("Content-Type", "application/json");
+    response.setBody("{\"id\": \"{{not a template}}\"}");
+
+    try recorder.record(&request, &response);
+
+    var replayed = try config.Config.loadFromDirectory(allocator, dir_path);
+    defer replayed.deinit();
+
+    try std.testing.expectEqual(@as(usize, 1), replayed.rules.items.len);
+    const rule = replayed.rules.items[0];
+    try std.testing.expectEqualStrings("/api/it's", rule.request.path);
+    try std.testing.expectEqualStrings("GET", rule.request.methods[0]);
+
+    const mock = rule.response.?;
+    try std.testing.expectEqual(@as(u16, 201), mock.status);
+    try std.testing.expect(!mock.isTemplated());
+    try std.testing.expectEqualStrings("application/json", mock.headers.?.get("Content-Type").?);
+
+    const body = try std.fs.cwd().readFileAlloc(allocator, mock.body_file.?, 1024);
+    defer allocator.free(body);
+    try std.testing.expectEqualStrings(response.body, body);
+}
@@ -0,0 +1,658 @@
+const std = @import("std");
+
+/// Details about a pattern that failed to compile
+pub const Diagnostic = struct {
+    message: []const u8 = "",
+    /// Byte offset in the pattern where the problem was found
+    offset: usize = 0,
+};
+
+pub const Error = error{InvalidPattern} || std.mem.Allocator.Error;
+
+/// Longest compiled program accepted; large repeat counts expand quickly
+const max_program_len = 10_000;
+const max_repeat = 1000;
+
+const Class = std.StaticBitSet(256);
+
+const Inst = union(enum) {
+    byte: u8,
+    any,
+    class: usize,
+    /// Follow both, preferring `first`
+    split: struct { first: usize, second: usize },
+    jump: usize,
+    save: usize,
+    assert_start,
+    assert_end,
+    match,
+};
+
+/// A compiled regular expression that must match the whole input. Supported
+/// syntax is the common subset of RE2/Perl: literals, `.`, classes (`[a-z]`,
+/// `[^/]`, `\d`, `\w`, `\s` and their negations), groups `(...)` and
+/// `(?:...)`, alternation `|`, quantifiers `*`, `+`, `?`, `{n}`, `{n,}`,
+/// `{n,m}` with lazy `?` variants, and the anchors `^` and `$`. Matching
+/// steps every thread through the input at once (a Pike VM), so time is
+/// bounded by pattern × input length and memory by the pattern alone.
+pub const Regex = struct {
+    allocator: std.mem.Allocator,
+    program: []const Inst,
+    classes: []const Class,
+    /// Capture groups in the pattern, not counting the implicit group 0
+    group_count: usize,
+
+    /// Compile `pattern`. On failure the diagnostic, if given, describes the problem.
+    pub fn compile(allocator: std.mem.Allocator, pattern: []const u8, diagnostic: ?*Diagnostic) Error!Regex {
+        var arena = std.heap.ArenaAllocator.init(allocator);
+        defer arena.deinit();
+
+        var classes = std.ArrayList(Class).init(allocator);
+        errdefer classes.deinit();
+
+        var parser = Parser{
+            .arena = arena.allocator(),
+            .pattern = pattern,
+            .classes = &classes,
+            .diagnostic = diagnostic,
+        };
+        const root = try parser.parseAlternation();
+        if (parser.pos < pattern.len) {
+            // parseAlternation only stops early at an unmatched ')'
+            return parser.fail("unmatched ')'");
+        }
+
+        var program = std.ArrayList(Inst).init(allocator);
+        errdefer program.deinit();
+
+        var emitter = Emitter{ .program = &program, .scratch = arena.allocator() };
+        try program.append(.{ .save = 0 });
+        emitter.emit(&root) catch |err| {
+            if (err == error.InvalidPattern) {
+                if (diagnostic) |d| d.* = .{ .message = "pattern is too large", .offset = 0 };
+            }
+            return err;
+        };
+        try program.append(.assert_end);
+        try program.append(.{ .save = 1 });
+        try program.append(.match);
+
+        return Regex{
+            .allocator = allocator,
+            .program = try program.toOwnedSlice(),
+            .classes = try classes.toOwnedSlice(),
+            .group_count = parser.group_count,
+        };
+    }
+
+    pub fn deinit(self: *Regex) void {
+        self.allocator.free(self.program);
+        self.allocator.free(self.classes);
+    }
+
+    /// Whether the whole input matches
+    pub fn isMatch(self: *const Regex, input: []const u8) std.mem.Allocator.Error!bool {
+        var fallback = std.heap.stackFallback(2048, self.allocator);
+        var no_captures: [0]?[]const u8 = .{};
+        return self.match(fallback.get(), input, &no_captures);
+    }
+
+    /// Match the whole input. On success, `captures[i]` receives group `i`
+    /// (group 0 being the full match), or null when the group did not take part;
+    /// groups beyond `captures.len` are dropped. `allocator` is only used for
+    /// scratch space.
+    pub fn match(self: *const Regex, allocator: std.mem.Allocator, input: []const u8, captures: []?[]const u8) std.mem.Allocator.Error!bool {
+        // Only the groups the caller asked for are tracked
+        const slot_count = 2 * @min(captures.len, self.group_count + 1);
+
+        var current = try Threads.init(allocator, self.program.len, slot_count);
+        defer current.deinit(allocator);
+        var next = try Threads.init(allocator, self.program.len, slot_count);
+        defer next.deinit(allocator);
+
+        const slots = try allocator.alloc(usize, slot_count);
+        defer allocator.free(slots);
+        @memset(slots, no_position);
+
+        var stack = std.ArrayList(Job).init(allocator);
+        defer stack.deinit();
+
+        try self.addThread(&current, &stack, 0, input, 0, slots);
+        var pos: usize = 0;
+        while (current.len > 0) : (pos += 1) {
+            for (current.pcs[0..current.len]) |pc| {
+                switch (self.program[pc]) {
+                    .byte, .any, .class => {
+                        if (!self.consumes(pc, input, pos)) continue;
+                        @memcpy(slots, current.slotsOf(pc));
+                        try self.addThread(&next, &stack, pc + 1, input, pos + 1, slots);
+                    },
+                    .match => {
+                        // Threads after this one have lower priority, so this is the match
+                        const found = current.slotsOf(pc);
+                        for (captures, 0..) |*capture, group| {
+                            capture.* = null;
+                            if (2 * group >= slot_count) continue;
+                            const start = found[2 * group];
+                            const end = found[2 * group + 1];
+                            if (start == no_position or end == no_position) continue;
+                            capture.* = input[start..end];
+                        }
+                        return true;
+                    },
+                    else => {},
+                }
+            }
+            std.mem.swap(Threads, &current, &next);
+            next.clear();
+        }
+        return false;
+    }
+
+    /// Follow the instructions that consume no input from `start`, adding
+    /// every instruction reached to `threads` in priority order. `slots` holds
+    /// the capture positions on entry and is restored before returning.
+    fn addThread(self: *const Regex, threads: *Threads, stack: *std.ArrayList(Job), start: usize, input: []const u8, pos: usize, slots: []usize) !void {
+        try stack.append(.{ .thread = start });
+        while (stack.pop()) |job| {
+            var pc = switch (job) {
+                .restore => |r| {
+                    slots[r.slot] = r.value;
+                    continue;
+                },
+                .thread => |first| first,
+            };
+
+            // A thread reaching an instruction another got to first loses to it
+            while (!threads.seen.isSet(pc)) {
+                threads.add(pc);
+                switch (self.program[pc]) {
+                    .split => |s| {
+                        try stack.append(.{ .thread = s.second });
+                        pc = s.first;
+                    },
+                    .jump => |target| pc = target,
+                    .save => |slot| {
+                        if (slot < slots.len) {
+                            try stack.append(.{ .restore = .{ .slot = slot, .value = slots[slot] } });
+                            slots[slot] = pos;
+                        }
+                        pc += 1;
+                    },
+                    .assert_start => {
+                        if (pos != 0) break;
+                        pc += 1;
+                    },
+                    .assert_end => {
+                        if (pos != input.len) break;
+                        pc += 1;
+                    },
+                    .byte, .any, .class, .match => {
+                        @memcpy(threads.slotsOf(pc), slots);
+                        break;
+                    },
+                }
+            }
+        }
+    }
+
+    fn consumes(self: *const Regex, pc: usize, input: []const u8, pos: usize) bool {
+        if (pos >= input.len) return false;
+        return switch (self.program[pc]) {
+            .byte => |b| input[pos] == b,
+            .any => true,
+            .class => |index| self.classes[index].isSet(input[pos]),
+            else => unreachable,
+        };
+    }
+};
+
+/// Capture slot value for a position not reached
+const no_position = std.math.maxInt(usize);
+
+const Job = union(enum) {
+    thread: usize,
+    restore: struct { slot: usize, value: usize },
+};
+
+/// The instructions reached at one input position, in priority order, with
+/// the capture slots of those that consume input or match
+const Threads = struct {
+    seen: std.DynamicBitSetUnmanaged,
+    pcs: []usize,
+    len: usize = 0,
+    /// `slot_count` positions per instruction
+    slots: []usize,
+    slot_count: usize,
+
+    fn init(allocator: std.mem.Allocator, program_len: usize, slot_count: usize) !Threads {
+        var seen = try std.DynamicBitSetUnmanaged.initEmpty(allocator, program_len);
+        errdefer seen.deinit(allocator);
+        const pcs = try allocator.alloc(usize, program_len);
+        errdefer allocator.free(pcs);
+        return Threads{
+            .seen = seen,
+            .pcs = pcs,
+            .slots = try allocator.alloc(usize, program_len * slot_count),
+            .slot_count = slot_count,
+        };
+    }
+
+    fn deinit(self: *Threads, allocator: std.mem.Allocator) void {
+        self.seen.deinit(allocator);
+        allocator.free(self.pcs);
+        allocator.free(self.slots);
+    }
+
+    fn add(self: *Threads, pc: usize) void {
+        self.seen.set(pc);
+        self.pcs[self.len] = pc;
+        self.len += 1;
+    }
+
+    fn clear(self: *Threads) void {
+        for (self.pcs[0..self.len]) |pc| self.seen.unset(pc);
+        self.len = 0;
+    }
+
+    fn slotsOf(self: *const Threads, pc: usize) []usize {
+        return self.slots[pc * self.slot_count ..][0..self.slot_count];
+    }
+};
+
+const Node = union(enum) {
+    empty,
+    byte: u8,
+    any,
+    class: usize,
+    group: struct { index: ?usize, child: *const Node },
+    concat: []const Node,
+    alternate: []const Node,
+    repeat: struct { child: *const Node, min: u32, max: ?u32, greedy: bool },
+    assert_start,
+    assert_end,
+};
+
+const Parser = struct {
+    arena: std.mem.Allocator,
+    pattern: []const u8,
+    pos: usize = 0,
+    group_count: usize = 0,
+    classes: *std.ArrayList(Class),
+    diagnostic: ?*Diagnostic,
+
+    fn fail(self: *Parser, message: []const u8) Error {
+        if (self.diagnostic) |d| d.* = .{ .message = message, .offset = self.pos };
+        return error.InvalidPattern;
+    }
+
+    fn peek(self: *const Parser) ?u8 {
+        return if (self.pos < self.pattern.len) self.pattern[self.pos] else null;
+    }
+
+    fn parseAlternation(self: *Parser) Error!Node {
+        var branches = std.ArrayList(Node).init(self.arena);
+        try branches.append(try self.parseConcat());
+        while (self.peek() == '|') {
+            self.pos += 1;
+            try branches.append(try self.parseConcat());
+        }
+        if (branches.items.len == 1) return branches.items[0];
+        return Node{ .alternate = branches.items };
+    }
+
+    fn parseConcat(self: *Parser) Error!Node {
+        var items = std.ArrayList(Node).init(self.arena);
+        while (self.peek()) |c| {
+            if (c == '|' or c == ')') break;
+            const atom = try self.parseAtom();
+            try items.append(try self.parseQuantifier(atom));
+        }
+        return switch (items.items.len) {
+            0 => .empty,
+            1 => items.items[0],
+            else => Node{ .concat = items.items },
+        };
+    }
+
+    fn parseAtom(self: *Parser) Error!Node {
+        const c = self.pattern[self.pos];
+        self.pos += 1;
+        switch (c) {
+            '.' => return .any,
+            '^' => return .assert_start,
+            '$' => return .assert_end,
+            '(' => {
+                var index: ?usize = null;
+                if (std.mem.startsWith(u8, self.pattern[self.pos..], "?:")) {
+                    self.pos += 2;
+                } else if (self.peek() == '?') {
+                    return self.fail("unsupported group syntax");
+                } else {
+                    self.group_count += 1;
+                    index = self.group_count;
+                }
+
+                const child = try self.arena.create(Node);
+                child.* = try self.parseAlternation();
+                if (self.peek() != ')') return self.fail("missing closing parenthesis");
+                self.pos += 1;
+                return Node{ .group = .{ .index = index, .child = child } };
+            },
+            '[' => return Node{ .class = try self.addClass(try self.parseClass()) },
+            '\\' => {
+                if (try self.parseEscape()) |class| {
+                    return Node{ .class = try self.addClass(class) };
+                }
+                return Node{ .byte = self.pattern[self.pos - 1] };
+            },
+            '*', '+', '?' => {
+                self.pos -= 1;
+                return self.fail("nothing to repeat");
+            },
+            else => return Node{ .byte = c },
+        }
+    }
+
+    fn parseQuantifier(self: *Parser, atom: Node) Error!Node {
+        var min: u32 = undefined;
+        var max: ?u32 = undefined;
+        switch (self.peek() orelse return atom) {
+            '*' => {
+                min = 0;
+                max = null;
+                self.pos += 1;
+            },
+            '+' => {
+                min = 1;
+                max = null;
+                self.pos += 1;
+            },
+            '?' => {
+                min = 0;
+                max = 1;
+                self.pos += 1;
+            },
+            // A brace that isn't a valid count is a literal, as in RE2
+            '{' => {
+                const count = try self.parseCount() orelse return atom;
+                min = count.min;
+                max = count.max;
+            },
+            else => return atom,
+        }
+
+        var greedy = true;
+        if (self.peek() == '?') {
+            greedy = false;
+            self.pos += 1;
+        }
+        if (self.peek()) |next| {
+            if (next == '*' or next == '+' or next == '?') return self.fail("nested repetition");
+        }
+
+        const child = try self.arena.create(Node);
+        child.* = atom;
+        return Node{ .repeat = .{ .child = child, .min = min, .max = max, .greedy = greedy } };
+    }
+
+    /// Parse `{n}`, `{n,}` or `{n,m}` at the current position, or return null
+    /// without consuming anything when the brace doesn't start a count
+    fn parseCount(self: *Parser) Error!?struct { min: u32, max: ?u32 } {
+        const rest = self.pattern[self.pos..];
+        const close = std.mem.indexOfScalar(u8, rest, '}') orelse return null;
+        const inner = rest[1..close];
+
+        const comma = std.mem.indexOfScalar(u8, inner, ',');
+        const min_text = if (comma) |i| inner[0..i] else inner;
+        const min = std.fmt.parseInt(u32, min_text, 10) catch return null;
+        var max: ?u32 = min;
+        if (comma) |i| {
+            const max_text = inner[i + 1 ..];
+            max = if (max_text.len == 0) null else std.fmt.parseInt(u32, max_text, 10) catch return null;
+        }
+
+        if (min > max_repeat or (max != null and max.? > max_repeat)) return self.fail("repeat count is too large");
+        if (max != null and max.? < min) return self.fail("invalid repeat count");
+        self.pos += close + 1;
+        return .{ .min = min, .max = max };
+    }
+
+    /// Parse the escape after a backslash. Returns the class for `\d`-style
+    /// escapes, or null for a literal byte, which is left at `pattern[pos - 1]`.
+    fn parseEscape(self: *Parser) Error!?Class {
+        const c = self.peek() orelse return self.fail("trailing backslash");
+        self.pos += 1;
+        if (escapeClass(c)) |class| return class;
+        if (std.ascii.isAlphanumeric(c)) {
+            self.pos -= 2;
+            return self.fail("unknown escape sequence");
+        }
+        return null;
+    }
+
+    fn parseClass(self: *Parser) Error!Class {
+        var class = Class.initEmpty();
+        var negate = false;
+        if (self.peek() == '^') {
+            negate = true;
+            self.pos += 1;
+        }
+
+        var first = true;
+        while (true) {
+            const c = self.peek() orelse return self.fail("missing closing ]");
+            if (c == ']' and !first) {
+                self.pos += 1;
+                break;
+            }
+            first = false;
+
+            const low = (try self.parseClassByte(&class)) orelse continue;
+            if (self.peek() == '-' and self.pos + 1 < self.pattern.len and self.pattern[self.pos + 1] != ']') {
+                self.pos += 1;
+                const high = (try self.parseClassByte(null)) orelse return self.fail("invalid class range");
+                if (high < low) return self.fail("invalid class range");
+                class.setRangeValue(.{ .start = low, .end = @as(usize, high) + 1 }, true);
+            } else {
+                class.set(low);
+            }
+        }
+
+        if (negate) class.toggleAll();
+        return class;
+    }
+
+    /// Read one class member. Escapes like `\d` are merged into `class` (and
+    /// rejected as range ends when `class` is null); other members are returned.
+    fn parseClassByte(self: *Parser, class: ?*Class) Error!?u8 {
+        const c = self.pattern[self.pos];
+        self.pos += 1;
+        if (c != '\\') return c;
+
+        if (try self.parseEscape()) |escaped| {
+            const target = class orelse return self.fail("invalid class range");
+            target.setUnion(escaped);
+            return null;
+        }
+        return self.pattern[self.pos - 1];
+    }
+
+    fn addClass(self: *Parser, class: Class) Error!usize {
+        try self.classes.append(class);
+        return self.classes.items.len - 1;
+    }
+};
+
+fn escapeClass(c: u8) ?Class {
+    var class = Class.initEmpty();
+    switch (std.ascii.toLower(c)) {
+        'd' => class.setRangeValue(.{ .start = '0', .end = '9' + 1 }, true),
+        'w' => {
+            class.setRangeValue(.{ .start = 'a', .end = 'z' + 1 }, true);
+            class.setRangeValue(.{ .start = 'A', .end = 'Z' + 1 }, true);
+            class.setRangeValue(.{ .start = '0', .end = '9' + 1 }, true);
+            class.set('_');
+        },
+        's' => for (" \t\n\r\x0b\x0c") |space| class.set(space),
+        else => return null,
+    }
+    if (std.ascii.isUpper(c)) class.toggleAll();
+    return class;
+}
+
+const Emitter = struct {
+    program: *std.ArrayList(Inst),
+    scratch: std.mem.Allocator,
+
+    /// Fails with error.InvalidPattern once the program outgrows `max_program_len`
+    fn append(self: *Emitter, inst: Inst) Error!usize {
+        if (self.program.items.len >= max_program_len) return error.InvalidPattern;
+        try self.program.append(inst);
+        return self.program.items.len - 1;
+    }
+
+    fn emit(self: *Emitter, node: *const Node) Error!void {
+        switch (node.*) {
+            .empty => {},
+            .byte => |b| _ = try self.append(.{ .byte = b }),
+            .any => _ = try self.append(.any),
+            .class => |index| _ = try self.append(.{ .class = index }),
+            .assert_start => _ = try self.append(.assert_start),
+            .assert_end => _ = try self.append(.assert_end),
+            .group => |group| {
+                if (group.index) |index| _ = try self.append(.{ .save = 2 * index });
+                try self.emit(group.child);
+                if (group.index) |index| _ = try self.append(.{ .save = 2 * index + 1 });
+            },
+            .concat => |items| {
+                for (items) |*item| try self.emit(item);
+            },
+            .alternate => |branches| {
+                var exits = std.ArrayList(usize).init(self.scratch);
+                for (branches[0 .. branches.len - 1]) |*branch| {
+                    const split = try self.append(.{ .split = .{ .first = self.program.items.len + 1, .second = 0 } });
+                    try self.emit(branch);
+                    try exits.append(try self.append(.{ .jump = 0 }));
+                    self.program.items[split].split.second = self.program.items.len;
+                }
+                try self.emit(&branches[branches.len - 1]);
+                for (exits.items) |exit| self.program.items[exit] = .{ .jump = self.program.items.len };
+            },
+            .repeat => |repeat| {
+                for (0..repeat.min) |_| try self.emit(repeat.child);
+
+                if (repeat.max == null) {
+                    // loop: split(body, out); body; jump loop
+                    const loop = try self.append(.{ .split = undefined });
+                    try self.emit(repeat.child);
+                    _ = try self.append(.{ .jump = loop });
+                    self.program.items[loop] = splitTo(loop + 1, self.program.items.len, repeat.greedy);
+                    return;
+                }
+
+                // Each optional copy may exit straight to the end
+                var exits = std.ArrayList(usize).init(self.scratch);
+                for (repeat.min..repeat.max.?) |_| {
+                    try exits.append(try self.append(.{ .split = undefined }));
+                    try self.emit(repeat.child);
+                }
+                for (exits.items) |exit| {
+                    self.program.items[exit] = splitTo(exit + 1, self.program.items.len, repeat.greedy);
+                }
+            },
+        }
+    }
+
+    fn splitTo(body: usize, out: usize, greedy: bool) Inst {
+        if (greedy) return .{ .split = .{ .first = body, .second = out } };
+        return .{ .split = .{ .first = out, .second = body } };
+    }
+};
+
+test "Regex matches whole input" {
+    const allocator = std.testing.allocator;
+
+    var json_files = try Regex.compile(allocator, "/files/.*\\.json", null);
+    defer json_files.deinit();
+    try std.testing.expect(try json_files.isMatch("/files/a/b.json"));
+    try std.testing.expect(!try json_files.isMatch("/files/a.jsonx"));
+    try std.testing.expect(!try json_files.isMatch("/x/files/a.json"));
+
+    var ids = try Regex.compile(allocator, "/users/(\\d+)(?:/(posts|comments))?/?", null);
+    defer ids.deinit();
+    try std.testing.expect(try ids.isMatch("/users/42"));
+    try std.testing.expect(try ids.isMatch("/users/42/posts/"));
+    try std.testing.expect(!try ids.isMatch("/users/abc"));
+    try std.testing.expect(!try ids.isMatch("/users/42/likes"));
+
+    var counted = try Regex.compile(allocator, "[a-f0-9]{2,4}-[^/]+", null);
+    defer counted.deinit();
+    try std.testing.expect(try counted.isMatch("beef-x"));
+    try std.testing.expect(!try counted.isMatch("b-x"));
+    try std.testing.expect(!try counted.isMatch("beef0-x"));
+    try std.testing.expect(!try counted.isMatch("beef-a/b"));
+
+    // Nested stars cost no more than a single one
+    var nested = try Regex.compile(allocator, "(a*)*b", null);
+    defer nested.deinit();
+    try std.testing.expect(!try nested.isMatch("a" ** 64));
+}
+
+test "Regex.match captures groups" {
+    const allocator = std.testing.allocator;
+
+    var regex = try Regex.compile(allocator, "/files/(.*?)(\\.json)?", null);
+    defer regex.deinit();
+    try std.testing.expectEqual(@as(usize, 2), regex.group_count);
+
+    var captures: [3]?[]const u8 = undefined;
+    try std.testing.expect(try regex.match(allocator, "/files/report.json", &captures));
+    try std.testing.expectEqualStrings("/files/report.json", captures[0].?);
+    try std.testing.expectEqualStrings("report", captures[1].?);
+    try std.testing.expectEqualStrings(".json", captures[2].?);
+
+    try std.testing.expect(try regex.match(allocator, "/files/report", &captures));
+    try std.testing.expectEqualStrings("report", captures[1].?);
+    try std.testing.expect(captures[2] == null);
+}
+
+test "Regex.match memory doesn't grow with the input" {
+    var regex = try Regex.compile(std.testing.allocator, "{\"id\": *(\\d+).*", null);
+    defer regex.deinit();
+
+    const body = try std.testing.allocator.alloc(u8, 4 * 1024 * 1024);
+    defer std.testing.allocator.free(body);
+    @memset(body, 'x');
+    @memcpy(body[0..9], "{\"id\": 42");
+
+    var counting = std.testing.FailingAllocator.init(std.testing.allocator, .{});
+    var captures: [2]?[]const u8 = undefined;
+    try std.testing.expect(try regex.match(counting.allocator(), body, &captures));
+    try std.testing.expectEqualStrings("42", captures[1].?);
+    try std.testing.expect(counting.allocated_bytes < 64 * 1024);
+
+    // Running out of memory is an error, not a failed match
+    var failing = std.testing.FailingAllocator.init(std.testing.allocator, .{ .fail_index = 0 });
+    try std.testing.expectError(error.OutOfMemory, regex.match(failing.allocator(), body, &captures));
+}
+
+test "Regex.compile reports invalid patterns" {
+    const allocator = std.testing.allocator;
+    const cases = [_]struct { pattern: []const u8, message: []const u8 }{
+        .{ .pattern = "/files/(.*", .message = "missing closing parenthesis" },
+        .{ .pattern = "/a)", .message = "unmatched ')'" },
+        .{ .pattern = "*.json", .message = "nothing to repeat" },
+        .{ .pattern = "[a-", .message = "missing closing ]" },
+        .{ .pattern = "[z-a]", .message = "invalid class range" },
+        .{ .pattern = "a**", .message = "nested repetition" },
+        .{ .pattern = "\\q", .message = "unknown escape sequence" },
+        .{ .pattern = "a{5000}", .message = "repeat count is too large" },
+    };
+
+    for (cases) |case| {
+        var diagnostic = Diagnostic{};
+        try std.testing.expectError(error.InvalidPattern, Regex.compile(allocator, case.pattern, &diagnostic));
+        try std.testing.expectEqualStrings(case.message, diagnostic.message);
+    }
+}
@@ -0,0 +1,256 @@
+const std = @import("std");
+const client_deadline = @import("client_deadline.zig");
+
+/// Largest config accepted from a URL
+pub const max_size = 16 * 1024 * 1024;
+
+/// Redirects followed before giving up, as many as std.http.Client follows
+const max_redirects = 3;
+
+/// How `fetch` talks to the server hosting a config
+pub const FetchOptions = struct {
+    /// Limit on the whole exchange, from connecting to the last body byte
+    timeout_ms: u64 = 10_000,
+    /// Sent as the `Authorization` header when set
+    authorization: ?[]const u8 = null,
+};
+
+/// Whether a config path is an http:// or https:// URL rather than a file
+pub fn isUrl(path: []const u8) bool {
+    return std.ascii.startsWithIgnoreCase(path, "http://") or std.ascii.startsWithIgnoreCase(path, "https://");
+}
+
+/// Download the config at `url`, following up to three redirects. Anything
+/// but a 200 fails with error.UnexpectedConfigStatus and running out of time
+/// with error.ConfigFetchTimeout, so a bad URL stops startup or a reload
+/// instead of leaving popshop with no routes. The caller owns the result.
+pub fn fetch(allocator: std.mem.Allocator, url: []const u8, options: FetchOptions) ![]u8 {
+    var uri = std.Uri.parse(url) catch {
+        std.log.warn("Config URL '{s}' is not a valid URL", .{url});
+        return error.InvalidConfigUrl;
+    };
+
+    var client = std.http.Client{ .allocator = allocator };
+    defer client.deinit();
+
+    // Holds each redirect target; relative ones refer back to the URL before them
+    var redirect_arena = std.heap.ArenaAllocator.init(allocator);
+    defer redirect_arena.deinit();
+
+    const deadline = std.time.milliTimestamp() + @as(i64, @intCast(options.timeout_ms));
+    var authorization = options.authorization;
+    var redirects: usize = 0;
+    while (true) {
+        // Redirects are followed here rather than by std.http.Client, which
+        // would connect to the new host with no deadline
+        var header_buffer: [16 * 1024]u8 = undefined;
+        var req = client_deadline.open(&client, .GET, uri, .{
+            .server_header_buffer = &header_buffer,
+            .redirect_behavior = .unhandled,
+            .headers = .{
+                .authorization = if (authorization) |value| .{ .override = value } else .default,
+            },
+        }, deadline) catch |err| return failed(url, options, deadline, err);
+        defer req.deinit();
+
+        return exchange(allocator, &req, deadline) catch |err| {
+            if (err == error.ConfigRedirect) {
+                if (redirects == max_redirects) {
+                    std.log.warn("Fetching config from {s} redirected more than {d} times", .{ url, max_redirects });
+                    return error.TooManyHttpRedirects;
+                }
+                redirects += 1;
+
+                const location = req.response.location orelse return failed(url, options, deadline, error.HttpRedirectLocationMissing);
+                var aux = try redirect_arena.allocator().alloc(u8, location.len + header_buffer.len);
+                const previous = uri;
+                uri = previous.resolve_inplace(location, &aux) catch return failed(url, options, deadline, error.HttpRedirectLocationInvalid);
+
+                // Credentials only go back to the host that was given them
+                if (!sameOrigin(previous, uri)) authorization = null;
+                continue;
+            }
+            if (err == error.UnexpectedConfigStatus) {
+                const status = req.response.status;
+                std.log.warn("Fetching config from {s} returned {d} {s}", .{ url, @intFromEnum(status), status.phrase() orelse "" });
+                return err;
+            }
+            return failed(url, options, deadline, err);
+        };
+    }
+}
+
+/// Log a failed fetch, reporting one that overran `deadline` as error.ConfigFetchTimeout
+fn failed(url: []const u8, options: FetchOptions, deadline: i64, err: anyerror) anyerror {
+    if (client_deadline.expired(err, deadline)) {
+        std.log.warn("Fetching config from {s} timed out after {d}ms", .{ url, options.timeout_ms });
+        return error.ConfigFetchTimeout;
+    }
+    std.log.warn("Fetching config from {s} failed: {s}", .{ url, @errorName(err) });
+    return err;
+}
+
+fn sameOrigin(a: std.Uri, b: std.Uri) bool {
+    var a_buffer: [std.Uri.host_name_max]u8 = undefined;
+    var b_buffer: [std.Uri.host_name_max]u8 = undefined;
+    const a_host = a.getHost(&a_buffer) catch return false;
+    const b_host = b.getHost(&b_buffer) catch return false;
+    return std.ascii.eqlIgnoreCase(a.scheme, b.scheme) and std.ascii.eqlIgnoreCase(a_host, b_host) and std.meta.eql(a.port, b.port);
+}
+
+fn exchange(allocator: std.mem.Allocator, req: *std.http.Client.Request, deadline: i64) ![]u8 {
+    try client_deadline.apply(req, deadline);
+    try req.send();
+    try client_deadline.apply(req, deadline);
+    try req.wait();
+    if (req.response.status.class() == .redirect and req.response.status != .not_modified) return error.ConfigRedirect;
+    if (req.response.status != .ok) return error.UnexpectedConfigStatus;
+
+    var body = std.ArrayList(u8).init(allocator);
+    errdefer body.deinit();
+    var buffer: [16 * 1024]u8 = undefined;
+    while (true) {
+        try client_deadline.apply(req, deadline);
+        const n = try req.reader().read(&buffer);
+        if (n == 0) break;
+        if (body.items.len + n > max_size) return error.StreamTooLong;
+        try body.appendSlice(buffer[0..n]);
+    }
+    return body.toOwnedSlice();
+}
+
+/// Server answering one request with a config, recording the
+/// `Authorization` header it was sent
+const TestConfigServer = struct {
+    status: std.http.Status = .ok,
+    body: []const u8,
+    /// Time to stall before responding
+    delay_ms: u64 = 0,
+    /// Sent as the `Location` header when set
+    location: ?[]const u8 = null,
+    authorization_buffer: [128]u8 = undefined,
+    authorization: ?[]const u8 = null,
+    err: ?anyerror = null,
+
+    fn serveOne(self: *TestConfigServer, listener: *std.net.Server) void {
+        self.serve(listener) catch |err| {
+            self.err = err;
+        };
+    }
+
+    fn serve(self: *TestConfigServer, listener: *std.net.Server) !void {
+        const connection = try listener.accept();
+        defer connection.stream.close();
+
+        var buffer: [8192]u8 = undefined;
+        var server = std.http.Server.init(connection, &buffer);
+        var req = try server.receiveHead();
+
+        var header_iter = req.iterateHeaders();
+        while (header_iter.next()) |header| {
+            if (std.ascii.eqlIgnoreCase(header.name, "authorization")) {
+                const len = @min(header.value.len, self.authorization_buffer.len);
+                @memcpy(self.authorization_buffer[0..len], header.value[0..len]);
+                self.authorization = self.authorization_buffer[0..len];
+            }
+        }
+
+        std.time.sleep(self.delay_ms * std.time.ns_per_ms);
+        const location = [_]std.http.Header{.{ .name = "Location", .value = self.location orelse "" }};
+        const extra_headers: []const std.http.Header = if (self.location != null) &location else &.{};
+        try req.respond(self.body, .{ .status = self.status, .keep_alive = false, .extra_headers = extra_headers });
+    }
+};
+
+fn testUrl(buffer: []u8, listener: *const std.net.Server) ![]const u8 {
+    return std.fmt.bufPrint(buffer, "http://127.0.0.1:{d}/popshop.yaml", .{listener.listen_address.getPort()});
+}
+
+test "isUrl" {
+    try std.testing.expect(isUrl("http://config.internal/popshop.yaml"));
+    try std.testing.expect(isUrl("HTTPS://config.internal/popshop.yaml"));
+    try std.testing.expect(!isUrl("popshop.yaml"));
+    try std.testing.expect(!isUrl("./http/popshop.yaml"));
+}
+
+test "fetch downloads the config with the Authorization header" {
+    const allocator = std.testing.allocator;
+    var listener = try (try std.net.Address.parseIp("127.0.0.1", 0)).listen(.{ .reuse_address = true });
+    defer listener.deinit();
+
+    var server = TestConfigServer{ .body = "- request:\n    path: /health\n" };
+    const thread = try std.Thread.spawn(.{}, TestConfigServer.serveOne, .{ &server, &listener });
+
+    var url_buffer: [64]u8 = undefined;
+    const content = try fetch(allocator, try testUrl(&url_buffer, &listener), .{ .authorization = "Bearer ci-token" });
+    defer allocator.free(content);
+    thread.join();
+    if (server.err) |err| return err;
+
+    try std.testing.expectEqualStrings("- request:\n    path: /health\n", content);
+    try std.testing.expectEqualStrings("Bearer ci-token", server.authorization.?);
+}
+
+test "fetch fails on anything but 200" {
+    var listener = try (try std.net.Address.parseIp("127.0.0.1", 0)).listen(.{ .reuse_address = true });
+    defer listener.deinit();
+
+    var server = TestConfigServer{ .status = .not_found, .body = "not here" };
+    const thread = try std.Thread.spawn(.{}, TestConfigServer.serveOne, .{ &server, &listener });
+    defer thread.join();
+
+    var url_buffer: [64]u8 = undefined;
+    try std.testing.expectError(error.UnexpectedConfigStatus, fetch(std.testing.allocator, try testUrl(&url_buffer, &listener), .{}));
+}
+
+test "fetch times out" {
+    var listener = try (try std.net.Address.parseIp("127.0.0.1", 0)).listen(.{ .reuse_address = true });
+    defer listener.deinit();
+
+    var server = TestConfigServer{ .body = "[]", .delay_ms = 500 };
+    const thread = try std.Thread.spawn(.{}, TestConfigServer.serveOne, .{ &server, &listener });
+    // The server may fail to respond once fetch hangs up; only fetch matters here
+    defer thread.join();
+
+    var url_buffer: [64]u8 = undefined;
+    try std.testing.expectError(error.ConfigFetchTimeout, fetch(std.testing.allocator, try testUrl(&url_buffer, &listener), .{ .timeout_ms = 100 }));
+}
+
+test "fetch follows redirects, dropping the Authorization header for another host" {
+    const allocator = std.testing.allocator;
+    var target_listener = try (try std.net.Address.parseIp("127.0.0.1", 0)).listen(.{ .reuse_address = true });
+    defer target_listener.deinit();
+    var redirect_listener = try (try std.net.Address.parseIp("127.0.0.1", 0)).listen(.{ .reuse_address = true });
+    defer redirect_listener.deinit();
+
+    var target_url_buffer: [64]u8 = undefined;
+    var redirect = TestConfigServer{ .status = .found, .body = "", .location = try testUrl(&target_url_buffer, &target_listener) };
+    var target = TestConfigServer{ .body = "[]" };
+    const redirect_thread = try std.Thread.spawn(.{}, TestConfigServer.serveOne, .{ &redirect, &redirect_listener });
+    const target_thread = try std.Thread.spawn(.{}, TestConfigServer.serveOne, .{ &target, &target_listener });
+
+    var url_buffer: [64]u8 = undefined;
+    const content = try fetch(allocator, try testUrl(&url_buffer, &redirect_listener), .{ .authorization = "Bearer ci-token" });
+    defer allocator.free(content);
+    redirect_thread.join();
+    target_thread.join();
+    if (redirect.err) |err| return err;
+    if (target.err) |err| return err;
+
+    try std.testing.expectEqualStrings("[]", content);
+    try std.testing.expectEqualStrings("Bearer ci-token", redirect.authorization.?);
+    try std.testing.expect(target.authorization == null);
+}
+
+test "fetch times out connecting to a host that never accepts" {
+    // With its one-connection backlog taken, the listener drops further SYNs
+    var listener = try (try std.net.Address.parseIp("127.0.0.1", 0)).listen(.{ .reuse_address = true, .kernel_backlog = 0 });
+    defer listener.deinit();
+    const filler = try std.net.tcpConnectToAddress(listener.listen_address);
+    defer filler.close();
+
+    var url_buffer: [64]u8 = undefined;
+    const started = std.time.milliTimestamp();
+    try std.testing.expectError(error.ConfigFetchTimeout, fetch(std.testing.allocator, try testUrl(&url_buffer, &listener), .{ .timeout_ms = 100 }));
+    try std.testing.expect(std.time.milliTimestamp() - started < 1000);
+}
@@ -0,0 +1,317 @@
+const std = @import("std");
+const yaml = @import("yaml");
+const interfaces = @import("http/interfaces.zig");
+const config = @import("config.zig");
+const app = @import("app.zig");
+const verifier = @import("verifier.zig");
+
+const Request = interfaces.Request;
+const Response = interfaces.Response;
+const Server = interfaces.Server;
+const Config = config.Config;
+const PopshopApp = app.PopshopApp;
+
+/// One example request from a `popshop test` file and what it should get back
+pub const Case = struct {
+    /// From `name:`, else the method and path
+    name: []const u8,
+    method: interfaces.Method = .GET,
+    path: []const u8,
+    query: []const u8 = "",
+    headers: []const Header = &.{},
+    body: []const u8 = "",
+    expect: Expectation = .{},
+};
+
+pub const Header = struct {
+    name: []const u8,
+    value: []const u8,
+};
+
+/// Only the parts given are checked
+pub const Expectation = struct {
+    status: ?u16 = null,
+    /// Compared byte for byte, or as JSON documents when both sides are JSON
+    body: ?[]const u8 = null,
+    /// Header names are compared case-insensitively, values exactly
+    headers: []const Header = &.{},
+};
+
+pub const Summary = struct {
+    passed: usize = 0,
+    failed: usize = 0,
+};
+
+/// Parse a YAML list of cases:
+///
+///     - name: "lists users"
+///       request:
+///         method: get
+///         path: "/api/users?page=2"
+///         headers: { Accept: "application/json" }
+///       expect:
+///         status: 200
+///         body: '[]'
+///
+/// Everything is allocated in `arena`.
+pub fn parseCases(arena: std.mem.Allocator, source: []const u8) ![]Case {
+    var document: yaml.Yaml = .{ .source = source };
+    document.load(arena) catch |err| switch (err) {
+        error.ParseFailure => {
+            std.log.err("Test cases are not valid YAML", .{});
+            return error.InvalidTestCases;
+        },
+        else => return err,
+    };
+    if (document.docs.items.len == 0) return &.{};
+    const items = switch (document.docs.items[0]) {
+        .list => |list| list,
+        .empty => return &.{},
+        else => {
+            std.log.err("Expected the test cases to be a list", .{});
+            return error.InvalidTestCases;
+        },
+    };
+
+    const cases = try arena.alloc(Case, items.len);
+    for (items, cases, 1..) |item, *case, number| {
+        case.* = try parseCase(arena, item, number);
+    }
+    return cases;
+}
+
+fn parseCase(arena: std.mem.Allocator, item: yaml.Value, number: usize) !Case {
+    if (item != .map) {
+        std.log.err("Test case {d}: expected a map with request and expect", .{number});
+        return error.InvalidTestCases;
+    }
+    const request_map = switch (item.map.get("request") orelse .empty) {
+        .map => |map| map,
+        else => {
+            std.log.err("Test case {d}: expected a request map with a path", .{number});
+            return error.InvalidTestCases;
+        },
+    };
+    const target = try scalar(request_map.get("path"), "request path", number) orelse {
+        std.log.err("Test case {d}: request needs a path", .{number});
+        return error.InvalidTestCases;
+    };
+
+    var case = Case{ .name = "", .path = target };
+    if (std.mem.indexOfScalar(u8, target, '?')) |question| {
+        case.path = target[0..question];
+        case.query = target[question + 1 ..];
+    }
+    const method_text = try scalar(request_map.get("method") orelse request_map.get("verb"), "request method", number);
+    if (method_text) |text| {
+        case.method = interfaces.Method.fromString(text) orelse {
+            std.log.err("Test case {d}: unknown method '{s}'", .{ number, text });
+            return error.InvalidTestCases;
+        };
+    }
+    if (request_map.get("headers")) |headers| case.headers = try parseHeaders(arena, headers, number);
+    if (try scalar(request_map.get("body"), "request body", number)) |body| case.body = body;
+
+    case.name = try scalar(item.map.get("name"), "name", number) orelse
+        try std.fmt.allocPrint(arena, "{s} {s}", .{ case.method.toString(), target });
+
+    if (item.map.get("expect")) |expect_value| {
+        const expect_map = switch (expect_value) {
+            .map => |map| map,
+            else => {
+                std.log.err("Test case {d}: expected expect to be a map", .{number});
+                return error.InvalidTestCases;
+            },
+        };
+        if (expect_map.get("status")) |status| {
+            case.expect.status = switch (status) {
+                .int => |code| std.math.cast(u16, code),
+                .string => |text| std.fmt.parseInt(u16, text, 10) catch null,
+                else => null,
+            } orelse {
+                std.log.err("Test case {d}: expect status must be a number", .{number});
+                return error.InvalidTestCases;
+            };
+        }
+        case.expect.body = try scalar(expect_map.get("body"), "expect body", number);
+        if (expect_map.get("headers")) |headers| case.expect.headers = try parseHeaders(arena, headers, number);
+    }
+    return case;
+}
+
+/// A string, with bare numbers and booleans taken as written
+fn scalar(value: ?yaml.Value, field_name: []const u8, number: usize) !?[]const u8 {
+    return switch (value orelse return null) {
+        .string => |text| text,
+        .empty => "",
+        else => {
+            std.log.err("Test case {d}: expected {s} to be a string", .{ number, field_name });
+            return error.InvalidTestCases;
+        },
+    };
+}
+
+fn parseHeaders(arena: std.mem.Allocator, value: yaml.Value, number: usize) ![]const Header {
+    if (value != .map) {
+        std.log.err("Test case {d}: expected headers to be a map", .{number});
+        return error.InvalidTestCases;
+    }
+    var headers = std.ArrayList(Header).init(arena);
+    var iter = value.map.iterator();
+    while (iter.next()) |entry| {
+        const header_value = try scalar(entry.value_ptr.*, "header value", number) orelse "";
+        try headers.append(.{ .name = entry.key_ptr.*, .value = header_value });
+    }
+    return headers.items;
+}
+
+/// Send each case through `popshop_app` in memory and write a PASS or
+/// FAIL line per case to `writer`, followed by what differed
+pub fn run(allocator: std.mem.Allocator, popshop_app: *PopshopApp, cases: []const Case, writer: anytype) !Summary {
+    var summary = Summary{};
+    for (cases) |*case| {
+        var arena = std.heap.ArenaAllocator.init(allocator);
+        defer arena.deinit();
+
+        var request = Request{
+            .method = case.method,
+            .path = case.path,
+            .query = case.query,
+            .headers = interfaces.HeaderMap.init(arena.allocator()),
+            .body = case.body,
+            .arena = arena.allocator(),
+        };
+        for (case.headers) |header| try request.headers.put(header.name, header.value);
+        // Delays aren't waited out; only the response itself is checked
+        var response = try popshop_app.handleRequestWithContext(&request);
+        response.finish();
+
+        var differences = std.ArrayList(u8).init(arena.allocator());
+        try writeDifferences(arena.allocator(), differences.writer(), &case.expect, &response);
+        if (differences.items.len == 0) {
+            summary.passed += 1;
+            try writer.print("PASS {s}\n", .{case.name});
+        } else {
+            summary.failed += 1;
+            try writer.print("FAIL {s}\n{s}", .{ case.name, differences.items });
+        }
+    }
+    try writer.print("\n{d} passed, {d} failed\n", .{ summary.passed, summary.failed });
+    return summary;
+}
+
+/// A line per expectation `response` misses, e.g. `  status: expected 200, got 404`
+fn writeDifferences(arena: std.mem.Allocator, writer: anytype, expect: *const Expectation, response: *const Response) !void {
+    const status = @intFromEnum(response.status);
+    if (expect.status) |expected| {
+        if (expected != status) try writer.print("  status: expected {d}, got {d}\n", .{ expected, status });
+    }
+    for (expect.headers) |header| {
+        const actual = response.getHeader(header.name);
+        if (actual != null and std.mem.eql(u8, actual.?, header.value)) continue;
+        try writer.print("  header {s}: expected ", .{header.name});
+        try std.json.encodeJsonString(header.value, .{}, writer);
+        if (actual) |text| {
+            try writer.writeAll(", got ");
+            try std.json.encodeJsonString(text, .{}, writer);
+            try writer.writeByte('\n');
+        } else {
+            try writer.writeAll(", got none\n");
+        }
+    }
+    if (expect.body) |expected| {
+        if (!verifier.sameBody(arena, expected, response.body)) {
+            try writer.writeAll("  body: expected ");
+            try std.json.encodeJsonString(expected, .{}, writer);
+            try writer.writeAll("\n        got ");
+            try std.json.encodeJsonString(response.body, .{}, writer);
+            try writer.writeByte('\n');
+        }
+    }
+}
+
+/// A server that never listens, for running cases through the app in memory
+pub fn offlineServer() Server {
+    return Server{
+        .ptr = &offline_state,
+        .vtable = &.{
+            .start = offlineStart,
+            .stop = offlineStop,
+            .addRoute = offlineAddRoute,
+            .addMiddleware = offlineAddMiddleware,
+        },
+    };
+}
+
+var offline_state: u8 = 0;
+
+fn offlineStart(_: *anyopaque, _: interfaces.ServerConfig) !void {}
+
+fn offlineStop(_: *anyopaque) !void {}
+
+fn offlineAddRoute(_: *anyopaque, _: interfaces.Method, _: []const u8, _: interfaces.HandlerFn) !void {}
+
+fn offlineAddMiddleware(_: *anyopaque, _: interfaces.MiddlewareFn) !void {}
+
+test "run reports passing and failing cases" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    const app_config = try Config.loadFromYaml(allocator,
+        \\- request:
+        \\    path: "/api/users"
+        \\    method: get
+        \\  response:
+        \\    headers:
+        \\      Content-Type: "application/json"
+        \\    body: '[{"id": 1}]'
+        \\- request:
+        \\    path: "/api/users"
+        \\    method: post
+        \\  response:
+        \\    status: 201
+    );
+    var popshop_app = PopshopApp.init(allocator, offlineServer(), app_config);
+    defer popshop_app.deinit();
+
+    const cases = try parseCases(arena.allocator(),
+        \\- name: "lists users"
+        \\  request:
+        \\    path: "/api/users?page=2"
+        \\  expect:
+        \\    status: 200
+        \\    headers:
+        \\      content-type: "application/json"
+        \\    body: '[{"id":1}]'
+        \\- request:
+        \\    verb: post
+        \\    path: "/api/users"
+        \\    headers:
+        \\      Content-Type: "application/json"
+        \\    body: '{"name": "Ada"}'
+        \\  expect:
+        \\    status: 200
+        \\    body: "created"
+    );
+    try std.testing.expectEqual(@as(usize, 2), cases.len);
+    try std.testing.expectEqualStrings("/api/users", cases[0].path);
+    try std.testing.expectEqualStrings("page=2", cases[0].query);
+    try std.testing.expectEqualStrings("POST /api/users", cases[1].name);
+
+    var out = std.ArrayList(u8).init(allocator);
+    defer out.deinit();
+    const summary = try run(allocator, &popshop_app, cases, out.writer());
+    try std.testing.expectEqual(@as(usize, 1), summary.passed);
+    try std.testing.expectEqual(@as(usize, 1), summary.failed);
+    try std.testing.expectEqualStrings(
+        \\PASS lists users
+        \\FAIL POST /api/users
+        \\  status: expected 200, got 201
+        \\  body: expected "created"
+        \\        got ""
+        \\
+        \\1 passed, 1 failed
+        \\
+    , out.items);
+}
@@ -0,0 +1,171 @@
+const std = @import("std");
+
+/// Response sequence positions kept in a JSON file, so that with
+/// `state_file:` a sequence carries on where it left off after a restart.
+/// The file maps a key per rule to the requests it has served, e.g.
+/// `{"GET /api/items": 2}`. Safe to use from several threads, but only one
+/// server should use a given file at a time.
+pub const StateStore = struct {
+    allocator: std.mem.Allocator,
+    path: []const u8,
+    /// Insertion-ordered, so the file keeps a stable layout between writes
+    counts: std.StringArrayHashMap(u64),
+    mutex: std.Thread.Mutex = .{},
+
+    /// Larger files aren't state files popshop wrote
+    pub const max_file_size = 1024 * 1024;
+
+    /// Load the counts saved in `path`. A missing file starts from zero, and
+    /// so does an unreadable or corrupt one, after a warning.
+    pub fn init(allocator: std.mem.Allocator, path: []const u8) !StateStore {
+        var store = StateStore{
+            .allocator = allocator,
+            .path = try allocator.dupe(u8, path),
+            .counts = std.StringArrayHashMap(u64).init(allocator),
+        };
+        errdefer store.deinit();
+
+        store.load() catch |err| switch (err) {
+            error.OutOfMemory => return err,
+            else => {
+                std.log.warn("Ignoring state file {s} and starting from zero: {}", .{ path, err });
+                store.clearCounts();
+            },
+        };
+        return store;
+    }
+
+    pub fn deinit(self: *StateStore) void {
+        self.clearCounts();
+        self.counts.deinit();
+        self.allocator.free(self.path);
+    }
+
+    fn load(self: *StateStore) !void {
+        const content = std.fs.cwd().readFileAlloc(self.allocator, self.path, max_file_size) catch |err| switch (err) {
+            error.FileNotFound => return,
+            else => return err,
+        };
+        defer self.allocator.free(content);
+
+        const parsed = try std.json.parseFromSlice(std.json.Value, self.allocator, content, .{});
+        defer parsed.deinit();
+        if (parsed.value != .object) return error.InvalidStateFile;
+
+        var iter = parsed.value.object.iterator();
+        while (iter.next()) |entry| {
+            const count = switch (entry.value_ptr.*) {
+                .integer => |i| std.math.cast(u64, i) orelse return error.InvalidStateFile,
+                else => return error.InvalidStateFile,
+            };
+            const key = try self.allocator.dupe(u8, entry.key_ptr.*);
+            errdefer self.allocator.free(key);
+            try self.counts.put(key, count);
+        }
+    }
+
+    fn clearCounts(self: *StateStore) void {
+        for (self.counts.keys()) |key| {
+            self.allocator.free(key);
+        }
+        self.counts.clearRetainingCapacity();
+    }
+
+    /// Claim the next position for `key`, which is the number of earlier
+    /// claims. The new count is written out before this returns; a failed
+    /// write is logged and the count kept in memory.
+    pub fn next(self: *StateStore, key: []const u8) !u64 {
+        self.mutex.lock();
+        defer self.mutex.unlock();
+
+        if (!self.counts.contains(key)) {
+            const owned_key = try self.allocator.dupe(u8, key);
+            errdefer self.allocator.free(owned_key);
+            try self.counts.put(owned_key, 0);
+        }
+        const count = self.counts.getPtr(key).?;
+        const position = count.*;
+        count.* += 1;
+
+        self.save() catch |err| {
+            std.log.warn("Failed to write state file {s}: {}", .{ self.path, err });
+        };
+        return position;
+    }
+
+    /// Forget every count, in the file too
+    pub fn reset(self: *StateStore) !void {
+        self.mutex.lock();
+        defer self.mutex.unlock();
+
+        self.clearCounts();
+        try self.save();
+    }
+
+    /// Replace the file in one step, so a crash mid-write leaves the
+    /// previous counts rather than a truncated file
+    fn save(self: *StateStore) !void {
+        var content = std.ArrayList(u8).init(self.allocator);
+        defer content.deinit();
+
+        var writer = std.json.writeStream(content.writer(), .{ .whitespace = .indent_2 });
+        try writer.beginObject();
+        for (self.counts.keys(), self.counts.values()) |key, count| {
+            try writer.objectField(key);
+            try writer.write(count);
+        }
+        try writer.endObject();
+        try content.append('\n');
+
+        var file = try std.fs.cwd().atomicFile(self.path, .{});
+        defer file.deinit();
+        try file.file.writeAll(content.items);
+        try file.finish();
+    }
+};
+
+test "StateStore survives a restart" {
+    const allocator = std.testing.allocator;
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+    const path = try std.fs.path.join(allocator, &.{ dir_path, "state.json" });
+    defer allocator.free(path);
+
+    {
+        var store = try StateStore.init(allocator, path);
+        defer store.deinit();
+        try std.testing.expectEqual(@as(u64, 0), try store.next("POST /api/users"));
+        try std.testing.expectEqual(@as(u64, 1), try store.next("POST /api/users"));
+        try std.testing.expectEqual(@as(u64, 0), try store.next("GET /api/items"));
+    }
+
+    var restarted = try StateStore.init(allocator, path);
+    defer restarted.deinit();
+    try std.testing.expectEqual(@as(u64, 2), try restarted.next("POST /api/users"));
+    try std.testing.expectEqual(@as(u64, 1), try restarted.next("GET /api/items"));
+
+    try restarted.reset();
+    try std.testing.expectEqual(@as(u64, 0), try restarted.next("POST /api/users"));
+}
+
+test "StateStore starts over from a corrupt file" {
+    const allocator = std.testing.allocator;
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    try tmp.dir.writeFile(.{ .sub_path = "state.json", .data = "{\"GET /a\": 3, \"GET /b\": " });
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+    const path = try std.fs.path.join(allocator, &.{ dir_path, "state.json" });
+    defer allocator.free(path);
+
+    var store = try StateStore.init(allocator, path);
+    defer store.deinit();
+    try std.testing.expectEqual(@as(u64, 0), try store.next("GET /a"));
+
+    // The next write replaces the corrupt file with a valid one
+    const content = try tmp.dir.readFileAlloc(allocator, "state.json", StateStore.max_file_size);
+    defer allocator.free(content);
+    try std.testing.expectEqualStrings("{\n  \"GET /a\": 1\n}\n", content);
+}
@@ -0,0 +1,268 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+const config = @import("config.zig");
+const FileCache = @import("file_cache.zig").FileCache;
+
+const Request = interfaces.Request;
+const Response = interfaces.Response;
+const StaticFiles = config.StaticFiles;
+
+/// Content types by file extension; anything else is application/octet-stream
+const content_types = [_]struct { extension: []const u8, content_type: []const u8 }{
+    .{ .extension = ".html", .content_type = "text/html; charset=utf-8" },
+    .{ .extension = ".htm", .content_type = "text/html; charset=utf-8" },
+    .{ .extension = ".css", .content_type = "text/css; charset=utf-8" },
+    .{ .extension = ".js", .content_type = "text/javascript; charset=utf-8" },
+    .{ .extension = ".mjs", .content_type = "text/javascript; charset=utf-8" },
+    .{ .extension = ".json", .content_type = "application/json" },
+    .{ .extension = ".map", .content_type = "application/json" },
+    .{ .extension = ".txt", .content_type = "text/plain; charset=utf-8" },
+    .{ .extension = ".xml", .content_type = "application/xml" },
+    .{ .extension = ".svg", .content_type = "image/svg+xml" },
+    .{ .extension = ".png", .content_type = "image/png" },
+    .{ .extension = ".jpg", .content_type = "image/jpeg" },
+    .{ .extension = ".jpeg", .content_type = "image/jpeg" },
+    .{ .extension = ".gif", .content_type = "image/gif" },
+    .{ .extension = ".webp", .content_type = "image/webp" },
+    .{ .extension = ".ico", .content_type = "image/x-icon" },
+    .{ .extension = ".woff", .content_type = "font/woff" },
+    .{ .extension = ".woff2", .content_type = "font/woff2" },
+    .{ .extension = ".wasm", .content_type = "application/wasm" },
+    .{ .extension = ".pdf", .content_type = "application/pdf" },
+};
+
+pub fn contentType(name: []const u8) []const u8 {
+    const extension = std.fs.path.extension(name);
+    for (content_types) |entry| {
+        if (std.ascii.eqlIgnoreCase(extension, entry.extension)) return entry.content_type;
+    }
+    return "application/octet-stream";
+}
+
+/// `path` when it stays inside the directory it is relative to: no `..`
+/// segments, backslashes or NUL bytes, and not absolute. Empty segments
+/// are harmless and left in.
+pub fn safePath(path: []const u8) ?[]const u8 {
+    if (std.fs.path.isAbsolute(path)) return null;
+    if (std.mem.indexOfAny(u8, path, "\\\x00") != null) return null;
+    var segments = std.mem.tokenizeScalar(u8, path, '/');
+    while (segments.next()) |segment| {
+        if (std.mem.eql(u8, segment, "..")) return null;
+    }
+    return path;
+}
+
+/// Serve the file `request` names under `prefix` from `static.dir`.
+/// A directory serves its index.html, or a listing when `static.listing`
+/// is set. A path naming nothing serves `static.index` when there is one,
+/// and is a 404 otherwise, as are paths that try to climb out of the
+/// directory.
+pub fn respond(request: *const Request, prefix: []const u8, static: *const StaticFiles) !Response {
+    const arena = request.arena;
+    const rest = if (request.path.len > prefix.len) request.path[prefix.len..] else "";
+    const decoded = try percentDecode(arena, std.mem.trimLeft(u8, rest, "/"));
+    const relative = safePath(decoded) orelse return notFound(request);
+
+    var dir = std.fs.cwd().openDir(static.dir, .{ .iterate = static.listing }) catch |err| {
+        std.log.warn("Failed to open static dir {s}: {}", .{ static.dir, err });
+        return notFound(request);
+    };
+    defer dir.close();
+
+    const target = if (std.mem.trim(u8, relative, "/").len == 0) "." else std.mem.trim(u8, relative, "/");
+    const stat = dir.statFile(target) catch |err| switch (err) {
+        error.FileNotFound, error.NotDir => return fallback(request, dir, static),
+        else => return err,
+    };
+    if (stat.kind == .directory) {
+        const index_path = try std.fs.path.join(arena, &.{ target, "index.html" });
+        if (try readFile(arena, dir, index_path)) |body| return fileResponse(request, index_path, body);
+        if (static.listing) return listing(request, dir, target);
+        return fallback(request, dir, static);
+    }
+    const body = try readFile(arena, dir, target) orelse return fallback(request, dir, static);
+    return fileResponse(request, target, body);
+}
+
+/// The SPA `index` for a path that names no file, else a 404
+fn fallback(request: *const Request, dir: std.fs.Dir, static: *const StaticFiles) !Response {
+    const index = static.index orelse return notFound(request);
+    const body = try readFile(request.arena, dir, index) orelse {
+        std.log.warn("Static index {s} is missing from {s}", .{ index, static.dir });
+        return notFound(request);
+    };
+    return fileResponse(request, index, body);
+}
+
+fn readFile(arena: std.mem.Allocator, dir: std.fs.Dir, path: []const u8) !?[]const u8 {
+    return dir.readFileAlloc(arena, path, FileCache.max_file_size) catch |err| switch (err) {
+        error.FileNotFound, error.IsDir, error.NotDir => null,
+        else => err,
+    };
+}
+
+fn fileResponse(request: *const Request, name: []const u8, body: []const u8) !Response {
+    var response = Response.init(request.arena, .ok);
+    try response.setHeader("Content-Type", contentType(name));
+    response.setBody(body);
+    return response;
+}
+
+fn notFound(request: *const Request) Response {
+    var response = Response.init(request.arena, .not_found);
+    response.setBody("File not found");
+    return response;
+}
+
+/// An HTML page linking each entry of the directory, sorted by name
+fn listing(request: *const Request, dir: std.fs.Dir, target: []const u8) !Response {
+    const arena = request.arena;
+    var sub_dir = try dir.openDir(target, .{ .iterate = true });
+    defer sub_dir.close();
+
+    var names = std.ArrayList([]const u8).init(arena);
+    var iter = sub_dir.iterate();
+    while (try iter.next()) |entry| {
+        const suffix = if (entry.kind == .directory) "/" else "";
+        try names.append(try std.fmt.allocPrint(arena, "{s}{s}", .{ entry.name, suffix }));
+    }
+    std.mem.sort([]const u8, names.items, {}, struct {
+        fn lessThan(_: void, a: []const u8, b: []const u8) bool {
+            return std.mem.lessThan(u8, a, b);
+        }
+    }.lessThan);
+
+    var body = std.ArrayList(u8).init(arena);
+    const writer = body.writer();
+    try writer.writeAll("<!doctype html>\n<ul>\n");
+    for (names.items) |name| {
+        try writer.writeAll("<li><a href=\"");
+        try writeHtmlEscaped(writer, name);
+        try writer.writeAll("\">");
+        try writeHtmlEscaped(writer, name);
+        try writer.writeAll("</a></li>\n");
+    }
+    try writer.writeAll("</ul>\n");
+
+    var response = Response.init(arena, .ok);
+    try response.setHeader("Content-Type", "text/html; charset=utf-8");
+    response.setBody(body.items);
+    return response;
+}
+
+fn writeHtmlEscaped(writer: anytype, text: []const u8) !void {
+    for (text) |c| {
+        switch (c) {
+            '&' => try writer.writeAll("&amp;"),
+            '<' => try writer.writeAll("&lt;"),
+            '>' => try writer.writeAll("&gt;"),
+            '"' => try writer.writeAll("&quot;"),
+            else => try writer.writeByte(c),
+        }
+    }
+}
+
+/// `%2e%2e` and friends decoded, so they are checked like the characters
+/// they stand for. Invalid escapes are kept as they are.
+fn percentDecode(arena: std.mem.Allocator, text: []const u8) ![]const u8 {
+    if (std.mem.indexOfScalar(u8, text, '%') == null) return text;
+    var out = try std.ArrayList(u8).initCapacity(arena, text.len);
+    var index: usize = 0;
+    while (index < text.len) : (index += 1) {
+        if (text[index] == '%' and index + 2 < text.len) {
+            if (std.fmt.parseInt(u8, text[index + 1 .. index + 3], 16)) |byte| {
+                try out.append(byte);
+                index += 2;
+                continue;
+            } else |_| {}
+        }
+        try out.append(text[index]);
+    }
+    return out.items;
+}
+
+test "safePath" {
+    try std.testing.expectEqualStrings("css/app.css", safePath("css/app.css").?);
+    try std.testing.expect(safePath("../secret.txt") == null);
+    try std.testing.expect(safePath("assets/../../secret.txt") == null);
+    try std.testing.expect(safePath("/etc/passwd") == null);
+    try std.testing.expect(safePath("a\\..\\b") == null);
+    // Dots inside a name are fine
+    try std.testing.expectEqualStrings("notes..txt", safePath("notes..txt").?);
+}
+
+test "respond serves files, directory indexes and the SPA fallback" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    try tmp.dir.makePath("site/css");
+    try tmp.dir.writeFile(.{ .sub_path = "site/index.html", .data = "<h1>app</h1>" });
+    try tmp.dir.writeFile(.{ .sub_path = "site/css/app.css", .data = "body{}" });
+    try tmp.dir.writeFile(.{ .sub_path = "secret.txt", .data = "hunter2" });
+    const dir_path = try tmp.dir.realpathAlloc(arena.allocator(), "site");
+
+    var static = StaticFiles{ .dir = dir_path };
+    var request = Request{
+        .method = .GET,
+        .path = "/app/css/app.css",
+        .query = "",
+        .headers = interfaces.HeaderMap.init(arena.allocator()),
+        .body = "",
+        .arena = arena.allocator(),
+    };
+
+    var response = try respond(&request, "/app", &static);
+    try std.testing.expectEqual(interfaces.Status.ok, response.status);
+    try std.testing.expectEqualStrings("body{}", response.body);
+    try std.testing.expectEqualStrings("text/css; charset=utf-8", response.getHeader("Content-Type").?);
+
+    // The prefix itself serves the directory's index.html
+    request.path = "/app/";
+    try std.testing.expectEqualStrings("<h1>app</h1>", (try respond(&request, "/app", &static)).body);
+
+    // Client-side routes are 404s until there's an index to fall back on
+    request.path = "/app/users/7";
+    try std.testing.expectEqual(interfaces.Status.not_found, (try respond(&request, "/app", &static)).status);
+    static.index = "index.html";
+    response = try respond(&request, "/app", &static);
+    try std.testing.expectEqual(interfaces.Status.ok, response.status);
+    try std.testing.expectEqualStrings("<h1>app</h1>", response.body);
+
+    // Nothing outside the directory is reachable, encoded or not
+    for ([_][]const u8{ "/app/../secret.txt", "/app/%2e%2e/secret.txt", "/app/css/%2E%2E/%2e%2e/secret.txt" }) |path| {
+        request.path = path;
+        try std.testing.expectEqual(interfaces.Status.not_found, (try respond(&request, "/app", &static)).status);
+    }
+}
+
+test "respond lists directories only when asked" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    try tmp.dir.makePath("files/docs");
+    try tmp.dir.writeFile(.{ .sub_path = "files/a&b.txt", .data = "x" });
+    const dir_path = try tmp.dir.realpathAlloc(arena.allocator(), "files");
+
+    var static = StaticFiles{ .dir = dir_path };
+    const request = Request{
+        .method = .GET,
+        .path = "/files",
+        .query = "",
+        .headers = interfaces.HeaderMap.init(arena.allocator()),
+        .body = "",
+        .arena = arena.allocator(),
+    };
+    try std.testing.expectEqual(interfaces.Status.not_found, (try respond(&request, "/files", &static)).status);
+
+    static.listing = true;
+    const response = try respond(&request, "/files", &static);
+    try std.testing.expectEqual(interfaces.Status.ok, response.status);
+    try std.testing.expect(std.mem.indexOf(u8, response.body, "<a href=\"a&amp;b.txt\">") != null);
+    try std.testing.expect(std.mem.indexOf(u8, response.body, "<a href=\"docs/\">") != null);
+}
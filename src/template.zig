@@ -0,0 +1,783 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+const kv_store = @import("kv_store.zig");
+
+const Request = interfaces.Request;
+const HeaderMap = interfaces.HeaderMap;
+const KvStore = kv_store.KvStore;
+
+/// Data available to response templates
+pub const Context = struct {
+    request: *const Request,
+    /// Path parameters captured by the matched rule
+    params: ?*const std.StringHashMap([]const u8) = null,
+    /// `path_regex` groups, with the whole match at index 0
+    matches: ?[]const ?[]const u8 = null,
+    /// `body_regex` groups, likewise
+    body_matches: ?[]const ?[]const u8 = null,
+    /// What the rule path's `*` matched
+    wildcard: ?[]const u8 = null,
+    /// Source for `uuid` and `randInt`; the OS CSPRNG when null
+    random: ?std.Random = null,
+    /// Milliseconds since the epoch that `now` renders; the clock when null
+    now_ms: ?i64 = null,
+    /// Variables `env` reads; the process environment when null
+    env: ?*const std.process.EnvMap = null,
+    /// The config's `vars:`
+    vars: ?*const std.StringHashMap([]const u8) = null,
+    /// What `store` writes and `load` reads; both do nothing when null
+    store: ?*KvStore = null,
+};
+
+/// Details about a failed render
+pub const Diagnostic = struct {
+    message: []const u8 = "",
+};
+
+pub const Error = error{
+    UnclosedAction,
+    UnknownField,
+} || std.mem.Allocator.Error;
+
+/// Whether the text contains any template actions
+pub fn hasActions(source: []const u8) bool {
+    return std.mem.indexOf(u8, source, "{{") != null;
+}
+
+/// Render a template against the request context. Supported actions:
+/// - `{{.Params.name}}`  path parameter captured by the rule path
+/// - `{{.Wildcard}}`     rest of the path matched by a trailing `*`
+/// - `{{.Query.name}}`   first value of a decoded query parameter
+/// - `{{.QueryAll.name}}` every value of a query parameter, as a JSON
+///   array of strings
+/// - `{{.Headers.Name}}` request header, name is case-insensitive
+/// - `{{.Cookies.name}}` decoded cookie value
+/// - `{{.Body}}`         raw request body
+/// - `{{.Method}}`       request method, e.g. `GET`
+/// - `{{.Path}}`         request path, without the query string
+/// - `{{.RawQuery}}`     query string as sent, without the `?`
+/// - `{{.URL}}`          path and query string, as in the request line
+/// - `{{.Parts}}`        names of the multipart parts, comma-separated
+/// - `{{.Multipart.name}}` contents of a multipart part
+/// - `{{.Files.name.filename}}` upload's filename, also `.size` in bytes
+///   and `.content_type`
+/// - `{{index .Matches 1}}` capture group of the rule's `path_regex`
+/// - `{{index .BodyMatches 1}}` capture group of the rule's `body_regex`
+/// - `{{.Vars.name}}`    value from the config's `vars:`
+/// - `{{range .QueryAll.name ","}}...{{end}}` the text up to `end` once
+///   per value of a query parameter, with `{{.}}` the value and the
+///   optional "separator" between repeats
+/// - `{{now}}`           current time as an RFC 3339 UTC timestamp
+/// - `{{uuid}}`          random version 4 UUID
+/// - `{{randInt 1 100}}` random integer, min inclusive and max exclusive
+/// - `{{env "NAME"}}`    environment variable
+/// - `{{jsonEscape .Body}}` a field or "string" escaped for a JSON string
+/// - `{{store "key" .Body}}` save a field or "string" under a key, which
+///   may be a field too; renders nothing
+/// - `{{load "key"}}`    value saved under a key, by this or an earlier request
+/// Missing values render as an empty string. On failure the diagnostic,
+/// if given, receives a message allocated with `allocator`.
+pub fn render(allocator: std.mem.Allocator, source: []const u8, ctx: *const Context, diagnostic: ?*Diagnostic) Error![]u8 {
+    var out = std.ArrayList(u8).init(allocator);
+    errdefer out.deinit();
+
+    var walker = Walker{ .allocator = allocator, .source = source, .rest = source, .ctx = ctx, .diagnostic = diagnostic };
+    try walker.block(&out, null);
+    return out.toOwnedSlice();
+}
+
+/// Check a template's actions without rendering it, so syntax errors and
+/// unknown fields are caught before any request arrives
+pub fn check(allocator: std.mem.Allocator, source: []const u8, diagnostic: ?*Diagnostic) Error!void {
+    var walker = Walker{ .allocator = allocator, .source = source, .rest = source, .ctx = null, .diagnostic = diagnostic };
+    try walker.block(null, null);
+}
+
+/// Steps through a template's text and actions, rendering into `out` or,
+/// without one, only parsing, which is how `check` works and how a range
+/// over no values is skipped
+const Walker = struct {
+    allocator: std.mem.Allocator,
+    source: []const u8,
+    rest: []const u8,
+    /// Null when only checking
+    ctx: ?*const Context,
+    diagnostic: ?*Diagnostic,
+    /// Ranges being walked; `end` and `{{.}}` only make sense inside one
+    depth: usize = 0,
+
+    /// Walk up to the end of the template, or past the `end` closing a
+    /// range when `current` is that range's value
+    fn block(self: *Walker, out: ?*std.ArrayList(u8), current: ?[]const u8) Error!void {
+        const in_range = self.depth > 0;
+        while (std.mem.indexOf(u8, self.rest, "{{")) |start| {
+            if (out) |o| try o.appendSlice(self.rest[0..start]);
+
+            const offset = self.source.len - self.rest.len + start;
+            const after = self.rest[start + 2 ..];
+            const end = std.mem.indexOf(u8, after, "}}") orelse {
+                return fail(self.allocator, self.diagnostic, error.UnclosedAction, "unclosed action at offset {d}", .{offset});
+            };
+            const text = std.mem.trim(u8, after[0..end], " \t");
+            self.rest = after[end + 2 ..];
+
+            const action = try parseAction(self.allocator, text, self.diagnostic);
+            switch (action) {
+                .end => {
+                    if (!in_range) return fail(self.allocator, self.diagnostic, error.UnknownField, "{{{{end}}}} at offset {d} closes no range", .{offset});
+                    return;
+                },
+                .dot => if (!in_range) return fail(self.allocator, self.diagnostic, error.UnknownField, "{{{{.}}}} at offset {d} is outside a range", .{offset}),
+                .range => |range_action| {
+                    try self.walkRange(out, range_action);
+                    continue;
+                },
+                else => {},
+            }
+            if (out) |o| try evalAction(self.allocator, o, action, self.ctx.?, current);
+        }
+        if (in_range) {
+            return fail(self.allocator, self.diagnostic, error.UnclosedAction, "range has no {{{{end}}}}", .{});
+        }
+        if (out) |o| try o.appendSlice(self.rest);
+        self.rest = "";
+    }
+
+    /// Walk the body of a range once per value, leaving `rest` after its `end`
+    fn walkRange(self: *Walker, out: ?*std.ArrayList(u8), action: RangeAction) Error!void {
+        self.depth += 1;
+        defer self.depth -= 1;
+
+        const body = self.rest;
+        var values = std.ArrayList([]const u8).init(self.allocator);
+        defer values.deinit();
+        if (out != null) try queryValues(&values, self.ctx.?.request, action.name);
+
+        // Without values the body is still walked once, to find its end
+        if (values.items.len == 0) return self.block(null, null);
+        for (values.items, 0..) |value, index| {
+            if (index > 0) try out.?.appendSlice(action.separator);
+            self.rest = body;
+            try self.block(out, value);
+        }
+    }
+};
+
+/// Every decoded value of query parameter `name`, in order
+fn queryValues(values: *std.ArrayList([]const u8), request: *const Request, name: []const u8) Error!void {
+    var query = request.queryParams();
+    while (try query.next()) |param| {
+        if (std.mem.eql(u8, param.name, name)) try values.append(param.value);
+    }
+}
+
+/// One `{{...}}` action, parsed
+const Action = union(enum) {
+    /// A field path such as `Query.name`, without the leading dot
+    field: []const u8,
+    /// `index .Matches N`
+    match: usize,
+    /// `index .BodyMatches N`
+    body_match: usize,
+    now,
+    uuid,
+    rand_int: struct { min: i64, max: i64 },
+    env: []const u8,
+    json_escape: Operand,
+    store: struct { key: Operand, value: Operand },
+    load: Operand,
+    /// `{{.}}`, the value of the range being rendered
+    dot,
+    range: RangeAction,
+    end,
+};
+
+/// `range .QueryAll.name "separator"`
+const RangeAction = struct {
+    /// The query parameter whose values are ranged over
+    name: []const u8,
+    separator: []const u8 = "",
+};
+
+/// A helper argument: a field path without the leading dot, or a string literal
+const Operand = union(enum) {
+    field: []const u8,
+    literal: []const u8,
+};
+
+/// Functions callable as `{{name arg...}}`
+const Helper = enum {
+    index,
+    now,
+    uuid,
+    randInt,
+    env,
+    jsonEscape,
+    store,
+    load,
+
+    fn arity(self: Helper) usize {
+        return switch (self) {
+            .now, .uuid => 0,
+            .env, .jsonEscape, .load => 1,
+            .index, .randInt, .store => 2,
+        };
+    }
+};
+
+fn parseAction(allocator: std.mem.Allocator, action: []const u8, diagnostic: ?*Diagnostic) Error!Action {
+    if (std.mem.eql(u8, action, ".")) return .dot;
+    if (std.mem.eql(u8, action, "end")) return .end;
+    if (std.mem.eql(u8, action, "range") or std.mem.startsWith(u8, action, "range ")) return parseRange(allocator, action, diagnostic);
+    if (action.len > 1 and action[0] == '.') {
+        if (!isKnownField(action[1..])) {
+            return fail(allocator, diagnostic, error.UnknownField, "unknown field '{s}'", .{action});
+        }
+        return .{ .field = action[1..] };
+    }
+
+    var words = Words{ .rest = action };
+    const name = words.next() orelse "";
+    const helper = std.meta.stringToEnum(Helper, name) orelse {
+        return fail(allocator, diagnostic, error.UnknownField, "unsupported action '{{{{{s}}}}}'", .{action});
+    };
+    var args: [2][]const u8 = undefined;
+    var count: usize = 0;
+    while (words.next()) |word| : (count += 1) {
+        if (count < args.len) args[count] = word;
+    }
+    if (count != helper.arity()) {
+        return fail(allocator, diagnostic, error.UnknownField, "{s} takes {d} argument(s) in '{{{{{s}}}}}'", .{ name, helper.arity(), action });
+    }
+
+    switch (helper) {
+        .index => {
+            const body = std.mem.eql(u8, args[0], ".BodyMatches");
+            if (!body and !std.mem.eql(u8, args[0], ".Matches")) {
+                return fail(allocator, diagnostic, error.UnknownField, "unsupported action '{{{{{s}}}}}'", .{action});
+            }
+            const index = std.fmt.parseInt(usize, args[1], 10) catch {
+                return fail(allocator, diagnostic, error.UnknownField, "invalid index '{s}' in '{{{{{s}}}}}'", .{ args[1], action });
+            };
+            return if (body) .{ .body_match = index } else .{ .match = index };
+        },
+        .now => return .now,
+        .uuid => return .uuid,
+        .randInt => {
+            var bounds: [2]i64 = undefined;
+            for (args, &bounds) |arg, *bound| {
+                bound.* = std.fmt.parseInt(i64, arg, 10) catch {
+                    return fail(allocator, diagnostic, error.UnknownField, "invalid number '{s}' in '{{{{{s}}}}}'", .{ arg, action });
+                };
+            }
+            if (bounds[0] >= bounds[1]) {
+                return fail(allocator, diagnostic, error.UnknownField, "randInt needs min below max in '{{{{{s}}}}}'", .{action});
+            }
+            return .{ .rand_int = .{ .min = bounds[0], .max = bounds[1] } };
+        },
+        .env => {
+            const variable = stringLiteral(args[0]) orelse {
+                return fail(allocator, diagnostic, error.UnknownField, "env takes a quoted variable name in '{{{{{s}}}}}'", .{action});
+            };
+            return .{ .env = variable };
+        },
+        .jsonEscape => {
+            const operand = parseOperand(args[0]) orelse {
+                return fail(allocator, diagnostic, error.UnknownField, "jsonEscape takes a field or a quoted string in '{{{{{s}}}}}'", .{action});
+            };
+            return .{ .json_escape = operand };
+        },
+        .store => {
+            var operands: [2]Operand = undefined;
+            for (args, &operands) |arg, *operand| {
+                operand.* = parseOperand(arg) orelse {
+                    return fail(allocator, diagnostic, error.UnknownField, "store takes a key and a value, each a field or a quoted string, in '{{{{{s}}}}}'", .{action});
+                };
+            }
+            return .{ .store = .{ .key = operands[0], .value = operands[1] } };
+        },
+        .load => {
+            const key = parseOperand(args[0]) orelse {
+                return fail(allocator, diagnostic, error.UnknownField, "load takes a field or a quoted key in '{{{{{s}}}}}'", .{action});
+            };
+            return .{ .load = key };
+        },
+    }
+}
+
+fn parseRange(allocator: std.mem.Allocator, action: []const u8, diagnostic: ?*Diagnostic) Error!Action {
+    var words = Words{ .rest = action["range".len..] };
+    const field = words.next() orelse "";
+    const separator = words.next();
+    const prefix = ".QueryAll.";
+    if (!std.mem.startsWith(u8, field, prefix) or field.len == prefix.len or words.next() != null) {
+        return fail(allocator, diagnostic, error.UnknownField, "range takes .QueryAll.name and an optional quoted separator in '{{{{{s}}}}}'", .{action});
+    }
+    var result = RangeAction{ .name = field[prefix.len..] };
+    if (separator) |word| {
+        result.separator = stringLiteral(word) orelse {
+            return fail(allocator, diagnostic, error.UnknownField, "range separator must be a quoted string in '{{{{{s}}}}}'", .{action});
+        };
+    }
+    return .{ .range = result };
+}
+
+/// A quoted string or a known field, as a helper argument
+fn parseOperand(word: []const u8) ?Operand {
+    if (stringLiteral(word)) |literal| return .{ .literal = literal };
+    if (word.len > 1 and word[0] == '.' and isKnownField(word[1..])) return .{ .field = word[1..] };
+    return null;
+}
+
+/// Splits an action on whitespace, keeping "quoted strings" whole
+const Words = struct {
+    rest: []const u8,
+
+    fn next(self: *Words) ?[]const u8 {
+        const text = std.mem.trimLeft(u8, self.rest, " \t");
+        if (text.len == 0) return null;
+        const end = if (text[0] == '"')
+            if (std.mem.indexOfScalarPos(u8, text, 1, '"')) |close| close + 1 else text.len
+        else
+            std.mem.indexOfAny(u8, text, " \t") orelse text.len;
+        self.rest = text[end..];
+        return text[0..end];
+    }
+};
+
+/// The contents of a double-quoted word; escapes aren't supported
+fn stringLiteral(word: []const u8) ?[]const u8 {
+    if (word.len < 2 or word[0] != '"' or word[word.len - 1] != '"') return null;
+    return word[1 .. word.len - 1];
+}
+
+/// `current` is the value of the range being rendered, if any
+fn evalAction(allocator: std.mem.Allocator, out: *std.ArrayList(u8), action: Action, ctx: *const Context, current: ?[]const u8) Error!void {
+    const random = ctx.random orelse std.crypto.random;
+    switch (action) {
+        .dot => try out.appendSlice(current orelse ""),
+        // The walker handles blocks itself
+        .range, .end => unreachable,
+        .field => |path| try out.appendSlice(try resolveField(path, ctx) orelse ""),
+        // A group that is out of range or did not participate renders empty
+        .match, .body_match => |index| {
+            const matches = (if (action == .match) ctx.matches else ctx.body_matches) orelse return;
+            if (index >= matches.len) return;
+            try out.appendSlice(matches[index] orelse return);
+        },
+        .now => try writeTimestamp(out.writer(), ctx.now_ms orelse std.time.milliTimestamp()),
+        .uuid => try writeUuid(out.writer(), random),
+        .rand_int => |range| try out.writer().print("{d}", .{random.intRangeLessThan(i64, range.min, range.max)}),
+        .env => |name| {
+            if (ctx.env) |env| {
+                try out.appendSlice(env.get(name) orelse "");
+                return;
+            }
+            const value = std.process.getEnvVarOwned(allocator, name) catch |err| switch (err) {
+                error.OutOfMemory => return error.OutOfMemory,
+                else => return,
+            };
+            defer allocator.free(value);
+            try out.appendSlice(value);
+        },
+        .json_escape => |operand| try std.json.encodeJsonStringChars(try resolveOperand(operand, ctx), .{}, out.writer()),
+        .store => |entry| {
+            const store = ctx.store orelse return;
+            try store.put(try resolveOperand(entry.key, ctx), try resolveOperand(entry.value, ctx));
+        },
+        .load => |key| {
+            const store = ctx.store orelse return;
+            const value = try store.get(allocator, try resolveOperand(key, ctx)) orelse return;
+            defer allocator.free(value);
+            try out.appendSlice(value);
+        },
+    }
+}
+
+/// A helper argument's text; a missing field is empty
+fn resolveOperand(operand: Operand, ctx: *const Context) Error![]const u8 {
+    return switch (operand) {
+        .field => |path| try resolveField(path, ctx) orelse "",
+        .literal => |literal| literal,
+    };
+}
+
+/// `2006-01-02T15:04:05Z` for a time in milliseconds since the epoch
+fn writeTimestamp(writer: anytype, ms: i64) !void {
+    const epoch_seconds = std.time.epoch.EpochSeconds{ .secs = @intCast(@max(0, @divFloor(ms, std.time.ms_per_s))) };
+    const year_day = epoch_seconds.getEpochDay().calculateYearDay();
+    const month_day = year_day.calculateMonthDay();
+    const day_seconds = epoch_seconds.getDaySeconds();
+    try writer.print("{d:0>4}-{d:0>2}-{d:0>2}T{d:0>2}:{d:0>2}:{d:0>2}Z", .{
+        year_day.year,
+        month_day.month.numeric(),
+        month_day.day_index + 1,
+        day_seconds.getHoursIntoDay(),
+        day_seconds.getMinutesIntoHour(),
+        day_seconds.getSecondsIntoMinute(),
+    });
+}
+
+/// A version 4 (random) UUID in its lowercase 8-4-4-4-12 form
+pub fn writeUuid(writer: anytype, random: std.Random) !void {
+    var bytes: [16]u8 = undefined;
+    random.bytes(&bytes);
+    bytes[6] = (bytes[6] & 0x0f) | 0x40;
+    bytes[8] = (bytes[8] & 0x3f) | 0x80;
+    const hex = std.fmt.bytesToHex(bytes, .lower);
+    try writer.print("{s}-{s}-{s}-{s}-{s}", .{ hex[0..8], hex[8..12], hex[12..16], hex[16..20], hex[20..32] });
+}
+
+/// Resolve a field path such as `Query.name` (without the leading dot)
+fn resolveField(path: []const u8, ctx: *const Context) Error!?[]const u8 {
+    const dot = std.mem.indexOfScalar(u8, path, '.');
+    const root = if (dot) |i| path[0..i] else path;
+    const key = if (dot) |i| path[i + 1 ..] else "";
+
+    if (std.mem.eql(u8, root, "Body") and key.len == 0) {
+        return ctx.request.body;
+    }
+    if (std.mem.eql(u8, root, "Method") and key.len == 0) {
+        return ctx.request.method.toString();
+    }
+    if (std.mem.eql(u8, root, "Path") and key.len == 0) {
+        return ctx.request.path;
+    }
+    if (std.mem.eql(u8, root, "RawQuery") and key.len == 0) {
+        return ctx.request.query;
+    }
+    if (std.mem.eql(u8, root, "URL") and key.len == 0) {
+        if (ctx.request.query.len == 0) return ctx.request.path;
+        return try std.fmt.allocPrint(ctx.request.arena, "{s}?{s}", .{ ctx.request.path, ctx.request.query });
+    }
+    if (std.mem.eql(u8, root, "Wildcard") and key.len == 0) {
+        return ctx.wildcard;
+    }
+    if (std.mem.eql(u8, root, "Parts") and key.len == 0) {
+        var names = std.ArrayList(u8).init(ctx.request.arena);
+        var parts = try ctx.request.multipartParts();
+        while (parts.next()) |part| {
+            if (names.items.len > 0) try names.appendSlice(", ");
+            try names.appendSlice(part.name);
+        }
+        return names.items;
+    }
+    if (key.len == 0) return null;
+
+    if (std.mem.eql(u8, root, "Params")) {
+        const params = ctx.params orelse return null;
+        return params.get(key);
+    }
+    if (std.mem.eql(u8, root, "Vars")) {
+        const vars = ctx.vars orelse return null;
+        return vars.get(key);
+    }
+    if (std.mem.eql(u8, root, "QueryAll")) {
+        var values = std.ArrayList([]const u8).init(ctx.request.arena);
+        try queryValues(&values, ctx.request, key);
+        return try std.json.stringifyAlloc(ctx.request.arena, values.items, .{});
+    }
+    if (std.mem.eql(u8, root, "Query")) {
+        var query = ctx.request.queryParams();
+        while (try query.next()) |param| {
+            if (std.mem.eql(u8, param.name, key)) return param.value;
+        }
+        return null;
+    }
+    if (std.mem.eql(u8, root, "Headers")) {
+        return ctx.request.getHeader(key);
+    }
+    if (std.mem.eql(u8, root, "Cookies")) {
+        return ctx.request.getCookie(key);
+    }
+    if (std.mem.eql(u8, root, "Multipart")) {
+        const part = (try ctx.request.getPart(key)) orelse return null;
+        return part.data;
+    }
+    if (std.mem.eql(u8, root, "Files")) {
+        // Part names may contain dots, so the attribute follows the last one
+        const attribute_dot = std.mem.lastIndexOfScalar(u8, key, '.') orelse return null;
+        const part = (try ctx.request.getPart(key[0..attribute_dot])) orelse return null;
+        const attribute = key[attribute_dot + 1 ..];
+        if (std.mem.eql(u8, attribute, "filename")) return part.filename;
+        if (std.mem.eql(u8, attribute, "content_type")) return part.content_type;
+        if (std.mem.eql(u8, attribute, "size")) return try std.fmt.allocPrint(ctx.request.arena, "{d}", .{part.data.len});
+        return null;
+    }
+    return null;
+}
+
+fn isKnownField(path: []const u8) bool {
+    const known_maps = [_][]const u8{ "Params.", "Query.", "QueryAll.", "Headers.", "Cookies.", "Multipart.", "Vars." };
+    for (known_maps) |prefix| {
+        if (std.mem.startsWith(u8, path, prefix) and path.len > prefix.len) return true;
+    }
+    if (std.mem.startsWith(u8, path, "Files.")) {
+        const attributes = [_][]const u8{ ".filename", ".size", ".content_type" };
+        for (attributes) |attribute| {
+            if (std.mem.endsWith(u8, path, attribute) and path.len > "Files.".len + attribute.len) return true;
+        }
+        return false;
+    }
+    const known_fields = [_][]const u8{ "Body", "Parts", "Wildcard", "Method", "Path", "RawQuery", "URL" };
+    for (known_fields) |field| {
+        if (std.mem.eql(u8, path, field)) return true;
+    }
+    return false;
+}
+
+fn fail(allocator: std.mem.Allocator, diagnostic: ?*Diagnostic, err: Error, comptime fmt: []const u8, args: anytype) Error {
+    if (diagnostic) |d| {
+        d.message = std.fmt.allocPrint(allocator, fmt, args) catch "";
+    }
+    return err;
+}
+
+fn testRequest(arena: std.mem.Allocator) !Request {
+    var headers = HeaderMap.init(arena);
+    try headers.put("x-request-id", "req-1");
+    try headers.put("cookie", "session=s%3A1; theme=dark");
+
+    return Request{
+        .method = .POST,
+        .path = "/users/42",
+        .query = "name=Jane+Doe&name=Other",
+        .headers = headers,
+        .body = "hello",
+        .arena = arena,
+    };
+}
+
+test "render request fields" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const allocator = arena.allocator();
+
+    const request = try testRequest(allocator);
+    var params = std.StringHashMap([]const u8).init(allocator);
+    try params.put("id", "42");
+
+    const ctx = Context{ .request = &request, .params = &params, .wildcard = "42/avatar.png" };
+    const output = try render(allocator,
+        \\{"id": "{{.Params.id}}", "name": "{{ .Query.name }}", "trace": "{{.Headers.X-Request-Id}}", "session": "{{.Cookies.session}}", "body": "{{.Body}}", "rest": "{{.Wildcard}}", "missing": "{{.Query.nope}}"}
+    , &ctx, null);
+
+    try std.testing.expectEqualStrings(
+        \\{"id": "42", "name": "Jane Doe", "trace": "req-1", "session": "s:1", "body": "hello", "rest": "42/avatar.png", "missing": ""}
+    , output);
+}
+
+test "render the request line" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const allocator = arena.allocator();
+
+    var request = try testRequest(allocator);
+    const ctx = Context{ .request = &request };
+    const output = try render(allocator, "{{.Method}} {{.URL}}|{{.Path}}|{{.RawQuery}}", &ctx, null);
+    try std.testing.expectEqualStrings("POST /users/42?name=Jane+Doe&name=Other|/users/42|name=Jane+Doe&name=Other", output);
+
+    // Without a query string the URL is just the path
+    request.query = "";
+    try std.testing.expectEqualStrings("/users/42|", try render(allocator, "{{.URL}}|{{.RawQuery}}", &ctx, null));
+}
+
+test "render vars" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const allocator = arena.allocator();
+
+    const request = try testRequest(allocator);
+    var vars = std.StringHashMap([]const u8).init(allocator);
+    try vars.put("baseURL", "https://api.example.com");
+
+    const ctx = Context{ .request = &request, .vars = &vars };
+    const output = try render(allocator, "{{.Vars.baseURL}}/users, {{.Vars.baseURL}}/orders{{.Vars.missing}}", &ctx, null);
+    try std.testing.expectEqualStrings("https://api.example.com/users, https://api.example.com/orders", output);
+
+    // No vars configured renders empty, like any missing value
+    const bare = Context{ .request = &request };
+    try std.testing.expectEqualStrings("", try render(allocator, "{{.Vars.baseURL}}", &bare, null));
+    try check(allocator, "{{.Vars.baseURL}}", null);
+}
+
+test "render multipart uploads" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const allocator = arena.allocator();
+
+    var request = try testRequest(allocator);
+    try request.headers.put("content-type", "multipart/form-data; boundary=----popshop");
+    request.body = "------popshop\r\n" ++
+        "Content-Disposition: form-data; name=\"caption\"\r\n" ++
+        "\r\n" ++
+        "Sunset\r\n" ++
+        "------popshop\r\n" ++
+        "Content-Disposition: form-data; name=\"photo.main\"; filename=\"sunset.png\"\r\n" ++
+        "Content-Type: image/png\r\n" ++
+        "\r\n" ++
+        "0123456789\r\n" ++
+        "------popshop--\r\n";
+
+    const ctx = Context{ .request = &request };
+    const output = try render(allocator, "{{.Parts}}|{{.Multipart.caption}}|{{.Files.photo.main.filename}}|{{.Files.photo.main.size}}|{{.Files.photo.main.content_type}}|{{.Files.caption.filename}}", &ctx, null);
+    try std.testing.expectEqualStrings("caption, photo.main|Sunset|sunset.png|10|image/png|", output);
+
+    var diagnostic = Diagnostic{};
+    try std.testing.expectError(error.UnknownField, check(allocator, "{{.Files.photo}}", &diagnostic));
+}
+
+test "render regex matches" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const allocator = arena.allocator();
+
+    const request = try testRequest(allocator);
+    const matches = [_]?[]const u8{ "/users/42", "42", null };
+    const body_matches = [_]?[]const u8{ "{\"order\": 7}", "7" };
+    const ctx = Context{ .request = &request, .matches = &matches, .body_matches = &body_matches };
+
+    const output = try render(allocator, "{{index .Matches 1}}|{{ index .Matches 2 }}|{{index .Matches 9}}", &ctx, null);
+    try std.testing.expectEqualStrings("42||", output);
+    try std.testing.expectEqualStrings("7|42", try render(allocator, "{{index .BodyMatches 1}}|{{index .Matches 1}}", &ctx, null));
+
+    var diagnostic = Diagnostic{};
+    try std.testing.expectError(error.UnknownField, render(allocator, "{{index .Query 1}}", &ctx, &diagnostic));
+    try std.testing.expectEqualStrings("unsupported action '{{index .Query 1}}'", diagnostic.message);
+}
+
+test "render repeated query parameters" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const allocator = arena.allocator();
+
+    var request = try testRequest(allocator);
+    request.query = "ids=1&ids=2&tag=a%20b&ids=3";
+    const ctx = Context{ .request = &request };
+
+    // .Query has the first value, .QueryAll every one
+    try std.testing.expectEqualStrings("1|[\"1\",\"2\",\"3\"]|[]", try render(allocator, "{{.Query.ids}}|{{.QueryAll.ids}}|{{.QueryAll.nope}}", &ctx, null));
+    try std.testing.expectEqualStrings(
+        \\[{"id": 1, "tag": "a b"}, {"id": 2, "tag": "a b"}, {"id": 3, "tag": "a b"}]
+    , try render(allocator,
+        \\[{{range .QueryAll.ids ", "}}{"id": {{.}}, "tag": "{{.Query.tag}}"}{{end}}]
+    , &ctx, null));
+
+    // Ranges nest, and one over no values renders nothing
+    try std.testing.expectEqualStrings("1:a b;2:a b;3:a b;|", try render(allocator, "{{range .QueryAll.ids}}{{.}}:{{range .QueryAll.tag}}{{.}}{{end}};{{end}}|{{range .QueryAll.nope}}x{{.}}{{end}}", &ctx, null));
+
+    var diagnostic = Diagnostic{};
+    try std.testing.expectError(error.UnclosedAction, check(allocator, "{{range .QueryAll.ids}}{{.}}", &diagnostic));
+    try std.testing.expectEqualStrings("range has no {{end}}", diagnostic.message);
+    try std.testing.expectError(error.UnknownField, check(allocator, "{{.Body}}{{end}}", &diagnostic));
+    try std.testing.expectEqualStrings("{{end}} at offset 9 closes no range", diagnostic.message);
+    try std.testing.expectError(error.UnknownField, check(allocator, "{{.}}", &diagnostic));
+    try std.testing.expectEqualStrings("{{.}} at offset 0 is outside a range", diagnostic.message);
+    try std.testing.expectError(error.UnknownField, check(allocator, "{{range .Query.ids}}{{end}}", &diagnostic));
+    try std.testing.expectEqualStrings("range takes .QueryAll.name and an optional quoted separator in '{{range .Query.ids}}'", diagnostic.message);
+}
+
+test "render helpers" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const allocator = arena.allocator();
+
+    var request = try testRequest(allocator);
+    request.body = "say \"hi\"\n";
+    var env = std.process.EnvMap.init(allocator);
+    try env.put("REGION", "eu-west-1");
+
+    var prng = std.Random.DefaultPrng.init(42);
+    var ctx = Context{ .request = &request, .random = prng.random(), .now_ms = 1_700_000_000_123, .env = &env };
+
+    try std.testing.expectEqualStrings("2023-11-14T22:13:20Z", try render(allocator, "{{now}}", &ctx, null));
+    try std.testing.expectEqualStrings("eu-west-1|", try render(allocator, "{{env \"REGION\"}}|{{ env \"UNSET\" }}", &ctx, null));
+    try std.testing.expectEqualStrings("say \\\"hi\\\"\\n|C:\\\\dir", try render(allocator, "{{jsonEscape .Body}}|{{jsonEscape \"C:\\dir\"}}", &ctx, null));
+
+    const uuid = try render(allocator, "{{uuid}}", &ctx, null);
+    try std.testing.expectEqual(@as(usize, 36), uuid.len);
+    for ([_]usize{ 8, 13, 18, 23 }) |dash| try std.testing.expectEqual(@as(u8, '-'), uuid[dash]);
+    try std.testing.expectEqual(@as(u8, '4'), uuid[14]);
+    try std.testing.expect(std.mem.indexOfScalar(u8, "89ab", uuid[19]) != null);
+
+    for (0..20) |_| {
+        const number = try std.fmt.parseInt(i64, try render(allocator, "{{randInt -2 3}}", &ctx, null), 10);
+        try std.testing.expect(number >= -2 and number < 3);
+    }
+
+    // The same seed renders the same values
+    prng = std.Random.DefaultPrng.init(7);
+    const first = try render(allocator, "{{uuid}} {{randInt 0 1000000}}", &ctx, null);
+    prng = std.Random.DefaultPrng.init(7);
+    try std.testing.expectEqualStrings(first, try render(allocator, "{{uuid}} {{randInt 0 1000000}}", &ctx, null));
+
+    var diagnostic = Diagnostic{};
+    try std.testing.expectError(error.UnknownField, check(allocator, "{{randInt 5 5}}", &diagnostic));
+    try std.testing.expectEqualStrings("randInt needs min below max in '{{randInt 5 5}}'", diagnostic.message);
+    try std.testing.expectError(error.UnknownField, check(allocator, "{{env REGION}}", &diagnostic));
+    try std.testing.expectEqualStrings("env takes a quoted variable name in '{{env REGION}}'", diagnostic.message);
+    try std.testing.expectError(error.UnknownField, check(allocator, "{{uuid 4}}", &diagnostic));
+    try std.testing.expectEqualStrings("uuid takes 0 argument(s) in '{{uuid 4}}'", diagnostic.message);
+}
+
+test "render store and load" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const allocator = arena.allocator();
+
+    var store = KvStore.init(std.testing.allocator);
+    defer store.deinit();
+
+    const request = try testRequest(allocator);
+    var params = std.StringHashMap([]const u8).init(allocator);
+    try params.put("id", "42");
+    const ctx = Context{ .request = &request, .params = &params, .store = &store };
+
+    try std.testing.expectEqualStrings("saved", try render(allocator, "{{store .Params.id .Body}}{{ store \"last\" .Params.id }}saved", &ctx, null));
+    try std.testing.expectEqualStrings("42=hello|", try render(allocator, "{{load \"last\"}}={{load .Params.id}}|{{load \"missing\"}}", &ctx, null));
+
+    // Without a store both helpers are no-ops
+    const bare = Context{ .request = &request };
+    try std.testing.expectEqualStrings("", try render(allocator, "{{store \"last\" \"x\"}}{{load \"last\"}}", &bare, null));
+
+    var diagnostic = Diagnostic{};
+    try std.testing.expectError(error.UnknownField, check(allocator, "{{store \"key\"}}", &diagnostic));
+    try std.testing.expectEqualStrings("store takes 2 argument(s) in '{{store \"key\"}}'", diagnostic.message);
+    try std.testing.expectError(error.UnknownField, check(allocator, "{{load key}}", &diagnostic));
+    try std.testing.expectEqualStrings("load takes a field or a quoted key in '{{load key}}'", diagnostic.message);
+}
+
+test "render reports errors" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const allocator = arena.allocator();
+
+    const request = try testRequest(allocator);
+    const ctx = Context{ .request = &request };
+
+    var diagnostic = Diagnostic{};
+    try std.testing.expectError(error.UnknownField, render(allocator, "{{.Nope}}", &ctx, &diagnostic));
+    try std.testing.expectEqualStrings("unknown field '.Nope'", diagnostic.message);
+
+    try std.testing.expectError(error.UnclosedAction, render(allocator, "ok {{.Body", &ctx, &diagnostic));
+    try std.testing.expectEqualStrings("unclosed action at offset 3", diagnostic.message);
+}
+
+test "check" {
+    var arena = std.heap.ArenaAllocator.init(std.testing.allocator);
+    defer arena.deinit();
+    const allocator = arena.allocator();
+
+    try check(allocator, "{\"id\": \"{{.Params.id}}\", \"q\": \"{{ .Query.q }}\", \"m\": \"{{index .Matches 1}}\"}", null);
+    try check(allocator, "no actions", null);
+
+    var diagnostic = Diagnostic{};
+    try std.testing.expectError(error.UnknownField, check(allocator, "{{.Params}}", &diagnostic));
+    try std.testing.expectEqualStrings("unknown field '.Params'", diagnostic.message);
+
+    try std.testing.expectError(error.UnknownField, check(allocator, "{{index .Matches x}}", &diagnostic));
+    try std.testing.expectEqualStrings("invalid index 'x' in '{{index .Matches x}}'", diagnostic.message);
+
+    try std.testing.expectError(error.UnclosedAction, check(allocator, "{{.Body}} {{.Body", &diagnostic));
+    try std.testing.expectEqualStrings("unclosed action at offset 10", diagnostic.message);
+}
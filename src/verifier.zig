@@ -0,0 +1,272 @@
+const std = @import("std");
+const interfaces = @import("http/interfaces.zig");
+const config = @import("config.zig");
+const recorder = @import("recorder.zig");
+
+const Request = interfaces.Request;
+const Response = interfaces.Response;
+const HeaderMap = interfaces.HeaderMap;
+
+/// Headers expected to change between an upstream's responses, so they
+/// never count as drift. Content-Length is covered by the body check.
+const volatile_headers = [_][]const u8{ "Date", "Age", "Expires", "Content-Length", "Set-Cookie", "X-Request-Id" };
+
+/// Compares proxied responses with the recordings `--record` saved in a
+/// directory, for `--verify`, and logs a JSON diff of each one that has
+/// drifted. Safe to call from several threads.
+pub const Verifier = struct {
+    allocator: std.mem.Allocator,
+    dir_path: []const u8,
+    /// Responses compared so far
+    checked: std.atomic.Value(u64) = std.atomic.Value(u64).init(0),
+    /// Of those, the ones that differed or had no recording
+    drifted: std.atomic.Value(u64) = std.atomic.Value(u64).init(0),
+
+    /// Check that `dir_path`, holding the recordings, can be opened
+    pub fn init(allocator: std.mem.Allocator, dir_path: []const u8) !Verifier {
+        var dir = std.fs.cwd().openDir(dir_path, .{}) catch |err| {
+            std.log.err("Failed to open verify directory {s}: {}", .{ dir_path, err });
+            return err;
+        };
+        dir.close();
+        return Verifier{ .allocator = allocator, .dir_path = try allocator.dupe(u8, dir_path) };
+    }
+
+    pub fn deinit(self: *Verifier) void {
+        self.allocator.free(self.dir_path);
+    }
+
+    /// Compare the upstream `response` to the recording for the request's
+    /// method and path. Returns the diff, allocated in the request arena,
+    /// or null when they agree; a drift is also logged as a warning.
+    pub fn verify(self: *Verifier, request: *const Request, response: *const Response) !?[]const u8 {
+        _ = self.checked.fetchAdd(1, .monotonic);
+        const arena = request.arena;
+
+        const name = try recorder.recordingName(arena, request.method.toString(), request.path);
+        const rule_path = try std.fs.path.join(arena, &.{ self.dir_path, try std.fmt.allocPrint(arena, "{s}.yaml", .{name}) });
+
+        var recorded: ?config.Config = null;
+        defer if (recorded) |*c| c.deinit();
+        if (std.fs.cwd().statFile(rule_path)) |_| {
+            recorded = try config.Config.loadFromFile(self.allocator, rule_path);
+        } else |err| switch (err) {
+            error.FileNotFound => {},
+            else => return err,
+        }
+
+        const mock = if (recorded) |*c| (if (c.rules.items.len > 0) c.rules.items[0].response else null) else null;
+        const recorded_body = if (mock) |m| blk: {
+            const body_file = m.body_file orelse break :blk m.body;
+            break :blk try std.fs.cwd().readFileAlloc(arena, body_file, std.math.maxInt(usize));
+        } else "";
+
+        const diff = try writeDiff(arena, request, if (mock) |*m| m else null, recorded_body, response) orelse return null;
+        _ = self.drifted.fetchAdd(1, .monotonic);
+        std.log.warn("Upstream drifted from the recording for {s} {s}: {s}", .{ request.method.toString(), request.path, diff });
+        return diff;
+    }
+
+    /// One line for the end of a run, e.g. "Verified 12 proxied response(s), 1 drifted"
+    pub fn logSummary(self: *const Verifier) void {
+        std.log.info("Verified {d} proxied response(s), {d} drifted", .{ self.checked.load(.monotonic), self.drifted.load(.monotonic) });
+    }
+};
+
+/// `{"method": ..., "path": ..., ...}` with a key for each part that
+/// differs: `recording` when there is none, else `status`, `headers` and
+/// `body`. Null when nothing does.
+fn writeDiff(arena: std.mem.Allocator, request: *const Request, mock: ?*const config.MockResponse, recorded_body: []const u8, response: *const Response) !?[]const u8 {
+    var out = std.ArrayList(u8).init(arena);
+    var json = std.json.writeStream(out.writer(), .{});
+    try json.beginObject();
+    try json.objectField("method");
+    try json.write(request.method.toString());
+    try json.objectField("path");
+    try json.write(request.path);
+
+    const recorded = mock orelse {
+        try json.objectField("recording");
+        try json.write("missing");
+        try json.endObject();
+        return out.items;
+    };
+    var drifted = false;
+
+    const live_status = @intFromEnum(response.status);
+    if (recorded.status != live_status) {
+        drifted = true;
+        try json.objectField("status");
+        try json.write(.{ .recorded = recorded.status, .live = live_status });
+    }
+
+    var recorded_headers = HeaderMap.init(arena);
+    if (recorded.headers) |headers| {
+        var iter = headers.iterator();
+        while (iter.next()) |entry| try recorded_headers.put(entry.key_ptr.*, entry.value_ptr.*);
+    }
+    var header_drift = false;
+    var names = recorded_headers.keyIterator();
+    while (names.next()) |header_name| {
+        if (isVolatile(header_name.*)) continue;
+        const live = response.getHeader(header_name.*);
+        if (live != null and std.mem.eql(u8, live.?, recorded_headers.get(header_name.*).?)) continue;
+        if (!header_drift) try beginHeaders(&json);
+        header_drift = true;
+        try json.write(.{ .name = header_name.*, .recorded = recorded_headers.get(header_name.*), .live = live });
+    }
+    var live_names = response.headers.keyIterator();
+    while (live_names.next()) |header_name| {
+        if (isVolatile(header_name.*) or recorded_headers.contains(header_name.*)) continue;
+        if (!header_drift) try beginHeaders(&json);
+        header_drift = true;
+        try json.write(.{ .name = header_name.*, .recorded = @as(?[]const u8, null), .live = response.getHeader(header_name.*) });
+    }
+    if (header_drift) try json.endArray();
+    drifted = drifted or header_drift;
+
+    if (!sameBody(arena, recorded_body, response.body)) {
+        drifted = true;
+        const common = @min(recorded_body.len, response.body.len);
+        const first_difference = std.mem.indexOfDiff(u8, recorded_body[0..common], response.body[0..common]) orelse common;
+        try json.objectField("body");
+        try json.write(.{ .recorded_bytes = recorded_body.len, .live_bytes = response.body.len, .first_difference = first_difference });
+    }
+
+    try json.endObject();
+    return if (drifted) out.items else null;
+}
+
+fn beginHeaders(json: anytype) !void {
+    try json.objectField("headers");
+    try json.beginArray();
+}
+
+fn isVolatile(name: []const u8) bool {
+    for (volatile_headers) |header_name| {
+        if (std.ascii.eqlIgnoreCase(name, header_name)) return true;
+    }
+    return false;
+}
+
+/// Byte-for-byte, or as JSON documents when both are JSON, so a change of
+/// key order or whitespace isn't drift
+pub fn sameBody(arena: std.mem.Allocator, recorded: []const u8, live: []const u8) bool {
+    if (std.mem.eql(u8, recorded, live)) return true;
+    const recorded_json = std.json.parseFromSliceLeaky(std.json.Value, arena, recorded, .{}) catch return false;
+    const live_json = std.json.parseFromSliceLeaky(std.json.Value, arena, live, .{}) catch return false;
+    return jsonEqual(recorded_json, live_json);
+}
+
+fn jsonEqual(a: std.json.Value, b: std.json.Value) bool {
+    if (std.meta.activeTag(a) != std.meta.activeTag(b)) return false;
+    return switch (a) {
+        .null => true,
+        .bool => |value| value == b.bool,
+        .integer => |value| value == b.integer,
+        .float => |value| value == b.float,
+        .number_string => |value| std.mem.eql(u8, value, b.number_string),
+        .string => |value| std.mem.eql(u8, value, b.string),
+        .array => |array| {
+            if (array.items.len != b.array.items.len) return false;
+            for (array.items, b.array.items) |item, other| {
+                if (!jsonEqual(item, other)) return false;
+            }
+            return true;
+        },
+        .object => |object| {
+            if (object.count() != b.object.count()) return false;
+            var iter = object.iterator();
+            while (iter.next()) |entry| {
+                const other = b.object.get(entry.key_ptr.*) orelse return false;
+                if (!jsonEqual(entry.value_ptr.*, other)) return false;
+            }
+            return true;
+        },
+    };
+}
+
+fn testRequest(arena: std.mem.Allocator, path: []const u8) Request {
+    return Request{
+        .method = .GET,
+        .path = path,
+        .query = "",
+        .headers = HeaderMap.init(arena),
+        .body = "",
+        .arena = arena,
+    };
+}
+
+test "Verifier accepts a response that matches its recording" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+
+    var response_recorder = try recorder.Recorder.init(allocator, dir_path);
+    defer response_recorder.deinit();
+    const request = testRequest(arena.allocator(), "/api/users");
+    var recorded = Response.init(arena.allocator(), .ok);
+    try recorded.setHeader("Content-Type", "application/json");
+    try recorded.setHeader("Date", "Mon, 01 Jan 2024 00:00:00 GMT");
+    recorded.setBody("{\"id\": 1, \"name\": \"Ada\"}");
+    try response_recorder.record(&request, &recorded);
+
+    var verifier = try Verifier.init(allocator, dir_path);
+    defer verifier.deinit();
+
+    // A new Date, other header case and reordered JSON keys are all the same response
+    var live = Response.init(arena.allocator(), .ok);
+    try live.setHeader("content-type", "application/json");
+    try live.setHeader("Date", "Tue, 02 Jan 2024 00:00:00 GMT");
+    live.setBody("{\"name\":\"Ada\",\"id\":1}");
+    try std.testing.expect(try verifier.verify(&request, &live) == null);
+    try std.testing.expectEqual(@as(u64, 1), verifier.checked.load(.monotonic));
+    try std.testing.expectEqual(@as(u64, 0), verifier.drifted.load(.monotonic));
+}
+
+test "Verifier reports a drifted response" {
+    const allocator = std.testing.allocator;
+    var arena = std.heap.ArenaAllocator.init(allocator);
+    defer arena.deinit();
+
+    var tmp = std.testing.tmpDir(.{});
+    defer tmp.cleanup();
+    const dir_path = try tmp.dir.realpathAlloc(allocator, ".");
+    defer allocator.free(dir_path);
+
+    var response_recorder = try recorder.Recorder.init(allocator, dir_path);
+    defer response_recorder.deinit();
+    const request = testRequest(arena.allocator(), "/api/users");
+    var recorded = Response.init(arena.allocator(), .ok);
+    try recorded.setHeader("Content-Type", "application/json");
+    recorded.setBody("{\"id\": 1}");
+    try response_recorder.record(&request, &recorded);
+
+    var verifier = try Verifier.init(allocator, dir_path);
+    defer verifier.deinit();
+
+    var live = Response.init(arena.allocator(), .created);
+    try live.setHeader("Content-Type", "text/plain");
+    try live.setHeader("X-Version", "2");
+    live.setBody("{\"id\": 2}");
+    const diff = (try verifier.verify(&request, &live)).?;
+
+    const parsed = try std.json.parseFromSliceLeaky(std.json.Value, arena.allocator(), diff, .{});
+    try std.testing.expectEqualStrings("/api/users", parsed.object.get("path").?.string);
+    const status = parsed.object.get("status").?.object;
+    try std.testing.expectEqual(@as(i64, 200), status.get("recorded").?.integer);
+    try std.testing.expectEqual(@as(i64, 201), status.get("live").?.integer);
+    try std.testing.expectEqual(@as(usize, 2), parsed.object.get("headers").?.array.items.len);
+    try std.testing.expectEqual(@as(i64, 7), parsed.object.get("body").?.object.get("first_difference").?.integer);
+
+    // Paths with no recording drift too
+    const unrecorded = testRequest(arena.allocator(), "/api/orders");
+    const missing = (try verifier.verify(&unrecorded, &live)).?;
+    try std.testing.expect(std.mem.indexOf(u8, missing, "\"recording\":\"missing\"") != null);
+    try std.testing.expectEqual(@as(u64, 2), verifier.drifted.load(.monotonic));
+}